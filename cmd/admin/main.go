@@ -0,0 +1,562 @@
+// Command admin runs the operational tasks otherwise done by hand in SQL,
+// through the same repository as the server:
+//
+//	admin sessions [-days 7]
+//	admin show <session-id>
+//	admin close <session-id>
+//	admin grant-cap [-extra 10] [-expires 2024-05-01T00:00:00Z] (-national-id <id> | -session <id>)
+//	admin resummarize <session-id>
+//	admin reassign -national-id <id> -name <name> -phone <phone> <session-id>
+//	admin purge <national-id>
+//	admin denylist
+//	admin block [-reason text] (-national-id <id> | -ip <ip>)
+//	admin unblock <entry-id>
+//
+// The database is given by -database-url and -database-driver before the
+// command, defaulting to DATABASE_URL and DATABASE_DRIVER, and
+// PII_ENCRYPTION_KEY must match the server's.  close, reassign, purge and
+// unblock ask for confirmation unless -yes is given; purge asks for the national ID to
+// be typed again.  Changes are recorded in the audit log with the actor
+// "cli:<user>".
+//
+// resummarize calls the model with the server's summary client settings
+// (LLM_SUMMARY_*, LLM_CHAT_* or OPENAI_*) and adds its cost to the month's
+// spend.  purge also deletes the patient's
+// attachments from the storage configured by STORAGE_BACKEND.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/internal/pii"
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/pkg"
+)
+
+// commands maps the subcommands to their functions, which parse their
+// own flags from args.
+var commands = map[string]func(a *admin, args []string) error{
+	"sessions":    (*admin).sessions,
+	"show":        (*admin).show,
+	"close":       (*admin).close,
+	"grant-cap":   (*admin).grantCap,
+	"resummarize": (*admin).resummarize,
+	"reassign":    (*admin).reassign,
+	"purge":       (*admin).purge,
+	"denylist":    (*admin).denylist,
+	"block":       (*admin).block,
+	"unblock":     (*admin).unblock,
+}
+
+// usages lists the arguments of the commands in the order of the usage
+// message.
+var usages = [][2]string{
+	{"sessions", "[-days 7]"},
+	{"show", "<session-id>"},
+	{"close", "<session-id>"},
+	{"grant-cap", "[-extra 10] [-expires time] (-national-id <id> | -session <id>)"},
+	{"resummarize", "<session-id>"},
+	{"reassign", "-national-id <id> -name <name> -phone <phone> <session-id>"},
+	{"purge", "<national-id>"},
+	{"denylist", ""},
+	{"block", "[-reason text] (-national-id <id> | -ip <ip>)"},
+	{"unblock", "<entry-id>"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: admin [-database-url url] [-database-driver driver] [-yes] <command> [arguments]\n\ncommands:\n")
+	for _, u := range usages {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", u[0], u[1])
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	dbURL := flag.String("database-url", os.Getenv("DATABASE_URL"), "database to work on (default $DATABASE_URL)")
+	driver := flag.String("database-driver", os.Getenv("DATABASE_DRIVER"), "postgres or sqlite (default $DATABASE_DRIVER)")
+	yes := flag.Bool("yes", false, "do not ask for confirmation")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	run, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if *dbURL == "" {
+		log.Fatal("-database-url or DATABASE_URL must be set")
+	}
+	dialect, err := db.ParseDialect(*driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbConn, err := db.Open(dialect, *dbURL)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer dbConn.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx, dbConn, dialect); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	}
+	repo := db.NewRepository(dbConn)
+	repo.Dialect = dialect
+	if key := os.Getenv("PII_ENCRYPTION_KEY"); key != "" {
+		cipher, err := pii.New(key)
+		if err != nil {
+			log.Fatalf("invalid PII_ENCRYPTION_KEY: %v", err)
+		}
+		repo.PII = cipher
+	}
+	a := &admin{
+		ctx:   ctx,
+		repo:  repo,
+		yes:   *yes,
+		in:    bufio.NewReader(os.Stdin),
+		out:   os.Stdout,
+		actor: "cli:" + currentUser(),
+	}
+	if err := run(a, flag.Args()[1:]); err != nil {
+		if errors.Is(err, errAborted) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+}
+
+// currentUser names the operator for the audit log.
+func currentUser() string {
+	for _, v := range []string{"SUDO_USER", "USER", "USERNAME"} {
+		if u := os.Getenv(v); u != "" {
+			return u
+		}
+	}
+	return "unknown"
+}
+
+// errAborted is returned when the operator does not confirm a change.
+var errAborted = errors.New("aborted")
+
+// admin holds what the commands share.
+type admin struct {
+	ctx   context.Context
+	repo  *db.Repository
+	yes   bool
+	in    *bufio.Reader
+	out   io.Writer
+	actor string
+}
+
+// confirm asks the operator to answer yes to question, unless -yes was
+// given, and returns errAborted otherwise.
+func (a *admin) confirm(question string) error {
+	if a.yes {
+		return nil
+	}
+	fmt.Fprintf(a.out, "%s [y/N] ", question)
+	answer, _ := a.in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errAborted
+}
+
+// audit records an action of the operator on a session.
+func (a *admin) audit(action, sessionID string) {
+	err := a.repo.InsertAuditEntries(a.ctx, []pkg.AuditEntry{{
+		Actor:     a.actor,
+		Action:    action,
+		SessionID: sessionID,
+		CreatedAt: time.Now(),
+	}})
+	if err != nil {
+		log.Printf("audit %s: %v", action, err)
+	}
+}
+
+// parse parses the flags of a command and returns its positional
+// arguments, exiting with the command's usage unless there are want.
+func parse(fs *flag.FlagSet, args []string, want int) []string {
+	fs.Parse(args)
+	if fs.NArg() != want {
+		for _, u := range usages {
+			if u[0] == fs.Name() {
+				fmt.Fprintf(os.Stderr, "usage: admin %s %s\n", u[0], u[1])
+			}
+		}
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+// session loads a session, naming it in the error when it does not exist.
+func (a *admin) session(id string) (*pkg.Session, error) {
+	s, err := a.repo.GetSessionByID(a.ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no session %s", id)
+	}
+	return s, err
+}
+
+func (a *admin) sessions(args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	days := fs.Int("days", 7, "list the sessions created in the last `n` days")
+	parse(fs, args, 0)
+	now := time.Now()
+	sessions, err := a.repo.ListSessionsCreatedBetween(a.ctx, now.AddDate(0, 0, -*days), now.Add(time.Minute))
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tCREATED\tSTATUS\tCLINIC\tNATIONAL ID\tNAME")
+	for i := len(sessions) - 1; i >= 0; i-- {
+		s := sessions[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.CreatedAt.Local().Format("2006-01-02 15:04"),
+			s.Status, s.ClinicID, deref(s.PatientID), deref(s.PatientName))
+	}
+	return w.Flush()
+}
+
+func (a *admin) show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	id := parse(fs, args, 1)[0]
+	s, err := a.session(id)
+	if err != nil {
+		return err
+	}
+	a.printSession(s)
+	transcript, err := a.repo.GetSessionRecord(a.ctx, id)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(a.out)
+	for _, m := range transcript {
+		content := m.Content
+		if m.RedactedAt != nil {
+			content = "[redacted by " + m.RedactedBy + "]"
+		}
+		fmt.Fprintf(a.out, "%3d %s %-7s %s\n", m.Seq, m.CreatedAt.Local().Format("15:04"), m.Role, content)
+	}
+	summary, err := a.repo.GetSummary(a.ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintln(a.out, "\nnot summarised yet")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.printSummary(summary)
+	return nil
+}
+
+func (a *admin) printSession(s *pkg.Session) {
+	fmt.Fprintf(a.out, "session     %s\n", s.ID)
+	fmt.Fprintf(a.out, "patient     %s, %s, %s\n", deref(s.PatientName), deref(s.PatientID), deref(s.PatientPhone))
+	fmt.Fprintf(a.out, "clinic      %s\n", s.ClinicID)
+	fmt.Fprintf(a.out, "status      %s\n", s.Status)
+	fmt.Fprintf(a.out, "created     %s\n", s.CreatedAt.Local().Format(time.RFC3339))
+	if s.ClosedAt != nil {
+		fmt.Fprintf(a.out, "closed      %s\n", s.ClosedAt.Local().Format(time.RFC3339))
+	}
+	if s.EscalatedAt != nil {
+		fmt.Fprintf(a.out, "escalated   %s (%s)\n", s.EscalatedAt.Local().Format(time.RFC3339), deref(s.EscalationReason))
+	}
+}
+
+func (a *admin) printSummary(s *pkg.Summary) {
+	fmt.Fprintf(a.out, "\nsummary, priority %d, updated %s\n", s.Priority, s.UpdatedAt.Local().Format(time.RFC3339))
+	for _, p := range s.KeyPoints {
+		fmt.Fprintf(a.out, "  - %s\n", p)
+	}
+	if s.FreeText != "" {
+		fmt.Fprintf(a.out, "\n%s\n", s.FreeText)
+	}
+	if len(s.Questions) > 0 {
+		fmt.Fprintln(a.out, "\nsuggested questions:")
+		for _, q := range s.Questions {
+			fmt.Fprintf(a.out, "  - %s\n", q)
+		}
+	}
+}
+
+func (a *admin) close(args []string) error {
+	fs := flag.NewFlagSet("close", flag.ExitOnError)
+	id := parse(fs, args, 1)[0]
+	s, err := a.session(id)
+	if err != nil {
+		return err
+	}
+	a.printSession(s)
+	if s.ClosedAt != nil {
+		fmt.Fprintln(a.out, "the session is already closed")
+		return nil
+	}
+	if err := a.confirm("Close this session?"); err != nil {
+		return err
+	}
+	closed, err := a.repo.CloseSession(a.ctx, id)
+	if err != nil {
+		return err
+	}
+	if !closed {
+		fmt.Fprintln(a.out, "the session was already closed")
+		return nil
+	}
+	a.audit(audit.ActionCloseSession, id)
+	fmt.Fprintln(a.out, "closed")
+	return nil
+}
+
+func (a *admin) grantCap(args []string) error {
+	fs := flag.NewFlagSet("grant-cap", flag.ExitOnError)
+	nationalID := fs.String("national-id", "", "grant the patient with this national ID")
+	sessionID := fs.String("session", "", "grant this session")
+	extra := fs.Int("extra", 10, "extra messages on top of the cap")
+	expires := fs.String("expires", "", "when the grant ends, RFC 3339 (default: the end of the cap week set by CAP_WEEK)")
+	parse(fs, args, 0)
+	if (*nationalID == "") == (*sessionID == "") {
+		return errors.New("give one of -national-id and -session")
+	}
+	if *extra < 1 {
+		return errors.New("-extra must be at least 1")
+	}
+	now := time.Now()
+	o := pkg.CapOverride{NationalID: *nationalID, SessionID: *sessionID, ExtraMessages: *extra, GrantedBy: a.actor}
+	if *expires == "" {
+		o.ExpiresAt = core.CapWeek(os.Getenv("CAP_WEEK")).ResetsAt(now)
+	} else {
+		t, err := time.Parse(time.RFC3339, *expires)
+		if err != nil {
+			return fmt.Errorf("invalid -expires: %v", err)
+		}
+		o.ExpiresAt = t
+	}
+	if !o.ExpiresAt.After(now) {
+		return errors.New("-expires must be in the future")
+	}
+	if o.SessionID != "" {
+		if _, err := a.session(o.SessionID); err != nil {
+			return err
+		}
+	}
+	if err := a.repo.CreateCapOverride(a.ctx, &o); err != nil {
+		return err
+	}
+	a.audit(audit.ActionGrantCapOverride, o.SessionID)
+	fmt.Fprintf(a.out, "granted %d extra messages until %s\n", o.ExtraMessages, o.ExpiresAt.Local().Format(time.RFC3339))
+	return nil
+}
+
+func (a *admin) resummarize(args []string) error {
+	fs := flag.NewFlagSet("resummarize", flag.ExitOnError)
+	id := parse(fs, args, 1)[0]
+	s, err := a.session(id)
+	if err != nil {
+		return err
+	}
+	transcript, err := a.repo.GetSessionTranscript(a.ctx, id)
+	if err != nil {
+		return err
+	}
+	prices, err := llm.ParsePrices(os.Getenv("LLM_PRICES"))
+	if err != nil {
+		return fmt.Errorf("invalid LLM_PRICES: %v", err)
+	}
+	_, client, _, err := llm.ClientsFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid LLM configuration: %v", err)
+	}
+	summarizer := core.NewSummarizer(llm.NewMeter(client, a.repo, prices, 0), a.repo)
+	summarizer.Embed = os.Getenv("RECALL_PAST_VISITS") == "true"
+	summary, _, err := summarizer.Refresh(a.ctx, a.prompts(s), id, transcript, true)
+	if err != nil {
+		return err
+	}
+	a.audit(audit.ActionRegenerateSummary, id)
+	a.printSummary(summary)
+	return nil
+}
+
+// prompts resolves the prompts of a session like the server does.
+func (a *admin) prompts(s *pkg.Session) core.Prompts {
+	if s.PromptProfile == nil {
+		return core.LocalePrompts(s.Locale)
+	}
+	profile, err := a.repo.GetPromptProfile(a.ctx, *s.PromptProfile)
+	if err != nil {
+		log.Printf("load prompt profile %q: %v", *s.PromptProfile, err)
+		return core.LocalePrompts(s.Locale)
+	}
+	return core.PromptsFor(profile, s.Locale)
+}
+
+func (a *admin) reassign(args []string) error {
+	fs := flag.NewFlagSet("reassign", flag.ExitOnError)
+	nationalID := fs.String("national-id", "", "the patient's real national ID")
+	name := fs.String("name", "", "the patient's name")
+	phone := fs.String("phone", "", "the patient's phone number")
+	id := parse(fs, args, 1)[0]
+	if *nationalID == "" || *name == "" || *phone == "" {
+		return errors.New("-national-id, -name and -phone are required")
+	}
+	s, err := a.session(id)
+	if err != nil {
+		return err
+	}
+	a.printSession(s)
+	if err := a.confirm(fmt.Sprintf("Move this session to %s, %s, %s?", *name, *nationalID, *phone)); err != nil {
+		return err
+	}
+	// The audit entry is written with the change, old and new identity
+	// hashed.
+	entry := pkg.AuditEntry{Actor: a.actor, Action: audit.ActionReassignSession}
+	if err := a.repo.ReassignSession(a.ctx, id, *nationalID, *name, *phone, entry); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.out, "reassigned")
+	return nil
+}
+
+func (a *admin) purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	nationalID := parse(fs, args, 1)[0]
+	sessions, err := a.repo.ListSessionsByNationalID(a.ctx, nationalID)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return fmt.Errorf("no sessions for national ID %s", nationalID)
+	}
+	for _, s := range sessions {
+		fmt.Fprintf(a.out, "%s  %s  %s  %s\n", s.ID, s.CreatedAt.Local().Format("2006-01-02 15:04"), s.Status, deref(s.PatientName))
+	}
+	if !a.yes {
+		fmt.Fprintf(a.out, "This deletes the %d sessions above with their messages, summaries and attachments.\nType the national ID again to confirm: ", len(sessions))
+		answer, _ := a.in.ReadString('\n')
+		if strings.TrimSpace(answer) != nationalID {
+			return errAborted
+		}
+	}
+	// Resolve the storage before deleting anything so a misconfiguration
+	// does not leave orphaned files behind.
+	store, err := storage.FromEnv()
+	if err != nil {
+		return fmt.Errorf("configure storage: %v", err)
+	}
+	ids, keys, err := a.repo.PurgePatient(a.ctx, nationalID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		a.audit(audit.ActionPurgePatient, id)
+	}
+	failed := 0
+	if store == nil && len(keys) > 0 {
+		log.Printf("STORAGE_BACKEND is none; the files of %d attachments were left in place", len(keys))
+	}
+	if store != nil {
+		for _, key := range keys {
+			if err := store.Delete(a.ctx, key); err != nil {
+				log.Printf("delete attachment %s: %v", key, err)
+				failed++
+			}
+		}
+	}
+	fmt.Fprintf(a.out, "purged %d sessions and %d attachments\n", len(ids), len(keys)-failed)
+	if failed > 0 {
+		return fmt.Errorf("%d attachment files could not be deleted", failed)
+	}
+	return nil
+}
+
+func (a *admin) denylist(args []string) error {
+	fs := flag.NewFlagSet("denylist", flag.ExitOnError)
+	parse(fs, args, 0)
+	entries, err := a.repo.ListDenylist(a.ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tVALUE\tADDED\tBY\tREASON")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Kind, e.Value,
+			e.CreatedAt.Local().Format("2006-01-02 15:04"), e.CreatedBy, e.Reason)
+	}
+	return w.Flush()
+}
+
+func (a *admin) block(args []string) error {
+	fs := flag.NewFlagSet("block", flag.ExitOnError)
+	nationalID := fs.String("national-id", "", "refuse sessions to this national ID")
+	ip := fs.String("ip", "", "refuse sessions from this client IP")
+	reason := fs.String("reason", "", "why, and who a blocked national ID belongs to")
+	parse(fs, args, 0)
+	e := pkg.DenylistEntry{Kind: pkg.DenyNationalID, Value: *nationalID, Reason: *reason, CreatedBy: a.actor}
+	switch {
+	case (*nationalID == "") == (*ip == ""):
+		return errors.New("give one of -national-id and -ip")
+	case *ip != "":
+		parsed := net.ParseIP(*ip)
+		if parsed == nil {
+			return fmt.Errorf("invalid IP %q", *ip)
+		}
+		e.Kind, e.Value = pkg.DenyIP, parsed.String()
+	}
+	if err := a.repo.AddDenylistEntry(a.ctx, &e); err != nil {
+		return err
+	}
+	a.audit(audit.ActionDenylistAdd, "")
+	fmt.Fprintf(a.out, "blocked (entry %d)\n", e.ID)
+	return nil
+}
+
+func (a *admin) unblock(args []string) error {
+	fs := flag.NewFlagSet("unblock", flag.ExitOnError)
+	id, err := strconv.ParseInt(parse(fs, args, 1)[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid entry ID: %v", err)
+	}
+	if err := a.confirm(fmt.Sprintf("Remove denylist entry %d?", id)); err != nil {
+		return err
+	}
+	if err := a.repo.DeleteDenylistEntry(a.ctx, id); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no denylist entry %d", id)
+	} else if err != nil {
+		return err
+	}
+	a.audit(audit.ActionDenylistRemove, "")
+	fmt.Fprintln(a.out, "unblocked")
+	return nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
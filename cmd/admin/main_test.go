@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+// newAdmin returns an admin on a migrated SQLite database of its own,
+// answering its questions with input, and its output.
+func newAdmin(t *testing.T, input string) (*admin, *bytes.Buffer) {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "admin.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.Migrate(ctx, conn, db.SQLite); err != nil {
+		t.Fatal(err)
+	}
+	repo := db.NewRepository(conn)
+	repo.Dialect = db.SQLite
+	var out bytes.Buffer
+	return &admin{
+		ctx:   ctx,
+		repo:  repo,
+		in:    bufio.NewReader(strings.NewReader(input)),
+		out:   &out,
+		actor: "cli:test",
+	}, &out
+}
+
+// startSession starts the session of a patient and returns it.
+func startSession(t *testing.T, a *admin, nationalID, name string) *pkg.Session {
+	t.Helper()
+	u := &pkg.User{NationalID: nationalID, Phone: "09120000000", Name: name}
+	if err := a.repo.UpsertUser(a.ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.repo.GetLatestSession(a.ctx, nationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// audited returns the actions recorded in the audit log for a session.
+func audited(t *testing.T, a *admin, sessionID string) []string {
+	t.Helper()
+	entries, err := a.repo.ListAuditEntries(a.ctx, pkg.AuditFilter{Actor: "cli:test", SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	return actions
+}
+
+func TestSessions(t *testing.T) {
+	a, out := newAdmin(t, "")
+	sara := startSession(t, a, "0012345678", "Sara")
+	reza := startSession(t, a, "0098765432", "Reza")
+	if err := a.sessions(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{sara.ID, "Sara", "0012345678", reza.ID, "Reza"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("sessions list lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestShow(t *testing.T) {
+	a, out := newAdmin(t, "")
+	s := startSession(t, a, "0012345678", "Sara")
+	id := uuid.MustParse(s.ID)
+	for _, m := range []struct {
+		role    pkg.MessageRole
+		content string
+	}{{pkg.RolePatient, "سردرد دارم"}, {pkg.RoleBot, "از کی این درد را دارید؟"}} {
+		if _, err := a.repo.CreateMessage(a.ctx, id, m.role, m.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.show([]string{s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Sara", "سردرد دارم", "از کی این درد را دارید؟", "not summarised yet"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("session lacks %q:\n%s", want, out)
+		}
+	}
+	out.Reset()
+	if err := a.repo.UpsertSummary(a.ctx, &pkg.Summary{SessionID: s.ID, KeyPoints: []string{"سردرد از دو روز پیش"}, FreeText: "بیمار سردرد دارد."}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.show([]string{s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "  - سردرد از دو روز پیش") || !strings.Contains(out.String(), "بیمار سردرد دارد.") {
+		t.Errorf("summary not shown:\n%s", out)
+	}
+	if err := a.show([]string{uuid.NewString()}); err == nil || !strings.HasPrefix(err.Error(), "no session") {
+		t.Errorf("unknown session: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	a, out := newAdmin(t, "n\ny\n")
+	s := startSession(t, a, "0012345678", "Sara")
+	if err := a.close([]string{s.ID}); !errors.Is(err, errAborted) {
+		t.Fatalf("declined close: %v", err)
+	}
+	if s, _ = a.repo.GetSessionByID(a.ctx, s.ID); s.ClosedAt != nil {
+		t.Fatal("session closed without confirmation")
+	}
+	if err := a.close([]string{s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ = a.repo.GetSessionByID(a.ctx, s.ID); s.ClosedAt == nil {
+		t.Fatal("session not closed")
+	}
+	if got := audited(t, a, s.ID); len(got) != 1 || got[0] != audit.ActionCloseSession {
+		t.Errorf("audit log %v, want one close", got)
+	}
+	// Closing it again asks nothing and changes nothing.
+	out.Reset()
+	if err := a.close([]string{s.ID}); err != nil || !strings.Contains(out.String(), "already closed") {
+		t.Errorf("second close: %v\n%s", err, out)
+	}
+}
+
+func TestGrantCap(t *testing.T) {
+	a, _ := newAdmin(t, "")
+	s := startSession(t, a, "0012345678", "Sara")
+	expires := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	if err := a.grantCap([]string{"-national-id", "0012345678", "-extra", "5", "-expires", expires.Format(time.RFC3339)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.grantCap([]string{"-session", s.ID}); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := a.repo.ListActiveCapOverrides(a.ctx, "0012345678", s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := 0
+	for _, o := range overrides {
+		extra += o.ExtraMessages
+		if o.GrantedBy != "cli:test" {
+			t.Errorf("override granted by %q", o.GrantedBy)
+		}
+	}
+	if len(overrides) != 2 || extra != 5+10 {
+		t.Errorf("overrides %+v, want 5 and the default 10 extra messages", overrides)
+	}
+	for _, args := range [][]string{
+		{"-extra", "5"},
+		{"-national-id", "0012345678", "-session", s.ID},
+		{"-national-id", "0012345678", "-extra", "0"},
+		{"-national-id", "0012345678", "-expires", "2001-01-01T00:00:00Z"},
+		{"-national-id", "0012345678", "-expires", "tomorrow"},
+		{"-session", uuid.NewString()},
+	} {
+		if err := a.grantCap(args); err == nil {
+			t.Errorf("grant-cap %q accepted", args)
+		}
+	}
+}
+
+func TestReassign(t *testing.T) {
+	a, _ := newAdmin(t, "no\nyes\n")
+	s := startSession(t, a, "0012345678", "Sara")
+	args := []string{"-national-id", "0098765432", "-name", "Reza", "-phone", "09121112233", s.ID}
+	if err := a.reassign(args); !errors.Is(err, errAborted) {
+		t.Fatalf("declined reassign: %v", err)
+	}
+	if err := a.reassign(args); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.repo.GetSessionByID(a.ctx, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deref(s.PatientID) != "0098765432" || deref(s.PatientName) != "Reza" || deref(s.PatientPhone) != "09121112233" {
+		t.Errorf("session of %s, %s, %s after reassigning", deref(s.PatientID), deref(s.PatientName), deref(s.PatientPhone))
+	}
+	if got := audited(t, a, s.ID); len(got) != 1 || got[0] != audit.ActionReassignSession {
+		t.Errorf("audit log %v, want one reassign", got)
+	}
+	if err := a.reassign([]string{"-national-id", "0098765432", s.ID}); err == nil {
+		t.Error("reassign without name and phone accepted")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORAGE_BACKEND", "local")
+	t.Setenv("STORAGE_DIR", dir)
+	store, err := storage.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, out := newAdmin(t, "0099999999\n0012345678\n")
+	s := startSession(t, a, "0012345678", "Sara")
+	other := startSession(t, a, "0098765432", "Reza")
+	m, err := a.repo.CreateMessage(a.ctx, uuid.MustParse(s.ID), pkg.RolePatient, "عکس آزمایش")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(a.ctx, "scan.jpg", "image/jpeg", []byte("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.repo.CreateAttachment(a.ctx, &pkg.Attachment{SessionID: s.ID, MessageID: m.ID, StorageKey: "scan.jpg", ContentType: "image/jpeg", Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The national ID typed again does not match.
+	if err := a.purge([]string{"0012345678"}); !errors.Is(err, errAborted) {
+		t.Fatalf("purge with the wrong national ID typed: %v", err)
+	}
+	if _, err := a.session(s.ID); err != nil {
+		t.Fatalf("session gone after an aborted purge: %v", err)
+	}
+	out.Reset()
+	if err := a.purge([]string{"0012345678"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "purged 1 sessions and 1 attachments") {
+		t.Errorf("purge output:\n%s", out)
+	}
+	if _, err := a.session(s.ID); err == nil {
+		t.Error("session left after the purge")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "scan.jpg")); !os.IsNotExist(err) {
+		t.Errorf("attachment file left after the purge: %v", err)
+	}
+	if _, err := a.session(other.ID); err != nil {
+		t.Errorf("other patient's session purged: %v", err)
+	}
+	if got := audited(t, a, s.ID); len(got) != 1 || got[0] != audit.ActionPurgePatient {
+		t.Errorf("audit log %v, want the purge kept", got)
+	}
+	if err := a.purge([]string{"0012345678"}); err == nil {
+		t.Error("purging a patient without sessions succeeded")
+	}
+}
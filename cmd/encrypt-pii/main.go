@@ -0,0 +1,50 @@
+// Command encrypt-pii is a one-off migration that encrypts the patient
+// fields of sessions stored before PII_ENCRYPTION_KEY was configured.  Run
+// it once after enabling encryption, with the same DATABASE_URL and key as
+// the server.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/pii"
+)
+
+func main() {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		log.Fatal("DATABASE_URL must be set")
+	}
+	key := os.Getenv("PII_ENCRYPTION_KEY")
+	if key == "" {
+		log.Fatal("PII_ENCRYPTION_KEY must be set")
+	}
+	cipher, err := pii.New(key)
+	if err != nil {
+		log.Fatalf("invalid PII_ENCRYPTION_KEY: %v", err)
+	}
+	dialect, err := db.ParseDialect(os.Getenv("DATABASE_DRIVER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbConn, err := db.Open(dialect, dbURL)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer dbConn.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx, dbConn, dialect); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	}
+	repo := db.NewRepository(dbConn)
+	repo.Dialect = dialect
+	repo.PII = cipher
+	n, err := repo.EncryptExistingPII(ctx)
+	if err != nil {
+		log.Fatalf("encrypted %d sessions before failing: %v", n, err)
+	}
+	log.Printf("encrypted %d sessions", n)
+}
@@ -0,0 +1,296 @@
+// Command export dumps the transcripts and summaries of the sessions created
+// in a date range as JSON lines, anonymised for model evaluation.  Message
+// content and summaries are passed through the redact package with the
+// patient's name, and national IDs are replaced by a keyed hash so the same
+// patient maps to the same token across sessions without the ID being
+// recoverable.  A manifest with counts and the output checksum is written
+// alongside so the export can be checked for completeness.  The bot's
+// messages are prefixed with EXPORT_BOT_MARKER ("[bot]" by default, none
+// when set empty) and each record states what was machine-generated, by
+// which models and when.
+//
+//	EXPORT_PSEUDONYM_KEY=... export -from 2024-01-01 -to 2024-02-01 -out jan.jsonl
+//
+// It uses the same DATABASE_URL, DATABASE_DRIVER and PII_ENCRYPTION_KEY as
+// the server.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/internal/pii"
+	"waitroom-chatbot/internal/redact"
+	"waitroom-chatbot/pkg"
+)
+
+// record is one line of the export: a session with its transcript and
+// summary.
+type record struct {
+	SessionID     string     `json:"session_id"`
+	Patient       string     `json:"patient,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+	Status        string     `json:"status"`
+	PromptProfile string     `json:"prompt_profile,omitempty"`
+	Escalated     bool       `json:"escalated"`
+	Messages      []message  `json:"messages"`
+	Summary       *summary   `json:"summary,omitempty"`
+	// Generation states what in the record was machine-generated.
+	Generation export.Generation `json:"generation"`
+}
+
+type message struct {
+	Role      pkg.MessageRole `json:"role"`
+	Content   string          `json:"content"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type summary struct {
+	KeyPoints  []string               `json:"key_points"`
+	Structured map[string]interface{} `json:"structured"`
+	FreeText   string                 `json:"free_text"`
+	Priority   int                    `json:"priority"`
+	Questions  []string               `json:"suggested_questions,omitempty"`
+	// Model and SchemaVersion are those of pkg.Summary.
+	Model         string `json:"model,omitempty"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// manifest describes a completed export.
+type manifest struct {
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Output      string         `json:"output"`
+	SHA256      string         `json:"sha256"`
+	Sessions    int            `json:"sessions"`
+	Patients    int            `json:"patients"`
+	Summaries   int            `json:"summaries"`
+	Messages    int            `json:"messages"`
+	ByRole      map[string]int `json:"messages_by_role"`
+}
+
+func main() {
+	fromFlag := flag.String("from", "", "first day to export (YYYY-MM-DD, inclusive)")
+	toFlag := flag.String("to", "", "day to stop at (YYYY-MM-DD, exclusive)")
+	out := flag.String("out", "-", `output file, or "-" for standard output`)
+	manifestPath := flag.String("manifest", "", `manifest file (default: the output file with ".manifest.json" appended, or one named after the Jalali date range when writing to standard output)`)
+	flag.Parse()
+
+	from, err := time.Parse("2006-01-02", *fromFlag)
+	if err != nil {
+		log.Fatalf("invalid -from: %v", err)
+	}
+	to, err := time.Parse("2006-01-02", *toFlag)
+	if err != nil {
+		log.Fatalf("invalid -to: %v", err)
+	}
+	if !to.After(from) {
+		log.Fatal("-to must be after -from")
+	}
+	if *manifestPath == "" {
+		*manifestPath = *out + ".manifest.json"
+		if *out == "-" {
+			*manifestPath = exportName(from, to) + ".manifest.json"
+		}
+	}
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		log.Fatal("DATABASE_URL must be set")
+	}
+	// The pseudonym key is separate from PII_ENCRYPTION_KEY so tokens in an
+	// export cannot be matched against the lookup hashes in the database.
+	pseudonymKey := os.Getenv("EXPORT_PSEUDONYM_KEY")
+	if pseudonymKey == "" {
+		log.Fatal("EXPORT_PSEUDONYM_KEY must be set")
+	}
+	dialect, err := db.ParseDialect(os.Getenv("DATABASE_DRIVER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbConn, err := db.Open(dialect, dbURL)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer dbConn.Close()
+	repo := db.NewRepository(dbConn)
+	repo.Dialect = dialect
+	if key := os.Getenv("PII_ENCRYPTION_KEY"); key != "" {
+		cipher, err := pii.New(key)
+		if err != nil {
+			log.Fatalf("invalid PII_ENCRYPTION_KEY: %v", err)
+		}
+		repo.PII = cipher
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	wm := export.Watermark{Marker: export.DefaultMarker}
+	if marker, ok := os.LookupEnv("EXPORT_BOT_MARKER"); ok {
+		wm.Marker = marker
+	}
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(w, hash))
+	m := manifest{From: from, To: to, Output: *out, ByRole: map[string]int{}}
+	if err := exportSessions(context.Background(), repo, buf, []byte(pseudonymKey), wm, &m); err != nil {
+		log.Fatalf("export failed after %d sessions: %v", m.Sessions, err)
+	}
+	if err := buf.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	m.GeneratedAt, m.SHA256 = time.Now().UTC(), hex.EncodeToString(hash.Sum(nil))
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*manifestPath, append(data, '\n'), 0o600); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("exported %d sessions (%d patients, %d messages, %d summaries); manifest in %s",
+		m.Sessions, m.Patients, m.Messages, m.Summaries, *manifestPath)
+}
+
+// exportSessions writes one record per session created in the manifest's
+// range, with the bot's messages marked by wm, counting what it writes
+// into m.  Each record is written as soon as it is built, so memory use
+// does not grow with the export.
+func exportSessions(ctx context.Context, repo *db.Repository, w io.Writer, key []byte, wm export.Watermark, m *manifest) error {
+	sessions, err := repo.ListSessionsCreatedBetween(ctx, m.From, m.To)
+	if err != nil {
+		return err
+	}
+	patients := map[string]bool{}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, s := range sessions {
+		r := redact.New(deref(s.PatientName))
+		rec := record{
+			SessionID:     s.ID,
+			Patient:       pseudonym(key, deref(s.PatientID)),
+			CreatedAt:     s.CreatedAt,
+			ClosedAt:      s.ClosedAt,
+			Status:        string(s.Status),
+			PromptProfile: deref(s.PromptProfile),
+			Escalated:     s.EscalatedAt != nil,
+			Messages:      []message{},
+		}
+		transcript, err := repo.GetSessionTranscript(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		meta, err := repo.GetSessionMetadata(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		for _, msg := range transcript {
+			rec.Messages = append(rec.Messages, message{msg.Role, wm.Content(msg.Role, r.Redact(msg.Content)), msg.CreatedAt})
+			m.ByRole[string(msg.Role)]++
+		}
+		sum, err := repo.GetSummary(ctx, s.ID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return err
+		default:
+			rec.Summary = redactSummary(r, sum)
+			m.Summaries++
+		}
+		rec.Generation = wm.Describe(transcript, meta, sum, time.Now())
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		if rec.Patient != "" && !patients[rec.Patient] {
+			patients[rec.Patient] = true
+			m.Patients++
+		}
+		m.Sessions++
+		m.Messages += len(rec.Messages)
+	}
+	return nil
+}
+
+// pseudonym returns the stable token for a national ID: a truncated
+// HMAC-SHA256 under the export key, or "" when the ID is unknown.
+func pseudonym(key []byte, nationalID string) string {
+	if nationalID == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nationalID))
+	return "p_" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// redactSummary returns the exported form of a summary with every string
+// in it redacted.
+func redactSummary(r *redact.Redactor, s *pkg.Summary) *summary {
+	out := &summary{FreeText: r.Redact(s.FreeText), Priority: s.Priority, KeyPoints: []string{},
+		Model: s.Model, SchemaVersion: s.SchemaVersion}
+	for _, p := range s.KeyPoints {
+		out.KeyPoints = append(out.KeyPoints, r.Redact(p))
+	}
+	for _, q := range s.Questions {
+		out.Questions = append(out.Questions, r.Redact(q))
+	}
+	out.Structured, _ = redactValue(r, s.Structured).(map[string]interface{})
+	return out
+}
+
+// redactValue redacts the strings in a decoded JSON value.
+func redactValue(r *redact.Redactor, v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.Redact(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redactValue(r, e)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = redactValue(r, e)
+		}
+		return out
+	}
+	return v
+}
+
+// exportName names an export of [from, to) after its Jalali dates, e.g.
+// "export-1403-01-01_1403-02-01", the calendar the clinic's staff use.
+func exportName(from, to time.Time) string {
+	name := func(t time.Time) string {
+		return strings.ReplaceAll(jalali.FromTime(t).String(), "/", "-")
+	}
+	return "export-" + name(from) + "_" + name(to)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+func TestExportName(t *testing.T) {
+	from := time.Date(2024, time.March, 20, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, time.April, 20, 0, 0, 0, 0, time.UTC)
+	if got, want := exportName(from, to), "export-1403-01-01_1403-02-01"; got != want {
+		t.Errorf("exportName = %q, want %q", got, want)
+	}
+}
+
+func TestExportSessions(t *testing.T) {
+	conn, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx, conn, db.SQLite); err != nil {
+		t.Fatal(err)
+	}
+	repo := db.NewRepository(conn)
+	repo.Dialect = db.SQLite
+	u := &pkg.User{NationalID: "0012345678", Phone: "09120000000", Name: "Sara"}
+	if err := repo.UpsertUser(ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	session, err := repo.GetLatestSession(ctx, u.NationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.MustParse(session.ID)
+	if _, err := repo.CreateMessage(ctx, id, pkg.RolePatient, "سردرد دارم"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := repo.CreateMessage(ctx, id, pkg.RoleBot, "از کی این درد را دارید؟")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetMessageMeta(ctx, reply.ID, pkg.MetaModel, "gpt-main"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.UpsertSummary(ctx, &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, FreeText: "سردرد",
+		Model: "gpt-summary", SchemaVersion: core.SummarySchemaVersion}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	m := manifest{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour), ByRole: map[string]int{}}
+	if err := exportSessions(ctx, repo, &out, []byte("key"), export.Watermark{Marker: "[ربات]"}, &m); err != nil {
+		t.Fatal(err)
+	}
+	var rec record
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatalf("%s: %v", out.String(), err)
+	}
+	if len(rec.Messages) != 2 || rec.Messages[0].Content != "سردرد دارم" || rec.Messages[1].Content != "[ربات] از کی این درد را دارید؟" {
+		t.Errorf("messages %+v, want the bot's marked", rec.Messages)
+	}
+	g := rec.Generation
+	if g.Marker != "[ربات]" || g.Disclaimer != export.Disclaimer || len(g.ReplyModels) != 1 || g.ReplyModels[0] != "gpt-main" ||
+		g.SummaryModel != "gpt-summary" || g.SummarySchemaVersion != core.SummarySchemaVersion || g.ExportedAt.IsZero() {
+		t.Errorf("generation %+v", g)
+	}
+	if rec.Summary == nil || rec.Summary.Model != "gpt-summary" || rec.Summary.SchemaVersion != core.SummarySchemaVersion {
+		t.Errorf("summary %+v, want its model and schema version", rec.Summary)
+	}
+	for _, field := range []string{`"generation":{"disclaimer":`, `"schema_version":1`} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("record %s: missing %s", out.String(), field)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Command replay replays recorded conversations against the chat prompt
+// and reports, per conversation, the replies that broke an expectation:
+// Persian only, one question at a time, within the reply length limit, a
+// red flag raised and the intake wrapped up exactly where expected.
+//
+//	go run ./cmd/replay [-real] [-dir fixtures] [-fixture name] [-v]
+//
+// The conversations are the fixtures built into internal/core unless -dir
+// names a directory of JSON fixtures (see core.Fixture).  By default the
+// model is not called: each turn's recorded reply stands in for its answer,
+// which exercises the checks and post-processing the server applies.  With
+// -real the model is called with the server's chat client settings
+// (LLM_CHAT_*, LLM_SUMMARY_* or OPENAI_*), for a manual run after changing
+// the prompt; its replies vary between runs.
+// SINGLE_QUESTION, MAX_REPLY_CHARS, SIMPLE_LANGUAGE and COMPLETION_TOPICS
+// apply as in the server.  It exits with status 1 when a reply failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/llm"
+)
+
+func main() {
+	live := flag.Bool("real", false, "call the model instead of replaying the recorded replies")
+	dir := flag.String("dir", "", "directory of JSON fixtures; the built-in ones by default")
+	only := flag.String("fixture", "", "replay only the fixture with this name")
+	verbose := flag.Bool("v", false, "print every reply, not only the failing ones")
+	flag.Parse()
+
+	var fsys fs.FS = core.ReplayFixtures
+	path := "fixtures"
+	if *dir != "" {
+		fsys, path = os.DirFS(*dir), "."
+	}
+	fixtures, err := core.LoadFixtures(fsys, path)
+	if err != nil {
+		log.Fatalf("load fixtures: %v", err)
+	}
+
+	chat := core.NewChatService(llm.NewFakeClient(""))
+	if *live {
+		client, _, _, err := llm.ClientsFromEnv()
+		if err != nil {
+			log.Fatalf("invalid LLM configuration: %v", err)
+		}
+		chat.LLM = client
+	}
+	chat.CompletionTopics = core.ParseTopics(os.Getenv("COMPLETION_TOPICS"))
+	singleQuestion, ok := core.ParseSingleQuestionMode(os.Getenv("SINGLE_QUESTION"))
+	if !ok {
+		log.Fatalf("invalid SINGLE_QUESTION %q", os.Getenv("SINGLE_QUESTION"))
+	}
+	chat.SingleQuestion = singleQuestion
+	chat.MaxReplyChars, _ = strconv.Atoi(os.Getenv("MAX_REPLY_CHARS"))
+	chat.SimpleLanguage = os.Getenv("SIMPLE_LANGUAGE") == "true"
+
+	failed, replayed := 0, 0
+	for _, f := range fixtures {
+		if *only != "" && f.Name != *only {
+			continue
+		}
+		replayed++
+		report := chat.Replay(context.Background(), core.DefaultPrompts(), f, !*live)
+		status := "ok  "
+		if report.Failed() {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%s  %s (%d of %d turns)\n", status, f.Name, len(report.Turns), len(f.Turns))
+		for i, t := range report.Turns {
+			if !*verbose && len(t.Failures) == 0 {
+				continue
+			}
+			fmt.Printf("      %d. patient: %s\n", i+1, t.Patient)
+			fmt.Printf("         bot:     %s\n", strings.ReplaceAll(t.Reply, "\n", " / "))
+			for _, failure := range t.Failures {
+				fmt.Printf("         - %s\n", failure)
+			}
+		}
+	}
+	if replayed == 0 {
+		log.Fatalf("no fixture to replay")
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d conversations failed\n", failed, replayed)
+		os.Exit(1)
+	}
+}
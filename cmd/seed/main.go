@@ -0,0 +1,225 @@
+// Command seed fills an empty database with a handful of made-up Persian
+// sessions for demos: a fresh one, one mid-intake, one that hit the message
+// cap, one closed with a summary and one with a red flag, so the doctor
+// dashboard and the chat page have something to show.
+//
+//	go run ./cmd/seed
+//
+// It uses the same DATABASE_URL, DATABASE_DRIVER, PII_ENCRYPTION_KEY and
+// MESSAGE_CAP as the server and refuses to touch a database that already
+// has sessions unless -force is given.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/pii"
+	"waitroom-chatbot/pkg"
+)
+
+// exchange is a patient message and the bot's reply.
+type exchange struct{ patient, bot string }
+
+// intake is a complete, unremarkable intake conversation.
+var intake = []exchange{
+	{"سلام، از دیروز گلودرد دارم و کمی تب کردم.", "سلام، ممنون که توضیح دادید. تب را اندازه گرفته‌اید؟ چند درجه بود؟"},
+	{"دیشب ۳۸ و نیم بود.", "متوجه شدم. شدت گلودرد از ۰ تا ۱۰ چند است؟"},
+	{"حدود ۵", "از چه زمانی این علائم شروع شده؟"},
+	{"دو روز", "دارویی مصرف می‌کنید یا برای این علائم چیزی خورده‌اید؟"},
+	{"فقط استامینوفن ۵۰۰ هر ۸ ساعت.", "به دارویی حساسیت دارید؟"},
+	{"به پنی‌سیلین حساسیت دارم.", "ممنون. سرفه، آبریزش بینی یا مشکل در بلع هم دارید؟"},
+	{"بلع کمی دردناک است ولی سرفه ندارم.", core.ClosingMessage},
+}
+
+// redFlag is an intake that mentions chest pain and shortness of breath.
+var redFlag = []exchange{
+	{"سلام، از صبح درد سینه دارم که به دست چپم می‌زند.", "سلام، ممنون که گفتید. تنگی نفس یا تعریق هم دارید؟"},
+	{"بله کمی تنگی نفس دارم و عرق سرد کردم.", "شدت درد از ۰ تا ۱۰ چند است؟"},
+	{"۸", "از چه ساعتی شروع شده؟"},
+	{"حدود سه ساعت است.", "لطفاً همین حالا به کارکنان پذیرش اطلاع دهید. داروی خاصی مصرف می‌کنید؟"},
+}
+
+// capFiller is repeated to bring a patient to the message cap.
+var capFiller = []exchange{
+	{"کمرم درد می‌کند.", "درد کمر از چه زمانی شروع شده؟"},
+	{"فکر کنم سه هفته است.", "درد به پا هم می‌زند؟"},
+	{"گاهی تا زانو می‌رسد.", "شدت درد از ۰ تا ۱۰ چند است؟"},
+	{"شاید ۶", "چیز دیگری هم هست که بخواهید بگویید؟"},
+	{"یک سؤال دیگر هم داشتم.", "بفرمایید."},
+}
+
+// demoSession describes one seeded patient.
+type demoSession struct {
+	user      pkg.User
+	exchanges []exchange
+	status    pkg.SessionStatus
+	summary   *pkg.Summary
+	closed    bool
+}
+
+func main() {
+	force := flag.Bool("force", false, "seed even if the database already has sessions")
+	flag.Parse()
+
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		log.Fatal("DATABASE_URL must be set")
+	}
+	messageCap := 50
+	if capStr := os.Getenv("MESSAGE_CAP"); capStr != "" {
+		n, err := strconv.Atoi(capStr)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid MESSAGE_CAP %q", capStr)
+		}
+		messageCap = n
+	}
+	dialect, err := db.ParseDialect(os.Getenv("DATABASE_DRIVER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbConn, err := db.Open(dialect, dbURL)
+	if err != nil {
+		log.Fatalf("failed to open database: %v", err)
+	}
+	defer dbConn.Close()
+	ctx := context.Background()
+	if err := db.Migrate(ctx, dbConn, dialect); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	}
+	repo := db.NewRepository(dbConn)
+	repo.Dialect = dialect
+	if key := os.Getenv("PII_ENCRYPTION_KEY"); key != "" {
+		cipher, err := pii.New(key)
+		if err != nil {
+			log.Fatalf("invalid PII_ENCRYPTION_KEY: %v", err)
+		}
+		repo.PII = cipher
+	}
+
+	n, err := repo.CountSessions(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n > 0 && !*force {
+		log.Fatalf("database already has %d sessions; refusing to seed demo data (use -force to seed anyway)", n)
+	}
+	for _, d := range demoSessions(messageCap) {
+		if err := seed(ctx, repo, d, messageCap); err != nil {
+			log.Fatalf("seed %s: %v", d.user.Name, err)
+		}
+		log.Printf("seeded %s (%d messages)", d.user.Name, 2*len(d.exchanges))
+	}
+}
+
+// demoSessions returns the sessions to seed.  National IDs and phone
+// numbers are made up.
+func demoSessions(messageCap int) []demoSession {
+	var capped []exchange
+	for i := 0; i < messageCap-1; i++ {
+		capped = append(capped, capFiller[i%len(capFiller)])
+	}
+	capped = append(capped, exchange{"باز هم درد دارم.", core.CapMessage})
+
+	return []demoSession{
+		{
+			user:   pkg.User{NationalID: "0010000001", Phone: "09120000001", Name: "سارا احمدی"},
+			status: pkg.StatusOpen,
+		},
+		{
+			user:      pkg.User{NationalID: "0010000002", Phone: "09120000002", Name: "رضا کریمی"},
+			exchanges: intake[:3],
+			status:    pkg.StatusOpen,
+		},
+		{
+			user:      pkg.User{NationalID: "0010000003", Phone: "09120000003", Name: "مریم حسینی"},
+			exchanges: capped,
+			status:    pkg.StatusOpen,
+		},
+		{
+			user:      pkg.User{NationalID: "0010000004", Phone: "09120000004", Name: "علی محمدی"},
+			exchanges: intake,
+			status:    pkg.StatusReadyForDoctor,
+			closed:    true,
+			summary: &pkg.Summary{
+				KeyPoints: []string{"گلودرد و تب از دو روز پیش", "تب ۳۸٫۵ درجه", "حساسیت به پنی‌سیلین", "مصرف استامینوفن"},
+				Structured: map[string]interface{}{
+					"chief_complaint": "گلودرد و تب",
+					"pain_score":      5,
+					"duration":        map[string]interface{}{"value": 2, "unit": pkg.UnitDay},
+					"medications":     []interface{}{map[string]interface{}{"name": "استامینوفن", "dose": "۵۰۰", "frequency": "هر ۸ ساعت"}},
+					"allergies":       []interface{}{"پنی‌سیلین"},
+				},
+				FreeText:      "بیمار از دو روز پیش گلودرد با شدت ۵ از ۱۰ و تب تا ۳۸٫۵ درجه دارد. بلع دردناک است و سرفه ندارد. استامینوفن ۵۰۰ هر ۸ ساعت مصرف می‌کند و به پنی‌سیلین حساسیت دارد.",
+				Questions:     []string{"آیا اطرافیان هم علائم مشابه دارند؟", "آیا تورم یا درد در گردن دارید؟"},
+				SchemaVersion: core.SummarySchemaVersion,
+			},
+		},
+		{
+			user:      pkg.User{NationalID: "0010000005", Phone: "09120000005", Name: "حسن رضایی"},
+			exchanges: redFlag,
+			status:    pkg.StatusOpen,
+			summary: &pkg.Summary{
+				KeyPoints: []string{"درد سینه انتشاری به دست چپ", "تنگی نفس و تعریق سرد", "شروع از سه ساعت پیش", "شدت درد ۸ از ۱۰"},
+				Structured: map[string]interface{}{
+					"chief_complaint": "درد قفسه سینه",
+					"pain_score":      8,
+					"red_flags":       []interface{}{"درد سینه", "تنگی نفس"},
+				},
+				FreeText:      "بیمار از سه ساعت پیش درد سینه با انتشار به دست چپ، تنگی نفس و تعریق سرد دارد. شدت درد ۸ از ۱۰ است. نیاز به بررسی فوری.",
+				SchemaVersion: core.SummarySchemaVersion,
+			},
+		},
+	}
+}
+
+// seed creates one demo session with the given message cap through the
+// repository, as the server would.
+func seed(ctx context.Context, repo *db.Repository, d demoSession, messageCap int) error {
+	if err := repo.UpsertUser(ctx, &d.user, "", "", "", messageCap); err != nil {
+		return err
+	}
+	session, err := repo.ResolveActiveSession(ctx, d.user.NationalID)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(session.ID)
+	if err != nil {
+		return err
+	}
+	for _, e := range d.exchanges {
+		if _, _, err := repo.CreateMessagePair(ctx, id, nil, e.patient, e.bot); err != nil {
+			return err
+		}
+	}
+	if err := repo.UpdateSessionStatus(ctx, session.ID, d.status); err != nil {
+		return err
+	}
+	if d.summary != nil {
+		transcript, err := repo.GetSessionTranscript(ctx, session.ID)
+		if err != nil {
+			return err
+		}
+		d.summary.SessionID = session.ID
+		d.summary.TranscriptHash = core.TranscriptHash(transcript)
+		core.ExtractVitals(d.summary, transcript)
+		d.summary.Priority = int(core.ScorePriority(d.summary, transcript))
+		if err := repo.UpsertSummary(ctx, d.summary); err != nil {
+			return fmt.Errorf("summary: %w", err)
+		}
+	}
+	if d.closed {
+		if _, err := repo.CloseSession(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,21 +3,39 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/config"
 	"waitroom-chatbot/internal/core"
 	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/digest"
+	"waitroom-chatbot/internal/export"
 	httpserver "waitroom-chatbot/internal/http"
 	"waitroom-chatbot/internal/llm"
-
-	_ "github.com/lib/pq"
+	"waitroom-chatbot/internal/metrics"
+	"waitroom-chatbot/internal/outbox"
+	"waitroom-chatbot/internal/pii"
+	"waitroom-chatbot/internal/sms"
+	"waitroom-chatbot/internal/status"
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/internal/webhook"
+	"waitroom-chatbot/pkg/cursor"
 )
 
 func main() {
+	check := flag.Bool("check", false, "validate the templates, prompts and model names, then exit")
+	flag.Parse()
 	// Load environment variables
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -31,36 +49,496 @@ func main() {
 			messageCap = v
 		}
 	}
-	// Open database connection
-	dbConn, err := sql.Open("postgres", dbURL)
+	// The cap applies per calendar week unless CAP_SCOPE=session
+	capScope := os.Getenv("CAP_SCOPE")
+	switch capScope {
+	case "":
+		capScope = httpserver.CapPerWeek
+	case httpserver.CapPerWeek, httpserver.CapPerSession:
+	default:
+		log.Fatalf("invalid CAP_SCOPE %q: want %s or %s", capScope, httpserver.CapPerWeek, httpserver.CapPerSession)
+	}
+	// A per-week cap counts the ISO week unless CAP_WEEK=jalali
+	capWeek := os.Getenv("CAP_WEEK")
+	switch capWeek {
+	case "":
+		capWeek = httpserver.CapWeekISO
+	case httpserver.CapWeekISO, httpserver.CapWeekJalali:
+	default:
+		log.Fatalf("invalid CAP_WEEK %q: want %s or %s", capWeek, httpserver.CapWeekISO, httpserver.CapWeekJalali)
+	}
+	// Open database connection (Postgres unless DATABASE_DRIVER=sqlite)
+	dialect, err := db.ParseDialect(os.Getenv("DATABASE_DRIVER"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Time every query for /metrics and log the slow ones, unless disabled
+	reg := metrics.NewRegistry()
+	open := db.Open
+	if os.Getenv("QUERY_METRICS") != "false" {
+		queries := reg.NewHistogramVec("db_query_duration_seconds", "Duration of database queries by Repository method.", "query",
+			[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+		queries.Init(db.QueryNames()...)
+		in := &db.Instrumentation{
+			Observe: func(name string, d time.Duration) { queries.Observe(name, d.Seconds()) },
+			Slow:    envDuration("SLOW_QUERY_THRESHOLD", 500*time.Millisecond),
+		}
+		open = func(dialect db.Dialect, dsn string) (*sql.DB, error) { return db.OpenInstrumented(dialect, dsn, in) }
+	}
+	dbConn, err := open(dialect, dbURL)
 	if err != nil {
 		log.Fatalf("failed to open database: %v", err)
 	}
+	// Size the connection pool (see db.PoolConfig for the defaults)
+	pool := poolConfig()
+	pool.Apply(dbConn)
+	registerPoolMetrics(reg, dbConn)
 	// Verify connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := dbConn.PingContext(ctx); err != nil {
 		log.Fatalf("failed to ping database: %v", err)
 	}
-	if err := db.Migrate(context.Background(), dbConn); err != nil {
+	if err := db.Migrate(context.Background(), dbConn, dialect); err != nil {
 		log.Fatalf("failed to run migrations: %v", err)
 	}
+	// Open the pool's connections before the first requests need them
+	warmCtx, warmCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := pool.WarmUp(warmCtx, dbConn); err != nil {
+		log.Fatalf("failed to warm up database connections: %v", err)
+	}
+	warmCancel()
 	repo := db.NewRepository(dbConn)
-	// Initialize OpenAI LLM client (uses env: OPENAI_API_KEY, OPENAI_MODEL_CHAT)
-	llmClient := llm.NewOpenAIClient()
+	repo.Dialect = dialect
+	// Encrypt patient PII at rest when a key is configured
+	if key := os.Getenv("PII_ENCRYPTION_KEY"); key != "" {
+		cipher, err := pii.New(key)
+		if err != nil {
+			log.Fatalf("invalid PII_ENCRYPTION_KEY: %v", err)
+		}
+		repo.PII = cipher
+	}
+	// Warn doctors of summaries the patient has written past
+	repo.StaleSummaryAfter = envDuration("SUMMARY_STALE_AFTER", 10*time.Minute)
+	// Keep the transcripts of recently active sessions in memory
+	if n := envInt("TRANSCRIPT_CACHE_SIZE", 0); n > 0 {
+		repo.Transcripts = db.NewTranscriptCache(n, envDuration("TRANSCRIPT_CACHE_TTL", 5*time.Minute))
+	}
+	// Initialize the LLM clients of the chat and of summaries (see
+	// llm.ClientsFromEnv), each behind a circuit breaker so an outage fails fast
+	// instead of piling up requests waiting for timeouts.
+	chatClient, summaryClient, openaiClient, err := llm.ClientsFromEnv()
+	if err != nil {
+		log.Fatalf("invalid LLM configuration:\n%v", err)
+	}
+	fallbacks := reg.NewCounter("llm_chat_fallback_total", "Number of chat calls answered by the fallback model.")
+	chatClient.OnFallback = fallbacks.Inc
+	summaryClient.OnFallback = fallbacks.Inc
+	// Opt-in log of every LLM request and response, with national IDs,
+	// phone numbers and patient names masked
+	var debugFile *llm.RotatingFile
+	if path := os.Getenv("LLM_DEBUG_LOG"); path != "" {
+		debugFile, err = llm.OpenRotatingFile(path, int64(envInt("LLM_DEBUG_LOG_MAX_MB", 10))<<20, 3)
+		if err != nil {
+			log.Fatalf("failed to open LLM_DEBUG_LOG: %v", err)
+		}
+		defer debugFile.Close()
+		log.Printf("logging redacted LLM requests to %s", path)
+	}
+	// Opt-in record of the model calls of sessions flagged for tracing,
+	// masked like the debug log, for doctors to debug a summary against
+	// the transcript
+	tracing := os.Getenv("LLM_TRACE") == "true"
+	// Track the health of the LLM provider and the database for the
+	// public status page and /metrics
+	tracker := status.NewTracker()
+	observe := func(c llm.Client) llm.Client {
+		if debugFile != nil {
+			c = llm.NewDebugLog(c, debugFile)
+		}
+		if tracing {
+			c = llm.NewTracer(c, repo)
+		}
+		return llm.NewReporter(c,
+			func(err error) { tracker.Record(status.Chat, err) },
+			func(err error) { tracker.Record(status.Summaries, err) })
+	}
+	go tracker.PingEvery(context.Background(), dbConn, envDuration("STATUS_PING_INTERVAL", 30*time.Second))
+	reg.NewGaugeVecFunc("service_status", "Health of the services patients depend on (0 green, 1 yellow, 2 red).", "component", func() map[string]float64 {
+		levels := make(map[string]float64)
+		for _, c := range tracker.Snapshot() {
+			levels[c.Name] = float64(c.Level)
+		}
+		return levels
+	})
+	circuitOpened := reg.NewCounter("llm_circuit_opened_total", "Number of times the LLM circuit breaker opened.")
+	newBreaker := func(c llm.Client) *llm.Breaker {
+		b := llm.NewBreaker(observe(c),
+			envInt("LLM_BREAKER_FAILURES", 5),
+			envDuration("LLM_BREAKER_WINDOW", time.Minute),
+			envDuration("LLM_BREAKER_COOLDOWN", 30*time.Second))
+		b.OnOpen = circuitOpened.Inc
+		return b
+	}
+	breaker := newBreaker(chatClient)
+	reg.NewGaugeFunc("llm_circuit_state", "LLM circuit breaker state (0 closed, 1 half-open, 2 open).", func() float64 {
+		return float64(breaker.State())
+	})
+	tracker.Watch(status.Chat, func() bool { return breaker.State() == llm.BreakerOpen })
+	// Summaries of a provider of their own get a breaker of their own, so
+	// either provider failing leaves the other's calls alone
+	var routed llm.Client = breaker
+	if summaryClient != chatClient {
+		summaryBreaker := newBreaker(summaryClient)
+		reg.NewGaugeFunc("llm_summary_circuit_state", "Summary LLM circuit breaker state (0 closed, 1 half-open, 2 open).", func() float64 {
+			return float64(summaryBreaker.State())
+		})
+		tracker.Watch(status.Summaries, func() bool { return summaryBreaker.State() == llm.BreakerOpen })
+		routed = llm.Roles{ForChat: breaker, ForSummary: summaryBreaker}
+	}
+	// Estimate LLM spend per calendar month from the price table (defaults
+	// overridable with LLM_PRICES) and stop calling the model once
+	// LLM_MONTHLY_BUDGET dollars are spent
+	prices, err := llm.ParsePrices(os.Getenv("LLM_PRICES"))
+	if err != nil {
+		log.Fatalf("invalid LLM_PRICES: %v", err)
+	}
+	budget, _ := strconv.ParseFloat(os.Getenv("LLM_MONTHLY_BUDGET"), 64)
+	// Cap concurrent LLM calls so a waiting-room rush stays within the
+	// provider's rate limits; calls queue briefly and then fail as busy
+	limiter := llm.NewLimiter(routed, envInt("LLM_MAX_CONCURRENCY", 4), envDuration("LLM_MAX_WAIT", 10*time.Second))
+	reg.NewGaugeFunc("llm_in_flight", "LLM calls in progress.", func() float64 {
+		return float64(limiter.InFlight())
+	})
+	reg.NewGaugeFunc("llm_queued", "LLM calls waiting for a free slot.", func() float64 {
+		return float64(limiter.Queued())
+	})
+	meter := llm.NewMeter(limiter, repo, prices, budget)
+	reg.NewGaugeFunc("llm_month_cost_usd", "Estimated LLM spend in the current calendar month, in US dollars.", func() float64 {
+		return meter.Status().Cost
+	})
+	go meter.Run(context.Background())
+	var llmClient llm.Client = meter
 	chatService := core.NewChatService(llmClient)
+	// Optional subset of intake topics required before the bot wraps up
+	chatService.CompletionTopics = core.ParseTopics(os.Getenv("COMPLETION_TOPICS"))
+	// Screen patient messages with the moderation endpoint when enabled
+	chatService.Moderation = os.Getenv("MODERATION_ENABLED") == "true"
+	// Keep replies asking several questions at once to the first one
+	singleQuestion, ok := core.ParseSingleQuestionMode(os.Getenv("SINGLE_QUESTION"))
+	if !ok {
+		log.Fatalf("invalid SINGLE_QUESTION %q: want off, %s or %s", os.Getenv("SINGLE_QUESTION"), core.SingleQuestionTruncate, core.SingleQuestionReprompt)
+	}
+	chatService.SingleQuestion = singleQuestion
+	// Bound the chat context to the patient's last turns and a token budget
+	chatService.ContextTurns = envInt("CONTEXT_MAX_TURNS", 20)
+	chatService.ContextTokens = envInt("CONTEXT_MAX_TOKENS", 4000)
+	// Keep replies short enough to read on a phone, and optionally in very
+	// plain wording; prompt profiles override both per clinic
+	chatService.MaxReplyChars = envInt("MAX_REPLY_CHARS", 0)
+	if chatService.MaxReplyChars != 0 && chatService.MaxReplyChars < core.MinReplyChars {
+		log.Fatalf("invalid MAX_REPLY_CHARS %d: want 0 or at least %d", chatService.MaxReplyChars, core.MinReplyChars)
+	}
+	chatService.SimpleLanguage = os.Getenv("SIMPLE_LANGUAGE") == "true"
+	summarizer := core.NewSummarizer(llmClient, repo)
+	// Per-call model parameters; unset variables keep the defaults
+	chatService.Options = llmOptions("LLM_CHAT_TEMPERATURE")
+	summarizer.Options = llmOptions("LLM_SUMMARY_TEMPERATURE")
+	// Remind the bot of a returning patient's relevant past visits
+	recallPastVisits := os.Getenv("RECALL_PAST_VISITS") == "true"
+	summarizer.Embed = recallPastVisits
+	// Webhooks (e.g. the EHR) are notified of summary updates through the
+	// events outbox below; the dispatcher delivers them in the background
+	dispatcher := webhook.NewDispatcher(repo)
+	meter.OnExceeded = func(ctx context.Context, status llm.CostStatus) {
+		if err := dispatcher.BudgetExceeded(ctx, status.Month, status.Cost, status.Budget); err != nil {
+			log.Printf("queue budget webhook: %v", err)
+		}
+	}
+	go dispatcher.Run(context.Background())
 	// Create HTTP server
-	srv, err := httpserver.NewServer(repo, chatService, messageCap)
+	srv, err := httpserver.NewServer(repo, chatService, summarizer, messageCap)
 	if err != nil {
 		log.Fatalf("failed to construct server: %v", err)
 	}
+	// Fail before binding the port on a broken template, prompt or model
+	// name rather than on a patient's request
+	checks := []error{srv.SelfCheck(context.Background())}
+	if openaiClient != nil {
+		checks = append(checks, openaiClient.CheckModels())
+	}
+	if err := errors.Join(checks...); err != nil {
+		log.Fatalf("self-check failed:\n%v", err)
+	}
+	if *check {
+		log.Printf("self-check passed")
+		return
+	}
+	srv.AdminToken = os.Getenv("ADMIN_TOKEN")
+	srv.APIKey = os.Getenv("SUMMARIES_API_KEY")
+	srv.Watermark = export.Watermark{Marker: export.DefaultMarker}
+	if marker, ok := os.LookupEnv("EXPORT_BOT_MARKER"); ok {
+		srv.Watermark.Marker = marker
+	}
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		srv.Cursors = cursor.New([]byte(secret))
+	}
+	srv.Metrics = reg
+	srv.Status = tracker
+	srv.Meter = meter
+	if recallPastVisits {
+		srv.Recall = core.NewRecall(llmClient, repo)
+	}
+	srv.DoctorUsers = parseUsers(os.Getenv("DOCTOR_USERS"))
+	// The doctor pages show patient data, so they need logins unless
+	// explicitly opened for development
+	srv.OpenDoctorRoutes = os.Getenv("DOCTOR_AUTH_DISABLED") == "true"
+	switch {
+	case len(srv.DoctorUsers) == 0 && !srv.OpenDoctorRoutes:
+		log.Fatal("DOCTOR_USERS must be set (or DOCTOR_AUTH_DISABLED=true for local development)")
+	case len(srv.DoctorUsers) == 0:
+		log.Printf("warning: DOCTOR_AUTH_DISABLED is set; the /doctor pages are open to anyone")
+	}
+	srv.DoctorClinics = parseUsers(os.Getenv("DOCTOR_CLINICS"))
+	// The doctors sessions are assigned to follow the logins
+	doctors := make(map[string]string, len(srv.DoctorUsers))
+	for name := range srv.DoctorUsers {
+		doctors[name] = srv.DoctorClinics[name]
+	}
+	if err := repo.SyncDoctors(context.Background(), doctors); err != nil {
+		log.Fatalf("failed to sync doctors: %v", err)
+	}
+	srv.RoundRobin = os.Getenv("DOCTOR_ASSIGNMENT") == "round_robin"
+	srv.CapScope = capScope
+	srv.CapWeek = capWeek
+	srv.AsyncReplies = os.Getenv("ASYNC_REPLIES") == "true"
+	srv.CoalesceWindow = envDuration("COALESCE_WINDOW", 0)
+	srv.DisableCompression = os.Getenv("DISABLE_COMPRESSION") == "true"
+	srv.PageTimeout = envDuration("PAGE_TIMEOUT", 15*time.Second)
+	srv.PostTimeout = envDuration("POST_TIMEOUT", 90*time.Second)
+	srv.SlowReply = envDuration("SLOW_REPLY_THRESHOLD", 20*time.Second)
+	// The patient cookie lasts while the chat is in use, up to a cap after
+	// which the start form must be filled in again
+	if secret := os.Getenv("COOKIE_SECRET"); secret != "" {
+		srv.CookieKey = []byte(secret)
+	} else {
+		log.Printf("warning: COOKIE_SECRET is not set; patients must fill in the start form again after a restart")
+	}
+	srv.CookieMaxAge = envDuration("PATIENT_COOKIE_MAX_AGE", 30*24*time.Hour)
+	srv.CookieAbsoluteMaxAge = envDuration("PATIENT_COOKIE_ABSOLUTE_MAX_AGE", 90*24*time.Hour)
+	if srv.CookieAbsoluteMaxAge < srv.CookieMaxAge {
+		log.Fatalf("PATIENT_COOKIE_ABSOLUTE_MAX_AGE (%s) must not be shorter than PATIENT_COOKIE_MAX_AGE (%s)", srv.CookieAbsoluteMaxAge, srv.CookieMaxAge)
+	}
+	if srv.TrustedProxies, err = httpserver.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	// Protections against fake registrations on /start; the denylist is
+	// managed with cmd/admin
+	srv.StartLimit = envInt("START_LIMIT_PER_IP", 0)
+	srv.CheckNationalID = os.Getenv("NATIONAL_ID_CHECKSUM") == "true"
+	// Verify the patient's phone with a texted code when an SMS provider
+	// is configured
+	if srv.SMS, err = sms.FromEnv(); err != nil {
+		log.Fatalf("failed to configure SMS: %v", err)
+	}
+	srv.OTPPerPhone = envInt("OTP_LIMIT_PER_PHONE", 3)
+	srv.OTPPerIP = envInt("OTP_LIMIT_PER_IP", 10)
+	srv.Tracing = tracing
+	srv.TraceRedFlags = tracing && os.Getenv("LLM_TRACE_RED_FLAGS") == "true"
+	auditLog := audit.NewLogger(repo, envInt("AUDIT_QUEUE_SIZE", 1024))
+	defer auditLog.Close()
+	srv.Audit = auditLog
+	// Storage for patient uploads (prescription photos)
+	store, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("failed to configure storage: %v", err)
+	}
+	srv.Storage = store
+	// Weekly digest of closed sessions for the clinic, when a sink is set
+	sink, err := newDigestSink()
+	if err != nil {
+		log.Fatalf("failed to configure digest: %v", err)
+	}
+	if sink != nil {
+		job := digest.NewJob(repo, sink, os.Getenv("PUBLIC_BASE_URL"))
+		job.Hour = envInt("DIGEST_HOUR", 8)
+		go job.Run(context.Background())
+		srv.Digest = job
+	}
+	channel := os.Getenv("POSTGRES_NOTIFY_CHANNEL")
+	if channel == "" {
+		channel = "summary_updates"
+	}
+	srv.Events = db.NewBroker(dialect, dbConn, channel)
+	// Publish the events recorded with summary updates to the dashboard
+	// and to webhooks
+	events := outbox.NewDispatcher(repo, srv.Events)
+	events.Handle = dispatcher.Publish
+	go events.Run(context.Background())
+	// Close sessions left idle for INACTIVITY_CLOSE_HOURS (0 disables)
+	if hours := envInt("INACTIVITY_CLOSE_HOURS", 6); hours > 0 {
+		go srv.RunSweeper(context.Background(), time.Duration(hours)*time.Hour)
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	addr := ":" + port
-	log.Printf("Listening on %s", addr)
-	if err := http.ListenAndServe(addr, srv); err != nil {
-		log.Fatalf("server error: %v", err)
+	servers := []*http.Server{{Addr: ":" + port, Handler: srv}}
+	// The admin routes get a listener of their own on ADMIN_PORT, so they
+	// can be kept off the patient-facing network
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		if adminPort == port {
+			log.Fatalf("ADMIN_PORT must differ from PORT (both %s)", port)
+		}
+		srv.SeparateAdmin = true
+		servers = append(servers, &http.Server{Addr: ":" + adminPort, Handler: srv.AdminHandler()})
+	}
+	serve(servers, envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+}
+
+// serve runs the HTTP servers until one fails or the process is asked to
+// stop, then shuts them all down, giving requests in flight up to timeout
+// to finish.
+func serve(servers []*http.Server, timeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		s := s
+		log.Printf("Listening on %s", s.Addr)
+		go func() {
+			if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("%s: %w", s.Addr, err)
+			}
+		}()
+	}
+	var failed error
+	select {
+	case failed = <-errs:
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shut down %s: %v", s.Addr, err)
+		}
+	}
+	if failed != nil {
+		log.Fatalf("server error: %v", failed)
+	}
+}
+
+// newDigestSink configures the weekly digest delivery from DIGEST_SINK:
+// "smtp" emails it, "webhook" POSTs it as JSON, and empty disables it.
+func newDigestSink() (digest.Sink, error) {
+	switch sink := os.Getenv("DIGEST_SINK"); sink {
+	case "":
+		return nil, nil
+	case "smtp":
+		s := &digest.SMTPSink{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("DIGEST_FROM"),
+		}
+		for _, to := range strings.Split(os.Getenv("DIGEST_TO"), ",") {
+			if to = strings.TrimSpace(to); to != "" {
+				s.To = append(s.To, to)
+			}
+		}
+		if s.Addr == "" || s.From == "" || len(s.To) == 0 {
+			return nil, errors.New("SMTP_ADDR, DIGEST_FROM and DIGEST_TO are required for the smtp sink")
+		}
+		return s, nil
+	case "webhook":
+		url := os.Getenv("DIGEST_WEBHOOK_URL")
+		if url == "" {
+			return nil, errors.New("DIGEST_WEBHOOK_URL is required for the webhook sink")
+		}
+		return &digest.WebhookSink{URL: url}, nil
+	default:
+		return nil, fmt.Errorf("unknown DIGEST_SINK %q", sink)
+	}
+}
+
+// poolConfig reads the settings of the database connection pool.
+func poolConfig() db.PoolConfig {
+	return db.PoolConfig{
+		MaxOpenConns:    envInt("DB_MAX_OPEN_CONNS", config.DBMaxOpenConns),
+		MaxIdleConns:    envInt("DB_MAX_IDLE_CONNS", config.DBMaxIdleConns),
+		ConnMaxLifetime: envDuration("DB_CONN_MAX_LIFETIME", config.DBConnMaxLifetime),
+		WarmUpConns:     envInt("DB_WARMUP_CONNS", config.DBWarmUpConns),
+	}
+}
+
+// registerPoolMetrics reports the stats of the connection pool of conn on
+// /metrics.
+func registerPoolMetrics(reg *metrics.Registry, conn *sql.DB) {
+	reg.NewGaugeVecFunc("db_connections", "Connections of the database pool by state.", "state", func() map[string]float64 {
+		st := conn.Stats()
+		return map[string]float64{"in_use": float64(st.InUse), "idle": float64(st.Idle)}
+	})
+	reg.NewGaugeFunc("db_max_open_connections", "Cap on the open connections of the database pool (0 for none).", func() float64 {
+		return float64(conn.Stats().MaxOpenConnections)
+	})
+	reg.NewGaugeFunc("db_connection_waits", "Number of times a query waited for a free database connection since startup.", func() float64 {
+		return float64(conn.Stats().WaitCount)
+	})
+	reg.NewGaugeFunc("db_connection_wait_seconds", "Total time spent waiting for free database connections since startup.", func() float64 {
+		return conn.Stats().WaitDuration.Seconds()
+	})
+	reg.NewGaugeVecFunc("db_connections_closed", "Database connections closed since startup, by the setting that closed them.", "reason", func() map[string]float64 {
+		st := conn.Stats()
+		return map[string]float64{
+			"max_idle":      float64(st.MaxIdleClosed),
+			"max_idle_time": float64(st.MaxIdleTimeClosed),
+			"max_lifetime":  float64(st.MaxLifetimeClosed),
+		}
+	})
+}
+
+// envInt reads an integer environment variable, returning def when it is
+// unset or invalid.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// llmOptions builds model options from the named temperature variable and
+// LLM_MAX_OUTPUT_TOKENS.
+func llmOptions(temperatureVar string) []llm.Option {
+	var opts []llm.Option
+	if t, err := strconv.ParseFloat(os.Getenv(temperatureVar), 32); err == nil {
+		opts = append(opts, llm.WithTemperature(float32(t)))
+	}
+	if n := envInt("LLM_MAX_OUTPUT_TOKENS", 0); n > 0 {
+		opts = append(opts, llm.WithMaxTokens(n))
+	}
+	return opts
+}
+
+// envDuration reads a duration environment variable such as "30s",
+// returning def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// parseUsers parses "name:value" pairs separated by commas, such as doctor
+// passwords or clinics.
+func parseUsers(s string) map[string]string {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		name, pass, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && name != "" {
+			users[name] = pass
+		}
 	}
+	return users
 }
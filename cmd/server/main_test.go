@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/config"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/internal/metrics"
+)
+
+func TestLLMOptions(t *testing.T) {
+	t.Setenv("LLM_CHAT_TEMPERATURE", "0.5")
+	t.Setenv("LLM_SUMMARY_TEMPERATURE", "warm")
+	t.Setenv("LLM_MAX_OUTPUT_TOKENS", "400")
+	if o := llm.NewOptions(llmOptions("LLM_CHAT_TEMPERATURE")...); o.Temperature != 0.5 || o.MaxTokens != 400 {
+		t.Errorf("chat options %+v", o)
+	}
+	// An invalid temperature keeps the default.
+	if o := llm.NewOptions(llmOptions("LLM_SUMMARY_TEMPERATURE")...); o.Temperature != llm.DefaultTemperature || o.MaxTokens != 400 {
+		t.Errorf("summary options %+v", o)
+	}
+	t.Setenv("LLM_MAX_OUTPUT_TOKENS", "")
+	if opts := llmOptions("LLM_SUMMARY_TEMPERATURE"); len(opts) != 0 {
+		t.Errorf("%d options without settings, want none", len(opts))
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	if got := poolConfig(); got != config.DefaultPool() {
+		t.Errorf("without settings %+v, want the defaults", got)
+	}
+	t.Setenv("DB_MAX_OPEN_CONNS", "50")
+	t.Setenv("DB_MAX_IDLE_CONNS", "20")
+	t.Setenv("DB_CONN_MAX_LIFETIME", "5m")
+	t.Setenv("DB_WARMUP_CONNS", "lots")
+	want := db.PoolConfig{MaxOpenConns: 50, MaxIdleConns: 20, ConnMaxLifetime: 5 * time.Minute, WarmUpConns: config.DBWarmUpConns}
+	if got := poolConfig(); got != want {
+		t.Errorf("pool %+v, want %+v", got, want)
+	}
+}
+
+func TestPoolMetrics(t *testing.T) {
+	conn, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pool := db.PoolConfig{MaxOpenConns: 4, MaxIdleConns: 2, WarmUpConns: 2}
+	pool.Apply(conn)
+	if err := pool.WarmUp(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+	reg := metrics.NewRegistry()
+	registerPoolMetrics(reg, conn)
+	var out bytes.Buffer
+	reg.Write(&out)
+	for _, want := range []string{
+		`db_connections{state="idle"} 2`,
+		`db_connections{state="in_use"} 0`,
+		`db_max_open_connections 4`,
+		`db_connection_waits 0`,
+		`db_connection_wait_seconds 0`,
+		`db_connections_closed{reason="max_lifetime"} 0`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("metrics %s: missing %q", out.String(), want)
+		}
+	}
+}
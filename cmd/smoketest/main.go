@@ -0,0 +1,394 @@
+// Command smoketest walks a deployed server through a patient's and a
+// doctor's path and reports whether each step worked:
+//
+//	go run ./cmd/smoketest -url https://clinic.example -doctor-user dr -doctor-password ...
+//
+// It checks GET /healthz and /readyz, registers a test patient with a
+// reserved national ID, opens the chat page, sends a message and waits for
+// the bot's reply (the canned one of a fake LLM or a real one alike),
+// checks the message shows on the reloaded chat page, finds the session
+// through the doctor's search and checks the dashboard lists it, and reads
+// /admin/stats.  Last, even when a step failed, it deletes the test
+// patient's sessions through POST /admin/patients/purge.  Credentials
+// default to the DOCTOR_USER, DOCTOR_PASSWORD and ADMIN_TOKEN environment
+// variables.
+//
+// Without an admin token the stats and the deletion are skipped and the
+// test patient's sessions stay in the database.  It exits with status 1
+// when a step fails.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Test patient registered by every run.  No real national ID is all zeros,
+// but the default fails the server's checksum with NATIONAL_ID_CHECKSUM set;
+// -national-id then gives a valid one reserved for the test.
+const (
+	testNationalID = "0000000000"
+	testName       = "بیمار آزمایشی (smoketest)"
+	testPhone      = "09000000000"
+)
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "base URL of the server")
+	doctorUser := flag.String("doctor-user", os.Getenv("DOCTOR_USER"), "doctor username, one of DOCTOR_USERS on the server")
+	doctorPassword := flag.String("doctor-password", os.Getenv("DOCTOR_PASSWORD"), "doctor password")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "admin token; the stats and deleting the test patient are skipped without one")
+	timeout := flag.Duration("timeout", 2*time.Minute, "how long to wait for the bot's reply")
+	nationalID := flag.String("national-id", testNationalID, "national ID of the test patient")
+	flag.Parse()
+
+	jar, _ := cookiejar.New(nil)
+	t := &smokeTest{
+		base:           strings.TrimSuffix(*base, "/"),
+		patient:        &http.Client{Jar: jar, Timeout: 30 * time.Second},
+		staff:          &http.Client{Timeout: 30 * time.Second},
+		doctorUser:     *doctorUser,
+		doctorPassword: *doctorPassword,
+		adminToken:     *adminToken,
+		replyTimeout:   *timeout,
+		nationalID:     *nationalID,
+		marker:         "smoketest-" + randomHex(4),
+	}
+	// Steps marked always run after a failed one, to clean up.
+	steps := []struct {
+		name   string
+		run    func() error
+		always bool
+	}{
+		{"health", t.health, false},
+		{"readiness", t.ready, false},
+		{"start page", t.startPage, false},
+		{"register patient", t.register, false},
+		{"send message", t.sendMessage, false},
+		{"transcript renders", t.transcript, false},
+		{"doctor search", t.search, false},
+		{"dashboard lists session", t.dashboard, false},
+		{"session page", t.sessionPage, false},
+		{"admin stats", t.adminStats, false},
+		{"delete test patient", t.purge, true},
+	}
+	failed := false
+	for _, step := range steps {
+		if failed && !step.always {
+			fmt.Printf("SKIP  %s\n", step.name)
+			continue
+		}
+		start := time.Now()
+		err := step.run()
+		d := time.Since(start).Round(time.Millisecond)
+		var reason skipped
+		switch {
+		case errors.As(err, &reason):
+			fmt.Printf("SKIP  %s: %s\n", step.name, reason)
+		case err != nil:
+			fmt.Printf("FAIL  %s (%s): %v\n", step.name, d, err)
+			failed = true
+		default:
+			fmt.Printf("ok    %s (%s)\n", step.name, d)
+		}
+	}
+	if failed {
+		fmt.Printf("smoke test of %s failed\n", t.base)
+		os.Exit(1)
+	}
+	fmt.Printf("smoke test of %s passed (session %s)\n", t.base, t.sessionID)
+}
+
+// skipped is returned by a step that does not apply, saying why.
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+// smokeTest holds the state passed from one step to the next.
+type smokeTest struct {
+	base string
+	// patient keeps the patient's cookie; staff sends credentials
+	// explicitly.
+	patient, staff *http.Client
+
+	doctorUser, doctorPassword string
+	adminToken                 string
+	replyTimeout               time.Duration
+	nationalID                 string
+
+	// marker makes the message of this run findable by the search.
+	marker    string
+	message   string
+	sessionID string
+	// messages is the path the chat page posts the patient's messages to.
+	messages string
+}
+
+func (t *smokeTest) health() error {
+	_, err := t.get(t.staff, "/healthz", nil)
+	return err
+}
+
+func (t *smokeTest) ready() error {
+	_, err := t.get(t.staff, "/readyz", nil)
+	return err
+}
+
+func (t *smokeTest) startPage() error {
+	body, err := t.get(t.patient, "/", nil)
+	if err != nil {
+		return err
+	}
+	return expect(body, `name="national_id"`)
+}
+
+func (t *smokeTest) register() error {
+	form := url.Values{"national_id": {t.nationalID}, "name": {testName}, "phone": {testPhone}}
+	resp, err := t.patient.PostForm(t.base+"/start", form)
+	if err != nil {
+		return err
+	}
+	body, err := read(resp)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(body, `name="code"`) {
+		return errors.New("the server verifies phone numbers by SMS (SMS_PROVIDER), which the smoke test cannot receive")
+	}
+	// The client follows the redirect to the chat page.
+	if resp.Request.URL.Path != "/chat" {
+		return fmt.Errorf("redirected to %s, want the chat page", resp.Request.URL.Path)
+	}
+	if err := expect(body, `id="chatForm"`); err != nil {
+		return err
+	}
+	m := messagesPath.FindStringSubmatch(body)
+	if m == nil {
+		return errors.New("the chat page has no session to post to")
+	}
+	t.messages = m[1]
+	return nil
+}
+
+// messagesPath finds the path the chat page posts messages to.
+var messagesPath = regexp.MustCompile(`hx-post="(/api/sessions/[0-9a-f-]{36}/messages)"`)
+
+func (t *smokeTest) sendMessage() error {
+	t.message = "پیام آزمایشی پس از استقرار، لطفاً نادیده بگیرید " + t.marker
+	content, _ := json.Marshal(map[string]string{"content": t.message})
+	req, err := http.NewRequest(http.MethodPost, t.base+t.messages, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.patient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := read(resp)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), t.replyTimeout)
+	defer cancel()
+	// With ASYNC_REPLIES the server answers with a placeholder polling
+	// for the reply.
+	for {
+		switch {
+		case strings.Contains(body, `class="msg bot error"`):
+			return fmt.Errorf("the reply failed: %s", body)
+		case strings.Contains(body, `class="msg bot pending"`):
+			m := pendingSrc.FindStringSubmatch(body)
+			if m == nil {
+				return fmt.Errorf("pending reply without a source: %s", body)
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("no reply after %s", t.replyTimeout)
+			case <-time.After(2 * time.Second):
+			}
+			if body, err = t.get(t.patient, m[1], nil); err != nil {
+				return err
+			}
+		case strings.Contains(body, `class="msg bot"`):
+			return nil
+		default:
+			return fmt.Errorf("unexpected reply: %s", body)
+		}
+	}
+}
+
+// pendingSrc finds the URL a pending reply is polled at.
+var pendingSrc = regexp.MustCompile(`hx-get="([^"]+)"`)
+
+func (t *smokeTest) transcript() error {
+	body, err := t.get(t.patient, "/chat", nil)
+	if err != nil {
+		return err
+	}
+	return expect(body, t.marker)
+}
+
+// sessionLink finds a session ID in the doctor's search results.
+var sessionLink = regexp.MustCompile(`href="/doctor/sessions/([0-9a-f-]{36})"`)
+
+func (t *smokeTest) search() error {
+	q := url.Values{"q": {t.marker}, "national_id": {t.nationalID}}
+	body, err := t.get(t.staff, "/doctor/search?"+q.Encode(), t.doctorAuth)
+	if err != nil {
+		return err
+	}
+	m := sessionLink.FindStringSubmatch(body)
+	if m == nil {
+		return fmt.Errorf("the message was not found")
+	}
+	t.sessionID = m[1]
+	return nil
+}
+
+// nextPage finds the path of the dashboard's "load more" sentinel.
+var nextPage = regexp.MustCompile(`hx-get="(/doctor/sessions\?cursor=[^"]+)"`)
+
+// dashboard pages through the dashboard until the session shows, since a
+// busy clinic lists more sessions before the test one than a page holds.
+func (t *smokeTest) dashboard() error {
+	path := "/doctor"
+	for pages := 1; ; pages++ {
+		body, err := t.get(t.staff, path, t.doctorAuth)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(body, "/doctor/sessions/"+t.sessionID) {
+			return nil
+		}
+		m := nextPage.FindStringSubmatch(body)
+		if m == nil {
+			return fmt.Errorf("the session is on none of the %d pages", pages)
+		}
+		path = html.UnescapeString(m[1])
+	}
+}
+
+func (t *smokeTest) sessionPage() error {
+	body, err := t.get(t.staff, "/doctor/sessions/"+t.sessionID, t.doctorAuth)
+	if err != nil {
+		return err
+	}
+	return expect(body, t.marker)
+}
+
+func (t *smokeTest) adminStats() error {
+	if t.adminToken == "" {
+		return skipped("no admin token")
+	}
+	body, err := t.get(t.staff, "/admin/stats", t.adminAuth)
+	if err != nil {
+		return err
+	}
+	return expect(body, "{")
+}
+
+// purge deletes the test patient's sessions.  A patient without sessions,
+// as when registering failed, has nothing to delete.
+func (t *smokeTest) purge() error {
+	if t.adminToken == "" {
+		return skipped("no admin token; the test patient stays in the database")
+	}
+	body, _ := json.Marshal(map[string]string{"national_id": t.nationalID})
+	req, err := http.NewRequest(http.MethodPost, t.base+"/admin/patients/purge", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	t.adminAuth(req)
+	resp, err := t.staff.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	_, err = read(resp)
+	return err
+}
+
+// adminAuth adds the admin token to req.
+func (t *smokeTest) adminAuth(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+t.adminToken)
+}
+
+// doctorAuth adds the doctor's credentials, when given, to req.
+func (t *smokeTest) doctorAuth(req *http.Request) {
+	if t.doctorUser != "" {
+		req.SetBasicAuth(t.doctorUser, t.doctorPassword)
+	}
+}
+
+// get fetches path, letting prepare add headers, and returns the body of a
+// 200 response.
+func (t *smokeTest) get(c *http.Client, path string, prepare func(*http.Request)) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, t.base+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	return read(resp)
+}
+
+// maxReported bounds how much of an unexpected body the report shows.
+const maxReported = 300
+
+// read returns the body of resp, or an error with its status and the
+// start of the body when the status is not 200.
+func read(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	body := string(b)
+	if resp.StatusCode != http.StatusOK {
+		if len(body) > maxReported {
+			body = body[:maxReported] + "…"
+		}
+		return "", fmt.Errorf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// expect reports an error unless body contains want.
+func expect(body, want string) error {
+	if !strings.Contains(body, want) {
+		return fmt.Errorf("response does not contain %q", want)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,115 @@
+// Package audit records who accessed which patient data.  Entries are
+// queued and written in batches by a background goroutine so auditing does
+// not add a database round trip to the request path; when the queue is full
+// entries are written synchronously instead of being dropped.
+package audit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionViewDashboard     = "dashboard.view"
+	ActionViewSession       = "session.view"
+	ActionSearch            = "messages.search"
+	ActionRegenerateSummary = "summary.regenerate"
+	ActionMarkReviewed      = "session.reviewed"
+	ActionGrantCapOverride  = "cap_override.grant"
+	ActionReassignSession   = "session.reassign"
+	ActionAssignSession     = "session.assign"
+	ActionCloseSession      = "session.close"
+	ActionPurgePatient      = "patient.purge"
+	ActionDenylistAdd       = "denylist.add"
+	ActionDenylistRemove    = "denylist.remove"
+	ActionRedactMessage     = "message.redact"
+	ActionTraceOn           = "session.trace_on"
+	ActionTraceOff          = "session.trace_off"
+	ActionViewTraces        = "session.traces_view"
+	ActionExport            = "export"
+	ActionListSummaries     = "summaries.list"
+	// Start forms refused by the protections against fake registrations,
+	// attributed to "ip:<client IP>".
+	ActionStartInvalidID   = "start.invalid_national_id"
+	ActionStartDenied      = "start.denied"
+	ActionStartRateLimited = "start.rate_limited"
+)
+
+// Store persists audit entries.
+type Store interface {
+	InsertAuditEntries(ctx context.Context, entries []pkg.AuditEntry) error
+}
+
+// Logger buffers audit entries and flushes them to a Store.
+type Logger struct {
+	store   Store
+	queue   chan pkg.AuditEntry
+	done    chan struct{}
+	closeMu sync.Once
+}
+
+// maxBatch bounds the number of entries written in one insert.
+const maxBatch = 100
+
+// NewLogger starts a Logger with a queue of the given capacity.
+func NewLogger(store Store, capacity int) *Logger {
+	l := &Logger{
+		store: store,
+		queue: make(chan pkg.AuditEntry, capacity),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues an entry.  If the queue is full it is written synchronously
+// so no access goes unrecorded.
+func (l *Logger) Record(ctx context.Context, e pkg.AuditEntry) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	select {
+	case l.queue <- e:
+	default:
+		if err := l.store.InsertAuditEntries(ctx, []pkg.AuditEntry{e}); err != nil {
+			log.Printf("audit: synchronous write failed: %v", err)
+		}
+	}
+}
+
+// Close flushes queued entries and stops the background writer.
+func (l *Logger) Close() {
+	l.closeMu.Do(func() {
+		close(l.queue)
+		<-l.done
+	})
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for e := range l.queue {
+		batch := []pkg.AuditEntry{e}
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case next, ok := <-l.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := l.store.InsertAuditEntries(ctx, batch); err != nil {
+			log.Printf("audit: failed to write %d entries: %v", len(batch), err)
+		}
+		cancel()
+	}
+}
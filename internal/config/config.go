@@ -0,0 +1,32 @@
+// Package config holds the defaults of the settings the server reads from
+// the environment, documented in one place so operators can tell what an
+// unset variable means.
+package config
+
+import (
+	"time"
+
+	"waitroom-chatbot/internal/db"
+)
+
+// Defaults of the database connection pool (DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_WARMUP_CONNS; see
+// db.PoolConfig).  database/sql keeps only two idle connections by default,
+// so a burst of requests opens most of its connections cold; ten stay warm
+// instead.  No connections are warmed up at startup unless asked.
+const (
+	DBMaxOpenConns    = 25
+	DBMaxIdleConns    = 10
+	DBConnMaxLifetime = 30 * time.Minute
+	DBWarmUpConns     = 0
+)
+
+// DefaultPool returns the default settings of the database connection pool.
+func DefaultPool() db.PoolConfig {
+	return db.PoolConfig{
+		MaxOpenConns:    DBMaxOpenConns,
+		MaxIdleConns:    DBMaxIdleConns,
+		ConnMaxLifetime: DBConnMaxLifetime,
+		WarmUpConns:     DBWarmUpConns,
+	}
+}
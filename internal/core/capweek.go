@@ -0,0 +1,35 @@
+package core
+
+import (
+	"time"
+
+	"waitroom-chatbot/internal/jalali"
+)
+
+// CapWeek is the week a per-week message cap counts.
+type CapWeek string
+
+const (
+	// CapWeekISO starts on Monday at midnight UTC.
+	CapWeekISO CapWeek = "iso"
+	// CapWeekJalali is the Persian week, starting on Saturday at midnight
+	// in Tehran.
+	CapWeekJalali CapWeek = "jalali"
+)
+
+// Start returns the start of the week containing t.  Any value other than
+// CapWeekJalali counts ISO weeks.
+func (w CapWeek) Start(t time.Time) time.Time {
+	if w == CapWeekJalali {
+		return jalali.WeekStart(t)
+	}
+	t = t.UTC()
+	days := (int(t.Weekday()) + 6) % 7 // days since Monday
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, time.UTC)
+}
+
+// ResetsAt returns when a cap reached at t starts counting afresh: the
+// start of the following week, at midnight like its start.
+func (w CapWeek) ResetsAt(t time.Time) time.Time {
+	return w.Start(t).AddDate(0, 0, 7)
+}
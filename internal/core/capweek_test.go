@@ -0,0 +1,72 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/jalali"
+)
+
+func TestCapWeek(t *testing.T) {
+	// Wednesday 20 March 2024, 02:00 in Tehran and 22:30 on Tuesday in UTC.
+	at := time.Date(2024, time.March, 19, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		week        CapWeek
+		start, next time.Time
+	}{
+		{CapWeekISO, time.Date(2024, time.March, 18, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 25, 0, 0, 0, 0, time.UTC)},
+		{"", time.Date(2024, time.March, 18, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 25, 0, 0, 0, 0, time.UTC)},
+		{CapWeekJalali, time.Date(2024, time.March, 16, 0, 0, 0, 0, jalali.Tehran), time.Date(2024, time.March, 23, 0, 0, 0, 0, jalali.Tehran)},
+	}
+	for _, tt := range tests {
+		if got := tt.week.Start(at); !got.Equal(tt.start) {
+			t.Errorf("%q week starts %v, want %v", tt.week, got, tt.start)
+		}
+		if got := tt.week.ResetsAt(at); !got.Equal(tt.next) {
+			t.Errorf("%q cap resets %v, want %v", tt.week, got, tt.next)
+		}
+		if got := tt.week.Start(tt.start); !got.Equal(tt.start) {
+			t.Errorf("%q week of its own start begins %v", tt.week, got)
+		}
+	}
+}
+
+func TestCapWeekResetsAt(t *testing.T) {
+	tests := []struct {
+		name string
+		week CapWeek
+		at   time.Time
+		want time.Time
+	}{
+		{"iso sunday night", CapWeekISO, time.Date(2024, time.March, 24, 23, 59, 59, 0, time.UTC), time.Date(2024, time.March, 25, 0, 0, 0, 0, time.UTC)},
+		{"iso monday midnight", CapWeekISO, time.Date(2024, time.March, 25, 0, 0, 0, 0, time.UTC), time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		// Monday already in Tehran, still Sunday in UTC.
+		{"iso in tehran", CapWeekISO, time.Date(2024, time.March, 25, 1, 0, 0, 0, jalali.Tehran), time.Date(2024, time.March, 25, 0, 0, 0, 0, time.UTC)},
+		{"iso across the year", CapWeekISO, time.Date(2025, time.December, 31, 12, 0, 0, 0, time.UTC), time.Date(2026, time.January, 5, 0, 0, 0, 0, time.UTC)},
+		// Saturday has begun in Tehran but not yet in UTC.
+		{"jalali friday night", CapWeekJalali, time.Date(2024, time.March, 22, 20, 29, 0, 0, time.UTC), time.Date(2024, time.March, 22, 20, 30, 0, 0, time.UTC)},
+		{"jalali saturday midnight", CapWeekJalali, time.Date(2024, time.March, 22, 20, 30, 0, 0, time.UTC), time.Date(2024, time.March, 29, 20, 30, 0, 0, time.UTC)},
+		// Tehran has kept +03:30 all year since 2022, summer included.
+		{"jalali summer", CapWeekJalali, time.Date(2024, time.July, 3, 12, 0, 0, 0, time.UTC), time.Date(2024, time.July, 5, 20, 30, 0, 0, time.UTC)},
+		// Nowruz: the week runs over the Jalali new year.
+		{"jalali new year", CapWeekJalali, time.Date(2025, time.March, 19, 12, 0, 0, 0, time.UTC), time.Date(2025, time.March, 21, 20, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := tt.week.ResetsAt(tt.at); !got.Equal(tt.want) {
+			t.Errorf("%s: resets %v, want %v", tt.name, got.UTC(), tt.want.UTC())
+		}
+	}
+}
+
+func TestCapNotice(t *testing.T) {
+	p := DefaultPrompts()
+	if got := p.CapNotice(time.Time{}); got != p.Cap {
+		t.Errorf("cap notice without a reset time %q, want the cap message", got)
+	}
+	// Saturday 4 Farvardin 1403, midnight in Tehran.
+	resetsAt := time.Date(2024, time.March, 22, 20, 30, 0, 0, time.UTC)
+	want := p.Cap + " از ۱۴۰۳/۰۱/۰۴ ۰۰:۰۰ می‌توانید دوباره پیام بفرستید."
+	if got := p.CapNotice(resetsAt); got != want {
+		t.Errorf("cap notice %q, want %q", got, want)
+	}
+}
@@ -2,7 +2,10 @@ package core
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"waitroom-chatbot/internal/i18n"
 	"waitroom-chatbot/internal/llm"
 	"waitroom-chatbot/pkg"
 )
@@ -12,11 +15,83 @@ import (
 // (mapped to OpenAI-style roles) plus the latest user message.
 type ChatService struct {
 	LLM llm.Client
+	// CompletionTopics lists the topics that must be covered before the bot
+	// wraps up the conversation.  An empty list disables wrap-up.
+	CompletionTopics []Topic
+	// Moderation enables the moderation check in ModerateMessage.
+	Moderation bool
+	// Options are passed to every chat call (temperature, max tokens, ...).
+	Options []llm.Option
+	// SingleQuestion says what to do with a reply asking several questions
+	// at once; replies are cleaned of speaker labels and markdown either way.
+	SingleQuestion SingleQuestionMode
+	// ContextTurns bounds the transcript sent with each chat call to the
+	// last ContextTurns patient messages and the replies to them, and
+	// ContextTokens to about that many tokens (see llm.EstimateTokens),
+	// whichever leaves fewer turns; zero lifts the bound.  The caller
+	// bounds the transcript to the last week (see ContextMessages).
+	ContextTurns  int
+	ContextTokens int
+	// MaxReplyChars and SimpleLanguage are the reply length limit and
+	// simple language setting of sessions whose prompt profile sets
+	// neither (see Prompts.MaxReplyChars); zero does not limit the length.
+	MaxReplyChars  int
+	SimpleLanguage bool
+}
+
+// withDefaults fills in the service's reply length limit and simple
+// language setting where prompts leave them unset.
+func (s *ChatService) withDefaults(prompts Prompts) Prompts {
+	if prompts.MaxReplyChars == 0 {
+		prompts.MaxReplyChars = s.MaxReplyChars
+	}
+	prompts.SimpleLanguage = prompts.SimpleLanguage || s.SimpleLanguage
+	return prompts
 }
 
 // NewChatService constructs a new ChatService with the given LLM client.
+// Wrap-up requires every topic in AllTopics by default.
 func NewChatService(client llm.Client) *ChatService {
-	return &ChatService{LLM: client}
+	return &ChatService{LLM: client, CompletionTopics: AllTopics}
+}
+
+// ShouldWrapUp reports whether the conversation has covered all completion
+// topics and the bot should send the closing message instead of another
+// question.
+// It returns false right after a wrap-up so a patient adding details after
+// the closing message gets a normal reply before the bot wraps up again.
+func (s *ChatService) ShouldWrapUp(history []pkg.Message) bool {
+	if len(s.CompletionTopics) == 0 {
+		return false
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == pkg.RoleBot {
+			if isClosing(history[i].Content) {
+				return false
+			}
+			break
+		}
+	}
+	covered := CoveredTopics(history)
+	for _, t := range s.CompletionTopics {
+		if !covered[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// isClosing reports whether content is the closing message in any locale.
+func isClosing(content string) bool {
+	if content == ClosingMessage {
+		return true
+	}
+	for _, l := range i18n.Supported() {
+		if msg, ok := i18n.Lookup(l.Code, "bot.closing"); ok && content == msg {
+			return true
+		}
+	}
+	return false
 }
 
 // Reply is kept for backward compatibility; it delegates to ReplyWithContext
@@ -26,26 +101,207 @@ func (s *ChatService) Reply(ctx context.Context, nationalID string, message stri
 }
 
 // ReplyWithContext generates a reply using the last week's transcript provided
-// by the caller (history). The history should be in chronological order.
+// by the caller (history). The history should be in chronological order.  It
+// is a thin wrapper returning only the text of ReplyWithPrompts.
 func (s *ChatService) ReplyWithContext(ctx context.Context, nationalID, lastUserMsg string, history []pkg.Message) (string, error) {
+	res, err := s.ReplyWithPrompts(ctx, DefaultPrompts(), lastUserMsg, history)
+	return res.Text, err
+}
+
+// Flags reported in ReplyResult.Flags.
+const (
+	// FlagUnavailable marks UnavailableMessage sent while the LLM circuit
+	// breaker is open.
+	FlagUnavailable = "unavailable"
+	// FlagBudget marks BudgetMessage sent while the monthly LLM budget is
+	// spent.
+	FlagBudget = "budget"
+	// FlagRedFlag marks a patient message mentioning a red-flag symptom
+	// (see ScorePriority).
+	FlagRedFlag = "red_flag"
+)
+
+// ReplyResult is a generated reply with what is known about how it was
+// produced.  Model and Usage are empty when the LLM was not called.
+// Latency is the duration of the whole call, including queueing for the
+// LLM, retries and fallbacks.
+type ReplyResult struct {
+	Text    string
+	Model   string
+	Usage   llm.Usage
+	Flags   []string
+	Latency time.Duration
+}
+
+// HasFlag reports whether the result carries flag.
+func (r ReplyResult) HasFlag(flag string) bool {
+	for _, f := range r.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplyWithPrompts is like ReplyWithContext but uses the session's resolved
+// prompts instead of the built-in ones and returns the full result.  opts
+// are added to the service's Options for this call.
+func (s *ChatService) ReplyWithPrompts(ctx context.Context, prompts Prompts, lastUserMsg string, history []pkg.Message, opts ...llm.Option) (ReplyResult, error) {
+	// Delegate to LLM. On error we return it so the HTTP handler can surface
+	// a proper 502 and the UI can show an error bubble.  While the circuit
+	// breaker is open or the monthly budget is spent the patient gets a
+	// friendly notice instead.
+	start := time.Now()
+	prompts = s.withDefaults(prompts)
+	res := newReplyResult(lastUserMsg)
+	opts = append(opts[:len(opts):len(opts)], llm.WithModelReport(&res.Model), llm.WithUsageReport(&res.Usage))
+	msgs := chatMessages(prompts, lastUserMsg, s.context(history))
+	reply, err := s.LLM.Chat(ctx, msgs, s.options(opts)...)
+	if err == nil {
+		reply, err = s.checked(ctx, prompts, msgs, reply, opts)
+	}
+	if err == nil {
+		reply = s.postprocess(ctx, prompts, msgs, reply, opts)
+		reply = s.breakLoop(ctx, prompts, history, msgs, reply, opts)
+		reply = truncateReply(reply, prompts.MaxReplyChars)
+	}
+	res.Latency = time.Since(start)
+	return res.finish(prompts, reply, err)
+}
+
+// StreamReplyWithPrompts is like ReplyWithPrompts but calls onChunk with
+// each part of the reply as the LLM produces it.  Clients that cannot
+// stream deliver the whole reply as one chunk.  A streamed reply that fails
+// the output check has been shown already; the reply requested in its place
+// is not streamed but returned, to replace it, as is a reply changed by
+// the post-processing (see postprocess, breakLoop and truncateReply).
+func (s *ChatService) StreamReplyWithPrompts(ctx context.Context, prompts Prompts, lastUserMsg string, history []pkg.Message, onChunk func(string), opts ...llm.Option) (ReplyResult, error) {
+	start := time.Now()
+	prompts = s.withDefaults(prompts)
+	res := newReplyResult(lastUserMsg)
+	opts = append(opts[:len(opts):len(opts)], llm.WithModelReport(&res.Model), llm.WithUsageReport(&res.Usage))
+	msgs := chatMessages(prompts, lastUserMsg, s.context(history))
+	reply, err := llm.ChatStream(ctx, s.LLM, msgs, onChunk, s.options(opts)...)
+	if err == nil {
+		reply, err = s.checked(ctx, prompts, msgs, reply, opts)
+	}
+	if err == nil {
+		reply = s.postprocess(ctx, prompts, msgs, reply, opts)
+		reply = s.breakLoop(ctx, prompts, history, msgs, reply, opts)
+		reply = truncateReply(reply, prompts.MaxReplyChars)
+	}
+	res.Latency = time.Since(start)
+	res, err = res.finish(prompts, reply, err)
+	if err == nil && res.Text != reply {
+		// A canned notice was never streamed; deliver it as one chunk.
+		onChunk(res.Text)
+	}
+	return res, err
+}
+
+// newReplyResult starts the result for a reply to lastUserMsg with the flags
+// that depend only on the patient's message.
+func newReplyResult(lastUserMsg string) ReplyResult {
+	var res ReplyResult
+	if MentionsRedFlag(lastUserMsg) {
+		res.Flags = append(res.Flags, FlagRedFlag)
+	}
+	return res
+}
+
+// finish sets the reply text, replacing errors that mean the LLM is
+// deliberately not being called by their canned notice from prompts.
+func (res ReplyResult) finish(prompts Prompts, reply string, err error) (ReplyResult, error) {
+	switch {
+	case errors.Is(err, llm.ErrCircuitOpen):
+		res.Text, res.Flags = prompts.Unavailable, append(res.Flags, FlagUnavailable)
+	case errors.Is(err, llm.ErrBudgetExceeded):
+		res.Text, res.Flags = prompts.Budget, append(res.Flags, FlagBudget)
+	case err != nil:
+		return res, err
+	default:
+		res.Text = reply
+		return res, nil
+	}
+	res.Model, res.Usage = "", llm.Usage{}
+	return res, nil
+}
+
+// options returns the service's Options followed by the call's.
+func (s *ChatService) options(opts []llm.Option) []llm.Option {
+	return append(s.Options[:len(s.Options):len(s.Options)], opts...)
+}
+
+// ContextMessages returns how many of the latest messages of a session the
+// caller needs to load for the chat context: two per turn, a patient message
+// and the reply to it, or zero for all of them when ContextTurns is zero.
+func (s *ChatService) ContextMessages() int {
+	return 2 * s.ContextTurns
+}
+
+// context returns the end of history sent with a chat call, bounded by
+// ContextTurns and ContextTokens.
+func (s *ChatService) context(history []pkg.Message) []pkg.Message {
+	return withinTokens(recentTurns(history, s.ContextTurns), s.ContextTokens)
+}
+
+// withinTokens returns the end of history starting at the earliest patient
+// message from which the estimated tokens of the messages fit in budget, so
+// turns are dropped whole; all of history when it fits or budget is zero.
+// Not even the last turn may fit.
+func withinTokens(history []pkg.Message, budget int) []pkg.Message {
+	if budget <= 0 {
+		return history
+	}
+	start, tokens := len(history), 0
+	for i := len(history) - 1; i >= 0; i-- {
+		if tokens += llm.EstimateTokens(history[i].Content); tokens > budget {
+			return history[start:]
+		}
+		if history[i].Role == pkg.RolePatient {
+			start = i
+		}
+	}
+	return history
+}
+
+// recentTurns returns the end of history starting at its n-th patient
+// message from the last, or all of history when n is zero or it holds no
+// more than n patient messages.
+func recentTurns(history []pkg.Message, n int) []pkg.Message {
+	if n <= 0 {
+		return history
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != pkg.RolePatient {
+			continue
+		}
+		if n--; n == 0 {
+			return history[i:]
+		}
+	}
+	return history
+}
+
+// chatMessages builds the LLM conversation: system prompt, prior
+// transcript, then the current patient message.  Patient messages are
+// delimited as data (see GuardInstruction).
+func chatMessages(prompts Prompts, lastUserMsg string, history []pkg.Message) []llm.Message {
 	var msgs []llm.Message
 
 	// System prompt (Persian) guiding tone & behavior.
-	msgs = append(msgs, llm.Message{Role: "system", Content: SystemPrompt})
+	msgs = append(msgs, llm.Message{Role: "system", Content: prompts.system()})
 
 	// Add prior transcript as alternating user/assistant messages.
 	for _, m := range history {
-		role := "user"
 		if m.Role == pkg.RoleBot {
-			role = "assistant"
+			msgs = append(msgs, llm.Message{Role: "assistant", Content: m.Content})
+			continue
 		}
-		msgs = append(msgs, llm.Message{Role: role, Content: m.Content})
+		msgs = append(msgs, llm.Message{Role: "user", Content: delimitPatient(m.Content)})
 	}
 
 	// Current patient message last.
-	msgs = append(msgs, llm.Message{Role: "user", Content: lastUserMsg})
-
-	// Delegate to LLM. On error we return it so the HTTP handler can surface
-	// a proper 502 and the UI can show an error bubble.
-	return s.LLM.Chat(ctx, msgs)
+	msgs = append(msgs, llm.Message{Role: "user", Content: delimitPatient(lastUserMsg)})
+	return msgs
 }
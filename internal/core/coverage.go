@@ -0,0 +1,114 @@
+package core
+
+import (
+	"strings"
+
+	"waitroom-chatbot/pkg"
+)
+
+// Topic identifies one of the intake areas the bot is asked to cover in
+// SystemPrompt.  Coverage is tracked so the conversation can be wrapped up
+// once everything the doctor needs has been collected.
+type Topic string
+
+const (
+	TopicChiefComplaint Topic = "chief_complaint"
+	TopicDuration       Topic = "duration"
+	TopicMedications    Topic = "medications"
+	TopicAllergies      Topic = "allergies"
+	TopicHistory        Topic = "history"
+	TopicFamily         Topic = "family"
+	TopicLifestyle      Topic = "lifestyle"
+	TopicPain           Topic = "pain"
+	TopicMood           Topic = "mood"
+)
+
+// AllTopics lists every intake topic in the order SystemPrompt introduces them.
+var AllTopics = []Topic{
+	TopicChiefComplaint,
+	TopicDuration,
+	TopicMedications,
+	TopicAllergies,
+	TopicHistory,
+	TopicFamily,
+	TopicLifestyle,
+	TopicPain,
+	TopicMood,
+}
+
+// topicKeywords maps each topic to Persian phrases that show up when the bot
+// asks about it.  A topic counts as covered once the bot has asked about it
+// and the patient has answered.  The chief complaint is asked by FirstMessage
+// and is therefore covered by any patient message.
+var topicKeywords = map[Topic][]string{
+	TopicDuration:    {"از چه زمانی", "چه مدت", "چند وقت", "چند روز", "مدت"},
+	TopicMedications: {"دارو", "قرص"},
+	TopicAllergies:   {"حساسیت", "آلرژی"},
+	TopicHistory:     {"سابقه‌ی بیماری", "سابقه بیماری", "سوابق پزشکی", "جراحی", "بیماری زمینه"},
+	TopicFamily:      {"خانواده", "خانوادگی"},
+	TopicLifestyle:   {"سیگار", "الکل", "شغل"},
+	TopicPain:        {"۰ تا ۱۰", "0 تا 10", "مقیاس", "شدت درد"},
+	TopicMood:        {"خلق", "اضطراب", "استرس", "افسرده", "غمگین"},
+}
+
+// topicQuestions are the built-in questions moving the conversation on to
+// each topic but the chief complaint.  Each contains one of the topic's
+// keywords, so asking it counts toward covering the topic.
+var topicQuestions = map[Topic]string{
+	TopicDuration:    "این مشکل از چه زمانی شروع شده است؟",
+	TopicMedications: "در حال حاضر چه داروهایی و با چه مقداری مصرف می‌کنید؟",
+	TopicAllergies:   "به چیزی حساسیت یا آلرژی دارید؟",
+	TopicHistory:     "سابقه‌ی بیماری یا جراحی قبلی دارید؟",
+	TopicFamily:      "در خانواده‌ی شما بیماری خاصی وجود دارد؟",
+	TopicLifestyle:   "سیگار یا الکل مصرف می‌کنید و شغلتان چیست؟",
+	TopicPain:        "شدت درد یا ناراحتی‌تان از ۰ تا ۱۰ چند است؟",
+	TopicMood:        "این روزها خلق‌تان چطور است و اضطراب یا غمی احساس می‌کنید؟",
+}
+
+// ParseTopics converts a comma separated list of topic names (as used by the
+// COMPLETION_TOPICS environment variable) into topics.  Unknown names are
+// ignored; an empty input yields AllTopics.
+func ParseTopics(s string) []Topic {
+	if strings.TrimSpace(s) == "" {
+		return AllTopics
+	}
+	known := make(map[Topic]bool, len(AllTopics))
+	for _, t := range AllTopics {
+		known[t] = true
+	}
+	var out []Topic
+	for _, part := range strings.Split(s, ",") {
+		t := Topic(strings.TrimSpace(part))
+		if known[t] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// CoveredTopics reports which topics have been asked by the bot and answered
+// by the patient in the given chronological transcript.
+func CoveredTopics(history []pkg.Message) map[Topic]bool {
+	covered := make(map[Topic]bool)
+	asked := make(map[Topic]bool)
+	for _, m := range history {
+		switch m.Role {
+		case pkg.RoleBot:
+			for t, words := range topicKeywords {
+				for _, w := range words {
+					if strings.Contains(m.Content, w) {
+						asked[t] = true
+						break
+					}
+				}
+			}
+		case pkg.RolePatient:
+			covered[TopicChiefComplaint] = true
+			for t := range asked {
+				covered[t] = true
+			}
+			asked = make(map[Topic]bool)
+		}
+	}
+	return covered
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// Delimiters around patient messages in the conversation sent to the LLM.
+// GuardInstruction names them, so they must not change on their own.
+const (
+	patientOpen  = "<patient_message>"
+	patientClose = "</patient_message>"
+)
+
+// ErrRejectedReply is returned when a reply fails the output check even
+// after it was requested again with the stricter instruction.
+var ErrRejectedReply = errs.New(errs.Unavailable, "llm reply rejected")
+
+// minScriptShare is the share of a reply's letters that must be in the
+// session's script, and of a summary's in its language's.  Drug names and
+// units are often written in Latin letters, so it is well below one.
+const minScriptShare = 0.6
+
+// minLeakRunes is how long a sentence of the system prompt must be for its
+// appearance in a reply to count as leaking the prompt.
+const minLeakRunes = 40
+
+// patientDelimiters strips the delimiters from patient text so a patient
+// cannot end their message early by typing one.
+var patientDelimiters = strings.NewReplacer(patientOpen, "", patientClose, "")
+
+// delimitPatient wraps a patient message in the delimiters.
+func delimitPatient(content string) string {
+	return patientOpen + "\n" + patientDelimiters.Replace(content) + "\n" + patientClose
+}
+
+// checked applies the output check to reply.  A rejected reply is
+// requested once more with prompts.Strict added to msgs; if that one fails
+// the check too, ErrRejectedReply is returned.
+func (s *ChatService) checked(ctx context.Context, prompts Prompts, msgs []llm.Message, reply string, opts []llm.Option) (string, error) {
+	reason := checkReply(prompts, reply)
+	if reason == "" {
+		return reply, nil
+	}
+	log.Printf("LLM reply rejected (%s); asking again", reason)
+	msgs = append(msgs[:len(msgs):len(msgs)], llm.Message{Role: "system", Content: prompts.Strict})
+	reply, err := s.LLM.Chat(ctx, msgs, s.options(opts)...)
+	if err != nil {
+		return "", err
+	}
+	if reason := checkReply(prompts, reply); reason != "" {
+		return "", fmt.Errorf("%w: %s", ErrRejectedReply, reason)
+	}
+	return reply, nil
+}
+
+// checkReply returns why reply must not reach the patient, or "" when it
+// may: it is not predominantly in prompts.Script, or it repeats part of the
+// system prompt verbatim.
+func checkReply(prompts Prompts, reply string) string {
+	if !writtenIn(reply, prompts.Script) {
+		return "not written in " + prompts.Script + " script"
+	}
+	if leaksPrompt(prompts.System, reply) {
+		return "repeats the system prompt"
+	}
+	return ""
+}
+
+// writtenIn reports whether text is predominantly written in the Unicode
+// script named script, or the script is unknown.
+func writtenIn(text, script string) bool {
+	table := unicode.Scripts[script]
+	if table == nil {
+		return true
+	}
+	var letters, inScript int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.Is(table, r) {
+				inScript++
+			}
+		}
+	}
+	return letters == 0 || float64(inScript) >= minScriptShare*float64(letters)
+}
+
+// leaksPrompt reports whether reply contains the system prompt or one of
+// its longer sentences.
+func leaksPrompt(system, reply string) bool {
+	if system == "" {
+		return false
+	}
+	if strings.Contains(reply, system) {
+		return true
+	}
+	sentences := strings.FieldsFunc(system, func(r rune) bool {
+		return r == '.' || r == '\n' || r == '؟' || r == '?' || r == '!'
+	})
+	for _, s := range sentences {
+		s = strings.TrimSpace(s)
+		if len([]rune(s)) >= minLeakRunes && strings.Contains(reply, s) {
+			return true
+		}
+	}
+	return false
+}
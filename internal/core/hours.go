@@ -0,0 +1,214 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// persianWeek lists the days by their names in operating hours, in the
+// order of the Persian week: Saturday first, the Thursday and Friday
+// weekend last, so "sat-wed" are the working days.
+var persianWeek = []struct {
+	name string
+	day  time.Weekday
+}{
+	{"sat", time.Saturday}, {"sun", time.Sunday}, {"mon", time.Monday}, {"tue", time.Tuesday},
+	{"wed", time.Wednesday}, {"thu", time.Thursday}, {"fri", time.Friday},
+}
+
+// OpenRange is a time of day the bot answers in, as minutes since midnight
+// with To exclusive.
+type OpenRange struct {
+	From, To int
+}
+
+// String formats the range as "08:00-20:00".
+func (r OpenRange) String() string {
+	return clock(r.From) + "-" + clock(r.To)
+}
+
+// OperatingHours are the weekly hours a clinic's bot answers patients in,
+// as time-of-day ranges per weekday in the clinic's time zone.  A nil
+// *OperatingHours is always open.
+type OperatingHours struct {
+	Location *time.Location
+	Days     [7][]OpenRange // by time.Weekday
+}
+
+// ParseOperatingHours parses a clinic's operating hours: entries separated
+// by ";", each naming days and the time ranges open on them, such as
+//
+//	sat-wed 08:00-13:00 16:00-20:00; thu 08:00-12:00
+//
+// Days are sat, sun, mon, tue, wed, thu and fri, alone, as a range in the
+// order of the Persian week (which may wrap past Friday) or listed with
+// commas; days no entry names are closed.  Ranges end by 24:00 and do not
+// cross midnight.  timezone is an IANA zone name, Tehran when empty.  An
+// empty spec parses to nil: always open.
+func ParseOperatingHours(spec, timezone string) (*OperatingHours, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	h := &OperatingHours{Location: jalali.Tehran}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, errs.Errorf(errs.Invalid, "operating hours: %w", err)
+		}
+		h.Location = loc
+	}
+	for _, entry := range strings.Split(spec, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errs.Errorf(errs.Invalid, "operating hours: %q has no time range", strings.TrimSpace(entry))
+		}
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields[1:] {
+			r, err := parseOpenRange(f)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range days {
+				h.Days[d] = append(h.Days[d], r)
+			}
+		}
+	}
+	return h, nil
+}
+
+// parseDays parses the days of an operating hours entry.
+func parseDays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		i, ok := weekIndex(first)
+		j := i
+		if ok && isRange {
+			j, ok = weekIndex(last)
+		}
+		if !ok {
+			return nil, errs.Errorf(errs.Invalid, "operating hours: unknown days %q", part)
+		}
+		for k := i; ; k = (k + 1) % len(persianWeek) {
+			days = append(days, persianWeek[k].day)
+			if k == j {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func weekIndex(name string) (int, bool) {
+	for i, d := range persianWeek {
+		if d.name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseOpenRange parses "HH:MM-HH:MM".
+func parseOpenRange(s string) (OpenRange, error) {
+	from, to, ok := strings.Cut(s, "-")
+	var r OpenRange
+	var err error
+	if ok {
+		r.From, err = parseClock(from)
+	}
+	if ok && err == nil {
+		r.To, err = parseClock(to)
+	}
+	if !ok || err != nil || r.From >= r.To {
+		return r, errs.Errorf(errs.Invalid, "operating hours: invalid time range %q", s)
+	}
+	return r, nil
+}
+
+// parseClock parses "HH:MM", up to 24:00, as minutes since midnight.
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func clock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Open reports whether t falls within the operating hours.
+func (h *OperatingHours) Open(t time.Time) bool {
+	if h == nil {
+		return true
+	}
+	t = t.In(h.Location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range h.Days[t.Weekday()] {
+		if minute >= r.From && minute < r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when the bot next answers after t: t itself when it is
+// open, the zero time when the hours never open.
+func (h *OperatingHours) NextOpen(t time.Time) time.Time {
+	if h.Open(t) {
+		return t
+	}
+	local := t.In(h.Location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, h.Location)
+	for i := 0; i <= 7; i++ {
+		day := midnight.AddDate(0, 0, i)
+		var next time.Time
+		for _, r := range h.Days[day.Weekday()] {
+			start := day.Add(time.Duration(r.From) * time.Minute)
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Week returns the operating hours of each day, in the order of the
+// Persian week, formatted as "08:00-20:00" ranges; closed days have none.
+func (h *OperatingHours) Week() []DayHours {
+	if h == nil {
+		return nil
+	}
+	out := make([]DayHours, len(persianWeek))
+	for i, d := range persianWeek {
+		out[i].Day = d.name
+		out[i].Ranges = []string{}
+		for _, r := range h.Days[d.day] {
+			out[i].Ranges = append(out[i].Ranges, r.String())
+		}
+	}
+	return out
+}
+
+// DayHours are the operating hours of a day of the week.
+type DayHours struct {
+	Day    string   `json:"day"`
+	Ranges []string `json:"ranges"`
+}
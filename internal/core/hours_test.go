@@ -0,0 +1,202 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// clinicWeek are the hours of a clinic open mornings and evenings on
+// working days and Thursday mornings, closed on Friday.
+const clinicWeek = "sat-wed 08:00-13:00 16:00-20:00; thu 08:00-12:00"
+
+// tehran returns a time of the week of 16 March 2024 (a Saturday) in
+// Tehran: day 0 is Saturday, 5 Thursday and 6 Friday.
+func tehran(day, hour, minute int) time.Time {
+	return time.Date(2024, time.March, 16+day, hour, minute, 0, 0, jalali.Tehran)
+}
+
+func TestOperatingHoursOpen(t *testing.T) {
+	h, err := ParseOperatingHours(clinicWeek, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Location != jalali.Tehran {
+		t.Errorf("location %v, want Tehran by default", h.Location)
+	}
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		open bool
+	}{
+		{"saturday opening", tehran(0, 8, 0), true},
+		{"saturday before opening", tehran(0, 7, 59), false},
+		{"wednesday morning", tehran(4, 12, 59), true},
+		{"wednesday lunch", tehran(4, 13, 0), false},
+		{"wednesday evening", tehran(4, 16, 0), true},
+		{"wednesday closing", tehran(4, 20, 0), false},
+		{"wednesday night", tehran(4, 2, 0), false},
+		{"thursday morning", tehran(5, 10, 0), true},
+		{"thursday afternoon", tehran(5, 12, 0), false},
+		{"thursday evening", tehran(5, 17, 0), false},
+		{"friday morning", tehran(6, 10, 0), false},
+		{"friday evening", tehran(6, 17, 0), false},
+		// 04:30 UTC on Saturday is 08:00 in Tehran.
+		{"saturday opening in UTC", time.Date(2024, time.March, 16, 4, 30, 0, 0, time.UTC), true},
+	} {
+		if got := h.Open(tc.at); got != tc.open {
+			t.Errorf("%s (%v): open %v, want %v", tc.name, tc.at, got, tc.open)
+		}
+	}
+	var always *OperatingHours
+	if !always.Open(tehran(6, 2, 0)) || !always.NextOpen(tehran(6, 2, 0)).Equal(tehran(6, 2, 0)) || always.Week() != nil {
+		t.Error("nil hours are not always open")
+	}
+}
+
+func TestOperatingHoursNextOpen(t *testing.T) {
+	h, err := ParseOperatingHours(clinicWeek, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		at, want time.Time
+	}{
+		{"open", tehran(1, 9, 30), tehran(1, 9, 30)},
+		{"lunch", tehran(4, 13, 30), tehran(4, 16, 0)},
+		{"wednesday night", tehran(4, 21, 0), tehran(5, 8, 0)},
+		{"before opening", tehran(2, 6, 0), tehran(2, 8, 0)},
+		{"thursday afternoon", tehran(5, 12, 30), tehran(7, 8, 0)},
+		{"friday", tehran(6, 23, 59), tehran(7, 8, 0)},
+	} {
+		if got := h.NextOpen(tc.at); !got.Equal(tc.want) {
+			t.Errorf("%s: next open %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	// Open only on Friday: a week ahead from Friday afternoon.
+	h, err = ParseOperatingHours("fri 09:00-10:00", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.NextOpen(tehran(6, 11, 0)); !got.Equal(tehran(13, 9, 0)) {
+		t.Errorf("next open %v, want the next Friday", got)
+	}
+	never := &OperatingHours{Location: jalali.Tehran}
+	if got := never.NextOpen(tehran(0, 9, 0)); !got.IsZero() {
+		t.Errorf("hours never open: next open %v, want zero", got)
+	}
+}
+
+func TestParseOperatingHours(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		open []int // days open at 09:30, 0 for Saturday
+	}{
+		{"sat-wed 09:00-17:00", []int{0, 1, 2, 3, 4}},
+		{"thu-sat 09:00-10:00", []int{0, 5, 6}},
+		{"sat,mon 09:00-10:00; fri 00:00-24:00", []int{0, 2, 6}},
+		{" SAT-SUN 09:00-10:00 ;; ", []int{0, 1}},
+	} {
+		h, err := ParseOperatingHours(tc.spec, "")
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		var open []int
+		for day := 0; day < 7; day++ {
+			if h.Open(tehran(day, 9, 30)) {
+				open = append(open, day)
+			}
+		}
+		if !equalInts(open, tc.open) {
+			t.Errorf("%q: open on days %v, want %v", tc.spec, open, tc.open)
+		}
+	}
+	if h, err := ParseOperatingHours("  ", "Asia/Tehran"); h != nil || err != nil {
+		t.Errorf("empty hours: %v, %v; want always open", h, err)
+	}
+	for _, spec := range []string{
+		"sat",
+		"sat-wed",
+		"xyz 08:00-09:00",
+		"sat-xyz 08:00-09:00",
+		"sat 09:00-08:00",
+		"sat 09:00-09:00",
+		"sat 08:00-24:01",
+		"sat 8-9",
+		"sat 08:60-09:00",
+		"sat 08:00",
+	} {
+		if _, err := ParseOperatingHours(spec, ""); !errs.Is(err, errs.Invalid) {
+			t.Errorf("%q: error %v, want invalid", spec, err)
+		}
+	}
+	if _, err := ParseOperatingHours(clinicWeek, "Mars/Olympus"); !errs.Is(err, errs.Invalid) {
+		t.Errorf("unknown time zone: error %v, want invalid", err)
+	}
+}
+
+func TestOperatingHoursTimezone(t *testing.T) {
+	h, err := ParseOperatingHours("mon 09:00-17:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 08:30 in Berlin but 11:00 in Tehran.
+	if at := time.Date(2024, time.March, 18, 7, 30, 0, 0, time.UTC); h.Open(at) {
+		t.Errorf("open at %v, before opening in Berlin", at)
+	}
+	if at := time.Date(2024, time.March, 18, 8, 0, 0, 0, time.UTC); !h.Open(at) {
+		t.Errorf("closed at %v, opening in Berlin", at)
+	}
+}
+
+func TestOperatingHoursWeek(t *testing.T) {
+	h, err := ParseOperatingHours(clinicWeek, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := h.Week()
+	if len(week) != 7 {
+		t.Fatalf("%d days, want 7", len(week))
+	}
+	want := []struct {
+		day    string
+		ranges string
+	}{
+		{"sat", "08:00-13:00 16:00-20:00"}, {"sun", "08:00-13:00 16:00-20:00"}, {"mon", "08:00-13:00 16:00-20:00"},
+		{"tue", "08:00-13:00 16:00-20:00"}, {"wed", "08:00-13:00 16:00-20:00"}, {"thu", "08:00-12:00"}, {"fri", ""},
+	}
+	for i, d := range week {
+		if d.Day != want[i].day || strings.Join(d.Ranges, " ") != want[i].ranges || d.Ranges == nil {
+			t.Errorf("day %d: %s %v, want %s %q", i, d.Day, d.Ranges, want[i].day, want[i].ranges)
+		}
+	}
+}
+
+func TestClosedHoursNotice(t *testing.T) {
+	p := DefaultPrompts()
+	if got := p.ClosedHoursNotice(time.Time{}); got != p.ClosedHours {
+		t.Errorf("notice without an opening time %q, want the closed hours message", got)
+	}
+	// Saturday 26 Esfand 1402.
+	want := p.ClosedHours + " از ۱۴۰۲/۱۲/۲۶ ۰۸:۰۰ می‌توانید دوباره پیام بفرستید."
+	if got := p.ClosedHoursNotice(tehran(0, 8, 0)); got != want {
+		t.Errorf("notice %q, want %q", got, want)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
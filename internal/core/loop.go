@@ -0,0 +1,110 @@
+package core
+
+import (
+	"context"
+	"log"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+const (
+	// loopWindow is how many of the bot's last messages a reply is
+	// compared with.
+	loopWindow = 2
+	// loopSimilarity is the share of words a reply must have in common
+	// with one of them to count as a repeat.
+	loopSimilarity = 0.8
+)
+
+// similarity returns the share of distinct words a and b have in common
+// (their Jaccard index), after normalising both, from 0 to 1.
+func similarity(a, b string) float64 {
+	wa, wb := wordSet(a), wordSet(b)
+	if len(wa) == 0 || len(wb) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wa)+len(wb)-common)
+}
+
+func wordSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range wordTokens(NormalizePersian(s)) {
+		set[w] = true
+	}
+	return set
+}
+
+// repeats reports whether reply is about the same as one of the last
+// loopWindow bot messages of history.
+func repeats(reply string, history []pkg.Message) bool {
+	seen := 0
+	for i := len(history) - 1; i >= 0 && seen < loopWindow; i-- {
+		if history[i].Role != pkg.RoleBot {
+			continue
+		}
+		seen++
+		if similarity(reply, history[i].Content) >= loopSimilarity {
+			return true
+		}
+	}
+	return false
+}
+
+// nextTopic returns the first topic, in AllTopics order, that history has
+// not covered yet, skipping the chief complaint.
+func nextTopic(history []pkg.Message) (Topic, bool) {
+	covered := CoveredTopics(history)
+	for _, t := range AllTopics[1:] {
+		if !covered[t] {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// breakLoop keeps the bot from asking the same question over and over, as
+// it may when the patient's answers stay vague.  A reply repeating one of
+// the bot's last messages is requested once more with prompts.Loop added;
+// if that one repeats too, fails the output check or the call fails, the
+// canned question of the next uncovered topic replaces it.  With every
+// topic covered the reply is kept.
+func (s *ChatService) breakLoop(ctx context.Context, prompts Prompts, history []pkg.Message, msgs []llm.Message, reply string, opts []llm.Option) string {
+	if !repeats(reply, history) {
+		return reply
+	}
+	sessionID := history[len(history)-1].SessionID
+	if prompts.Loop != "" {
+		log.Printf("LLM reply repeats an earlier question in session %s; asking again", sessionID)
+		msgs = append(msgs[:len(msgs):len(msgs)],
+			llm.Message{Role: "assistant", Content: reply},
+			llm.Message{Role: "system", Content: prompts.Loop})
+		again, err := s.LLM.Chat(ctx, msgs, s.options(opts)...)
+		if err != nil {
+			log.Printf("ask again for a new question in session %s: %v", sessionID, err)
+		} else if reason := checkReply(prompts, again); reason != "" {
+			log.Printf("LLM reply asked again for a new question rejected in session %s (%s)", sessionID, reason)
+		} else {
+			again = cleanReply(again)
+			if s.SingleQuestion != SingleQuestionOff && multipleQuestions(again) {
+				again = firstQuestion(again)
+			}
+			if !repeats(again, history) {
+				return again
+			}
+		}
+	}
+	topic, ok := nextTopic(history)
+	if !ok || prompts.TopicQuestions[topic] == "" {
+		log.Printf("LLM reply repeats an earlier question in session %s; no topic left to move on to", sessionID)
+		return reply
+	}
+	log.Printf("LLM reply repeats an earlier question in session %s; moving on to %s", sessionID, topic)
+	return prompts.TopicQuestions[topic]
+}
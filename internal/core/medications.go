@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+//go:embed medications.csv
+var medicationsCSV []byte
+
+// Medications is the reference list of common medications used to
+// normalise drug mentions in summaries.  It is loaded from the embedded
+// medications.csv.
+var Medications = mustLoadMedications(medicationsCSV)
+
+// MedicationList maps Persian and Latin spellings of medications to a
+// canonical (generic, Latin) name.
+type MedicationList struct {
+	names map[string]string // lookup key -> canonical name
+	// maxTokens is the number of tokens in the longest spelling.
+	maxTokens int
+}
+
+// Medication is a normalised drug mention.  Name is the canonical name, or
+// the mention without its dose when it is not in the reference list
+// (Unmatched).  Original is the mention as the summariser wrote it.
+type Medication struct {
+	Name      string `json:"name"`
+	Original  string `json:"original,omitempty"`
+	Dose      string `json:"dose,omitempty"`
+	Unmatched bool   `json:"unmatched,omitempty"`
+}
+
+// LoadMedicationList reads a reference list from CSV with the header
+// "name,persian,spellings": the canonical name, its Persian spelling and
+// further spellings separated by "|".
+func LoadMedicationList(r io.Reader) (*MedicationList, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != "name" || header[1] != "persian" || header[2] != "spellings" {
+		return nil, fmt.Errorf("medication list: unexpected header %q", header)
+	}
+	l := &MedicationList{names: map[string]string{}}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return l, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSpace(rec[0])
+		if name == "" {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("medication list: line %d has no name", line)
+		}
+		spellings := append([]string{name, rec[1]}, strings.Split(rec[2], "|")...)
+		for _, s := range spellings {
+			tokens := wordTokens(NormalizePersian(s))
+			if len(tokens) == 0 {
+				continue
+			}
+			l.names[strings.Join(tokens, "")] = name
+			if len(tokens) > l.maxTokens {
+				l.maxTokens = len(tokens)
+			}
+		}
+	}
+}
+
+func mustLoadMedications(data []byte) *MedicationList {
+	l, err := LoadMedicationList(bytes.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// Normalize maps a free-text mention such as "قرص متفورمین ۵۰۰" to its
+// canonical name ("metformin").  The dose is the text from the first digit
+// on, as written.  Mentions that match no spelling are returned Unmatched
+// with the dose stripped from the name.
+func (l *MedicationList) Normalize(mention string) Medication {
+	mention = strings.TrimSpace(mention)
+	m := Medication{Original: mention}
+	name := mention
+	if i := strings.IndexFunc(mention, unicode.IsDigit); i >= 0 {
+		name, m.Dose = strings.TrimSpace(mention[:i]), strings.TrimSpace(mention[i:])
+	}
+	tokens := wordTokens(NormalizePersian(name))
+	size := l.maxTokens
+	if len(tokens) < size {
+		size = len(tokens)
+	}
+	for ; size > 0; size-- {
+		for i := 0; i+size <= len(tokens); i++ {
+			if canonical, ok := l.names[strings.Join(tokens[i:i+size], "")]; ok {
+				m.Name = canonical
+				return m
+			}
+		}
+	}
+	m.Name, m.Unmatched = name, true
+	return m
+}
+
+// normalizeMedication rewrites a medication entry from a structured summary
+// (a bare mention or an object with "name" and usually "dose") as an object
+// with the canonical name, the original mention, the dose and, when the name
+// is not in the reference list, "unmatched": true.  Other fields of the
+// object are kept.
+func normalizeMedication(med interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	if obj, ok := med.(map[string]interface{}); ok {
+		for k, v := range obj {
+			out[k] = v
+		}
+	}
+	mention := medicationName(med)
+	if orig, ok := out["original"].(string); ok && orig != "" {
+		mention = orig // already normalised; start again from what was written
+	}
+	m := Medications.Normalize(mention)
+	out["name"], out["original"] = m.Name, m.Original
+	if empty(out["dose"]) && m.Dose != "" {
+		out["dose"] = m.Dose
+	}
+	delete(out, "unmatched")
+	if m.Unmatched {
+		out["unmatched"] = true
+	}
+	return out
+}
+
+// SummaryMedications returns the medications of a structured summary for
+// display, normalising entries stored before normalisation was added.
+func SummaryMedications(structured map[string]interface{}) []Medication {
+	var out []Medication
+	for _, med := range list(structured["medications"]) {
+		obj := normalizeMedication(med)
+		m := Medication{Unmatched: obj["unmatched"] == true}
+		m.Name, _ = obj["name"].(string)
+		m.Original, _ = obj["original"].(string)
+		if !empty(obj["dose"]) {
+			m.Dose = fmt.Sprint(obj["dose"])
+		}
+		if m.Name != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
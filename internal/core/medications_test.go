@@ -0,0 +1,108 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/pkg"
+)
+
+func TestMedicationListEmbedded(t *testing.T) {
+	records, err := csv.NewReader(bytes.NewReader(medicationsCSV)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, rec := range records[1:] {
+		name := rec[0]
+		if seen[name] {
+			t.Errorf("%s listed twice", name)
+		}
+		seen[name] = true
+		// Every spelling of a row maps to its own canonical name.
+		for _, s := range append([]string{name, rec[1]}, strings.Split(rec[2], "|")...) {
+			if s == "" {
+				continue
+			}
+			if m := Medications.Normalize(s); m.Name != name || m.Unmatched {
+				t.Errorf("%q normalised to %+v, want %s", s, m, name)
+			}
+		}
+	}
+	if len(seen) < 50 {
+		t.Errorf("%d medications in the reference list", len(seen))
+	}
+}
+
+func TestNormalizeMedication(t *testing.T) {
+	tests := []struct {
+		mention string
+		want    Medication
+	}{
+		{"متفورمین", Medication{Name: "metformin", Original: "متفورمین"}},
+		{"metformin", Medication{Name: "metformin", Original: "metformin"}},
+		{"Metformin 500mg", Medication{Name: "metformin", Original: "Metformin 500mg", Dose: "500mg"}},
+		{"قرص متفورمین ۵۰۰", Medication{Name: "metformin", Original: "قرص متفورمین ۵۰۰", Dose: "۵۰۰"}},
+		{"  گلوکوفاژ ۱۰۰۰ میلی‌گرم ", Medication{Name: "metformin", Original: "گلوکوفاژ ۱۰۰۰ میلی‌گرم", Dose: "۱۰۰۰ میلی‌گرم"}},
+		{"پاراستامول", Medication{Name: "acetaminophen", Original: "پاراستامول"}},
+		{"قطره گیاهی ۲۰ قطره", Medication{Name: "قطره گیاهی", Original: "قطره گیاهی ۲۰ قطره", Dose: "۲۰ قطره", Unmatched: true}},
+		{"", Medication{Unmatched: true}},
+	}
+	for _, tt := range tests {
+		if got := Medications.Normalize(tt.mention); got != tt.want {
+			t.Errorf("Normalize(%q) = %+v, want %+v", tt.mention, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMedicationList(t *testing.T) {
+	l, err := LoadMedicationList(strings.NewReader("name,persian,spellings\nsalbutamol,سالبوتامول,ventolin|ونتولین\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := l.Normalize("اسپری ونتولین"); m.Name != "salbutamol" || m.Unmatched {
+		t.Errorf("normalised to %+v", m)
+	}
+	for name, data := range map[string]string{
+		"empty":        "",
+		"wrong header": "drug,persian,spellings\n",
+		"no name":      "name,persian,spellings\n,آسپرین,\n",
+		"short row":    "name,persian,spellings\naspirin,آسپرین\n",
+	} {
+		if _, err := LoadMedicationList(strings.NewReader(data)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestMergeMedicationSpellings(t *testing.T) {
+	var summary *pkg.Summary
+	for _, med := range []interface{}{
+		"متفورمین",
+		"metformin",
+		map[string]interface{}{"name": "قرص متفورمین ۵۰۰"},
+		map[string]interface{}{"name": "قطره گیاهی"},
+	} {
+		summary = MergeSummaries(summary, &pkg.Summary{Structured: map[string]interface{}{"medications": []interface{}{med}}})
+	}
+	meds := SummaryMedications(summary.Structured)
+	if len(meds) != 2 {
+		t.Fatalf("medications %+v, want metformin and the unknown drop", meds)
+	}
+	want := []Medication{
+		{Name: "metformin", Original: "قرص متفورمین ۵۰۰", Dose: "۵۰۰"},
+		{Name: "قطره گیاهی", Original: "قطره گیاهی", Unmatched: true},
+	}
+	for i := range want {
+		if meds[i] != want[i] {
+			t.Errorf("medication %d: %+v, want %+v", i, meds[i], want[i])
+		}
+	}
+	// A later mention without a dose keeps the known one.
+	summary = MergeSummaries(summary, &pkg.Summary{Structured: map[string]interface{}{"medications": []interface{}{"گلوکوفاژ"}}})
+	if meds := SummaryMedications(summary.Structured); len(meds) != 2 || meds[0].Dose != "۵۰۰" || meds[0].Original != "گلوکوفاژ" {
+		t.Errorf("after a mention without a dose: %+v", meds)
+	}
+}
@@ -0,0 +1,260 @@
+package core
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"waitroom-chatbot/pkg"
+)
+
+// MaxKeyPoints caps the key points kept on a merged summary.
+const MaxKeyPoints = 7
+
+// keyPointSimilarity is the word overlap (Jaccard index) above which two
+// key points are considered the same.
+const keyPointSimilarity = 0.6
+
+// MergeSummaries combines a freshly generated summary with the stored one so
+// details the patient gave earlier are not lost when the LLM omits them:
+//
+//   - scalar structured fields take the new value only when it is non-empty;
+//   - "medications" are normalised against the reference list and merge
+//     by canonical name, keeping the newest dose;
+//   - "allergies" are a union, deduplicated case-insensitively after
+//     Persian normalisation;
+//   - key points are deduplicated by word overlap (the newer wording wins)
+//     and capped at MaxKeyPoints, dropping the oldest;
+//   - free text is replaced when the new one is non-empty;
+//   - UpdatedAt always advances.
+//
+// Either argument may be nil.  The result is a new summary; neither input
+// is modified.
+func MergeSummaries(old, latest *pkg.Summary) *pkg.Summary {
+	if latest == nil {
+		return old
+	}
+	merged := *latest
+	if old == nil {
+		merged.Structured = mergeStructured(nil, latest.Structured)
+		return &merged
+	}
+	merged.Structured = mergeStructured(old.Structured, latest.Structured)
+	merged.KeyPoints = mergeKeyPoints(old.KeyPoints, latest.KeyPoints)
+	if strings.TrimSpace(merged.FreeText) == "" {
+		merged.FreeText = old.FreeText
+	}
+	if !merged.UpdatedAt.After(old.UpdatedAt) {
+		merged.UpdatedAt = time.Now()
+		if !merged.UpdatedAt.After(old.UpdatedAt) {
+			merged.UpdatedAt = old.UpdatedAt.Add(time.Millisecond)
+		}
+	}
+	return &merged
+}
+
+func mergeStructured(old, latest map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(old)+len(latest))
+	for k, v := range old {
+		out[k] = v
+	}
+	for k, v := range latest {
+		switch k {
+		case "medications":
+			out[k] = mergeMedications(out[k], v)
+		case "allergies":
+			out[k] = mergeAllergies(out[k], v)
+		default:
+			if !empty(v) {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+// mergeMedications merges two medication lists by canonical name (see
+// MedicationList.Normalize).  Entries are either mentions or objects with a
+// "name" (and usually a "dose"); a newer entry replaces the older one of the
+// same drug but keeps its dose when the newer one has none.
+func mergeMedications(old, latest interface{}) interface{} {
+	oldList, newList := list(old), list(latest)
+	if len(newList) == 0 {
+		return old
+	}
+	var out []interface{}
+	index := map[string]int{}
+	add := func(med interface{}) {
+		next := normalizeMedication(med)
+		name, _ := next["name"].(string)
+		key := NormalizePersian(name)
+		if key == "" {
+			return
+		}
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(out)
+			out = append(out, next)
+			return
+		}
+		prev := out[i].(map[string]interface{})
+		if empty(next["dose"]) && !empty(prev["dose"]) {
+			next["dose"] = prev["dose"]
+		}
+		out[i] = next
+	}
+	for _, m := range oldList {
+		add(m)
+	}
+	for _, m := range newList {
+		add(m)
+	}
+	return out
+}
+
+func medicationName(med interface{}) string {
+	switch m := med.(type) {
+	case string:
+		return m
+	case map[string]interface{}:
+		name, _ := m["name"].(string)
+		return name
+	}
+	return ""
+}
+
+// mergeAllergies returns the union of two allergy lists, keeping the first
+// spelling of each normalised entry.
+func mergeAllergies(old, latest interface{}) interface{} {
+	if len(list(latest)) == 0 {
+		return old
+	}
+	var out []interface{}
+	seen := map[string]bool{}
+	for _, a := range append(list(old), list(latest)...) {
+		s, ok := a.(string)
+		if !ok {
+			continue
+		}
+		key := NormalizePersian(s)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// mergeKeyPoints appends the new key points to the old ones, replacing any
+// old point a new one is similar to, and keeps the newest MaxKeyPoints.
+func mergeKeyPoints(old, latest []string) []string {
+	out := append([]string(nil), old...)
+	for _, p := range latest {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		replaced := false
+		for i, q := range out {
+			if similar(p, q) {
+				out = append(out[:i], out[i+1:]...)
+				out = append(out, p)
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, p)
+		}
+	}
+	if len(out) > MaxKeyPoints {
+		out = out[len(out)-MaxKeyPoints:]
+	}
+	return out
+}
+
+// similar reports whether two key points say the same thing: one contains
+// the other after normalisation or their words overlap enough.
+func similar(a, b string) bool {
+	na, nb := NormalizePersian(a), NormalizePersian(b)
+	if na == nb || strings.Contains(na, nb) || strings.Contains(nb, na) {
+		return true
+	}
+	wa, wb := strings.Fields(na), strings.Fields(nb)
+	set := make(map[string]bool, len(wa))
+	for _, w := range wa {
+		set[w] = true
+	}
+	union := len(set)
+	common := 0
+	for _, w := range wb {
+		if set[w] {
+			common++
+			delete(set, w)
+		} else {
+			union++
+		}
+	}
+	return union > 0 && float64(common)/float64(union) >= keyPointSimilarity
+}
+
+// NormalizePersian folds text for comparison: Arabic yeh and kaf become
+// their Persian forms, diacritics and tatweel are dropped, zero-width
+// non-joiners become spaces, digits become ASCII, letters are lower-cased
+// and whitespace is collapsed.
+func NormalizePersian(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == 'ي' || r == 'ى':
+			r = 'ی'
+		case r == 'ك':
+			r = 'ک'
+		case r == 'ة':
+			r = 'ه'
+		case r == '\u200c' || r == '\u200e' || r == '\u200f':
+			r = ' '
+		case r == '\u0640' || (r >= '\u064b' && r <= '\u0652'):
+			continue
+		case r >= '۰' && r <= '۹':
+			r = '0' + (r - '۰')
+		case r >= '٠' && r <= '٩':
+			r = '0' + (r - '٠')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// list returns v as a JSON array, treating a lone value as a one-element
+// list.
+func list(v interface{}) []interface{} {
+	switch l := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return l
+	case []string:
+		out := make([]interface{}, len(l))
+		for i, s := range l {
+			out[i] = s
+		}
+		return out
+	}
+	return []interface{}{v}
+}
+
+// empty reports whether a structured value carries no information.
+func empty(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(x) == ""
+	case []interface{}:
+		return len(x) == 0
+	case map[string]interface{}:
+		return len(x) == 0
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+func TestMergeSummaries(t *testing.T) {
+	stored := time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC)
+	numbered := func(from, to int) []string {
+		var points []string
+		for i := from; i <= to; i++ {
+			points = append(points, fmt.Sprintf("نکته %d", i))
+		}
+		return points
+	}
+	tests := []struct {
+		name   string
+		old    *pkg.Summary
+		latest *pkg.Summary
+		want   *pkg.Summary
+	}{
+		{
+			name: "scalar overwritten only by a non-empty value",
+			old: &pkg.Summary{Structured: map[string]interface{}{
+				"chief_complaint": "سردرد", "duration": "سه روز", "severity": "متوسط",
+			}},
+			latest: &pkg.Summary{Structured: map[string]interface{}{
+				"chief_complaint": "سردرد شدید", "duration": "  ", "severity": nil,
+			}},
+			want: &pkg.Summary{Structured: map[string]interface{}{
+				"chief_complaint": "سردرد شدید", "duration": "سه روز", "severity": "متوسط",
+			}},
+		},
+		{
+			name: "medication of the same normalized name keeps the newest dose",
+			old: &pkg.Summary{Structured: map[string]interface{}{"medications": []interface{}{
+				map[string]interface{}{"name": "متفورمین", "dose": "500mg"},
+				map[string]interface{}{"name": "پاراستامول", "dose": "325mg"},
+			}}},
+			latest: &pkg.Summary{Structured: map[string]interface{}{"medications": []interface{}{
+				map[string]interface{}{"name": "Metformin", "dose": "1000mg"},
+				map[string]interface{}{"name": "پاراستامول"},
+			}}},
+			want: &pkg.Summary{Structured: map[string]interface{}{"medications": []interface{}{
+				map[string]interface{}{"name": "metformin", "original": "Metformin", "dose": "1000mg"},
+				map[string]interface{}{"name": "acetaminophen", "original": "پاراستامول", "dose": "325mg"},
+			}}},
+		},
+		{
+			name: "allergies deduplicated case-insensitively and after Persian normalization",
+			old: &pkg.Summary{Structured: map[string]interface{}{
+				"allergies": []interface{}{"Aspirin", "پنی‌سیلین", "کدئین"},
+			}},
+			latest: &pkg.Summary{Structured: map[string]interface{}{
+				"allergies": []interface{}{"aspirin", "پني‌سيلين", "كدئين", "لاتکس"},
+			}},
+			want: &pkg.Summary{Structured: map[string]interface{}{
+				"allergies": []interface{}{"Aspirin", "پنی‌سیلین", "کدئین", "لاتکس"},
+			}},
+		},
+		{
+			name:   "similar key points collapse into the newer wording",
+			old:    &pkg.Summary{KeyPoints: []string{"سردرد از سه روز پیش", "تب ندارد"}},
+			latest: &pkg.Summary{KeyPoints: []string{"سردرد از سه روز قبل", "تب ندارد"}},
+			want:   &pkg.Summary{KeyPoints: []string{"سردرد از سه روز قبل", "تب ندارد"}},
+		},
+		{
+			name:   "key points capped, dropping the oldest",
+			old:    &pkg.Summary{KeyPoints: numbered(1, 6)},
+			latest: &pkg.Summary{KeyPoints: numbered(7, 9)},
+			want:   &pkg.Summary{KeyPoints: numbered(3, 9)},
+		},
+		{
+			name:   "free text kept when the new one is empty",
+			old:    &pkg.Summary{FreeText: "بیمار سردرد دارد."},
+			latest: &pkg.Summary{FreeText: " "},
+			want:   &pkg.Summary{FreeText: "بیمار سردرد دارد."},
+		},
+		{
+			name:   "first summary",
+			latest: &pkg.Summary{KeyPoints: []string{"سردرد"}, FreeText: "بیمار سردرد دارد."},
+			want:   &pkg.Summary{KeyPoints: []string{"سردرد"}, FreeText: "بیمار سردرد دارد."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.old != nil {
+				tt.old.UpdatedAt = stored
+			}
+			if tt.want.Structured == nil {
+				tt.want.Structured = map[string]interface{}{}
+			}
+			got := MergeSummaries(tt.old, tt.latest)
+			if !reflect.DeepEqual(got.KeyPoints, tt.want.KeyPoints) {
+				t.Errorf("key points %q, want %q", got.KeyPoints, tt.want.KeyPoints)
+			}
+			if !reflect.DeepEqual(got.Structured, tt.want.Structured) {
+				t.Errorf("structured %v, want %v", got.Structured, tt.want.Structured)
+			}
+			if got.FreeText != tt.want.FreeText {
+				t.Errorf("free text %q, want %q", got.FreeText, tt.want.FreeText)
+			}
+			if tt.old != nil && !got.UpdatedAt.After(tt.old.UpdatedAt) {
+				t.Errorf("updated at %v, not after the stored %v", got.UpdatedAt, tt.old.UpdatedAt)
+			}
+		})
+	}
+}
+
+func TestMergeSummariesUpdatedAt(t *testing.T) {
+	// A stored summary from a clock running ahead still yields a later
+	// time, as does one stored just now.
+	for _, stored := range []time.Time{time.Now().Add(time.Hour), time.Now()} {
+		old := &pkg.Summary{UpdatedAt: stored}
+		if got := MergeSummaries(old, &pkg.Summary{}); !got.UpdatedAt.After(stored) {
+			t.Errorf("merged into a summary of %v: updated at %v", stored, got.UpdatedAt)
+		}
+	}
+	latest := time.Now().Add(2 * time.Hour)
+	old := &pkg.Summary{UpdatedAt: time.Now()}
+	if got := MergeSummaries(old, &pkg.Summary{UpdatedAt: latest}); !got.UpdatedAt.Equal(latest) {
+		t.Errorf("updated at %v, want the new summary's %v", got.UpdatedAt, latest)
+	}
+}
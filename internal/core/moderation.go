@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+
+	"waitroom-chatbot/internal/llm"
+)
+
+// ModerationOutcome tells the caller how to handle a patient message after
+// moderation.  When Reply is non-empty the message must not be forwarded to
+// the chat model and Reply is sent instead.  Escalate marks content that
+// needs the doctor's immediate attention.
+type ModerationOutcome struct {
+	Category string
+	Reply    string
+	Escalate bool
+}
+
+// ModerateMessage checks a patient message before it reaches the chat model.
+// Self-harm content gets the crisis response and is escalated; harassment,
+// hate and content flagged for a category not known here get a calm
+// boundary-setting reply.  Violence and sexual content are recorded but
+// proceed normally, as patients describe injuries and symptoms.  It is a no-op unless ChatService.Moderation is set.
+func (s *ChatService) ModerateMessage(ctx context.Context, content string) (ModerationOutcome, error) {
+	if !s.Moderation {
+		return ModerationOutcome{}, nil
+	}
+	res, err := s.LLM.Moderate(ctx, content)
+	if err != nil {
+		return ModerationOutcome{}, err
+	}
+	out := ModerationOutcome{Category: res.Category}
+	switch res.Category {
+	case llm.CategorySelfHarm:
+		out.Reply = CrisisMessage
+		out.Escalate = true
+	case llm.CategoryViolence, llm.CategorySexual:
+	default:
+		if res.Flagged {
+			if out.Category == "" {
+				out.Category = llm.CategoryUnknown
+			}
+			out.Reply = BoundaryMessage
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"waitroom-chatbot/internal/llm"
+)
+
+func TestModerateMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		moderation llm.ModerationResult
+		want       ModerationOutcome
+	}{
+		{"clean", llm.ModerationResult{}, ModerationOutcome{}},
+		{"self-harm", llm.ModerationResult{Flagged: true, Category: llm.CategorySelfHarm},
+			ModerationOutcome{Category: llm.CategorySelfHarm, Reply: CrisisMessage, Escalate: true}},
+		{"harassment only", llm.ModerationResult{Flagged: true, Category: llm.CategoryHarassment},
+			ModerationOutcome{Category: llm.CategoryHarassment, Reply: BoundaryMessage}},
+		{"hate", llm.ModerationResult{Flagged: true, Category: llm.CategoryHate},
+			ModerationOutcome{Category: llm.CategoryHate, Reply: BoundaryMessage}},
+		{"violence proceeds", llm.ModerationResult{Flagged: true, Category: llm.CategoryViolence},
+			ModerationOutcome{Category: llm.CategoryViolence}},
+		{"unknown category", llm.ModerationResult{Flagged: true, Category: llm.CategoryUnknown},
+			ModerationOutcome{Category: llm.CategoryUnknown, Reply: BoundaryMessage}},
+		{"unrecognised category", llm.ModerationResult{Flagged: true, Category: "illicit"},
+			ModerationOutcome{Category: "illicit", Reply: BoundaryMessage}},
+		{"flagged without a category", llm.ModerationResult{Flagged: true},
+			ModerationOutcome{Category: llm.CategoryUnknown, Reply: BoundaryMessage}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := llm.NewFakeClient("")
+			fake.Moderation = tt.moderation
+			chat := NewChatService(fake)
+			chat.Moderation = true
+			got, err := chat.ModerateMessage(context.Background(), "پیام")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("outcome %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
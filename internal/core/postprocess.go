@@ -0,0 +1,223 @@
+package core
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"waitroom-chatbot/internal/llm"
+)
+
+// SingleQuestionMode says what happens to a reply that asks the patient
+// several questions at once, against the system prompt's one question at a
+// time.
+type SingleQuestionMode string
+
+const (
+	// SingleQuestionOff sends such replies as they are.
+	SingleQuestionOff SingleQuestionMode = ""
+	// SingleQuestionTruncate cuts the reply after its first question.
+	SingleQuestionTruncate SingleQuestionMode = "truncate"
+	// SingleQuestionReprompt requests the reply once more with
+	// prompts.SingleQuestion added, and truncates that one if it still asks
+	// several questions.
+	SingleQuestionReprompt SingleQuestionMode = "reprompt"
+)
+
+// ParseSingleQuestionMode parses a SINGLE_QUESTION value: "off" or empty,
+// "truncate" or "reprompt".
+func ParseSingleQuestionMode(s string) (SingleQuestionMode, bool) {
+	switch m := SingleQuestionMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "off":
+		return SingleQuestionOff, true
+	case SingleQuestionOff, SingleQuestionTruncate, SingleQuestionReprompt:
+		return m, true
+	}
+	return SingleQuestionOff, false
+}
+
+var (
+	// rolePrefix matches a speaker label the model sometimes starts its
+	// reply with, as if continuing a transcript.
+	rolePrefix = regexp.MustCompile(`^(?i:assistant|bot|ai|chatbot|دستیار|ربات|پزشک|المساعد|Köməkçi)\s*[:：]\s*`)
+	// headingMarker matches a markdown heading marker.
+	headingMarker = regexp.MustCompile(`(?m)^[ \t]*#{1,6}[ \t]+`)
+	// emphasis matches markdown bold markers and inline code backticks.
+	emphasis = regexp.MustCompile("\\*\\*|__|`")
+	// blankLines matches a run of more than one blank line.
+	blankLines = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+	// listItem matches the marker of a numbered list item, in Latin,
+	// Persian or Arabic digits.
+	listItem = regexp.MustCompile(`^[ \t]*[0-9۰-۹٠-٩]+[.)\-–][ \t]*`)
+)
+
+// cleanReply removes what the patient should not see in a reply: a leading
+// speaker label, markdown headings and emphasis (the chat shows plain
+// text), trailing spaces and runs of blank lines.
+func cleanReply(reply string) string {
+	// Markdown goes first, so that a label in bold ("**assistant:**") is
+	// recognised.
+	reply = headingMarker.ReplaceAllString(reply, "")
+	reply = strings.TrimSpace(emphasis.ReplaceAllString(reply, ""))
+	for {
+		trimmed := rolePrefix.ReplaceAllString(reply, "")
+		if trimmed == reply {
+			break
+		}
+		reply = strings.TrimSpace(trimmed)
+	}
+	lines := strings.Split(reply, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	reply = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(reply, "\n\n"))
+}
+
+// isQuestionMark reports whether r ends a question, in Persian, Arabic or
+// Latin script.
+func isQuestionMark(r rune) bool {
+	return r == '؟' || r == '?'
+}
+
+// multipleQuestions reports whether a reply asks more than one question:
+// it has several question marks or a numbered list of two or more items.
+func multipleQuestions(reply string) bool {
+	if strings.Count(reply, "؟")+strings.Count(reply, "?") > 1 {
+		return true
+	}
+	items := 0
+	for _, l := range strings.Split(reply, "\n") {
+		if listItem.MatchString(l) {
+			items++
+		}
+	}
+	return items > 1
+}
+
+// firstQuestion cuts a reply asking several questions after the first one.
+// In a numbered list that is the first item, without its number; text
+// before the list is kept unless it announces the list (ends in a colon).
+func firstQuestion(reply string) string {
+	lines := strings.Split(reply, "\n")
+	for i, l := range lines {
+		loc := listItem.FindStringIndex(l)
+		if loc == nil {
+			continue
+		}
+		intro := strings.TrimSpace(strings.Join(lines[:i], "\n"))
+		if strings.IndexFunc(intro, isQuestionMark) >= 0 {
+			return upToQuestion(intro)
+		}
+		if strings.HasSuffix(intro, ":") {
+			intro = ""
+		}
+		return strings.TrimSpace(intro + "\n" + upToQuestion(l[loc[1]:]))
+	}
+	return upToQuestion(reply)
+}
+
+// upToQuestion returns s up to and including its first question mark, or
+// all of s when it has none.
+func upToQuestion(s string) string {
+	if i := strings.IndexFunc(s, isQuestionMark); i >= 0 {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		s = s[:i+size]
+	}
+	return strings.TrimSpace(s)
+}
+
+// postprocess cleans a reply that passed the output check and, per
+// s.SingleQuestion, keeps it to one question.  A reply requested again
+// goes through the output check like the first one; if it fails the check
+// or the call fails, the first reply is truncated instead.
+func (s *ChatService) postprocess(ctx context.Context, prompts Prompts, msgs []llm.Message, reply string, opts []llm.Option) string {
+	reply = cleanReply(reply)
+	if s.SingleQuestion == SingleQuestionOff || !multipleQuestions(reply) {
+		return reply
+	}
+	if s.SingleQuestion == SingleQuestionReprompt && prompts.SingleQuestion != "" {
+		log.Printf("LLM reply asks several questions; asking again")
+		msgs = append(msgs[:len(msgs):len(msgs)],
+			llm.Message{Role: "assistant", Content: reply},
+			llm.Message{Role: "system", Content: prompts.SingleQuestion})
+		again, err := s.LLM.Chat(ctx, msgs, s.options(opts)...)
+		if err != nil {
+			log.Printf("ask again for a single question: %v", err)
+		} else if reason := checkReply(prompts, again); reason != "" {
+			log.Printf("LLM reply asked again for a single question rejected (%s)", reason)
+		} else if again = cleanReply(again); !multipleQuestions(again) {
+			return again
+		} else {
+			reply = again
+		}
+	}
+	return firstQuestion(reply)
+}
+
+// ellipsis marks a reply cut inside a sentence.
+const ellipsis = "…"
+
+// isSentenceEnd reports whether r ends a sentence, in Persian, Arabic or
+// Latin script.
+func isSentenceEnd(r rune) bool {
+	switch r {
+	case '.', '!', '?', '؟', '۔', '…':
+		return true
+	}
+	return false
+}
+
+// isClauseEnd reports whether r ends a clause: a comma, semicolon or
+// colon, in Persian, Arabic or Latin script.
+func isClauseEnd(r rune) bool {
+	switch r {
+	case '،', ',', '؛', ';', ':':
+		return true
+	}
+	return false
+}
+
+// truncateReply cuts a reply longer than max characters at the last
+// sentence end that keeps it within max.  Punctuation only ends a sentence
+// before a space or the end of the reply, so "2.5" is not split.  When
+// the first sentence alone is too long it is cut at its last clause end,
+// or else its last space, and ends with an ellipsis.  max <= 0 leaves the
+// reply as it is.
+func truncateReply(reply string, max int) string {
+	text := []rune(reply)
+	if max <= 0 || len(text) <= max {
+		return reply
+	}
+	sentence, clause, space := -1, -1, -1
+	for i := 0; i < max; i++ {
+		r := text[i]
+		boundary := i+1 == len(text) || unicode.IsSpace(text[i+1])
+		switch {
+		case r == '\n':
+			sentence, space = i, i
+		case unicode.IsSpace(r):
+			space = i
+		case isSentenceEnd(r) && boundary:
+			sentence = i + 1
+		case isClauseEnd(r) && boundary:
+			clause = i
+		}
+	}
+	var cut string
+	switch {
+	case sentence > 0:
+		cut = string(text[:sentence])
+	case clause > 0:
+		cut = string(text[:clause]) + ellipsis
+	case space > 0:
+		cut = strings.TrimSpace(string(text[:space])) + ellipsis
+	default:
+		cut = string(text[:max-1]) + ellipsis
+	}
+	log.Printf("LLM reply of %d characters cut to %d", len(text), utf8.RuneCountInString(cut))
+	return strings.TrimSpace(cut)
+}
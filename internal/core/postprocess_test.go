@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+func TestCleanReply(t *testing.T) {
+	tests := []struct{ reply, want string }{
+		{"از کی این درد را دارید؟", "از کی این درد را دارید؟"},
+		{"assistant: از کی این درد را دارید؟", "از کی این درد را دارید؟"},
+		{"Assistant： دستیار: از کی این درد را دارید؟", "از کی این درد را دارید؟"},
+		{"**assistant:** از کی این درد را دارید؟", "از کی این درد را دارید؟"},
+		{"ربات:  درد در کدام قسمت سر است؟", "درد در کدام قسمت سر است؟"},
+		{"## سؤال\n**از کی** این درد را `دارید`؟", "سؤال\nاز کی این درد را دارید؟"},
+		{"متوجه شدم.  \n\n\n\n  \nاز کی این درد را دارید؟\t", "متوجه شدم.\n\nاز کی این درد را دارید؟"},
+		{"\n\n  از کی این درد را دارید؟  \n\n", "از کی این درد را دارید؟"},
+	}
+	for _, tt := range tests {
+		if got := cleanReply(tt.reply); got != tt.want {
+			t.Errorf("cleanReply(%q) = %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+}
+
+// problematicReplies are replies asking several questions at once, as the
+// model returns them, with the first question alone.
+var problematicReplies = []struct{ reply, first string }{
+	{
+		"از کی این درد را دارید؟ آیا تب هم دارید؟ دارویی مصرف می‌کنید؟",
+		"از کی این درد را دارید؟",
+	},
+	{
+		"متوجه شدم. لطفاً به این سؤال‌ها پاسخ دهید:\n1. از کی این درد را دارید؟\n2. آیا تب هم دارید؟\n3. دارویی مصرف می‌کنید؟",
+		"از کی این درد را دارید؟",
+	},
+	{
+		"ممنون که گفتید.\n۱) درد در کدام قسمت سر است؟\n۲) شدت درد از ۱ تا ۱۰ چقدر است؟",
+		"ممنون که گفتید.\nدرد در کدام قسمت سر است؟",
+	},
+	{
+		"آیا سابقه‌ی بیماری قلبی دارید؟\n1- فشار خون\n2- دیابت",
+		"آیا سابقه‌ی بیماری قلبی دارید؟",
+	},
+	{
+		"**دستیار:** درد ناگهانی شروع شد یا کم‌کم؟ همراه با تهوع است؟",
+		"درد ناگهانی شروع شد یا کم‌کم؟",
+	},
+}
+
+func TestFirstQuestion(t *testing.T) {
+	for _, tt := range problematicReplies {
+		reply := cleanReply(tt.reply)
+		if !multipleQuestions(reply) {
+			t.Errorf("%q not taken for several questions", reply)
+		}
+		if got := firstQuestion(reply); got != tt.first {
+			t.Errorf("firstQuestion(%q) = %q, want %q", reply, got, tt.first)
+		}
+	}
+	for _, reply := range []string{
+		"از کی این درد را دارید؟",
+		"متوجه شدم. درد از دیروز شروع شده است.",
+		"لطفاً بگویید درد از ۱ تا ۱۰ چقدر است؟",
+	} {
+		if multipleQuestions(reply) {
+			t.Errorf("%q taken for several questions", reply)
+		}
+	}
+}
+
+func TestSingleQuestion(t *testing.T) {
+	prompts := DefaultPrompts()
+	const single = "از کی این درد را دارید؟"
+	for _, tt := range problematicReplies {
+		tests := []struct {
+			mode    SingleQuestionMode
+			replies []string
+			want    string
+			calls   int
+		}{
+			{SingleQuestionOff, []string{tt.reply}, cleanReply(tt.reply), 1},
+			{SingleQuestionTruncate, []string{tt.reply}, tt.first, 1},
+			{SingleQuestionReprompt, []string{tt.reply, single}, single, 2},
+			// Asked again, the model still asks several questions.
+			{SingleQuestionReprompt, []string{tt.reply, tt.reply}, tt.first, 2},
+			// The reply asked for again fails the output check.
+			{SingleQuestionReprompt, []string{tt.reply, "Sure, here are my questions in English."}, tt.first, 2},
+		}
+		for _, c := range tests {
+			fake := llm.NewFakeClient("")
+			fake.ChatReplies = c.replies
+			chat := NewChatService(fake)
+			chat.SingleQuestion = c.mode
+			res, err := chat.ReplyWithPrompts(context.Background(), prompts, "سردرد دارم", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Text != c.want {
+				t.Errorf("%s %q: %q, want %q", c.mode, c.replies, res.Text, c.want)
+			}
+			if len(fake.ChatCalls) != c.calls {
+				t.Errorf("%s %q: %d chat calls, want %d", c.mode, c.replies, len(fake.ChatCalls), c.calls)
+				continue
+			}
+			if c.calls == 2 {
+				again := fake.ChatCalls[1]
+				if last := again[len(again)-1]; last.Role != "system" || last.Content != prompts.SingleQuestion {
+					t.Errorf("reply asked again with %+v, want the single question instruction", last)
+				}
+			}
+		}
+	}
+}
+
+func TestParseSingleQuestionMode(t *testing.T) {
+	for s, want := range map[string]SingleQuestionMode{
+		"": SingleQuestionOff, "off": SingleQuestionOff, " Truncate ": SingleQuestionTruncate, "reprompt": SingleQuestionReprompt,
+	} {
+		if got, ok := ParseSingleQuestionMode(s); !ok || got != want {
+			t.Errorf("ParseSingleQuestionMode(%q) = %q, %v; want %q", s, got, ok, want)
+		}
+	}
+	if _, ok := ParseSingleQuestionMode("first"); ok {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestTruncateReply(t *testing.T) {
+	tests := []struct {
+		name, reply string
+		max         int
+		want        string
+	}{
+		{"fits", "از کی این درد را دارید؟", 80, "از کی این درد را دارید؟"},
+		{"no limit", "درد دارید؟ تب هم دارید؟", 0, "درد دارید؟ تب هم دارید؟"},
+		{"question mark", "متوجه شدم؟ از کی این درد را دارید؟", 20, "متوجه شدم؟"},
+		{"urdu full stop", "متوجه شدم۔ از کی این درد را دارید؟", 20, "متوجه شدم۔"},
+		{"last sentence that fits", "ممنون. درد دارید؟ از کی شروع شد؟", 25, "ممنون. درد دارید؟"},
+		{"line break", "ممنون از توضیحات شما\nاز کی این درد را دارید؟", 30, "ممنون از توضیحات شما"},
+		{"decimal point", "دمای ۳۸.۵ یا 38.5 درجه داشتید؟ از کی؟", 25, "دمای ۳۸.۵ یا 38.5 درجه…"},
+		{"persian comma", "درد از دیروز شروع شده، همراه با تهوع و سرگیجه است؟", 30, "درد از دیروز شروع شده…"},
+		{"persian semicolon", "درد را توضیح دهید؛ شدت و محل آن را بگویید.", 30, "درد را توضیح دهید…"},
+		{"space", "لطفاً محل و شدت و مدت درد خود را بگویید", 20, "لطفاً محل و شدت و…"},
+		{"one long word", "ااااااااااااااااااااااااا", 10, "ااااااااا…"},
+	}
+	for _, tt := range tests {
+		got := truncateReply(tt.reply, tt.max)
+		if got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.max > 0 && len([]rune(got)) > tt.max {
+			t.Errorf("%s: %d characters, over %d", tt.name, len([]rune(got)), tt.max)
+		}
+	}
+}
+
+func TestReplyLength(t *testing.T) {
+	long := "ممنون که توضیح دادید. " + strings.Repeat("درد شما ممکن است دلایل مختلفی داشته باشد. ", 5) + "از کی این درد را دارید؟"
+	fake := llm.NewFakeClient(long)
+	chat := NewChatService(fake)
+	chat.MaxReplyChars = 100
+	res, err := chat.ReplyWithPrompts(context.Background(), DefaultPrompts(), "سردرد دارم", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len([]rune(res.Text)); n > 100 || !strings.HasSuffix(res.Text, ".") {
+		t.Errorf("reply of %d characters %q, want cut at a sentence end within 100", n, res.Text)
+	}
+	system := fake.ChatCalls[0][0].Content
+	if !strings.Contains(system, strings.ReplaceAll(ReplyLengthInstruction, CharsPlaceholder, "100")) {
+		t.Errorf("system prompt does not give the limit:\n%s", system)
+	}
+	if strings.Contains(system, SimpleLanguageInstruction) {
+		t.Error("simple language asked for without being set")
+	}
+
+	// The profile's settings win over the service's, in every locale.
+	profile := &pkg.PromptProfile{Name: "clinic", MaxReplyChars: 250, SimpleLanguage: true}
+	for _, locale := range []string{"fa", "ar"} {
+		fake := llm.NewFakeClient(long)
+		chat := NewChatService(fake)
+		chat.MaxReplyChars = 100
+		prompts := PromptsFor(profile, locale)
+		if _, err := chat.ReplyWithPrompts(context.Background(), prompts, "سردرد دارم", nil); err != nil {
+			t.Fatal(err)
+		}
+		system := fake.ChatCalls[0][0].Content
+		if !strings.Contains(system, strings.ReplaceAll(prompts.Length, CharsPlaceholder, "250")) || !strings.Contains(system, prompts.Simple) {
+			t.Errorf("%s: system prompt lacks the profile's settings:\n%s", locale, system)
+		}
+	}
+}
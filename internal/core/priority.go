@@ -0,0 +1,177 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"waitroom-chatbot/pkg"
+)
+
+// Priority orders sessions on the doctor dashboard; higher is more urgent.
+// It is computed whenever a summary is generated and stored with it.
+type Priority int
+
+const (
+	PriorityDefault      Priority = 0
+	PriorityLongDuration Priority = 1
+	PriorityHighPain     Priority = 2
+	PriorityRedFlag      Priority = 3
+)
+
+// Thresholds used by ScorePriority.
+const (
+	// HighPainThreshold is the lowest 0-10 pain score considered high.
+	HighPainThreshold = 7
+	// LongDurationDays is the symptom duration, in days, from which a
+	// complaint counts as long standing.
+	LongDurationDays = 14
+)
+
+// redFlagPhrases are Persian phrases in patient messages that warrant the
+// doctor's attention ahead of everyone else.
+var redFlagPhrases = []string{
+	"درد قفسه سینه", "درد سینه", "تنگی نفس", "نفس کشیدن سخت", "خونریزی",
+	"استفراغ خونی", "مدفوع سیاه", "بیهوش", "غش", "تشنج", "فلج",
+	"بی‌حسی یک طرف", "کج شدن صورت", "سردرد شدید ناگهانی", "تب بالا",
+}
+
+// ScorePriority rates how urgently a session should be seen: red flags
+// first, then a pain score of HighPainThreshold or more, then symptoms
+// lasting LongDurationDays or longer.  The summary's PainScore and Duration
+// and its "red_flags" field take precedence over what can be read from the
+// transcript.
+func ScorePriority(summary *pkg.Summary, transcript []pkg.Message) Priority {
+	var structured map[string]interface{}
+	var pain *int
+	var duration *pkg.Duration
+	if summary != nil {
+		structured, pain, duration = summary.Structured, summary.PainScore, summary.Duration
+	}
+	if hasRedFlag(structured, transcript) {
+		return PriorityRedFlag
+	}
+	if pain == nil {
+		if v, ok := answerTo(transcript, TopicPain, parsePain); ok {
+			pain = &v
+		}
+	}
+	if pain != nil && *pain >= HighPainThreshold {
+		return PriorityHighPain
+	}
+	if duration == nil {
+		if d, ok := answerTo(transcript, TopicDuration, ParseDuration); ok {
+			duration = &d
+		}
+	}
+	if duration != nil && duration.Days() >= LongDurationDays {
+		return PriorityLongDuration
+	}
+	return PriorityDefault
+}
+
+// MentionsRedFlag reports whether a patient message mentions a red-flag
+// symptom, as ReplyResult's FlagRedFlag does.
+func MentionsRedFlag(content string) bool {
+	return hasRedFlag(nil, []pkg.Message{{Role: pkg.RolePatient, Content: content}})
+}
+
+func hasRedFlag(structured map[string]interface{}, transcript []pkg.Message) bool {
+	if flags, ok := structured["red_flags"].([]interface{}); ok && len(flags) > 0 {
+		return true
+	}
+	for _, m := range transcript {
+		if m.Role != pkg.RolePatient {
+			continue
+		}
+		for _, p := range redFlagPhrases {
+			if strings.Contains(m.Content, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerTo parses the patient's answer to the last bot question about the
+// topic.  It returns false when the topic was not asked or the answer does
+// not parse.
+func answerTo[T any](transcript []pkg.Message, topic Topic, parse func(string) (T, bool)) (T, bool) {
+	asked := false
+	var value T
+	found := false
+	for _, m := range transcript {
+		switch m.Role {
+		case pkg.RoleBot:
+			asked = false
+			for _, w := range topicKeywords[topic] {
+				if strings.Contains(m.Content, w) {
+					asked = true
+					break
+				}
+			}
+		case pkg.RolePatient:
+			if asked {
+				if v, ok := parse(m.Content); ok {
+					value, found = v, true
+				}
+				asked = false
+			}
+		}
+	}
+	return value, found
+}
+
+// parsePain reads a 0-10 pain score from the first number in s.
+func parsePain(s string) (int, bool) {
+	n, _, ok := firstNumber(s)
+	if !ok || n > 10 {
+		return 0, false
+	}
+	return n, true
+}
+
+// firstNumber returns the first run of ASCII, Persian or Arabic-Indic digits
+// in s and the text following it.
+func firstNumber(s string) (int, string, bool) {
+	var digits strings.Builder
+	end := -1
+	for i, r := range s {
+		if !unicode.IsDigit(r) {
+			if digits.Len() > 0 {
+				end = i
+				break
+			}
+			continue
+		}
+		switch {
+		case r >= '۰' && r <= '۹':
+			r = '0' + (r - '۰')
+		case r >= '٠' && r <= '٩':
+			r = '0' + (r - '٠')
+		}
+		digits.WriteRune(r)
+	}
+	if digits.Len() == 0 {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(digits.String())
+	if err != nil {
+		return 0, "", false
+	}
+	if end < 0 {
+		return n, "", true
+	}
+	return n, s[end:], true
+}
+
+// number converts a JSON number from the structured summary to an int.
+func number(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+// conversation returns a transcript alternating bot questions and patient
+// answers, starting with the bot.
+func conversation(contents ...string) []pkg.Message {
+	var ms []pkg.Message
+	for i, c := range contents {
+		role := pkg.RoleBot
+		if i%2 == 1 {
+			role = pkg.RolePatient
+		}
+		ms = append(ms, pkg.Message{Role: role, Content: c})
+	}
+	return ms
+}
+
+func TestScorePriority(t *testing.T) {
+	pain := func(v int) *int { return &v }
+	days := func(n int) *pkg.Duration { return &pkg.Duration{Value: n, Unit: pkg.UnitDay} }
+	tests := []struct {
+		name       string
+		summary    *pkg.Summary
+		transcript []pkg.Message
+		want       Priority
+	}{
+		{"nothing known", nil, nil, PriorityDefault},
+		{"red flag in a message", nil, conversation("چه مشکلی دارید؟", "از صبح درد قفسه سینه دارم"), PriorityRedFlag},
+		{"red flag in a bot message", nil, []pkg.Message{{Role: pkg.RoleBot, Content: "تنگی نفس دارید؟"}}, PriorityDefault},
+		{"red flag in the summary", &pkg.Summary{Structured: map[string]interface{}{"red_flags": []interface{}{"تشنج"}}}, nil, PriorityRedFlag},
+		{"no red flags listed", &pkg.Summary{Structured: map[string]interface{}{"red_flags": []interface{}{}}}, nil, PriorityDefault},
+		{"red flag beats pain", &pkg.Summary{PainScore: pain(10)}, conversation("چه مشکلی دارید؟", "غش کردم"), PriorityRedFlag},
+		{"high pain", &pkg.Summary{PainScore: pain(HighPainThreshold)}, nil, PriorityHighPain},
+		{"pain below the threshold", &pkg.Summary{PainScore: pain(HighPainThreshold - 1)}, nil, PriorityDefault},
+		{"high pain answered", nil, conversation("شدت درد از ۰ تا ۱۰ چند است؟", "۸"), PriorityHighPain},
+		{"pain answer out of range", nil, conversation("شدت درد از ۰ تا ۱۰ چند است؟", "۸۰"), PriorityDefault},
+		{"number not answering the pain question", nil, conversation("چند سال دارید؟", "۹"), PriorityDefault},
+		{"summary pain wins", &pkg.Summary{PainScore: pain(3)}, conversation("شدت درد از ۰ تا ۱۰ چند است؟", "۹"), PriorityDefault},
+		{"pain beats duration", &pkg.Summary{PainScore: pain(9), Duration: days(30)}, nil, PriorityHighPain},
+		{"long duration", &pkg.Summary{Duration: days(LongDurationDays)}, nil, PriorityLongDuration},
+		{"short duration", &pkg.Summary{Duration: days(LongDurationDays - 1)}, nil, PriorityDefault},
+		{"long duration answered", nil, conversation("از چه زمانی شروع شده است؟", "سه هفته"), PriorityLongDuration},
+		{"short duration answered", nil, conversation("از چه زمانی شروع شده است؟", "دو روز"), PriorityDefault},
+	}
+	for _, tt := range tests {
+		if got := ScorePriority(tt.summary, tt.transcript); got != tt.want {
+			t.Errorf("%s: priority %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryPriorityRecomputed(t *testing.T) {
+	fake := llm.NewFakeClient("")
+	fake.SummaryReply = `{"key_points":["سردرد"],"structured":{},"free_text":"بیمار سردرد دارد."}`
+	s := NewSummarizer(fake, nil)
+	ctx := context.Background()
+	transcript := conversation("چه مشکلی دارید؟", "سردرد دارم")
+	first, err := s.Summarize(ctx, "s", transcript, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Priority != int(PriorityDefault) {
+		t.Fatalf("first summary priority %d", first.Priority)
+	}
+	// The stored priority is not carried over; the update is scored anew.
+	transcript = append(transcript, conversation("شدت درد از ۰ تا ۱۰ چند است؟", "۹")...)
+	second, err := s.Summarize(ctx, "s", transcript, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Priority != int(PriorityHighPain) {
+		t.Errorf("updated summary priority %d, want %d", second.Priority, PriorityHighPain)
+	}
+	fake.Err = context.DeadlineExceeded
+	transcript = append(transcript, conversation("چیز دیگری هست؟", "تنگی نفس هم دارم")...)
+	if fallback, _ := s.Summarize(ctx, "s", transcript, second); fallback.Priority != int(PriorityRedFlag) {
+		t.Errorf("fallback summary priority %d, want %d", fallback.Priority, PriorityRedFlag)
+	}
+}
@@ -0,0 +1,240 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+// Prompts is the set of prompts and canned bot messages used for one
+// session.  It is resolved from the session's locale and prompt profile,
+// falling back to the built-in constants.
+type Prompts struct {
+	System       string
+	FirstMessage string
+	Summarize    string
+	// Canned messages sent instead of an LLM reply.
+	Cap         string
+	CapReset    string
+	Closing     string
+	Unavailable string
+	Budget      string
+	ClosedHours string
+	// Guard is appended to System and Strict added when a reply is
+	// requested again after failing the output check.  SingleQuestion is
+	// added when a reply is requested again for asking several questions,
+	// Loop for repeating an earlier one.
+	Guard          string
+	Strict         string
+	SingleQuestion string
+	Loop           string
+	// Length is appended to System when MaxReplyChars limits the length
+	// of replies, with CharsPlaceholder standing for the limit, and Simple
+	// when SimpleLanguage is set.
+	Length         string
+	Simple         string
+	MaxReplyChars  int
+	SimpleLanguage bool
+	// TopicQuestions are the canned questions moving the conversation on
+	// to each topic but the chief complaint (see breakLoop).
+	TopicQuestions map[Topic]string
+	// Script is the Unicode script (e.g. "Arabic") replies must be
+	// predominantly written in.
+	Script string
+	// SummaryLanguage is the code of the language summaries are written
+	// in, one of SummaryLanguages; empty for DefaultSummaryLanguage.
+	SummaryLanguage string
+}
+
+// DefaultPrompts returns the built-in Persian prompts.
+func DefaultPrompts() Prompts {
+	return Prompts{
+		System:         SystemPrompt,
+		FirstMessage:   FirstMessage,
+		Summarize:      SummarizationInstruction,
+		Cap:            CapMessage,
+		CapReset:       CapResetMessage,
+		Closing:        ClosingMessage,
+		Unavailable:    UnavailableMessage,
+		Budget:         BudgetMessage,
+		ClosedHours:    ClosedHoursMessage,
+		Guard:          GuardInstruction,
+		Strict:         StrictInstruction,
+		SingleQuestion: SingleQuestionInstruction,
+		Loop:           LoopInstruction,
+		Length:         ReplyLengthInstruction,
+		Simple:         SimpleLanguageInstruction,
+		TopicQuestions: copyTopicQuestions(topicQuestions),
+		Script:         i18n.T(i18n.Default, "locale.script"),
+	}
+}
+
+// localeKeys maps the i18n keys of the patient-facing prompts to their
+// fields.  Summaries are read by the doctor, so Summarize stays Persian.
+var localeKeys = map[string]func(*Prompts) *string{
+	"bot.system":          func(p *Prompts) *string { return &p.System },
+	"bot.first_message":   func(p *Prompts) *string { return &p.FirstMessage },
+	"bot.cap":             func(p *Prompts) *string { return &p.Cap },
+	"bot.cap_reset":       func(p *Prompts) *string { return &p.CapReset },
+	"bot.closing":         func(p *Prompts) *string { return &p.Closing },
+	"bot.unavailable":     func(p *Prompts) *string { return &p.Unavailable },
+	"bot.budget":          func(p *Prompts) *string { return &p.Budget },
+	"bot.closed_hours":    func(p *Prompts) *string { return &p.ClosedHours },
+	"bot.guard":           func(p *Prompts) *string { return &p.Guard },
+	"bot.strict":          func(p *Prompts) *string { return &p.Strict },
+	"bot.single_question": func(p *Prompts) *string { return &p.SingleQuestion },
+	"bot.loop":            func(p *Prompts) *string { return &p.Loop },
+	"bot.length":          func(p *Prompts) *string { return &p.Length },
+	"bot.simple_language": func(p *Prompts) *string { return &p.Simple },
+	"locale.script":       func(p *Prompts) *string { return &p.Script },
+}
+
+// LocalePrompts returns the built-in prompts translated into locale.
+// Messages the locale's catalog does not translate stay Persian.
+func LocalePrompts(locale string) Prompts {
+	out := DefaultPrompts()
+	for key, field := range localeKeys {
+		if msg, ok := i18n.Lookup(locale, key); ok {
+			*field(&out) = msg
+		}
+	}
+	for t := range out.TopicQuestions {
+		if msg, ok := i18n.Lookup(locale, "bot.topic."+string(t)); ok {
+			out.TopicQuestions[t] = msg
+		}
+	}
+	return out
+}
+
+func copyTopicQuestions(m map[Topic]string) map[Topic]string {
+	out := make(map[Topic]string, len(m))
+	for t, q := range m {
+		out[t] = q
+	}
+	return out
+}
+
+// PromptsFor resolves the prompts for a profile in a locale.  A nil profile
+// or empty profile fields fall back to LocalePrompts.  Profiles are written
+// in Persian, so their prompts only apply to sessions in the default
+// locale; the reply length, simple language and summary language settings
+// apply to all.
+func PromptsFor(p *pkg.PromptProfile, locale string) Prompts {
+	out := LocalePrompts(locale)
+	if p == nil {
+		return out
+	}
+	out.MaxReplyChars, out.SimpleLanguage = p.MaxReplyChars, p.SimpleLanguage
+	out.SummaryLanguage = p.SummaryLanguage
+	if i18n.Normalize(locale) != i18n.Default {
+		return out
+	}
+	if p.SystemPrompt != "" {
+		out.System = p.SystemPrompt
+	}
+	if p.FirstMessage != "" {
+		out.FirstMessage = p.FirstMessage
+	}
+	if p.SummarizeInstruction != "" {
+		out.Summarize = p.SummarizeInstruction
+	}
+	return out
+}
+
+// ClinicPlaceholder in a first message stands for the name of the
+// session's clinic, e.g. "به {clinic} خوش آمدید".
+const ClinicPlaceholder = "{clinic}"
+
+// Greeting returns the first message with ClinicPlaceholder replaced by
+// the clinic's name.
+func (p Prompts) Greeting(clinic string) string {
+	return strings.ReplaceAll(p.FirstMessage, ClinicPlaceholder, clinic)
+}
+
+// LanguagePlaceholder in Summarize stands for the name of the language the
+// summary is written in.
+const LanguagePlaceholder = "{language}"
+
+// CharsPlaceholder in Length stands for the maximum reply length.
+const CharsPlaceholder = "{chars}"
+
+// MinReplyChars is the lowest maximum reply length that may be configured;
+// below it even a single short question would be cut.
+const MinReplyChars = 80
+
+// system returns the system prompt: System followed by Guard and, when
+// set, the reply length and simple language instructions.
+func (p Prompts) system() string {
+	system := p.System
+	if p.Guard != "" {
+		system += "\n\n" + p.Guard
+	}
+	if p.MaxReplyChars > 0 && p.Length != "" {
+		system += "\n\n" + strings.ReplaceAll(p.Length, CharsPlaceholder, strconv.Itoa(p.MaxReplyChars))
+	}
+	if p.SimpleLanguage && p.Simple != "" {
+		system += "\n\n" + p.Simple
+	}
+	return system
+}
+
+// TimePlaceholder in CapReset stands for when the cap resets.
+const TimePlaceholder = "{time}"
+
+// CapNotice returns the cap message, followed by CapReset with the Jalali
+// date and Tehran time of resetsAt when the cap resets at a known time.
+func (p Prompts) CapNotice(resetsAt time.Time) string {
+	if resetsAt.IsZero() {
+		return p.Cap
+	}
+	return p.Cap + " " + strings.ReplaceAll(p.CapReset, TimePlaceholder, jalali.FormatDateTime(resetsAt))
+}
+
+// ClosedHoursNotice returns the closed hours message, followed by CapReset
+// with the Jalali date and Tehran time of opensAt when the bot answers again
+// at a known time.
+func (p Prompts) ClosedHoursNotice(opensAt time.Time) string {
+	if opensAt.IsZero() {
+		return p.ClosedHours
+	}
+	return p.ClosedHours + " " + strings.ReplaceAll(p.CapReset, TimePlaceholder, jalali.FormatDateTime(opensAt))
+}
+
+// MaxPromptTokens bounds each prompt and canned message, so a profile
+// pasted twice or a runaway edit is caught before it eats the context
+// window of every call.
+const MaxPromptTokens = 4000
+
+// CheckPrompts reports every prompt of p that is empty or longer than
+// MaxPromptTokens.  name says where p comes from in the errors.
+func CheckPrompts(name string, p Prompts) error {
+	var errs []error
+	for _, f := range []struct {
+		field, text string
+	}{
+		{"system", p.System}, {"first message", p.FirstMessage}, {"summarize", p.Summarize},
+		{"cap", p.Cap}, {"cap reset", p.CapReset}, {"closing", p.Closing}, {"unavailable", p.Unavailable}, {"budget", p.Budget},
+		{"closed hours", p.ClosedHours},
+		{"guard", p.Guard}, {"strict", p.Strict}, {"single question", p.SingleQuestion}, {"loop", p.Loop},
+		{"length", p.Length}, {"simple language", p.Simple},
+	} {
+		if f.text == "" {
+			errs = append(errs, fmt.Errorf("%s: %s prompt is empty", name, f.field))
+		} else if n := llm.EstimateTokens(f.text); n > MaxPromptTokens {
+			errs = append(errs, fmt.Errorf("%s: %s prompt is about %d tokens, over %d", name, f.field, n, MaxPromptTokens))
+		}
+	}
+	for _, t := range AllTopics[1:] {
+		if p.TopicQuestions[t] == "" {
+			errs = append(errs, fmt.Errorf("%s: no question for topic %s", name, t))
+		}
+	}
+	return errors.Join(errs...)
+}
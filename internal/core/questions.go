@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"waitroom-chatbot/pkg"
+)
+
+// MaxQuestions is the number of follow-up questions suggested to the
+// doctor.
+const MaxQuestions = 3
+
+// SuggestQuestions asks the LLM for up to MaxQuestions short Persian
+// questions the doctor could ask the patient, targeting gaps or
+// inconsistencies in the summary's structured data.  It uses the summary
+// model and options and is meant for the background summarisation path.
+func (s *Summarizer) SuggestQuestions(ctx context.Context, summary *pkg.Summary, transcript []pkg.Message) ([]string, error) {
+	structured, err := json.Marshal(summary.Structured)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString(QuestionsInstruction)
+	b.WriteString("\n\nخلاصه‌ی ساختاریافته:\n")
+	b.Write(structured)
+	b.WriteString("\n\nگفت‌وگو:\n")
+	for _, m := range transcript {
+		role := "بیمار"
+		if m.Role == pkg.RoleBot {
+			role = "دستیار"
+		}
+		b.WriteString(role + ": " + m.Content + "\n")
+	}
+	resp, err := s.LLM.Summarize(ctx, b.String(), s.Options...)
+	if err != nil {
+		return nil, err
+	}
+	return parseQuestions(resp), nil
+}
+
+// parseQuestions reads the questions from a JSON array of strings, or
+// failing that one per line with any list numbering removed, keeping at
+// most MaxQuestions.
+func parseQuestions(resp string) []string {
+	var lines []string
+	resp = strings.TrimSpace(resp)
+	resp = strings.TrimSuffix(strings.TrimPrefix(resp, "```json"), "```")
+	if err := json.Unmarshal([]byte(strings.TrimSpace(resp)), &lines); err != nil {
+		lines = strings.Split(resp, "\n")
+	}
+	var out []string
+	for _, l := range lines {
+		l = strings.TrimLeftFunc(l, func(r rune) bool {
+			return unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("-*•.)", r)
+		})
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		out = append(out, l)
+		if len(out) == MaxQuestions {
+			break
+		}
+	}
+	return out
+}
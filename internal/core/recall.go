@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+// RecallStore lists a patient's earlier summaries.
+type RecallStore interface {
+	ListPastSummaries(ctx context.Context, nationalID, excludeSessionID string, limit int) ([]pkg.Summary, error)
+}
+
+// Recall reminds the chat model of a returning patient's previous visits.
+// Past summaries are ranked by the similarity of their embeddings to the
+// current conversation; when none has an embedding (or the query cannot be
+// embedded) the most recent past summary is used instead.
+type Recall struct {
+	LLM   llm.Client
+	Store RecallStore
+	// Limit is the number of past visits added to the prompt and
+	// Candidates the number of recent sessions compared.
+	Limit      int
+	Candidates int
+}
+
+// NewRecall constructs a Recall adding up to two of the last twenty visits.
+func NewRecall(client llm.Client, store RecallStore) *Recall {
+	return &Recall{LLM: client, Store: store, Limit: 2, Candidates: 20}
+}
+
+// Prompts returns prompts with a RecallHeading block of the patient's most
+// relevant past visits appended to the system prompt.  query is the current
+// conversation, e.g. the patient's messages so far.  Failures are logged
+// and leave the prompts unchanged.
+func (r *Recall) Prompts(ctx context.Context, prompts Prompts, nationalID, sessionID, query string) Prompts {
+	past, err := r.Store.ListPastSummaries(ctx, nationalID, sessionID, r.Candidates)
+	if err != nil {
+		log.Printf("recall past visits for session %s: %v", sessionID, err)
+		return prompts
+	}
+	visits := r.relevant(ctx, past, query)
+	if len(visits) == 0 {
+		return prompts
+	}
+	var b strings.Builder
+	b.WriteString(prompts.System)
+	b.WriteString("\n\n")
+	b.WriteString(RecallHeading)
+	for _, v := range visits {
+		text := v.FreeText
+		if text == "" {
+			text = strings.Join(v.KeyPoints, "؛ ")
+		}
+		b.WriteString("\n- " + v.UpdatedAt.Format("2006-01-02") + ": " + text)
+	}
+	prompts.System = b.String()
+	return prompts
+}
+
+// relevant picks the past summaries most similar to query, in chronological
+// order, falling back to the most recent one.
+func (r *Recall) relevant(ctx context.Context, past []pkg.Summary, query string) []pkg.Summary {
+	if len(past) == 0 {
+		return nil
+	}
+	fallback := past[:1]
+	var embedded []pkg.Summary
+	for _, s := range past {
+		if len(s.Embedding) > 0 {
+			embedded = append(embedded, s)
+		}
+	}
+	if len(embedded) == 0 || strings.TrimSpace(query) == "" {
+		return fallback
+	}
+	q, err := r.LLM.Embed(ctx, query)
+	if err != nil {
+		log.Printf("embed recall query: %v", err)
+		return fallback
+	}
+	sort.SliceStable(embedded, func(i, j int) bool {
+		return llm.Cosine(q, embedded[i].Embedding) > llm.Cosine(q, embedded[j].Embedding)
+	})
+	if len(embedded) > r.Limit {
+		embedded = embedded[:r.Limit]
+	}
+	sort.SliceStable(embedded, func(i, j int) bool { return embedded[i].UpdatedAt.Before(embedded[j].UpdatedAt) })
+	return embedded
+}
+
+// embeddingText is the text of a summary that is embedded for recall.
+func embeddingText(s *pkg.Summary) string {
+	return strings.Join(append(s.KeyPoints[:len(s.KeyPoints):len(s.KeyPoints)], s.FreeText), "\n")
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+// ReplayFixtures holds the built-in conversation fixtures for Replay: an
+// intake covering every topic and the red-flag escalation cases.
+//
+//go:embed fixtures/*.json
+var ReplayFixtures embed.FS
+
+// Fixture is a recorded conversation to replay against the chat prompt,
+// e.g. after changing SystemPrompt.
+type Fixture struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Turns       []FixtureTurn `json:"turns"`
+}
+
+// FixtureTurn is a patient message of a fixture with what is expected of
+// the reply to it.  Bot is the reply recorded for it, which a recorded
+// replay has the model answer; the bot's replies in the history of later
+// turns are the replies of the replay itself.
+type FixtureTurn struct {
+	Patient string `json:"patient"`
+	Bot     string `json:"bot,omitempty"`
+	// RedFlag says the message mentions a red-flag symptom (see
+	// FlagRedFlag), and WrapUp that the bot should send the closing message
+	// in reply.
+	RedFlag bool `json:"red_flag,omitempty"`
+	WrapUp  bool `json:"wrap_up,omitempty"`
+}
+
+// LoadFixtures reads the fixtures in the JSON files of a directory of
+// fsys, sorted by name.
+func LoadFixtures(fsys fs.FS, dir string) ([]Fixture, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		var f Fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if f.Name == "" || len(f.Turns) == 0 {
+			return nil, fmt.Errorf("%s: a fixture needs a name and turns", name)
+		}
+		fixtures = append(fixtures, f)
+	}
+	sort.Slice(fixtures, func(i, j int) bool { return fixtures[i].Name < fixtures[j].Name })
+	return fixtures, nil
+}
+
+// ReplayReport is the outcome of replaying a fixture.
+type ReplayReport struct {
+	Fixture string
+	Turns   []ReplayTurn
+}
+
+// ReplayTurn is a replayed patient message with the bot's reply and the
+// expectations the reply failed, if any.
+type ReplayTurn struct {
+	Patient  string
+	Reply    string
+	Failures []string
+}
+
+// Failed reports whether a reply of the replay failed an expectation.
+func (r ReplayReport) Failed() bool {
+	for _, t := range r.Turns {
+		if len(t.Failures) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Replay sends the patient turns of a fixture through the chat service in
+// order, as the server does, and checks each reply: it is in Persian
+// script only, asks at most one question, is within the reply length limit
+// and carries the red-flag flag and is the closing message exactly when
+// the turn expects it.  With recorded set the model is not called; each
+// turn's recorded reply stands in for its answer, going through the same
+// checks and post-processing.  A turn whose reply fails stops the replay.
+func (s *ChatService) Replay(ctx context.Context, prompts Prompts, f Fixture, recorded bool) ReplayReport {
+	report := ReplayReport{Fixture: f.Name}
+	limit := s.withDefaults(prompts).MaxReplyChars
+	var history []pkg.Message
+	for _, turn := range f.Turns {
+		rt := ReplayTurn{Patient: turn.Patient}
+		patient := pkg.Message{Role: pkg.RolePatient, Content: turn.Patient}
+		wrapUp := s.ShouldWrapUp(append(history[:len(history):len(history)], patient))
+		var res ReplyResult
+		if wrapUp {
+			res = newReplyResult(turn.Patient)
+			res.Text = prompts.Closing
+		} else {
+			chat := s
+			if recorded {
+				if turn.Bot == "" {
+					rt.Failures = append(rt.Failures, "no recorded reply to replay")
+					report.Turns = append(report.Turns, rt)
+					return report
+				}
+				c := *s
+				c.LLM = llm.NewFakeClient(turn.Bot)
+				chat = &c
+			}
+			var err error
+			if res, err = chat.ReplyWithPrompts(ctx, prompts, turn.Patient, history); err != nil {
+				rt.Failures = append(rt.Failures, "reply failed: "+err.Error())
+				report.Turns = append(report.Turns, rt)
+				return report
+			}
+		}
+		rt.Reply = res.Text
+		if latin := latinLetters(res.Text); latin > 0 {
+			rt.Failures = append(rt.Failures, fmt.Sprintf("reply has %d Latin letters", latin))
+		}
+		if multipleQuestions(res.Text) {
+			rt.Failures = append(rt.Failures, "reply asks more than one question")
+		}
+		if n := utf8.RuneCountInString(res.Text); limit > 0 && n > limit {
+			rt.Failures = append(rt.Failures, fmt.Sprintf("reply is %d characters, over the limit of %d", n, limit))
+		}
+		if flagged := res.HasFlag(FlagRedFlag); flagged != turn.RedFlag {
+			rt.Failures = append(rt.Failures, fmt.Sprintf("red flag raised: %t, want %t", flagged, turn.RedFlag))
+		}
+		if wrapUp != turn.WrapUp {
+			rt.Failures = append(rt.Failures, fmt.Sprintf("wrapped up: %t, want %t", wrapUp, turn.WrapUp))
+		}
+		report.Turns = append(report.Turns, rt)
+		if len(rt.Failures) > 0 {
+			return report
+		}
+		history = append(history, patient, pkg.Message{Role: pkg.RoleBot, Content: res.Text})
+	}
+	return report
+}
+
+// latinLetters counts the Latin letters in s.
+func latinLetters(s string) int {
+	n := 0
+	for _, r := range s {
+		if unicode.Is(unicode.Latin, r) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/llm"
+)
+
+func TestReplayFixtures(t *testing.T) {
+	fixtures, err := LoadFixtures(ReplayFixtures, "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) < 5 {
+		t.Fatalf("%d fixtures loaded", len(fixtures))
+	}
+	prompts := DefaultPrompts()
+	chat := NewChatService(llm.NewFakeClient(""))
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			report := chat.Replay(context.Background(), prompts, f, true)
+			if report.Fixture != f.Name || len(report.Turns) != len(f.Turns) {
+				t.Errorf("replayed %d of %d turns", len(report.Turns), len(f.Turns))
+			}
+			for i, rt := range report.Turns {
+				for _, failure := range rt.Failures {
+					t.Errorf("turn %d (%s): %s", i+1, rt.Patient, failure)
+				}
+				if rt.Patient != f.Turns[i].Patient {
+					t.Errorf("turn %d replayed %q", i+1, rt.Patient)
+				}
+				switch {
+				case f.Turns[i].WrapUp:
+					if rt.Reply != prompts.Closing {
+						t.Errorf("turn %d: wrap-up reply %q, want the closing message", i+1, rt.Reply)
+					}
+				case rt.Reply == "":
+					t.Errorf("turn %d: empty reply", i+1)
+				}
+			}
+			if report.Failed() {
+				t.Errorf("report failed")
+			}
+		})
+	}
+}
+
+func TestReplayCleansRecordedReplies(t *testing.T) {
+	fixtures, err := LoadFixtures(ReplayFixtures, "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		if f.Name != "reply_cleanup" {
+			continue
+		}
+		report := NewChatService(llm.NewFakeClient("")).Replay(context.Background(), DefaultPrompts(), f, true)
+		for i, rt := range report.Turns {
+			if strings.ContainsAny(rt.Reply, "*#") || strings.HasPrefix(rt.Reply, "ربات:") {
+				t.Errorf("turn %d: reply %q kept its markup or label", i+1, rt.Reply)
+			}
+			if rt.Reply == f.Turns[i].Bot {
+				t.Errorf("turn %d: recorded reply passed through unchanged", i+1)
+			}
+		}
+		return
+	}
+	t.Fatal("no reply_cleanup fixture")
+}
+
+func TestReplayReportsFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		turn    FixtureTurn
+		failure string
+	}{
+		{"english reply", FixtureTurn{Patient: "سلام", Bot: "Hello, how are you?"}, "reply failed"},
+		{"two questions", FixtureTurn{Patient: "سلام", Bot: "از کی شروع شده؟ دارویی مصرف می‌کنید؟"}, "more than one question"},
+		{"missed red flag", FixtureTurn{Patient: "درد قفسه سینه و تنگی نفس دارم.", Bot: "از کی شروع شده است؟"}, "red flag raised: true, want false"},
+		{"unexpected red flag", FixtureTurn{Patient: "سرفه دارم.", Bot: "از کی شروع شده است؟", RedFlag: true}, "red flag raised: false, want true"},
+		{"no recording", FixtureTurn{Patient: "سلام"}, "no recorded reply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := FixtureTurn{Patient: "بعدی", Bot: "ممنون."}
+			f := Fixture{Name: tt.name, Turns: []FixtureTurn{tt.turn, next}}
+			report := NewChatService(llm.NewFakeClient("")).Replay(context.Background(), DefaultPrompts(), f, true)
+			if !report.Failed() {
+				t.Fatalf("report passed: %+v", report)
+			}
+			// A failing turn stops the replay.
+			if len(report.Turns) != 1 {
+				t.Errorf("replayed %d turns after a failure", len(report.Turns))
+			}
+			if failures := strings.Join(report.Turns[0].Failures, "; "); !strings.Contains(failures, tt.failure) {
+				t.Errorf("failures %q, want %q", failures, tt.failure)
+			}
+		})
+	}
+}
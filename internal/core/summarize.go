@@ -2,11 +2,18 @@ package core
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"waitroom-chatbot/internal/llm"
 	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
 )
 
 // Summarizer coordinates extraction of structured data and free‑text summary from
@@ -14,20 +21,262 @@ import (
 // extraction.  In the MVP this is a simple stub.
 type Summarizer struct {
 	LLM llm.Client
+	// Store persists summaries for Refresh.
+	Store SummaryStore
+	// Options are passed to every summarisation call.
+	Options []llm.Option
+	// Embed stores an embedding of every new summary so Recall can find
+	// similar past visits.
+	Embed bool
 }
 
-// NewSummarizer constructs a summariser.
-func NewSummarizer(client llm.Client) *Summarizer {
-	return &Summarizer{LLM: client}
+// SummaryStore persists summaries together with the hash of the transcript
+// they were generated from.  ClaimSummary must atomically decide whether a
+// regeneration is needed so concurrent workers do not both call the LLM.
+// RecordSummaryFailure records a failed regeneration, which UpsertSummary
+// does not store, so the doctor can be warned the summary is stale.
+type SummaryStore interface {
+	GetSummary(ctx context.Context, sessionID string) (*pkg.Summary, error)
+	ClaimSummary(ctx context.Context, sessionID, hash string, force bool) (bool, error)
+	ReleaseSummaryClaim(ctx context.Context, sessionID, hash string) error
+	UpsertSummary(ctx context.Context, s *pkg.Summary) error
+	RecordSummaryFailure(ctx context.Context, sessionID, errorClass string) error
 }
 
-// Summarize analyses the transcript and produces a Summary. The transcript
-// should contain all messages for a user ordered chronologically.  The old
-// summary can be passed in to support merging; new non‑empty values
-// overwrite previous ones and arrays are deduplicated.  For the MVP, the
+// SummarySchemaVersion is the version of the format of structured
+// summaries: the fields SummarizationInstruction asks for and what the
+// code reading them expects.  It is stored with every summary and must be
+// raised when the format changes incompatibly.
+const SummarySchemaVersion = 1
+
+// ErrInvalidSummary is returned with the summary by SummarizeWithPrompts
+// when the model's response was not the requested JSON object, so the
+// summary only holds the response as free text.
+var ErrInvalidSummary = errs.New(errs.Unavailable, "summary response is not the requested JSON")
+
+// Classes of summarisation errors recorded in pkg.SummaryAttempt.
+const (
+	SummaryErrInvalidJSON    = "invalid_json"
+	SummaryErrRateLimited    = "rate_limited"
+	SummaryErrTimeout        = "timeout"
+	SummaryErrUnavailable    = "unavailable"
+	SummaryErrBudgetExceeded = "budget_exceeded"
+	SummaryErrLLM            = "llm_error"
+	SummaryErrStore          = "store_error"
+)
+
+// SummaryErrorClass returns the class of an error of summarising a
+// session: "unavailable" when the circuit breaker or the concurrency limit
+// turned the call away, "llm_error" for any other failure of the model.
+func SummaryErrorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidSummary):
+		return SummaryErrInvalidJSON
+	case llm.RateLimited(err):
+		return SummaryErrRateLimited
+	case errors.Is(err, context.DeadlineExceeded):
+		return SummaryErrTimeout
+	case errors.Is(err, llm.ErrCircuitOpen), errors.Is(err, llm.ErrBusy):
+		return SummaryErrUnavailable
+	case errors.Is(err, llm.ErrBudgetExceeded):
+		return SummaryErrBudgetExceeded
+	}
+	return SummaryErrLLM
+}
+
+// TranscriptHash returns the hex SHA-256 of the roles and contents of a
+// transcript.  Identical transcripts always hash identically.
+func TranscriptHash(transcript []pkg.Message) string {
+	h := sha256.New()
+	for _, m := range transcript {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.Itoa(len(m.Content))))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Content))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Refresh regenerates and stores the session summary unless the stored one
+// was already produced from an identical transcript (or another worker is
+// producing it), in which case the stored summary is returned without
+// calling the LLM.  force bypasses the check.  The boolean result reports
+// whether the LLM was called.  The outcome of a regeneration is recorded
+// with the summary (see pkg.SummaryAttempt); a response that is not JSON
+// is stored as free text but recorded as failed.
+func (s *Summarizer) Refresh(ctx context.Context, prompts Prompts, sessionID string, transcript []pkg.Message, force bool) (*pkg.Summary, bool, error) {
+	hash := TranscriptHash(transcript)
+	claimed, err := s.Store.ClaimSummary(ctx, sessionID, hash, force)
+	if err != nil {
+		return nil, false, err
+	}
+	old, err := s.Store.GetSummary(ctx, sessionID)
+	if err != nil && !errs.Is(err, errs.NotFound) {
+		if claimed {
+			_ = s.Store.ReleaseSummaryClaim(ctx, sessionID, hash)
+		}
+		return nil, false, err
+	}
+	if !claimed {
+		return old, false, nil
+	}
+	summary, err := s.regenerate(ctx, prompts, sessionID, transcript, hash, old, false)
+	return summary, true, err
+}
+
+// Replace regenerates and stores the session summary from the transcript
+// alone, discarding the stored one, e.g. after a message was redacted from
+// the transcript.  Unlike Refresh nothing of the stored summary is merged
+// in or kept: when the model cannot be reached the fallback summary
+// replaces it, recorded as failed.
+func (s *Summarizer) Replace(ctx context.Context, prompts Prompts, sessionID string, transcript []pkg.Message) (*pkg.Summary, error) {
+	hash := TranscriptHash(transcript)
+	if _, err := s.Store.ClaimSummary(ctx, sessionID, hash, true); err != nil {
+		return nil, err
+	}
+	return s.regenerate(ctx, prompts, sessionID, transcript, hash, nil, true)
+}
+
+// regenerate summarises a transcript claimed under hash, merging in old,
+// and stores the summary.  With replace a failure of the model stores the
+// fallback summary rather than leaving the stored one in place.
+func (s *Summarizer) regenerate(ctx context.Context, prompts Prompts, sessionID string, transcript []pkg.Message, hash string, old *pkg.Summary, replace bool) (*pkg.Summary, error) {
+	summary, err := s.SummarizeWithPrompts(ctx, prompts, sessionID, transcript, old)
+	if errors.Is(err, ErrInvalidSummary) {
+		log.Printf("summarize session %s: %v", sessionID, err)
+		summary.LastAttempt = &pkg.SummaryAttempt{Status: pkg.AttemptFailed, Error: SummaryErrInvalidJSON}
+	} else if err != nil && replace {
+		log.Printf("summarize session %s: %v", sessionID, err)
+		summary.LastAttempt = &pkg.SummaryAttempt{Status: pkg.AttemptFailed, Error: SummaryErrorClass(err)}
+	} else if err != nil {
+		_ = s.Store.ReleaseSummaryClaim(ctx, sessionID, hash)
+		s.recordFailure(sessionID, SummaryErrorClass(err))
+		return nil, err
+	}
+	summary.TranscriptHash = hash
+	// Follow-up questions for the doctor track the summary; on failure the
+	// previous ones are kept.
+	if questions, err := s.SuggestQuestions(ctx, summary, transcript); err != nil {
+		log.Printf("suggest questions for session %s: %v", sessionID, err)
+		if old != nil {
+			summary.Questions = old.Questions
+		}
+	} else {
+		summary.Questions = questions
+	}
+	if s.Embed {
+		// Without an embedding Recall falls back to the most recent visit.
+		embedding, err := s.LLM.Embed(ctx, embeddingText(summary))
+		if err != nil {
+			log.Printf("embed summary of session %s: %v", sessionID, err)
+		}
+		summary.Embedding = embedding
+	}
+	if err := s.Store.UpsertSummary(ctx, summary); err != nil {
+		_ = s.Store.ReleaseSummaryClaim(ctx, sessionID, hash)
+		s.recordFailure(sessionID, SummaryErrStore)
+		return nil, err
+	}
+	return summary, nil
+}
+
+// recordFailure records a failed regeneration.  It does not use the
+// caller's context, which may be what expired.
+func (s *Summarizer) recordFailure(sessionID, errorClass string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Store.RecordSummaryFailure(ctx, sessionID, errorClass); err != nil {
+		log.Printf("record summary failure of session %s: %v", sessionID, err)
+	}
+}
+
+// summaryResponse is the JSON object SummarizationInstruction asks for.
+type summaryResponse struct {
+	KeyPoints  []string               `json:"key_points"`
+	Structured map[string]interface{} `json:"structured"`
+	FreeText   string                 `json:"free_text"`
+}
+
+// SummaryLanguage is a language summaries can be written in for the
+// doctor.  Only the values are written in it: the JSON keys and the field
+// names of the structured data stay English for the code reading them.
+type SummaryLanguage struct {
+	// Name stands for LanguagePlaceholder in the Persian instructions.
+	Name string
+	// Script is the Unicode script the free text must be predominantly
+	// written in.
+	Script string
+	// KeyPoint and FreeText make up the summary stored when the model
+	// cannot be reached.
+	KeyPoint string
+	FreeText string
+}
+
+// DefaultSummaryLanguage is the language of summaries unless the prompt
+// profile sets another.
+const DefaultSummaryLanguage = "fa"
+
+// SummaryLanguages are the languages summaries can be written in, by code.
+var SummaryLanguages = map[string]SummaryLanguage{
+	"fa": {Name: "فارسی", Script: "Arabic", KeyPoint: "گفت‌وگو انجام شد", FreeText: "خلاصهٔ گفت‌وگو در دسترس نیست."},
+	"en": {Name: "انگلیسی", Script: "Latin", KeyPoint: "Conversation held", FreeText: "The conversation summary is not available."},
+}
+
+// summaryLanguage returns the language summaries are written in, the
+// default for an unknown code.
+func (p Prompts) summaryLanguage() SummaryLanguage {
+	if lang, ok := SummaryLanguages[p.SummaryLanguage]; ok {
+		return lang
+	}
+	return SummaryLanguages[DefaultSummaryLanguage]
+}
+
+// parseSummary reads the summary of a session from the model's response.
+// The model is asked for a JSON object with the three parts; anything else
+// (e.g. the stubbed client) is kept as free text, reported by ok.
+func parseSummary(sessionID, resp string) (summary *pkg.Summary, ok bool) {
+	summary = &pkg.Summary{
+		SessionID:     sessionID,
+		KeyPoints:     []string{resp},
+		Structured:    map[string]interface{}{},
+		FreeText:      resp,
+		UpdatedAt:     time.Now(),
+		SchemaVersion: SummarySchemaVersion,
+	}
+	var parsed summaryResponse
+	if err := json.Unmarshal([]byte(resp), &parsed); err == nil && (len(parsed.KeyPoints) > 0 || parsed.Structured != nil) {
+		summary.KeyPoints, summary.FreeText = parsed.KeyPoints, parsed.FreeText
+		if parsed.Structured != nil {
+			summary.Structured = parsed.Structured
+		}
+		ok = true
+	}
+	return summary, ok
+}
+
+// NewSummarizer constructs a summariser that stores summaries in store.
+func NewSummarizer(client llm.Client, store SummaryStore) *Summarizer {
+	return &Summarizer{LLM: client, Store: store}
+}
+
+// Summarize analyses the transcript and produces a Summary for the given
+// session. The transcript should contain all messages for a user ordered
+// chronologically.  The old
+// summary can be passed in to support merging; see MergeSummaries for the
+// rules.  For the MVP, the
 // summariser simply echoes the last patient message as free text and leaves
 // the structured data empty.
-func (s *Summarizer) Summarize(ctx context.Context, nationalID string, transcript []pkg.Message, old *pkg.Summary) (*pkg.Summary, error) {
+func (s *Summarizer) Summarize(ctx context.Context, sessionID string, transcript []pkg.Message, old *pkg.Summary) (*pkg.Summary, error) {
+	return s.SummarizeWithPrompts(ctx, DefaultPrompts(), sessionID, transcript, old)
+}
+
+// SummarizeWithPrompts is like Summarize but uses the summarisation
+// instruction and summary language from the session's resolved prompts.
+// A free text not predominantly in the language's script is requested
+// again once.  A response that is not the requested JSON is kept as free
+// text and returned with ErrInvalidSummary.
+func (s *Summarizer) SummarizeWithPrompts(ctx context.Context, prompts Prompts, sessionID string, transcript []pkg.Message, old *pkg.Summary) (*pkg.Summary, error) {
 	// Compose the prompt for the LLM.  In a full implementation you would
 	// include the transcript and the existing structured data.  For now we
 	// pass only the latest patient message to the stubbed summariser.
@@ -38,30 +287,48 @@ func (s *Summarizer) Summarize(ctx context.Context, nationalID string, transcrip
 			break
 		}
 	}
-	prompt := SummarizationInstruction + "\n\n" + lastMsg
-	resp, err := s.LLM.Summarize(ctx, prompt)
+	lang := prompts.summaryLanguage()
+	instruction := strings.ReplaceAll(prompts.Summarize, LanguagePlaceholder, lang.Name)
+	var model string
+	opts := append(s.Options[:len(s.Options):len(s.Options)], llm.WithModelReport(&model))
+	resp, err := s.LLM.Summarize(ctx, instruction+"\n\n"+lastMsg, opts...)
 	if err != nil {
 		// fallback summary when the LLM call fails
-		return &pkg.Summary{
-			SessionID:  nationalID,
-			KeyPoints:  []string{"گفت‌وگو انجام شد"},
-			Structured: map[string]interface{}{},
-			FreeText:   "خلاصهٔ گفت‌وگو در دسترس نیست.",
-			UpdatedAt:  time.Now(),
-		}, err
-	}
-	// The stubbed LLM client returns JSON for the structured field followed by
-	// free text separated by a delimiter.  Since this is a placeholder, we
-	// decode an empty JSON object and use the raw response as free text.
-	var structured map[string]interface{}
-	if err := json.Unmarshal([]byte("{}"), &structured); err != nil {
-		structured = map[string]interface{}{}
-	}
-	return &pkg.Summary{
-		SessionID:  nationalID,
-		KeyPoints:  []string{resp},
-		Structured: structured,
-		FreeText:   resp,
-		UpdatedAt:  time.Now(),
-	}, nil
+		fallback := &pkg.Summary{
+			SessionID:     sessionID,
+			KeyPoints:     []string{lang.KeyPoint},
+			Structured:    map[string]interface{}{},
+			FreeText:      lang.FreeText,
+			UpdatedAt:     time.Now(),
+			SchemaVersion: SummarySchemaVersion,
+		}
+		fallback.Priority = int(ScorePriority(fallback, transcript))
+		return fallback, err
+	}
+	latest, ok := parseSummary(sessionID, resp)
+	// A summary whose free text is in the wrong language is requested once
+	// more with the corrective instruction; if that one is no better the
+	// first is kept.
+	if !writtenIn(latest.FreeText, lang.Script) {
+		log.Printf("summary of session %s not written in %s script; asking again", sessionID, lang.Script)
+		correction := strings.ReplaceAll(SummaryLanguageInstruction, LanguagePlaceholder, lang.Name)
+		var retryModel string
+		retryOpts := append(s.Options[:len(s.Options):len(s.Options)], llm.WithModelReport(&retryModel))
+		resp, err := s.LLM.Summarize(ctx, instruction+"\n\n"+correction+"\n\n"+lastMsg, retryOpts...)
+		if err != nil {
+			log.Printf("summarize session %s again: %v", sessionID, err)
+		} else if retry, retryOK := parseSummary(sessionID, resp); writtenIn(retry.FreeText, lang.Script) {
+			latest, ok, model = retry, retryOK, retryModel
+		} else {
+			log.Printf("summary of session %s still not written in %s script", sessionID, lang.Script)
+		}
+	}
+	latest.Model = model
+	summary := MergeSummaries(old, latest)
+	ExtractVitals(summary, transcript)
+	summary.Priority = int(ScorePriority(summary, transcript))
+	if !ok {
+		return summary, ErrInvalidSummary
+	}
+	return summary, nil
 }
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+)
+
+func TestSummaryLanguage(t *testing.T) {
+	const (
+		persian = `{"key_points":["سردرد از دو روز پیش"],"structured":{"chief_complaint":"سردرد"},"free_text":"بیمار از دو روز پیش سردرد دارد."}`
+		english = `{"key_points":["Headache for two days"],"structured":{"chief_complaint":"headache"},"free_text":"The patient has had a headache for two days."}`
+	)
+	tests := []struct {
+		name     string
+		language string
+		replies  []string
+		calls    int
+		want     string
+	}{
+		{"persian", "", []string{persian}, 1, "بیمار از دو روز پیش سردرد دارد."},
+		{"english", "en", []string{english}, 1, "The patient has had a headache for two days."},
+		{"english after persian", "en", []string{persian, english}, 2, "The patient has had a headache for two days."},
+		{"persian twice", "en", []string{persian, persian}, 2, "بیمار از دو روز پیش سردرد دارد."},
+		{"persian after english", "fa", []string{english, persian}, 2, "بیمار از دو روز پیش سردرد دارد."},
+	}
+	for _, tt := range tests {
+		fake := llm.NewFakeClient("")
+		fake.SummaryReplies = tt.replies
+		prompts := PromptsFor(&pkg.PromptProfile{Name: "clinic", SummaryLanguage: tt.language}, "fa")
+		summary, err := NewSummarizer(fake, nil).SummarizeWithPrompts(context.Background(), prompts, "s", conversation("چه مشکلی دارید؟", "سردرد دارم"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.FreeText != tt.want {
+			t.Errorf("%s: free text %q, want %q", tt.name, summary.FreeText, tt.want)
+		}
+		// The field names stay English whatever the language.
+		if _, ok := summary.Structured["chief_complaint"]; !ok {
+			t.Errorf("%s: structured %v", tt.name, summary.Structured)
+		}
+		if len(fake.SummarizeCalls) != tt.calls {
+			t.Errorf("%s: %d summarise calls, want %d", tt.name, len(fake.SummarizeCalls), tt.calls)
+			continue
+		}
+		name := SummaryLanguages[DefaultSummaryLanguage].Name
+		if tt.language != "" {
+			name = SummaryLanguages[tt.language].Name
+		}
+		first := fake.SummarizeCalls[0]
+		if strings.Contains(first, LanguagePlaceholder) || !strings.HasPrefix(first, "فقط به زبان "+name+".") {
+			t.Errorf("%s: instruction does not name %s: %q", tt.name, name, first)
+		}
+		if tt.calls == 2 {
+			correction := strings.ReplaceAll(SummaryLanguageInstruction, LanguagePlaceholder, name)
+			if !strings.Contains(fake.SummarizeCalls[1], correction) {
+				t.Errorf("%s: summary asked again without the corrective instruction", tt.name)
+			}
+		}
+	}
+}
+
+func TestSummaryLanguageFallback(t *testing.T) {
+	for language, want := range map[string]string{"": "گفت‌وگو انجام شد", "en": "Conversation held", "xx": "گفت‌وگو انجام شد"} {
+		fake := llm.NewFakeClient("")
+		fake.Err = errors.New("unreachable")
+		// The profile's summary language applies in every locale.
+		prompts := PromptsFor(&pkg.PromptProfile{Name: "clinic", SummaryLanguage: language}, "ar")
+		summary, err := NewSummarizer(fake, nil).SummarizeWithPrompts(context.Background(), prompts, "s", conversation("چه مشکلی دارید؟", "سردرد دارم"), nil)
+		if err == nil {
+			t.Fatal("no error from an unreachable model")
+		}
+		if len(summary.KeyPoints) != 1 || summary.KeyPoints[0] != want {
+			t.Errorf("%q: fallback key points %q, want %q", language, summary.KeyPoints, want)
+		}
+	}
+}
+
+func TestSummaryProvenance(t *testing.T) {
+	fake := llm.NewFakeClient(`{"key_points":["سردرد"],"structured":{},"free_text":"بیمار سردرد دارد."}`)
+	fake.Model = "gpt-summary"
+	summary, err := NewSummarizer(fake, nil).Summarize(context.Background(), "s", conversation("چه مشکلی دارید؟", "سردرد دارم"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Model != "gpt-summary" || summary.SchemaVersion != SummarySchemaVersion {
+		t.Errorf("summary by %q in schema version %d, want gpt-summary in %d", summary.Model, summary.SchemaVersion, SummarySchemaVersion)
+	}
+	// A fallback summary was written by no model.
+	fake.Err = errors.New("unreachable")
+	summary, _ = NewSummarizer(fake, nil).Summarize(context.Background(), "s", conversation("چه مشکلی دارید؟", "سردرد دارم"), nil)
+	if summary.Model != "" || summary.SchemaVersion != SummarySchemaVersion {
+		t.Errorf("fallback summary by %q in schema version %d, want no model", summary.Model, summary.SchemaVersion)
+	}
+}
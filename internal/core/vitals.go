@@ -0,0 +1,194 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"waitroom-chatbot/pkg"
+)
+
+// MaxPainScore is the top of the 0-10 pain scale.
+const MaxPainScore = 10
+
+// ExtractVitals fills the summary's PainScore and Duration from the
+// "pain_score" and "duration" fields returned by the summariser, falling
+// back to the patient's answers in the transcript when the model left them
+// empty.  A pain score outside 0-10 is clamped and flagged with
+// PainScoreClamped.  The normalised values are written back into Structured
+// (together with "duration_days") so webhooks and exports see the same
+// numbers as the dashboard.
+func ExtractVitals(summary *pkg.Summary, transcript []pkg.Message) {
+	if summary.Structured == nil {
+		summary.Structured = map[string]interface{}{}
+	}
+	st := summary.Structured
+
+	summary.PainScore, summary.PainScoreClamped = nil, false
+	if v, ok := number(st["pain_score"]); ok {
+		clamped := v
+		if clamped < 0 {
+			clamped = 0
+		} else if clamped > MaxPainScore {
+			clamped = MaxPainScore
+		}
+		summary.PainScore = &clamped
+		summary.PainScoreClamped = clamped != v
+	} else if v, ok := answerTo(transcript, TopicPain, parsePain); ok {
+		summary.PainScore = &v
+	}
+	if summary.PainScore != nil {
+		st["pain_score"] = *summary.PainScore
+	} else {
+		delete(st, "pain_score")
+	}
+
+	summary.Duration = nil
+	if d, ok := structuredDuration(st); ok {
+		summary.Duration = &d
+	} else if d, ok := answerTo(transcript, TopicDuration, ParseDuration); ok {
+		summary.Duration = &d
+	}
+	if d := summary.Duration; d != nil {
+		st["duration"] = map[string]interface{}{"value": d.Value, "unit": d.Unit}
+		st["duration_days"] = d.Days()
+	} else {
+		delete(st, "duration")
+		delete(st, "duration_days")
+	}
+}
+
+// structuredDuration reads the summariser's "duration" field, given either
+// as {"value": 3, "unit": "week"} or as free text, or its older
+// "duration_days" field.
+func structuredDuration(st map[string]interface{}) (pkg.Duration, bool) {
+	switch v := st["duration"].(type) {
+	case map[string]interface{}:
+		n, ok := number(v["value"])
+		unit, _ := v["unit"].(string)
+		unit = durationUnit(NormalizePersian(unit))
+		if ok && n > 0 && unit != "" {
+			return pkg.Duration{Value: n, Unit: unit}, true
+		}
+	case string:
+		if d, ok := ParseDuration(v); ok {
+			return d, true
+		}
+	}
+	if n, ok := number(st["duration_days"]); ok && n > 0 {
+		return pkg.Duration{Value: n, Unit: pkg.UnitDay}, true
+	}
+	return pkg.Duration{}, false
+}
+
+// durationUnitWords maps Persian and English unit names to duration units.
+var durationUnitWords = map[string]string{
+	"روز": pkg.UnitDay, "day": pkg.UnitDay, "days": pkg.UnitDay,
+	"هفته": pkg.UnitWeek, "week": pkg.UnitWeek, "weeks": pkg.UnitWeek,
+	"ماه": pkg.UnitMonth, "month": pkg.UnitMonth, "months": pkg.UnitMonth,
+	"سال": pkg.UnitYear, "year": pkg.UnitYear, "years": pkg.UnitYear,
+}
+
+// durationUnit returns the unit named by a normalised word, accepting the
+// Persian plural and adjectival forms ("روزها", "روزه"), or "" if the word
+// is not a unit.
+func durationUnit(word string) string {
+	if u, ok := durationUnitWords[word]; ok {
+		return u
+	}
+	for _, suffix := range []string{"ها", "ه"} {
+		if !strings.HasSuffix(word, suffix) {
+			continue
+		}
+		if u, ok := durationUnitWords[strings.TrimSuffix(word, suffix)]; ok {
+			return u
+		}
+	}
+	return ""
+}
+
+// numberWords are the Persian number words patients use for durations.
+var numberWords = map[string]int{
+	"یک": 1, "یه": 1, "دو": 2, "سه": 3, "چهار": 4, "چار": 4, "پنج": 5,
+	"شش": 6, "شیش": 6, "هفت": 7, "هشت": 8, "نه": 9, "ده": 10,
+	"یازده": 11, "دوازده": 12, "سیزده": 13, "چهارده": 14, "پانزده": 15,
+	"پونزده": 15, "شانزده": 16, "هفده": 17, "هجده": 18, "هیجده": 18,
+	"نوزده": 19, "بیست": 20, "سی": 30, "چهل": 40, "پنجاه": 50, "شصت": 60,
+}
+
+// ParseDuration reads a Persian duration such as "۲ هفته", "سه روز",
+// "بیست و یک روزه" or "یک ماه".  A unit without a number ("از هفته پیش")
+// counts as one.
+func ParseDuration(s string) (pkg.Duration, bool) {
+	tokens := wordTokens(NormalizePersian(s))
+	for i, tok := range tokens {
+		unit := durationUnit(tok)
+		if unit == "" {
+			continue
+		}
+		n := 1
+		if i > 0 {
+			if v, ok := tokenNumber(tokens[:i]); ok {
+				n = v
+			}
+		}
+		if n <= 0 {
+			continue
+		}
+		return pkg.Duration{Value: n, Unit: unit}, true
+	}
+	return pkg.Duration{}, false
+}
+
+// tokenNumber reads the number ending the tokens: digits, a number word, or
+// a compound such as "بیست و یک".
+func tokenNumber(tokens []string) (int, bool) {
+	last := tokens[len(tokens)-1]
+	if n, err := strconv.Atoi(last); err == nil {
+		return n, true
+	}
+	n, ok := numberWords[last]
+	if !ok {
+		return 0, false
+	}
+	if k := len(tokens); k >= 3 && tokens[k-2] == "و" {
+		if tens, ok := numberWords[tokens[k-3]]; ok && tens >= 20 && tens%10 == 0 && n < 10 {
+			n += tens
+		}
+	}
+	return n, true
+}
+
+// wordTokens splits normalised text into runs of digits and runs of
+// letters, so "3هفته" and "۳ هفته." both yield "3" followed by "هفته".
+func wordTokens(s string) []string {
+	var tokens []string
+	var cur strings.Builder
+	digit := false
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			if !digit {
+				flush()
+			}
+			digit = true
+			cur.WriteRune(r)
+		case unicode.IsLetter(r):
+			if digit {
+				flush()
+			}
+			digit = false
+			cur.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"waitroom-chatbot/pkg"
+)
+
+// CreateAttachment records an uploaded file linked to a patient message.
+func (r *Repository) CreateAttachment(ctx context.Context, a *pkg.Attachment) error {
+	return insertAttachment(ctx, r.DB, a)
+}
+
+func insertAttachment(ctx context.Context, q queryer, a *pkg.Attachment) error {
+	return q.QueryRowContext(ctx,
+		`INSERT INTO attachments (session_id, message_id, storage_key, content_type, size_bytes)
+         VALUES ($1, $2, $3, $4, $5)
+         RETURNING id, created_at`,
+		a.SessionID, a.MessageID, a.StorageKey, a.ContentType, a.Size,
+	).Scan(&a.ID, &a.CreatedAt)
+}
+
+// GetAttachment loads an attachment by ID.
+func (r *Repository) GetAttachment(ctx context.Context, id int64) (*pkg.Attachment, error) {
+	var a pkg.Attachment
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT id, session_id, message_id, storage_key, content_type, size_bytes, created_at
+         FROM attachments WHERE id = $1`, id,
+	).Scan(&a.ID, &a.SessionID, &a.MessageID, &a.StorageKey, &a.ContentType, &a.Size, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AttachAttachments loads the attachments of the given messages in one
+// query and sets them on each message.
+func (r *Repository) AttachAttachments(ctx context.Context, msgs []pkg.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(msgs))
+	ids := make([]interface{}, len(msgs))
+	index := make(map[int64]int, len(msgs))
+	for i, m := range msgs {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		ids[i] = m.ID
+		index[m.ID] = i
+	}
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, session_id, message_id, storage_key, content_type, size_bytes, created_at
+         FROM attachments
+         WHERE message_id IN (`+strings.Join(placeholders, ", ")+`)
+         ORDER BY id`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a pkg.Attachment
+		if err := rows.Scan(&a.ID, &a.SessionID, &a.MessageID, &a.StorageKey, &a.ContentType, &a.Size, &a.CreatedAt); err != nil {
+			return err
+		}
+		m := &msgs[index[a.MessageID]]
+		m.Attachments = append(m.Attachments, a)
+	}
+	return rows.Err()
+}
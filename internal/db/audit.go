@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"waitroom-chatbot/pkg"
+)
+
+// defaultAuditLimit caps ListAuditEntries when the filter sets no limit.
+const defaultAuditLimit = 200
+
+// InsertAuditEntries writes a batch of audit entries in one statement.
+func (r *Repository) InsertAuditEntries(ctx context.Context, entries []pkg.AuditEntry) error {
+	return r.insertAuditEntries(ctx, r.DB, entries)
+}
+
+// insertAuditEntries writes a batch of audit entries through q, which may
+// be the transaction of the change they record.
+func (r *Repository) insertAuditEntries(ctx context.Context, q queryer, entries []pkg.AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO audit_log (actor, action, session_id, request_id, assignee, details, created_at) VALUES `)
+	args := make([]interface{}, 0, len(entries)*7)
+	for i, e := range entries {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := i * 7
+		fmt.Fprintf(&sb, "($%d, $%d, %s, $%d, NULLIF($%d, ''), NULLIF($%d, ''), $%d)", n+1, n+2, r.Dialect.uuid(fmt.Sprintf("NULLIF($%d, '')", n+3)), n+4, n+5, n+6, n+7)
+		args = append(args, e.Actor, e.Action, e.SessionID, e.RequestID, e.Assignee, e.Details, e.CreatedAt.UTC())
+	}
+	_, err := q.ExecContext(ctx, sb.String(), args...)
+	return err
+}
+
+// ListAuditEntries returns audit entries matching the filter, newest first.
+func (r *Repository) ListAuditEntries(ctx context.Context, f pkg.AuditFilter) ([]pkg.AuditEntry, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Actor != "" {
+		add("actor = $%d", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.SessionID != "" {
+		add("session_id = "+r.Dialect.uuid("$%d"), f.SessionID)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To.UTC())
+	}
+	query := `SELECT id, actor, action, COALESCE(CAST(session_id AS TEXT), ''), request_id, COALESCE(assignee, ''), COALESCE(details, ''), created_at FROM audit_log`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.AuditEntry
+	for rows.Next() {
+		var e pkg.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.SessionID, &e.RequestID, &e.Assignee, &e.Details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
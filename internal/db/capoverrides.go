@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// CreateCapOverride records extra messages granted on top of the message
+// cap.  The national ID is stored as its lookup key, so it is not kept in
+// plaintext when PII encryption is enabled.
+func (r *Repository) CreateCapOverride(ctx context.Context, o *pkg.CapOverride) error {
+	var nationalID interface{}
+	if o.NationalID != "" {
+		nationalID = r.lookupKey(o.NationalID)
+	}
+	return r.DB.QueryRowContext(ctx,
+		`INSERT INTO cap_overrides (national_id, session_id, extra_messages, granted_by, expires_at)
+         VALUES ($1, `+r.Dialect.uuid("NULLIF($2, '')")+`, $3, $4, $5)
+         RETURNING id, created_at`,
+		nationalID, o.SessionID, o.ExtraMessages, o.GrantedBy, r.Dialect.timeArg(o.ExpiresAt),
+	).Scan(&o.ID, &o.CreatedAt)
+}
+
+// ListActiveCapOverrides returns the unexpired overrides granted to the
+// patient with the national ID or to the session, oldest first.  Their
+// NationalID is left empty.
+func (r *Repository) ListActiveCapOverrides(ctx context.Context, nationalID, sessionID string) ([]pkg.CapOverride, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, COALESCE(CAST(session_id AS TEXT), ''), extra_messages, granted_by, expires_at, created_at
+         FROM cap_overrides
+         WHERE (national_id = $1 OR session_id = `+r.Dialect.uuid("NULLIF($2, '')")+`)
+           AND expires_at > $3
+         ORDER BY id`,
+		r.lookupKey(nationalID), sessionID, r.Dialect.timeArg(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.CapOverride
+	for rows.Next() {
+		var o pkg.CapOverride
+		if err := rows.Scan(&o.ID, &o.SessionID, &o.ExtraMessages, &o.GrantedBy, &o.ExpiresAt, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
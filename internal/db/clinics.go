@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"waitroom-chatbot/pkg"
+)
+
+const clinicColumns = `id, name, COALESCE(host, ''), COALESCE(path_prefix, ''), message_cap,
+       COALESCE(display_name, ''), COALESCE(logo_url, ''), COALESCE(accent_color, ''),
+       COALESCE(operating_hours, ''), COALESCE(timezone, '')`
+
+func scanClinic(row rowScanner) (*pkg.Clinic, error) {
+	var c pkg.Clinic
+	if err := row.Scan(&c.ID, &c.Name, &c.Host, &c.PathPrefix, &c.MessageCap,
+		&c.DisplayName, &c.LogoURL, &c.AccentColor, &c.OperatingHours, &c.Timezone); err != nil {
+		return nil, notFound(err)
+	}
+	return &c, nil
+}
+
+// GetClinic loads a clinic by ID.  It returns ErrNotFound when there is
+// no such clinic.
+func (r *Repository) GetClinic(ctx context.Context, id string) (*pkg.Clinic, error) {
+	return scanClinic(r.DB.QueryRowContext(ctx,
+		`SELECT `+clinicColumns+` FROM clinics WHERE id = $1`, id))
+}
+
+// GetClinicByPrefix loads the clinic reached through a path prefix.  It
+// returns ErrNotFound when no clinic uses the prefix.
+func (r *Repository) GetClinicByPrefix(ctx context.Context, prefix string) (*pkg.Clinic, error) {
+	return scanClinic(r.DB.QueryRowContext(ctx,
+		`SELECT `+clinicColumns+` FROM clinics WHERE path_prefix = $1`, prefix))
+}
+
+// ClinicForHost returns the clinic mapped to a host name, or the default
+// clinic when none is.
+func (r *Repository) ClinicForHost(ctx context.Context, host string) (*pkg.Clinic, error) {
+	c, err := scanClinic(r.DB.QueryRowContext(ctx,
+		`SELECT `+clinicColumns+` FROM clinics WHERE host = $1`, host))
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.GetClinic(ctx, pkg.DefaultClinic)
+	}
+	return c, err
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// AddDenylistEntry refuses sessions to a national ID or a client IP.  A
+// national ID is stored as its lookup key, like a cap override's.  Adding
+// an entry that exists already updates its reason.
+func (r *Repository) AddDenylistEntry(ctx context.Context, e *pkg.DenylistEntry) error {
+	value := e.Value
+	if e.Kind == pkg.DenyNationalID {
+		value = r.lookupKey(e.Value)
+	}
+	return r.DB.QueryRowContext(ctx,
+		`INSERT INTO denylist (kind, value, reason, created_by)
+         VALUES ($1, $2, $3, $4)
+         ON CONFLICT (kind, value) DO UPDATE SET reason = excluded.reason
+         RETURNING id, created_at`,
+		e.Kind, value, e.Reason, e.CreatedBy,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// ListDenylist returns the denylist, newest first.
+func (r *Repository) ListDenylist(ctx context.Context) ([]pkg.DenylistEntry, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, kind, value, reason, created_by, created_at
+         FROM denylist
+         ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.DenylistEntry
+	for rows.Next() {
+		var e pkg.DenylistEntry
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Value, &e.Reason, &e.CreatedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// DeleteDenylistEntry removes an entry.  It returns ErrNotFound when
+// there is none with the ID.
+func (r *Repository) DeleteDenylistEntry(ctx context.Context, id int64) error {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM denylist WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// IsDenied reports whether the national ID or the client IP, when not
+// empty, is on the denylist.
+func (r *Repository) IsDenied(ctx context.Context, nationalID, ip string) (bool, error) {
+	var n int
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM denylist
+         WHERE (kind = 'national_id' AND value = $1) OR (kind = 'ip' AND value = $2)`,
+		r.lookupKey(nationalID), ip,
+	).Scan(&n)
+	return n > 0, err
+}
+
+// CountSessionsFromIPSince counts the sessions created from the client IP
+// since the given time.
+func (r *Repository) CountSessionsFromIPSince(ctx context.Context, ip string, since time.Time) (int, error) {
+	var n int
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM sessions
+         WHERE client_ip = `+r.Dialect.inet("$1")+` AND created_at >= $2`,
+		ip, r.Dialect.timeArg(since),
+	).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Dialect selects the SQL flavour used by the Repository.  Postgres is the
+// default; SQLite serves single-clinic deployments that do not want to run a
+// database server.  Only the few expressions that differ between the two are
+// routed through the dialect; everything else is portable SQL.
+type Dialect string
+
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// ParseDialect maps the DATABASE_DRIVER setting to a Dialect.  An empty value
+// selects Postgres.
+func ParseDialect(name string) (Dialect, error) {
+	switch Dialect(name) {
+	case "", Postgres:
+		return Postgres, nil
+	case SQLite:
+		return SQLite, nil
+	}
+	return "", fmt.Errorf("unknown database driver %q", name)
+}
+
+// sqliteNow is the current UTC time with millisecond precision, in the text
+// form SQLite timestamps are stored in so they sort and compare correctly.
+const sqliteNow = `strftime('%Y-%m-%d %H:%M:%f', 'now')`
+
+// now returns the SQL expression for the current time.
+func (d Dialect) now() string {
+	if d == SQLite {
+		return sqliteNow
+	}
+	return "NOW()"
+}
+
+// ago returns the SQL expression for the current time minus interval, which
+// must be of the form "<n> <unit>s" (e.g. "7 days", "5 minutes").
+func (d Dialect) ago(interval string) string {
+	if d == SQLite {
+		return `strftime('%Y-%m-%d %H:%M:%f', 'now', '-` + interval + `')`
+	}
+	return "NOW() - INTERVAL '" + interval + "'"
+}
+
+// later returns the SQL expression for the current time plus interval, in
+// the same form as ago.
+func (d Dialect) later(interval string) string {
+	if d == SQLite {
+		return `strftime('%Y-%m-%d %H:%M:%f', 'now', '+` + interval + `')`
+	}
+	return "NOW() + INTERVAL '" + interval + "'"
+}
+
+// skipLocked returns the row-locking clause that lets concurrent workers
+// claim different rows.  SQLite serialises writers, so it needs none.
+func (d Dialect) skipLocked() string {
+	if d == SQLite {
+		return ""
+	}
+	return " FOR UPDATE SKIP LOCKED"
+}
+
+// ilike returns the case-insensitive LIKE operator.  SQLite's LIKE is
+// already case-insensitive (for ASCII).
+func (d Dialect) ilike() string {
+	if d == SQLite {
+		return "LIKE"
+	}
+	return "ILIKE"
+}
+
+// uuid casts a text expression to the type of the UUID columns.
+func (d Dialect) uuid(expr string) string {
+	if d == SQLite {
+		return expr
+	}
+	return "CAST(" + expr + " AS uuid)"
+}
+
+// inet casts a text expression to the type of the INET columns.
+func (d Dialect) inet(expr string) string {
+	if d == SQLite {
+		return expr
+	}
+	return "CAST(" + expr + " AS inet)"
+}
+
+// host returns the text form of an INET column.
+func (d Dialect) host(col string) string {
+	if d == SQLite {
+		return col
+	}
+	return "host(" + col + ")"
+}
+
+// jsonSet returns the SQL expression for the JSON object col with the key
+// given by the text expression key set to the JSON text expression value.
+func (d Dialect) jsonSet(col, key, value string) string {
+	if d == SQLite {
+		return "json_set(" + col + `, '$."' || ` + key + ` || '"', json(` + value + "))"
+	}
+	return "jsonb_set(" + col + ", ARRAY[CAST(" + key + " AS text)], CAST(" + value + " AS jsonb))"
+}
+
+// timeArg returns t as a query argument that compares correctly with the
+// timestamp columns: SQLite stores them as UTC text with millisecond
+// precision, which a time.Time argument would not match exactly.
+func (d Dialect) timeArg(t time.Time) interface{} {
+	if d == SQLite {
+		return t.UTC().Format("2006-01-02 15:04:05.000")
+	}
+	return t.UTC()
+}
+
+// timeColumn scans timestamps computed in SQL (COALESCE, MAX, ...).  SQLite
+// only converts columns declared as TIMESTAMP, so computed ones arrive as
+// text and are parsed here.
+type timeColumn struct{ t *time.Time }
+
+// timeLayouts are the text forms SQLite timestamps are written in.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func (c timeColumn) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case time.Time:
+		*c.t = v
+		return nil
+	case nil:
+		*c.t = time.Time{}
+		return nil
+	case []byte:
+		return c.parse(string(v))
+	case string:
+		return c.parse(v)
+	}
+	return fmt.Errorf("cannot scan %T into time", v)
+}
+
+func (c timeColumn) parse(s string) error {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			*c.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse time %q", s)
+}
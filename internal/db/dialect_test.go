@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDialect(t *testing.T) {
+	tests := []struct {
+		name string
+		want Dialect
+		ok   bool
+	}{
+		{"", Postgres, true},
+		{"postgres", Postgres, true},
+		{"sqlite", SQLite, true},
+		{"mysql", "", false},
+		{"SQLite", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseDialect(tt.name)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseDialect(%q) = %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	driver, dsn := driverDSN(SQLite, "/var/lib/chat.db")
+	if driver != "sqlite" || !strings.HasPrefix(dsn, "file:/var/lib/chat.db?") {
+		t.Errorf("sqlite opened as %s %s", driver, dsn)
+	}
+	if driver, dsn := driverDSN(Postgres, "postgres://localhost/chat"); driver != "postgres" || dsn != "postgres://localhost/chat" {
+		t.Errorf("postgres opened as %s %s", driver, dsn)
+	}
+
+	// Foreign keys are enforced and the database is in WAL mode.
+	r := newTestRepo(t)
+	var fk int
+	var mode string
+	if err := r.DB.QueryRow(`PRAGMA foreign_keys`).Scan(&fk); err != nil || fk != 1 {
+		t.Errorf("foreign_keys %d, %v", fk, err)
+	}
+	if err := r.DB.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode %q, %v", mode, err)
+	}
+	// The schema can be applied again.
+	if err := Migrate(context.Background(), r.DB, SQLite); err != nil {
+		t.Errorf("second migration: %v", err)
+	}
+}
+
+func TestSQLiteTimes(t *testing.T) {
+	r := newTestRepo(t)
+	var now, ago string
+	if err := r.DB.QueryRow(`SELECT `+r.Dialect.now()+`, `+r.Dialect.ago("7 days")).Scan(&now, &ago); err != nil {
+		t.Fatal(err)
+	}
+	// Timestamps compare as text, so they must share timeArg's layout.
+	layout := "2006-01-02 15:04:05.000"
+	n, err := time.Parse(layout, now)
+	if err != nil {
+		t.Fatalf("now %q: %v", now, err)
+	}
+	a, err := time.Parse(layout, ago)
+	if err != nil {
+		t.Fatalf("ago %q: %v", ago, err)
+	}
+	if d := n.Sub(a); d != 7*24*time.Hour {
+		t.Errorf("7 days ago is %v before now", d)
+	}
+	if arg := r.Dialect.timeArg(n); arg != now {
+		t.Errorf("timeArg(%v) = %v, want %q", n, arg, now)
+	}
+}
+
+func TestLocalBroker(t *testing.T) {
+	if _, ok := NewBroker(SQLite, nil, "summaries").(*LocalBroker); !ok {
+		t.Error("SQLite does not get the in-process broker")
+	}
+	if _, ok := NewBroker(Postgres, nil, "summaries").(*Notifier); !ok {
+		t.Error("Postgres does not get the notifier")
+	}
+
+	b := NewLocalBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := b.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Listen(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Notify(ctx, "session-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []<-chan string{first, second} {
+		select {
+		case id := <-ch:
+			if id != "session-1" {
+				t.Errorf("received %q", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification not delivered")
+		}
+	}
+
+	// A cancelled listener's channel is closed and no longer notified.
+	cancel()
+	select {
+	case _, open := <-first:
+		if open {
+			t.Error("notified after cancelling")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancelling")
+	}
+	// A listener that does not keep up misses notifications rather than
+	// blocking the sender.
+	for i := 0; i < 100; i++ {
+		if err := b.Notify(context.Background(), "session-2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(second); n != cap(second) {
+		t.Errorf("%d notifications buffered, want %d", n, cap(second))
+	}
+}
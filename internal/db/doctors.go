@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"waitroom-chatbot/pkg"
+)
+
+const doctorColumns = `id, username, clinic_id, active`
+
+func scanDoctor(row rowScanner) (*pkg.Doctor, error) {
+	var d pkg.Doctor
+	if err := row.Scan(&d.ID, &d.Username, &d.ClinicID, &d.Active); err != nil {
+		return nil, notFound(err)
+	}
+	return &d, nil
+}
+
+// SyncDoctors makes the doctors table match the configured logins, given
+// as username to clinic (empty for the default clinic): listed doctors are
+// added or moved to their clinic and re-activated, the others deactivated.
+func (r *Repository) SyncDoctors(ctx context.Context, clinics map[string]string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `UPDATE doctors SET active = FALSE`); err != nil {
+		return err
+	}
+	for username, clinicID := range clinics {
+		if clinicID == "" {
+			clinicID = pkg.DefaultClinic
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO doctors (username, clinic_id) VALUES ($1, $2)
+             ON CONFLICT (username) DO UPDATE SET clinic_id = excluded.clinic_id, active = TRUE`,
+			username, clinicID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDoctorByUsername loads a doctor by login name.  It returns
+// ErrNotFound when there is no such doctor.
+func (r *Repository) GetDoctorByUsername(ctx context.Context, username string) (*pkg.Doctor, error) {
+	return scanDoctor(r.DB.QueryRowContext(ctx,
+		`SELECT `+doctorColumns+` FROM doctors WHERE username = $1`, username))
+}
+
+// ListDoctors returns the active doctors of a clinic by username.
+func (r *Repository) ListDoctors(ctx context.Context, clinicID string) ([]pkg.Doctor, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+doctorColumns+` FROM doctors
+         WHERE clinic_id = $1 AND active
+         ORDER BY username`, clinicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Doctor
+	for rows.Next() {
+		d, err := scanDoctor(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *d)
+	}
+	return out, rows.Err()
+}
+
+// AssignSession assigns a session to a doctor, replacing any previous
+// assignee.  It returns ErrNotFound when there is no such session.
+func (r *Repository) AssignSession(ctx context.Context, sessionID string, doctorID int64) error {
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions SET assigned_doctor_id = $2 WHERE id = $1`, sessionID, doctorID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// AssignRoundRobin assigns the patient's open session at a clinic, when it
+// is unassigned, to the clinic's active doctor who was assigned a session
+// least recently.  It returns the session and the doctor's username, both
+// empty when there was nothing to assign or no doctor to assign it to.
+func (r *Repository) AssignRoundRobin(ctx context.Context, nationalID, clinicID string) (sessionID, doctor string, err error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx,
+		`SELECT id FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
+           AND clinic_id = $2 AND closed_at IS NULL AND assigned_doctor_id IS NULL`,
+		r.lookupKey(nationalID), clinicID).Scan(&sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	// Doctors never assigned to come first, then the longest waiting;
+	// concurrent registrations skip the doctor being assigned to
+	var doctorID int64
+	err = tx.QueryRowContext(ctx,
+		`UPDATE doctors SET last_assigned_at = `+r.Dialect.now()+`
+         WHERE id = (SELECT id FROM doctors
+                     WHERE clinic_id = $1 AND active
+                     ORDER BY last_assigned_at IS NOT NULL, last_assigned_at, id
+                     LIMIT 1`+r.Dialect.skipLocked()+`)
+         RETURNING id, username`, clinicID).Scan(&doctorID, &doctor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE sessions SET assigned_doctor_id = $2 WHERE id = $1`, sessionID, doctorID); err != nil {
+		return "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+	return sessionID, doctor, nil
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrNotFound is returned for a row that does not exist, of kind
+// errs.NotFound.  It wraps sql.ErrNoRows, which callers may still test
+// for.
+var ErrNotFound = errs.Wrap(errs.NotFound, sql.ErrNoRows)
+
+// notFound returns ErrNotFound for sql.ErrNoRows and other errors as they
+// are.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// recordEvent adds an event to the events outbox as part of tx, so it is
+// stored if and only if the change it describes is.
+func (r *Repository) recordEvent(ctx context.Context, tx *sql.Tx, kind, sessionID string, payload []byte) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO events (kind, session_id, payload) VALUES ($1, $2, $3)`,
+		kind, sessionID, string(payload))
+	return err
+}
+
+// eventColumns lists the columns scanned by scanEvent.
+const eventColumns = `id, kind, session_id, payload, created_at, published_at`
+
+func scanEvent(row rowScanner) (pkg.Event, error) {
+	var e pkg.Event
+	var payload []byte
+	err := row.Scan(&e.ID, &e.Kind, &e.SessionID, &payload, &e.CreatedAt, &e.PublishedAt)
+	e.Payload = payload
+	return e, err
+}
+
+// ClaimUnpublishedEvents returns up to limit unpublished events, oldest
+// first, and postpones them by lease so other dispatchers skip them while
+// this one publishes.  An event whose publisher died is claimed again once
+// the lease runs out.
+func (r *Repository) ClaimUnpublishedEvents(ctx context.Context, limit int, lease time.Duration) ([]pkg.Event, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`UPDATE events
+         SET next_attempt_at = `+r.Dialect.later(seconds(lease))+`
+         WHERE id IN (SELECT id FROM events
+                      WHERE published_at IS NULL AND next_attempt_at <= `+r.Dialect.now()+`
+                      ORDER BY id
+                      LIMIT $1`+r.Dialect.skipLocked()+`)
+         RETURNING `+eventColumns, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Event
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING gives no order.
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// MarkEventPublished records that an event has been published.
+func (r *Repository) MarkEventPublished(ctx context.Context, id int64) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE events SET published_at = `+r.Dialect.now()+` WHERE id = $1`, id)
+	return err
+}
+
+// ListEventsSince returns up to limit events of the clinic's sessions with
+// an ID above after, in ID order, whether published yet or not.
+func (r *Repository) ListEventsSince(ctx context.Context, clinicID string, after int64, limit int) ([]pkg.Event, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT e.id, e.kind, e.session_id, e.payload, e.created_at, e.published_at
+         FROM events e
+         JOIN sessions s ON s.id = e.session_id
+         WHERE e.id > $1 AND s.clinic_id = $2
+         ORDER BY e.id
+         LIMIT $3`, after, clinicID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Event
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// LatestEventID returns the ID of the newest event, or 0 when there is
+// none.
+func (r *Repository) LatestEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instrumentation times the statements run on a database opened with
+// OpenInstrumented.  Statements are named after the Repository method that
+// ran them, or "other" outside one (migrations, LISTEN/NOTIFY).
+type Instrumentation struct {
+	// Observe, when set, receives the duration of every statement.
+	Observe func(name string, d time.Duration)
+	// Slow is the duration above which a statement is logged, with the
+	// values of its parameters left out; zero disables the log.
+	Slow time.Duration
+}
+
+// QueryNames returns the names statements can be observed under: those of
+// the Repository methods and "other".
+func QueryNames() []string {
+	t := reflect.TypeOf(&Repository{})
+	names := make([]string, 0, t.NumMethod()+1)
+	for i := 0; i < t.NumMethod(); i++ {
+		names = append(names, t.Method(i).Name)
+	}
+	return append(names, otherQuery)
+}
+
+// otherQuery names the statements not run by a Repository method.
+const otherQuery = "other"
+
+// OpenInstrumented opens the database like Open, with every statement run
+// on it timed by in.
+func OpenInstrumented(dialect Dialect, dsn string, in *Instrumentation) (*sql.DB, error) {
+	name, dsn := driverDSN(dialect, dsn)
+	// sql.Open does not connect, so the pool is closed unused; it is only
+	// opened to look up the driver.
+	plain, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := plain.Driver()
+	plain.Close()
+	var connector driver.Connector = dsnConnector{dsn: dsn, driver: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(instrumentedConnector{Connector: connector, in: in}), nil
+}
+
+// dsnConnector is the connector of a driver without one of its own.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.driver }
+
+type instrumentedConnector struct {
+	driver.Connector
+	in *Instrumentation
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, in: c.in}, nil
+}
+
+// instrumentedConn times the statements run directly on a connection,
+// which is how both drivers run Repository queries.  Statements the driver
+// cannot run directly fall back to prepared statements, which are not
+// timed.
+type instrumentedConn struct {
+	driver.Conn
+	in *Instrumentation
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	c.in.done(start, query, args)
+	return rows, err
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	c.in.done(start, query, args)
+	return res, err
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// maxLoggedQuery is how much of a slow statement's text is logged.
+const maxLoggedQuery = 500
+
+// done reports a statement that started at start.
+func (in *Instrumentation) done(start time.Time, query string, args []driver.NamedValue) {
+	d := time.Since(start)
+	slow := in.Slow > 0 && d > in.Slow
+	if in.Observe == nil && !slow {
+		return
+	}
+	name := queryName()
+	if in.Observe != nil {
+		in.Observe(name, d)
+	}
+	if slow {
+		types := make([]string, len(args))
+		for i, a := range args {
+			types[i] = fmt.Sprintf("%T", a.Value)
+		}
+		query = strings.Join(strings.Fields(query), " ")
+		if len(query) > maxLoggedQuery {
+			query = query[:maxLoggedQuery] + "…"
+		}
+		log.Printf("slow query %s took %s: %s [args: %s]", name, d.Round(time.Millisecond), query, strings.Join(types, ", "))
+	}
+}
+
+// repositoryPrefix starts the function names of the Repository methods.
+var repositoryPrefix = reflect.TypeOf(Repository{}).PkgPath() + ".(*Repository)."
+
+// frameNames caches, by program counter, the Repository method a frame
+// belongs to, or "" for other functions.
+var frameNames sync.Map
+
+// queryName returns the Repository method on the stack of the caller, the
+// innermost one when methods call each other.
+func queryName() string {
+	var pcs [32]uintptr
+	n := runtime.Callers(3, pcs[:])
+	for _, pc := range pcs[:n] {
+		name, ok := frameNames.Load(pc)
+		if !ok {
+			name = frameName(pc)
+			frameNames.Store(pc, name)
+		}
+		if name != "" {
+			return name.(string)
+		}
+	}
+	return otherQuery
+}
+
+// frameName returns the Repository method of the frame at pc, or "".  A pc
+// can stand for several frames when calls were inlined.
+func frameName(pc uintptr) string {
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		f, more := frames.Next()
+		if method, ok := strings.CutPrefix(f.Function, repositoryPrefix); ok {
+			// Closures inside a method are named Method.func1.
+			method, _, _ = strings.Cut(method, ".")
+			return method
+		}
+		if !more {
+			return ""
+		}
+	}
+}
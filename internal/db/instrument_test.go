@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/metrics"
+	"waitroom-chatbot/pkg"
+)
+
+// TestQueryNames checks that every Repository method has a series of the
+// query histogram before its first query.
+func TestQueryNames(t *testing.T) {
+	reg := metrics.NewRegistry()
+	queries := reg.NewHistogramVec("db_query_duration_seconds", "Duration of database queries.", "query", []float64{.01, .1})
+	queries.Init(QueryNames()...)
+	var out bytes.Buffer
+	reg.Write(&out)
+	typ := reflect.TypeOf(&Repository{})
+	for i := 0; i < typ.NumMethod(); i++ {
+		name := typ.Method(i).Name
+		if !strings.Contains(out.String(), `db_query_duration_seconds_count{query="`+name+`"} 0`) {
+			t.Errorf("no series for %s", name)
+		}
+	}
+	if !strings.Contains(out.String(), `query="other"`) {
+		t.Error("no series for statements outside the Repository")
+	}
+}
+
+func TestInstrumentationNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	counts := map[string]int{}
+	conn, err := OpenInstrumented(SQLite, path, &Instrumentation{Observe: func(name string, d time.Duration) { counts[name]++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if err := Migrate(ctx, conn, SQLite); err != nil {
+		t.Fatal(err)
+	}
+	if counts[otherQuery] == 0 {
+		t.Errorf("migrations not observed as %q: %v", otherQuery, counts)
+	}
+	r := NewRepository(conn)
+	r.Dialect = SQLite
+	for name := range counts {
+		delete(counts, name)
+	}
+	newTestSession(t, r, "0012345678")
+	if _, err := r.GetLatestSession(ctx, "0012345678"); err != nil {
+		t.Fatal(err)
+	}
+	if counts["UpsertUser"] == 0 || counts["GetLatestSession"] == 0 {
+		t.Errorf("statements not named after their methods: %v", counts)
+	}
+	for name := range counts {
+		if _, ok := reflect.TypeOf(r).MethodByName(name); !ok {
+			t.Errorf("statements observed as %q", name)
+		}
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+	path := filepath.Join(t.TempDir(), "test.db")
+	conn, err := OpenInstrumented(SQLite, path, &Instrumentation{Slow: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	if err := Migrate(ctx, conn, SQLite); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepository(conn)
+	r.Dialect = SQLite
+	const nationalID = "0098765432"
+	if err := r.UpsertUser(ctx, &pkg.User{NationalID: nationalID, Phone: "09121112233", Name: "Sara"}, "", pkg.DefaultClinic, "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	out := logged.String()
+	if !strings.Contains(out, "slow query UpsertUser took") || !strings.Contains(out, "[args: string") {
+		t.Errorf("slow statement not logged with its parameter types: %s", out)
+	}
+	for _, secret := range []string{nationalID, "09121112233", "Sara"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("parameter %q logged", secret)
+		}
+	}
+
+	// Statements under the threshold are not logged.
+	logged.Reset()
+	fast, err := OpenInstrumented(SQLite, path, &Instrumentation{Slow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	if _, err := fast.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("fast statement logged: %s", logged.String())
+	}
+}
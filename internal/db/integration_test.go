@@ -0,0 +1,842 @@
+//go:build integration
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// startSession creates the open session of a patient and returns it.
+func startSession(t *testing.T, repo *db.Repository, nationalID string) *pkg.Session {
+	t.Helper()
+	ctx := context.Background()
+	u := &pkg.User{NationalID: nationalID, Phone: "09120000000", Name: "Sara"}
+	if err := repo.UpsertUser(ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	s, err := repo.GetLatestSession(ctx, nationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// transcript returns the messages of a session.
+func transcript(t *testing.T, repo *db.Repository, sessionID string) []pkg.Message {
+	t.Helper()
+	ms, err := repo.GetSessionTranscript(context.Background(), sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestMigrateTwice(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		s := startSession(t, repo, "0012345678")
+		if _, err := repo.CreateMessage(context.Background(), uuid.MustParse(s.ID), pkg.RolePatient, "سلام"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrate(context.Background(), repo.DB, repo.Dialect); err != nil {
+			t.Fatalf("second migration: %v", err)
+		}
+		ms := transcript(t, repo, s.ID)
+		if len(ms) != 1 || ms[0].Seq != 1 {
+			t.Errorf("transcript after the second migration: %+v", ms)
+		}
+	})
+}
+
+func TestCreateMessagePairSeq(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		if _, err := repo.CreateMessage(ctx, id, pkg.RoleBot, "خوش آمدید"); err != nil {
+			t.Fatal(err)
+		}
+		p, b, err := repo.CreateMessagePair(ctx, id, nil, "سردرد دارم", "از کی؟")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Seq != 2 || b.Seq != 3 {
+			t.Errorf("pair numbered %d and %d, want 2 and 3", p.Seq, b.Seq)
+		}
+		ms := transcript(t, repo, s.ID)
+		want := []pkg.MessageRole{pkg.RoleBot, pkg.RolePatient, pkg.RoleBot}
+		if len(ms) != len(want) {
+			t.Fatalf("%d messages, want %d", len(ms), len(want))
+		}
+		for i, m := range ms {
+			if m.Role != want[i] || m.Seq != i+1 {
+				t.Errorf("message %d: %s seq %d, want %s seq %d", i, m.Role, m.Seq, want[i], i+1)
+			}
+		}
+		// A pair into a session that does not exist stores neither message.
+		if _, _, err := repo.CreateMessagePair(ctx, uuid.New(), nil, "a", "b"); err == nil {
+			t.Error("pair stored in a missing session")
+		}
+	})
+}
+
+func TestConcurrentSeq(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		const n = 20
+		var wg sync.WaitGroup
+		errc := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := repo.CreateMessagePair(context.Background(), id, nil, "پیام", "پاسخ")
+				errc <- err
+			}()
+		}
+		wg.Wait()
+		close(errc)
+		for err := range errc {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ms := transcript(t, repo, s.ID)
+		if len(ms) != 2*n {
+			t.Fatalf("%d messages, want %d", len(ms), 2*n)
+		}
+		for i, m := range ms {
+			if m.Seq != i+1 {
+				t.Fatalf("message %d has seq %d", i, m.Seq)
+			}
+			// Each pair is numbered together.
+			if want := []pkg.MessageRole{pkg.RolePatient, pkg.RoleBot}[i%2]; m.Role != want {
+				t.Fatalf("message %d is the %s's, want the %s's", i, m.Role, want)
+			}
+		}
+	})
+}
+
+func TestPendingReply(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		pm, p, err := repo.CreatePendingReply(ctx, id, nil, "سردرد دارم")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The patient message is stored at once and counts toward the cap.
+		if ms := transcript(t, repo, s.ID); len(ms) != 1 || ms[0].ID != pm.ID {
+			t.Errorf("transcript with the reply pending: %+v", ms)
+		}
+		if n, err := repo.CountSessionPatientMessages(ctx, s.ID); err != nil || n != 1 {
+			t.Errorf("%d patient messages counted, %v; want 1", n, err)
+		}
+		got, err := repo.GetPendingReply(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != pkg.ReplyPending || got.PatientMessageID != pm.ID || got.Patient != "سردرد دارم" {
+			t.Errorf("pending reply %+v", got)
+		}
+		if _, err := repo.CompletePendingReply(ctx, p.ID, id, "چیز دیگری", "از کی؟"); !errors.Is(err, db.ErrMessageEdited) {
+			t.Errorf("completing the reply to another message: %v, want ErrMessageEdited", err)
+		}
+		bm, err := repo.CompletePendingReply(ctx, p.ID, id, "سردرد دارم", "از کی؟")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bm.Seq != 2 {
+			t.Errorf("reply numbered %d, want 2", bm.Seq)
+		}
+		got, err = repo.GetPendingReply(ctx, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != pkg.ReplyDone || got.Content != "از کی؟" {
+			t.Errorf("completed reply %+v", got)
+		}
+		if _, err := repo.CompletePendingReply(ctx, p.ID, id, "سردرد دارم", "again"); err == nil {
+			t.Error("reply completed twice")
+		}
+		if n := len(transcript(t, repo, s.ID)); n != 2 {
+			t.Errorf("%d messages, want 2", n)
+		}
+
+		// A failed reply leaves its message to be retried.
+		fm, failed, err := repo.CreatePendingReply(ctx, id, nil, "و تب")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.FailPendingReply(ctx, failed.ID, "llm error"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.GetPendingReply(ctx, failed.ID); err != nil || got.Status != pkg.ReplyFailed {
+			t.Errorf("failed reply %+v, %v", got, err)
+		}
+		if _, _, err := repo.ClaimRetry(ctx, s.ID, fm.ID, 3); err != nil {
+			t.Errorf("retry of the failed reply's message: %v", err)
+		}
+
+		// A cap reached by the pending message stores nothing.
+		c := &db.Cap{Limit: 2}
+		if _, _, err := repo.CreatePendingReply(ctx, id, c, "یکی دیگر"); !errors.Is(err, db.ErrCapped) {
+			t.Errorf("pending reply over the cap: %v, want ErrCapped", err)
+		}
+	})
+}
+
+func TestCoalescedReplyBurstCap(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		const burst, limit = 8, 3
+		c := &db.Cap{Limit: limit, NationalID: "0012345678", ClinicID: pkg.DefaultClinic, Since: time.Now().Add(-time.Hour)}
+		var wg sync.WaitGroup
+		errc := make(chan error, burst)
+		for i := 0; i < burst; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := repo.CreateCoalescedReply(ctx, id, c, "پیام")
+				errc <- err
+			}()
+		}
+		wg.Wait()
+		close(errc)
+		var capped int
+		for err := range errc {
+			switch {
+			case errors.Is(err, db.ErrCapped):
+				capped++
+			case err != nil:
+				t.Fatal(err)
+			}
+		}
+		if capped != burst-limit {
+			t.Errorf("%d messages capped, want %d", capped, burst-limit)
+		}
+		if n, err := repo.CountSessionPatientMessages(ctx, s.ID); err != nil || n != limit {
+			t.Errorf("%d patient messages stored, %v; want %d", n, err, limit)
+		}
+	})
+}
+
+func TestClaimRetry(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		m, err := repo.CreateUnansweredMessage(ctx, id, "سردرد دارم")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 2; i++ {
+			got, retries, err := repo.ClaimRetry(ctx, s.ID, m.ID, 2)
+			if err != nil {
+				t.Fatalf("retry %d: %v", i, err)
+			}
+			if got.ID != m.ID || retries != i {
+				t.Errorf("retry %d claimed message %d with %d retries", i, got.ID, retries)
+			}
+		}
+		if _, _, err := repo.ClaimRetry(ctx, s.ID, m.ID, 2); !errors.Is(err, db.ErrRetryLimit) {
+			t.Errorf("third retry: %v, want ErrRetryLimit", err)
+		}
+		if _, err := repo.AnswerMessage(ctx, id, m.ID, "سردرد دارم", "از کی؟"); err != nil {
+			t.Fatal(err)
+		}
+		// Only the latest message can be retried.
+		if _, _, err := repo.ClaimRetry(ctx, s.ID, m.ID, 5); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("retry of an answered message: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestCapCounts(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		before := time.Now().Add(-time.Minute)
+		for i := 0; i < 3; i++ {
+			if _, _, err := repo.CreateMessagePair(ctx, id, nil, "پیام", "پاسخ"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := repo.CreateUnansweredMessage(ctx, id, "بی‌پاسخ"); err != nil {
+			t.Fatal(err)
+		}
+		n, err := repo.CountSessionPatientMessages(ctx, s.ID)
+		if err != nil || n != 4 {
+			t.Errorf("session count %d, %v; want 4", n, err)
+		}
+		n, err = repo.CountUserMessagesSince(ctx, "0012345678", pkg.DefaultClinic, before)
+		if err != nil || n != 4 {
+			t.Errorf("count since before the messages %d, %v; want 4", n, err)
+		}
+		n, err = repo.CountUserMessagesSince(ctx, "0012345678", pkg.DefaultClinic, time.Now().Add(time.Minute))
+		if err != nil || n != 0 {
+			t.Errorf("count since after the messages %d, %v; want 0", n, err)
+		}
+		n, err = repo.CountUserMessagesSince(ctx, "0012345678", "elsewhere", before)
+		if err != nil || n != 0 {
+			t.Errorf("count at another clinic %d, %v; want 0", n, err)
+		}
+		n, err = repo.CountUserMessagesSince(ctx, "0099999999", pkg.DefaultClinic, before)
+		if err != nil || n != 0 {
+			t.Errorf("count of another patient %d, %v; want 0", n, err)
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		if err := repo.UpsertSummary(ctx, &pkg.Summary{SessionID: s.ID, KeyPoints: []string{"سردرد"}}); err != nil {
+			t.Fatal(err)
+		}
+		events, err := repo.ClaimUnpublishedEvents(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Kind != pkg.EventSummaryUpdated || events[0].SessionID != s.ID {
+			t.Fatalf("claimed %+v, want the summary update", events)
+		}
+		// A claimed event is leased to its dispatcher.
+		if again, err := repo.ClaimUnpublishedEvents(ctx, 10, time.Minute); err != nil || len(again) != 0 {
+			t.Errorf("claimed a leased event again: %+v, %v", again, err)
+		}
+		if err := repo.MarkEventPublished(ctx, events[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		listed, err := repo.ListEventsSince(ctx, pkg.DefaultClinic, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 1 || listed[0].PublishedAt == nil {
+			t.Errorf("listed %+v, want the published event", listed)
+		}
+		if other, err := repo.ListEventsSince(ctx, "elsewhere", 0, 10); err != nil || len(other) != 0 {
+			t.Errorf("events of another clinic: %+v, %v", other, err)
+		}
+	})
+}
+
+// backdate sets when a message was created.
+func backdate(t *testing.T, repo *db.Repository, messageID int64, at time.Time) {
+	t.Helper()
+	if _, err := repo.DB.Exec(`UPDATE messages SET created_at = $1 WHERE id = $2`, timeArg(repo, at), messageID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertUserIdempotent(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		u := &pkg.User{NationalID: "0012345678", Phone: "09121111111", Name: "Sara R"}
+		for i := 0; i < 2; i++ {
+			if err := repo.UpsertUser(ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		again, err := repo.GetLatestSession(ctx, "0012345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != s.ID {
+			t.Errorf("upsert opened session %s, want the open one %s", again.ID, s.ID)
+		}
+		var sessions int
+		if err := repo.DB.QueryRow(`SELECT COUNT(*) FROM sessions WHERE patient_national_id = $1`, "0012345678").Scan(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		if sessions != 1 {
+			t.Errorf("%d sessions, want 1", sessions)
+		}
+		got, err := repo.GetUser(ctx, "0012345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Phone != u.Phone || got.Name != u.Name {
+			t.Errorf("user %+v, want the phone and name updated", got)
+		}
+
+		// Another clinic, or a closed session, gets a session of its own.
+		if _, err := repo.DB.Exec(`INSERT INTO clinics (id, name) VALUES ('elsewhere', 'Elsewhere')`); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.UpsertUser(ctx, u, "", "elsewhere", "fa", 10); err != nil {
+			t.Fatal(err)
+		}
+		if closed, err := repo.CloseSession(ctx, s.ID); err != nil || !closed {
+			t.Fatalf("close session: %v, %v", closed, err)
+		}
+		if err := repo.UpsertUser(ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DB.QueryRow(`SELECT COUNT(*) FROM sessions WHERE patient_national_id = $1`, "0012345678").Scan(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		if sessions != 3 {
+			t.Errorf("%d sessions, want 3", sessions)
+		}
+	})
+}
+
+func TestGetTranscriptWindow(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		var ids []int64
+		for _, content := range []string{"هشت روز پیش", "شش روز پیش", "امروز"} {
+			m, err := repo.CreateMessage(ctx, id, pkg.RolePatient, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, m.ID)
+		}
+		backdate(t, repo, ids[0], time.Now().Add(-8*24*time.Hour))
+		backdate(t, repo, ids[1], time.Now().Add(-6*24*time.Hour))
+		ms, err := repo.GetTranscript(ctx, "0012345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ms) != 2 || ms[0].ID != ids[1] || ms[1].ID != ids[2] {
+			t.Errorf("transcript %+v, want the messages of the last 7 days in order", ms)
+		}
+		if other, err := repo.GetTranscript(ctx, "0099999999"); err != nil || len(other) != 0 {
+			t.Errorf("transcript of another patient: %+v, %v", other, err)
+		}
+	})
+}
+
+func TestCountsAcrossWeekBoundary(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		// A week starting on Monday at midnight UTC, a few days ago.
+		now := time.Now().UTC()
+		week := time.Date(now.Year(), now.Month(), now.Day()-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+		for _, at := range []time.Time{week.Add(-time.Second), week, week.Add(time.Second)} {
+			p, _, err := repo.CreateMessagePair(ctx, id, nil, "پیام", "پاسخ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			backdate(t, repo, p.ID, at)
+		}
+		n, err := repo.CountUserMessagesSince(ctx, "0012345678", pkg.DefaultClinic, week)
+		if err != nil || n != 2 {
+			t.Errorf("count since the week started %d, %v; want 2, the one at its start included", n, err)
+		}
+		n, err = repo.CountUserMessagesSince(ctx, "0012345678", pkg.DefaultClinic, week.AddDate(0, 0, -7))
+		if err != nil || n != 3 {
+			t.Errorf("count since the week before %d, %v; want 3", n, err)
+		}
+		// The per-week cap counts the last week's message as well only until
+		// the boundary.
+		c := &db.Cap{Limit: 2, NationalID: "0012345678", ClinicID: pkg.DefaultClinic, Since: week}
+		if _, _, err := repo.CreateMessagePair(ctx, id, c, "یکی دیگر", "پاسخ"); !errors.Is(err, db.ErrCapped) {
+			t.Errorf("third message of the week: %v, want ErrCapped", err)
+		}
+		c.Limit = 3
+		if _, _, err := repo.CreateMessagePair(ctx, id, c, "یکی دیگر", "پاسخ"); err != nil {
+			t.Errorf("third message of the week under a cap of 3: %v", err)
+		}
+	})
+}
+
+func TestSummaries(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		if _, err := repo.GetSummary(ctx, s.ID); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("summary of an unsummarised session: %v, want ErrNotFound", err)
+		}
+
+		claimed, err := repo.ClaimSummary(ctx, s.ID, "h1", false)
+		if err != nil || !claimed {
+			t.Fatalf("first claim: %v, %v", claimed, err)
+		}
+		if claimed, err := repo.ClaimSummary(ctx, s.ID, "h1", false); err != nil || claimed {
+			t.Errorf("claim of a hash being summarised: %v, %v; want false", claimed, err)
+		}
+		if claimed, err := repo.ClaimSummary(ctx, s.ID, "h1", true); err != nil || !claimed {
+			t.Errorf("forced claim: %v, %v; want true", claimed, err)
+		}
+		summary := &pkg.Summary{
+			SessionID:      s.ID,
+			KeyPoints:      []string{"سردرد"},
+			Structured:     map[string]interface{}{"allergies": []interface{}{"پنی‌سیلین"}},
+			FreeText:       "بیمار سردرد دارد.",
+			TranscriptHash: "h1",
+			Model:          "test-model",
+			SchemaVersion:  2,
+		}
+		if err := repo.UpsertSummary(ctx, summary); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.GetSummary(ctx, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FreeText != summary.FreeText || len(got.KeyPoints) != 1 || got.KeyPoints[0] != "سردرد" ||
+			got.Model != "test-model" || got.SchemaVersion != 2 || got.TranscriptHash != "h1" {
+			t.Errorf("stored summary %+v", got)
+		}
+		if got.LastAttempt == nil || got.LastAttempt.Status != pkg.AttemptOK {
+			t.Errorf("last attempt %+v, want ok", got.LastAttempt)
+		}
+		// A summary of the same transcript is not regenerated.
+		if claimed, err := repo.ClaimSummary(ctx, s.ID, "h1", false); err != nil || claimed {
+			t.Errorf("claim of the summarised hash: %v, %v; want false", claimed, err)
+		}
+
+		// A failed regeneration releases its claim and keeps the summary.
+		if claimed, err := repo.ClaimSummary(ctx, s.ID, "h2", false); err != nil || !claimed {
+			t.Fatalf("claim of a new hash: %v, %v", claimed, err)
+		}
+		if err := repo.ReleaseSummaryClaim(ctx, s.ID, "h2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.RecordSummaryFailure(ctx, s.ID, "timeout"); err != nil {
+			t.Fatal(err)
+		}
+		got, err = repo.GetSummary(ctx, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FreeText != summary.FreeText || got.LastAttempt == nil || got.LastAttempt.Status != pkg.AttemptFailed || got.LastAttempt.Error != "timeout" {
+			t.Errorf("summary after a failure %+v, attempt %+v", got, got.LastAttempt)
+		}
+		if claimed, err := repo.ClaimSummary(ctx, s.ID, "h2", false); err != nil || !claimed {
+			t.Errorf("claim after the release: %v, %v; want true", claimed, err)
+		}
+		// A write for a superseded claim is dropped.
+		stale := *summary
+		stale.FreeText, stale.TranscriptHash = "قدیمی", "h1"
+		if err := repo.UpsertSummary(ctx, &stale); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.GetSummary(ctx, s.ID); err != nil || got.FreeText != summary.FreeText {
+			t.Errorf("summary after a superseded write %+v, %v", got, err)
+		}
+
+		// The patient's next visit sees this one's summary.
+		if _, err := repo.CloseSession(ctx, s.ID); err != nil {
+			t.Fatal(err)
+		}
+		next := startSession(t, repo, "0012345678")
+		past, err := repo.ListPastSummaries(ctx, "0012345678", next.ID, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(past) != 1 || past[0].SessionID != s.ID {
+			t.Errorf("past summaries %+v, want the first session's", past)
+		}
+
+		// Listing returns settled summaries only.
+		list, err := repo.ListSummaries(ctx, pkg.SummaryFilter{NationalID: "0012345678"})
+		if err != nil || len(list) != 0 {
+			t.Errorf("listed %+v, %v; want none before the summary settles", list, err)
+		}
+		if _, err := repo.DB.Exec(`UPDATE summaries SET updated_at = $1`, timeArg(repo, time.Now().Add(-time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+		list, err = repo.ListSummaries(ctx, pkg.SummaryFilter{NationalID: "0012345678"})
+		if err != nil || len(list) != 1 || list[0].SessionID != s.ID {
+			t.Errorf("listed %+v, %v; want the session's summary", list, err)
+		}
+		if other, err := repo.ListSummaries(ctx, pkg.SummaryFilter{NationalID: "0099999999"}); err != nil || len(other) != 0 {
+			t.Errorf("summaries of another patient: %+v, %v", other, err)
+		}
+	})
+}
+
+func TestListSummariesFilters(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		// Three patients' summaries, last updated three days, two days
+		// and two hours ago.
+		updated := map[string]time.Time{
+			"0011111111": now.Add(-72 * time.Hour),
+			"0022222222": now.Add(-48 * time.Hour),
+			"0033333333": now.Add(-2 * time.Hour),
+		}
+		sessions := map[string]string{}
+		for nationalID, at := range updated {
+			s := startSession(t, repo, nationalID)
+			sessions[s.ID] = nationalID
+			if err := repo.UpsertSummary(ctx, &pkg.Summary{SessionID: s.ID, KeyPoints: []string{"سردرد"}, FreeText: "سردرد"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.DB.Exec(`UPDATE summaries SET updated_at = $1 WHERE session_id = $2`, timeArg(repo, at), s.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		list := func(f pkg.SummaryFilter) []string {
+			t.Helper()
+			summaries, err := repo.ListSummaries(ctx, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, s := range summaries {
+				ids = append(ids, sessions[s.SessionID])
+			}
+			return ids
+		}
+
+		tests := []struct {
+			name   string
+			filter pkg.SummaryFilter
+			want   []string
+		}{
+			{"all", pkg.SummaryFilter{}, []string{"0011111111", "0022222222", "0033333333"}},
+			{"patient", pkg.SummaryFilter{NationalID: "0022222222"}, []string{"0022222222"}},
+			{"unknown patient", pkg.SummaryFilter{NationalID: "0099999999"}, nil},
+			{"from", pkg.SummaryFilter{From: now.Add(-60 * time.Hour)}, []string{"0022222222", "0033333333"}},
+			{"to", pkg.SummaryFilter{To: now.Add(-48 * time.Hour)}, []string{"0011111111"}},
+			{"from and to", pkg.SummaryFilter{From: now.Add(-60 * time.Hour), To: now.Add(-time.Hour)}, []string{"0022222222", "0033333333"}},
+			{"from and patient", pkg.SummaryFilter{From: now.Add(-60 * time.Hour), NationalID: "0011111111"}, nil},
+			{"limit", pkg.SummaryFilter{Limit: 2}, []string{"0011111111", "0022222222"}},
+		}
+		for _, tt := range tests {
+			if got := list(tt.filter); !equalStrings(got, tt.want) {
+				t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+			}
+		}
+
+		// Paging resumes after the cursor; a summary updated meanwhile
+		// moves behind it and is listed again.
+		page, err := repo.ListSummaries(ctx, pkg.SummaryFilter{Limit: 2})
+		if err != nil || len(page) != 2 {
+			t.Fatalf("first page %+v, %v", page, err)
+		}
+		if _, err := repo.DB.Exec(`UPDATE summaries SET updated_at = $1 WHERE session_id = $2`, timeArg(repo, now.Add(-time.Minute)), page[0].SessionID); err != nil {
+			t.Fatal(err)
+		}
+		last := page[len(page)-1]
+		if got, want := list(pkg.SummaryFilter{AfterUpdatedAt: last.UpdatedAt, AfterID: last.ID}), []string{"0033333333", "0011111111"}; !equalStrings(got, want) {
+			t.Errorf("second page %v, want %v", got, want)
+		}
+
+		// Summaries updated at the same time are ordered by id.
+		if _, err := repo.DB.Exec(`UPDATE summaries SET updated_at = $1`, timeArg(repo, now.Add(-time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+		page, err = repo.ListSummaries(ctx, pkg.SummaryFilter{Limit: 1})
+		if err != nil || len(page) != 1 {
+			t.Fatalf("first page of ties %+v, %v", page, err)
+		}
+		if rest, err := repo.ListSummaries(ctx, pkg.SummaryFilter{AfterUpdatedAt: page[0].UpdatedAt, AfterID: page[0].ID}); err != nil || len(rest) != 2 || rest[0].ID <= page[0].ID || rest[1].ID <= rest[0].ID {
+			t.Errorf("pages of ties %+v then %+v, %v", page, rest, err)
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchMessagesPersian(t *testing.T) {
+	t.Parallel()
+	repo := newRepo(t)
+	ctx := context.Background()
+	a := startSession(t, repo, "0012345678")
+	b := startSession(t, repo, "0098765432")
+	if _, _, err := repo.CreateMessagePair(ctx, uuid.MustParse(a.ID), nil, "به پنی‌سیلین حساسیت دارم", "ممنون."); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.CreateMessagePair(ctx, uuid.MustParse(b.ID), nil, "Allergic to PENICILLIN, ۵۰٪ sure", "ممنون."); err != nil {
+		t.Fatal(err)
+	}
+	var indexed bool
+	if err := repo.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_indexes WHERE tablename = 'messages' AND indexdef LIKE '%gin_trgm_ops%')`).Scan(&indexed); err != nil || !indexed {
+		t.Errorf("no trigram index on messages: %v", err)
+	}
+	tests := []struct {
+		query, nationalID string
+		want              []string
+		match             string
+	}{
+		{"پنی‌سیلین", "", []string{a.ID}, "پنی‌سیلین"},
+		{"penicillin", "", []string{b.ID}, "PENICILLIN"},
+		{"حساسیت", "0098765432", nil, ""},
+		{"٪", "", []string{b.ID}, "٪"},
+		{"%", "", nil, ""},
+	}
+	for _, tt := range tests {
+		hits, err := repo.SearchMessages(ctx, tt.query, tt.nationalID, "", 10)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var got []string
+		for _, h := range hits {
+			got = append(got, h.SessionID)
+			if h.Match != tt.match {
+				t.Errorf("%s: match %q, want %q", tt.query, h.Match, tt.match)
+			}
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s: sessions %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPromptProfileReplyLength(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		p := &pkg.PromptProfile{Name: "village", SystemPrompt: "…", MaxReplyChars: 200, SimpleLanguage: true, SummaryLanguage: "en"}
+		if err := repo.UpsertPromptProfile(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.GetPromptProfile(ctx, "village")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.MaxReplyChars != 200 || !got.SimpleLanguage || got.SummaryLanguage != "en" {
+			t.Errorf("profile %+v, want 200 characters in simple language, summarised in English", got)
+		}
+		p.MaxReplyChars, p.SimpleLanguage, p.SummaryLanguage = 0, false, ""
+		if err := repo.UpsertPromptProfile(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		list, err := repo.ListPromptProfiles(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].MaxReplyChars != 0 || list[0].SimpleLanguage || list[0].SummaryLanguage != "" {
+			t.Errorf("profiles %+v, want the settings cleared", list)
+		}
+	})
+}
+
+func TestPoolWarmUpBurst(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		pool := db.PoolConfig{MaxOpenConns: 3, MaxIdleConns: 3, ConnMaxLifetime: time.Minute, WarmUpConns: 3}
+		pool.Apply(repo.DB)
+		if err := pool.WarmUp(ctx, repo.DB); err != nil {
+			t.Fatal(err)
+		}
+		if st := repo.DB.Stats(); st.Idle != 3 || st.OpenConnections != 3 || st.MaxOpenConnections != 3 {
+			t.Fatalf("after warm up %+v, want 3 idle of at most 3", st)
+		}
+		// A burst runs on the warm connections without opening others.
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := repo.GetLatestSession(ctx, fmt.Sprintf("00%08d", i)); err != nil && !errs.Is(err, errs.NotFound) {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if st := repo.DB.Stats(); st.OpenConnections != 3 || st.MaxIdleClosed != 0 || st.MaxLifetimeClosed != 0 {
+			t.Errorf("after the burst %+v, want the 3 warm connections kept", st)
+		}
+	})
+}
+
+func TestClinicHours(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		c, err := repo.GetClinic(ctx, pkg.DefaultClinic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.OperatingHours != "" || c.Timezone != "" {
+			t.Errorf("clinic %+v, want no operating hours by default", c)
+		}
+		hours := "sat-wed 08:00-20:00; thu 08:00-13:00"
+		if _, err := repo.DB.Exec(`UPDATE clinics SET operating_hours = $1, timezone = $2 WHERE id = $3`, hours, "Asia/Tehran", pkg.DefaultClinic); err != nil {
+			t.Fatal(err)
+		}
+		if c, err = repo.GetClinic(ctx, pkg.DefaultClinic); err != nil {
+			t.Fatal(err)
+		}
+		if c.OperatingHours != hours || c.Timezone != "Asia/Tehran" {
+			t.Errorf("clinic %+v, want the operating hours in Tehran", c)
+		}
+	})
+}
+
+func TestExportProvenance(t *testing.T) {
+	eachBackend(t, func(t *testing.T, repo *db.Repository) {
+		ctx := context.Background()
+		s := startSession(t, repo, "0012345678")
+		id := uuid.MustParse(s.ID)
+		patient, err := repo.CreateMessage(ctx, id, pkg.RolePatient, "سردرد دارم")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := repo.CreateMessage(ctx, id, pkg.RoleBot, "از کی این درد را دارید؟")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetMessageMeta(ctx, reply.ID, pkg.MetaModel, "gpt-main"); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := repo.GetSessionMetadata(ctx, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var model string
+		if ok, err := meta[reply.ID].Get(pkg.MetaModel, &model); !ok || err != nil || model != "gpt-main" {
+			t.Errorf("metadata %v: model %q, want gpt-main", meta, model)
+		}
+		if _, ok := meta[patient.ID]; ok || len(meta) != 1 {
+			t.Errorf("metadata %v, want the reply's only", meta)
+		}
+
+		if err := repo.UpsertSummary(ctx, &pkg.Summary{SessionID: s.ID, FreeText: "سردرد", Model: "gpt-summary", SchemaVersion: 1}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.GetSummary(ctx, s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Model != "gpt-summary" || got.SchemaVersion != 1 {
+			t.Errorf("summary by %q in schema version %d, want gpt-summary in 1", got.Model, got.SchemaVersion)
+		}
+		// A summary regenerated without a reported model keeps none.
+		if err := repo.UpsertSummary(ctx, &pkg.Summary{SessionID: s.ID, FreeText: "سردرد", SchemaVersion: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = repo.GetSummary(ctx, s.ID); err != nil {
+			t.Fatal(err)
+		}
+		if got.Model != "" || got.SchemaVersion != 2 {
+			t.Errorf("summary by %q in schema version %d, want no model in 2", got.Model, got.SchemaVersion)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+
+	"waitroom-chatbot/pkg"
+)
+
+// AddLLMCost adds the tokens and estimated cost of an LLM call to the
+// running total of its month ("2006-01") and model.
+func (r *Repository) AddLLMCost(ctx context.Context, month, model string, promptTokens, completionTokens int, cost float64) error {
+	_, err := r.DB.ExecContext(ctx,
+		`INSERT INTO llm_costs (month, model, prompt_tokens, completion_tokens, cost_usd, updated_at)
+         VALUES ($1, $2, $3, $4, $5, `+r.Dialect.now()+`)
+         ON CONFLICT (month, model) DO UPDATE
+         SET prompt_tokens     = llm_costs.prompt_tokens + EXCLUDED.prompt_tokens,
+             completion_tokens = llm_costs.completion_tokens + EXCLUDED.completion_tokens,
+             cost_usd          = llm_costs.cost_usd + EXCLUDED.cost_usd,
+             updated_at        = EXCLUDED.updated_at`,
+		month, model, promptTokens, completionTokens, cost)
+	return err
+}
+
+// MonthlyLLMCost returns the estimated LLM spend of a month across models.
+func (r *Repository) MonthlyLLMCost(ctx context.Context, month string) (float64, error) {
+	var cost float64
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(cost_usd), 0) FROM llm_costs WHERE month = $1`, month,
+	).Scan(&cost)
+	return cost, err
+}
+
+// ListLLMCosts returns a month's usage per model, most expensive first.
+func (r *Repository) ListLLMCosts(ctx context.Context, month string) ([]pkg.LLMCost, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT month, model, prompt_tokens, completion_tokens, cost_usd
+         FROM llm_costs
+         WHERE month = $1
+         ORDER BY cost_usd DESC, model`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.LLMCost
+	for rows.Next() {
+		var c pkg.LLMCost
+		if err := rows.Scan(&c.Month, &c.Model, &c.PromptTokens, &c.CompletionTokens, &c.Cost); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
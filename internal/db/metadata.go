@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+
+	"waitroom-chatbot/pkg"
+)
+
+// SetMessageMeta stores value, encoded as JSON, under key in the metadata
+// of a message (see pkg.MessageMetadata).  The key is set in place, so
+// other keys, including ones set concurrently, are kept.
+func (r *Repository) SetMessageMeta(ctx context.Context, messageID int64, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = r.DB.ExecContext(ctx,
+		`UPDATE messages SET metadata = `+r.Dialect.jsonSet("metadata", "$1", "$2")+` WHERE id = $3`,
+		key, string(raw), messageID)
+	return err
+}
+
+// GetMessageMetadata returns the metadata of a message.
+func (r *Repository) GetMessageMetadata(ctx context.Context, messageID int64) (pkg.MessageMetadata, error) {
+	var raw []byte
+	if err := r.DB.QueryRowContext(ctx,
+		`SELECT metadata FROM messages WHERE id = $1`, messageID,
+	).Scan(&raw); err != nil {
+		return nil, err
+	}
+	meta := make(pkg.MessageMetadata)
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// GetSessionMetadata returns the metadata of the messages of a session by
+// message ID.  Messages without any metadata are left out.
+func (r *Repository) GetSessionMetadata(ctx context.Context, sessionID string) (map[int64]pkg.MessageMetadata, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, metadata FROM messages WHERE session_id = $1`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]pkg.MessageMetadata)
+	for rows.Next() {
+		var id int64
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, err
+		}
+		meta := make(pkg.MessageMetadata)
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, err
+		}
+		if len(meta) > 0 {
+			out[id] = meta
+		}
+	}
+	return out, rows.Err()
+}
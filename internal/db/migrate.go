@@ -10,10 +10,17 @@ import (
 //go:embed schema.sql
 var schemaSQL string
 
+//go:embed schema_sqlite.sql
+var sqliteSchemaSQL string
+
 // Migrate applies the database schema to the given database. It executes the
-// statements in schema.sql which create tables and types if they do not
-// already exist.
-func Migrate(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, schemaSQL)
+// statements in schema.sql (schema_sqlite.sql for SQLite) which create tables
+// and types if they do not already exist.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	schema := schemaSQL
+	if dialect == SQLite {
+		schema = sqliteSchemaSQL
+	}
+	_, err := db.ExecContext(ctx, schema)
 	return err
 }
@@ -5,10 +5,27 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/lib/pq"
 )
 
+// Broker delivers summary update notifications to listeners such as the
+// doctor dashboard.  Notifier implements it for Postgres; LocalBroker keeps
+// listeners in process for SQLite, which has no LISTEN/NOTIFY.
+type Broker interface {
+	Notify(ctx context.Context, sessionID string) error
+	Listen(ctx context.Context) (<-chan string, error)
+}
+
+// NewBroker returns the Broker suited to the dialect.
+func NewBroker(dialect Dialect, db *sql.DB, channel string) Broker {
+	if dialect == SQLite {
+		return NewLocalBroker()
+	}
+	return NewNotifier(db, channel)
+}
+
 // Notifier wraps the LISTEN/NOTIFY mechanism in PostgreSQL.  It can send
 // notifications when summaries are updated and listen for them on the
 // doctor dashboard.  In this skeleton the functionality is simplified.
@@ -74,3 +91,45 @@ func (n *Notifier) Listen(ctx context.Context) (<-chan string, error) {
 	}()
 	return ch, nil
 }
+
+// LocalBroker is an in-process Broker.  It only reaches listeners in the same
+// process, which is all a single-instance SQLite deployment has.
+type LocalBroker struct {
+	mu        sync.Mutex
+	listeners map[chan string]struct{}
+}
+
+// NewLocalBroker constructs an empty LocalBroker.
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{listeners: make(map[chan string]struct{})}
+}
+
+// Notify delivers the session ID to every listener.  Listeners that are not
+// keeping up miss the notification rather than blocking the sender.
+func (b *LocalBroker) Notify(ctx context.Context, sessionID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.listeners {
+		select {
+		case ch <- sessionID:
+		default:
+		}
+	}
+	return nil
+}
+
+// Listen yields session IDs until ctx is cancelled, then closes the channel.
+func (b *LocalBroker) Listen(ctx context.Context) (<-chan string, error) {
+	ch := make(chan string, 16)
+	b.mu.Lock()
+	b.listeners[ch] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.listeners, ch)
+		b.mu.Unlock()
+		close(ch)
+	}()
+	return ch, nil
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"database/sql"
+	"net/url"
+
+	_ "github.com/lib/pq"  // Postgres driver
+	_ "modernc.org/sqlite" // SQLite driver
+)
+
+// Open opens the database for the dialect.  For Postgres dsn is a lib/pq
+// connection string; for SQLite it is the path of the database file, which
+// is opened with foreign keys enforced and in WAL mode so the dashboard can
+// read while patients write.
+func Open(dialect Dialect, dsn string) (*sql.DB, error) {
+	return sql.Open(driverDSN(dialect, dsn))
+}
+
+// driverDSN returns the database/sql driver name and data source name Open
+// uses for the dialect.
+func driverDSN(dialect Dialect, dsn string) (string, string) {
+	if dialect != SQLite {
+		return "postgres", dsn
+	}
+	q := url.Values{}
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Set("_time_format", "sqlite")
+	return "sqlite", "file:" + dsn + "?" + q.Encode()
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PoolConfig tunes the connection pool of a database handle.  MaxOpenConns
+// caps the connections open at once (0 for no cap), MaxIdleConns the ones
+// kept open between queries, and ConnMaxLifetime how long a connection is
+// reused before it is replaced (0 for ever).  WarmUpConns connections are
+// opened at startup by WarmUp; the pool keeps at most MaxIdleConns of
+// them.  The defaults are in package config.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	WarmUpConns     int
+}
+
+// Apply sets the pool settings on db.
+func (c PoolConfig) Apply(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+}
+
+// WarmUp opens and pings the configured number of connections, all at
+// once, then returns them to the pool so the first requests after startup
+// do not wait for connections to be established.  The count is bounded by
+// MaxIdleConns and MaxOpenConns, as the pool would close or refuse the
+// others.
+func (c PoolConfig) WarmUp(ctx context.Context, db *sql.DB) error {
+	n := c.WarmUpConns
+	if n > c.MaxIdleConns {
+		n = c.MaxIdleConns
+	}
+	if c.MaxOpenConns > 0 && n > c.MaxOpenConns {
+		n = c.MaxOpenConns
+	}
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPoolConfigApply(t *testing.T) {
+	conn, err := Open(SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	pool := PoolConfig{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Hour}
+	pool.Apply(conn)
+	if got := conn.Stats().MaxOpenConnections; got != 4 {
+		t.Errorf("max open connections %d, want 4", got)
+	}
+	// Three connections released at once: the pool keeps two of them idle
+	// and closes the third.
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		c, err := conn.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if st := conn.Stats(); st.Idle != 2 || st.MaxIdleClosed != 1 {
+		t.Errorf("%d idle, %d closed as surplus; want 2 idle, 1 closed", st.Idle, st.MaxIdleClosed)
+	}
+	// The lifetime is reported only through the connections it closes, so
+	// the handle's setter is checked with a lifetime already expired.
+	expired := PoolConfig{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Nanosecond}
+	expired.Apply(conn)
+	if err := conn.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := conn.Stats(); st.MaxLifetimeClosed == 0 {
+		t.Errorf("stats %+v: no connection closed for its lifetime", st)
+	}
+}
+
+func TestPoolWarmUp(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pool PoolConfig
+		idle int
+	}{
+		{"no warm up", PoolConfig{MaxIdleConns: 5}, 0},
+		{"warm up", PoolConfig{MaxIdleConns: 5, WarmUpConns: 3}, 3},
+		{"bounded by the idle cap", PoolConfig{MaxIdleConns: 2, WarmUpConns: 5}, 2},
+		{"bounded by the open cap", PoolConfig{MaxOpenConns: 1, MaxIdleConns: 5, WarmUpConns: 5}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Open(SQLite, filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			tc.pool.Apply(conn)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tc.pool.WarmUp(ctx, conn); err != nil {
+				t.Fatal(err)
+			}
+			if st := conn.Stats(); st.OpenConnections != tc.idle || st.Idle != tc.idle {
+				t.Errorf("%d open, %d idle; want %d idle", st.OpenConnections, st.Idle, tc.idle)
+			}
+		})
+	}
+}
+
+func TestPoolWarmUpCanceled(t *testing.T) {
+	conn, err := Open(SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := PoolConfig{MaxIdleConns: 2, WarmUpConns: 2}
+	if err := pool.WarmUp(ctx, conn); err == nil {
+		t.Error("warm up with a canceled context succeeded")
+	}
+	if st := conn.Stats(); st.InUse != 0 {
+		t.Errorf("%d connections left in use", st.InUse)
+	}
+}
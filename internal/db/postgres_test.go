@@ -0,0 +1,177 @@
+//go:build integration
+
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/db"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// postgresImage is the image the integration tests run Postgres from.
+const postgresImage = "postgres:16-alpine"
+
+// serverDSN is the connection string of the Postgres server the tests
+// create their databases on, with a %s for the database name; empty when
+// none could be started.
+var serverDSN string
+
+// TestMain runs the integration tests against INTEGRATION_POSTGRES_URL, a
+// Postgres server URL without a database name, or else against Postgres
+// started with testcontainers for the run.  Without either, e.g. where
+// Docker is not available, the Postgres tests are skipped; eachBackend
+// still runs its tests on SQLite.
+func TestMain(m *testing.M) {
+	if url := os.Getenv("INTEGRATION_POSTGRES_URL"); url != "" {
+		serverDSN = strings.TrimSuffix(url, "/") + "/%s?sslmode=disable"
+		os.Exit(m.Run())
+	}
+	ctx := context.Background()
+	container, err := startPostgres(ctx)
+	if err != nil {
+		log.Printf("Postgres tests skipped: %v", err)
+		os.Exit(m.Run())
+	}
+	code := m.Run()
+	_ = container.Terminate(ctx)
+	os.Exit(code)
+}
+
+// startPostgres starts a throwaway Postgres container, waits for it to
+// accept connections and sets serverDSN.
+func startPostgres(ctx context.Context) (container testcontainers.Container, err error) {
+	// testcontainers panics when it finds no Docker to talk to.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("docker not available: %v", r)
+		}
+	}()
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err != nil {
+		return nil, fmt.Errorf("docker not available: %w", err)
+	}
+	if err := provider.Health(ctx); err != nil {
+		return nil, fmt.Errorf("docker not available: %w", err)
+	}
+	dsn := func(host string, port nat.Port) string {
+		return "postgres://postgres:test@" + net.JoinHostPort(host, port.Port()) + "/%s?sslmode=disable"
+	}
+	container, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        postgresImage,
+			Env:          map[string]string{"POSTGRES_PASSWORD": "test"},
+			ExposedPorts: []string{"5432/tcp"},
+			WaitingFor: wait.ForSQL("5432/tcp", "postgres", func(host string, port nat.Port) string {
+				return fmt.Sprintf(dsn(host, port), "postgres")
+			}).WithStartupTimeout(60 * time.Second),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("start postgres: %w", err)
+	}
+	host, err := container.Host(ctx)
+	if err != nil {
+		_ = container.Terminate(ctx)
+		return nil, err
+	}
+	port, err := container.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		_ = container.Terminate(ctx)
+		return nil, err
+	}
+	serverDSN = dsn(host, port)
+	return container, nil
+}
+
+// databases numbers the databases created by newRepo.
+var databases int64
+
+// newRepo returns a Repository on a database of its own, migrated, so
+// tests can run in parallel.  It skips the test without a Postgres server.
+func newRepo(t *testing.T) *db.Repository {
+	t.Helper()
+	if serverDSN == "" {
+		t.Skip("no Postgres server")
+	}
+	admin, err := sql.Open("postgres", fmt.Sprintf(serverDSN, "postgres"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	name := fmt.Sprintf("test_%d_%d", os.Getpid(), atomic.AddInt64(&databases, 1))
+	if _, err := admin.Exec(`CREATE DATABASE ` + name); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Open(db.Postgres, fmt.Sprintf(serverDSN, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		if admin, err := sql.Open("postgres", fmt.Sprintf(serverDSN, "postgres")); err == nil {
+			_, _ = admin.Exec(`DROP DATABASE IF EXISTS ` + name)
+			admin.Close()
+		}
+	})
+	if err := db.Migrate(context.Background(), conn, db.Postgres); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db.NewRepository(conn)
+}
+
+// newSQLiteRepo returns a Repository on a migrated SQLite database of its
+// own.
+func newSQLiteRepo(t *testing.T) *db.Repository {
+	t.Helper()
+	conn, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.Migrate(context.Background(), conn, db.SQLite); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo := db.NewRepository(conn)
+	repo.Dialect = db.SQLite
+	return repo
+}
+
+// eachBackend runs test in parallel against a repository of its own on
+// each database backend, so both run the same suite.  The Postgres run is
+// skipped without a Postgres server.
+func eachBackend(t *testing.T, test func(t *testing.T, repo *db.Repository)) {
+	for _, open := range []struct {
+		name string
+		repo func(*testing.T) *db.Repository
+	}{{"sqlite", newSQLiteRepo}, {"postgres", newRepo}} {
+		open := open
+		t.Run(open.name, func(t *testing.T) {
+			t.Parallel()
+			test(t, open.repo(t))
+		})
+	}
+}
+
+// timeArg returns t as a query argument comparing correctly with the
+// timestamp columns of the repository's backend.
+func timeArg(repo *db.Repository, t time.Time) interface{} {
+	if repo.Dialect == db.SQLite {
+		return t.UTC().Format("2006-01-02 15:04:05.000")
+	}
+	return t
+}
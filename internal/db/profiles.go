@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+
+	"waitroom-chatbot/pkg"
+)
+
+// UpsertPromptProfile creates a prompt profile or replaces the prompts of an
+// existing one with the same name.
+func (r *Repository) UpsertPromptProfile(ctx context.Context, p *pkg.PromptProfile) error {
+	return r.DB.QueryRowContext(ctx,
+		`INSERT INTO prompt_profiles (name, system_prompt, first_message, summarize_instruction, max_reply_chars, simple_language, summary_language)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)
+         ON CONFLICT (name) DO UPDATE
+         SET system_prompt         = EXCLUDED.system_prompt,
+             first_message         = EXCLUDED.first_message,
+             summarize_instruction = EXCLUDED.summarize_instruction,
+             max_reply_chars       = EXCLUDED.max_reply_chars,
+             simple_language       = EXCLUDED.simple_language,
+             summary_language      = EXCLUDED.summary_language,
+             updated_at            = `+r.Dialect.now()+`
+         RETURNING updated_at`,
+		p.Name, p.SystemPrompt, p.FirstMessage, p.SummarizeInstruction, p.MaxReplyChars, p.SimpleLanguage, p.SummaryLanguage,
+	).Scan(&p.UpdatedAt)
+}
+
+// GetPromptProfile loads a prompt profile by name.  It returns ErrNotFound
+// when no such profile exists.
+func (r *Repository) GetPromptProfile(ctx context.Context, name string) (*pkg.PromptProfile, error) {
+	var p pkg.PromptProfile
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT name, system_prompt, first_message, summarize_instruction, max_reply_chars, simple_language, summary_language, updated_at
+         FROM prompt_profiles
+         WHERE name = $1`, name,
+	).Scan(&p.Name, &p.SystemPrompt, &p.FirstMessage, &p.SummarizeInstruction, &p.MaxReplyChars, &p.SimpleLanguage, &p.SummaryLanguage, &p.UpdatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+// ListPromptProfiles returns all prompt profiles ordered by name.
+func (r *Repository) ListPromptProfiles(ctx context.Context) ([]pkg.PromptProfile, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT name, system_prompt, first_message, summarize_instruction, max_reply_chars, simple_language, summary_language, updated_at
+         FROM prompt_profiles
+         ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.PromptProfile
+	for rows.Next() {
+		var p pkg.PromptProfile
+		if err := rows.Scan(&p.Name, &p.SystemPrompt, &p.FirstMessage, &p.SummarizeInstruction, &p.MaxReplyChars, &p.SimpleLanguage, &p.SummaryLanguage, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// DeletePromptProfile removes a profile.  Sessions referencing it fall back
+// to the default prompts.
+func (r *Repository) DeletePromptProfile(ctx context.Context, name string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM prompt_profiles WHERE name = $1`, name)
+	return err
+}
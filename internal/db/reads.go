@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// MarkSessionRead records that the patient's chat page has shown the
+// session's messages up to seq.  It is a single UPDATE that only moves
+// last_read_seq forward, so repeated and out-of-order receipts are
+// harmless, and it matches nothing for another patient's session or a seq
+// beyond the session's messages.
+func (r *Repository) MarkSessionRead(ctx context.Context, sessionID, nationalID string, seq int) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions SET last_read_seq = $1
+         WHERE id = $2 AND COALESCE(patient_national_id_hmac, patient_national_id) = $3
+           AND last_read_seq < $1 AND last_seq >= $1`,
+		seq, sessionID, r.lookupKey(nationalID))
+	return err
+}
+
+// ReadReceiptStats counts, among the sessions started in [from, to) with a
+// bot message, those whose last message is the bot's, left unanswered, and
+// those whose last bot message the patient's page never showed.
+func (r *Repository) ReadReceiptStats(ctx context.Context, from, to time.Time) (pkg.ReadStats, error) {
+	var stats pkg.ReadStats
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*),
+                COALESCE(SUM(CASE WHEN b.last_bot_seq = s.last_seq THEN 1 ELSE 0 END), 0),
+                COALESCE(SUM(CASE WHEN b.last_bot_seq > s.last_read_seq THEN 1 ELSE 0 END), 0)
+         FROM sessions s
+         JOIN (SELECT session_id, MAX(seq) AS last_bot_seq
+               FROM messages
+               WHERE role = 'bot'
+               GROUP BY session_id) b ON b.session_id = s.id
+         WHERE s.created_at >= $1 AND s.created_at < $2`,
+		r.Dialect.timeArg(from), r.Dialect.timeArg(to),
+	).Scan(&stats.Sessions, &stats.Unanswered, &stats.Unread)
+	return stats, err
+}
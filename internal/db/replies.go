@@ -0,0 +1,532 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// CreatePendingReply stores the patient message patient, flagged as
+// unanswered, and records the reply to it that is about to be generated in
+// the background, in one transaction.  The message counts toward the cap
+// and shows on reloads at once; should the reply never be stored, it is
+// left for the patient to retry (see ClaimRetry).  With c the cap is checked
+// in the transaction as by CreateMessagePair.
+func (r *Repository) CreatePendingReply(ctx context.Context, sessionID uuid.UUID, c *Cap, patient string) (*pkg.Message, *pkg.PendingReply, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	m, err := insertUnanswered(ctx, tx, sessionID, patient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c != nil {
+		if err := r.checkCap(ctx, tx, sessionID, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	p := pkg.PendingReply{ID: uuid.NewString(), SessionID: sessionID.String(), Status: pkg.ReplyPending, Patient: patient, PatientMessageID: m.ID}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO pending_replies (id, session_id, patient_message_id) VALUES ($1, $2, $3)
+         RETURNING created_at`, p.ID, sessionID, m.ID,
+	).Scan(&p.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	r.Transcripts.add(m)
+	return m, &p, nil
+}
+
+// ErrMessageEdited is returned by CompletePendingReply and
+// CompleteCoalescedReply when the patient edited the message after its
+// reply was generated.
+var ErrMessageEdited = errs.New(errs.Conflict, "patient message edited")
+
+// CompletePendingReply stores the generated reply to the patient message of
+// a pending reply, clears the message's unanswered flag and marks the
+// pending reply done, in one transaction.  It returns the bot message.
+// patient is the message the reply was generated for: when the patient
+// edited it meanwhile nothing is stored and ErrMessageEdited is returned,
+// for the reply to the edited message (see GetPendingReply) to be generated
+// instead.  When the message was answered otherwise, by a retry, the
+// pending reply is superseded and ErrReplySuperseded returned.
+func (r *Repository) CompletePendingReply(ctx context.Context, replyID string, sessionID uuid.UUID, patient, reply string) (*pkg.Message, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var patientID int64
+	err = tx.QueryRowContext(ctx,
+		`UPDATE pending_replies
+         SET status = 'done', completed_at = `+r.Dialect.now()+`
+         WHERE id = $1 AND status = 'pending' AND patient_message_id IS NOT NULL
+         RETURNING patient_message_id`, replyID,
+	).Scan(&patientID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	res, err := tx.ExecContext(ctx,
+		`UPDATE messages SET unanswered = FALSE
+         WHERE id = $1 AND unanswered AND content = $2 AND deleted_at IS NULL`, patientID, patient)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		var unanswered bool
+		if tx.QueryRowContext(ctx,
+			`SELECT unanswered FROM messages WHERE id = $1 AND deleted_at IS NULL`, patientID,
+		).Scan(&unanswered) == nil && unanswered {
+			return nil, ErrMessageEdited
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE pending_replies SET status = 'superseded' WHERE id = $1`, replyID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReplySuperseded
+	}
+	b, err := insertMessage(ctx, tx, sessionID, pkg.RoleBot, reply)
+	if err != nil {
+		return nil, err
+	}
+	if err := touchSession(ctx, tx, b); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE pending_replies SET message_id = $1 WHERE id = $2`, b.ID, replyID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.add(b)
+	return b, nil
+}
+
+// FailPendingReply marks a pending reply as failed.
+func (r *Repository) FailPendingReply(ctx context.Context, replyID, reason string) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE pending_replies
+         SET status = 'failed', error = $1, completed_at = `+r.Dialect.now()+`
+         WHERE id = $2 AND status = 'pending'`, reason, replyID)
+	return err
+}
+
+// ErrReplySuperseded is returned by CompleteCoalescedReply when a later
+// reply took over the patient messages it was to answer, and by
+// CompletePendingReply when a retry answered its message.
+var ErrReplySuperseded = errs.New(errs.Conflict, "pending reply superseded")
+
+// CreateCoalescedReply stores a patient message and records the reply to
+// be generated in the background for it and the patient messages before it
+// that the bot has yet to answer, in one transaction.  The earlier pending
+// coalesced replies of the session are superseded by it, so one reply
+// answers them all.  Unlike CreatePendingReply's, the pending reply has no
+// patient message of its own.  With c the cap is checked in the
+// transaction as by CreateMessagePair.
+func (r *Repository) CreateCoalescedReply(ctx context.Context, sessionID uuid.UUID, c *Cap, patient string) (*pkg.Message, *pkg.PendingReply, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	m, err := insertMessage(ctx, tx, sessionID, pkg.RolePatient, patient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c != nil {
+		if err := r.checkCap(ctx, tx, sessionID, c); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := touchSession(ctx, tx, m); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE pending_replies
+         SET status = 'superseded', completed_at = `+r.Dialect.now()+`
+         WHERE session_id = $1 AND status = 'pending'
+           AND patient_message_id IS NULL AND patient_content IS NULL`, sessionID); err != nil {
+		return nil, nil, err
+	}
+	p := pkg.PendingReply{ID: uuid.NewString(), SessionID: sessionID.String(), Status: pkg.ReplyPending}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO pending_replies (id, session_id) VALUES ($1, $2)
+         RETURNING created_at`, p.ID, sessionID,
+	).Scan(&p.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	r.Transcripts.add(m)
+	return m, &p, nil
+}
+
+// CompleteCoalescedReply stores the bot's reply to the patient messages of
+// turn, the session's latest messages, and marks the coalesced pending
+// reply done in the same transaction.  When a later reply superseded it, or
+// the session no longer ends with turn (e.g. the bot replied meanwhile),
+// nothing is stored and ErrReplySuperseded is returned; the pending reply
+// is superseded in the latter case too.  When the patient edited one of
+// the messages meanwhile nothing is stored and ErrMessageEdited is
+// returned, for the reply to be generated again.  The reply's metadata
+// lists the seqs of the messages it answers (pkg.MetaAnswers).
+func (r *Repository) CompleteCoalescedReply(ctx context.Context, replyID string, sessionID uuid.UUID, turn []pkg.Message, reply string) (*pkg.Message, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx,
+		`UPDATE pending_replies
+         SET status = 'done', completed_at = `+r.Dialect.now()+`
+         WHERE id = $1 AND status = 'pending'`, replyID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrReplySuperseded
+	}
+	rows, err := tx.QueryContext(ctx,
+		`SELECT role, content FROM messages
+         WHERE session_id = $1 AND seq >= $2 AND deleted_at IS NULL
+         ORDER BY seq ASC`, sessionID, turn[0].Seq)
+	if err != nil {
+		return nil, err
+	}
+	var latest []pkg.Message
+	for rows.Next() {
+		var m pkg.Message
+		if err := rows.Scan(&m.Role, &m.Content); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		latest = append(latest, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch turnState(latest, turn) {
+	case turnAnswered:
+		// The messages were answered otherwise: give the reply up.
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE pending_replies SET status = 'superseded' WHERE id = $1`, replyID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrReplySuperseded
+	case turnEdited:
+		return nil, ErrMessageEdited
+	}
+	b, err := insertMessage(ctx, tx, sessionID, pkg.RoleBot, reply)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]int, len(turn))
+	for i, m := range turn {
+		answers[i] = m.Seq
+	}
+	raw, err := json.Marshal(answers)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE messages SET metadata = `+r.Dialect.jsonSet("metadata", "$1", "$2")+` WHERE id = $3`,
+		pkg.MetaAnswers, string(raw), b.ID); err != nil {
+		return nil, err
+	}
+	if err := touchSession(ctx, tx, b); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE pending_replies SET message_id = $1 WHERE id = $2`, b.ID, replyID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.add(b)
+	return b, nil
+}
+
+// States of a coalesced turn reported by turnState.
+const (
+	turnUnchanged = iota
+	turnEdited
+	turnAnswered
+)
+
+// turnState compares the session's latest messages with the turn a reply
+// was generated for: the same patient messages, some edited, or no longer
+// the patient messages the session ends with.
+func turnState(latest, turn []pkg.Message) int {
+	if len(latest) != len(turn) {
+		return turnAnswered
+	}
+	state := turnUnchanged
+	for i, m := range latest {
+		if m.Role != pkg.RolePatient {
+			return turnAnswered
+		}
+		if m.Content != turn[i].Content {
+			state = turnEdited
+		}
+	}
+	return state
+}
+
+// SupersedePendingReply marks a pending reply superseded, e.g. a coalesced
+// reply left with no patient message to answer.
+func (r *Repository) SupersedePendingReply(ctx context.Context, replyID string) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE pending_replies
+         SET status = 'superseded', completed_at = `+r.Dialect.now()+`
+         WHERE id = $1 AND status = 'pending'`, replyID)
+	return err
+}
+
+// GetPendingReply loads a pending reply with its bot message, if done, and
+// the current content of the patient message it answers.
+func (r *Repository) GetPendingReply(ctx context.Context, replyID string) (*pkg.PendingReply, error) {
+	var p pkg.PendingReply
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT p.id, p.session_id, p.status, COALESCE(m.content, ''), COALESCE(m.seq, 0),
+                COALESCE(pm.content, p.patient_content, ''), COALESCE(p.patient_message_id, 0), p.created_at
+         FROM pending_replies p
+         LEFT JOIN messages m ON m.id = p.message_id
+         LEFT JOIN messages pm ON pm.id = p.patient_message_id
+         WHERE p.id = $1`, replyID,
+	).Scan(&p.ID, &p.SessionID, &p.Status, &p.Content, &p.Seq, &p.Patient, &p.PatientMessageID, &p.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+// ErrRetryLimit is returned by ClaimRetry once a message has been retried
+// as often as allowed.
+var ErrRetryLimit = errs.New(errs.Capped, "retry limit reached")
+
+// CreateUnansweredMessage stores a patient message whose reply could not be
+// generated, flagged as unanswered so the reply can be retried with
+// ClaimRetry and AnswerMessage.  The message counts toward the cap once,
+// however often it is retried.
+func (r *Repository) CreateUnansweredMessage(ctx context.Context, sessionID uuid.UUID, patient string) (*pkg.Message, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	m, err := insertUnanswered(ctx, tx, sessionID, patient)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.add(m)
+	return m, nil
+}
+
+// insertUnanswered stores a patient message flagged as unanswered in the
+// transaction q.
+func insertUnanswered(ctx context.Context, q queryer, sessionID uuid.UUID, patient string) (*pkg.Message, error) {
+	m, err := insertMessage(ctx, q, sessionID, pkg.RolePatient, patient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.ExecContext(ctx,
+		`UPDATE messages SET unanswered = TRUE WHERE id = $1`, m.ID); err != nil {
+		return nil, err
+	}
+	if err := touchSession(ctx, q, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ClaimRetry records another attempt at replying to an unanswered patient
+// message and returns the message with the number of attempts so far.
+// Only the latest message of the session can be retried, so a reply never
+// lands above messages sent after it.  A trailing patient message is
+// unanswered even without the flag (e.g. the server stopped before storing
+// the reply); claiming it sets the flag.  A message retried limit times
+// already yields ErrRetryLimit; one that cannot be retried ErrNotFound.
+func (r *Repository) ClaimRetry(ctx context.Context, sessionID string, messageID int64, limit int) (*pkg.Message, int, error) {
+	m := pkg.Message{SessionID: sessionID}
+	var retries int
+	err := r.DB.QueryRowContext(ctx,
+		`UPDATE messages SET retries = retries + 1, unanswered = TRUE
+         WHERE id = $1 AND session_id = $2 AND role = 'patient' AND retries < $3
+           AND deleted_at IS NULL
+           AND seq = (SELECT MAX(seq) FROM messages WHERE session_id = $2)
+         RETURNING id, seq, role, content, created_at, retries`, messageID, sessionID, limit,
+	).Scan(&m.ID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt, &retries)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exhausted bool
+		if r.DB.QueryRowContext(ctx,
+			`SELECT retries >= $3 FROM messages
+             WHERE id = $1 AND session_id = $2 AND role = 'patient'`, messageID, sessionID, limit,
+		).Scan(&exhausted) == nil && exhausted {
+			return nil, 0, ErrRetryLimit
+		}
+	}
+	if err != nil {
+		return nil, 0, notFound(err)
+	}
+	return &m, retries, nil
+}
+
+// AnswerMessage stores the bot's reply to an unanswered patient message and
+// clears its flag in one transaction.  patient is the message content the
+// reply was generated for.  A message answered meanwhile, by a concurrent
+// retry, or edited since yields ErrNotFound and stores nothing.
+func (r *Repository) AnswerMessage(ctx context.Context, sessionID uuid.UUID, messageID int64, patient, reply string) (*pkg.Message, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx,
+		`UPDATE messages SET unanswered = FALSE
+         WHERE id = $1 AND session_id = $2 AND unanswered AND content = $3`, messageID, sessionID, patient)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	b, err := insertMessage(ctx, tx, sessionID, pkg.RoleBot, reply)
+	if err != nil {
+		return nil, err
+	}
+	if err := touchSession(ctx, tx, b); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.add(b)
+	return b, nil
+}
+
+// GetTrailingUnansweredMessage returns the latest message of a session if
+// it is a patient message, not redacted, which the bot has not answered, and
+// ErrNotFound otherwise.
+func (r *Repository) GetTrailingUnansweredMessage(ctx context.Context, sessionID string) (*pkg.Message, error) {
+	m := pkg.Message{SessionID: sessionID}
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT id, seq, role, content, created_at, deleted_at
+         FROM messages
+         WHERE session_id = $1
+         ORDER BY seq DESC
+         LIMIT 1`, sessionID,
+	).Scan(&m.ID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt, &m.RedactedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if m.Role != pkg.RolePatient || m.RedactedAt != nil {
+		return nil, ErrNotFound
+	}
+	return &m, nil
+}
+
+// ErrNotEditable is returned by EditLastPatientMessage when the session has
+// no patient message awaiting a reply to edit.
+var ErrNotEditable = errs.New(errs.Conflict, "message can no longer be edited")
+
+// EditLastPatientMessage replaces the content of the patient message the
+// bot has yet to reply to in a session: its latest message if that is a
+// patient message, one whose reply is pending or left unanswered.  Only a
+// message sent after since can be edited.  The content replaced is appended
+// to the message's edits.  It returns ErrNotEditable when there is no such
+// message, e.g. because the bot has replied.  A pending reply generated for
+// the earlier content is not stored (see CompletePendingReply).
+func (r *Repository) EditLastPatientMessage(ctx context.Context, sessionID, content string, since time.Time) error {
+	var edits string
+	var m pkg.Message
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT id, role, content, edits, created_at, deleted_at
+         FROM messages
+         WHERE session_id = $1
+         ORDER BY seq DESC
+         LIMIT 1`, sessionID,
+	).Scan(&m.ID, &m.Role, &m.Content, &edits, &m.CreatedAt, &m.RedactedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotEditable
+	}
+	if err != nil {
+		return err
+	}
+	if m.Role != pkg.RolePatient || m.RedactedAt != nil || !m.CreatedAt.After(since) {
+		return ErrNotEditable
+	}
+	if edits, err = appendEdit(edits, m.Content); err != nil {
+		return err
+	}
+	// The bot may have replied since the message was read.
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE messages SET content = $1, edits = $2
+         WHERE id = $3 AND content = $4 AND deleted_at IS NULL
+           AND seq = (SELECT MAX(seq) FROM messages WHERE session_id = $5)`,
+		content, edits, m.ID, m.Content, sessionID)
+	if err := editApplied(res, err); err != nil {
+		return err
+	}
+	r.Transcripts.invalidate(sessionID)
+	return nil
+}
+
+// editApplied returns the error of an edit's UPDATE, ErrNotEditable when it
+// matched no row.
+func editApplied(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotEditable
+	}
+	return nil
+}
+
+// appendEdit returns the JSON edit history edits with content, replaced
+// now, appended.
+func appendEdit(edits, content string) (string, error) {
+	var list []pkg.MessageEdit
+	if err := json.Unmarshal([]byte(edits), &list); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(append(list, pkg.MessageEdit{Content: content, EditedAt: time.Now().UTC()}))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -3,10 +3,11 @@ package db
 import (
 	"context"
 	"database/sql"
-	"errors"
-	"fmt"
+	"sort"
 	"time"
+	"waitroom-chatbot/internal/pii"
 	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
 
 	"github.com/google/uuid"
 )
@@ -15,20 +16,73 @@ import (
 // A single postgres database is used in this stub implementation.
 type Repository struct {
 	DB *sql.DB
+	// PII encrypts patient name, phone and national ID at rest.  When nil
+	// they are stored in plaintext.
+	PII *pii.Cipher
+	// Dialect is the SQL flavour of DB.  The zero value means Postgres.
+	Dialect Dialect
+	// Transcripts caches session transcripts for GetSessionTranscript.
+	// When nil every call queries the database.
+	Transcripts *TranscriptCache
+	// StaleSummaryAfter is how long the patient may go on writing after
+	// the summary was last updated before session previews flag it stale
+	// (see pkg.Summary.Stale).
+	StaleSummaryAfter time.Duration
 }
 
 // NewRepository constructs a new Repository from an existing sql.DB.
 // The caller is responsible for managing the DB connection lifecycle.
 func NewRepository(db *sql.DB) *Repository { return &Repository{DB: db} }
 
-// UpsertUser creates or updates a session for the user identified by national ID.
-func (r *Repository) UpsertUser(ctx context.Context, u *pkg.User) error {
-	// Try to update the latest session with this national ID
+// lookupKey returns the value sessions are matched on for a national ID:
+// its HMAC when PII encryption is enabled, the plain ID otherwise.  Queries
+// compare it with COALESCE(patient_national_id_hmac, patient_national_id),
+// which is indexed.
+func (r *Repository) lookupKey(nationalID string) string {
+	if r.PII.Enabled() {
+		return r.PII.Hash(nationalID)
+	}
+	return nationalID
+}
+
+// encryptUser returns the stored forms of a user's national ID, phone and
+// name.
+func (r *Repository) encryptUser(u *pkg.User) (nationalID, phone, name string, err error) {
+	if nationalID, err = r.PII.Encrypt(u.NationalID); err != nil {
+		return
+	}
+	if phone, err = r.PII.Encrypt(u.Phone); err != nil {
+		return
+	}
+	name, err = r.PII.Encrypt(u.Name)
+	return
+}
+
+// UpsertUser creates or updates the open session of the user identified by
+// national ID at the given clinic ("" means pkg.DefaultClinic).  A non-empty
+// profile selects the prompt profile used for the session and a non-empty
+// locale the language it is held in.  A new session keeps messageCap as its
+// message cap, so later changes to the configured cap leave it alone, and
+// records the user's ClientIP.
+func (r *Repository) UpsertUser(ctx context.Context, u *pkg.User, profile, clinicID, locale string, messageCap int) error {
+	if clinicID == "" {
+		clinicID = pkg.DefaultClinic
+	}
+	encID, encPhone, encName, err := r.encryptUser(u)
+	if err != nil {
+		return err
+	}
+	// Try to update the open session with this national ID; a patient whose
+	// session was closed starts a fresh one
 	res, err := r.DB.ExecContext(ctx,
 		`UPDATE sessions
-         SET patient_phone = $1, patient_name = $2
-         WHERE patient_national_id = $3`,
-		u.Phone, u.Name, u.NationalID,
+         SET patient_phone = $1, patient_name = $2,
+             prompt_profile = COALESCE(NULLIF($4, ''), prompt_profile),
+             locale = COALESCE(NULLIF($6, ''), locale)
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $3
+           AND clinic_id = $5
+           AND closed_at IS NULL`,
+		encPhone, encName, r.lookupKey(u.NationalID), profile, clinicID, locale,
 	)
 	if err != nil {
 		return err
@@ -41,9 +95,9 @@ func (r *Repository) UpsertUser(ctx context.Context, u *pkg.User) error {
 		// Insert new session
 		newID := uuid.New()
 		_, err := r.DB.ExecContext(ctx,
-			`INSERT INTO sessions (id, patient_national_id, patient_phone, patient_name)
-             VALUES ($1, $2, $3, $4)`,
-			newID, u.NationalID, u.Phone, u.Name,
+			`INSERT INTO sessions (id, patient_national_id, patient_national_id_hmac, patient_phone, patient_name, prompt_profile, clinic_id, locale, message_cap, client_ip)
+             VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7, COALESCE(NULLIF($8, ''), 'fa'), $9, `+r.Dialect.inet("NULLIF($10, '')")+`)`,
+			newID, encID, r.PII.Hash(u.NationalID), encPhone, encName, profile, clinicID, locale, messageCap, u.ClientIP,
 		)
 		if err != nil {
 			return err
@@ -58,63 +112,207 @@ func (r *Repository) GetUser(ctx context.Context, nationalID string) (*pkg.User,
 	err := r.DB.QueryRowContext(ctx,
 		`SELECT patient_national_id, patient_phone, patient_name, created_at
          FROM sessions
-         WHERE patient_national_id = $1
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
          ORDER BY created_at DESC
          LIMIT 1`,
-		nationalID,
+		r.lookupKey(nationalID),
 	).Scan(&u.NationalID, &u.Phone, &u.Name, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
+	for _, f := range []*string{&u.NationalID, &u.Phone, &u.Name} {
+		if err := r.PII.DecryptPtr(f); err != nil {
+			return nil, err
+		}
+	}
 	return &u, nil
 }
 
-// CreateMessage stores a new message for the given national ID.
-func (r *Repository) CreateMessage(ctx context.Context, nationalID string, role pkg.MessageRole, content string) (*pkg.Message, error) {
-	// Find the latest session ID for this nationalID
-	var sessionID uuid.UUID
-	err := r.DB.QueryRowContext(ctx,
-		`SELECT id FROM sessions
-         WHERE patient_national_id = $1
-         ORDER BY created_at DESC
-         LIMIT 1`, nationalID).Scan(&sessionID)
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// CreateMessage stores a new message in the given session.
+func (r *Repository) CreateMessage(ctx context.Context, sessionID uuid.UUID, role pkg.MessageRole, content string) (*pkg.Message, error) {
+	// The message and the session's last_message_at are written together so
+	// the dashboard never sees one without the other.
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	m, err := insertMessage(ctx, tx, sessionID, role, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := touchSession(ctx, tx, m); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.add(m)
+	return m, nil
+}
+
+// Cap is the message cap a patient message is checked against in the
+// transaction storing it: at most Limit patient messages in the session or,
+// with Since set, at the patient's clinic since then.
+type Cap struct {
+	Limit      int
+	NationalID string
+	ClinicID   string
+	Since      time.Time
+}
+
+// ErrCapped is returned when storing a patient message would exceed its
+// Cap.
+var ErrCapped = errs.New(errs.Capped, "message cap reached")
+
+// checkCap returns ErrCapped when the patient messages counted against c,
+// those stored in the transaction q included, exceed it.  The transaction
+// must hold the session row's lock (see insertMessage), so concurrent
+// messages of the session are counted one after the other.
+func (r *Repository) checkCap(ctx context.Context, q queryer, sessionID uuid.UUID, c *Cap) error {
+	var count int
+	var err error
+	if c.Since.IsZero() {
+		count, err = countSessionPatientMessages(ctx, q, sessionID.String())
+	} else {
+		count, err = r.countUserMessagesSince(ctx, q, c.NationalID, c.ClinicID, c.Since)
+	}
+	if err != nil {
+		return err
+	}
+	if count > c.Limit {
+		return ErrCapped
+	}
+	return nil
+}
+
+// CreateMessagePair stores a patient message and the bot's reply to it in
+// one transaction, so a failure leaves neither behind and a retry does not
+// count twice toward the weekly cap.  Attachments are linked to the patient
+// message in the same transaction.  With c the cap is checked again in the
+// transaction, and nothing is stored and ErrCapped returned when the message
+// would exceed it: messages sent at the same time all pass the check made
+// before their reply is generated.
+func (r *Repository) CreateMessagePair(ctx context.Context, sessionID uuid.UUID, c *Cap, patient, reply string, attachments ...*pkg.Attachment) (*pkg.Message, *pkg.Message, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	p, b, err := insertMessagePair(ctx, tx, sessionID, patient, reply, attachments)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("no session found for national ID %s", nationalID)
+		return nil, nil, err
+	}
+	if c != nil {
+		if err := r.checkCap(ctx, tx, sessionID, c); err != nil {
+			return nil, nil, err
 		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	r.Transcripts.add(p, b)
+	return p, b, nil
+}
+
+func insertMessagePair(ctx context.Context, q queryer, sessionID uuid.UUID, patient, reply string, attachments []*pkg.Attachment) (*pkg.Message, *pkg.Message, error) {
+	p, err := insertMessage(ctx, q, sessionID, pkg.RolePatient, patient)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range attachments {
+		a.SessionID, a.MessageID = p.SessionID, p.ID
+		if err := insertAttachment(ctx, q, a); err != nil {
+			return nil, nil, err
+		}
+	}
+	b, err := insertMessage(ctx, q, sessionID, pkg.RoleBot, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := touchSession(ctx, q, b); err != nil {
+		return nil, nil, err
+	}
+	return p, b, nil
+}
+
+// insertMessage stores a message with the next seq of its session.  q must
+// be a transaction: taking the number locks the session row until it ends.
+func insertMessage(ctx context.Context, q queryer, sessionID uuid.UUID, role pkg.MessageRole, content string) (*pkg.Message, error) {
+	m := pkg.Message{SessionID: sessionID.String()}
+	err := q.QueryRowContext(ctx,
+		`UPDATE sessions SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq`, sessionID,
+	).Scan(&m.Seq)
+	if err != nil {
 		return nil, err
 	}
-	var m pkg.Message
-	err = r.DB.QueryRowContext(ctx,
-		`INSERT INTO messages (session_id, role, content)
-         VALUES ($1, $2, $3)
+	err = q.QueryRowContext(ctx,
+		`INSERT INTO messages (session_id, seq, role, content)
+         VALUES ($1, $2, $3, $4)
          RETURNING id, role, content, created_at`,
-		sessionID, role, content,
+		sessionID, m.Seq, role, content,
 	).Scan(&m.ID, &m.Role, &m.Content, &m.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
-	m.NationalID = nationalID
 	return &m, nil
 }
 
-// GetTranscript returns messages from the last week for a user ordered by creation time.
+// touchSession sets the session's last_message_at to the time of m.
+func touchSession(ctx context.Context, q queryer, m *pkg.Message) error {
+	_, err := q.ExecContext(ctx,
+		`UPDATE sessions
+         SET last_message_at = (SELECT created_at FROM messages WHERE id = $1)
+         WHERE id = $2`, m.ID, m.SessionID)
+	return err
+}
+
+// SetMessageModeration records the moderation category of a stored message.
+func (r *Repository) SetMessageModeration(ctx context.Context, messageID int64, category string) error {
+	return r.SetMessageMeta(ctx, messageID, pkg.MetaModerationCategory, category)
+}
+
+// SetMessageModel records the chat model that produced a stored bot reply.
+func (r *Repository) SetMessageModel(ctx context.Context, messageID int64, model string) error {
+	return r.SetMessageMeta(ctx, messageID, pkg.MetaModel, model)
+}
+
+// PatientTranscriptWindow is how far back GetTranscript reaches: the
+// patient's chat page shows the last week across their sessions.
+const PatientTranscriptWindow = 7 * 24 * time.Hour
+
+// GetTranscript returns messages from the last week for a user ordered by
+// creation time.  Views of a whole session (the doctor's, summaries) use
+// GetSessionTranscript instead.
 func (r *Repository) GetTranscript(ctx context.Context, nationalID string) ([]pkg.Message, error) {
+	return r.GetTranscriptWindow(ctx, nationalID, PatientTranscriptWindow)
+}
+
+// GetTranscriptWindow returns a user's messages from the last window, across
+// their sessions, ordered by creation time.  Redacted messages are left out.
+func (r *Repository) GetTranscriptWindow(ctx context.Context, nationalID string, window time.Duration) ([]pkg.Message, error) {
 	rows, err := r.DB.QueryContext(ctx,
-		`SELECT m.id, s.patient_national_id, m.role, m.content, m.created_at
+		`SELECT m.id, m.session_id, m.seq, m.role, m.content, m.created_at
          FROM messages m
          JOIN sessions s ON m.session_id = s.id
-         WHERE s.patient_national_id = $1
-           AND m.created_at >= NOW() - INTERVAL '7 days'
-         ORDER BY m.created_at ASC`, nationalID)
+         WHERE COALESCE(s.patient_national_id_hmac, s.patient_national_id) = $1
+           AND m.created_at >= $2
+           AND m.deleted_at IS NULL
+         ORDER BY s.created_at ASC, s.id ASC, m.seq ASC`, r.lookupKey(nationalID), r.Dialect.timeArg(time.Now().Add(-window)))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var transcript []pkg.Message
 	for rows.Next() {
-		var m pkg.Message
-		if err := rows.Scan(&m.ID, &m.NationalID, &m.Role, &m.Content, &m.CreatedAt); err != nil {
+		m := pkg.Message{NationalID: nationalID}
+		if err := rows.Scan(&m.ID, &m.SessionID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt); err != nil {
 			return nil, err
 		}
 		transcript = append(transcript, m)
@@ -122,35 +320,229 @@ func (r *Repository) GetTranscript(ctx context.Context, nationalID string) ([]pk
 	return transcript, rows.Err()
 }
 
-// CountUserMessagesThisWeek counts patient messages from the start of the
-// current week (ISO week starting Monday) for usage‑cap enforcement.
-func (r *Repository) CountUserMessagesThisWeek(ctx context.Context, nationalID string) (int, error) {
+// GetSessionTranscript returns all messages of a session in order, however
+// old, for the doctor, summaries and wrap-up detection.  Redacted messages are left out;
+// the doctor's view shows them with GetSessionRecord.  It is served from
+// Transcripts when cached.
+func (r *Repository) GetSessionTranscript(ctx context.Context, sessionID string) ([]pkg.Message, error) {
+	cached, epoch, ok := r.Transcripts.get(sessionID)
+	if ok {
+		return cached, nil
+	}
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, session_id, seq, role, content, created_at
+         FROM messages
+         WHERE session_id = $1 AND deleted_at IS NULL
+         ORDER BY seq ASC`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transcript []pkg.Message
+	for rows.Next() {
+		var m pkg.Message
+		if err := rows.Scan(&m.ID, &m.SessionID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		transcript = append(transcript, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	r.Transcripts.put(sessionID, transcript, epoch)
+	return transcript, nil
+}
+
+// GetRecentMessages returns the latest messages of a session, at most
+// limit of them (all for zero) and none older than a week
+// (PatientTranscriptWindow), in order, for the chat context.  Redacted
+// messages are left out.
+func (r *Repository) GetRecentMessages(ctx context.Context, sessionID string, limit int) ([]pkg.Message, error) {
+	query := `SELECT id, session_id, seq, role, content, created_at
+         FROM messages
+         WHERE session_id = $1 AND created_at >= $2 AND deleted_at IS NULL
+         ORDER BY seq DESC`
+	args := []interface{}{sessionID, r.Dialect.timeArg(time.Now().Add(-PatientTranscriptWindow))}
+	if limit > 0 {
+		query += ` LIMIT $3`
+		args = append(args, limit)
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recent []pkg.Message
+	for rows.Next() {
+		var m pkg.Message
+		if err := rows.Scan(&m.ID, &m.SessionID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		recent = append(recent, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	return recent, nil
+}
+
+// GetSessionRecord returns all messages of a session in order, like
+// GetSessionTranscript but with the redacted ones, whose content is empty,
+// for the doctor's view of the record.
+func (r *Repository) GetSessionRecord(ctx context.Context, sessionID string) ([]pkg.Message, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, session_id, seq, role, content, created_at, deleted_at, COALESCE(redacted_by, '')
+         FROM messages
+         WHERE session_id = $1
+         ORDER BY seq ASC`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRecord(rows)
+}
+
+// GetMessagesSince returns the messages of a session written after since,
+// like GetSessionRecord.
+func (r *Repository) GetMessagesSince(ctx context.Context, sessionID string, since time.Time) ([]pkg.Message, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, session_id, seq, role, content, created_at, deleted_at, COALESCE(redacted_by, '')
+         FROM messages
+         WHERE session_id = $1 AND created_at > $2
+         ORDER BY seq ASC`, sessionID, r.Dialect.timeArg(since))
+	if err != nil {
+		return nil, err
+	}
+	return scanRecord(rows)
+}
+
+// scanRecord reads the messages selected by GetSessionRecord and closes
+// rows.
+func scanRecord(rows *sql.Rows) ([]pkg.Message, error) {
+	defer rows.Close()
+	var record []pkg.Message
+	for rows.Next() {
+		var m pkg.Message
+		if err := rows.Scan(&m.ID, &m.SessionID, &m.Seq, &m.Role, &m.Content, &m.CreatedAt, &m.RedactedAt, &m.RedactedBy); err != nil {
+			return nil, err
+		}
+		record = append(record, m)
+	}
+	return record, rows.Err()
+}
+
+// RedactMessage blanks the content of a message of a session and records
+// who redacted it and when.  The row is kept, so the record still shows
+// that a message was there.  A message that does not exist in the session
+// or is already redacted yields ErrNotFound.
+func (r *Repository) RedactMessage(ctx context.Context, sessionID string, messageID int64, actor string) error {
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE messages
+         SET content = '', deleted_at = `+r.Dialect.now()+`, redacted_by = $1
+         WHERE id = $2 AND session_id = $3 AND deleted_at IS NULL`, actor, messageID, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	r.Transcripts.invalidate(sessionID)
+	return nil
+}
+
+// CountUserMessagesSince counts patient messages sent since the given time,
+// the start of the cap window, for usage‑cap enforcement.  A non-empty
+// clinicID counts only messages sent to that clinic, whose cap may differ
+// from the others'.
+func (r *Repository) CountUserMessagesSince(ctx context.Context, nationalID, clinicID string, since time.Time) (int, error) {
+	return r.countUserMessagesSince(ctx, r.DB, nationalID, clinicID, since)
+}
+
+func (r *Repository) countUserMessagesSince(ctx context.Context, q queryer, nationalID, clinicID string, since time.Time) (int, error) {
 	var count int
-	err := r.DB.QueryRowContext(ctx,
+	err := q.QueryRowContext(ctx,
 		`SELECT COUNT(*)
          FROM messages m
          JOIN sessions s ON m.session_id = s.id
-         WHERE s.patient_national_id = $1
+         WHERE COALESCE(s.patient_national_id_hmac, s.patient_national_id) = $1
+           AND ($2 = '' OR s.clinic_id = $2)
            AND m.role = 'patient'
-           AND m.created_at >= date_trunc('week', NOW())`,
-		nationalID,
+           AND m.created_at >= $3`,
+		r.lookupKey(nationalID), clinicID, r.Dialect.timeArg(since),
+	).Scan(&count)
+	return count, err
+}
+
+// CountSessionPatientMessages counts the patient messages of one session,
+// for a message cap applied per visit.
+func (r *Repository) CountSessionPatientMessages(ctx context.Context, sessionID string) (int, error) {
+	return countSessionPatientMessages(ctx, r.DB, sessionID)
+}
+
+func countSessionPatientMessages(ctx context.Context, q queryer, sessionID string) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM messages WHERE session_id = $1 AND role = 'patient'`,
+		sessionID,
 	).Scan(&count)
 	return count, err
 }
 
-// GetTranscriptSince returns the transcript for a nationalID but only messages
-// with created_at >= since. It reuses GetTranscript and filters in-memory to
-// avoid coupling to any specific SQL shape used by GetTranscript.
-func (r *Repository) GetTranscriptSince(ctx context.Context, nationalID string, since time.Time) ([]pkg.Message, error) {
-	all, err := r.GetTranscript(ctx, nationalID)
+// SetMessageLatency records how long a bot reply took in total and in the
+// LLM call.
+func (r *Repository) SetMessageLatency(ctx context.Context, messageID int64, total, llm time.Duration) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE messages SET latency_ms = $1, llm_latency_ms = $2 WHERE id = $3`,
+		total.Milliseconds(), llm.Milliseconds(), messageID)
+	return err
+}
+
+// LatencyPercentiles returns the median and 95th percentile latencies of
+// the bot replies created in [from, to).  Percentiles are computed here
+// rather than in SQL, which SQLite cannot do.
+func (r *Repository) LatencyPercentiles(ctx context.Context, from, to time.Time) (pkg.LatencyStats, error) {
+	var stats pkg.LatencyStats
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT latency_ms, COALESCE(llm_latency_ms, 0)
+         FROM messages
+         WHERE role = 'bot' AND latency_ms IS NOT NULL
+           AND created_at >= $1 AND created_at < $2`,
+		r.Dialect.timeArg(from), r.Dialect.timeArg(to))
 	if err != nil {
-		return nil, err
+		return stats, err
 	}
-	out := make([]pkg.Message, 0, len(all))
-	for _, m := range all {
-		if m.CreatedAt.After(since) || m.CreatedAt.Equal(since) {
-			out = append(out, m)
+	defer rows.Close()
+	var total, llm []int64
+	for rows.Next() {
+		var t, l int64
+		if err := rows.Scan(&t, &l); err != nil {
+			return stats, err
 		}
+		total, llm = append(total, t), append(llm, l)
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+	stats.Replies = len(total)
+	stats.TotalP50, stats.TotalP95 = percentile(total, 50), percentile(total, 95)
+	stats.LLMP50, stats.LLMP95 = percentile(llm, 50), percentile(llm, 95)
+	return stats, nil
+}
+
+// percentile returns the nearest-rank p-th percentile of values, sorting
+// them in place, or 0 when there are none.
+func percentile(values []int64, p int) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	rank := (p*len(values) + 99) / 100
+	if rank < 1 {
+		rank = 1
 	}
-	return out, nil
+	return values[rank-1]
 }
@@ -0,0 +1,349 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// newTestRepo returns a Repository on a migrated SQLite database of its
+// own.
+func newTestRepo(t *testing.T) *Repository {
+	t.Helper()
+	conn, err := Open(SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := Migrate(context.Background(), conn, SQLite); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	r := NewRepository(conn)
+	r.Dialect = SQLite
+	return r
+}
+
+// newTestSession starts the session of a patient and returns its ID.
+func newTestSession(t testing.TB, r *Repository, nationalID string) uuid.UUID {
+	t.Helper()
+	ctx := context.Background()
+	u := &pkg.User{NationalID: nationalID, Phone: "09120000000", Name: "Sara"}
+	if err := r.UpsertUser(ctx, u, "", pkg.DefaultClinic, "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.GetLatestSession(ctx, nationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uuid.MustParse(s.ID)
+}
+
+// sessionActivity returns the session's last_message_at, last_seq and
+// message count.
+func sessionActivity(t *testing.T, r *Repository, id uuid.UUID) (last sql.NullString, seq, messages int) {
+	t.Helper()
+	err := r.DB.QueryRow(
+		`SELECT last_message_at, last_seq, (SELECT COUNT(*) FROM messages WHERE session_id = $1)
+         FROM sessions WHERE id = $1`, id,
+	).Scan(&last, &seq, &messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return last, seq, messages
+}
+
+func TestLastMessageAtRollback(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	if _, _, err := r.CreateMessagePair(ctx, id, nil, "سردرد دارم", "از کی؟"); err != nil {
+		t.Fatal(err)
+	}
+	last, seq, n := sessionActivity(t, r, id)
+	if !last.Valid || seq != 2 || n != 2 {
+		t.Fatalf("after a pair: last_message_at %v, last_seq %d, %d messages", last, seq, n)
+	}
+
+	// Bot messages now fail to insert, after the patient's went in.
+	if _, err := r.DB.Exec(`CREATE TRIGGER fail_bot BEFORE INSERT ON messages
+        WHEN NEW.role = 'bot' BEGIN SELECT RAISE(ABORT, 'bot insert failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.CreateMessagePair(ctx, id, nil, "و تب", "چقدر؟"); err == nil {
+		t.Fatal("pair stored with a failing insert")
+	}
+	if _, err := r.CreateMessage(ctx, id, pkg.RoleBot, "چقدر؟"); err == nil {
+		t.Fatal("message stored with a failing insert")
+	}
+	if l, s, m := sessionActivity(t, r, id); l != last || s != seq || m != n {
+		t.Errorf("after failed inserts: last_message_at %v, last_seq %d, %d messages; want %v, %d, %d", l, s, m, last, seq, n)
+	}
+	if ms, err := r.GetSessionTranscript(ctx, id.String()); err != nil || len(ms) != 2 {
+		t.Errorf("transcript after failed inserts: %d messages, %v", len(ms), err)
+	}
+}
+
+func TestCreateMessagePairCap(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	perSession := &Cap{Limit: 2}
+	for i := 0; i < 2; i++ {
+		if _, _, err := r.CreateMessagePair(ctx, id, perSession, "پیام", "پاسخ"); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	last, seq, n := sessionActivity(t, r, id)
+	if _, _, err := r.CreateMessagePair(ctx, id, perSession, "یکی دیگر", "پاسخ"); !errs.Is(err, errs.Capped) {
+		t.Fatalf("message over the cap: %v, want a Capped error", err)
+	}
+	if l, s, m := sessionActivity(t, r, id); l != last || s != seq || m != n {
+		t.Errorf("message over the cap was stored: last_seq %d, %d messages; want %d, %d", s, m, seq, n)
+	}
+
+	// A per-week cap counts the patient's messages since the week started.
+	week := &Cap{Limit: 3, NationalID: "0012345678", ClinicID: pkg.DefaultClinic, Since: time.Now().Add(-time.Hour)}
+	if _, _, err := r.CreateMessagePair(ctx, id, week, "پیام", "پاسخ"); err != nil {
+		t.Fatalf("third message of the week: %v", err)
+	}
+	if _, _, err := r.CreateMessagePair(ctx, id, week, "پیام", "پاسخ"); !errs.Is(err, errs.Capped) {
+		t.Errorf("fourth message of the week: %v, want a Capped error", err)
+	}
+	week.Since = time.Now().Add(time.Hour)
+	if _, _, err := r.CreateMessagePair(ctx, id, week, "پیام", "پاسخ"); err != nil {
+		t.Errorf("first message of a new week: %v", err)
+	}
+}
+
+func TestCountSessionPatientMessages(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	first := newTestSession(t, r, "0012345678")
+	for i := 0; i < 2; i++ {
+		if _, _, err := r.CreateMessagePair(ctx, first, nil, "پیام", "پاسخ"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.CloseSession(ctx, first.String()); err != nil {
+		t.Fatal(err)
+	}
+	// The same patient's next visit starts from zero; bot messages never
+	// count.
+	next := newTestSession(t, r, "0012345678")
+	if _, _, err := r.CreateMessagePair(ctx, next, nil, "پیام", "پاسخ"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uuid.UUID]int{first: 2, next: 1} {
+		if n, err := r.CountSessionPatientMessages(ctx, id.String()); err != nil || n != want {
+			t.Errorf("session %s: %d, %v; want %d", id, n, err, want)
+		}
+	}
+}
+
+func TestGetTrailingUnansweredMessage(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	if _, err := r.GetTrailingUnansweredMessage(ctx, id.String()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("empty session: %v, want ErrNotFound", err)
+	}
+	if _, _, err := r.CreateMessagePair(ctx, id, nil, "سلام", "سلام"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetTrailingUnansweredMessage(ctx, id.String()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("answered session: %v, want ErrNotFound", err)
+	}
+	m, err := r.CreateMessage(ctx, id, pkg.RolePatient, "سردرد دارم")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.GetTrailingUnansweredMessage(ctx, id.String()); err != nil || got.ID != m.ID || got.Content != m.Content {
+		t.Errorf("unanswered message %+v, %v; want %+v", got, err, m)
+	}
+	// A redacted message is not answered.
+	if err := r.RedactMessage(ctx, id.String(), m.ID, "dr"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetTrailingUnansweredMessage(ctx, id.String()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("redacted message: %v, want ErrNotFound", err)
+	}
+}
+
+func TestTranscriptWindows(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	old, _, err := r.CreateMessagePair(ctx, id, nil, "از دو هفته پیش سرفه دارم", "تب هم دارید؟")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DB.Exec(`UPDATE messages SET created_at = $1 WHERE session_id = $2`, r.Dialect.timeArg(time.Now().Add(-8*24*time.Hour)), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.CreateMessagePair(ctx, id, nil, "نه", "از کی سرفه دارید؟"); err != nil {
+		t.Fatal(err)
+	}
+	has := func(transcript []pkg.Message) bool {
+		for _, m := range transcript {
+			if m.ID == old.ID {
+				return true
+			}
+		}
+		return false
+	}
+	tests := []struct {
+		name     string
+		read     func() ([]pkg.Message, error)
+		n        int
+		hasEarly bool
+	}{
+		{"patient transcript", func() ([]pkg.Message, error) { return r.GetTranscript(ctx, "0012345678") }, 2, false},
+		{"30-day window", func() ([]pkg.Message, error) { return r.GetTranscriptWindow(ctx, "0012345678", 30*24*time.Hour) }, 4, true},
+		{"session transcript", func() ([]pkg.Message, error) { return r.GetSessionTranscript(ctx, id.String()) }, 4, true},
+		{"recent messages", func() ([]pkg.Message, error) { return r.GetRecentMessages(ctx, id.String(), 0) }, 2, false},
+		{"recent messages past the limit", func() ([]pkg.Message, error) { return r.GetRecentMessages(ctx, id.String(), 10) }, 2, false},
+	}
+	for _, tt := range tests {
+		transcript, err := tt.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transcript) != tt.n || has(transcript) != tt.hasEarly {
+			t.Errorf("%s: %d messages, the 8-day-old one included %v; want %d, %v", tt.name, len(transcript), has(transcript), tt.n, tt.hasEarly)
+		}
+	}
+}
+
+func TestGetRecentMessages(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	for _, content := range []string{"سردرد دارم", "از دیروز", "تب ندارم"} {
+		if _, _, err := r.CreateMessagePair(ctx, id, nil, content, "دیگر چه علامتی دارید؟"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent, err := r.GetRecentMessages(ctx, id.String(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range recent {
+		got = append(got, m.Content)
+	}
+	want := []string{"دیگر چه علامتی دارید؟", "تب ندارم", "دیگر چه علامتی دارید؟"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("last 3 messages %q, want %q", got, want)
+	}
+	for i := 1; i < len(recent); i++ {
+		if recent[i].Seq <= recent[i-1].Seq {
+			t.Errorf("messages out of order: seq %d after %d", recent[i].Seq, recent[i-1].Seq)
+		}
+	}
+}
+
+func TestPendingReplyMessage(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	pm, p, err := r.CreatePendingReply(ctx, id, nil, "سردرد دارم")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The patient edits the message while its reply is generated.
+	if err := r.EditLastPatientMessage(ctx, id.String(), "سردرد شدید دارم", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CompletePendingReply(ctx, p.ID, id, "سردرد دارم", "از کی؟"); !errs.Is(err, errs.Conflict) {
+		t.Fatalf("reply to the earlier content: %v, want ErrMessageEdited", err)
+	}
+	got, err := r.GetPendingReply(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != pkg.ReplyPending || got.Patient != "سردرد شدید دارم" {
+		t.Fatalf("pending reply after the edit %+v", got)
+	}
+	b, err := r.CompletePendingReply(ctx, p.ID, id, got.Patient, "از کی؟")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := r.GetSessionTranscript(ctx, id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].ID != pm.ID || ms[0].Content != "سردرد شدید دارم" || ms[1].ID != b.ID {
+		t.Errorf("transcript %+v", ms)
+	}
+	if _, _, err := r.ClaimRetry(ctx, id.String(), pm.ID, 3); !errs.Is(err, errs.NotFound) {
+		t.Errorf("retry of an answered message: %v, want NotFound", err)
+	}
+
+	// A retry answering the message first supersedes the pending reply.
+	pm, p, err = r.CreatePendingReply(ctx, id, nil, "و تب")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ClaimRetry(ctx, id.String(), pm.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AnswerMessage(ctx, id, pm.ID, "و تب", "چقدر؟"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CompletePendingReply(ctx, p.ID, id, "و تب", "چقدر؟"); !errors.Is(err, ErrReplySuperseded) {
+		t.Errorf("reply to a message a retry answered: %v, want ErrReplySuperseded", err)
+	}
+	if got, err := r.GetPendingReply(ctx, p.ID); err != nil || got.Status != pkg.ReplySuperseded {
+		t.Errorf("pending reply %+v, %v; want it superseded", got, err)
+	}
+	if n, err := countSessionPatientMessages(ctx, r.DB, id.String()); err != nil || n != 2 {
+		t.Errorf("%d patient messages, %v; want 2", n, err)
+	}
+}
+
+func TestCoalescedReplyBurstCap(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	// A burst of messages, all past the check made before they are stored.
+	const burst, limit = 6, 3
+	c := &Cap{Limit: limit}
+	errc := make(chan error, burst)
+	for i := 0; i < burst; i++ {
+		go func() {
+			_, _, err := r.CreateCoalescedReply(ctx, id, c, "پیام")
+			errc <- err
+		}()
+	}
+	var capped int
+	for i := 0; i < burst; i++ {
+		switch err := <-errc; {
+		case errors.Is(err, ErrCapped):
+			capped++
+		case err != nil:
+			t.Fatal(err)
+		}
+	}
+	if capped != burst-limit {
+		t.Errorf("%d messages capped, want %d", capped, burst-limit)
+	}
+	if n, err := countSessionPatientMessages(ctx, r.DB, id.String()); err != nil || n != limit {
+		t.Errorf("%d patient messages stored, %v; want %d", n, err, limit)
+	}
+	// The capped messages superseded none of the stored ones' replies.
+	var pending int
+	if err := r.DB.QueryRow(
+		`SELECT COUNT(*) FROM pending_replies WHERE session_id = $1 AND status = 'pending'`, id,
+	).Scan(&pending); err != nil || pending != 1 {
+		t.Errorf("%d pending replies, %v; want 1", pending, err)
+	}
+}
@@ -37,4 +37,510 @@ CREATE TABLE IF NOT EXISTS summaries (
 );
 
 CREATE INDEX IF NOT EXISTS idx_summaries_updated_at
-    ON summaries (updated_at DESC);
\ No newline at end of file
+    ON summaries (updated_at DESC);
+-- session lifecycle status; ready_for_doctor once intake topics are covered
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'open';
+
+-- prompt_profiles: per-clinic intake prompts that override the defaults
+CREATE TABLE IF NOT EXISTS prompt_profiles (
+    name                  TEXT PRIMARY KEY,
+    system_prompt         TEXT NOT NULL DEFAULT '',
+    first_message         TEXT NOT NULL DEFAULT '',
+    summarize_instruction TEXT NOT NULL DEFAULT '',
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at            TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS prompt_profile TEXT REFERENCES prompt_profiles(name) ON DELETE SET NULL;
+
+-- moderation category of patient messages, kept for audit
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS moderation_category TEXT;
+
+-- escalation raised for the doctor (e.g. self-harm content)
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS escalated_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS escalation_reason TEXT;
+
+-- hash of the transcript a summary was generated from, plus the hash a
+-- worker is currently regenerating, so identical requests skip the LLM
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS transcript_hash TEXT,
+    ADD COLUMN IF NOT EXISTS pending_hash TEXT,
+    ADD COLUMN IF NOT EXISTS pending_at TIMESTAMPTZ;
+
+-- trigram index for doctor message search; works for Persian text where
+-- stemming text search configurations do not
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_messages_content_trgm
+    ON messages USING gin (content gin_trgm_ops);
+
+-- deterministic HMAC of the national ID, set when PII encryption is enabled
+-- so encrypted sessions can still be looked up by national ID
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS patient_national_id_hmac TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_national_id_lookup
+    ON sessions ((COALESCE(patient_national_id_hmac, patient_national_id)), created_at DESC);
+
+-- audit_log: who accessed which patient data and when
+CREATE TABLE IF NOT EXISTS audit_log (
+    id          BIGSERIAL PRIMARY KEY,
+    actor       TEXT NOT NULL,
+    action      TEXT NOT NULL,
+    session_id  UUID,
+    request_id  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at
+    ON audit_log (created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_session_id
+    ON audit_log (session_id, created_at DESC);
+
+-- attachments: uploaded files (prescription photos) linked to the patient
+-- message that carried them
+CREATE TABLE IF NOT EXISTS attachments (
+    id            BIGSERIAL PRIMARY KEY,
+    session_id    UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    message_id    BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    storage_key   TEXT NOT NULL,
+    content_type  TEXT NOT NULL,
+    size_bytes    BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id
+    ON attachments (message_id);
+
+-- triage priority computed with each summary (core.ScorePriority); sorts the
+-- doctor dashboard
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+
+-- webhooks: outbound endpoints notified when summaries change (EHR
+-- integration); payloads are signed with the shared secret
+CREATE TABLE IF NOT EXISTS webhooks (
+    id          BIGSERIAL PRIMARY KEY,
+    url         TEXT NOT NULL,
+    secret      TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- webhook_deliveries: one row per event per webhook, retried until
+-- delivered or marked dead
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    webhook_id       BIGINT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event            TEXT NOT NULL,
+    payload          JSONB NOT NULL,
+    status           TEXT NOT NULL DEFAULT 'pending',
+    attempts         INT NOT NULL DEFAULT 0,
+    last_error       TEXT,
+    response_status  INT,
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due
+    ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook
+    ON webhook_deliveries (webhook_id, created_at DESC);
+
+-- time of the latest message, maintained by CreateMessage so the inactivity
+-- sweeper does not need a MAX(created_at) scan per session.  Sessions that
+-- had messages before it was maintained are backfilled when it is added.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'sessions' AND column_name = 'last_message_at') THEN
+        ALTER TABLE sessions ADD COLUMN last_message_at TIMESTAMPTZ;
+        UPDATE sessions
+        SET last_message_at = (SELECT MAX(m.created_at) FROM messages m WHERE m.session_id = sessions.id)
+        WHERE EXISTS (SELECT 1 FROM messages m WHERE m.session_id = sessions.id);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_open_last_activity
+    ON sessions ((COALESCE(last_message_at, created_at))) WHERE closed_at IS NULL;
+
+-- pending_replies: bot replies generated in the background when async
+-- replies are enabled; the patient's page polls until one is done
+CREATE TABLE IF NOT EXISTS pending_replies (
+    id            UUID PRIMARY KEY,
+    session_id    UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    message_id    BIGINT REFERENCES messages(id) ON DELETE SET NULL,
+    error         TEXT,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at  TIMESTAMPTZ
+);
+
+-- typed pain score and symptom duration extracted with each summary
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS pain_score INT,
+    ADD COLUMN IF NOT EXISTS pain_score_clamped BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS duration_value INT,
+    ADD COLUMN IF NOT EXISTS duration_unit TEXT;
+
+-- chat model that produced each bot reply; differs from the configured one
+-- when the fallback model answered
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS model TEXT;
+
+-- llm_costs: running token usage and estimated cost per calendar month
+-- ("2006-01") and model, for the monthly budget guard
+CREATE TABLE IF NOT EXISTS llm_costs (
+    month              TEXT NOT NULL,
+    model              TEXT NOT NULL,
+    prompt_tokens      BIGINT NOT NULL DEFAULT 0,
+    completion_tokens  BIGINT NOT NULL DEFAULT 0,
+    cost_usd           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (month, model)
+);
+
+-- embedding of each summary (JSON array of floats) for recalling similar
+-- past visits of a returning patient
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS embedding JSONB;
+
+-- follow-up questions suggested to the doctor, regenerated with the summary
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS questions JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+-- time to produce each bot reply: latency_ms from receiving the patient's
+-- message to storing the reply, llm_latency_ms spent generating it
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS latency_ms INTEGER;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS llm_latency_ms INTEGER;
+
+-- clinics sharing the instance.  A session belongs to the clinic whose
+-- path_prefix or host the patient started from, otherwise to 'default'; a
+-- clinic's message_cap overrides MESSAGE_CAP for its patients
+CREATE TABLE IF NOT EXISTS clinics (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    host         TEXT UNIQUE,
+    path_prefix  TEXT UNIQUE,
+    message_cap  INT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO clinics (id, name) VALUES ('default', 'Default clinic')
+    ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS clinic_id TEXT NOT NULL DEFAULT 'default' REFERENCES clinics(id);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_clinic_open
+    ON sessions (clinic_id) WHERE closed_at IS NULL;
+
+-- sessions closed before CloseSession set the status are marked closed,
+-- once: the comment on the status column records that they were
+DO $$
+BEGIN
+    IF col_description('sessions'::regclass, (SELECT attnum FROM pg_attribute
+        WHERE attrelid = 'sessions'::regclass AND attname = 'status')) IS NULL THEN
+        UPDATE sessions SET status = 'closed'
+        WHERE closed_at IS NOT NULL AND status <> 'closed';
+        COMMENT ON COLUMN sessions.status IS 'open, ready_for_doctor, reviewed or closed';
+    END IF;
+END $$;
+
+-- locale: the language the patient chose on the start form; the chat page
+-- and bot messages use it, summaries stay Persian
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'fa';
+
+-- cap_overrides: extra messages granted to a patient (by national ID lookup
+-- key, as matched against sessions) or to one session until expires_at, on
+-- top of the message cap
+CREATE TABLE IF NOT EXISTS cap_overrides (
+    id              BIGSERIAL PRIMARY KEY,
+    national_id     TEXT,
+    session_id      UUID REFERENCES sessions(id) ON DELETE CASCADE,
+    extra_messages  INT NOT NULL CHECK (extra_messages > 0),
+    granted_by      TEXT NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (national_id IS NOT NULL OR session_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_national_id
+    ON cap_overrides (national_id, expires_at);
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_session
+    ON cap_overrides (session_id, expires_at);
+
+-- message_cap: the cap in force when the session started, stored so that
+-- changing MESSAGE_CAP or a clinic's cap only affects new sessions.  The
+-- old default of 50 was never enforced, so those rows are reset to 0, which
+-- means "use the current cap".
+DO $$
+BEGIN
+    IF (SELECT column_default FROM information_schema.columns
+        WHERE table_name = 'sessions' AND column_name = 'message_cap') = '50' THEN
+        UPDATE sessions SET message_cap = 0;
+        ALTER TABLE sessions ALTER COLUMN message_cap SET DEFAULT 0;
+    END IF;
+END $$;
+
+-- unanswered: a patient message stored after its reply failed, which the
+-- patient can retry; retries counts the attempts
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS unanswered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS retries INT NOT NULL DEFAULT 0;
+
+-- deleted_at/redacted_by: a message a doctor redacted; its content is
+-- blanked but the row is kept for the audit trail
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS redacted_by TEXT;
+
+-- events: outbox of session events (summary updates), written in the same
+-- transaction as the change and published to the dashboard and webhooks by
+-- the outbox dispatcher.  IDs increase, so consumers catch up from the last
+-- one they saw.
+CREATE TABLE IF NOT EXISTS events (
+    id               BIGSERIAL PRIMARY KEY,
+    kind             TEXT NOT NULL,
+    session_id       UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    payload          JSONB NOT NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    published_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_unpublished
+    ON events (id) WHERE published_at IS NULL;
+
+-- display_name/logo_url/accent_color: a clinic's branding on the patient
+-- pages; unset fields keep the default look
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS display_name TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS logo_url TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS accent_color TEXT;
+
+-- seq: a message's number within its session, ordering transcripts where
+-- created_at ties.  sessions.last_seq is the last number given out; taking
+-- the next one locks the session row, so concurrent messages are numbered
+-- one after the other.  Existing messages are numbered by created_at, id.
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS last_seq INT NOT NULL DEFAULT 0;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS seq INT;
+DO $$
+BEGIN
+    IF (SELECT is_nullable FROM information_schema.columns
+        WHERE table_name = 'messages' AND column_name = 'seq') = 'YES' THEN
+        UPDATE messages m SET seq = n.seq
+        FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY session_id ORDER BY created_at, id) AS seq
+              FROM messages) n
+        WHERE m.id = n.id;
+        ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+        UPDATE sessions
+        SET last_seq = (SELECT COALESCE(MAX(m.seq), 0) FROM messages m WHERE m.session_id = sessions.id);
+    END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_session_seq
+    ON messages (session_id, seq);
+
+-- denylist: national IDs (by lookup key, as matched against sessions) and
+-- client IPs refused a session on /start, for fake registrations
+CREATE TABLE IF NOT EXISTS denylist (
+    id          BIGSERIAL PRIMARY KEY,
+    kind        TEXT NOT NULL CHECK (kind IN ('national_id', 'ip')),
+    value       TEXT NOT NULL,
+    reason      TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (kind, value)
+);
+
+-- client_ip is now recorded on new sessions; the index serves the per-IP
+-- limit on new sessions
+CREATE INDEX IF NOT EXISTS idx_sessions_client_ip
+    ON sessions (client_ip, created_at);
+
+-- phone_verifications: start forms waiting for the patient to enter the
+-- code texted to their phone.  The patient fields are encrypted like the
+-- sessions'; phone_key is the phone's lookup key, for the per-phone limit.
+CREATE TABLE IF NOT EXISTS phone_verifications (
+    id           UUID PRIMARY KEY,
+    national_id  TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    phone        TEXT NOT NULL,
+    phone_key    TEXT NOT NULL,
+    clinic_id    TEXT NOT NULL REFERENCES clinics(id),
+    profile      TEXT NOT NULL DEFAULT '',
+    locale       TEXT NOT NULL DEFAULT '',
+    client_ip    INET,
+    code_hash    TEXT NOT NULL,
+    attempts     INT NOT NULL DEFAULT 0,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    verified_at  TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_phone
+    ON phone_verifications (phone_key, created_at);
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_ip
+    ON phone_verifications (client_ip, created_at);
+
+-- trace_llm: the session's model calls are recorded in llm_traces, with
+-- the patient's identifiers masked, for debugging e.g. a summary that
+-- contradicts the transcript; traces are deleted after 30 days
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS trace_llm BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS llm_traces (
+    id          BIGSERIAL PRIMARY KEY,
+    session_id  UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    kind        TEXT NOT NULL,
+    model       TEXT NOT NULL DEFAULT '',
+    messages    JSONB NOT NULL,
+    response    TEXT NOT NULL DEFAULT '',
+    error       TEXT NOT NULL DEFAULT '',
+    latency_ms  BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_traces_session
+    ON llm_traces (session_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_llm_traces_created
+    ON llm_traces (created_at);
+
+-- max_reply_chars/simple_language: a profile's limit on the length of the
+-- bot's replies (0 keeps the server's default) and plain wording for
+-- patients who may not read well
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS max_reply_chars INT NOT NULL DEFAULT 0;
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS simple_language BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- doctors: the doctor logins (DOCTOR_USERS), synced at startup; doctors
+-- no longer configured are kept inactive for their past assignments.
+-- last_assigned_at drives the round-robin assignment of new sessions.
+CREATE TABLE IF NOT EXISTS doctors (
+    id                BIGSERIAL PRIMARY KEY,
+    username          TEXT NOT NULL UNIQUE,
+    clinic_id         TEXT NOT NULL REFERENCES clinics(id),
+    active            BOOLEAN NOT NULL DEFAULT TRUE,
+    last_assigned_at  TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- assigned_doctor_id: the doctor a session is assigned to, by claiming it
+-- on the dashboard or round robin; NULL sessions are everyone's
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS assigned_doctor_id BIGINT REFERENCES doctors(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_assigned_doctor
+    ON sessions (assigned_doctor_id) WHERE closed_at IS NULL;
+
+-- assignee: the doctor a session was assigned to, on session.assign entries
+ALTER TABLE audit_log
+    ADD COLUMN IF NOT EXISTS assignee TEXT;
+
+-- session_views: when each doctor last opened a session, to mark the
+-- messages that arrived since in the transcript and count them on the
+-- dashboard.  Doctors are keyed by login name like the audit log.
+CREATE TABLE IF NOT EXISTS session_views (
+    session_id      UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    doctor          TEXT NOT NULL,
+    last_viewed_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (session_id, doctor)
+);
+
+-- patient_content: the patient message a pending reply answers, stored
+-- with the reply once it is done; patient_edits and messages.edits: the
+-- earlier versions of a patient message the patient edited before the bot
+-- replied, oldest first, as [{"content", "edited_at"}]
+ALTER TABLE pending_replies
+    ADD COLUMN IF NOT EXISTS patient_content TEXT,
+    ADD COLUMN IF NOT EXISTS patient_edits JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS edits JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+-- summary_language: the language a profile's summaries are written in for
+-- the doctor, e.g. 'en'; '' keeps Persian
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS summary_language TEXT NOT NULL DEFAULT '';
+
+-- last_read_seq: the highest seq of the messages the patient's chat page
+-- has shown, reported by its read receipts, for the abandonment stats
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS last_read_seq INT NOT NULL DEFAULT 0;
+
+-- attempt_status, attempt_error, attempted_at: the outcome of the latest
+-- attempt to regenerate the summary ('ok' or 'failed' with the class of the
+-- failure), so the doctor is told when the summary shown is stale
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS attempt_status TEXT,
+    ADD COLUMN IF NOT EXISTS attempt_error TEXT,
+    ADD COLUMN IF NOT EXISTS attempted_at TIMESTAMPTZ;
+
+-- metadata: a JSON object of what is known about a message, under the keys
+-- of the pkg.Meta* constants, e.g. the model that wrote a bot reply; the
+-- moderation_category and model columns are moved into it when it is added
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'messages' AND column_name = 'metadata') THEN
+        ALTER TABLE messages ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+        UPDATE messages
+        SET metadata = metadata || jsonb_strip_nulls(jsonb_build_object(
+                'moderation_category', moderation_category,
+                'model', model)),
+            moderation_category = NULL,
+            model = NULL
+        WHERE moderation_category IS NOT NULL OR model IS NOT NULL;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_messages_moderation_category
+    ON messages ((metadata->>'moderation_category'))
+    WHERE metadata ? 'moderation_category';
+
+-- operating_hours: the weekly hours the bot answers patients in, e.g.
+-- 'sat-wed 08:00-20:00; thu 08:00-13:00' (see core.ParseOperatingHours);
+-- unset for always.  timezone: the IANA zone the hours are in, Tehran when
+-- unset
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS operating_hours TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS timezone TEXT;
+
+-- model: the model that wrote the summary, unset when unknown.
+-- schema_version: the version of the structured summary format (see
+-- core.SummarySchemaVersion); summaries stored before it was recorded are
+-- version 1
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS model TEXT;
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS schema_version INT NOT NULL DEFAULT 1;
+
+-- patient_message_id: the patient message a pending reply answers, stored
+-- unanswered when the reply is requested so it counts toward the cap and
+-- shows on reloads; patient_content is only set on replies stored before
+-- it was
+ALTER TABLE pending_replies
+    ADD COLUMN IF NOT EXISTS patient_message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE;
+
+-- details: JSON describing the change of an entry, such as the hashed
+-- identities a session.reassign entry moved the session between
+ALTER TABLE audit_log
+    ADD COLUMN IF NOT EXISTS details TEXT;
@@ -0,0 +1,341 @@
+-- SQLite schema for single-clinic deployments (DATABASE_DRIVER=sqlite).  It
+-- mirrors schema.sql after all Postgres migrations; keep the two in step.
+-- UUIDs and JSON are stored as TEXT and timestamps as UTC text in the form
+-- written by strftime('%Y-%m-%d %H:%M:%f', 'now') so they compare correctly.
+
+-- prompt_profiles: per-clinic intake prompts that override the defaults
+CREATE TABLE IF NOT EXISTS prompt_profiles (
+    name                  TEXT PRIMARY KEY,
+    system_prompt         TEXT NOT NULL DEFAULT '',
+    first_message         TEXT NOT NULL DEFAULT '',
+    summarize_instruction TEXT NOT NULL DEFAULT '',
+    max_reply_chars       INTEGER NOT NULL DEFAULT 0,
+    simple_language       BOOLEAN NOT NULL DEFAULT FALSE,
+    summary_language      TEXT NOT NULL DEFAULT '',
+    created_at            TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    updated_at            TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+-- clinics sharing the instance; sessions default to the 'default' clinic
+CREATE TABLE IF NOT EXISTS clinics (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    host         TEXT UNIQUE,
+    path_prefix  TEXT UNIQUE,
+    message_cap  INTEGER,
+    display_name TEXT,
+    logo_url     TEXT,
+    accent_color TEXT,
+    -- operating_hours: when the bot answers, e.g. 'sat-wed 08:00-20:00'
+    -- (see core.ParseOperatingHours); unset for always.  timezone: the
+    -- IANA zone of the hours, Tehran when unset
+    operating_hours TEXT,
+    timezone     TEXT,
+    created_at   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+INSERT INTO clinics (id, name) VALUES ('default', 'Default clinic')
+    ON CONFLICT (id) DO NOTHING;
+
+-- doctors: the doctor logins (DOCTOR_USERS), synced at startup; doctors
+-- no longer configured are kept inactive for their past assignments
+CREATE TABLE IF NOT EXISTS doctors (
+    id                INTEGER PRIMARY KEY AUTOINCREMENT,
+    username          TEXT NOT NULL UNIQUE,
+    clinic_id         TEXT NOT NULL REFERENCES clinics(id),
+    active            BOOLEAN NOT NULL DEFAULT TRUE,
+    last_assigned_at  TIMESTAMP,
+    created_at        TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+-- sessions: one per patient visit
+CREATE TABLE IF NOT EXISTS sessions (
+    id                        TEXT PRIMARY KEY,
+    created_at                TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    closed_at                 TIMESTAMP,
+    message_cap               INTEGER NOT NULL DEFAULT 0,
+    patient_name              TEXT,
+    patient_address           TEXT,
+    patient_phone             TEXT,
+    patient_national_id       TEXT,
+    patient_national_id_hmac  TEXT,
+    client_ip                 TEXT,
+    user_agent                TEXT,
+    status                    TEXT NOT NULL DEFAULT 'open',
+    prompt_profile            TEXT REFERENCES prompt_profiles(name) ON DELETE SET NULL,
+    escalated_at              TIMESTAMP,
+    escalation_reason         TEXT,
+    last_message_at           TIMESTAMP,
+    clinic_id                 TEXT NOT NULL DEFAULT 'default' REFERENCES clinics(id),
+    locale                    TEXT NOT NULL DEFAULT 'fa',
+    last_seq                  INTEGER NOT NULL DEFAULT 0,
+    last_read_seq             INTEGER NOT NULL DEFAULT 0,
+    trace_llm                 BOOLEAN NOT NULL DEFAULT FALSE,
+    assigned_doctor_id        INTEGER REFERENCES doctors(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_national_id_lookup
+    ON sessions (COALESCE(patient_national_id_hmac, patient_national_id), created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_open_last_activity
+    ON sessions (COALESCE(last_message_at, created_at)) WHERE closed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_clinic_open
+    ON sessions (clinic_id) WHERE closed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_assigned_doctor
+    ON sessions (assigned_doctor_id) WHERE closed_at IS NULL;
+
+-- sessions closed before CloseSession set the status are marked closed
+UPDATE sessions SET status = 'closed'
+WHERE closed_at IS NOT NULL AND status <> 'closed';
+
+-- messages: transcript lines
+CREATE TABLE IF NOT EXISTS messages (
+    id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id           TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    role                 TEXT NOT NULL CHECK (role IN ('patient','bot')),
+    content              TEXT NOT NULL,
+    moderation_category  TEXT,
+    model                TEXT,
+    latency_ms           INTEGER,
+    llm_latency_ms       INTEGER,
+    unanswered           BOOLEAN NOT NULL DEFAULT FALSE,
+    retries              INTEGER NOT NULL DEFAULT 0,
+    deleted_at           TIMESTAMP,
+    redacted_by          TEXT,
+    edits                TEXT NOT NULL DEFAULT '[]',
+    metadata             TEXT NOT NULL DEFAULT '{}',
+    seq                  INTEGER NOT NULL,
+    created_at           TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_session_id_created_at
+    ON messages (session_id, created_at);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_session_seq
+    ON messages (session_id, seq);
+
+CREATE INDEX IF NOT EXISTS idx_messages_moderation_category
+    ON messages (json_extract(metadata, '$.moderation_category'))
+    WHERE json_extract(metadata, '$.moderation_category') IS NOT NULL;
+
+-- summaries: one row per session
+CREATE TABLE IF NOT EXISTS summaries (
+    id                 INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id         TEXT NOT NULL UNIQUE REFERENCES sessions(id) ON DELETE CASCADE,
+    key_points         TEXT NOT NULL DEFAULT '[]',
+    structured         TEXT NOT NULL DEFAULT '{}',
+    free_text          TEXT,
+    transcript_hash    TEXT,
+    pending_hash       TEXT,
+    pending_at         TIMESTAMP,
+    priority           INTEGER NOT NULL DEFAULT 0,
+    pain_score         INTEGER,
+    pain_score_clamped BOOLEAN NOT NULL DEFAULT FALSE,
+    duration_value     INTEGER,
+    duration_unit      TEXT,
+    embedding          TEXT,
+    questions          TEXT NOT NULL DEFAULT '[]',
+    attempt_status     TEXT,
+    attempt_error      TEXT,
+    attempted_at       TIMESTAMP,
+    model              TEXT,
+    schema_version     INTEGER NOT NULL DEFAULT 1,
+    updated_at         TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_summaries_updated_at
+    ON summaries (updated_at DESC);
+
+-- audit_log: who accessed which patient data and when
+CREATE TABLE IF NOT EXISTS audit_log (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor       TEXT NOT NULL,
+    action      TEXT NOT NULL,
+    session_id  TEXT,
+    request_id  TEXT NOT NULL DEFAULT '',
+    assignee    TEXT,
+    details     TEXT,
+    created_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at
+    ON audit_log (created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_session_id
+    ON audit_log (session_id, created_at DESC);
+
+-- attachments: uploaded files (prescription photos) linked to the patient
+-- message that carried them
+CREATE TABLE IF NOT EXISTS attachments (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id    TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    message_id    INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    storage_key   TEXT NOT NULL,
+    content_type  TEXT NOT NULL,
+    size_bytes    INTEGER NOT NULL,
+    created_at    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id
+    ON attachments (message_id);
+
+-- webhooks: outbound endpoints notified when summaries change (EHR
+-- integration); payloads are signed with the shared secret
+CREATE TABLE IF NOT EXISTS webhooks (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    url         TEXT NOT NULL,
+    secret      TEXT NOT NULL,
+    created_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+-- webhook_deliveries: one row per event per webhook, retried until
+-- delivered or marked dead
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event            TEXT NOT NULL,
+    payload          TEXT NOT NULL,
+    status           TEXT NOT NULL DEFAULT 'pending',
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    last_error       TEXT,
+    response_status  INTEGER,
+    next_attempt_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    created_at       TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    delivered_at     TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due
+    ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook
+    ON webhook_deliveries (webhook_id, created_at DESC);
+
+-- pending_replies: bot replies generated in the background when async
+-- replies are enabled; the patient's page polls until one is done
+CREATE TABLE IF NOT EXISTS pending_replies (
+    id               TEXT PRIMARY KEY,
+    session_id       TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    status           TEXT NOT NULL DEFAULT 'pending',
+    message_id       INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+    error            TEXT,
+    patient_content  TEXT,
+    patient_edits    TEXT NOT NULL DEFAULT '[]',
+    patient_message_id INTEGER REFERENCES messages(id) ON DELETE CASCADE,
+    created_at       TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    completed_at     TIMESTAMP
+);
+
+-- llm_costs: running token usage and estimated cost per calendar month
+-- ("2006-01") and model, for the monthly budget guard
+CREATE TABLE IF NOT EXISTS llm_costs (
+    month              TEXT NOT NULL,
+    model              TEXT NOT NULL,
+    prompt_tokens      INTEGER NOT NULL DEFAULT 0,
+    completion_tokens  INTEGER NOT NULL DEFAULT 0,
+    cost_usd           REAL NOT NULL DEFAULT 0,
+    updated_at         TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (month, model)
+);
+
+-- cap_overrides: extra messages granted to a patient (by national ID lookup
+-- key, as matched against sessions) or to one session until expires_at, on
+-- top of the message cap
+CREATE TABLE IF NOT EXISTS cap_overrides (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    national_id     TEXT,
+    session_id      TEXT REFERENCES sessions(id) ON DELETE CASCADE,
+    extra_messages  INTEGER NOT NULL CHECK (extra_messages > 0),
+    granted_by      TEXT NOT NULL,
+    expires_at      TIMESTAMP NOT NULL,
+    created_at      TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    CHECK (national_id IS NOT NULL OR session_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_national_id
+    ON cap_overrides (national_id, expires_at);
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_session
+    ON cap_overrides (session_id, expires_at);
+
+-- events: outbox of session events, written in the same transaction as the
+-- change and published by the outbox dispatcher
+CREATE TABLE IF NOT EXISTS events (
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind             TEXT NOT NULL,
+    session_id       TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    payload          TEXT NOT NULL,
+    created_at       TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    next_attempt_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    published_at     TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_unpublished
+    ON events (id) WHERE published_at IS NULL;
+
+-- denylist: national IDs (by lookup key, as matched against sessions) and
+-- client IPs refused a session on /start, for fake registrations
+CREATE TABLE IF NOT EXISTS denylist (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind        TEXT NOT NULL CHECK (kind IN ('national_id', 'ip')),
+    value       TEXT NOT NULL,
+    reason      TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL,
+    created_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    UNIQUE (kind, value)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_client_ip
+    ON sessions (client_ip, created_at);
+
+-- phone_verifications: start forms waiting for the patient to enter the
+-- code texted to their phone.  The patient fields are encrypted like the
+-- sessions'; phone_key is the phone's lookup key, for the per-phone limit.
+CREATE TABLE IF NOT EXISTS phone_verifications (
+    id           TEXT PRIMARY KEY,
+    national_id  TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    phone        TEXT NOT NULL,
+    phone_key    TEXT NOT NULL,
+    clinic_id    TEXT NOT NULL REFERENCES clinics(id),
+    profile      TEXT NOT NULL DEFAULT '',
+    locale       TEXT NOT NULL DEFAULT '',
+    client_ip    TEXT,
+    code_hash    TEXT NOT NULL,
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    expires_at   TIMESTAMP NOT NULL,
+    verified_at  TIMESTAMP,
+    created_at   TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_phone
+    ON phone_verifications (phone_key, created_at);
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_ip
+    ON phone_verifications (client_ip, created_at);
+
+-- llm_traces: model calls of sessions flagged for tracing (trace_llm),
+-- with the patient's identifiers masked; deleted after 30 days
+CREATE TABLE IF NOT EXISTS llm_traces (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id  TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    kind        TEXT NOT NULL,
+    model       TEXT NOT NULL DEFAULT '',
+    messages    TEXT NOT NULL,
+    response    TEXT NOT NULL DEFAULT '',
+    error       TEXT NOT NULL DEFAULT '',
+    latency_ms  INTEGER NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_traces_session
+    ON llm_traces (session_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_llm_traces_created
+    ON llm_traces (created_at);
+
+-- session_views: when each doctor last opened a session
+CREATE TABLE IF NOT EXISTS session_views (
+    session_id      TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    doctor          TEXT NOT NULL,
+    last_viewed_at  TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (session_id, doctor)
+);
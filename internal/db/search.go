@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"strings"
+
+	"waitroom-chatbot/pkg"
+)
+
+// snippetContext is the number of characters kept on each side of a match.
+const snippetContext = 40
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchMessages finds messages containing query (case-insensitive substring
+// match backed by the pg_trgm index) across all sessions, newest first.  A
+// non-empty nationalID restricts the search to that patient's sessions and a
+// non-empty clinicID to the clinic's.
+func (r *Repository) SearchMessages(ctx context.Context, query, nationalID, clinicID string, limit int) ([]pkg.SearchHit, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+	var key string
+	if nationalID != "" {
+		key = r.lookupKey(nationalID)
+	}
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT m.id, COALESCE(s.patient_national_id, ''), m.role, m.content, m.created_at,
+                s.id, COALESCE(s.patient_name, ''), s.created_at
+         FROM messages m
+         JOIN sessions s ON m.session_id = s.id
+         WHERE m.content `+r.Dialect.ilike()+` '%' || $1 || '%' ESCAPE '\'
+           AND m.deleted_at IS NULL
+           AND ($2 = '' OR COALESCE(s.patient_national_id_hmac, s.patient_national_id) = $2)
+           AND ($3 = '' OR s.clinic_id = $3)
+         ORDER BY m.created_at DESC
+         LIMIT $4`,
+		likeEscaper.Replace(query), key, clinicID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hits []pkg.SearchHit
+	for rows.Next() {
+		var h pkg.SearchHit
+		m := &h.Message
+		if err := rows.Scan(&m.ID, &m.NationalID, &m.Role, &m.Content, &m.CreatedAt,
+			&h.SessionID, &h.PatientName, &h.SessionAt); err != nil {
+			return nil, err
+		}
+		m.SessionID = h.SessionID
+		if err := r.PII.DecryptPtr(&m.NationalID); err != nil {
+			return nil, err
+		}
+		if err := r.PII.DecryptPtr(&h.PatientName); err != nil {
+			return nil, err
+		}
+		h.Before, h.Match, h.After = snippet(m.Content, query)
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// snippet splits content around the first case-insensitive occurrence of
+// query, trimming the surrounding text to snippetContext characters.
+func snippet(content, query string) (before, match, after string) {
+	runes := []rune(content)
+	lower := []rune(strings.ToLower(content))
+	q := []rune(strings.ToLower(query))
+	idx := -1
+	if len(lower) == len(runes) {
+		idx = indexRunes(lower, q)
+	}
+	if idx < 0 {
+		if len(runes) > 2*snippetContext {
+			return string(runes[:2*snippetContext]) + "…", "", ""
+		}
+		return content, "", ""
+	}
+	start := idx - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	end := idx + len(q) + snippetContext
+	if end > len(runes) {
+		end = len(runes)
+	}
+	before = string(runes[start:idx])
+	if start > 0 {
+		before = "…" + before
+	}
+	after = string(runes[idx+len(q) : end])
+	if end < len(runes) {
+		after += "…"
+	}
+	return before, string(runes[idx : idx+len(q)]), after
+}
+
+func indexRunes(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		found := true
+		for j := range sub {
+			if s[i+j] != sub[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
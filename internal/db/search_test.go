@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+func TestSearchMessages(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	first := newTestSession(t, r, "0012345678")
+	if _, _, err := r.CreateMessagePair(ctx, first, nil, "به پنی‌سیلین حساسیت دارم", "ممنون."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CloseSession(ctx, first.String()); err != nil {
+		t.Fatal(err)
+	}
+	second := newTestSession(t, r, "0012345678")
+	if second == first {
+		t.Fatal("no new session after closing")
+	}
+	if _, _, err := r.CreateMessagePair(ctx, second, nil, "باز هم پنی‌سیلین خوردم و کهیر زدم", "چه زمانی؟"); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestSession(t, r, "0098765432")
+	if _, _, err := r.CreateMessagePair(ctx, other, nil, "پنی‌سیلین ۱۰۰% مصرف می‌کنم", "ممنون."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.DB.Exec(`INSERT INTO clinics (id, name) VALUES ('north', 'North')`); err != nil {
+		t.Fatal(err)
+	}
+	u := &pkg.User{NationalID: "0011111111", Phone: "09120000000", Name: "Reza"}
+	if err := r.UpsertUser(ctx, u, "", "north", "fa", 10); err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.GetLatestSession(ctx, u.NationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	north := s.ID
+	redacted, _, err := r.CreateMessagePair(ctx, other, nil, "پنی‌سیلین را پاک کنید", "باشه.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RedactMessage(ctx, other.String(), redacted.ID, "dr"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.CreateMessagePair(ctx, uuid.MustParse(north), nil, "پنی‌سیلین", "ممنون."); err != nil {
+		t.Fatal(err)
+	}
+	// Messages stored in the same millisecond would tie.
+	if _, err := r.DB.Exec(`UPDATE messages SET created_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '-' || (100 - id) || ' seconds')`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, query, nationalID, clinic string
+		limit                           int
+		want                            []string // session of each hit, newest first
+	}{
+		{"every session", "پنی‌سیلین", "", "", 10, []string{north, other.String(), second.String(), first.String()}},
+		{"one patient", "پنی‌سیلین", "0012345678", "", 10, []string{second.String(), first.String()}},
+		{"one clinic", "پنی‌سیلین", "", pkg.DefaultClinic, 10, []string{other.String(), second.String(), first.String()}},
+		{"limited", "پنی‌سیلین", "", "", 2, []string{north, other.String()}},
+		{"bot replies", "چه زمانی", "", "", 10, []string{second.String()}},
+		{"percent is literal", "۱۰۰%", "", "", 10, []string{other.String()}},
+		{"no wildcard", "%", "", "", 10, []string{other.String()}},
+		{"underscore is literal", "_", "", "", 10, nil},
+		{"no match", "آموکسی‌سیلین", "", "", 10, nil},
+		{"blank query", "  ", "", "", 10, nil},
+	}
+	for _, tt := range tests {
+		hits, err := r.SearchMessages(ctx, tt.query, tt.nationalID, tt.clinic, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, h := range hits {
+			got = append(got, h.SessionID)
+			if h.Message.SessionID != h.SessionID || !strings.Contains(h.Message.Content, strings.TrimSpace(tt.query)) {
+				t.Errorf("%s: hit %+v", tt.name, h)
+			}
+			if h.Match != strings.TrimSpace(tt.query) || h.Before+h.Match+h.After != h.Message.Content {
+				t.Errorf("%s: snippet %q|%q|%q of %q", tt.name, h.Before, h.Match, h.After, h.Message.Content)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: sessions %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	hits, err := r.SearchMessages(ctx, "پنی‌سیلین", "0098765432", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].PatientName != "Sara" || hits[0].Message.NationalID != "0098765432" || hits[0].Message.Role != pkg.RolePatient {
+		t.Errorf("hits of the patient %+v", hits)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("الف ", 30) // 120 characters
+	runes := []rune(long)
+	tests := []struct {
+		content, query       string
+		before, match, after string
+	}{
+		{"به پنی‌سیلین حساسیت دارم", "پنی‌سیلین", "به ", "پنی‌سیلین", " حساسیت دارم"},
+		{"Allergic to Penicillin", "penicillin", "Allergic to ", "Penicillin", ""},
+		{long + "کهیر" + long, "کهیر", "…" + string(runes[80:]), "کهیر", string(runes[:40]) + "…"},
+		{"سردرد", "تب", "سردرد", "", ""},
+		{long, "تب", string(runes[:80]) + "…", "", ""},
+	}
+	for _, tt := range tests {
+		before, match, after := snippet(tt.content, tt.query)
+		if before != tt.before || match != tt.match || after != tt.after {
+			t.Errorf("snippet(%q, %q) = %q|%q|%q, want %q|%q|%q", tt.content, tt.query, before, match, after, tt.before, tt.match, tt.after)
+		}
+	}
+}
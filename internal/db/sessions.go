@@ -0,0 +1,687 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// sessionColumns lists the columns scanned by scanSession in order.
+func (r *Repository) sessionColumns() string {
+	return `id, created_at, closed_at, message_cap, status,
+       patient_name, patient_phone, patient_national_id, ` + r.Dialect.host("client_ip") + `, user_agent,
+       prompt_profile, escalated_at, escalation_reason, clinic_id, locale, trace_llm,
+       (SELECT d.username FROM doctors d WHERE d.id = assigned_doctor_id)`
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSession scans a row selected with sessionColumns and decrypts the
+// patient fields.
+func (r *Repository) scanSession(row rowScanner) (*pkg.Session, error) {
+	var s pkg.Session
+	err := row.Scan(&s.ID, &s.CreatedAt, &s.ClosedAt, &s.MessageCap, &s.Status,
+		&s.PatientName, &s.PatientPhone, &s.PatientID, &s.ClientIP, &s.UserAgent,
+		&s.PromptProfile, &s.EscalatedAt, &s.EscalationReason, &s.ClinicID, &s.Locale, &s.TraceLLM,
+		&s.AssignedDoctor)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	for _, f := range []*string{s.PatientName, s.PatientPhone, s.PatientID} {
+		if err := r.PII.DecryptPtr(f); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// GetSessionByID loads a single session by its UUID.
+func (r *Repository) GetSessionByID(ctx context.Context, sessionID string) (*pkg.Session, error) {
+	return r.scanSession(r.DB.QueryRowContext(ctx,
+		`SELECT `+r.sessionColumns()+`
+         FROM sessions
+         WHERE id = $1`, sessionID))
+}
+
+// GetLatestSession returns the most recently created session for a national ID.
+func (r *Repository) GetLatestSession(ctx context.Context, nationalID string) (*pkg.Session, error) {
+	s, err := r.scanSession(r.DB.QueryRowContext(ctx,
+		`SELECT `+r.sessionColumns()+`
+         FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
+         ORDER BY created_at DESC
+         LIMIT 1`, r.lookupKey(nationalID)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no session found for national ID %s: %w", nationalID, err)
+	}
+	return s, err
+}
+
+// ListSessionsByNationalID returns all sessions of a patient, newest first.
+func (r *Repository) ListSessionsByNationalID(ctx context.Context, nationalID string) ([]pkg.Session, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+r.sessionColumns()+`
+         FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
+         ORDER BY created_at DESC`, r.lookupKey(nationalID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Session
+	for rows.Next() {
+		s, err := r.scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
+
+// ErrNoActiveSession is returned by ResolveActiveSession when the patient
+// has no open session, e.g. because it was closed for inactivity.
+var ErrNoActiveSession = errs.New(errs.NotFound, "no active session")
+
+// ResolveActiveSession returns the patient's most recent open session.
+// Handlers resolve it once per request and pass its ID down.
+func (r *Repository) ResolveActiveSession(ctx context.Context, nationalID string) (*pkg.Session, error) {
+	s, err := r.scanSession(r.DB.QueryRowContext(ctx,
+		`SELECT `+r.sessionColumns()+`
+         FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
+           AND closed_at IS NULL
+         ORDER BY created_at DESC
+         LIMIT 1`, r.lookupKey(nationalID)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoActiveSession
+	}
+	return s, err
+}
+
+// statusSources lists, for each status UpdateSessionStatus can set, the
+// statuses it may be reached from.  Sessions are closed with CloseSession.
+var statusSources = map[pkg.SessionStatus][]pkg.SessionStatus{
+	pkg.StatusOpen:           {pkg.StatusReadyForDoctor, pkg.StatusReviewed},
+	pkg.StatusReadyForDoctor: {pkg.StatusOpen},
+	pkg.StatusReviewed:       {pkg.StatusOpen, pkg.StatusReadyForDoctor},
+}
+
+// TransitionError is returned by UpdateSessionStatus for a status change
+// the session lifecycle does not allow.
+type TransitionError struct {
+	From, To pkg.SessionStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("session status cannot change from %q to %q", e.From, e.To)
+}
+
+// Kind classifies the error as errs.Conflict.
+func (e *TransitionError) Kind() errs.Kind { return errs.Conflict }
+
+// UpdateSessionStatus sets the lifecycle status of a session.  Setting the
+// current status again is a no-op; other changes not allowed from the
+// current status fail with a *TransitionError, and an unknown session with
+// ErrNotFound.
+func (r *Repository) UpdateSessionStatus(ctx context.Context, sessionID string, status pkg.SessionStatus) error {
+	args := []interface{}{status, sessionID}
+	var sources []string
+	for _, from := range statusSources[status] {
+		args = append(args, from)
+		sources = append(sources, fmt.Sprintf("$%d", len(args)))
+	}
+	cond := "status = $1"
+	if len(sources) > 0 {
+		cond += " OR status IN (" + strings.Join(sources, ", ") + ")"
+	}
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions SET status = $1 WHERE id = $2 AND (`+cond+`)`, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	var current pkg.SessionStatus
+	if err := r.DB.QueryRowContext(ctx,
+		`SELECT status FROM sessions WHERE id = $1`, sessionID).Scan(&current); err != nil {
+		return notFound(err)
+	}
+	return &TransitionError{From: current, To: status}
+}
+
+// EscalateSession flags a session for the doctor's immediate attention.  The
+// first escalation wins; later calls keep the original time and reason.
+func (r *Repository) EscalateSession(ctx context.Context, sessionID, reason string) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions
+         SET escalated_at = `+r.Dialect.now()+`, escalation_reason = $1
+         WHERE id = $2 AND escalated_at IS NULL`, reason, sessionID)
+	return err
+}
+
+// SetSessionTrace turns the recording of a session's model calls (see
+// llm.Tracer) on or off.  It returns ErrNotFound when the session does
+// not exist.
+func (r *Repository) SetSessionTrace(ctx context.Context, sessionID string, on bool) error {
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions SET trace_llm = $1 WHERE id = $2`, on, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// ListActiveSessions returns previews of the sessions that have not been
+// closed, of one clinic or, when clinicID is empty, of all, optionally only
+// those with the given status.  Escalated sessions are listed first, then by
+// triage priority (highest first), then sessions that are ready for the
+// doctor, then the most recently active ones.
+func (r *Repository) ListActiveSessions(ctx context.Context, clinicID string, status pkg.SessionStatus) ([]pkg.DoctorSessionPreview, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+previewColumns("0")+`
+         FROM sessions s
+         LEFT JOIN summaries sm ON sm.session_id = s.id
+         LEFT JOIN doctors d ON d.id = s.assigned_doctor_id
+         WHERE s.closed_at IS NULL
+           AND ($1 = '' OR s.clinic_id = $1)
+           AND ($2 = '' OR s.status = $2)
+         ORDER BY s.escalated_at IS NULL,
+                  COALESCE(sm.priority, 0) DESC,
+                  CASE s.status WHEN 'ready_for_doctor' THEN 0 ELSE 1 END,
+                  COALESCE(s.last_message_at, s.created_at) DESC`, clinicID, status)
+	if err != nil {
+		return nil, err
+	}
+	return r.scanPreviews(rows)
+}
+
+// previewColumns returns the columns scanPreviews reads, selected from
+// sessions s joined with their summaries sm and assigned doctors d; unread
+// is the SQL expression for the number of unread messages.
+func previewColumns(unread string) string {
+	return `s.id, s.status, s.escalated_at IS NOT NULL,
+                COALESCE(sm.priority, 0),
+                sm.pain_score, sm.duration_value, sm.duration_unit,
+                COALESCE(sm.key_points, '[]'),
+                COALESCE(sm.updated_at, s.created_at),
+                COALESCE(s.last_message_at, s.created_at),
+                COALESCE(d.username, ''), ` + unread + `,
+                COALESCE(sm.free_text, ''), COALESCE(sm.attempt_status, '')`
+}
+
+// unreadSince counts the patient messages of session s written after the
+// viewer, the doctor given as query argument n, last opened it: all of
+// them if the doctor never did.
+func unreadSince(n int) string {
+	return fmt.Sprintf(`(SELECT COUNT(*) FROM messages m
+                 WHERE m.session_id = s.id AND m.role = 'patient'
+                   AND NOT EXISTS (SELECT 1 FROM session_views v
+                                   WHERE v.session_id = s.id AND v.doctor = $%d
+                                     AND v.last_viewed_at >= m.created_at))`, n)
+}
+
+// ListSessionPreviews returns a page of previews of the sessions that have
+// not been closed, of one clinic or, when clinicID is empty, of all, most
+// recently updated first, narrowed by f.  The summary and last activity come
+// from the same query, so a page costs one round trip however many sessions
+// it holds.  Pages are keyed on (updated_at, session_id): pass the last
+// preview of a page as after to get the next one, or nil for the first.
+// Unread counts the patient messages since viewer last opened the session.
+func (r *Repository) ListSessionPreviews(ctx context.Context, clinicID, viewer string, f pkg.PreviewFilter, after *pkg.PreviewCursor, limit int) ([]pkg.DoctorSessionPreview, error) {
+	conds, args := r.previewConditions(clinicID, f)
+	if after != nil {
+		args = append(args, r.Dialect.timeArg(after.UpdatedAt), after.SessionID)
+		conds = append(conds, fmt.Sprintf(`(COALESCE(sm.updated_at, s.created_at) < $%d
+                OR COALESCE(sm.updated_at, s.created_at) = $%d AND s.id < $%d)`, len(args)-1, len(args)-1, len(args)))
+	}
+	args = append(args, viewer, limit)
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+previewColumns(unreadSince(len(args)-1))+`
+         FROM sessions s
+         LEFT JOIN summaries sm ON sm.session_id = s.id
+         LEFT JOIN doctors d ON d.id = s.assigned_doctor_id
+         WHERE `+strings.Join(conds, " AND ")+`
+         ORDER BY COALESCE(sm.updated_at, s.created_at) DESC, s.id DESC
+         LIMIT `+fmt.Sprintf("$%d", len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	return r.scanPreviews(rows)
+}
+
+// CountPreviewsUpdatedSince counts the sessions ListSessionPreviews would
+// list with f whose preview changed after since.  They have moved ahead of
+// pages fetched before then.
+func (r *Repository) CountPreviewsUpdatedSince(ctx context.Context, clinicID string, f pkg.PreviewFilter, since time.Time) (int, error) {
+	conds, args := r.previewConditions(clinicID, f)
+	args = append(args, r.Dialect.timeArg(since))
+	conds = append(conds, fmt.Sprintf("COALESCE(sm.updated_at, s.created_at) > $%d", len(args)))
+	var n int
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*)
+         FROM sessions s
+         LEFT JOIN summaries sm ON sm.session_id = s.id
+         WHERE `+strings.Join(conds, " AND "), args...,
+	).Scan(&n)
+	return n, err
+}
+
+// redFlagPriority is the triage priority of sessions with red flags (see
+// core.PriorityRedFlag).
+const redFlagPriority = 3
+
+// previewConditions returns the WHERE conditions, and their arguments, that
+// select the open sessions of a clinic (or all) matching f.
+func (r *Repository) previewConditions(clinicID string, f pkg.PreviewFilter) ([]string, []interface{}) {
+	conds := []string{"s.closed_at IS NULL"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if clinicID != "" {
+		add("s.clinic_id = $%d", clinicID)
+	}
+	if f.Status != "" {
+		add("s.status = $%d", f.Status)
+	}
+	if f.RedFlag {
+		add("(s.escalated_at IS NOT NULL OR sm.priority = $%d)", redFlagPriority)
+	}
+	if !f.From.IsZero() {
+		add("s.created_at >= $%d", r.Dialect.timeArg(f.From))
+	}
+	if !f.To.IsZero() {
+		add("s.created_at < $%d", r.Dialect.timeArg(f.To))
+	}
+	if f.Doctor != 0 {
+		add("(s.assigned_doctor_id = $%d OR s.assigned_doctor_id IS NULL)", f.Doctor)
+	}
+	return conds, args
+}
+
+// scanPreviews reads rows of previewColumns and closes rows.  A summary is
+// flagged stale as by Summary.Stale with StaleSummaryAfter, against the
+// session's last message.
+func (r *Repository) scanPreviews(rows *sql.Rows) ([]pkg.DoctorSessionPreview, error) {
+	defer rows.Close()
+	var out []pkg.DoctorSessionPreview
+	for rows.Next() {
+		var p pkg.DoctorSessionPreview
+		var keyPoints []byte
+		var durationValue *int
+		var durationUnit *string
+		var freeText, attemptStatus string
+		if err := rows.Scan(&p.SessionID, &p.Status, &p.Escalated, &p.Priority,
+			&p.PainScore, &durationValue, &durationUnit, &keyPoints,
+			timeColumn{&p.UpdatedAt}, timeColumn{&p.LastMessage}, &p.AssignedTo, &p.Unread,
+			&freeText, &attemptStatus); err != nil {
+			return nil, err
+		}
+		p.Duration = duration(durationValue, durationUnit)
+		if err := json.Unmarshal(keyPoints, &p.KeyPoints); err != nil {
+			return nil, err
+		}
+		summary := pkg.Summary{KeyPoints: p.KeyPoints, FreeText: freeText, UpdatedAt: p.UpdatedAt}
+		if attemptStatus != "" {
+			summary.LastAttempt = &pkg.SummaryAttempt{Status: attemptStatus}
+		}
+		p.SummaryStale = summary.Stale(p.LastMessage, r.StaleSummaryAfter)
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// EncryptExistingPII encrypts the patient fields of sessions written before
+// PII encryption was enabled and fills in their lookup HMAC.  It processes
+// rows in batches and returns the number of sessions converted.
+func (r *Repository) EncryptExistingPII(ctx context.Context) (int, error) {
+	if !r.PII.Enabled() {
+		return 0, errors.New("PII encryption is not configured")
+	}
+	const batch = 500
+	total := 0
+	for {
+		rows, err := r.DB.QueryContext(ctx,
+			`SELECT id, COALESCE(patient_national_id, ''), COALESCE(patient_phone, ''), COALESCE(patient_name, '')
+             FROM sessions
+             WHERE patient_national_id_hmac IS NULL AND patient_national_id IS NOT NULL
+             LIMIT $1`, batch)
+		if err != nil {
+			return total, err
+		}
+		type plainSession struct {
+			id string
+			u  pkg.User
+		}
+		var todo []plainSession
+		for rows.Next() {
+			var p plainSession
+			if err := rows.Scan(&p.id, &p.u.NationalID, &p.u.Phone, &p.u.Name); err != nil {
+				rows.Close()
+				return total, err
+			}
+			todo = append(todo, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(todo) == 0 {
+			return total, nil
+		}
+		for _, p := range todo {
+			encID, encPhone, encName, err := r.encryptUser(&p.u)
+			if err != nil {
+				return total, err
+			}
+			_, err = r.DB.ExecContext(ctx,
+				`UPDATE sessions
+                 SET patient_national_id = $1, patient_national_id_hmac = $2,
+                     patient_phone = NULLIF($3, ''), patient_name = NULLIF($4, '')
+                 WHERE id = $5 AND patient_national_id_hmac IS NULL`,
+				encID, r.PII.Hash(p.u.NationalID), encPhone, encName, p.id)
+			if err != nil {
+				return total, err
+			}
+			total++
+		}
+	}
+}
+
+// ListClosedSessions returns the sessions closed in [from, to), oldest first,
+// with their triage priority and summary key points.
+func (r *Repository) ListClosedSessions(ctx context.Context, from, to time.Time) ([]pkg.ClosedSession, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT s.id, COALESCE(s.patient_name, ''), s.closed_at,
+                s.escalated_at IS NOT NULL, COALESCE(s.escalation_reason, ''),
+                COALESCE(sm.priority, 0), COALESCE(sm.key_points, '[]')
+         FROM sessions s
+         LEFT JOIN summaries sm ON sm.session_id = s.id
+         WHERE s.closed_at >= $1 AND s.closed_at < $2
+         ORDER BY s.closed_at`, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.ClosedSession
+	for rows.Next() {
+		var c pkg.ClosedSession
+		var keyPoints []byte
+		if err := rows.Scan(&c.SessionID, &c.PatientName, &c.ClosedAt, &c.Escalated,
+			&c.EscalationReason, &c.Priority, &keyPoints); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(keyPoints, &c.KeyPoints); err != nil {
+			return nil, err
+		}
+		if err := r.PII.DecryptPtr(&c.PatientName); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// CountSessions returns the number of sessions ever started.
+func (r *Repository) CountSessions(ctx context.Context) (int, error) {
+	var n int
+	err := r.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM sessions`).Scan(&n)
+	return n, err
+}
+
+// ListSessionsCreatedBetween returns the sessions created in [from, to),
+// oldest first, with their patient fields decrypted.
+func (r *Repository) ListSessionsCreatedBetween(ctx context.Context, from, to time.Time) ([]pkg.Session, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+r.sessionColumns()+`
+         FROM sessions
+         WHERE created_at >= $1 AND created_at < $2
+         ORDER BY created_at, id`, r.Dialect.timeArg(from), r.Dialect.timeArg(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Session
+	for rows.Next() {
+		s, err := r.scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *s)
+	}
+	return out, rows.Err()
+}
+
+// ListStaleOpenSessions returns the IDs of open sessions without a message
+// (or, lacking messages, created) within idle.
+func (r *Repository) ListStaleOpenSessions(ctx context.Context, idle time.Duration) ([]string, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id FROM sessions
+         WHERE closed_at IS NULL
+           AND COALESCE(last_message_at, created_at) < `+r.Dialect.ago(seconds(idle)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ErrOpenSessionExists is returned by ReassignSession when the new patient
+// already has another open session at the clinic.
+var ErrOpenSessionExists = errs.New(errs.Conflict, "the patient already has an open session")
+
+// identityHashes are the hashes of a patient's identifiers recorded in the
+// audit log of a reassignment (see auditHash).
+type identityHashes struct {
+	NationalID string `json:"national_id"`
+	Name       string `json:"name"`
+	Phone      string `json:"phone"`
+}
+
+// reassignment is the audit detail of a session.reassign entry.
+type reassignment struct {
+	From identityHashes `json:"from"`
+	To   identityHashes `json:"to"`
+}
+
+// auditHash returns the hash a patient identifier is recorded under in the
+// audit log: its lookup hash when PII encryption is enabled and its SHA-256
+// otherwise, so the log never holds the identifier itself but a suspected
+// value can be checked against it.
+func (r *Repository) auditHash(value string) string {
+	if r.PII.Enabled() {
+		return r.PII.Hash(value)
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReassignSession moves a session to another patient, for a patient
+// registered under a mistyped national ID: the national ID, name and phone
+// of the session are replaced, so the old national ID no longer resolves to
+// it.  entry, naming the actor and request, is written to the audit log in
+// the same transaction with the session ID and, as Details, the hashes of
+// the old and new identifiers, so a wrong reassignment can be traced back.
+// An open session cannot be moved to a patient with another open session
+// at its clinic (ErrOpenSessionExists); an unknown session yields
+// ErrNotFound.
+func (r *Repository) ReassignSession(ctx context.Context, sessionID, nationalID, name, phone string, entry pkg.AuditEntry) error {
+	encID, encPhone, encName, err := r.encryptUser(&pkg.User{NationalID: nationalID, Name: name, Phone: phone})
+	if err != nil {
+		return err
+	}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var clinicID string
+	var open bool
+	var oldID, oldName, oldPhone sql.NullString
+	if err := tx.QueryRowContext(ctx,
+		`SELECT clinic_id, closed_at IS NULL, patient_national_id, patient_name, patient_phone
+         FROM sessions WHERE id = $1`, sessionID,
+	).Scan(&clinicID, &open, &oldID, &oldName, &oldPhone); err != nil {
+		return notFound(err)
+	}
+	if open {
+		var other string
+		err := tx.QueryRowContext(ctx,
+			`SELECT id FROM sessions
+             WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1
+               AND clinic_id = $2 AND closed_at IS NULL AND id <> $3
+             LIMIT 1`, r.lookupKey(nationalID), clinicID, sessionID,
+		).Scan(&other)
+		if err == nil {
+			return ErrOpenSessionExists
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	change := reassignment{To: identityHashes{NationalID: r.auditHash(nationalID), Name: r.auditHash(name), Phone: r.auditHash(phone)}}
+	for _, f := range []struct {
+		stored sql.NullString
+		hash   *string
+	}{{oldID, &change.From.NationalID}, {oldName, &change.From.Name}, {oldPhone, &change.From.Phone}} {
+		if !f.stored.Valid {
+			continue
+		}
+		value, err := r.PII.Decrypt(f.stored.String)
+		if err != nil {
+			return err
+		}
+		*f.hash = r.auditHash(value)
+	}
+	details, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE sessions
+         SET patient_national_id = $1, patient_national_id_hmac = NULLIF($2, ''),
+             patient_name = $3, patient_phone = $4
+         WHERE id = $5`,
+		encID, r.PII.Hash(nationalID), encName, encPhone, sessionID); err != nil {
+		return err
+	}
+	entry.SessionID = sessionID
+	entry.Details = string(details)
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if err := r.insertAuditEntries(ctx, tx, []pkg.AuditEntry{entry}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.Transcripts.invalidate(sessionID)
+	return nil
+}
+
+// CloseSession marks a session closed.  It reports false when the session
+// was already closed, so concurrent sweepers close each session once.
+func (r *Repository) CloseSession(ctx context.Context, sessionID string) (bool, error) {
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE sessions SET closed_at = `+r.Dialect.now()+`, status = 'closed'
+         WHERE id = $1 AND closed_at IS NULL`, sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// PurgePatient deletes every session of the patient with the national ID,
+// with their messages, summaries, attachments and events, and the cap
+// overrides granted to the patient.  The audit log is kept.  It returns
+// the IDs of the deleted sessions and the storage keys of their
+// attachments, whose files the caller removes.
+func (r *Repository) PurgePatient(ctx context.Context, nationalID string) (sessionIDs, storageKeys []string, err error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	key := r.lookupKey(nationalID)
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1`, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows, err = tx.QueryContext(ctx,
+		`SELECT a.storage_key FROM attachments a
+         JOIN sessions s ON s.id = a.session_id
+         WHERE COALESCE(s.patient_national_id_hmac, s.patient_national_id) = $1`, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		storageKeys = append(storageKeys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	// Messages, summaries, attachments, pending replies, events and the
+	// sessions' cap overrides go with the sessions.
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM sessions
+         WHERE COALESCE(patient_national_id_hmac, patient_national_id) = $1`, key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cap_overrides WHERE national_id = $1`, key); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	for _, id := range sessionIDs {
+		r.Transcripts.invalidate(id)
+	}
+	return sessionIDs, storageKeys, nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+func TestListActiveSessionsPriority(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	ids, byName := make(map[string]string), make(map[string]string)
+	for i, name := range []string{"routine", "pain", "red flag", "escalated", "ready"} {
+		id := newTestSession(t, r, fmt.Sprintf("00%d0000000", i+1)).String()
+		ids[id], byName[name] = name, id
+	}
+	for name, priority := range map[string]int{"routine": 0, "pain": 2, "red flag": 3, "escalated": 0, "ready": 0} {
+		if err := r.UpsertSummary(ctx, &pkg.Summary{SessionID: byName[name], KeyPoints: []string{name}, Priority: priority}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.EscalateSession(ctx, byName["escalated"], "red flag"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateSessionStatus(ctx, byName["ready"], pkg.StatusReadyForDoctor); err != nil {
+		t.Fatal(err)
+	}
+	// The routine session is the most recently active.
+	if _, _, err := r.CreateMessagePair(ctx, uuid.MustParse(byName["routine"]), nil, "سلام", "سلام"); err != nil {
+		t.Fatal(err)
+	}
+
+	previews, err := r.ListActiveSessions(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, p := range previews {
+		order = append(order, ids[p.SessionID])
+		if s, err := r.GetSummary(ctx, p.SessionID); err != nil || s.Priority != p.Priority {
+			t.Errorf("%s: preview priority %d, stored %+v, %v", ids[p.SessionID], p.Priority, s, err)
+		}
+	}
+	if got, want := strings.Join(order, ", "), "escalated, red flag, pain, ready, routine"; got != want {
+		t.Errorf("order %s, want %s", got, want)
+	}
+
+	// The red-flag filter of the dashboard selects escalated sessions and
+	// those of the red-flag priority.
+	flagged, err := r.ListSessionPreviews(ctx, "", "", pkg.PreviewFilter{RedFlag: true}, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range flagged {
+		names = append(names, ids[p.SessionID])
+	}
+	if len(names) != 2 || !strings.Contains(strings.Join(names, ","), "escalated") || !strings.Contains(strings.Join(names, ","), "red flag") {
+		t.Errorf("red-flag filter %v", names)
+	}
+}
+
+// seedPreviews inserts n open sessions in one transaction, every other one
+// with a summary.  Sessions share their update time in threes, so pages
+// fall between sessions updated at once.
+func seedPreviews(t testing.TB, r *Repository, n int) {
+	t.Helper()
+	tx, err := r.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		id := uuid.NewString()
+		at := r.Dialect.timeArg(start.Add(time.Duration(i/3) * time.Millisecond))
+		if _, err := tx.Exec(`INSERT INTO sessions (id, created_at, patient_national_id) VALUES ($1, $2, $3)`, id, at, fmt.Sprintf("%010d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			if _, err := tx.Exec(`INSERT INTO summaries (session_id, key_points, free_text, updated_at) VALUES ($1, '["سردرد"]', 'سردرد', $2)`, id, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newCountingRepo returns a Repository on a migrated SQLite database whose
+// statements are counted by the name of the Repository method that ran
+// them.
+func newCountingRepo(t testing.TB) (*Repository, map[string]int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	plain, err := Open(SQLite, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := Migrate(context.Background(), plain, SQLite); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	counts := map[string]int{}
+	conn, err := OpenInstrumented(SQLite, path, &Instrumentation{Observe: func(name string, d time.Duration) { counts[name]++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := NewRepository(conn)
+	r.Dialect = SQLite
+	return r, counts
+}
+
+func TestListSessionPreviewsPages(t *testing.T) {
+	r, counts := newCountingRepo(t)
+	ctx := context.Background()
+	const sessions, pageSize = 250, 40
+	seedPreviews(t, r, sessions)
+
+	seen := map[string]bool{}
+	var after *pkg.PreviewCursor
+	var last pkg.DoctorSessionPreview
+	pages := 0
+	for {
+		delete(counts, "ListSessionPreviews")
+		page, err := r.ListSessionPreviews(ctx, "", "dr", pkg.PreviewFilter{}, after, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := counts["ListSessionPreviews"]; n != 1 {
+			t.Fatalf("page %d took %d queries, want 1", pages+1, n)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages++
+		for _, p := range page {
+			if seen[p.SessionID] {
+				t.Fatalf("session %s listed twice", p.SessionID)
+			}
+			seen[p.SessionID] = true
+			// Newest first, ties broken by descending session id.
+			if last.SessionID != "" && (p.UpdatedAt.After(last.UpdatedAt) || p.UpdatedAt.Equal(last.UpdatedAt) && p.SessionID > last.SessionID) {
+				t.Fatalf("%s (%v) listed after %s (%v)", p.SessionID, p.UpdatedAt, last.SessionID, last.UpdatedAt)
+			}
+			last = p
+		}
+		if len(page) > pageSize {
+			t.Fatalf("page of %d, want at most %d", len(page), pageSize)
+		}
+		after = &pkg.PreviewCursor{UpdatedAt: last.UpdatedAt, SessionID: last.SessionID}
+	}
+	if len(seen) != sessions || pages != (sessions+pageSize-1)/pageSize {
+		t.Errorf("%d sessions in %d pages, want %d", len(seen), pages, sessions)
+	}
+}
+
+func BenchmarkListSessionPreviews(b *testing.B) {
+	r, _ := newCountingRepo(b)
+	ctx := context.Background()
+	seedPreviews(b, r, 3000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ListSessionPreviews(ctx, "", "dr", pkg.PreviewFilter{}, nil, 50); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReassignSessionAudit(t *testing.T) {
+	r := newTestRepo(t)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678").String()
+	newTestSession(t, r, "0098765432")
+
+	// Moving the open session onto a patient with one fails and logs nothing.
+	entry := pkg.AuditEntry{Actor: "admin", Action: "session.reassign", RequestID: "req-1"}
+	if err := r.ReassignSession(ctx, id, "0098765432", "Reza", "09121112233", entry); err != ErrOpenSessionExists {
+		t.Fatalf("reassign onto an open session: %v", err)
+	}
+	if got, err := r.ListAuditEntries(ctx, pkg.AuditFilter{SessionID: id}); err != nil || len(got) != 0 {
+		t.Fatalf("audit log after a failed reassign: %v, %v", got, err)
+	}
+
+	if err := r.ReassignSession(ctx, id, "0011111111", "Reza", "09121112233", entry); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ListAuditEntries(ctx, pkg.AuditFilter{SessionID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Actor != "admin" || got[0].RequestID != "req-1" {
+		t.Fatalf("audit log %+v, want the reassign", got)
+	}
+	var change reassignment
+	if err := json.Unmarshal([]byte(got[0].Details), &change); err != nil {
+		t.Fatalf("details %q: %v", got[0].Details, err)
+	}
+	want := reassignment{
+		From: identityHashes{NationalID: r.auditHash("0012345678"), Name: r.auditHash("Sara"), Phone: r.auditHash("09120000000")},
+		To:   identityHashes{NationalID: r.auditHash("0011111111"), Name: r.auditHash("Reza"), Phone: r.auditHash("09121112233")},
+	}
+	if change != want {
+		t.Errorf("details %+v, want %+v", change, want)
+	}
+	if strings.Contains(got[0].Details, "0012345678") || strings.Contains(got[0].Details, "Reza") {
+		t.Errorf("details %q hold an identifier in the clear", got[0].Details)
+	}
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// summaryClaimTimeout is how long a regeneration claim blocks other workers
+// before it is considered abandoned.
+const summaryClaimTimeout = "5 minutes"
+
+// UpsertSummary stores the summary for a session, replacing any previous one.
+// When the summary carries a TranscriptHash the write only happens if this
+// worker still holds the claim for that hash (see ClaimSummary); a write
+// superseded by a newer claim is silently dropped and leaves s.ID zero.
+// A stored summary records a summary.updated event in the events outbox in
+// the same transaction.  It also records the latest attempt to regenerate
+// the summary: s.LastAttempt, or a successful one when nil.
+func (r *Repository) UpsertSummary(ctx context.Context, s *pkg.Summary) error {
+	keyPoints, err := json.Marshal(s.KeyPoints)
+	if err != nil {
+		return err
+	}
+	structured, err := json.Marshal(s.Structured)
+	if err != nil {
+		return err
+	}
+	questions, err := json.Marshal(s.Questions)
+	if err != nil {
+		return err
+	}
+	if s.Questions == nil {
+		questions = []byte("[]")
+	}
+	var durationValue *int
+	var durationUnit *string
+	if s.Duration != nil {
+		durationValue, durationUnit = &s.Duration.Value, &s.Duration.Unit
+	}
+	var embedding *string
+	if len(s.Embedding) > 0 {
+		b, err := json.Marshal(s.Embedding)
+		if err != nil {
+			return err
+		}
+		e := string(b)
+		embedding = &e
+	}
+	attempt := pkg.SummaryAttempt{Status: pkg.AttemptOK}
+	if s.LastAttempt != nil {
+		attempt = *s.LastAttempt
+	}
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO summaries (session_id, key_points, structured, free_text, transcript_hash, priority,
+                                pain_score, pain_score_clamped, duration_value, duration_unit, embedding, questions,
+                                attempt_status, attempt_error, attempted_at, model, schema_version, updated_at)
+         VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10, $11, $12,
+                 $13, NULLIF($14, ''), `+r.Dialect.now()+`, NULLIF($15, ''), $16, `+r.Dialect.now()+`)
+         ON CONFLICT (session_id) DO UPDATE
+         SET key_points         = EXCLUDED.key_points,
+             structured         = EXCLUDED.structured,
+             free_text          = EXCLUDED.free_text,
+             transcript_hash    = EXCLUDED.transcript_hash,
+             priority           = EXCLUDED.priority,
+             pain_score         = EXCLUDED.pain_score,
+             pain_score_clamped = EXCLUDED.pain_score_clamped,
+             duration_value     = EXCLUDED.duration_value,
+             duration_unit      = EXCLUDED.duration_unit,
+             embedding          = EXCLUDED.embedding,
+             questions          = EXCLUDED.questions,
+             attempt_status     = EXCLUDED.attempt_status,
+             attempt_error      = EXCLUDED.attempt_error,
+             attempted_at       = EXCLUDED.attempted_at,
+             model              = EXCLUDED.model,
+             schema_version     = EXCLUDED.schema_version,
+             pending_hash       = NULL,
+             pending_at         = NULL,
+             updated_at         = EXCLUDED.updated_at
+         WHERE EXCLUDED.transcript_hash IS NULL
+            OR summaries.pending_hash = EXCLUDED.transcript_hash
+         RETURNING id, updated_at`,
+		s.SessionID, keyPoints, structured, s.FreeText, s.TranscriptHash, s.Priority,
+		s.PainScore, s.PainScoreClamped, durationValue, durationUnit, embedding, questions,
+		attempt.Status, attempt.Error, s.Model, s.SchemaVersion,
+	).Scan(&s.ID, &s.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	attempt.At = s.UpdatedAt
+	s.LastAttempt = &attempt
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := r.recordEvent(ctx, tx, pkg.EventSummaryUpdated, s.SessionID, payload); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimSummary atomically checks whether the session's summary needs to be
+// regenerated for the transcript with the given hash and, if so, claims the
+// regeneration.  It returns false when the stored summary already matches
+// the hash or another worker is regenerating it, unless force is set.
+func (r *Repository) ClaimSummary(ctx context.Context, sessionID, hash string, force bool) (bool, error) {
+	var id int64
+	err := r.DB.QueryRowContext(ctx,
+		`INSERT INTO summaries (session_id, pending_hash, pending_at)
+         VALUES ($1, $2, `+r.Dialect.now()+`)
+         ON CONFLICT (session_id) DO UPDATE
+         SET pending_hash = EXCLUDED.pending_hash,
+             pending_at   = EXCLUDED.pending_at
+         WHERE $3
+            OR (summaries.transcript_hash IS DISTINCT FROM EXCLUDED.pending_hash
+                AND (summaries.pending_hash IS DISTINCT FROM EXCLUDED.pending_hash
+                     OR summaries.pending_at < `+r.Dialect.ago(summaryClaimTimeout)+`))
+         RETURNING id`,
+		sessionID, hash, force,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseSummaryClaim drops a claim taken with ClaimSummary after the
+// regeneration failed, so the next attempt does not have to wait for the
+// claim to time out.
+func (r *Repository) ReleaseSummaryClaim(ctx context.Context, sessionID, hash string) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE summaries SET pending_hash = NULL, pending_at = NULL
+         WHERE session_id = $1 AND pending_hash = $2`, sessionID, hash)
+	return err
+}
+
+// RecordSummaryFailure records that the latest attempt to regenerate the
+// session's summary failed with the given class of error, keeping the
+// summary itself.
+func (r *Repository) RecordSummaryFailure(ctx context.Context, sessionID, errorClass string) error {
+	_, err := r.DB.ExecContext(ctx,
+		`INSERT INTO summaries (session_id, attempt_status, attempt_error, attempted_at)
+         VALUES ($1, $2, $3, `+r.Dialect.now()+`)
+         ON CONFLICT (session_id) DO UPDATE
+         SET attempt_status = EXCLUDED.attempt_status,
+             attempt_error  = EXCLUDED.attempt_error,
+             attempted_at   = EXCLUDED.attempted_at`,
+		sessionID, pkg.AttemptFailed, errorClass)
+	return err
+}
+
+// GetSummary returns the stored summary for a session.  It returns
+// ErrNotFound when the session has not been summarised yet.
+func (r *Repository) GetSummary(ctx context.Context, sessionID string) (*pkg.Summary, error) {
+	var s pkg.Summary
+	var keyPoints, structured, questions []byte
+	var freeText, hash, durationUnit, attemptStatus, attemptError, model *string
+	var durationValue *int
+	var attemptedAt *time.Time
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT id, session_id, key_points, structured, free_text, transcript_hash, priority,
+                pain_score, pain_score_clamped, duration_value, duration_unit, questions, updated_at,
+                attempt_status, attempt_error, attempted_at, model, schema_version
+         FROM summaries
+         WHERE session_id = $1`, sessionID,
+	).Scan(&s.ID, &s.SessionID, &keyPoints, &structured, &freeText, &hash, &s.Priority,
+		&s.PainScore, &s.PainScoreClamped, &durationValue, &durationUnit, &questions, &s.UpdatedAt,
+		&attemptStatus, &attemptError, &attemptedAt, &model, &s.SchemaVersion)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if attemptStatus != nil {
+		s.LastAttempt = &pkg.SummaryAttempt{Status: *attemptStatus}
+		if attemptError != nil {
+			s.LastAttempt.Error = *attemptError
+		}
+		if attemptedAt != nil {
+			s.LastAttempt.At = *attemptedAt
+		}
+	}
+	if err := json.Unmarshal(keyPoints, &s.KeyPoints); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(structured, &s.Structured); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(questions, &s.Questions); err != nil {
+		return nil, err
+	}
+	if freeText != nil {
+		s.FreeText = *freeText
+	}
+	if hash != nil {
+		s.TranscriptHash = *hash
+	}
+	if model != nil {
+		s.Model = *model
+	}
+	s.Duration = duration(durationValue, durationUnit)
+	return &s, nil
+}
+
+// ListPastSummaries returns the summaries of the patient's other sessions,
+// most recent session first, with their embeddings when stored.
+func (r *Repository) ListPastSummaries(ctx context.Context, nationalID, excludeSessionID string, limit int) ([]pkg.Summary, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT su.id, su.session_id, su.key_points, su.free_text, su.embedding, su.updated_at
+         FROM summaries su
+         JOIN sessions s ON s.id = su.session_id
+         WHERE COALESCE(s.patient_national_id_hmac, s.patient_national_id) = $1
+           AND s.id <> $2
+           AND su.free_text IS NOT NULL
+         ORDER BY s.created_at DESC
+         LIMIT $3`, r.lookupKey(nationalID), excludeSessionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Summary
+	for rows.Next() {
+		var s pkg.Summary
+		var keyPoints []byte
+		var embedding *string
+		if err := rows.Scan(&s.ID, &s.SessionID, &keyPoints, &s.FreeText, &embedding, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(keyPoints, &s.KeyPoints); err != nil {
+			return nil, err
+		}
+		if embedding != nil {
+			if err := json.Unmarshal([]byte(*embedding), &s.Embedding); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// summarySettle is how old a summary update must be before ListSummaries
+// returns it.  Updates committed out of order within it (the timestamp is
+// taken when the transaction starts) can then not land behind a cursor
+// that was already handed out.
+const summarySettle = "5 seconds"
+
+// defaultSummaryLimit and maxSummaryLimit bound ListSummaries pages.
+const (
+	defaultSummaryLimit = 100
+	maxSummaryLimit     = 500
+)
+
+// ListSummaries returns summaries with their session metadata in
+// (updated_at, id) order, starting after the filter's cursor.  A summary
+// updated while a client pages through the list moves past the cursor and
+// is returned again on a later page, so a client that pages to the end sees
+// every change at least once.
+func (r *Repository) ListSummaries(ctx context.Context, f pkg.SummaryFilter) ([]pkg.SessionSummary, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultSummaryLimit
+	}
+	if limit > maxSummaryLimit {
+		limit = maxSummaryLimit
+	}
+	conds := []string{"su.free_text IS NOT NULL", "su.updated_at < " + r.Dialect.ago(summarySettle)}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, "su.updated_at >= "+arg(r.Dialect.timeArg(f.From)))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, "su.updated_at < "+arg(r.Dialect.timeArg(f.To)))
+	}
+	if f.NationalID != "" {
+		conds = append(conds, "COALESCE(s.patient_national_id_hmac, s.patient_national_id) = "+arg(r.lookupKey(f.NationalID)))
+	}
+	if !f.AfterUpdatedAt.IsZero() {
+		after := arg(r.Dialect.timeArg(f.AfterUpdatedAt))
+		conds = append(conds, "(su.updated_at > "+after+" OR (su.updated_at = "+after+" AND su.id > "+arg(f.AfterID)+"))")
+	}
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT su.id, su.session_id, su.key_points, su.structured, su.free_text, su.priority,
+                su.pain_score, su.pain_score_clamped, su.duration_value, su.duration_unit, su.questions, su.updated_at,
+                su.model, su.schema_version,
+                s.created_at, s.closed_at, s.status, s.prompt_profile, s.escalated_at, s.escalation_reason
+         FROM summaries su
+         JOIN sessions s ON s.id = su.session_id
+         WHERE `+strings.Join(conds, " AND ")+`
+         ORDER BY su.updated_at, su.id
+         LIMIT `+arg(limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.SessionSummary
+	for rows.Next() {
+		var s pkg.SessionSummary
+		var keyPoints, structured, questions []byte
+		var durationUnit, model *string
+		var durationValue *int
+		if err := rows.Scan(&s.ID, &s.SessionID, &keyPoints, &structured, &s.FreeText, &s.Priority,
+			&s.PainScore, &s.PainScoreClamped, &durationValue, &durationUnit, &questions, &s.UpdatedAt,
+			&model, &s.SchemaVersion,
+			&s.SessionCreatedAt, &s.SessionClosedAt, &s.Status, &s.PromptProfile, &s.EscalatedAt, &s.EscalationReason); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(keyPoints, &s.KeyPoints); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(structured, &s.Structured); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(questions, &s.Questions); err != nil {
+			return nil, err
+		}
+		if model != nil {
+			s.Model = *model
+		}
+		s.Duration = duration(durationValue, durationUnit)
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// duration builds a Duration from its nullable columns.
+func duration(value *int, unit *string) *pkg.Duration {
+	if value == nil || unit == nil {
+		return nil
+	}
+	return &pkg.Duration{Value: *value, Unit: *unit}
+}
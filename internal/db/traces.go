@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// InsertLLMTrace stores a traced model call.
+func (r *Repository) InsertLLMTrace(ctx context.Context, t *pkg.LLMTrace) error {
+	messages, err := json.Marshal(t.Messages)
+	if err != nil {
+		return err
+	}
+	_, err = r.DB.ExecContext(ctx,
+		`INSERT INTO llm_traces (session_id, kind, model, messages, response, error, latency_ms)
+         VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		t.SessionID, t.Call, t.Model, string(messages), t.Response, t.Error, t.LatencyMS)
+	return err
+}
+
+// ListLLMTraces returns the traced model calls of a session, oldest first.
+func (r *Repository) ListLLMTraces(ctx context.Context, sessionID string) ([]pkg.LLMTrace, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, session_id, kind, model, messages, response, error, latency_ms, created_at
+         FROM llm_traces
+         WHERE session_id = $1
+         ORDER BY created_at, id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var traces []pkg.LLMTrace
+	for rows.Next() {
+		var t pkg.LLMTrace
+		var messages []byte
+		if err := rows.Scan(&t.ID, &t.SessionID, &t.Call, &t.Model, &messages, &t.Response, &t.Error, &t.LatencyMS, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(messages, &t.Messages); err != nil {
+			return nil, err
+		}
+		traces = append(traces, t)
+	}
+	return traces, rows.Err()
+}
+
+// DeleteLLMTracesBefore removes the traces recorded before the given time.
+func (r *Repository) DeleteLLMTracesBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.DB.ExecContext(ctx,
+		`DELETE FROM llm_traces WHERE created_at < $1`, r.Dialect.timeArg(before))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
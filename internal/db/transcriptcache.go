@@ -0,0 +1,133 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// TranscriptCache keeps the transcripts of the most recently used sessions
+// in memory for GetSessionTranscript, which every patient message reads
+// again.  Messages this process stores are appended to the cached
+// transcript; messages stored by other instances are only picked up once
+// an entry is older than the TTL, which bounds how stale a transcript can
+// be when several servers share the database.
+type TranscriptCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // of *cachedTranscript, most recently used first
+	entries map[string]*list.Element
+	// epoch counts writes, so that a transcript loaded while a message
+	// was being stored is not cached without it.
+	epoch uint64
+	now   func() time.Time
+}
+
+type cachedTranscript struct {
+	sessionID string
+	messages  []pkg.Message
+	loaded    time.Time
+}
+
+// NewTranscriptCache returns a cache holding up to size transcripts, each
+// for at most ttl.
+func NewTranscriptCache(size int, ttl time.Duration) *TranscriptCache {
+	return &TranscriptCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// get returns a copy of the cached transcript of a session.  On a miss it
+// returns the epoch to pass to put once the transcript is loaded.  A nil
+// cache always misses.
+func (c *TranscriptCache) get(sessionID string) ([]pkg.Message, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[sessionID]
+	if !ok {
+		return nil, c.epoch, false
+	}
+	t := e.Value.(*cachedTranscript)
+	if c.now().Sub(t.loaded) >= c.ttl {
+		c.remove(e)
+		return nil, c.epoch, false
+	}
+	c.order.MoveToFront(e)
+	return append([]pkg.Message(nil), t.messages...), 0, true
+}
+
+// put caches a transcript loaded from the database, unless a message was
+// stored or a session changed since get returned epoch.
+func (c *TranscriptCache) put(sessionID string, messages []pkg.Message, epoch uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if e, ok := c.entries[sessionID]; ok {
+		c.remove(e)
+	}
+	t := &cachedTranscript{sessionID: sessionID, messages: append([]pkg.Message(nil), messages...), loaded: c.now()}
+	c.entries[sessionID] = c.order.PushFront(t)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// add appends newly stored messages to the cached transcripts of their
+// sessions.  A message whose seq does not follow the last cached one's
+// drops the session's transcript instead, to be reloaded in order: a
+// message was stored in between, by another instance or redacted since.
+func (c *TranscriptCache) add(messages ...*pkg.Message) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, m := range messages {
+		e, ok := c.entries[m.SessionID]
+		if !ok {
+			continue
+		}
+		t := e.Value.(*cachedTranscript)
+		if n := len(t.messages); n > 0 && m.Seq != t.messages[n-1].Seq+1 {
+			c.remove(e)
+			continue
+		}
+		t.messages = append(t.messages, *m)
+	}
+}
+
+// invalidate drops the cached transcript of a session.
+func (c *TranscriptCache) invalidate(sessionID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	if e, ok := c.entries[sessionID]; ok {
+		c.remove(e)
+	}
+}
+
+// remove drops an entry.  c.mu must be held.
+func (c *TranscriptCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cachedTranscript).sessionID)
+}
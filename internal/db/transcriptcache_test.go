@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// messages returns messages of a session with consecutive seqs from 1.
+func messages(sessionID string, n int) []pkg.Message {
+	ms := make([]pkg.Message, n)
+	for i := range ms {
+		ms[i] = pkg.Message{ID: int64(i + 1), SessionID: sessionID, Seq: i + 1}
+	}
+	return ms
+}
+
+func TestTranscriptCache(t *testing.T) {
+	now := time.Now()
+	c := NewTranscriptCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	cache := func(sessionID string, n int) {
+		t.Helper()
+		if _, epoch, ok := c.get(sessionID); !ok {
+			c.put(sessionID, messages(sessionID, n), epoch)
+		}
+	}
+	cached := func(sessionID string) int {
+		t.Helper()
+		ms, _, ok := c.get(sessionID)
+		if !ok {
+			return -1
+		}
+		return len(ms)
+	}
+
+	cache("a", 2)
+	cache("b", 1)
+	if cached("a") != 2 {
+		t.Fatal("transcript not cached")
+	}
+	// "b" is the least recently used and makes way for "c".
+	cache("c", 1)
+	if cached("b") != -1 || cached("a") != 2 || cached("c") != 1 {
+		t.Errorf("least recently used transcript kept")
+	}
+
+	// Stored messages are appended in order; a gap drops the transcript.
+	c.add(&pkg.Message{SessionID: "a", Seq: 3}, &pkg.Message{SessionID: "elsewhere", Seq: 9})
+	if cached("a") != 3 {
+		t.Errorf("stored message not appended")
+	}
+	c.add(&pkg.Message{SessionID: "a", Seq: 5})
+	if cached("a") != -1 {
+		t.Errorf("transcript kept across a gap in seq")
+	}
+
+	// A transcript loaded while a message was stored is not cached.
+	_, epoch, _ := c.get("a")
+	c.add(&pkg.Message{SessionID: "c", Seq: 2})
+	c.put("a", messages("a", 4), epoch)
+	if cached("a") != -1 {
+		t.Errorf("transcript cached across a write")
+	}
+
+	c.invalidate("c")
+	if cached("c") != -1 {
+		t.Errorf("invalidated transcript kept")
+	}
+
+	cache("d", 1)
+	now = now.Add(time.Minute)
+	if cached("d") != -1 {
+		t.Errorf("transcript kept past the TTL")
+	}
+
+	// Callers get copies.
+	cache("e", 1)
+	ms, _, _ := c.get("e")
+	ms[0].Content = "changed"
+	if again, _, _ := c.get("e"); again[0].Content != "" {
+		t.Errorf("cached transcript changed through a returned copy")
+	}
+
+	var none *TranscriptCache
+	none.put("a", messages("a", 1), 0)
+	none.add(&pkg.Message{SessionID: "a", Seq: 2})
+	none.invalidate("a")
+	if _, _, ok := none.get("a"); ok {
+		t.Errorf("nil cache hit")
+	}
+}
+
+func TestRepositoryTranscriptCache(t *testing.T) {
+	r, counts := newCountingRepo(t)
+	r.Transcripts = NewTranscriptCache(10, time.Minute)
+	ctx := context.Background()
+	id := newTestSession(t, r, "0012345678")
+	sessionID := id.String()
+	read := func() ([]pkg.Message, int) {
+		t.Helper()
+		delete(counts, "GetSessionTranscript")
+		transcript, err := r.GetSessionTranscript(ctx, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transcript, counts["GetSessionTranscript"]
+	}
+
+	if _, _, err := r.CreateMessagePair(ctx, id, nil, "سلام", "سلام"); err != nil {
+		t.Fatal(err)
+	}
+	if _, queries := read(); queries == 0 {
+		t.Fatal("first read not from the database")
+	}
+	if transcript, queries := read(); queries != 0 || len(transcript) != 2 {
+		t.Errorf("second read: %d messages in %d queries, want 2 from the cache", len(transcript), queries)
+	}
+
+	// Stored messages are read from the cache as the database has them.
+	p, _, err := r.CreateMessagePair(ctx, id, nil, "سردرد دارم", "از کی؟")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript, queries := read()
+	r.Transcripts = nil
+	stored, _ := read()
+	r.Transcripts = NewTranscriptCache(10, time.Minute)
+	if queries != 0 || len(transcript) != len(stored) || transcript[2].ID != stored[2].ID || transcript[3].Content != stored[3].Content {
+		t.Errorf("cached transcript %+v in %d queries, stored %+v", transcript, queries, stored)
+	}
+
+	// Redactions and reassignment drop the cached transcript.
+	read()
+	if err := r.RedactMessage(ctx, sessionID, p.ID, "dr"); err != nil {
+		t.Fatal(err)
+	}
+	if transcript, queries := read(); queries == 0 || len(transcript) != 3 {
+		t.Errorf("after a redaction: %d messages in %d queries, want 3 from the database", len(transcript), queries)
+	}
+	if err := r.ReassignSession(ctx, sessionID, "0098765432", "Sara", "09120000000", pkg.AuditEntry{Actor: "admin", Action: "session.reassign"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, queries := read(); queries == 0 {
+		t.Error("transcript of a reassigned session read from the cache")
+	}
+}
+
+func BenchmarkSessionTranscript(b *testing.B) {
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			r, counts := newCountingRepo(b)
+			if cached {
+				r.Transcripts = NewTranscriptCache(100, time.Minute)
+			}
+			ctx := context.Background()
+			id := newTestSession(b, r, "0012345678")
+			for i := 0; i < 20; i++ {
+				if _, _, err := r.CreateMessagePair(ctx, id, nil, "پیام", "پاسخ"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			delete(counts, "GetSessionTranscript")
+			b.ResetTimer()
+			// Each patient message reads the transcript and stores a pair.
+			for i := 0; i < b.N; i++ {
+				if _, err := r.GetSessionTranscript(ctx, id.String()); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := r.CreateMessagePair(ctx, id, nil, "پیام", "پاسخ"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(counts["GetSessionTranscript"])/float64(b.N), "queries/op")
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrVerificationClosed is returned by CheckPhoneVerification for a
+// verification that expired, ran out of attempts or was used already.
+var ErrVerificationClosed = errs.New(errs.Invalid, "verification expired or used")
+
+// ErrWrongCode is returned by CheckPhoneVerification for a code that does
+// not match.
+var ErrWrongCode = errs.New(errs.Invalid, "wrong verification code")
+
+// codeHash hashes a verification code with the verification's ID, so equal
+// codes of different verifications hash differently.
+func codeHash(id, code string) string {
+	h := sha256.Sum256([]byte(id + ":" + code))
+	return hex.EncodeToString(h[:])
+}
+
+// CreatePhoneVerification stores a start form waiting for code to be
+// entered before ttl passes, setting its ID and ExpiresAt.
+func (r *Repository) CreatePhoneVerification(ctx context.Context, v *pkg.PhoneVerification, code string, ttl time.Duration) error {
+	encID, encPhone, encName, err := r.encryptUser(&v.User)
+	if err != nil {
+		return err
+	}
+	v.ID = uuid.NewString()
+	v.ExpiresAt = time.Now().Add(ttl)
+	_, err = r.DB.ExecContext(ctx,
+		`INSERT INTO phone_verifications (id, national_id, name, phone, phone_key, clinic_id, profile, locale, client_ip, code_hash, expires_at)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, `+r.Dialect.inet("NULLIF($9, '')")+`, $10, $11)`,
+		v.ID, encID, encName, encPhone, r.lookupKey(v.User.Phone), v.ClinicID, v.Profile, v.Locale,
+		v.User.ClientIP, codeHash(v.ID, code), r.Dialect.timeArg(v.ExpiresAt))
+	return err
+}
+
+// CountPhoneVerificationsSince counts the verifications started since the
+// given time for the phone and from the client IP.
+func (r *Repository) CountPhoneVerificationsSince(ctx context.Context, phone, ip string, since time.Time) (byPhone, byIP int, err error) {
+	err = r.DB.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(CASE WHEN phone_key = $1 THEN 1 ELSE 0 END), 0),
+                COALESCE(SUM(CASE WHEN client_ip = `+r.Dialect.inet("NULLIF($2, '')")+` THEN 1 ELSE 0 END), 0)
+         FROM phone_verifications
+         WHERE (phone_key = $1 OR client_ip = `+r.Dialect.inet("NULLIF($2, '')")+`) AND created_at >= $3`,
+		r.lookupKey(phone), ip, r.Dialect.timeArg(since),
+	).Scan(&byPhone, &byIP)
+	return byPhone, byIP, err
+}
+
+// CheckPhoneVerification counts an attempt at entering code for the
+// verification and returns its start form when the code matches, marking
+// it used.  A verification takes at most maxAttempts attempts, the right
+// one included; after that, once expired or once used it yields
+// ErrVerificationClosed.  A wrong code yields ErrWrongCode.
+func (r *Repository) CheckPhoneVerification(ctx context.Context, id, code string, maxAttempts int) (*pkg.PhoneVerification, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrVerificationClosed
+	}
+	// Counting the attempt and reading the hash in one statement keeps
+	// concurrent guesses within maxAttempts.
+	v := pkg.PhoneVerification{ID: id}
+	var hash string
+	var ip *string
+	err := r.DB.QueryRowContext(ctx,
+		`UPDATE phone_verifications SET attempts = attempts + 1
+         WHERE id = $1 AND verified_at IS NULL AND attempts < $2 AND expires_at > $3
+         RETURNING national_id, name, phone, clinic_id, profile, locale, `+r.Dialect.host("client_ip")+`, code_hash, expires_at`,
+		id, maxAttempts, r.Dialect.timeArg(time.Now()),
+	).Scan(&v.User.NationalID, &v.User.Name, &v.User.Phone, &v.ClinicID, &v.Profile, &v.Locale,
+		&ip, &hash, &v.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrVerificationClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash(id, code))) != 1 {
+		return nil, ErrWrongCode
+	}
+	res, err := r.DB.ExecContext(ctx,
+		`UPDATE phone_verifications SET verified_at = `+r.Dialect.now()+`
+         WHERE id = $1 AND verified_at IS NULL`, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrVerificationClosed
+	}
+	if ip != nil {
+		v.User.ClientIP = *ip
+	}
+	for _, f := range []*string{&v.User.NationalID, &v.User.Name, &v.User.Phone} {
+		if err := r.PII.DecryptPtr(f); err != nil {
+			return nil, err
+		}
+	}
+	return &v, nil
+}
+
+// DeletePhoneVerificationsBefore removes the verifications started before
+// the given time, which no longer count against the limits.
+func (r *Repository) DeletePhoneVerificationsBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.DB.ExecContext(ctx,
+		`DELETE FROM phone_verifications WHERE created_at < $1`, r.Dialect.timeArg(before))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
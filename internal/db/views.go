@@ -0,0 +1,26 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MarkSessionViewed records that a doctor is viewing a session now and
+// returns when the doctor viewed it before, or the zero time the first
+// time.
+func (r *Repository) MarkSessionViewed(ctx context.Context, sessionID, doctor string) (time.Time, error) {
+	var last time.Time
+	err := r.DB.QueryRowContext(ctx,
+		`SELECT last_viewed_at FROM session_views WHERE session_id = $1 AND doctor = $2`,
+		sessionID, doctor).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	_, err = r.DB.ExecContext(ctx,
+		`INSERT INTO session_views (session_id, doctor) VALUES ($1, $2)
+         ON CONFLICT (session_id, doctor) DO UPDATE SET last_viewed_at = `+r.Dialect.now(),
+		sessionID, doctor)
+	return last, err
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// CreateWebhook registers an outbound webhook endpoint.
+func (r *Repository) CreateWebhook(ctx context.Context, w *pkg.Webhook) error {
+	return r.DB.QueryRowContext(ctx,
+		`INSERT INTO webhooks (url, secret) VALUES ($1, $2)
+         RETURNING id, created_at`, w.URL, w.Secret,
+	).Scan(&w.ID, &w.CreatedAt)
+}
+
+// ListWebhooks returns all webhook endpoints, including their secrets.
+func (r *Repository) ListWebhooks(ctx context.Context) ([]pkg.Webhook, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT id, url, secret, created_at FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.Webhook
+	for rows.Next() {
+		var w pkg.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// DeleteWebhook removes a webhook endpoint and its deliveries.  It returns
+// ErrNotFound when no such webhook exists.
+func (r *Repository) DeleteWebhook(ctx context.Context, id int64) error {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// EnqueueWebhookEvent queues the event for delivery to every registered
+// webhook and returns the number of deliveries queued.
+func (r *Repository) EnqueueWebhookEvent(ctx context.Context, event string, payload []byte) (int64, error) {
+	res, err := r.DB.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (webhook_id, event, payload)
+         SELECT id, $1, $2 FROM webhooks`, event, string(payload))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// webhookDeliveryColumns lists the columns scanned by scanWebhookDelivery.
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts,
+       COALESCE(last_error, ''), COALESCE(response_status, 0), next_attempt_at, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (pkg.WebhookDelivery, error) {
+	var d pkg.WebhookDelivery
+	var payload []byte
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts,
+		&d.LastError, &d.ResponseStatus, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt)
+	d.Payload = payload
+	return d, err
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is due and postpones them by lease, so other dispatchers skip them
+// while this one is sending.
+func (r *Repository) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`UPDATE webhook_deliveries
+         SET next_attempt_at = `+r.Dialect.later(seconds(lease))+`
+         WHERE id IN (SELECT id FROM webhook_deliveries
+                      WHERE status = 'pending' AND next_attempt_at <= `+r.Dialect.now()+`
+                      ORDER BY next_attempt_at
+                      LIMIT $1`+r.Dialect.skipLocked()+`)
+         RETURNING `+webhookDeliveryColumns, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// RecordWebhookAttempt stores the outcome of a delivery attempt.  A pending
+// delivery is retried after retryIn.
+func (r *Repository) RecordWebhookAttempt(ctx context.Context, d *pkg.WebhookDelivery, retryIn time.Duration) error {
+	_, err := r.DB.ExecContext(ctx,
+		`UPDATE webhook_deliveries
+         SET status = $1, attempts = $2, last_error = NULLIF($3, ''),
+             response_status = NULLIF($4, 0),
+             next_attempt_at = `+r.Dialect.later(seconds(retryIn))+`,
+             delivered_at = CASE WHEN $1 = 'delivered' THEN `+r.Dialect.now()+` END
+         WHERE id = $5`,
+		d.Status, d.Attempts, d.LastError, d.ResponseStatus, d.ID)
+	return err
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a webhook.
+func (r *Repository) ListWebhookDeliveries(ctx context.Context, webhookID int64, limit int) ([]pkg.WebhookDelivery, error) {
+	rows, err := r.DB.QueryContext(ctx,
+		`SELECT `+webhookDeliveryColumns+`
+         FROM webhook_deliveries
+         WHERE webhook_id = $1
+         ORDER BY created_at DESC, id DESC
+         LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []pkg.WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// seconds formats d as an interval for Dialect.ago and Dialect.later.
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d/time.Second))
+}
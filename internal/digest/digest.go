@@ -0,0 +1,90 @@
+// Package digest sends the clinic a weekly digest of the sessions closed in
+// the previous week.  A Job builds the digest every Monday morning and hands
+// it to a Sink (email or webhook), retrying failed deliveries with backoff.
+package digest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// redFlagPriority is the triage priority of sessions with red flags (see
+// core.PriorityRedFlag).
+const redFlagPriority = 3
+
+// Store loads the sessions a digest reports on.
+type Store interface {
+	ListClosedSessions(ctx context.Context, from, to time.Time) ([]pkg.ClosedSession, error)
+}
+
+// Digest summarises the sessions closed in [From, To).
+type Digest struct {
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Total     int            `json:"total"`
+	Escalated int            `json:"escalated"`
+	RedFlags  []SessionEntry `json:"red_flags"`
+}
+
+// SessionEntry is a session listed in the digest with a link to its detail
+// page on the doctor dashboard.
+type SessionEntry struct {
+	pkg.ClosedSession
+	URL string `json:"url"`
+}
+
+// Build collects the digest for [from, to).  baseURL is the public address
+// of the server used for links, e.g. "https://clinic.example.com".
+func Build(ctx context.Context, store Store, from, to time.Time, baseURL string) (*Digest, error) {
+	sessions, err := store.ListClosedSessions(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	d := &Digest{From: from, To: to, Total: len(sessions)}
+	for _, s := range sessions {
+		if s.Escalated {
+			d.Escalated++
+		}
+		if s.Escalated || s.Priority >= redFlagPriority {
+			d.RedFlags = append(d.RedFlags, SessionEntry{
+				ClosedSession: s,
+				URL:           strings.TrimRight(baseURL, "/") + "/doctor/sessions/" + s.SessionID,
+			})
+		}
+	}
+	return d, nil
+}
+
+// Subject returns the subject line used for the digest email.
+func (d *Digest) Subject() string {
+	return fmt.Sprintf("گزارش هفتگی نوبت‌ها %s تا %s", d.From.Format("2006-01-02"), d.To.AddDate(0, 0, -1).Format("2006-01-02"))
+}
+
+// Text renders the digest as plain text.
+func (d *Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", d.Subject())
+	fmt.Fprintf(&b, "تعداد نوبت‌های بسته‌شده: %d\n", d.Total)
+	fmt.Fprintf(&b, "نوبت‌های ارجاع فوری: %d\n", d.Escalated)
+	fmt.Fprintf(&b, "نوبت‌های دارای علائم هشدار: %d\n", len(d.RedFlags))
+	for _, s := range d.RedFlags {
+		b.WriteString("\n- ")
+		if s.PatientName != "" {
+			b.WriteString(s.PatientName + " — ")
+		}
+		b.WriteString(s.ClosedAt.Format("2006-01-02 15:04"))
+		if s.EscalationReason != "" {
+			b.WriteString(" (" + s.EscalationReason + ")")
+		}
+		b.WriteString("\n  " + s.URL)
+		for _, kp := range s.KeyPoints {
+			b.WriteString("\n  • " + kp)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -0,0 +1,122 @@
+package digest
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job sends the digest of the previous week every Monday at Hour (local
+// time).
+type Job struct {
+	Store   Store
+	Sink    Sink
+	BaseURL string
+	// Hour is the local hour on Monday at which the digest is sent.
+	Hour int
+	// Attempts bounds delivery attempts per digest; Backoff is the delay
+	// before the first retry and doubles after each failure.
+	Attempts int
+	Backoff  time.Duration
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Status reports the outcome of the most recent delivery.
+type Status struct {
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextRun     time.Time `json:"next_run"`
+}
+
+// NewJob constructs a Job sending at 08:00 with five attempts per digest.
+func NewJob(store Store, sink Sink, baseURL string) *Job {
+	return &Job{Store: store, Sink: sink, BaseURL: baseURL, Hour: 8, Attempts: 5, Backoff: time.Minute}
+}
+
+// Status returns the delivery status.
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Run sends a digest every Monday until ctx is cancelled.
+func (j *Job) Run(ctx context.Context) {
+	for {
+		next := nextRun(time.Now(), j.Hour)
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// The digest covers the seven days up to midnight this Monday.
+		to := time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, next.Location())
+		if err := j.Send(ctx, to.AddDate(0, 0, -7), to); err != nil {
+			log.Printf("digest: giving up: %v", err)
+		}
+	}
+}
+
+// Send builds and delivers the digest for [from, to), retrying with
+// exponential backoff.
+func (j *Job) Send(ctx context.Context, from, to time.Time) error {
+	backoff := j.Backoff
+	var err error
+	for attempt := 1; attempt <= j.Attempts; attempt++ {
+		var d *Digest
+		d, err = Build(ctx, j.Store, from, to, j.BaseURL)
+		if err == nil {
+			err = j.Sink.Send(ctx, d)
+		}
+		j.record(attempt, err)
+		if err == nil {
+			log.Printf("digest: sent %d sessions for %s", d.Total, from.Format("2006-01-02"))
+			return nil
+		}
+		log.Printf("digest: attempt %d failed: %v", attempt, err)
+		if attempt == j.Attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+func (j *Job) record(attempt int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.status.LastAttempt = now
+	j.status.Attempts = attempt
+	if err != nil {
+		j.status.LastError = err.Error()
+		return
+	}
+	j.status.LastSuccess = now
+	j.status.LastError = ""
+}
+
+// nextRun returns the next Monday at hour:00 strictly after now.
+func nextRun(now time.Time, hour int) time.Time {
+	days := (int(time.Monday) - int(now.Weekday()) + 7) % 7
+	next := time.Date(now.Year(), now.Month(), now.Day()+days, hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
@@ -0,0 +1,84 @@
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Sink delivers a digest to the clinic.
+type Sink interface {
+	Send(ctx context.Context, d *Digest) error
+}
+
+// SMTPSink emails the digest as plain text.
+type SMTPSink struct {
+	Addr     string // host:port of the SMTP server
+	Username string // optional; enables PLAIN auth
+	Password string
+	From     string
+	To       []string
+}
+
+// Send implements Sink.
+func (s *SMTPSink) Send(ctx context.Context, d *Digest) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", d.Subject()))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(d.Text(), "\n", "\r\n"))
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, msg.Bytes())
+}
+
+// WebhookSink POSTs the digest as JSON, with the rendered text under "text".
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements Sink.
+func (s *WebhookSink) Send(ctx context.Context, d *Digest) error {
+	body, err := json.Marshal(struct {
+		*Digest
+		Subject string `json:"subject"`
+		Text    string `json:"text"`
+	}{d, d.Subject(), d.Text()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
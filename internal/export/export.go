@@ -0,0 +1,125 @@
+// Package export marks what the bot wrote in exported transcripts and
+// summaries, so a reader of an export outside the service can tell the
+// bot's words from the patient's and knows which models produced them.
+// Every export format applies the same two steps: Watermark.Mark prefixes
+// the bot's messages with a marker, and Describe collects the generation
+// details each format writes out in its own way.
+package export
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// DefaultMarker prefixes the bot's messages in exports unless another is
+// configured.
+const DefaultMarker = "[bot]"
+
+// Disclaimer states what in an export was machine-generated.
+const Disclaimer = "The bot's messages and the summary in this export were generated by a language model " +
+	"and have not been verified unless a doctor reviewed the session."
+
+// Watermark marks the bot's messages in exports.  An empty Marker leaves
+// them as written.
+type Watermark struct {
+	Marker string
+}
+
+// Content returns the exported content of a message: the bot's prefixed
+// with the marker.  Empty content, as of a redacted message, is left
+// empty.
+func (w Watermark) Content(role pkg.MessageRole, content string) string {
+	if role != pkg.RoleBot || w.Marker == "" || content == "" {
+		return content
+	}
+	return w.Marker + " " + content
+}
+
+// Mark returns a copy of the transcript with the bot's messages marked.
+func (w Watermark) Mark(transcript []pkg.Message) []pkg.Message {
+	out := make([]pkg.Message, len(transcript))
+	for i, m := range transcript {
+		m.Content = w.Content(m.Role, m.Content)
+		out[i] = m
+	}
+	return out
+}
+
+// Generation describes the machine-generated content of an export.  JSON
+// exports embed it as is; other formats write Lines.
+type Generation struct {
+	Disclaimer string `json:"disclaimer"`
+	// Marker is what the bot's messages are prefixed with, empty when
+	// they are not.
+	Marker string `json:"bot_marker,omitempty"`
+	// ReplyModels are the models that wrote the bot's replies, in name
+	// order; FirstReplyAt and LastReplyAt bound when they were written.
+	ReplyModels  []string   `json:"reply_models,omitempty"`
+	FirstReplyAt *time.Time `json:"first_reply_at,omitempty"`
+	LastReplyAt  *time.Time `json:"last_reply_at,omitempty"`
+	// SummaryModel, SummaryGeneratedAt and SummarySchemaVersion describe
+	// the summary, when the export has one (see pkg.Summary).
+	SummaryModel         string     `json:"summary_model,omitempty"`
+	SummaryGeneratedAt   *time.Time `json:"summary_generated_at,omitempty"`
+	SummarySchemaVersion int        `json:"summary_schema_version,omitempty"`
+	ExportedAt           time.Time  `json:"exported_at"`
+}
+
+// Describe collects the generation details of an export of transcript
+// and summary (nil when there is none).  meta is the metadata of the
+// transcript's messages by ID (see pkg.MetaModel); bot replies without a
+// recorded model only count towards the reply times.
+func (w Watermark) Describe(transcript []pkg.Message, meta map[int64]pkg.MessageMetadata, summary *pkg.Summary, exportedAt time.Time) Generation {
+	g := Generation{Disclaimer: Disclaimer, Marker: w.Marker, ExportedAt: exportedAt.UTC()}
+	models := map[string]bool{}
+	for _, m := range transcript {
+		if m.Role != pkg.RoleBot {
+			continue
+		}
+		at := m.CreatedAt.UTC()
+		if g.FirstReplyAt == nil {
+			g.FirstReplyAt = &at
+		}
+		g.LastReplyAt = &at
+		var model string
+		if ok, _ := meta[m.ID].Get(pkg.MetaModel, &model); ok && model != "" && !models[model] {
+			models[model] = true
+			g.ReplyModels = append(g.ReplyModels, model)
+		}
+	}
+	sort.Strings(g.ReplyModels)
+	if summary != nil && !summary.UpdatedAt.IsZero() {
+		at := summary.UpdatedAt.UTC()
+		g.SummaryModel = summary.Model
+		g.SummaryGeneratedAt = &at
+		g.SummarySchemaVersion = summary.SchemaVersion
+	}
+	return g
+}
+
+// Lines renders the generation details as text lines, the disclaimer
+// first, for formats without fields of their own.
+func (g Generation) Lines() []string {
+	lines := []string{g.Disclaimer}
+	if g.Marker != "" {
+		lines = append(lines, fmt.Sprintf("Bot messages are prefixed with %q.", g.Marker))
+	}
+	if len(g.ReplyModels) > 0 {
+		lines = append(lines, "Reply models: "+strings.Join(g.ReplyModels, ", "))
+	}
+	if g.FirstReplyAt != nil {
+		lines = append(lines, "Replies written: "+g.FirstReplyAt.Format(time.RFC3339)+" to "+g.LastReplyAt.Format(time.RFC3339))
+	}
+	if g.SummaryGeneratedAt != nil {
+		line := "Summary generated: " + g.SummaryGeneratedAt.Format(time.RFC3339)
+		if g.SummaryModel != "" {
+			line += " by " + g.SummaryModel
+		}
+		lines = append(lines, line, fmt.Sprintf("Summary schema version: %d", g.SummarySchemaVersion))
+	}
+	return append(lines, "Exported: "+g.ExportedAt.Format(time.RFC3339))
+}
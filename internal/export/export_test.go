@@ -0,0 +1,142 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with the golden file testdata/name, rewriting it
+// instead with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+var start = time.Date(2024, time.March, 10, 8, 0, 0, 0, time.UTC)
+
+// testExport returns the transcript, its metadata and the summary of a
+// session whose replies were written by two models, one of them twice
+// and one reply without a recorded model.
+func testExport(t *testing.T) ([]pkg.Message, map[int64]pkg.MessageMetadata, *pkg.Summary) {
+	t.Helper()
+	transcript := []pkg.Message{
+		{ID: 1, Role: pkg.RoleBot, Content: "سلام، چه مشکلی دارید؟", CreatedAt: start},
+		{ID: 2, Role: pkg.RolePatient, Content: "سردرد دارم", CreatedAt: start.Add(time.Minute)},
+		{ID: 3, Role: pkg.RoleBot, Content: "از کی این درد را دارید؟", CreatedAt: start.Add(2 * time.Minute)},
+		{ID: 4, Role: pkg.RolePatient, Content: "از دیروز", CreatedAt: start.Add(3 * time.Minute)},
+		{ID: 5, Role: pkg.RoleBot, Content: "درد چقدر شدید است؟", CreatedAt: start.Add(4 * time.Minute)},
+		{ID: 6, Role: pkg.RoleBot, Content: "", CreatedAt: start.Add(5 * time.Minute)},
+	}
+	meta := map[int64]pkg.MessageMetadata{}
+	for id, model := range map[int64]string{3: "gpt-fallback", 5: "gpt-main", 6: "gpt-main"} {
+		m := pkg.MessageMetadata{}
+		if err := m.Set(pkg.MetaModel, model); err != nil {
+			t.Fatal(err)
+		}
+		meta[id] = m
+	}
+	summary := &pkg.Summary{UpdatedAt: start.Add(10 * time.Minute), Model: "gpt-summary", SchemaVersion: 1}
+	return transcript, meta, summary
+}
+
+func TestContent(t *testing.T) {
+	w := Watermark{Marker: DefaultMarker}
+	for _, tc := range []struct {
+		w       Watermark
+		role    pkg.MessageRole
+		content string
+		want    string
+	}{
+		{w, pkg.RoleBot, "از کی این درد را دارید؟", "[bot] از کی این درد را دارید؟"},
+		{w, pkg.RolePatient, "سردرد دارم", "سردرد دارم"},
+		{w, pkg.RoleBot, "", ""},
+		{Watermark{Marker: "«ربات»"}, pkg.RoleBot, "سلام", "«ربات» سلام"},
+		{Watermark{}, pkg.RoleBot, "سلام", "سلام"},
+	} {
+		if got := tc.w.Content(tc.role, tc.content); got != tc.want {
+			t.Errorf("marker %q, %s %q: %q, want %q", tc.w.Marker, tc.role, tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestMark(t *testing.T) {
+	transcript, _, _ := testExport(t)
+	marked := Watermark{Marker: DefaultMarker}.Mark(transcript)
+	if len(marked) != len(transcript) {
+		t.Fatalf("%d messages, want %d", len(marked), len(transcript))
+	}
+	for i, m := range marked {
+		if want := (Watermark{Marker: DefaultMarker}).Content(m.Role, transcript[i].Content); m.Content != want || m.ID != transcript[i].ID {
+			t.Errorf("message %d: %q, want %q", m.ID, m.Content, want)
+		}
+	}
+	if strings.HasPrefix(transcript[0].Content, DefaultMarker) {
+		t.Error("Mark changed the transcript it was given")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	transcript, meta, summary := testExport(t)
+	exported := time.Date(2024, time.March, 11, 12, 0, 0, 0, time.FixedZone("IRST", 12600))
+	g := Watermark{Marker: DefaultMarker}.Describe(transcript, meta, summary, exported)
+	if strings.Join(g.ReplyModels, ",") != "gpt-fallback,gpt-main" {
+		t.Errorf("reply models %v, want each model once in name order", g.ReplyModels)
+	}
+	if !g.FirstReplyAt.Equal(start) || !g.LastReplyAt.Equal(start.Add(5*time.Minute)) {
+		t.Errorf("replies %v to %v, want the first and last bot message", g.FirstReplyAt, g.LastReplyAt)
+	}
+	if g.SummaryModel != "gpt-summary" || g.SummarySchemaVersion != 1 || !g.SummaryGeneratedAt.Equal(summary.UpdatedAt) {
+		t.Errorf("summary %q v%d at %v", g.SummaryModel, g.SummarySchemaVersion, g.SummaryGeneratedAt)
+	}
+	if g.ExportedAt.Location() != time.UTC || !g.ExportedAt.Equal(exported) {
+		t.Errorf("exported at %v, want %v in UTC", g.ExportedAt, exported)
+	}
+
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "generation.json", append(data, '\n'))
+	golden(t, "generation.txt", []byte(strings.Join(g.Lines(), "\n")+"\n"))
+}
+
+// TestDescribeWithoutSummary checks the generation details of a session
+// not summarised, with the bot's messages left unmarked.
+func TestDescribeWithoutSummary(t *testing.T) {
+	transcript, _, _ := testExport(t)
+	exported := time.Date(2024, time.March, 11, 8, 30, 0, 0, time.UTC)
+	for _, summary := range []*pkg.Summary{nil, {}} {
+		g := Watermark{}.Describe(transcript[:2], nil, summary, exported)
+		if g.ReplyModels != nil || g.SummaryGeneratedAt != nil || g.SummaryModel != "" || g.FirstReplyAt == nil {
+			t.Errorf("generation %+v, want the reply time only", g)
+		}
+		data, err := json.MarshalIndent(g, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden(t, "generation_unsummarized.json", append(data, '\n'))
+		golden(t, "generation_unsummarized.txt", []byte(strings.Join(g.Lines(), "\n")+"\n"))
+	}
+}
@@ -0,0 +1,500 @@
+// Package fhir exports a session's summary and transcript as a FHIR R4
+// document Bundle for clinic record systems.  All field mappings live in
+// this file; what cannot be mapped onto a resource cleanly is written into
+// the Composition's narrative rather than dropped.
+package fhir
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+// NationalIDSystem is the identifier system of the national IDs on
+// exported Patient resources.
+const NationalIDSystem = "urn:waitroom-chatbot:national-id"
+
+// Author is the display name of the Composition's author: the bot wrote
+// the summary, whether or not a doctor has reviewed it since.
+const Author = "waitroom-chatbot"
+
+// Code systems used by the mappings.
+const (
+	systemLOINC        = "http://loinc.org"
+	systemURI          = "urn:ietf:rfc:3986"
+	systemObsCategory  = "http://terminology.hl7.org/CodeSystem/observation-category"
+	systemAllergyClin  = "http://terminology.hl7.org/CodeSystem/allergyintolerance-clinical"
+	systemAllergyVerif = "http://terminology.hl7.org/CodeSystem/allergyintolerance-verification"
+	systemParticipant  = "http://terminology.hl7.org/CodeSystem/provenance-participant-type"
+)
+
+// SummarySchemaPolicy prefixes the version of the structured summary
+// format in the policy of the Provenance.
+const SummarySchemaPolicy = "urn:waitroom-chatbot:summary-schema:"
+
+// Structured summary fields with a mapping of their own; the others are
+// listed in the narrative.
+const (
+	fieldChiefComplaint = "chief_complaint"
+	fieldMedications    = "medications"
+	fieldAllergies      = "allergies"
+	fieldPainScore      = "pain_score"
+)
+
+// Export maps a session, its summary (nil when it has not been summarised
+// yet) and its transcript onto a document Bundle:
+//
+//   - the session's demographics become the Patient;
+//   - the free text becomes the Composition's narrative, with sections for
+//     the key points, the chief complaint, medications, allergies, pain,
+//     the suggested questions, the details left unmapped and the
+//     transcript;
+//   - each medication becomes a MedicationStatement named by its
+//     canonical name (see core.SummaryMedications) with its dose and
+//     frequency as the dosage; entries without a name, and fields other
+//     than these, are left unmapped;
+//   - each allergy given as text becomes an unconfirmed AllergyIntolerance;
+//   - the pain score becomes an Observation (LOINC 72514-3);
+//   - other structured fields, and the pain score when it is not a 0-10
+//     integer, are left unmapped;
+//   - gen becomes a Provenance of the Composition and the resources
+//     derived from the summary, with the models as its authors and the
+//     disclaimer as its narrative.
+//
+// The transcript is exported as given, so it should already be marked
+// (see export.Watermark).  The Composition is final once a doctor has
+// reviewed the session or it has closed, preliminary before.
+func Export(session *pkg.Session, summary *pkg.Summary, transcript []pkg.Message, gen export.Generation) *Bundle {
+	if summary == nil {
+		summary = &pkg.Summary{}
+	}
+	date := summary.UpdatedAt
+	if date.IsZero() {
+		date = session.CreatedAt
+	}
+	b := &builder{}
+	subject := b.add(patient(session))
+	var sections []Section
+	var unmapped []string
+
+	if len(summary.KeyPoints) > 0 {
+		sections = append(sections, Section{Title: "Key points",
+			Code: loinc("10164-2", "History of Present illness Narrative"),
+			Text: narrative(bullets(summary.KeyPoints))})
+	}
+	if v, ok := summary.Structured[fieldChiefComplaint]; ok && !isEmpty(v) {
+		if s, ok := v.(string); ok {
+			sections = append(sections, Section{Title: "Chief complaint",
+				Code: loinc("10154-3", "Chief complaint Narrative - Reported"),
+				Text: narrative(paragraph(s))})
+		} else {
+			unmapped = append(unmapped, field(fieldChiefComplaint, v))
+		}
+	}
+
+	meds := Section{Title: "Medications", Code: loinc("10160-0", "History of Medication use Narrative")}
+	var medLines []string
+	for _, raw := range entries(summary.Structured[fieldMedications], fieldMedications, &unmapped) {
+		st, extra, ok := medicationStatement(raw, subject)
+		if !ok {
+			unmapped = append(unmapped, field(fieldMedications, raw))
+			continue
+		}
+		unmapped = append(unmapped, extra...)
+		meds.Entry = append(meds.Entry, b.add(st.ID, st))
+		line := st.MedicationCodeableConcept.Text
+		if len(st.Dosage) > 0 {
+			line += " — " + st.Dosage[0].Text
+		}
+		medLines = append(medLines, line)
+	}
+	if len(meds.Entry) > 0 {
+		meds.Text = narrative(bullets(medLines))
+		sections = append(sections, meds)
+	}
+
+	allergies := Section{Title: "Allergies", Code: loinc("48765-2", "Allergies and adverse reactions Document")}
+	var allergyLines []string
+	for _, raw := range entries(summary.Structured[fieldAllergies], fieldAllergies, &unmapped) {
+		s, ok := raw.(string)
+		if !ok || strings.TrimSpace(s) == "" {
+			if !isEmpty(raw) {
+				unmapped = append(unmapped, field(fieldAllergies, raw))
+			}
+			continue
+		}
+		a := allergyIntolerance(strings.TrimSpace(s), subject)
+		allergies.Entry = append(allergies.Entry, b.add(a.ID, a))
+		allergyLines = append(allergyLines, a.Code.Text)
+	}
+	if len(allergies.Entry) > 0 {
+		allergies.Text = narrative(bullets(allergyLines))
+		sections = append(sections, allergies)
+	}
+
+	if summary.PainScore != nil {
+		obs := painObservation(summary, subject, date)
+		sections = append(sections, Section{Title: "Pain",
+			Text:  narrative(paragraph(fmt.Sprintf("Pain score %d/10", *summary.PainScore))),
+			Entry: []Reference{b.add(obs.ID, obs)}})
+	} else if v := summary.Structured[fieldPainScore]; !isEmpty(v) {
+		unmapped = append(unmapped, field(fieldPainScore, v))
+	}
+
+	if len(summary.Questions) > 0 {
+		sections = append(sections, Section{Title: "Suggested questions", Text: narrative(bullets(summary.Questions))})
+	}
+	keys := make([]string, 0, len(summary.Structured))
+	for k := range summary.Structured {
+		switch k {
+		case fieldChiefComplaint, fieldMedications, fieldAllergies, fieldPainScore:
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := summary.Structured[k]; !isEmpty(v) {
+			unmapped = append(unmapped, field(k, v))
+		}
+	}
+	if len(unmapped) > 0 {
+		sections = append(sections, Section{Title: "Other details", Text: narrative(bullets(unmapped))})
+	}
+	if len(transcript) > 0 {
+		sections = append(sections, Section{Title: "Transcript", Text: narrative(transcriptList(transcript))})
+	}
+
+	comp := Composition{
+		ResourceType: "Composition",
+		ID:           uuid.NewString(),
+		Status:       compositionStatus(session.Status),
+		Type:         *loinc("51855-5", "Patient Note"),
+		Subject:      subject,
+		Date:         date,
+		Author:       []Reference{{Display: Author}},
+		Title:        "Waiting room intake summary",
+		Section:      sections,
+	}
+	if strings.TrimSpace(summary.FreeText) != "" {
+		comp.Text = narrative(paragraph(summary.FreeText))
+	}
+	// Everything but the Patient was generated.
+	targets := []Reference{{Reference: "urn:uuid:" + comp.ID}}
+	for _, e := range b.entries[1:] {
+		targets = append(targets, Reference{Reference: e.FullURL})
+	}
+	prov := provenance(gen, targets)
+	b.add(prov.ID, prov)
+	// A document bundle starts with its Composition.
+	entries := append([]Entry{{FullURL: "urn:uuid:" + comp.ID, Resource: comp}}, b.entries...)
+
+	return &Bundle{
+		ResourceType: "Bundle",
+		ID:           uuid.NewString(),
+		Identifier:   &Identifier{System: systemURI, Value: "urn:uuid:" + session.ID},
+		Type:         "document",
+		Timestamp:    gen.ExportedAt,
+		Entry:        entries,
+	}
+}
+
+// builder collects the entries of a bundle.
+type builder struct {
+	entries []Entry
+}
+
+// add adds the resource with the given ID and returns a reference to it.
+func (b *builder) add(id string, resource interface{}) Reference {
+	url := "urn:uuid:" + id
+	b.entries = append(b.entries, Entry{FullURL: url, Resource: resource})
+	return Reference{Reference: url}
+}
+
+// patient maps the session's demographics.
+func patient(session *pkg.Session) (string, Patient) {
+	p := Patient{ResourceType: "Patient", ID: uuid.NewString()}
+	if v := deref(session.PatientID); v != "" {
+		p.Identifier = []Identifier{{System: NationalIDSystem, Value: v}}
+	}
+	if v := deref(session.PatientName); v != "" {
+		p.Name = []HumanName{{Text: v}}
+	}
+	if v := deref(session.PatientPhone); v != "" {
+		p.Telecom = []ContactPoint{{System: "phone", Value: v, Use: "mobile"}}
+	}
+	return p.ID, p
+}
+
+// medicationStatement maps a medication entry of a structured summary.
+// extra lists the entry's fields that have no place on the statement; ok
+// is false when the entry has no name.
+func medicationStatement(raw interface{}, subject Reference) (st MedicationStatement, extra []string, ok bool) {
+	meds := core.SummaryMedications(map[string]interface{}{fieldMedications: []interface{}{raw}})
+	if len(meds) == 0 {
+		return st, nil, false
+	}
+	m := meds[0]
+	source := subject
+	st = MedicationStatement{
+		ResourceType:              "MedicationStatement",
+		ID:                        uuid.NewString(),
+		Status:                    "active",
+		MedicationCodeableConcept: CodeableConcept{Text: m.Name},
+		Subject:                   subject,
+		InformationSource:         &source,
+	}
+	dosage := []string{}
+	if m.Dose != "" {
+		dosage = append(dosage, m.Dose)
+	}
+	if obj, isObj := raw.(map[string]interface{}); isObj {
+		if f := obj["frequency"]; !isEmpty(f) {
+			dosage = append(dosage, describe(f))
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch k {
+			case "name", "original", "dose", "frequency", "unmatched":
+				continue
+			}
+			if !isEmpty(obj[k]) {
+				extra = append(extra, field(fieldMedications+" ("+m.Name+") "+k, obj[k]))
+			}
+		}
+	}
+	if len(dosage) > 0 {
+		st.Dosage = []Dosage{{Text: strings.Join(dosage, ", ")}}
+	}
+	switch {
+	case m.Unmatched:
+		st.Note = []Annotation{{Text: "Not in the reference medication list; as reported: " + m.Original}}
+	case m.Original != "" && m.Original != m.Name:
+		st.Note = []Annotation{{Text: "As reported: " + m.Original}}
+	}
+	return st, extra, true
+}
+
+// allergyIntolerance maps an allergy the patient reported.
+func allergyIntolerance(substance string, subject Reference) AllergyIntolerance {
+	return AllergyIntolerance{
+		ResourceType:       "AllergyIntolerance",
+		ID:                 uuid.NewString(),
+		ClinicalStatus:     &CodeableConcept{Coding: []Coding{{System: systemAllergyClin, Code: "active"}}},
+		VerificationStatus: &CodeableConcept{Coding: []Coding{{System: systemAllergyVerif, Code: "unconfirmed"}}},
+		Code:               CodeableConcept{Text: substance},
+		Patient:            subject,
+	}
+}
+
+// painObservation maps the summary's pain score, noting when the score the
+// patient gave was outside 0-10 and clamped.
+func painObservation(summary *pkg.Summary, subject Reference, date time.Time) Observation {
+	score := *summary.PainScore
+	obs := Observation{
+		ResourceType:      "Observation",
+		ID:                uuid.NewString(),
+		Status:            "preliminary",
+		Category:          []CodeableConcept{{Coding: []Coding{{System: systemObsCategory, Code: "survey"}}}},
+		Code:              *loinc("72514-3", "Pain severity - 0-10 verbal numeric rating [Score] - Reported"),
+		Subject:           subject,
+		EffectiveDateTime: date,
+		ValueInteger:      &score,
+	}
+	if summary.PainScoreClamped {
+		reported := "The score reported"
+		if v := summary.Structured[fieldPainScore]; !isEmpty(v) {
+			reported += " (" + describe(v) + ")"
+		}
+		obs.Note = []Annotation{{Text: reported + " was outside 0-10 and was clamped."}}
+	}
+	return obs
+}
+
+// provenance maps the generation details of the export onto a Provenance
+// of targets: the models are its authors and the bot, which assembled the
+// document, its assembler.
+func provenance(gen export.Generation, targets []Reference) Provenance {
+	p := Provenance{
+		ResourceType: "Provenance",
+		ID:           uuid.NewString(),
+		Text:         narrative(bullets(gen.Lines())),
+		Target:       targets,
+		Recorded:     gen.ExportedAt,
+		Agent:        []ProvenanceAgent{{Type: participant("assembler"), Who: Reference{Display: Author}}},
+	}
+	if gen.SummarySchemaVersion > 0 {
+		p.Policy = []string{fmt.Sprintf("%s%d", SummarySchemaPolicy, gen.SummarySchemaVersion)}
+	}
+	period := &Period{Start: gen.FirstReplyAt, End: gen.LastReplyAt}
+	if at := gen.SummaryGeneratedAt; at != nil {
+		if period.Start == nil || at.Before(*period.Start) {
+			period.Start = at
+		}
+		if period.End == nil || at.After(*period.End) {
+			period.End = at
+		}
+	}
+	if period.Start != nil {
+		p.OccurredPeriod = period
+	}
+	models := append([]string{}, gen.ReplyModels...)
+	if gen.SummaryModel != "" && !contains(models, gen.SummaryModel) {
+		models = append(models, gen.SummaryModel)
+	}
+	for _, m := range models {
+		p.Agent = append(p.Agent, ProvenanceAgent{Type: participant("author"), Who: Reference{Display: m}})
+	}
+	return p
+}
+
+func participant(code string) *CodeableConcept {
+	return &CodeableConcept{Coding: []Coding{{System: systemParticipant, Code: code}}}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compositionStatus maps a session status onto a Composition status.
+func compositionStatus(status pkg.SessionStatus) string {
+	switch status {
+	case pkg.StatusReviewed, pkg.StatusClosed:
+		return "final"
+	}
+	return "preliminary"
+}
+
+// entries returns the items of a list field of a structured summary.  A
+// value that is not a list is left unmapped under name.
+func entries(v interface{}, name string, unmapped *[]string) []interface{} {
+	switch l := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return l
+	}
+	if !isEmpty(v) {
+		*unmapped = append(*unmapped, field(name, v))
+	}
+	return nil
+}
+
+// transcriptList renders the transcript as an ordered list, without the
+// content of redacted messages.
+func transcriptList(transcript []pkg.Message) string {
+	var sb strings.Builder
+	sb.WriteString("<ol>")
+	for _, m := range transcript {
+		content := m.Content
+		if m.RedactedAt != nil {
+			content = "[redacted]"
+		}
+		if n := len(m.Attachments); n > 0 {
+			content += fmt.Sprintf(" [%d attachment(s)]", n)
+		}
+		fmt.Fprintf(&sb, "<li>%s (%s): %s</li>", html.EscapeString(string(m.Role)),
+			m.CreatedAt.UTC().Format(time.RFC3339), html.EscapeString(content))
+	}
+	sb.WriteString("</ol>")
+	return sb.String()
+}
+
+func loinc(code, display string) *CodeableConcept {
+	return &CodeableConcept{Coding: []Coding{{System: systemLOINC, Code: code, Display: display}}, Text: display}
+}
+
+// narrative wraps XHTML content in the div a Narrative requires.
+func narrative(content string) *Narrative {
+	return &Narrative{Status: "generated", Div: `<div xmlns="http://www.w3.org/1999/xhtml">` + content + `</div>`}
+}
+
+func paragraph(text string) string {
+	return "<p>" + html.EscapeString(text) + "</p>"
+}
+
+func bullets(items []string) string {
+	var sb strings.Builder
+	sb.WriteString("<ul>")
+	for _, item := range items {
+		sb.WriteString("<li>" + html.EscapeString(item) + "</li>")
+	}
+	sb.WriteString("</ul>")
+	return sb.String()
+}
+
+// field renders a structured summary value for the narrative.
+func field(name string, v interface{}) string {
+	return name + ": " + describe(v)
+}
+
+// describe renders a JSON value as text: lists joined by "; ", objects as
+// "key: value" pairs in key order.
+func describe(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []interface{}:
+		parts := make([]string, 0, len(x))
+		for _, item := range x {
+			if !isEmpty(item) {
+				parts = append(parts, describe(item))
+			}
+		}
+		return strings.Join(parts, "; ")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			if !isEmpty(x[k]) {
+				parts = append(parts, field(k, x[k]))
+			}
+		}
+		return strings.Join(parts, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+func isEmpty(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(x) == ""
+	case []interface{}:
+		return len(x) == 0
+	case map[string]interface{}:
+		return len(x) == 0
+	}
+	return false
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,360 @@
+package fhir
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/pkg"
+)
+
+func strPtr(s string) *string { return &s }
+
+func intPtr(n int) *int { return &n }
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+var (
+	created  = time.Date(2024, 3, 10, 8, 0, 0, 0, time.UTC)
+	reviewed = created.Add(30 * time.Minute)
+)
+
+func testSession(status pkg.SessionStatus) *pkg.Session {
+	return &pkg.Session{
+		ID:           "7d9c3c8e-0f43-4f49-9d4e-5b7a4c1f2e11",
+		CreatedAt:    created,
+		Status:       status,
+		PatientName:  strPtr("مریم احمدی"),
+		PatientPhone: strPtr("09121234567"),
+		PatientID:    strPtr("0012345678"),
+	}
+}
+
+// resources returns the bundle's resources of type T, in bundle order.
+func resources[T any](b *Bundle) []T {
+	var out []T
+	for _, e := range b.Entry {
+		if r, ok := e.Resource.(T); ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func section(t *testing.T, c Composition, title string) Section {
+	t.Helper()
+	for _, s := range c.Section {
+		if s.Title == title {
+			return s
+		}
+	}
+	t.Fatalf("no section %q in %+v", title, c.Section)
+	return Section{}
+}
+
+func hasSection(c Composition, title string) bool {
+	for _, s := range c.Section {
+		if s.Title == title {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExport(t *testing.T) {
+	summary := &pkg.Summary{
+		KeyPoints: []string{"سردرد از دو روز پیش"},
+		FreeText:  "بیمار از سردرد <شدید> شکایت دارد.",
+		UpdatedAt: reviewed,
+		PainScore: intPtr(7),
+		Questions: []string{"آیا تاری دید دارید؟"},
+		Structured: map[string]interface{}{
+			"chief_complaint": "سردرد",
+			"medications": []interface{}{
+				"قرص متفورمین ۵۰۰",
+				map[string]interface{}{"name": "آسپرین", "dose": "80mg", "frequency": "روزی یک بار", "route": "خوراکی"},
+				map[string]interface{}{"dose": "5"},
+			},
+			"allergies":  []interface{}{"پنی‌سیلین", float64(3), " "},
+			"pain_score": float64(7),
+			"occupation": "معلم",
+			"smoking":    "",
+		},
+	}
+	gen := export.Generation{
+		Disclaimer:           export.Disclaimer,
+		ReplyModels:          []string{"model-a", "model-b"},
+		FirstReplyAt:         timePtr(created.Add(time.Minute)),
+		LastReplyAt:          timePtr(created.Add(10 * time.Minute)),
+		SummaryModel:         "model-b",
+		SummaryGeneratedAt:   timePtr(reviewed),
+		SummarySchemaVersion: 2,
+		ExportedAt:           reviewed.Add(time.Hour),
+	}
+	b := Export(testSession(pkg.StatusReviewed), summary, nil, gen)
+
+	if b.Type != "document" || b.Identifier == nil || b.Identifier.Value != "urn:uuid:7d9c3c8e-0f43-4f49-9d4e-5b7a4c1f2e11" {
+		t.Errorf("bundle %+v, want a document identified by the session", b)
+	}
+	comp, ok := b.Entry[0].Resource.(Composition)
+	if !ok {
+		t.Fatalf("first entry %T, want the Composition", b.Entry[0].Resource)
+	}
+	if comp.Status != "final" || !comp.Date.Equal(reviewed) {
+		t.Errorf("composition status %q date %v, want final at %v", comp.Status, comp.Date, reviewed)
+	}
+	if comp.Text == nil || !strings.Contains(comp.Text.Div, "&lt;شدید&gt;") {
+		t.Errorf("composition narrative %+v, want the escaped free text", comp.Text)
+	}
+
+	patients := resources[Patient](b)
+	if len(patients) != 1 {
+		t.Fatalf("%d patients, want 1", len(patients))
+	}
+	p := patients[0]
+	if len(p.Identifier) != 1 || p.Identifier[0] != (Identifier{System: NationalIDSystem, Value: "0012345678"}) {
+		t.Errorf("patient identifier %+v", p.Identifier)
+	}
+	if len(p.Name) != 1 || p.Name[0].Text != "مریم احمدی" || len(p.Telecom) != 1 || p.Telecom[0].Value != "09121234567" {
+		t.Errorf("patient name %+v telecom %+v", p.Name, p.Telecom)
+	}
+	if comp.Subject.Reference != "urn:uuid:"+p.ID {
+		t.Errorf("composition subject %q, want the patient", comp.Subject.Reference)
+	}
+
+	meds := resources[MedicationStatement](b)
+	if len(meds) != 2 {
+		t.Fatalf("%d medication statements, want 2 (the entry without a name unmapped)", len(meds))
+	}
+	if m := meds[0]; m.MedicationCodeableConcept.Text != "metformin" || len(m.Dosage) != 1 || m.Dosage[0].Text != "۵۰۰" ||
+		len(m.Note) != 1 || m.Note[0].Text != "As reported: قرص متفورمین ۵۰۰" {
+		t.Errorf("metformin %+v", m)
+	}
+	if m := meds[1]; m.MedicationCodeableConcept.Text != "aspirin" || len(m.Dosage) != 1 || m.Dosage[0].Text != "80mg, روزی یک بار" {
+		t.Errorf("aspirin %+v", m)
+	}
+	if got := len(section(t, comp, "Medications").Entry); got != 2 {
+		t.Errorf("medications section has %d entries, want 2", got)
+	}
+
+	allergies := resources[AllergyIntolerance](b)
+	if len(allergies) != 1 || allergies[0].Code.Text != "پنی‌سیلین" ||
+		allergies[0].VerificationStatus.Coding[0].Code != "unconfirmed" {
+		t.Errorf("allergies %+v, want an unconfirmed penicillin allergy", allergies)
+	}
+
+	obs := resources[Observation](b)
+	if len(obs) != 1 || obs[0].ValueInteger == nil || *obs[0].ValueInteger != 7 ||
+		obs[0].Code.Coding[0].Code != "72514-3" || obs[0].Note != nil {
+		t.Errorf("observations %+v, want the pain score 7", obs)
+	}
+
+	other := section(t, comp, "Other details").Text.Div
+	for _, want := range []string{
+		"medications: dose: 5",
+		"medications (aspirin) route: خوراکی",
+		"allergies: 3",
+		"occupation: معلم",
+	} {
+		if !strings.Contains(other, want) {
+			t.Errorf("other details %s: missing %q", other, want)
+		}
+	}
+	for _, mapped := range []string{"chief_complaint", "pain_score", "smoking", "frequency"} {
+		if strings.Contains(other, mapped) {
+			t.Errorf("other details %s: %q should not be listed", other, mapped)
+		}
+	}
+	for _, title := range []string{"Key points", "Chief complaint", "Allergies", "Pain", "Suggested questions"} {
+		section(t, comp, title)
+	}
+	if hasSection(comp, "Transcript") {
+		t.Error("transcript section without a transcript")
+	}
+
+	provs := resources[Provenance](b)
+	if len(provs) != 1 {
+		t.Fatalf("%d provenances, want 1", len(provs))
+	}
+	prov := provs[0]
+	targets := map[string]bool{}
+	for _, r := range prov.Target {
+		targets[r.Reference] = true
+	}
+	for _, e := range b.Entry {
+		_, isPatient := e.Resource.(Patient)
+		_, isProv := e.Resource.(Provenance)
+		if want := !isPatient && !isProv; targets[e.FullURL] != want {
+			t.Errorf("provenance target %T: %v, want %v", e.Resource, targets[e.FullURL], want)
+		}
+	}
+	var authors []string
+	for _, a := range prov.Agent {
+		if a.Type.Coding[0].Code == "author" {
+			authors = append(authors, a.Who.Display)
+		}
+	}
+	if strings.Join(authors, ",") != "model-a,model-b" {
+		t.Errorf("provenance authors %v, want each model once", authors)
+	}
+	if len(prov.Policy) != 1 || prov.Policy[0] != SummarySchemaPolicy+"2" {
+		t.Errorf("provenance policy %v", prov.Policy)
+	}
+	if prov.OccurredPeriod == nil || !prov.OccurredPeriod.Start.Equal(*gen.FirstReplyAt) || !prov.OccurredPeriod.End.Equal(reviewed) {
+		t.Errorf("provenance period %+v, want first reply to summary", prov.OccurredPeriod)
+	}
+	if prov.Text == nil || !strings.Contains(prov.Text.Div, "language model") {
+		t.Errorf("provenance narrative %+v, want the disclaimer", prov.Text)
+	}
+}
+
+func TestExportUnmapped(t *testing.T) {
+	summary := &pkg.Summary{
+		UpdatedAt: reviewed,
+		Structured: map[string]interface{}{
+			"chief_complaint": map[string]interface{}{"site": "سر", "side": "چپ"},
+			"medications":     "هیچ",
+			"allergies":       map[string]interface{}{"food": "بادام"},
+			"pain_score":      "زیاد",
+		},
+	}
+	b := Export(testSession(pkg.StatusReadyForDoctor), summary, nil, export.Generation{ExportedAt: reviewed})
+	comp := b.Entry[0].Resource.(Composition)
+	if comp.Status != "preliminary" {
+		t.Errorf("composition status %q, want preliminary before review", comp.Status)
+	}
+	if n := len(resources[MedicationStatement](b)) + len(resources[AllergyIntolerance](b)) + len(resources[Observation](b)); n != 0 {
+		t.Errorf("%d resources mapped from values that do not fit", n)
+	}
+	other := section(t, comp, "Other details").Text.Div
+	for _, want := range []string{
+		"chief_complaint: side: چپ, site: سر",
+		"medications: هیچ",
+		"allergies: food: بادام",
+		"pain_score: زیاد",
+	} {
+		if !strings.Contains(other, want) {
+			t.Errorf("other details %s: missing %q", other, want)
+		}
+	}
+	for _, title := range []string{"Chief complaint", "Medications", "Allergies", "Pain"} {
+		if hasSection(comp, title) {
+			t.Errorf("section %q for a value left unmapped", title)
+		}
+	}
+}
+
+func TestExportPainClamped(t *testing.T) {
+	summary := &pkg.Summary{
+		UpdatedAt:        reviewed,
+		PainScore:        intPtr(10),
+		PainScoreClamped: true,
+		Structured:       map[string]interface{}{"pain_score": float64(12)},
+	}
+	b := Export(testSession(pkg.StatusReadyForDoctor), summary, nil, export.Generation{ExportedAt: reviewed})
+	obs := resources[Observation](b)
+	if len(obs) != 1 || *obs[0].ValueInteger != 10 || len(obs[0].Note) != 1 ||
+		obs[0].Note[0].Text != "The score reported (12) was outside 0-10 and was clamped." {
+		t.Errorf("observations %+v, want 10 noting the clamped 12", obs)
+	}
+	if hasSection(b.Entry[0].Resource.(Composition), "Other details") {
+		t.Error("a clamped pain score is mapped, not left unmapped")
+	}
+}
+
+func TestExportWithoutSummary(t *testing.T) {
+	redacted := created.Add(5 * time.Minute)
+	transcript := []pkg.Message{
+		{Role: pkg.RolePatient, Content: "سلام <دکتر>", CreatedAt: created},
+		{Role: pkg.RoleBot, Content: "[bot] از کی این درد را دارید؟", CreatedAt: created.Add(time.Minute)},
+		{Role: pkg.RolePatient, Content: "شماره کارتم ۶۰۳۷", CreatedAt: created.Add(2 * time.Minute), RedactedAt: &redacted},
+	}
+	session := testSession(pkg.StatusOpen)
+	session.PatientName, session.PatientPhone = nil, nil
+	b := Export(session, nil, transcript, export.Generation{ExportedAt: reviewed})
+
+	comp := b.Entry[0].Resource.(Composition)
+	if comp.Status != "preliminary" || !comp.Date.Equal(created) || comp.Text != nil {
+		t.Errorf("composition %+v, want a preliminary one dated by the session without narrative", comp)
+	}
+	if len(comp.Section) != 1 || comp.Section[0].Title != "Transcript" {
+		t.Fatalf("sections %+v, want the transcript only", comp.Section)
+	}
+	div := comp.Section[0].Text.Div
+	for _, want := range []string{"سلام &lt;دکتر&gt;", "[bot] از کی این درد را دارید؟", "[redacted]", "2024-03-10T08:01:00Z"} {
+		if !strings.Contains(div, want) {
+			t.Errorf("transcript %s: missing %q", div, want)
+		}
+	}
+	if strings.Contains(div, "۶۰۳۷") {
+		t.Errorf("transcript %s: redacted content exported", div)
+	}
+	p := resources[Patient](b)[0]
+	if p.Name != nil || p.Telecom != nil || len(p.Identifier) != 1 {
+		t.Errorf("patient %+v, want the national ID only", p)
+	}
+	if len(b.Entry) != 3 {
+		t.Errorf("%d entries, want the composition, patient and provenance", len(b.Entry))
+	}
+}
+
+// TestExportReferences checks that every reference in the encoded bundle
+// resolves to one of its entries.
+func TestExportReferences(t *testing.T) {
+	summary := &pkg.Summary{
+		UpdatedAt:  reviewed,
+		PainScore:  intPtr(3),
+		Structured: map[string]interface{}{"medications": []interface{}{"بروفن ۴۰۰"}, "allergies": []interface{}{"گرده"}},
+	}
+	data, err := json.Marshal(Export(testSession(pkg.StatusClosed), summary, nil, export.Generation{ExportedAt: reviewed}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Entry []struct {
+			FullURL string `json:"fullUrl"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	urls := map[string]bool{}
+	for _, e := range doc.Entry {
+		if urls[e.FullURL] {
+			t.Errorf("duplicate entry %s", e.FullURL)
+		}
+		urls[e.FullURL] = true
+	}
+	var refs int
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := x["reference"].(string); ok {
+				refs++
+				if !urls[ref] {
+					t.Errorf("reference %s resolves to no entry", ref)
+				}
+			}
+			for _, item := range x {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range x {
+				walk(item)
+			}
+		}
+	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	walk(raw)
+	// Subjects, the medication's source, the sections' entries and the
+	// provenance targets.
+	if refs < 10 {
+		t.Errorf("%d references, want at least 10", refs)
+	}
+}
@@ -0,0 +1,166 @@
+package fhir
+
+import "time"
+
+// Bundle is a FHIR R4 Bundle.  Export builds document bundles: the
+// Composition first, then the resources it refers to.
+type Bundle struct {
+	ResourceType string      `json:"resourceType"`
+	ID           string      `json:"id"`
+	Identifier   *Identifier `json:"identifier,omitempty"`
+	Type         string      `json:"type"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Entry        []Entry     `json:"entry"`
+}
+
+// Entry is a resource of a Bundle.  FullURL is the urn:uuid the other
+// resources of the bundle refer to it by.
+type Entry struct {
+	FullURL  string      `json:"fullUrl"`
+	Resource interface{} `json:"resource"`
+}
+
+// Patient is the FHIR Patient resource.
+type Patient struct {
+	ResourceType string         `json:"resourceType"`
+	ID           string         `json:"id"`
+	Identifier   []Identifier   `json:"identifier,omitempty"`
+	Name         []HumanName    `json:"name,omitempty"`
+	Telecom      []ContactPoint `json:"telecom,omitempty"`
+}
+
+// Composition is the FHIR Composition resource: the intake note itself.
+type Composition struct {
+	ResourceType string          `json:"resourceType"`
+	ID           string          `json:"id"`
+	Text         *Narrative      `json:"text,omitempty"`
+	Status       string          `json:"status"`
+	Type         CodeableConcept `json:"type"`
+	Subject      Reference       `json:"subject"`
+	Date         time.Time       `json:"date"`
+	Author       []Reference     `json:"author"`
+	Title        string          `json:"title"`
+	Section      []Section       `json:"section,omitempty"`
+}
+
+// Section is a section of a Composition.
+type Section struct {
+	Title string           `json:"title"`
+	Code  *CodeableConcept `json:"code,omitempty"`
+	Text  *Narrative       `json:"text,omitempty"`
+	Entry []Reference      `json:"entry,omitempty"`
+}
+
+// MedicationStatement is the FHIR MedicationStatement resource.
+type MedicationStatement struct {
+	ResourceType              string          `json:"resourceType"`
+	ID                        string          `json:"id"`
+	Status                    string          `json:"status"`
+	MedicationCodeableConcept CodeableConcept `json:"medicationCodeableConcept"`
+	Subject                   Reference       `json:"subject"`
+	InformationSource         *Reference      `json:"informationSource,omitempty"`
+	Dosage                    []Dosage        `json:"dosage,omitempty"`
+	Note                      []Annotation    `json:"note,omitempty"`
+}
+
+// AllergyIntolerance is the FHIR AllergyIntolerance resource.
+type AllergyIntolerance struct {
+	ResourceType       string           `json:"resourceType"`
+	ID                 string           `json:"id"`
+	ClinicalStatus     *CodeableConcept `json:"clinicalStatus,omitempty"`
+	VerificationStatus *CodeableConcept `json:"verificationStatus,omitempty"`
+	Code               CodeableConcept  `json:"code"`
+	Patient            Reference        `json:"patient"`
+}
+
+// Observation is the FHIR Observation resource.
+type Observation struct {
+	ResourceType      string            `json:"resourceType"`
+	ID                string            `json:"id"`
+	Status            string            `json:"status"`
+	Category          []CodeableConcept `json:"category,omitempty"`
+	Code              CodeableConcept   `json:"code"`
+	Subject           Reference         `json:"subject"`
+	EffectiveDateTime time.Time         `json:"effectiveDateTime"`
+	ValueInteger      *int              `json:"valueInteger,omitempty"`
+	Note              []Annotation      `json:"note,omitempty"`
+}
+
+// Provenance is the FHIR Provenance resource: what generated the
+// resources it targets.
+type Provenance struct {
+	ResourceType   string            `json:"resourceType"`
+	ID             string            `json:"id"`
+	Text           *Narrative        `json:"text,omitempty"`
+	Target         []Reference       `json:"target"`
+	OccurredPeriod *Period           `json:"occurredPeriod,omitempty"`
+	Recorded       time.Time         `json:"recorded"`
+	Policy         []string          `json:"policy,omitempty"`
+	Agent          []ProvenanceAgent `json:"agent"`
+}
+
+// ProvenanceAgent is an agent of a Provenance.
+type ProvenanceAgent struct {
+	Type *CodeableConcept `json:"type,omitempty"`
+	Who  Reference        `json:"who"`
+}
+
+// Period is a FHIR Period.
+type Period struct {
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+// Identifier is a FHIR Identifier.
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// HumanName is a FHIR HumanName; only the name as written is known.
+type HumanName struct {
+	Text string `json:"text"`
+}
+
+// ContactPoint is a FHIR ContactPoint.
+type ContactPoint struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+	Use    string `json:"use,omitempty"`
+}
+
+// CodeableConcept is a FHIR CodeableConcept.
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// Coding is a FHIR Coding.
+type Coding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+// Reference is a FHIR Reference, to a bundle entry's FullURL or by display
+// only.
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+// Narrative is a FHIR Narrative; Div is an XHTML div.
+type Narrative struct {
+	Status string `json:"status"`
+	Div    string `json:"div"`
+}
+
+// Dosage is a FHIR Dosage given as text.
+type Dosage struct {
+	Text string `json:"text"`
+}
+
+// Annotation is a FHIR Annotation.
+type Annotation struct {
+	Text string `json:"text"`
+}
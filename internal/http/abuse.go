@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// validNationalID reports whether id is a well-formed Iranian national ID:
+// ten digits, Persian or Latin, not all the same, whose last digit is the
+// check digit of the other nine.
+func validNationalID(id string) bool {
+	var d [10]int
+	n := 0
+	for _, r := range latinDigits(id) {
+		if n == len(d) || r < '0' || r > '9' {
+			return false
+		}
+		d[n] = int(r - '0')
+		n++
+	}
+	if n != len(d) {
+		return false
+	}
+	same := true
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += d[i] * (10 - i)
+		same = same && d[i] == d[9]
+	}
+	if same {
+		return false
+	}
+	check := sum % 11
+	if check >= 2 {
+		check = 11 - check
+	}
+	return d[9] == check
+}
+
+// latinDigits replaces the Persian and Arabic digits of s, as a patient's
+// keyboard may type them, with Latin ones.
+func latinDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '۰' && r <= '۹':
+			return '0' + (r - '۰')
+		case r >= '٠' && r <= '٩':
+			return '0' + (r - '٠')
+		}
+		return r
+	}, s)
+}
+
+// clientIP returns the address of the patient's client, as seen through
+// the trusted proxies (see withForwarded), or "" when it is not an IP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+var (
+	// errInvalidNationalID refuses a national ID failing the checksum.
+	errInvalidNationalID = errs.New(errs.Invalid, "invalid national ID")
+	// errDeniedIdentity refuses a national ID or client IP on the
+	// denylist.
+	errDeniedIdentity = errs.New(errs.Invalid, "national ID or IP denied")
+)
+
+// checkIdentity applies the start form's checks of a patient's details,
+// wherever they are stored: the national ID checksum when CheckNationalID
+// is set and the denylist of national IDs and, when set, the client IP.  It
+// returns errInvalidNationalID or errDeniedIdentity for refused details.
+func (s *Server) checkIdentity(ctx context.Context, u *pkg.User) error {
+	if s.CheckNationalID && !validNationalID(u.NationalID) {
+		return errInvalidNationalID
+	}
+	denied, err := s.Repo.IsDenied(ctx, u.NationalID, u.ClientIP)
+	if err != nil {
+		return err
+	}
+	if denied {
+		return errDeniedIdentity
+	}
+	return nil
+}
+
+// admitStart applies the protections against fake registrations to a
+// submitted start form, before anything is stored: checkIdentity and
+// StartLimit.  A refused attempt is recorded in the audit log and answered
+// with the start page showing a message; it returns false then.  Patients
+// with a session already, who are re-registering, are not counted against
+// StartLimit.
+func (s *Server) admitStart(w http.ResponseWriter, r *http.Request, u *pkg.User, page startPage) bool {
+	switch err := s.checkIdentity(r.Context(), u); {
+	case err == errInvalidNationalID:
+		s.refuseStart(w, r, page, audit.ActionStartInvalidID, http.StatusBadRequest, "start.invalid_national_id")
+		return false
+	case err == errDeniedIdentity:
+		s.refuseStart(w, r, page, audit.ActionStartDenied, http.StatusForbidden, "start.unavailable")
+		return false
+	case err != nil:
+		writeError(w, r, err)
+		return false
+	}
+	if s.StartLimit <= 0 || u.ClientIP == "" {
+		return true
+	}
+	if _, err := s.Repo.GetLatestSession(r.Context(), u.NationalID); err == nil {
+		return true
+	}
+	n, err := s.Repo.CountSessionsFromIPSince(r.Context(), u.ClientIP, time.Now().Add(-time.Hour))
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	if n >= s.StartLimit {
+		s.refuseStart(w, r, page, audit.ActionStartRateLimited, http.StatusTooManyRequests, "start.unavailable")
+		return false
+	}
+	return true
+}
+
+// refuseStart records a refused start in the audit log, attributed to the
+// client IP, and renders the start page again with the message of key.
+func (s *Server) refuseStart(w http.ResponseWriter, r *http.Request, page startPage, action string, status int, key string) {
+	if s.Audit != nil {
+		s.Audit.Record(r.Context(), pkg.AuditEntry{
+			Actor:     "ip:" + clientIP(r),
+			Action:    action,
+			RequestID: requestID(r.Context()),
+		})
+	}
+	page.Error = i18n.T(page.Locale, key)
+	s.renderStatus(w, r, status, "start", page)
+}
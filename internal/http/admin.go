@@ -0,0 +1,390 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/digest"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// authorizeAdmin checks the admin token on an admin request.  API clients
+// send it as a bearer token; browsers use HTTP Basic auth with the token as
+// the password and any username, which becomes the audit actor.  It writes
+// the error response and returns nil when the request must not proceed.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) *http.Request {
+	if s.AdminToken == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+	name, token, ok := r.BasicAuth()
+	if !ok {
+		name, token = "admin", strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+		writeError(w, r, errUnauthorized)
+		return nil
+	}
+	if name == "" {
+		name = "admin"
+	}
+	return r.WithContext(context.WithValue(r.Context(), actorKey, name))
+}
+
+// requireAdmin serves only requests authorized by authorizeAdmin.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r = s.authorizeAdmin(w, r); r != nil {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleMetrics renders the metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.Metrics.Write(w)
+}
+
+// routeAdmin routes the /admin endpoints.
+func (s *Server) routeAdmin(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/admin/audit" && r.Method == http.MethodGet:
+		s.handleAuditLog(w, r)
+	case r.URL.Path == "/admin/stats" && r.Method == http.MethodGet:
+		s.handleStats(w, r)
+	case r.URL.Path == "/admin/webhooks" && r.Method == http.MethodGet:
+		s.handleListWebhooks(w, r)
+	case r.URL.Path == "/admin/webhooks" && r.Method == http.MethodPost:
+		s.handleCreateWebhook(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/webhooks/") && strings.HasSuffix(r.URL.Path, "/deliveries") && r.Method == http.MethodGet:
+		s.handleWebhookDeliveries(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/webhooks/"), "/deliveries"))
+	case strings.HasPrefix(r.URL.Path, "/admin/webhooks/") && r.Method == http.MethodDelete:
+		s.handleDeleteWebhook(w, r, strings.TrimPrefix(r.URL.Path, "/admin/webhooks/"))
+	case strings.HasPrefix(r.URL.Path, "/admin/sessions/") && strings.HasSuffix(r.URL.Path, "/traces") && r.Method == http.MethodGet:
+		s.handleAdminTraces(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"), "/traces"))
+	case r.URL.Path == "/admin/cap-overrides" && r.Method == http.MethodPost:
+		s.handleCreateCapOverride(w, r)
+	case r.URL.Path == "/admin/patients/purge" && r.Method == http.MethodPost:
+		s.handlePurgePatient(w, r)
+	case r.URL.Path == "/admin/prompt-profiles" && r.Method == http.MethodGet:
+		s.handleListPromptProfiles(w, r)
+	case r.URL.Path == "/admin/prompt-profiles" && r.Method == http.MethodPost:
+		s.handleSavePromptProfile(w, r)
+	case strings.HasPrefix(r.URL.Path, "/admin/prompt-profiles/") && r.Method == http.MethodGet:
+		s.handleGetPromptProfile(w, r, strings.TrimPrefix(r.URL.Path, "/admin/prompt-profiles/"))
+	case strings.HasPrefix(r.URL.Path, "/admin/prompt-profiles/") && r.Method == http.MethodDelete:
+		s.handleDeletePromptProfile(w, r, strings.TrimPrefix(r.URL.Path, "/admin/prompt-profiles/"))
+	default:
+		if !methodNotAllowed(w, r, adminRoutes) {
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// handleListPromptProfiles returns all prompt profiles as JSON.
+func (s *Server) handleListPromptProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.Repo.ListPromptProfiles(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if profiles == nil {
+		profiles = []pkg.PromptProfile{}
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+// handleGetPromptProfile returns a single prompt profile as JSON.
+func (s *Server) handleGetPromptProfile(w http.ResponseWriter, r *http.Request, name string) {
+	profile, err := s.Repo.GetPromptProfile(r.Context(), name)
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// handleSavePromptProfile creates or updates a prompt profile from a JSON body.
+func (s *Server) handleSavePromptProfile(w http.ResponseWriter, r *http.Request) {
+	var p pkg.PromptProfile
+	if !decodeJSON(w, r, &p) {
+		return
+	}
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		writeError(w, r, errs.New(errs.Invalid, "name is required"))
+		return
+	}
+	if p.MaxReplyChars != 0 && p.MaxReplyChars < core.MinReplyChars {
+		writeError(w, r, errs.Errorf(errs.Invalid, "max_reply_chars must be 0 (server default) or at least %d", core.MinReplyChars))
+		return
+	}
+	if _, ok := core.SummaryLanguages[p.SummaryLanguage]; p.SummaryLanguage != "" && !ok {
+		writeError(w, r, errs.Errorf(errs.Invalid, "unknown summary_language %q", p.SummaryLanguage))
+		return
+	}
+	if err := s.Repo.UpsertPromptProfile(r.Context(), &p); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// handleDeletePromptProfile removes a prompt profile.
+func (s *Server) handleDeletePromptProfile(w http.ResponseWriter, r *http.Request, name string) {
+	if err := s.Repo.DeletePromptProfile(r.Context(), name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeRequest is the body of POST /admin/patients/purge.  The national ID
+// is sent in the body rather than the path to keep it out of access logs.
+type purgeRequest struct {
+	NationalID string `json:"national_id"`
+}
+
+// purgeResponse is the body of a successful POST /admin/patients/purge.
+type purgeResponse struct {
+	Sessions    int `json:"sessions"`
+	Attachments int `json:"attachments"`
+}
+
+// handlePurgePatient deletes every session of a patient with their
+// messages, summaries and attachments, as the admin command's purge does,
+// and records each deleted session in the audit log.  Attachment files
+// that cannot be deleted are logged and left out of the count.  It answers
+// 404 when the patient has no sessions.
+func (s *Server) handlePurgePatient(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.NationalID = strings.TrimSpace(req.NationalID); req.NationalID == "" {
+		writeError(w, r, errs.New(errs.Invalid, "national_id is required"))
+		return
+	}
+	ids, keys, err := s.Repo.PurgePatient(r.Context(), req.NationalID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(ids) == 0 {
+		writeError(w, r, errs.New(errs.NotFound, "no sessions for the national ID"))
+		return
+	}
+	for _, id := range ids {
+		s.recordAccess(r, audit.ActionPurgePatient, id)
+	}
+	deleted := 0
+	if s.Storage == nil && len(keys) > 0 {
+		log.Printf("purge: uploads are disabled; the files of %d attachments were left in place", len(keys))
+	}
+	if s.Storage != nil {
+		for _, key := range keys {
+			if err := s.Storage.Delete(r.Context(), key); err != nil {
+				log.Printf("purge: delete attachment %s: %v", key, err)
+				continue
+			}
+			deleted++
+		}
+	}
+	writeJSON(w, http.StatusOK, purgeResponse{Sessions: len(ids), Attachments: deleted})
+}
+
+// auditPage is the data of the "admin_audit" template.
+type auditPage struct {
+	Filter  pkg.AuditFilter
+	From    string
+	To      string
+	Entries []pkg.AuditEntry
+}
+
+// handleAuditLog renders the audit log filtered by the actor, action,
+// session_id, from and to (YYYY-MM-DD) query parameters.
+func (s *Server) handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := pkg.AuditFilter{
+		Actor:     q.Get("actor"),
+		Action:    q.Get("action"),
+		SessionID: q.Get("session_id"),
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+		f.From = t
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+		f.To = t.AddDate(0, 0, 1)
+	}
+	entries, err := s.Repo.ListAuditEntries(r.Context(), f)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	data := auditPage{Filter: f, From: q.Get("from"), To: q.Get("to"), Entries: entries}
+	s.render(w, r, "admin_audit", data)
+}
+
+// statsResponse is the body of GET /admin/stats.
+type statsResponse struct {
+	ActiveSessions int              `json:"active_sessions"`
+	Latency        pkg.LatencyStats `json:"reply_latency"`
+	Reads          pkg.ReadStats    `json:"reads"`
+	LLMCost        *llm.CostStatus  `json:"llm_cost,omitempty"`
+	LLMModels      []pkg.LLMCost    `json:"llm_models,omitempty"`
+	Digest         *digest.Status   `json:"digest,omitempty"`
+}
+
+// handleStats reports operational statistics as JSON: the number of active
+// sessions (of one clinic when ?clinic= is given), the p50/p95 reply latency between from and to (default: the last
+// 24 hours), the abandonment counts from the read receipts of the sessions
+// started in the same period, the month-to-date LLM spend per model and,
+// when the weekly digest is configured, its delivery status.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.Repo.ListActiveSessions(r.Context(), r.URL.Query().Get("clinic"), "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	stats := statsResponse{ActiveSessions: len(sessions)}
+	// Reply latency covers the last day unless from/to are given.
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = parseAPITime(v, false); err != nil {
+			writeError(w, r, errs.New(errs.Invalid, "invalid from"))
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseAPITime(v, true); err != nil {
+			writeError(w, r, errs.New(errs.Invalid, "invalid to"))
+			return
+		}
+	}
+	if stats.Latency, err = s.Repo.LatencyPercentiles(r.Context(), from, to); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if stats.Reads, err = s.Repo.ReadReceiptStats(r.Context(), from, to); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if s.Meter != nil {
+		status := s.Meter.Status()
+		stats.LLMCost = &status
+		if stats.LLMModels, err = s.Repo.ListLLMCosts(r.Context(), status.Month); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if s.Digest != nil {
+		status := s.Digest.Status()
+		stats.Digest = &status
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleListWebhooks returns the registered webhooks without their secrets.
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := s.Repo.ListWebhooks(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if hooks == nil {
+		hooks = []pkg.Webhook{}
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// handleCreateWebhook registers a webhook from a JSON body with a url and an
+// optional secret.  A random secret is generated when none is given; the
+// response is the only place it is shown.
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook pkg.Webhook
+	if !decodeJSON(w, r, &hook) {
+		return
+	}
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		writeError(w, r, errs.New(errs.Invalid, "url must be an absolute http(s) URL"))
+		return
+	}
+	if hook.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		hook.Secret = hex.EncodeToString(buf)
+	}
+	if err := s.Repo.CreateWebhook(r.Context(), &hook); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// handleDeleteWebhook removes a webhook and its queued deliveries.
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = s.Repo.DeleteWebhook(r.Context(), id)
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWebhookDeliveries returns the most recent deliveries of a webhook
+// (limit query parameter, default 50).
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	limit := 50
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 500 {
+		limit = v
+	}
+	deliveries, err := s.Repo.ListWebhookDeliveries(r.Context(), id, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []pkg.WebhookDelivery{}
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
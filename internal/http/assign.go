@@ -0,0 +1,87 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// recordAssignment writes the audit entry of a session being assigned to a
+// doctor.
+func (s *Server) recordAssignment(ctx context.Context, by, sessionID, doctor string) {
+	if s.Audit == nil {
+		return
+	}
+	s.Audit.Record(ctx, pkg.AuditEntry{
+		Actor:     by,
+		Action:    audit.ActionAssignSession,
+		SessionID: sessionID,
+		RequestID: requestID(ctx),
+		Assignee:  doctor,
+	})
+}
+
+// assignRoundRobin assigns the patient's new session to the next doctor of
+// the clinic in turn.  A failure is logged and the session stays
+// unassigned, for any doctor to claim.
+func (s *Server) assignRoundRobin(ctx context.Context, nationalID, clinicID string) {
+	sessionID, doctor, err := s.Repo.AssignRoundRobin(ctx, nationalID, clinicID)
+	if err != nil {
+		log.Printf("assign session (request %s): %v", requestID(ctx), err)
+		return
+	}
+	if doctor != "" {
+		s.recordAssignment(ctx, "system:round_robin", sessionID, doctor)
+	}
+}
+
+// dashboardDoctor returns the ID of the doctor whose patients the dashboard
+// lists when mine is set: the logged in doctor's.  It is 0, listing every
+// doctor's patients, otherwise or when doctors do not log in.
+func (s *Server) dashboardDoctor(ctx context.Context, mine bool) (int64, error) {
+	if !mine || len(s.DoctorUsers) == 0 {
+		return 0, nil
+	}
+	d, err := s.Repo.GetDoctorByUsername(ctx, actor(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return d.ID, nil
+}
+
+// handleAssignSession assigns a session to the doctor posted as doctor, or
+// to the logged in doctor claiming it when empty, and re-renders the
+// detail fragment.  Only active doctors of the session's clinic qualify.
+func (s *Server) handleAssignSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	session := s.clinicSession(w, r, sessionID)
+	if session == nil {
+		return
+	}
+	username := r.FormValue("doctor")
+	if username == "" {
+		username = actor(r.Context())
+	}
+	doctor, err := s.Repo.GetDoctorByUsername(r.Context(), username)
+	if errs.Is(err, errs.NotFound) || err == nil && (!doctor.Active || doctor.ClinicID != session.ClinicID) {
+		writeError(w, r, errs.New(errs.Invalid, "unknown doctor"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.Repo.AssignSession(r.Context(), sessionID, doctor.ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAssignment(r.Context(), actor(r.Context()), sessionID, doctor.Username)
+	s.handleDoctorSession(w, r, sessionID)
+}
@@ -0,0 +1,210 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// maxAttachmentSize is the largest photo a patient may upload.
+const maxAttachmentSize = 5 << 20
+
+// errInvalidUpload fails an upload whose multipart body cannot be read.
+var errInvalidUpload = errs.New(errs.Invalid, "invalid upload")
+
+// attachmentTypes maps the accepted (sniffed) content types to the file
+// extension used in the storage key.
+var attachmentTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+}
+
+// handlePostAttachment accepts a photo (e.g. of a medication box) from the
+// patient.  It is stored as a patient message carrying core.AttachmentNote
+// and an optional caption, so it counts toward the cap and the LLM knows a
+// photo was sent.  The response holds the patient's photo bubble followed by
+// the bot's reply.  Only the patient the session belongs to may post to
+// it.
+func (s *Server) handlePostAttachment(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if s.Storage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session := s.patientSession(w, r, sessionID)
+	if session == nil {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	if err := r.ParseMultipartForm(maxAttachmentSize); err != nil {
+		writeError(w, r, errInvalidUpload)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, errs.New(errs.Invalid, "missing file"))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		writeError(w, r, errInvalidUpload)
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		writeError(w, r, errs.Errorf(errs.Invalid, "file larger than %d bytes", maxAttachmentSize))
+		return
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		writeError(w, r, errs.Errorf(errs.Invalid, "%s upload: only JPEG and PNG images are accepted", contentType))
+		return
+	}
+	content := core.AttachmentNote
+	if caption := strings.TrimSpace(r.FormValue("caption")); caption != "" {
+		content += "\n" + caption
+	}
+	if session.ClosedAt != nil {
+		httpTurn{w, r}.closed()
+		return
+	}
+	s.respondInSession(r.Context(), httpTurn{w, r}, session, *session.PatientID, content, &upload{data: data, contentType: contentType, ext: ext})
+}
+
+// upload is a validated file waiting to be stored with a patient message.
+type upload struct {
+	data        []byte
+	contentType string
+	ext         string
+}
+
+// storeUpload puts an upload into storage and returns the attachment to
+// link to the patient message.
+func (s *Server) storeUpload(ctx context.Context, sessionID string, u *upload) (*pkg.Attachment, error) {
+	a := &pkg.Attachment{
+		SessionID:   sessionID,
+		StorageKey:  fmt.Sprintf("attachments/%s/%s.%s", sessionID, uuid.NewString(), u.ext),
+		ContentType: u.contentType,
+		Size:        int64(len(u.data)),
+	}
+	if err := s.Storage.Put(ctx, a.StorageKey, u.contentType, u.data); err != nil {
+		return nil, fmt.Errorf("store attachment: %w", err)
+	}
+	return a, nil
+}
+
+// discardUploads deletes stored files whose message was never saved.
+func (s *Server) discardUploads(ctx context.Context, attachments []*pkg.Attachment) {
+	for _, a := range attachments {
+		if err := s.Storage.Delete(ctx, a.StorageKey); err != nil {
+			log.Printf("delete orphaned attachment %s: %v", a.StorageKey, err)
+		}
+	}
+}
+
+// writeReply writes the bot's reply fragment, preceded by the patient's
+// photo bubble when the message carried attachments.
+func writeReply(w http.ResponseWriter, attachments []*pkg.Attachment, reply *pkg.Message) {
+	if len(attachments) > 0 {
+		var b strings.Builder
+		b.WriteString(`<div class="msg patient">`)
+		for _, a := range attachments {
+			b.WriteString(attachmentThumb(a.ID))
+		}
+		b.WriteString(`</div>`)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, b.String())
+	}
+	writeBotMessage(w, reply)
+}
+
+// attachmentThumb renders the thumbnail link for an attachment.
+func attachmentThumb(id int64) string {
+	src := template.HTMLEscapeString("/attachments/" + strconv.FormatInt(id, 10))
+	return `<a href="` + src + `" target="_blank"><img class="thumb" src="` + src + `" alt="" /></a>`
+}
+
+// handleGetAttachment serves an uploaded file to the patient who sent it or
+// to an authorized doctor of the session's clinic.
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || s.Storage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := s.Repo.GetAttachment(r.Context(), id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.ownsSession(r, a.SessionID) {
+		if r = s.authorizeDoctor(w, r); r == nil {
+			return
+		}
+		if s.clinicSession(w, r, a.SessionID) == nil {
+			return
+		}
+	}
+	body, err := s.Storage.Get(r.Context(), a.StorageKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("serve attachment %d: %v", a.ID, err)
+	}
+}
+
+// ownsSession reports whether the patient cookie on the request belongs to
+// the given session.
+func (s *Server) ownsSession(r *http.Request, sessionID string) bool {
+	session, err := s.Repo.GetSessionByID(r.Context(), sessionID)
+	return err == nil && s.ownedBy(r, session)
+}
+
+// ownedBy reports whether the national_id cookie of the request names the
+// patient of session.
+func (s *Server) ownedBy(r *http.Request, session *pkg.Session) bool {
+	nationalID := s.patientNationalID(r)
+	return nationalID != "" && session.PatientID != nil && *session.PatientID == nationalID
+}
+
+// patientNationalID returns the national ID the national_id cookie of the
+// request names, empty without a validly signed cookie.
+func (s *Server) patientNationalID(r *http.Request) string {
+	c, err := r.Cookie(patientCookie)
+	if err != nil {
+		return ""
+	}
+	nationalID, _, _ := s.parsePatientCookie(c.Value)
+	return nationalID
+}
+
+// loadAttachments loads attachments for a transcript so the
+// templates can show thumbnails.  Failures only drop the thumbnails.
+func (s *Server) loadAttachments(ctx context.Context, transcript []pkg.Message) {
+	if err := s.Repo.AttachAttachments(ctx, transcript); err != nil {
+		log.Printf("load attachments: %v", err)
+	}
+}
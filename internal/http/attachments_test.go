@@ -0,0 +1,104 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/pkg"
+)
+
+func TestGetAttachmentClinic(t *testing.T) {
+	s, _ := newTestServer(t)
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Storage = store
+	s.DoctorUsers = map[string]string{"dr": "pw", "north": "pw"}
+	s.DoctorClinics = map[string]string{"north": "north"}
+	cookie, session := startPatient(t, s, "0012345678")
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"عکس نسخه"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	ctx := context.Background()
+	transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &pkg.Attachment{SessionID: session.ID, MessageID: transcript[0].ID, StorageKey: "attachments/" + session.ID + "/rx.png", ContentType: "image/png", Size: 3}
+	if err := store.Put(ctx, a.StorageKey, a.ContentType, []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Repo.CreateAttachment(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	target := "/attachments/" + strconv.FormatInt(a.ID, 10)
+
+	if resp := serve(s, http.MethodGet, target, nil, cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("patient: status %d, want 200", resp.StatusCode)
+	}
+	for _, tc := range []struct {
+		user   string
+		status int
+	}{
+		{"dr", http.StatusOK},
+		{"north", http.StatusNotFound},
+	} {
+		r := newRequest(http.MethodGet, target, nil)
+		r.SetBasicAuth(tc.user, "pw")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("doctor %s: status %d, want %d", tc.user, w.Code, tc.status)
+		}
+	}
+}
+
+func TestPurgePatient(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.AdminToken = "admin-token"
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Storage = store
+	cookie, session := startPatient(t, s, "0012345678")
+	_, other := startPatient(t, s, "0098765432")
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"عکس نسخه"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	ctx := context.Background()
+	transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &pkg.Attachment{SessionID: session.ID, MessageID: transcript[0].ID, StorageKey: "attachments/" + session.ID + "/rx.png", ContentType: "image/png", Size: 3}
+	if err := store.Put(ctx, a.StorageKey, a.ContentType, []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Repo.CreateAttachment(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRequest(http.MethodPost, "/admin/patients/purge", `{"national_id":"0012345678"}`)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"sessions":1,"attachments":1}`+"\n" {
+		t.Fatalf("purge: status %d: %s", w.Code, w.Body)
+	}
+	if _, err := s.Repo.GetSessionByID(ctx, session.ID); err == nil {
+		t.Error("the purged session is still stored")
+	}
+	if _, err := store.Get(ctx, a.StorageKey); err == nil {
+		t.Error("the purged attachment's file is still stored")
+	}
+	if _, err := s.Repo.GetSessionByID(ctx, other.ID); err != nil {
+		t.Errorf("the other patient's session: %v", err)
+	}
+}
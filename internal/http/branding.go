@@ -0,0 +1,94 @@
+package http
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+
+	"waitroom-chatbot/pkg"
+)
+
+// defaultAccent is the colour of the chat page's buttons for clinics
+// without an accent colour of their own.
+const defaultAccent = "#0b74de"
+
+// branding is how a clinic's patient pages look: its display name, logo
+// and accent colour, each left out of the page when empty.  The zero value
+// is the default look.
+type branding struct {
+	Name   string
+	Logo   template.URL
+	Accent template.CSS
+}
+
+// Button returns the colour of the chat page's buttons.
+func (b branding) Button() template.CSS {
+	if b.Accent == "" {
+		return defaultAccent
+	}
+	return b.Accent
+}
+
+// accentPattern matches the accent colours a clinic may set.
+var accentPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// brandingFor returns the branding of a clinic.  A logo or accent colour
+// that is not of a form brandingFor accepts is dropped, so a bad value in
+// the clinics table cannot inject markup or styles into the page.
+func brandingFor(c *pkg.Clinic) branding {
+	var b branding
+	if c == nil {
+		return b
+	}
+	b.Name = c.DisplayName
+	if safeLogo(c.LogoURL) {
+		b.Logo = template.URL(c.LogoURL)
+	}
+	if accentPattern.MatchString(c.AccentColor) {
+		b.Accent = template.CSS(c.AccentColor)
+	}
+	return b
+}
+
+// safeLogo reports whether a logo URL may be used as an image source: an
+// http(s) URL, a path on this server or an embedded data:image URI (other
+// than SVG, which can carry scripts).
+func safeLogo(u string) bool {
+	switch {
+	case strings.HasPrefix(u, "https://"), strings.HasPrefix(u, "http://"):
+		return true
+	case strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//"):
+		return true
+	case strings.HasPrefix(u, "data:image/") && !strings.HasPrefix(u, "data:image/svg"):
+		return true
+	}
+	return false
+}
+
+// clinicName is the name a clinic is called by in greetings: its display
+// name, or its name when it has none.
+func clinicName(c *pkg.Clinic) string {
+	if c == nil {
+		return ""
+	}
+	if c.DisplayName != "" {
+		return c.DisplayName
+	}
+	return c.Name
+}
+
+// sessionClinic loads the clinic of a session, or nil when there is no
+// session or the clinic cannot be loaded.
+func (s *Server) sessionClinic(ctx context.Context, session *pkg.Session) *pkg.Clinic {
+	if session == nil {
+		return nil
+	}
+	clinic, err := s.Repo.GetClinic(ctx, session.ClinicID)
+	if err != nil {
+		log.Printf("load clinic %s of session %s: %v", session.ClinicID, session.ID, err)
+		return nil
+	}
+	return clinic
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// maxExtraMessages bounds a single cap override so a typo cannot lift the
+// cap for good.
+const maxExtraMessages = 500
+
+// defaultExtraMessages is what the doctor's "grant more messages" button
+// adds when the form does not say.
+const defaultExtraMessages = 10
+
+// handleCreateCapOverride grants a patient (national_id) or a session
+// (session_id) extra messages on top of the cap.  The grant lasts until
+// expires_at, by default the end of the current cap week.
+func (s *Server) handleCreateCapOverride(w http.ResponseWriter, r *http.Request) {
+	var o pkg.CapOverride
+	if !decodeJSON(w, r, &o) {
+		return
+	}
+	if o.NationalID == "" && o.SessionID == "" {
+		writeError(w, r, errs.New(errs.Invalid, "national_id or session_id is required"))
+		return
+	}
+	if o.SessionID != "" {
+		if _, err := s.Repo.GetSessionByID(r.Context(), o.SessionID); errs.Is(err, errs.NotFound) {
+			writeError(w, r, errs.New(errs.Invalid, "unknown session"))
+			return
+		} else if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := s.validateCapOverride(&o); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.grantCapOverride(r, &o); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// handleDoctorCapOverride grants the patient of a session extra messages
+// from the doctor's session page and re-renders the detail fragment.
+func (s *Server) handleDoctorCapOverride(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	o := pkg.CapOverride{SessionID: sessionID, ExtraMessages: defaultExtraMessages}
+	if v := r.FormValue("extra_messages"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, r, errs.New(errs.Invalid, "invalid extra_messages"))
+			return
+		}
+		o.ExtraMessages = n
+	}
+	if err := s.validateCapOverride(&o); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.grantCapOverride(r, &o); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// validateCapOverride checks the extra messages and expiry of an override,
+// defaulting the expiry to the end of the current cap week.  It returns an
+// Invalid error naming the problem, or nil when the override is valid.
+func (s *Server) validateCapOverride(o *pkg.CapOverride) error {
+	if o.ExtraMessages < 1 || o.ExtraMessages > maxExtraMessages {
+		return errs.Errorf(errs.Invalid, "extra_messages must be between 1 and %d", maxExtraMessages)
+	}
+	now := time.Now()
+	if o.ExpiresAt.IsZero() {
+		o.ExpiresAt = core.CapWeek(s.CapWeek).ResetsAt(now)
+	}
+	if !o.ExpiresAt.After(now) {
+		return errs.New(errs.Invalid, "expires_at must be in the future")
+	}
+	return nil
+}
+
+// grantCapOverride stores an override granted by the request's actor and
+// records the grant in the audit log.
+func (s *Server) grantCapOverride(r *http.Request, o *pkg.CapOverride) error {
+	o.GrantedBy = actor(r.Context())
+	if err := s.Repo.CreateCapOverride(r.Context(), o); err != nil {
+		return err
+	}
+	s.recordAccess(r, audit.ActionGrantCapOverride, o.SessionID)
+	return nil
+}
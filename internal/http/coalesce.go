@@ -0,0 +1,124 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+// replyCoalesced is replyAsync for a server with a CoalesceWindow: the
+// patient message is stored at once and the reply is generated in the
+// background once the window has passed, answering it together with the
+// patient messages before it the bot has yet to answer.  A message
+// arriving meanwhile, while the reply waits or is being generated,
+// supersedes it with a reply of its own that answers them all, so the
+// patient's page drops the earlier placeholder (see handleGetReply).  c is
+// the cap the message is checked against; over it nothing is stored and
+// db.ErrCapped returned.
+func (s *Server) replyCoalesced(ctx context.Context, session *pkg.Session, sessionID uuid.UUID, c *db.Cap, content, category string, received time.Time) (*pkg.PendingReply, error) {
+	patientMsg, pending, err := s.Repo.CreateCoalescedReply(ctx, sessionID, c, content)
+	if err != nil {
+		return nil, err
+	}
+	s.recordMessageMeta(ctx, patientMsg, nil, category, core.ReplyResult{})
+	base := s.sessionPrompts(ctx, session)
+	go func() {
+		ctx, cancel := context.WithTimeout(withLLMContext(context.Background(), session), pendingReplyTimeout)
+		defer cancel()
+		select {
+		case <-time.After(s.CoalesceWindow):
+		case <-ctx.Done():
+		}
+		err := s.answerCoalesced(ctx, base, session, sessionID, pending.ID, received)
+		if err != nil && !errors.Is(err, db.ErrReplySuperseded) {
+			log.Printf("coalesced reply %s for session %s: %v", pending.ID, session.ID, err)
+			if err := s.Repo.FailPendingReply(context.Background(), pending.ID, err.Error()); err != nil {
+				log.Printf("mark reply %s failed: %v", pending.ID, err)
+			}
+		}
+	}()
+	return pending, nil
+}
+
+// answerCoalesced generates and stores the coalesced reply replyID to the
+// patient messages the session ends with, again if the patient edits one
+// of them meanwhile.  It returns db.ErrReplySuperseded when another reply
+// answers them instead.
+func (s *Server) answerCoalesced(ctx context.Context, base core.Prompts, session *pkg.Session, sessionID uuid.UUID, replyID string, received time.Time) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+		if err != nil {
+			return err
+		}
+		_, turn := splitTurn(transcript)
+		if len(turn) == 0 {
+			if err := s.Repo.SupersedePendingReply(ctx, replyID); err != nil {
+				return err
+			}
+			return db.ErrReplySuperseded
+		}
+		recent, err := s.patientContext(ctx, session.ID)
+		if err != nil {
+			return err
+		}
+		history := messagesBefore(recent, turn[0].ID)
+		content := turnContent(turn)
+		prompts := s.recallPrompts(ctx, base, session, history, content)
+		res, err := s.Chat.ReplyWithPrompts(ctx, prompts, content, history)
+		if err != nil {
+			return err
+		}
+		botMsg, err := s.Repo.CompleteCoalescedReply(ctx, replyID, sessionID, turn, res.Text)
+		if errors.Is(err, db.ErrMessageEdited) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.recordMessageMeta(ctx, &turn[len(turn)-1], botMsg, "", res)
+		s.recordLatency(ctx, session.ID, botMsg, time.Since(received), res.Latency)
+		return nil
+	}
+}
+
+// splitTurn splits a transcript into the messages before the patient's
+// current turn and the turn itself: the patient messages it ends with.
+func splitTurn(transcript []pkg.Message) (history, turn []pkg.Message) {
+	i := len(transcript)
+	for i > 0 && transcript[i-1].Role == pkg.RolePatient {
+		i--
+	}
+	return transcript[:i], transcript[i:]
+}
+
+// messagesBefore returns the messages of transcript before the one with the
+// given ID, all of them when it holds no such message.
+func messagesBefore(transcript []pkg.Message, id int64) []pkg.Message {
+	for i, m := range transcript {
+		if m.ID == id {
+			return transcript[:i]
+		}
+	}
+	return transcript
+}
+
+// turnContent joins the patient messages of a turn, one per line, into the
+// message the LLM answers.
+func turnContent(turn []pkg.Message) string {
+	parts := make([]string, len(turn))
+	for i, m := range turn {
+		parts[i] = m.Content
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressWriter compresses the response body with gzip or deflate.  The
+// decision is made when the body starts, so handlers can still set their
+// Content-Type (or Content-Encoding) first; responses that are already
+// compressed, SSE streams and bodiless statuses pass through unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	enc      io.WriteCloser
+	status   int
+	started  bool
+}
+
+// compressResponse wraps w when the client accepts gzip or deflate.  The
+// caller must Close the returned writer.  WebSocket upgrades are never
+// wrapped since they hijack the connection.
+func compressResponse(w http.ResponseWriter, r *http.Request) (*compressWriter, bool) {
+	if r.Header.Get("Upgrade") != "" {
+		return nil, false
+	}
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil, false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, encoding: encoding}, true
+}
+
+// withCompression compresses the responses of clients accepting it,
+// unless DisableCompression is set.
+func (s *Server) withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.DisableCompression {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cw, ok := compressResponse(w, r); ok {
+			defer cw.Close()
+			w = cw
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip and honouring q=0.
+func acceptedEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.started || c.status != 0 {
+		return
+	}
+	c.status = status
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.started {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.start()
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// start writes the header, switching to compression when the response
+// qualifies.
+func (c *compressWriter) start() {
+	c.started = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	h := c.Header()
+	if compressible(c.status, h) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if c.encoding == "gzip" {
+			c.enc = gzip.NewWriter(c.ResponseWriter)
+		} else {
+			c.enc, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+}
+
+// compressible reports whether a response with this status and header
+// should be compressed.
+func compressible(status int, h http.Header) bool {
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := strings.ToLower(h.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(ct, "text/event-stream"):
+		return false // must reach the browser event by event
+	case strings.HasPrefix(ct, "image/") && !strings.HasPrefix(ct, "image/svg"),
+		strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"),
+		strings.Contains(ct, "zip"), strings.Contains(ct, "compressed"),
+		strings.HasPrefix(ct, "application/pdf"):
+		return false
+	}
+	return true
+}
+
+// Flush flushes compressed data written so far, for streaming handlers.
+func (c *compressWriter) Flush() {
+	if !c.started {
+		c.start()
+	}
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes the header of an empty response and finishes the
+// compressed stream.
+func (c *compressWriter) Close() error {
+	if !c.started {
+		// Nothing was written (e.g. a redirect or a bare status); there is no
+		// body to compress.
+		c.started = true
+		if c.status != 0 {
+			c.ResponseWriter.WriteHeader(c.status)
+		}
+		return nil
+	}
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
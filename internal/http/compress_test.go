@@ -0,0 +1,225 @@
+package http
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"GZIP":                    "gzip",
+		"deflate":                 "deflate",
+		"deflate, gzip;q=0.5":     "gzip",
+		"gzip;q=0, deflate":       "deflate",
+		"gzip; q=0":               "",
+		"gzip;q=0.0, deflate;q=0": "",
+		"br, gzip":                "gzip",
+		"*":                       "",
+	}
+	for header, want := range tests {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		status          int
+		contentType     string
+		contentEncoding string
+		want            bool
+	}{
+		{200, "text/html; charset=utf-8", "", true},
+		{200, "application/json", "", true},
+		{404, "text/plain; charset=utf-8", "", true},
+		{200, "image/svg+xml", "", true},
+		{200, "text/event-stream", "", false},
+		{200, "image/png", "", false},
+		{200, "application/zip", "", false},
+		{200, "application/pdf", "", false},
+		{200, "text/html", "br", false},
+		{204, "", "", false},
+		{304, "text/html", "", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Content-Type", tt.contentType)
+		if tt.contentEncoding != "" {
+			h.Set("Content-Encoding", tt.contentEncoding)
+		}
+		if got := compressible(tt.status, h); got != tt.want {
+			t.Errorf("compressible(%d, %q, %q) = %t", tt.status, tt.contentType, tt.contentEncoding, got)
+		}
+	}
+}
+
+// decompress returns the body of a response in its Content-Encoding.
+func decompress(t testing.TB, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var r io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case "deflate":
+		r = flate.NewReader(w.Body)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompression(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	for _, content := range []string{"از دیروز سردرد دارم", "تب هم دارم"} {
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {content}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: status %d", resp.StatusCode)
+		}
+	}
+	get := func(target, encoding string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodGet, target, nil)
+		r.AddCookie(cookie)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	plain := get("/chat", "")
+	if plain.Code != http.StatusOK || plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("uncompressed chat page: %d, %q", plain.Code, plain.Header().Get("Content-Encoding"))
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		w := get("/chat", encoding)
+		if w.Header().Get("Content-Encoding") != encoding || !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%s: Content-Encoding %q, Vary %q", encoding, w.Header().Get("Content-Encoding"), w.Header().Get("Vary"))
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Length %s of the uncompressed body", encoding, w.Header().Get("Content-Length"))
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s: Content-Type %q", encoding, w.Header().Get("Content-Type"))
+		}
+		if w.Body.Len() >= plain.Body.Len() {
+			t.Errorf("%s: %d bytes, not smaller than %d", encoding, w.Body.Len(), plain.Body.Len())
+		}
+		if body := decompress(t, w); body != plain.Body.String() {
+			t.Errorf("%s: decompressed page differs from the uncompressed one", encoding)
+		}
+	}
+
+	// HTMX fragments are compressed too.
+	r := newRequest(http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"گلودرد ندارم"}})
+	r.AddCookie(cookie)
+	r.Header.Set("HX-Request", "true")
+	r.Header.Set("Accept-Encoding", "gzip")
+	fragment := httptest.NewRecorder()
+	s.ServeHTTP(fragment, r)
+	if body := decompress(t, fragment); fragment.Code != http.StatusOK || fragment.Header().Get("Content-Encoding") != "gzip" || !strings.Contains(body, `class="msg bot"`) {
+		t.Errorf("message fragment: %d, %q: %s", fragment.Code, fragment.Header().Get("Content-Encoding"), body)
+	}
+
+	s.DisableCompression = true
+	if w := get("/chat", "gzip"); w.Header().Get("Content-Encoding") != "" || w.Body.String() != get("/chat", "").Body.String() {
+		t.Errorf("compressed with DisableCompression: %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressWriterPassThrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		compressed  bool
+	}{
+		{"html", "text/html; charset=utf-8", "", true},
+		{"event stream", "text/event-stream", "", false},
+		{"image", "image/jpeg", "", false},
+		{"already encoded", "text/html", "gzip", false},
+	}
+	// A response without a body gets no Content-Encoding.
+	r := httptest.NewRequest(http.MethodPost, "/start", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	(&Server{}).withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/chat", http.StatusSeeOther)
+	})).ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+		t.Errorf("redirect: %d, %q, %d bytes", w.Code, w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+
+	body := strings.Repeat("سلام دنیا ", 200)
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h := (&Server{}).withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				w.Header().Set("Content-Encoding", tt.encoding)
+			}
+			w.Header().Set("Content-Length", "2200")
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			io.WriteString(w, body[len(body)/2:])
+		}))
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: status %d", tt.name, w.Code)
+		}
+		if compressed := w.Header().Get("Content-Encoding") == "gzip" && tt.encoding == ""; compressed != tt.compressed {
+			t.Errorf("%s: compressed %t, want %t", tt.name, compressed, tt.compressed)
+		}
+		if tt.compressed {
+			if decompress(t, w) != body || w.Header().Get("Content-Length") != "" {
+				t.Errorf("%s: body or Content-Length wrong", tt.name)
+			}
+		} else if w.Body.String() != body {
+			t.Errorf("%s: body changed", tt.name)
+		}
+	}
+}
+
+// BenchmarkChatPage serves a chat page with a history, reporting the size
+// of the response with and without compression.
+func BenchmarkChatPage(b *testing.B) {
+	s, _ := newTestServer(b)
+	s.MessageCap = 100
+	cookie, session := startPatient(b, s, "0012345678")
+	for i := 0; i < 20; i++ {
+		serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"از دیروز سردرد دارم و کمی تب هم کرده‌ام"}}, cookie)
+	}
+	for _, encoding := range []string{"identity", "gzip"} {
+		b.Run(encoding, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				r := newRequest(http.MethodGet, "/chat", nil)
+				r.AddCookie(cookie)
+				r.Header.Set("Accept-Encoding", encoding)
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, r)
+				size = w.Body.Len()
+			}
+			b.ReportMetric(float64(size), "bytes/page")
+		})
+	}
+}
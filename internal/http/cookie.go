@@ -0,0 +1,131 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patientCookie names the cookie identifying the patient: their national
+// ID, when they filled in the start form in Unix seconds and the signature
+// of both by Server.CookieKey, separated by dots.
+const patientCookie = "national_id"
+
+// Default patient cookie lifetimes; see Server.CookieMaxAge and
+// Server.CookieAbsoluteMaxAge.
+const (
+	defaultCookieMaxAge         = 30 * 24 * time.Hour
+	defaultCookieAbsoluteMaxAge = 90 * 24 * time.Hour
+)
+
+// cookieExpiredKey marks the context of a request whose patient cookie
+// was dropped for being too old (see withPatientCookie).
+type cookieExpiredKey struct{}
+
+// cookieExpired reports whether the patient cookie of the request was
+// dropped for being too old.
+func cookieExpired(ctx context.Context) bool {
+	expired, _ := ctx.Value(cookieExpiredKey{}).(bool)
+	return expired
+}
+
+// signPatientCookie returns the signature of a patient cookie's national
+// ID and issued time: their HMAC-SHA256 by CookieKey, in URL-safe base64.
+func (s *Server) signPatientCookie(nationalID, unix string) string {
+	h := hmac.New(sha256.New, s.CookieKey)
+	h.Write([]byte(nationalID + "." + unix))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// parsePatientCookie verifies a patient cookie value and splits it into
+// the national ID and the time it was issued.  ok is false for a malformed
+// or forged value, including those of cookies issued before they were
+// signed.
+func (s *Server) parsePatientCookie(value string) (nationalID string, issued time.Time, ok bool) {
+	i, j := strings.Index(value, "."), strings.LastIndex(value, ".")
+	if i <= 0 || i == j {
+		return "", time.Time{}, false
+	}
+	nationalID, unix, sig := value[:i], value[i+1:j], value[j+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.signPatientCookie(nationalID, unix))) {
+		return "", time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return nationalID, time.Unix(sec, 0), true
+}
+
+// cookieLifetimes returns the configured lifetimes of the patient cookie,
+// the defaults where unset.
+func (s *Server) cookieLifetimes() (maxAge, absolute time.Duration) {
+	maxAge, absolute = s.CookieMaxAge, s.CookieAbsoluteMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultCookieMaxAge
+	}
+	if absolute <= 0 {
+		absolute = defaultCookieAbsoluteMaxAge
+	}
+	return maxAge, absolute
+}
+
+// setPatientCookie sets the patient cookie of a national ID issued at
+// issued.  The browser keeps it for CookieMaxAge, but never past
+// CookieAbsoluteMaxAge after it was issued.
+func (s *Server) setPatientCookie(w http.ResponseWriter, r *http.Request, nationalID string, issued time.Time) {
+	maxAge, absolute := s.cookieLifetimes()
+	unix := strconv.FormatInt(issued.Unix(), 10)
+	if left := time.Until(issued.Add(absolute)); left < maxAge {
+		maxAge = left
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     patientCookie,
+		Value:    nationalID + "." + unix + "." + s.signPatientCookie(nationalID, unix),
+		Path:     "/",
+		MaxAge:   int(math.Ceil(maxAge.Seconds())), // 0 would make it a session cookie
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// withPatientCookie keeps patient cookies in use alive and retires old
+// ones.  A valid cookie is set again on the response, so its lifetime
+// rolls with the patient's activity.  One issued more than
+// CookieAbsoluteMaxAge ago, forged or in an older format is deleted and
+// hidden from the handlers, which see a request without one; /chat then
+// sends the patient to the start form with a notice (see cookieExpired).
+func (s *Server) withPatientCookie(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(patientCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, absolute := s.cookieLifetimes()
+		nationalID, issued, ok := s.parsePatientCookie(c.Value)
+		if ok && time.Since(issued) < absolute {
+			s.setPatientCookie(w, r, nationalID, issued)
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: patientCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: isHTTPS(r), SameSite: http.SameSiteLaxMode})
+		cookies := r.Cookies()
+		r = r.WithContext(context.WithValue(r.Context(), cookieExpiredKey{}, true))
+		r.Header = r.Header.Clone()
+		r.Header.Del("Cookie")
+		for _, other := range cookies {
+			if other.Name != patientCookie {
+				r.AddCookie(other)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
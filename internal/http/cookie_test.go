@@ -0,0 +1,93 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForgedPatientCookie(t *testing.T) {
+	s, _ := newTestServer(t)
+	_, session := startPatient(t, s, "0012345678")
+	mine, _ := startPatient(t, s, "0098765432")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := mine.Value[strings.LastIndex(mine.Value, ".")+1:]
+	forged := []struct {
+		name, value string
+	}{
+		{"unsigned", "0012345678." + now},
+		{"signature of another cookie", "0012345678." + now + "." + sig},
+		{"empty signature", "0012345678." + now + "."},
+		{"other key", signedCookie(&Server{CookieKey: []byte("guessed")}, "0012345678", time.Now()).Value},
+	}
+	for _, f := range forged {
+		t.Run(f.name, func(t *testing.T) {
+			c := &http.Cookie{Name: patientCookie, Value: f.value}
+			resp := serve(s, http.MethodGet, "/chat", nil, c)
+			if loc, _, _ := strings.Cut(resp.Header.Get("Location"), "?"); resp.StatusCode != http.StatusSeeOther || loc != "/" {
+				t.Errorf("chat: %d to %q, want 303 to the start form", resp.StatusCode, resp.Header.Get("Location"))
+			}
+			for _, target := range []string{"/chat/history", "/ws/sessions/" + session.ID} {
+				if resp := serve(s, http.MethodGet, target, nil, c); resp.StatusCode != http.StatusNotFound {
+					t.Errorf("GET %s: %d, want 404", target, resp.StatusCode)
+				}
+			}
+			resp = serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سلام"}}, c)
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("message: %d, want 404", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// signedCookie returns the patient cookie s would set for a national ID
+// issued at issued.
+func signedCookie(s *Server, nationalID string, issued time.Time) *http.Cookie {
+	unix := strconv.FormatInt(issued.Unix(), 10)
+	return &http.Cookie{Name: patientCookie, Value: nationalID + "." + unix + "." + s.signPatientCookie(nationalID, unix)}
+}
+
+func TestPatientCookieExpiry(t *testing.T) {
+	s, _ := newTestServer(t)
+	startPatient(t, s, "0012345678")
+	s.CookieMaxAge, s.CookieAbsoluteMaxAge = 24*time.Hour, 10*24*time.Hour
+	day := 24 * time.Hour
+
+	// A fresh cookie is set again, its lifetime rolling.
+	resp := serve(s, http.MethodGet, "/chat", nil, signedCookie(s, "0012345678", time.Now().Add(-day)))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("fresh cookie: status %d", resp.StatusCode)
+	}
+	if c := patientCookieOf(t, resp); c.MaxAge != int(day.Seconds()) {
+		t.Errorf("rolled cookie lasts %ds, want %ds", c.MaxAge, int(day.Seconds()))
+	}
+	// Near the absolute age it lasts only until then.
+	resp = serve(s, http.MethodGet, "/chat", nil, signedCookie(s, "0012345678", time.Now().Add(-10*day+time.Hour)))
+	if c := patientCookieOf(t, resp); resp.StatusCode != http.StatusOK || c.MaxAge <= 0 || c.MaxAge > int(time.Hour.Seconds()) {
+		t.Errorf("cookie near its absolute age: status %d, lasts %ds, want at most an hour", resp.StatusCode, c.MaxAge)
+	}
+
+	// An expired cookie is deleted and the patient sent to the start form.
+	expired := signedCookie(s, "0012345678", time.Now().Add(-11*day))
+	resp = serve(s, http.MethodGet, "/chat", nil, expired)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/?expired=1" {
+		t.Errorf("expired cookie: %d to %q, want 303 to /?expired=1", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if c := patientCookieOf(t, resp); c.MaxAge >= 0 {
+		t.Errorf("expired cookie not deleted: Max-Age %d", c.MaxAge)
+	}
+
+	// Rewriting the issued time of an expired cookie breaks its signature.
+	sig := expired.Value[strings.LastIndex(expired.Value, ".")+1:]
+	tampered := &http.Cookie{Name: patientCookie, Value: "0012345678." + strconv.FormatInt(time.Now().Unix(), 10) + "." + sig}
+	resp = serve(s, http.MethodGet, "/chat", nil, tampered)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/?expired=1" {
+		t.Errorf("tampered cookie: %d to %q, want 303 to /?expired=1", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := serve(s, http.MethodGet, "/chat/history", nil, tampered); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("history with a tampered cookie: %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,159 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxJSONBody bounds the JSON request bodies decodeJSON reads.
+const maxJSONBody = 1 << 20
+
+// inputError is a request body the API rejects, answered with its status
+// and {"error": Message, "field": Field}.  Field is the JSON name of the
+// offending field, empty when the body as a whole is wrong.
+type inputError struct {
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *inputError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// writeInputError writes err as a JSON error response.
+func writeInputError(w http.ResponseWriter, err *inputError) {
+	writeJSON(w, err.Status, err)
+}
+
+// isJSON reports whether the request body is declared as JSON.
+func isJSON(r *http.Request) bool {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t == "application/json"
+}
+
+// decodeJSON reads a single JSON object from the request body into v, a
+// pointer to a struct, and checks its validate tags.  Unknown fields,
+// trailing data and bodies over maxJSONBody are rejected.  It writes the
+// error response and returns false when the body is not acceptable.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := readJSON(w, r, v); err != nil {
+		writeInputError(w, err)
+		return false
+	}
+	if err := validate(v); err != nil {
+		writeInputError(w, err)
+		return false
+	}
+	return true
+}
+
+// readJSON decodes the request body into v, describing a failure by the
+// field it concerns where there is one.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) *inputError {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if dec.More() || dec.Decode(&struct{}{}) != io.EOF {
+			return &inputError{Status: http.StatusBadRequest, Message: "body must hold a single JSON object"}
+		}
+		return nil
+	}
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &inputError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("body exceeds %d bytes", maxJSONBody)}
+	case errors.As(err, &syntax):
+		return &inputError{Status: http.StatusBadRequest, Message: fmt.Sprintf("malformed JSON at offset %d", syntax.Offset)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &inputError{Status: http.StatusBadRequest, Message: "malformed JSON: unexpected end of body"}
+	case errors.Is(err, io.EOF):
+		return &inputError{Status: http.StatusBadRequest, Message: "body is empty"}
+	case errors.As(err, &typ):
+		return &inputError{Status: http.StatusBadRequest, Field: typ.Field, Message: "must be " + jsonType(typ.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder reports unknown fields only in the message.
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return &inputError{Status: http.StatusBadRequest, Field: field, Message: "unknown field"}
+	}
+	return &inputError{Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// jsonType names the JSON type a Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// validate checks the validate tags of the fields of the struct v points
+// to: "required" rejects a blank string or a zero number, and "max=N" a
+// string longer than N characters or a number above N.
+func validate(v interface{}) *inputError {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" {
+			name = f.Name
+		}
+		fv := rv.Field(i)
+		for _, rule := range strings.Split(tag, ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			switch rule {
+			case "required":
+				if fv.Kind() == reflect.String && strings.TrimSpace(fv.String()) == "" || fv.IsZero() {
+					return &inputError{Status: http.StatusBadRequest, Field: name, Message: "is required"}
+				}
+			case "max":
+				n, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					panic("validate: bad max in tag of " + rt.Name() + "." + f.Name)
+				}
+				switch fv.Kind() {
+				case reflect.String:
+					if int64(utf8.RuneCountInString(fv.String())) > n {
+						return &inputError{Status: http.StatusBadRequest, Field: name, Message: fmt.Sprintf("must be at most %d characters", n)}
+					}
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					if fv.Int() > n {
+						return &inputError{Status: http.StatusBadRequest, Field: name, Message: fmt.Sprintf("must be at most %d", n)}
+					}
+				}
+			default:
+				panic("validate: unknown rule " + rule + " in tag of " + rt.Name() + "." + f.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.AdminToken = "admin-token"
+	cookie, session := startPatient(t, s, "0012345678")
+	messages := "/api/sessions/" + session.ID + "/messages"
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		admin  bool
+		status int
+		field  string
+		error  string
+	}{
+		{name: "message", target: messages, body: `{"content":"سردرد دارم"}`, status: http.StatusOK},
+		{name: "empty message", target: messages, body: `{"content":""}`, status: http.StatusBadRequest, field: "content", error: "is required"},
+		{name: "blank message", target: messages, body: `{"content":"  \n"}`, status: http.StatusBadRequest, field: "content", error: "is required"},
+		{name: "missing content", target: messages, body: `{}`, status: http.StatusBadRequest, field: "content", error: "is required"},
+		{name: "long message", target: messages, body: `{"content":"` + strings.Repeat("د", 4001) + `"}`, status: http.StatusBadRequest, field: "content", error: "must be at most 4000 characters"},
+		{name: "content not a string", target: messages, body: `{"content":5}`, status: http.StatusBadRequest, field: "content", error: "must be a string"},
+		{name: "unknown field", target: messages, body: `{"content":"سلام","role":"bot"}`, status: http.StatusBadRequest, field: "role", error: "unknown field"},
+		{name: "trailing object", target: messages, body: `{"content":"سلام"} {}`, status: http.StatusBadRequest, error: "body must hold a single JSON object"},
+		{name: "truncated", target: messages, body: `{"content":`, status: http.StatusBadRequest, error: "malformed JSON: unexpected end of body"},
+		{name: "syntax error", target: messages, body: `{"content" "سلام"}`, status: http.StatusBadRequest, error: "malformed JSON at offset 12"},
+		{name: "empty body", target: messages, body: ``, status: http.StatusBadRequest, error: "body is empty"},
+		{name: "array", target: messages, body: `["سلام"]`, status: http.StatusBadRequest, error: "must be an object"},
+		{name: "too large", target: messages, body: `{"content":"` + strings.Repeat("a", maxJSONBody) + `"}`, status: http.StatusRequestEntityTooLarge, error: "body exceeds 1048576 bytes"},
+
+		{name: "cap override", target: "/admin/cap-overrides", admin: true, body: `{"national_id":"0012345678","extra_messages":5}`, status: http.StatusCreated},
+		{name: "cap override without extra messages", target: "/admin/cap-overrides", admin: true, body: `{"national_id":"0012345678"}`, status: http.StatusBadRequest, field: "extra_messages", error: "is required"},
+		{name: "cap override count as string", target: "/admin/cap-overrides", admin: true, body: `{"national_id":"0012345678","extra_messages":"5"}`, status: http.StatusBadRequest, field: "extra_messages", error: "must be an integer"},
+		{name: "cap override long national id", target: "/admin/cap-overrides", admin: true, body: `{"national_id":"` + strings.Repeat("1", 33) + `","extra_messages":5}`, status: http.StatusBadRequest, field: "national_id", error: "must be at most 32 characters"},
+		{name: "cap override unknown field", target: "/admin/cap-overrides", admin: true, body: `{"national_id":"0012345678","extra_messages":5,"reason":"x"}`, status: http.StatusBadRequest, field: "reason", error: "unknown field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(http.MethodPost, tt.target, tt.body)
+			r.AddCookie(cookie)
+			if tt.admin {
+				r.Header.Set("Authorization", "Bearer admin-token")
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.error == "" {
+				return
+			}
+			var got inputError
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("error body %q: %v", w.Body, err)
+			}
+			if got.Field != tt.field || got.Message != tt.error {
+				t.Errorf("error %+v, want field %q and error %q", got, tt.field, tt.error)
+			}
+		})
+	}
+}
+
+// TestMessageFormValidated checks that messages posted as forms are held
+// to the same rules as JSON ones.
+func TestMessageFormValidated(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	for _, content := range []string{" ", strings.Repeat("د", 4001)} {
+		resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {content}}, cookie)
+		if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, `"kind":"invalid"`) {
+			t.Errorf("message of %d characters: status %d %s, want 400", len([]rune(content)), resp.StatusCode, body)
+		}
+	}
+	if len(fake.ChatCalls) != 0 {
+		t.Errorf("%d chat calls for rejected messages", len(fake.ChatCalls))
+	}
+}
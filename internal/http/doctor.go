@@ -0,0 +1,580 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/cursor"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// authorizeDoctor checks HTTP Basic credentials against DoctorUsers and
+// returns the request with the doctor's name attached as the actor and
+// their clinic from DoctorClinics.  It writes the error response and
+// returns nil when access is denied, as it always is without DoctorUsers
+// unless OpenDoctorRoutes is set.
+func (s *Server) authorizeDoctor(w http.ResponseWriter, r *http.Request) *http.Request {
+	if len(s.DoctorUsers) == 0 && s.OpenDoctorRoutes {
+		return r
+	}
+	user, pass, ok := r.BasicAuth()
+	want, known := s.DoctorUsers[user]
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="doctor"`)
+		writeError(w, r, errUnauthorized)
+		return nil
+	}
+	ctx := context.WithValue(r.Context(), actorKey, user)
+	return r.WithContext(context.WithValue(ctx, clinicKey, s.DoctorClinics[user]))
+}
+
+// requireDoctor serves only requests authenticated by authorizeDoctor.
+func (s *Server) requireDoctor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r = s.authorizeDoctor(w, r); r != nil {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// routeDoctor routes the /doctor pages.
+func (s *Server) routeDoctor(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/doctor":
+		s.handleDoctorDashboard(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/doctor/search":
+		s.handleDoctorSearch(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/doctor/sessions":
+		s.handleDashboardPage(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/doctor/events":
+		s.handleEvents(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/doctor/events/stream":
+		s.handleEventStream(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/summary"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/summary")
+		s.handleRegenerateSummary(w, r, sessionID)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/reviewed"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/reviewed")
+		s.handleMarkReviewed(w, r, sessionID)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/redact"):
+		// /doctor/sessions/{id}/messages/{messageID}/redact
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 7 && parts[4] == "messages" {
+			s.handleRedactMessage(w, r, parts[3], parts[5])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/reassign"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/reassign")
+		s.handleReassignSession(w, r, sessionID)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/assign"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/assign")
+		s.handleAssignSession(w, r, sessionID)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/cap-overrides"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/cap-overrides")
+		s.handleDoctorCapOverride(w, r, sessionID)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/trace") && s.Tracing:
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/trace")
+		s.handleDoctorTrace(w, r, sessionID)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.HasSuffix(r.URL.Path, "/traces"):
+		sessionID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/doctor/sessions/"), "/traces")
+		s.handleDoctorTraces(w, r, sessionID)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/doctor/sessions/") && strings.Count(r.URL.Path, "/") == 3:
+		sessionID := strings.TrimPrefix(r.URL.Path, "/doctor/sessions/")
+		s.handleDoctorSession(w, r, sessionID)
+	default:
+		if !methodNotAllowed(w, r, doctorRoutes) {
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// recordAccess writes an audit entry for the current request.  It never
+// blocks on the database unless the audit queue is full.
+func (s *Server) recordAccess(r *http.Request, action, sessionID string) {
+	if s.Audit == nil {
+		return
+	}
+	s.Audit.Record(r.Context(), pkg.AuditEntry{
+		Actor:     actor(r.Context()),
+		Action:    action,
+		SessionID: sessionID,
+		RequestID: requestID(r.Context()),
+	})
+}
+
+// dashboardFilters maps the dashboard's ?status= values to the session
+// status they list.
+var dashboardFilters = map[string]pkg.SessionStatus{
+	"":         "",
+	"open":     pkg.StatusOpen,
+	"ready":    pkg.StatusReadyForDoctor,
+	"reviewed": pkg.StatusReviewed,
+}
+
+// dashboardPageSize is how many sessions the dashboard lists at a time.
+const dashboardPageSize = 50
+
+// dashboardCursorTTL is how long after the dashboard was loaded its "load
+// more" sentinel keeps working; the doctor then reloads the list.
+const dashboardCursorTTL = 30 * time.Minute
+
+// dashboardQuery holds the dashboard filters as given in the query string:
+// status (a dashboardFilters key), red_flag, the from and to dates
+// (YYYY-MM-DD, in Tehran) bounding when the session started, and mine,
+// keeping the doctor's own and the unassigned sessions.
+type dashboardQuery struct {
+	Status  string `json:"status,omitempty"`
+	RedFlag bool   `json:"red_flag,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Mine    bool   `json:"mine,omitempty"`
+}
+
+func parseDashboardQuery(q url.Values) dashboardQuery {
+	return dashboardQuery{Status: q.Get("status"), RedFlag: q.Get("red_flag") != "", From: q.Get("from"), To: q.Get("to"),
+		Mine: q.Get("mine") != ""}
+}
+
+// filter returns the preview filter q selects.
+func (q dashboardQuery) filter() (pkg.PreviewFilter, error) {
+	status, ok := dashboardFilters[q.Status]
+	if !ok {
+		return pkg.PreviewFilter{}, errs.New(errs.Invalid, "unknown status")
+	}
+	f := pkg.PreviewFilter{Status: status, RedFlag: q.RedFlag}
+	if q.From != "" {
+		t, err := time.ParseInLocation("2006-01-02", q.From, jalali.Tehran)
+		if err != nil {
+			return f, errs.New(errs.Invalid, "invalid from")
+		}
+		f.From = t
+	}
+	if q.To != "" {
+		t, err := time.ParseInLocation("2006-01-02", q.To, jalali.Tehran)
+		if err != nil {
+			return f, errs.New(errs.Invalid, "invalid to")
+		}
+		f.To = t.AddDate(0, 0, 1)
+	}
+	return f, nil
+}
+
+// url returns the dashboard URL with the filters of q.
+func (q dashboardQuery) url() string {
+	v := url.Values{}
+	for name, value := range map[string]string{"status": q.Status, "from": q.From, "to": q.To} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	if q.RedFlag {
+		v.Set("red_flag", "1")
+	}
+	if q.Mine {
+		v.Set("mine", "1")
+	}
+	if len(v) == 0 {
+		return "/doctor"
+	}
+	return "/doctor?" + v.Encode()
+}
+
+// dashboardCursor is the position of the dashboard's "load more" sentinel:
+// the filters of the list, the last preview listed and when the first page
+// was loaded.
+type dashboardCursor struct {
+	Query     dashboardQuery `json:"q"`
+	UpdatedAt time.Time      `json:"u"`
+	SessionID string         `json:"id"`
+	LoadedAt  time.Time      `json:"t"`
+}
+
+// previewsPage is the data of the "doctor_sessions" fragment: a page of the
+// dashboard's session list followed by the sentinel loading the next one.
+type previewsPage struct {
+	Sessions []pkg.DoctorSessionPreview
+	// Next is the cursor of the following page, empty on the last one.
+	Next string
+	// Updated counts the sessions changed since the list was loaded.  They
+	// have moved to its top, which was already fetched, so the doctor is
+	// offered to reload rather than miss them.
+	Updated int
+	// Expired is set instead of listing sessions when the cursor has
+	// outlived dashboardCursorTTL.
+	Expired bool
+	// Reload is the dashboard URL with the list's filters.
+	Reload string
+}
+
+// dashboardPage is the data of the "doctor" template.
+type dashboardPage struct {
+	previewsPage
+	Query dashboardQuery
+	// Assignment offers the "my patients" filter, when doctors log in.
+	Assignment bool
+}
+
+// handleDoctorDashboard renders the first page of the active sessions for
+// the doctor, most recently updated first, narrowed by the dashboardQuery
+// filters.  The rest is fetched from handleDashboardPage as the doctor
+// scrolls.
+func (s *Server) handleDoctorDashboard(w http.ResponseWriter, r *http.Request) {
+	q := parseDashboardQuery(r.URL.Query())
+	f, err := q.filter()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	page := previewsPage{}
+	f.Doctor, err = s.dashboardDoctor(r.Context(), q.Mine)
+	if err == nil {
+		page, err = s.previews(r.Context(), f, dashboardCursor{Query: q, LoadedAt: time.Now()})
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionViewDashboard, "")
+	s.render(w, r, "doctor", dashboardPage{previewsPage: page, Query: q, Assignment: len(s.DoctorUsers) > 0})
+}
+
+// handleDashboardPage serves GET /doctor/sessions?cursor=, the page of the
+// dashboard after the cursor of the previous one, as an HTML fragment
+// replacing its sentinel.
+func (s *Server) handleDashboardPage(w http.ResponseWriter, r *http.Request) {
+	var c dashboardCursor
+	if err := s.Cursors.Decode(r.URL.Query().Get("cursor"), &c); err != nil || c.SessionID == "" {
+		writeError(w, r, cursor.ErrInvalid)
+		return
+	}
+	f, err := c.Query.filter()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if time.Since(c.LoadedAt) > dashboardCursorTTL {
+		s.render(w, r, "doctor_sessions", previewsPage{Expired: true, Reload: c.Query.url()})
+		return
+	}
+	page := previewsPage{}
+	f.Doctor, err = s.dashboardDoctor(r.Context(), c.Query.Mine)
+	if err == nil {
+		page, err = s.previews(r.Context(), f, c)
+	}
+	if err == nil {
+		page.Updated, err = s.Repo.CountPreviewsUpdatedSince(r.Context(), doctorClinic(r.Context()), f, c.LoadedAt)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionViewDashboard, "")
+	s.render(w, r, "doctor_sessions", page)
+}
+
+// previews loads the dashboard page after c, or the first page when c has
+// no session, filtered by f (the filter of c.Query), and the cursor of the
+// page following it.
+func (s *Server) previews(ctx context.Context, f pkg.PreviewFilter, c dashboardCursor) (previewsPage, error) {
+	var after *pkg.PreviewCursor
+	if c.SessionID != "" {
+		after = &pkg.PreviewCursor{UpdatedAt: c.UpdatedAt, SessionID: c.SessionID}
+	}
+	// One more than a page tells whether there is a next one, so the last
+	// page never ends in a sentinel loading nothing.
+	sessions, err := s.Repo.ListSessionPreviews(ctx, doctorClinic(ctx), actor(ctx), f, after, dashboardPageSize+1)
+	if err != nil {
+		return previewsPage{}, err
+	}
+	page := previewsPage{Sessions: sessions, Reload: c.Query.url()}
+	if len(sessions) > dashboardPageSize {
+		page.Sessions = sessions[:dashboardPageSize]
+		last := page.Sessions[dashboardPageSize-1]
+		c.UpdatedAt, c.SessionID = last.UpdatedAt, last.SessionID
+		page.Next = s.Cursors.Encode(c)
+	}
+	return page, nil
+}
+
+// clinicSession loads a session of the doctor's clinic.  It writes the
+// error response and returns nil when the session does not exist or belongs
+// to another clinic.
+func (s *Server) clinicSession(w http.ResponseWriter, r *http.Request, sessionID string) *pkg.Session {
+	session, err := s.Repo.GetSessionByID(r.Context(), sessionID)
+	if errs.Is(err, errs.NotFound) || err == nil && session.ClinicID != doctorClinic(r.Context()) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+	return session
+}
+
+// summaryFailures describes the classes of summarisation errors (see
+// core.SummaryErrorClass) to the doctor.
+var summaryFailures = map[string]string{
+	core.SummaryErrInvalidJSON:    "پاسخ مدل قالب درستی نداشت",
+	core.SummaryErrRateLimited:    "سرویس هوش مصنوعی درخواست را به دلیل محدودیت تعداد نپذیرفت",
+	core.SummaryErrTimeout:        "پاسخ مدل به‌موقع نرسید",
+	core.SummaryErrUnavailable:    "سرویس هوش مصنوعی در دسترس نبود",
+	core.SummaryErrBudgetExceeded: "سقف هزینهٔ ماهانهٔ مدل پر شده است",
+	core.SummaryErrLLM:            "خطای سرویس هوش مصنوعی",
+	core.SummaryErrStore:          "خطای ذخیرهٔ خلاصه",
+}
+
+// sessionPage is the data of the "doctor_session" template.
+type sessionPage struct {
+	Session       *pkg.Session
+	Summary       *pkg.Summary
+	Medications   []core.Medication
+	Transcript    []pkg.Message
+	CapOverrides  []pkg.CapOverride
+	ExtraMessages int
+	// Tracing shows the switch for recording the session's model calls.
+	Tracing bool
+	// Doctors are those of the clinic the session can be assigned to, when
+	// doctors log in; Me is the logged in doctor and Assignee the doctor
+	// the session is assigned to, if any.
+	Doctors  []pkg.Doctor
+	Me       string
+	Assignee string
+	// NewFrom is the first of the NewCount messages written since the
+	// doctor last viewed the session, 0 on the first view.
+	NewFrom  int64
+	NewCount int
+	// SummaryStale warns that the summary may not reflect the conversation
+	// (see pkg.Summary.Stale); SummaryFailure describes why the latest
+	// attempt to regenerate it failed, if it did.
+	SummaryStale   bool
+	SummaryFailure string
+}
+
+// handleDoctorSession renders the summary and transcript of one session as
+// an HTMX fragment for the dashboard's detail pane.
+func (s *Server) handleDoctorSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session := s.clinicSession(w, r, sessionID)
+	if session == nil {
+		return
+	}
+	summary, err := s.Repo.GetSummary(r.Context(), sessionID)
+	if errs.Is(err, errs.NotFound) {
+		summary = &pkg.Summary{SessionID: sessionID}
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// The messages written since the doctor last looked are marked new;
+	// other doctors keep their own mark.
+	since, err := s.Repo.MarkSessionViewed(r.Context(), sessionID, actor(r.Context()))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var fresh []pkg.Message
+	if !since.IsZero() {
+		if fresh, err = s.Repo.GetMessagesSince(r.Context(), sessionID, since); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	transcript, err := s.Repo.GetSessionRecord(r.Context(), sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.loadAttachments(r.Context(), transcript)
+	var nationalID string
+	if session.PatientID != nil {
+		nationalID = *session.PatientID
+	}
+	overrides, err := s.Repo.ListActiveCapOverrides(r.Context(), nationalID, sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var doctors []pkg.Doctor
+	if len(s.DoctorUsers) > 0 {
+		if doctors, err = s.Repo.ListDoctors(r.Context(), session.ClinicID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	s.recordAccess(r, audit.ActionViewSession, sessionID)
+	data := sessionPage{Session: session, Summary: summary, Medications: core.SummaryMedications(summary.Structured), Transcript: transcript,
+		CapOverrides: overrides, ExtraMessages: defaultExtraMessages, Tracing: s.Tracing,
+		Doctors: doctors, Me: actor(r.Context())}
+	if session.AssignedDoctor != nil {
+		data.Assignee = *session.AssignedDoctor
+	}
+	if len(fresh) > 0 {
+		data.NewFrom, data.NewCount = fresh[0].ID, len(fresh)
+	}
+	var lastPatientMessage time.Time
+	for _, m := range transcript {
+		if m.Role == pkg.RolePatient {
+			lastPatientMessage = m.CreatedAt
+		}
+	}
+	data.SummaryStale = summary.Stale(lastPatientMessage, s.Repo.StaleSummaryAfter)
+	if a := summary.LastAttempt; a != nil && a.Status == pkg.AttemptFailed {
+		data.SummaryFailure = summaryFailures[a.Error]
+		if data.SummaryFailure == "" {
+			data.SummaryFailure = summaryFailures[core.SummaryErrLLM]
+		}
+	}
+	s.render(w, r, "doctor_session", data)
+}
+
+// handleRegenerateSummary regenerates a session summary on the doctor's
+// request and re-renders the detail fragment.  The LLM is only called when
+// the transcript changed since the last summary unless force=1 is posted.
+// A failed regeneration is recorded with the summary, so the fragment
+// shows it in the stale summary warning.
+func (s *Server) handleRegenerateSummary(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	force := r.FormValue("force") == "1"
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	s.recordAccess(r, audit.ActionRegenerateSummary, sessionID)
+	if _, err := s.refreshSummary(r.Context(), sessionID, force); err != nil {
+		log.Printf("regenerate summary of %s (request %s): %v", sessionID, requestID(r.Context()), err)
+	}
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// handleMarkReviewed marks a session reviewed by the doctor and re-renders
+// the detail fragment.  Closed sessions cannot be marked reviewed.
+func (s *Server) handleMarkReviewed(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	if err := s.Repo.UpdateSessionStatus(r.Context(), sessionID, pkg.StatusReviewed); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionMarkReviewed, sessionID)
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// handleReassignSession moves a session registered under a mistyped
+// national ID to the patient's real details and re-renders the detail
+// fragment.  The details go through the start form's checks (see
+// checkIdentity), and the change is audited with the old and new identity
+// in the same transaction.  The patient then starts again from the form
+// with the right national ID and continues the same session.
+func (s *Server) handleReassignSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	nationalID := strings.TrimSpace(r.FormValue("national_id"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	phone := strings.TrimSpace(r.FormValue("phone"))
+	if nationalID == "" || name == "" || phone == "" {
+		writeError(w, r, errMissingFields)
+		return
+	}
+	if err := s.checkIdentity(r.Context(), &pkg.User{NationalID: nationalID, Name: name, Phone: phone}); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	entry := pkg.AuditEntry{Actor: actor(r.Context()), Action: audit.ActionReassignSession, RequestID: requestID(r.Context())}
+	if err := s.Repo.ReassignSession(r.Context(), sessionID, nationalID, name, phone, entry); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// handleRedactMessage blanks a message of a session, e.g. another person's
+// details a patient pasted, and re-renders the detail fragment.  The summary
+// may repeat the content, so it is regenerated from scratch without the
+// message in the background rather than merged into.
+func (s *Server) handleRedactMessage(w http.ResponseWriter, r *http.Request, sessionID, messageID string) {
+	id, err := strconv.ParseInt(messageID, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	err = s.Repo.RedactMessage(r.Context(), sessionID, id, actor(r.Context()))
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionRedactMessage, sessionID)
+	go s.replaceSummary(sessionID)
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// searchResultLimit caps the number of messages returned by a search.
+const searchResultLimit = 100
+
+// searchGroup collects the hits of one session for the search page.
+type searchGroup struct {
+	SessionID   string
+	PatientName string
+	SessionAt   time.Time
+	Hits        []pkg.SearchHit
+}
+
+// searchPage is the data of the "doctor_search" template.
+type searchPage struct {
+	Query      string
+	NationalID string
+	Groups     []*searchGroup
+}
+
+// handleDoctorSearch searches message content across sessions and renders
+// the hits grouped by session, most recent match first.
+func (s *Server) handleDoctorSearch(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	nationalID := strings.TrimSpace(r.URL.Query().Get("national_id"))
+	hits, err := s.Repo.SearchMessages(r.Context(), query, nationalID, doctorClinic(r.Context()), searchResultLimit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if query != "" {
+		s.recordAccess(r, audit.ActionSearch, "")
+	}
+	var groups []*searchGroup
+	bySession := make(map[string]*searchGroup)
+	for _, h := range hits {
+		g, ok := bySession[h.SessionID]
+		if !ok {
+			g = &searchGroup{SessionID: h.SessionID, PatientName: h.PatientName, SessionAt: h.SessionAt}
+			bySession[h.SessionID] = g
+			groups = append(groups, g)
+		}
+		g.Hits = append(g.Hits, h)
+	}
+	data := searchPage{Query: query, NationalID: nationalID, Groups: groups}
+	s.render(w, r, "doctor_search", data)
+}
@@ -0,0 +1,426 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/pkg"
+)
+
+func TestDoctorAuthFailsClosed(t *testing.T) {
+	s, _ := newTestServer(t)
+	startPatient(t, s, "0012345678")
+	for _, target := range []string{"/doctor", "/doctor/search?q=x", "/doctor/events?since=0"} {
+		if resp := serve(s, "GET", target, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("GET %s without DoctorUsers: %d, want 401", target, resp.StatusCode)
+		}
+	}
+	s.OpenDoctorRoutes = true
+	if resp := serve(s, "GET", "/doctor", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /doctor with OpenDoctorRoutes: %d, want 200", resp.StatusCode)
+	}
+	// Logins, once configured, are required even with the opt-out set.
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	if resp := serve(s, "GET", "/doctor", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /doctor with DoctorUsers and no login: %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestRedactMessageReplacesSummary(t *testing.T) {
+	s, fake := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	cookie, session := startPatient(t, s, "0012345678")
+	const secret = "پنی‌سیلین"
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"به " + secret + " حساسیت دارم"}}, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	fake.SummaryReply = `{"key_points":["حساسیت به ` + secret + `"],"structured":{"allergies":["` + secret + `"]},"free_text":"بیمار به ` + secret + ` حساسیت دارد."}`
+	ctx := context.Background()
+	if _, err := s.refreshSummary(ctx, session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if summary, err := s.Repo.GetSummary(ctx, session.ID); err != nil || !strings.Contains(summaryJSON(t, summary), secret) {
+		t.Fatalf("summary before the redaction %+v, %v; want it to mention %s", summary, err, secret)
+	}
+	transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Merging into the stored summary would keep its key points and
+	// allergies; the redaction replaces it.
+	fake.SummaryReply = `{"key_points":["سردرد"],"structured":{},"free_text":"بیمار سردرد دارد."}`
+	req := newRequest(http.MethodPost, "/doctor/sessions/"+session.ID+"/messages/"+strconv.FormatInt(transcript[0].ID, 10)+"/redact", nil)
+	req.SetBasicAuth("dr", "pw")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("redact: status %d: %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary, err := s.Repo.GetSummary(ctx, session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if summary.FreeText == "بیمار سردرد دارد." {
+			if got := summaryJSON(t, summary); strings.Contains(got, secret) {
+				t.Errorf("summary after the redaction still mentions %s: %s", secret, got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("summary not regenerated after the redaction: %+v", summary)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveDoctor serves a request logged in as the doctor "dr" with password
+// "pw", the login tests configure in DoctorUsers.
+func serveDoctor(s *Server, method, target string, body interface{}) *httptest.ResponseRecorder {
+	r := newRequest(method, target, body)
+	r.SetBasicAuth("dr", "pw")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// summaryJSON returns the JSON of a summary.
+func summaryJSON(t *testing.T, summary *pkg.Summary) string {
+	t.Helper()
+	b, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDoctorSearch(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	for _, p := range []struct{ nationalID, content string }{
+		{"0012345678", "به پنی‌سیلین حساسیت دارم"},
+		{"0012345678", "پنی‌سیلین را دیروز خوردم"},
+		{"0098765432", "پنی‌سیلین مصرف نمی‌کنم"},
+		{"0011111111", "سردرد دارم"},
+	} {
+		cookie, session := startPatient(t, s, p.nationalID)
+		resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {p.content}}, cookie)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: status %d", resp.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		target       string
+		groups, hits int
+	}{
+		{"/doctor/search?q=" + url.QueryEscape("پنی‌سیلین"), 2, 3},
+		{"/doctor/search?q=" + url.QueryEscape("پنی‌سیلین") + "&national_id=0098765432", 1, 1},
+		{"/doctor/search?q=" + url.QueryEscape("آموکسی‌سیلین"), 0, 0},
+	}
+	for _, tt := range tests {
+		w := serveDoctor(s, http.MethodGet, tt.target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.target, w.Code)
+		}
+		body := w.Body.String()
+		if groups, hits := strings.Count(body, `class="group"`), strings.Count(body, "<mark>پنی‌سیلین</mark>"); groups != tt.groups || hits != tt.hits {
+			t.Errorf("%s: %d sessions with %d hits, want %d with %d", tt.target, groups, hits, tt.groups, tt.hits)
+		}
+		if tt.groups == 0 && !strings.Contains(body, "نتیجه‌ای یافت نشد") {
+			t.Errorf("%s: no empty result message", tt.target)
+		}
+	}
+	// Without a query the form is shown alone.
+	if body := serveDoctor(s, http.MethodGet, "/doctor/search", nil).Body.String(); strings.Contains(body, `class="group"`) || strings.Contains(body, "نتیجه‌ای یافت نشد") {
+		t.Errorf("search page without a query lists results")
+	}
+}
+
+func TestDashboardPriorityBadges(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	ctx := context.Background()
+	for i, priority := range []int{3, 2, 1, 0} {
+		_, session := startPatient(t, s, "001234567"+strconv.Itoa(i))
+		if err := s.Repo.UpsertSummary(ctx, &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, Priority: priority}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serveDoctor(s, http.MethodGet, "/doctor", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("dashboard: status %d", w.Code)
+	}
+	for _, badge := range []string{"priority-3", "priority-2", "priority-1"} {
+		if n := strings.Count(w.Body.String(), `class="badge `+badge+`"`); n != 1 {
+			t.Errorf("%d %s badges, want 1", n, badge)
+		}
+	}
+}
+
+func TestDoctorSessionUnmatchedMedication(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	_, session := startPatient(t, s, "0012345678")
+	summary := &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, Structured: map[string]interface{}{
+		"medications": []interface{}{"قرص متفورمین ۵۰۰", "قطره گیاهی"},
+	}}
+	if err := s.Repo.UpsertSummary(context.Background(), summary); err != nil {
+		t.Fatal(err)
+	}
+	w := serveDoctor(s, http.MethodGet, "/doctor/sessions/"+session.ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("session page: status %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "metformin") || !strings.Contains(body, "قطره گیاهی") {
+		t.Errorf("medications missing from the session page")
+	}
+	if n := strings.Count(body, "نامشخص</span>"); n != 1 {
+		t.Errorf("%d unmatched badges, want 1", n)
+	}
+}
+
+func TestDoctorSessionJalaliDates(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	cookie, session := startPatient(t, s, "0012345678")
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	// 21:00 UTC is half past midnight on Nowruz 1403 in Tehran.
+	if _, err := s.Repo.DB.Exec(`UPDATE messages SET created_at = '2024-03-19 21:00:00.000' WHERE session_id = $1`, session.ID); err != nil {
+		t.Fatal(err)
+	}
+	w := serveDoctor(s, http.MethodGet, "/doctor/sessions/"+session.ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("session page: status %d", w.Code)
+	}
+	if n := strings.Count(w.Body.String(), "۱۴۰۳/۰۱/۰۱ ۰۰:۳۰"); n != 2 {
+		t.Errorf("%d messages dated ۱۴۰۳/۰۱/۰۱ ۰۰:۳۰, want 2", n)
+	}
+}
+
+func TestOldMessagesInDoctorView(t *testing.T) {
+	s, fake := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	cookie, session := startPatient(t, s, "0012345678")
+	const early = "از دو هفته پیش سرفه دارم"
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {early}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	at := time.Now().Add(-8 * 24 * time.Hour).UTC().Format("2006-01-02 15:04:05.000")
+	if _, err := s.Repo.DB.Exec(`UPDATE messages SET created_at = $1 WHERE session_id = $2`, at, session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie)); strings.Contains(body, early) {
+		t.Error("patient chat page shows a message older than a week")
+	}
+	if body := serveDoctor(s, http.MethodGet, "/doctor/sessions/"+session.ID, nil).Body.String(); !strings.Contains(body, early) {
+		t.Error("doctor's session page leaves out a message older than a week")
+	}
+	fake.SummaryReply = `{"key_points":["سرفه"],"structured":{},"free_text":"بیمار سرفه دارد."}`
+	if _, err := s.refreshSummary(context.Background(), session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if prompt := fake.SummarizeCalls[0]; !strings.Contains(prompt, early) {
+		t.Errorf("summary prompt leaves out a message older than a week:\n%s", prompt)
+	}
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"هنوز سرفه دارم"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	for _, m := range fake.ChatCalls[len(fake.ChatCalls)-1] {
+		if strings.Contains(m.Content, early) {
+			t.Errorf("chat context sent to the model holds a message older than a week: %+v", m)
+		}
+	}
+}
+
+var (
+	listedSession = regexp.MustCompile(`hx-get="/doctor/sessions/([0-9a-f-]{36})"`)
+	nextCursor    = regexp.MustCompile(`hx-get="/doctor/sessions\?cursor=([^"]+)"`)
+)
+
+// dashboardPageOf returns the sessions listed on a dashboard page or
+// fragment and the cursor of the next page, "" on the last.
+func dashboardPageOf(t *testing.T, s *Server, target string) (sessions []string, next string, body string) {
+	t.Helper()
+	w := serveDoctor(s, http.MethodGet, target, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", target, w.Code, w.Body)
+	}
+	body = w.Body.String()
+	for _, m := range listedSession.FindAllStringSubmatch(body, -1) {
+		sessions = append(sessions, m[1])
+	}
+	if m := nextCursor.FindStringSubmatch(body); m != nil {
+		next = html.UnescapeString(m[1])
+	}
+	return sessions, next, body
+}
+
+func TestDashboardPages(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	ctx := context.Background()
+	// Two and a bit pages of sessions ready for the doctor, and a few open
+	// ones the status filter leaves out.
+	const ready = 2*dashboardPageSize + 10
+	var readyIDs, openIDs []string
+	for i := 0; i < ready+5; i++ {
+		nationalID := fmt.Sprintf("%010d", i+1)
+		if err := s.Repo.UpsertUser(ctx, &pkg.User{NationalID: nationalID, Phone: "09120000000", Name: "Sara"}, "", pkg.DefaultClinic, "fa", testMessageCap); err != nil {
+			t.Fatal(err)
+		}
+		session, err := s.Repo.GetLatestSession(ctx, nationalID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= ready {
+			openIDs = append(openIDs, session.ID)
+			continue
+		}
+		if err := s.Repo.UpdateSessionStatus(ctx, session.ID, pkg.StatusReadyForDoctor); err != nil {
+			t.Fatal(err)
+		}
+		readyIDs = append(readyIDs, session.ID)
+	}
+
+	seen := map[string]bool{}
+	list := func(sessions []string) {
+		t.Helper()
+		for _, id := range sessions {
+			if seen[id] {
+				t.Errorf("session %s listed twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	first, next, _ := dashboardPageOf(t, s, "/doctor?status=ready")
+	if len(first) != dashboardPageSize || next == "" {
+		t.Fatalf("first page of %d sessions, cursor %q", len(first), next)
+	}
+	list(first)
+
+	// A session not listed yet is updated and moves to the top, which was
+	// fetched already; an open session updated too is not counted.
+	time.Sleep(5 * time.Millisecond)
+	var moved string
+	for _, id := range readyIDs {
+		if !seen[id] {
+			moved = id
+			break
+		}
+	}
+	for _, id := range []string{moved, openIDs[0]} {
+		if err := s.Repo.UpsertSummary(ctx, &pkg.Summary{SessionID: id, KeyPoints: []string{"سردرد"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages := 1
+	for next != "" {
+		var sessions []string
+		var body string
+		sessions, next, body = dashboardPageOf(t, s, "/doctor/sessions?cursor="+url.QueryEscape(next))
+		pages++
+		list(sessions)
+		if !strings.Contains(body, "1 نوبت پس از بارگذاری") {
+			t.Errorf("page %d does not report the one updated session", pages)
+		}
+	}
+	if pages != 3 {
+		t.Errorf("%d pages, want 3", pages)
+	}
+	// Every ready session was listed once, except the one that moved up.
+	for _, id := range readyIDs {
+		if seen[id] == (id == moved) {
+			t.Errorf("session %s listed %v", id, seen[id])
+		}
+	}
+	for _, id := range openIDs {
+		if seen[id] {
+			t.Errorf("open session %s listed with the ready filter", id)
+		}
+	}
+	// Reloading lists it at the top.
+	if again, _, _ := dashboardPageOf(t, s, "/doctor?status=ready"); again[0] != moved {
+		t.Errorf("updated session not at the top after reloading")
+	}
+}
+
+func TestDashboardPageCursor(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	_, session := startPatient(t, s, "0012345678")
+	for _, c := range []string{"", "abc"} {
+		if w := serveDoctor(s, http.MethodGet, "/doctor/sessions?cursor="+c, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q: status %d, want 400", c, w.Code)
+		}
+	}
+	// The page after the last session is empty and ends the list.
+	after := dashboardCursor{Query: dashboardQuery{Status: "open"}, UpdatedAt: time.Unix(0, 0), SessionID: session.ID, LoadedAt: time.Now()}
+	sessions, next, _ := dashboardPageOf(t, s, "/doctor/sessions?cursor="+url.QueryEscape(s.Cursors.Encode(after)))
+	if len(sessions) != 0 || next != "" {
+		t.Errorf("page past the end: %v, cursor %q", sessions, next)
+	}
+	// An expired cursor offers to reload the list with its filters.
+	after.LoadedAt = time.Now().Add(-dashboardCursorTTL - time.Minute)
+	_, _, body := dashboardPageOf(t, s, "/doctor/sessions?cursor="+url.QueryEscape(s.Cursors.Encode(after)))
+	if !strings.Contains(body, "این فهرست قدیمی شده است") || !strings.Contains(body, `href="/doctor?status=open"`) {
+		t.Errorf("expired cursor: %s", body)
+	}
+}
+
+func TestReassignSession(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	s.CheckNationalID = true
+	_, session := startPatient(t, s, "0012345679")
+	ctx := context.Background()
+	if err := s.Repo.AddDenylistEntry(ctx, &pkg.DenylistEntry{Kind: pkg.DenyNationalID, Value: "0098765434", CreatedBy: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	target := "/doctor/sessions/" + session.ID + "/reassign"
+	form := func(nationalID string) url.Values {
+		return url.Values{"national_id": {nationalID}, "name": {"Reza"}, "phone": {"09121112233"}}
+	}
+
+	// The new details go through the start form's checks.
+	for _, nationalID := range []string{"0012345678", "0098765434"} {
+		if w := serveDoctor(s, http.MethodPost, target, form(nationalID)); w.Code != http.StatusBadRequest {
+			t.Errorf("reassign to %s: status %d, want 400", nationalID, w.Code)
+		}
+	}
+	if got, err := s.Repo.GetSessionByID(ctx, session.ID); err != nil || *got.PatientID != "0012345679" {
+		t.Fatalf("session after refused reassigns: %v", err)
+	}
+
+	if w := serveDoctor(s, http.MethodPost, target, form("0012345687")); w.Code != http.StatusOK {
+		t.Fatalf("reassign: status %d: %s", w.Code, w.Body.String())
+	}
+	entries, err := s.Repo.ListAuditEntries(ctx, pkg.AuditFilter{SessionID: session.ID, Action: audit.ActionReassignSession})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "dr" || entries[0].Details == "" {
+		t.Fatalf("audit log %+v, want one reassign by dr with details", entries)
+	}
+	if strings.Contains(entries[0].Details, "0012345679") || strings.Contains(entries[0].Details, "0012345687") {
+		t.Errorf("details %q hold a national ID in the clear", entries[0].Details)
+	}
+}
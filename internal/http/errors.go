@@ -0,0 +1,102 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg/errs"
+)
+
+var (
+	// errUnauthorized fails a request without the right credentials.
+	errUnauthorized = errs.New(errs.Unauthorized, "unauthorized")
+	// errInvalidForm fails a request whose form cannot be parsed.
+	errInvalidForm = errs.New(errs.Invalid, "invalid form")
+	// errMissingFields fails a form without a required field.
+	errMissingFields = errs.New(errs.Invalid, "missing fields")
+	// errSessionNotFound fails a request for a session that does not
+	// exist or is not the caller's.
+	errSessionNotFound = errs.New(errs.NotFound, "session not found")
+	// errSessionClosed fails a request the closed session no longer
+	// allows.
+	errSessionClosed = errs.New(errs.Conflict, "session closed")
+	// errReplyFailed reports a reply generated in the background that
+	// failed.
+	errReplyFailed = errs.New(errs.Unavailable, "reply failed")
+)
+
+// errorStatuses maps the kind of an error to the HTTP status it is
+// reported with; kinds not listed, Internal among them, are 500.
+var errorStatuses = map[errs.Kind]int{
+	errs.NotFound:     http.StatusNotFound,
+	errs.Invalid:      http.StatusBadRequest,
+	errs.Conflict:     http.StatusConflict,
+	errs.Unavailable:  http.StatusServiceUnavailable,
+	errs.Capped:       http.StatusTooManyRequests,
+	errs.Unauthorized: http.StatusUnauthorized,
+}
+
+// errorStatus returns the HTTP status for err by its kind (see errs.Kind).
+func errorStatus(err error) int {
+	if status, ok := errorStatuses[errs.KindOf(err)]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorMessage returns what a user is told of err: the catalog's message
+// for its kind in the locale.  The error's own text, which may carry SQL
+// or a provider's response, is only logged.
+func errorMessage(locale string, err error) string {
+	return i18n.T(locale, "error."+errs.KindOf(err).String())
+}
+
+// errorBody is the JSON body of a failed API request.
+type errorBody struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+// writeError reports a failed request: the status of err's kind with the
+// Persian message for it, as an errorBody under /api/ and as text
+// elsewhere.  Failures of the service are logged, as the response no
+// longer says what they were.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r.Context(), r.Method+" "+r.URL.Path, err)
+	writeErrorBody(w, r, i18n.Default, err)
+}
+
+// writeErrorBody writes the response of writeError, with the message in
+// the locale, without logging err.
+func writeErrorBody(w http.ResponseWriter, r *http.Request, locale string, err error) {
+	status, msg := errorStatus(err), errorMessage(locale, err)
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSON(w, status, errorBody{Error: msg, Kind: errs.KindOf(err).String()})
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// failTurn fails a chat turn with err, in the session's locale.
+func failTurn(ctx context.Context, t turn, locale string, err error) {
+	logError(ctx, "chat turn", err)
+	t.fail(locale, err)
+}
+
+// replyError classifies the failure of an LLM reply: whatever went wrong,
+// the model could not answer, and trying again later may succeed.
+func replyError(err error) error {
+	return errs.Wrap(errs.Unavailable, err)
+}
+
+// logError logs err when it is an Internal or Unavailable one, failures
+// of the service rather than of the request.
+func logError(ctx context.Context, what string, err error) {
+	switch errs.KindOf(err) {
+	case errs.Internal, errs.Unavailable:
+		log.Printf("%s (request %s): %v", what, requestID(ctx), err)
+	}
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/internal/storage"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{errs.New(errs.Internal, "db down"), http.StatusInternalServerError},
+		{errs.New(errs.NotFound, "no session"), http.StatusNotFound},
+		{errs.New(errs.Invalid, "bad"), http.StatusBadRequest},
+		{errs.New(errs.Conflict, "taken"), http.StatusConflict},
+		{errs.New(errs.Unavailable, "model down"), http.StatusServiceUnavailable},
+		{errs.New(errs.Capped, "cap reached"), http.StatusTooManyRequests},
+		{errs.New(errs.Unauthorized, "no key"), http.StatusUnauthorized},
+		{fmt.Errorf("no kind"), http.StatusInternalServerError},
+		{errs.New(errs.Unauthorized+1, "unknown kind"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		kind := errs.KindOf(tt.err)
+		t.Run(kind.String(), func(t *testing.T) {
+			if got := errorStatus(tt.err); got != tt.status {
+				t.Errorf("errorStatus = %d, want %d", got, tt.status)
+			}
+			// The message is the catalog's, never the error's own text.
+			msg := errorMessage(i18n.Default, tt.err)
+			if strings.Contains(msg, tt.err.Error()) {
+				t.Errorf("message %q leaks %q", msg, tt.err)
+			}
+			if _, ok := errorStatuses[kind]; ok && msg == "error."+kind.String() {
+				t.Errorf("no catalog message for %s", kind)
+			}
+
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/api/summaries", nil), tt.err)
+			var body errorBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("API body %q: %v", w.Body, err)
+			}
+			if w.Code != tt.status || body.Kind != kind.String() || body.Error != msg {
+				t.Errorf("API: %d %+v, want %d {%s %s}", w.Code, body, tt.status, msg, kind)
+			}
+
+			w = httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodPost, "/start", nil), tt.err)
+			if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != msg {
+				t.Errorf("page: %d %q, want %d %q", w.Code, w.Body, tt.status, msg)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("page Content-Type %q", ct)
+			}
+		})
+	}
+}
+
+func TestHandlerErrorKinds(t *testing.T) {
+	s, fake := newTestServer(t)
+	s.APIKey = "api-key"
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Storage = store
+	s.SetRouterConfig(s.DefaultRouterConfig())
+	cookie, session := startPatient(t, s, "0012345678")
+	sessionPath := "/api/sessions/" + session.ID
+	if resp := serve(s, http.MethodPost, sessionPath+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name    string
+		kind    errs.Kind
+		request func() *http.Response
+	}{
+		{"summaries without the API key", errs.Unauthorized, func() *http.Response {
+			return serve(s, http.MethodGet, "/api/summaries", nil)
+		}},
+		{"message to an unknown session", errs.NotFound, func() *http.Response {
+			return serve(s, http.MethodPost, "/api/sessions/"+uuid.NewString()+"/messages", url.Values{"content": {"سلام"}}, cookie)
+		}},
+		{"read receipt without seq", errs.Invalid, func() *http.Response {
+			return serve(s, http.MethodPost, sessionPath+"/read", url.Values{"seq": {"0"}}, cookie)
+		}},
+		{"edit of an answered message", errs.Conflict, func() *http.Response {
+			return serve(s, http.MethodPut, sessionPath+"/messages/last", url.Values{"content": {"سردرد شدید دارم"}}, cookie)
+		}},
+		{"retry past the limit", errs.Capped, func() *http.Response {
+			unanswered, err := s.Repo.CreateMessage(context.Background(), uuid.MustParse(session.ID), pkg.RolePatient, "از دیروز")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake.Err = errors.New("model down")
+			defer func() { fake.Err = nil }()
+			for i := 0; i < maxReplyRetries; i++ {
+				serve(s, http.MethodPost, retryPath(unanswered), nil, cookie)
+			}
+			return serve(s, http.MethodPost, retryPath(unanswered), nil, cookie)
+		}},
+		{"photo the model cannot answer", errs.Unavailable, func() *http.Response {
+			fake.Err = errors.New("model down")
+			defer func() { fake.Err = nil }()
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("file", "rx.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+			mw.Close()
+			r := httptest.NewRequest(http.MethodPost, sessionPath+"/attachments", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w.Result()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind.String(), func(t *testing.T) {
+			resp := tt.request()
+			var body errorBody
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("%s: body: %v", tt.name, err)
+			}
+			want := errorBody{Error: errorMessage(i18n.Default, errs.New(tt.kind, "")), Kind: tt.kind.String()}
+			if resp.StatusCode != errorStatuses[tt.kind] || body != want {
+				t.Errorf("%s: %d %+v, want %d %+v", tt.name, resp.StatusCode, body, errorStatuses[tt.kind], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// eventsPageSize is how many events one catch-up request or stream write
+// returns at most.
+const eventsPageSize = 500
+
+// eventsPollInterval is how often the event stream looks for new events.
+const eventsPollInterval = 2 * time.Second
+
+// eventsResponse is the body of GET /doctor/events: the events after the
+// requested ID and the ID to ask for the next ones after.
+type eventsResponse struct {
+	Events []pkg.Event `json:"events"`
+	Last   int64       `json:"last_id"`
+}
+
+// handleEvents serves GET /doctor/events?since=<id>, the events of the
+// doctor's clinic recorded after event id, for clients catching up after a
+// disconnect.  A full page means there may be more.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		writeError(w, r, errs.New(errs.Invalid, "since must be an event ID"))
+		return
+	}
+	events, err := s.Repo.ListEventsSince(r.Context(), doctorClinic(r.Context()), since, eventsPageSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := eventsResponse{Events: events, Last: since}
+	if resp.Events == nil {
+		resp.Events = []pkg.Event{}
+	}
+	if n := len(events); n > 0 {
+		resp.Last = events[n-1].ID
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleEventStream serves GET /doctor/events/stream, the events of the
+// doctor's clinic as server-sent events carrying the event ID.  A browser
+// reconnecting sends the last ID it saw in Last-Event-ID and is first sent
+// the events it missed; a new stream starts with the events recorded after
+// it opened.
+func (s *Server) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errs.New(errs.Internal, "streaming unsupported"))
+		return
+	}
+	ctx := r.Context()
+	var last int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		if last, err = strconv.ParseInt(id, 10, 64); err != nil || last < 0 {
+			writeError(w, r, errs.New(errs.Invalid, "invalid Last-Event-ID"))
+			return
+		}
+	} else {
+		var err error
+		if last, err = s.Repo.LatestEventID(ctx); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	setStreamHeaders(w.Header())
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	quiet := time.Now()
+	for {
+		events, err := s.Repo.ListEventsSince(ctx, doctorClinic(ctx), last, eventsPageSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("event stream: %v", err)
+			}
+			return
+		}
+		for _, e := range events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Kind, data)
+			last = e.ID
+		}
+		if len(events) == 0 && time.Since(quiet) >= streamKeepAlive {
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if len(events) > 0 || time.Since(quiet) >= streamKeepAlive {
+			flusher.Flush()
+			quiet = time.Now()
+		}
+		if len(events) == eventsPageSize {
+			continue // more to replay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/fhir"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// fhirContentType is the media type of FHIR JSON resources.
+const fhirContentType = "application/fhir+json"
+
+// handleFHIRExport serves GET /api/sessions/{id}/fhir to external tooling:
+// the session's summary and transcript as a FHIR document Bundle (see
+// fhir.Export), with the bot's messages marked by the Watermark.  A
+// session not summarised yet is exported with its demographics and
+// transcript only.  Like /api/summaries it requires the APIKey.
+func (s *Server) handleFHIRExport(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if r = s.authorizeAPIKey(w, r); r == nil {
+		return
+	}
+	if _, err := uuid.Parse(sessionID); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, err := s.Repo.GetSessionByID(r.Context(), sessionID)
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	summary, err := s.Repo.GetSummary(r.Context(), sessionID)
+	if err != nil && !errs.Is(err, errs.NotFound) {
+		writeError(w, r, err)
+		return
+	}
+	transcript, err := s.Repo.GetSessionTranscript(r.Context(), sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	meta, err := s.Repo.GetSessionMetadata(r.Context(), sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	gen := s.Watermark.Describe(transcript, meta, summary, time.Now())
+	s.recordAccess(r, audit.ActionExport, sessionID)
+	w.Header().Set("Content-Type", fhirContentType+"; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(fhir.Export(session, summary, s.Watermark.Mark(transcript), gen))
+}
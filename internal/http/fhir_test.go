@@ -0,0 +1,106 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/pkg"
+)
+
+func TestFHIRExport(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.APIKey = "api-key"
+	s.Watermark = export.Watermark{Marker: export.DefaultMarker}
+	cookie, session := startPatient(t, s, "0012345678")
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie); resp.StatusCode >= 400 {
+		t.Fatalf("message: status %d", resp.StatusCode)
+	}
+	pain := 6
+	if err := s.Repo.UpsertSummary(context.Background(), &pkg.Summary{
+		SessionID:  session.ID,
+		KeyPoints:  []string{"سردرد"},
+		FreeText:   "سردرد از دیروز",
+		PainScore:  &pain,
+		Structured: map[string]interface{}{"medications": []interface{}{"بروفن ۴۰۰"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target, key string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodGet, target, nil)
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := get("/api/sessions/"+session.ID+"/fhir", "api-key")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), fhirContentType) {
+		t.Fatalf("export: %d %q, want 200 of %s", w.Code, w.Header().Get("Content-Type"), fhirContentType)
+	}
+	var bundle struct {
+		ResourceType string `json:"resourceType"`
+		Type         string `json:"type"`
+		Entry        []struct {
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatalf("%s: %v", w.Body, err)
+	}
+	if bundle.ResourceType != "Bundle" || bundle.Type != "document" {
+		t.Errorf("bundle %s %s, want a document Bundle", bundle.ResourceType, bundle.Type)
+	}
+	types := map[string]int{}
+	for _, e := range bundle.Entry {
+		types[e.Resource["resourceType"].(string)]++
+	}
+	for _, want := range []string{"Composition", "Patient", "MedicationStatement", "Observation", "Provenance"} {
+		if types[want] != 1 {
+			t.Errorf("%d %s resources, want 1 (%v)", types[want], want, types)
+		}
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "[bot] از کی این درد را دارید؟") || !strings.Contains(body, "سردرد دارم") {
+		t.Errorf("export %s: want the transcript with the bot's messages marked", body)
+	}
+
+	if w := get("/api/sessions/"+session.ID+"/fhir", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without the key: status %d, want 401", w.Code)
+	}
+	if w := get("/api/sessions/"+session.ID+"/fhir", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d, want 401", w.Code)
+	}
+	for _, id := range []string{"not-a-uuid", "7d9c3c8e-0f43-4f49-9d4e-5b7a4c1f2e11"} {
+		if w := get("/api/sessions/"+id+"/fhir", "api-key"); w.Code != http.StatusNotFound {
+			t.Errorf("session %s: status %d, want 404", id, w.Code)
+		}
+	}
+}
+
+func TestFHIRExportWithoutSummary(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.APIKey = "api-key"
+	_, session := startPatient(t, s, "0012345678")
+	r := newRequest(http.MethodGet, "/api/sessions/"+session.ID+"/fhir", nil)
+	r.Header.Set(apiKeyHeader, "api-key")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d, want 200", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"status":"preliminary"`) || !strings.Contains(body, "0012345678") {
+		t.Errorf("export %s: want a preliminary composition for the patient", body)
+	}
+	if strings.Contains(body, "MedicationStatement") || strings.Contains(body, "Observation") {
+		t.Errorf("export %s: resources mapped without a summary", body)
+	}
+}
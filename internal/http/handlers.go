@@ -1,81 +1,364 @@
 package http
 
 import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"log"
+	"net"
 	"net/http"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"waitroom-chatbot/internal/audit"
 	"waitroom-chatbot/internal/core"
 	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/digest"
+	"waitroom-chatbot/internal/export"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/internal/metrics"
+	"waitroom-chatbot/internal/redact"
+	"waitroom-chatbot/internal/sms"
+	"waitroom-chatbot/internal/status"
+	"waitroom-chatbot/internal/storage"
 	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/cursor"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
 )
 
 // Server bundles together dependencies required by HTTP handlers.
 type Server struct {
 	Repo       *db.Repository
 	Chat       *core.ChatService
+	Summarizer *core.Summarizer
 	Templates  *template.Template
 	MessageCap int
+	// CapScope is what MessageCap limits: the patient's messages in the
+	// current week (CapPerWeek, the default) or in the session (CapPerSession).
+	CapScope string
+	// CapWeek is the week a per-week cap counts: the ISO week starting
+	// Monday at midnight UTC (CapWeekISO, the default) or the Persian week
+	// starting Saturday at midnight in Tehran (CapWeekJalali).
+	CapWeek string
+	// AdminToken guards the /admin endpoints.  Admin endpoints are disabled
+	// when it is empty.
+	AdminToken string
+	// APIKey guards the /api/summaries and /api/sessions/{id}/fhir
+	// endpoints for external tooling, sent in the X-API-Key header.  They
+	// are disabled when it is empty.
+	APIKey string
+	// Watermark marks the bot's messages in exports.
+	Watermark export.Watermark
+	// Metrics is rendered at GET /metrics when set.
+	Metrics *metrics.Registry
+	// SeparateAdmin keeps the admin routes (/admin and /metrics) off the
+	// public handler; they are then served only by AdminHandler, on a
+	// listener of their own.
+	SeparateAdmin bool
+	// DoctorUsers maps doctor usernames to passwords for HTTP Basic auth on
+	// the /doctor routes.  When empty the routes refuse every request unless
+	// OpenDoctorRoutes is set.
+	DoctorUsers map[string]string
+	// OpenDoctorRoutes serves the /doctor routes to anyone when DoctorUsers
+	// is empty, with audit entries attributed to "anonymous".  It is meant
+	// for local development only.
+	OpenDoctorRoutes bool
+	// DoctorClinics maps doctor usernames to the clinic whose patients they
+	// see; doctors not listed (and anonymous access) see pkg.DefaultClinic.
+	DoctorClinics map[string]string
+	// RoundRobin assigns new sessions to the clinic's doctors in turn;
+	// otherwise they stay unassigned until a doctor claims them.
+	RoundRobin bool
+	// Audit records doctor access to patient data when set.
+	Audit *audit.Logger
+	// Storage keeps uploaded attachments.  Uploads are disabled when nil.
+	Storage storage.Storage
+	// Digest is the weekly digest job whose status /admin/stats reports.
+	Digest *digest.Job
+	// Recall adds a returning patient's relevant past visits to the chat
+	// prompt when set.
+	Recall *core.Recall
+	// Meter tracks the month-to-date LLM spend that /admin/stats reports.
+	Meter *llm.Meter
+	// Events notifies the doctor dashboard of session changes when set.
+	Events db.Broker
+	// TrustedProxies lists the reverse proxies (e.g. the TLS terminator)
+	// whose X-Forwarded-* headers are honoured.
+	TrustedProxies []*net.IPNet
+	// DisableCompression turns off gzip/deflate response compression, e.g.
+	// to read responses while debugging.
+	DisableCompression bool
+	// PageTimeout and PostTimeout bound page renders and posts (which may
+	// wait on the LLM); zero selects the default and a negative value
+	// disables the deadline.  Streams are never cut off.
+	PageTimeout time.Duration
+	PostTimeout time.Duration
+	// AsyncReplies makes text messages return a pending reply at once; the
+	// LLM call runs in the background and the page polls for the result.
+	AsyncReplies bool
+	// CoalesceWindow makes async replies wait this long for more patient
+	// messages, answering those sent in quick succession, or while a reply
+	// is pending, with one reply (see replyCoalesced); zero answers each
+	// message on its own.  Streamed replies are not coalesced.
+	CoalesceWindow time.Duration
+	// SlowReply is the reply latency above which a warning is logged; zero
+	// disables the warning.
+	SlowReply time.Duration
+	// Status tracks the health shown at GET /status, which is not served
+	// when it is nil.
+	Status *status.Tracker
+	// StartLimit bounds the new sessions created from one client IP per
+	// hour on /start; zero disables the limit.
+	StartLimit int
+	// CheckNationalID refuses start forms whose national ID fails the
+	// checksum.
+	CheckNationalID bool
+	// SMS texts the patient a code on /start that must be entered before
+	// the session is created, verifying the phone number.  The step is
+	// skipped when it is nil.
+	SMS sms.Sender
+	// OTPPerPhone and OTPPerIP bound the codes sent per hour to one phone
+	// number and to one client IP; zero is unlimited.
+	OTPPerPhone int
+	OTPPerIP    int
+	// Tracing lets doctors flag sessions whose model calls are recorded in
+	// llm_traces (see llm.Tracer), and TraceRedFlags flags those whose
+	// patient mentions a red-flag symptom.
+	Tracing       bool
+	TraceRedFlags bool
+	// CookieMaxAge is how long the patient cookie lasts without the patient
+	// using the chat, and CookieAbsoluteMaxAge how long it lasts at most
+	// before the start form must be filled in again (see
+	// withPatientCookie); zero selects 30 and 90 days.
+	CookieMaxAge         time.Duration
+	CookieAbsoluteMaxAge time.Duration
+	// CookieKey signs the patient cookie, so its national ID and issued
+	// time cannot be forged.  NewServer sets a random one, which cookies
+	// do not survive a restart with.
+	CookieKey []byte
+	// Cursors signs the pagination cursors handed to clients.  NewServer
+	// sets one with a random key, which cursors do not survive a restart
+	// with.
+	Cursors *cursor.Codec
+
+	router      router
+	statusCache statusCache
 }
 
-// NewServer constructs a Server. Templates are loaded from internal/http/templates.
-func NewServer(repo *db.Repository, chat *core.ChatService, messageCap int) (*Server, error) {
-	tmplPath := filepath.Join("internal", "http", "templates", "*.html")
-	tmpl, err := template.ParseGlob(tmplPath)
+// templateFS holds the page templates, embedded so the server (and any
+// test constructing one) does not depend on the working directory.
+//
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// NewServer constructs a Server with the embedded templates.
+func NewServer(repo *db.Repository, chat *core.ChatService, summarizer *core.Summarizer, messageCap int) (*Server, error) {
+	tmpl, err := parseTemplates()
 	if err != nil {
 		return nil, err
 	}
-	return &Server{Repo: repo, Chat: chat, Templates: tmpl, MessageCap: messageCap}, nil
+	if err := checkTemplates(tmpl); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	cookieKey := make([]byte, 32)
+	if _, err := rand.Read(cookieKey); err != nil {
+		return nil, err
+	}
+	s := &Server{Repo: repo, Chat: chat, Summarizer: summarizer, Templates: tmpl, MessageCap: messageCap, Cursors: cursor.New(key), CookieKey: cookieKey}
+	s.SetRouterConfig(s.DefaultRouterConfig())
+	return s, nil
 }
 
-// ServeHTTP performs very small routing based on path.
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// route performs very small routing based on path, for the patient routes.
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.Method == http.MethodGet && r.URL.Path == "/":
-		s.handleStartPage(w, r)
+		s.handleStartPage(w, r, "")
 	case r.Method == http.MethodPost && r.URL.Path == "/start":
-		s.handleStart(w, r)
+		s.handleStart(w, r, "")
+	case r.Method == http.MethodPost && r.URL.Path == "/start/verify":
+		s.handleVerifyStart(w, r, "")
+	case r.Method == http.MethodGet && r.URL.Path == "/status":
+		s.handleStatus(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/healthz":
+		s.handleHealthz(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/readyz":
+		s.handleReadyz(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/chat":
+		s.handleChatPage(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/chat/history":
+		s.handlePatientHistory(w, r)
 	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/chat/"):
-		nationalID := strings.TrimPrefix(r.URL.Path, "/chat/")
-		s.handleChatPage(w, r, nationalID)
+		// /chat/{nationalID}[/history], from before the chat pages left the
+		// national ID out of their URLs
+		nationalID, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/chat/"), "/")
+		s.handleLegacyChatPath(w, r, nationalID, rest)
 	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/users/") && strings.HasSuffix(r.URL.Path, "/messages"):
 		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) >= 4 {
+		if len(parts) == 5 {
 			nationalID := parts[3]
 			s.handlePostMessage(w, r, nationalID)
 			return
 		}
 		http.NotFound(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/retry"):
+		// /api/sessions/{id}/messages/{messageID}/retry
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 7 && parts[4] == "messages" {
+			s.handleRetryReply(w, r, parts[3], parts[5])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/messages/stream"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 6 {
+			s.handleStreamSessionMessage(w, r, parts[3])
+			return
+		}
+		http.NotFound(w, r)
 	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/messages"):
 		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) >= 4 {
-			nationalID := parts[3]
-			s.handlePostMessage(w, r, nationalID)
+		if len(parts) == 5 {
+			s.handlePostSessionMessage(w, r, parts[3])
 			return
 		}
 		http.NotFound(w, r)
-	default:
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/messages/last"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 6 {
+			s.handleEditLastMessage(w, r, parts[3])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/read"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 5 {
+			s.handleMarkRead(w, r, parts[3])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/attachments"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 5 {
+			s.handlePostAttachment(w, r, parts[3])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.Contains(r.URL.Path, "/replies/") && strings.HasSuffix(r.URL.Path, "/stream"):
+		// /api/sessions/{id}/replies/{replyID}/stream
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 7 && parts[4] == "replies" {
+			s.handleReplyStream(w, r, parts[3], parts[5])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.Contains(r.URL.Path, "/replies/"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 6 && parts[4] == "replies" {
+			s.handleGetReply(w, r, parts[3], parts[5])
+			return
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/sessions/") && strings.HasSuffix(r.URL.Path, "/fhir"):
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) == 5 {
+			s.handleFHIRExport(w, r, parts[3])
+			return
+		}
 		http.NotFound(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/summaries":
+		s.handleListSummaries(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/openapi.json":
+		s.handleOpenAPI(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/ws/sessions/"):
+		s.handleChatSocket(w, r, strings.TrimPrefix(r.URL.Path, "/ws/sessions/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/attachments/"):
+		s.handleGetAttachment(w, r, strings.TrimPrefix(r.URL.Path, "/attachments/"))
+	default:
+		// Clinics sharing the instance have their own start page under
+		// their path prefix, e.g. /north/ posting to /north/start.
+		prefix, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		switch {
+		case methodNotAllowed(w, r, patientRoutes):
+		case prefix != "" && r.Method == http.MethodGet && rest == "":
+			s.handleStartPage(w, r, prefix)
+		case prefix != "" && r.Method == http.MethodPost && rest == "start":
+			s.handleStart(w, r, prefix)
+		case prefix != "" && r.Method == http.MethodPost && rest == "start/verify":
+			s.handleVerifyStart(w, r, prefix)
+		default:
+			http.NotFound(w, r)
+		}
 	}
 }
 
-// handleStartPage renders the initial form for collecting user details.
-func (s *Server) handleStartPage(w http.ResponseWriter, r *http.Request) {
-	if c, err := r.Cookie("national_id"); err == nil && c.Value != "" {
-		http.Redirect(w, r, "/chat/"+c.Value, http.StatusSeeOther)
+// startPage is the data of the "start" template.
+type startPage struct {
+	pageContext
+	Profile string
+	Action  string
+	Locales []i18n.Locale
+	// Error is shown above the form when a submission was refused, and
+	// Notice when the patient was sent back to it to sign in again.
+	Error  string
+	Notice string
+}
+
+// handleStartPage renders the initial form for collecting user details.  A
+// non-empty prefix is the path prefix of the clinic the form is for.
+func (s *Server) handleStartPage(w http.ResponseWriter, r *http.Request, prefix string) {
+	clinic, err := s.resolveClinic(r, prefix)
+	if err != nil {
+		s.clinicError(w, r, err)
 		return
 	}
-	if err := s.Templates.ExecuteTemplate(w, "start", nil); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if nationalID := s.patientNationalID(r); nationalID != "" {
+		// Returning patients go back to their open session; once it has been
+		// closed they start a fresh one through the form.
+		if session, err := s.Repo.GetLatestSession(r.Context(), nationalID); err == nil && session.ClosedAt == nil {
+			http.Redirect(w, r, "/chat", http.StatusSeeOther)
+			return
+		}
 	}
+	page := newStartPage(clinic, prefix, r.URL.Query().Get("profile"), r.URL.Query().Get("lang"))
+	if r.URL.Query().Get("expired") == "1" {
+		page.Notice = i18n.T(page.Locale, "start.expired")
+	}
+	s.render(w, r, "start", page)
 }
 
-// handleStart processes the start form, stores user info and redirects to chat page.
-func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
+// newStartPage returns the data of the start form of clinic, posting to
+// the clinic's prefix, in locale.
+func newStartPage(clinic *pkg.Clinic, prefix, profile, locale string) startPage {
+	action := "/start"
+	if prefix != "" {
+		action = "/" + prefix + "/start"
+	}
+	return startPage{
+		pageContext: newPageContext(clinic, locale),
+		Profile:     profile,
+		Action:      action,
+		Locales:     i18n.Supported(),
+	}
+}
+
+// handleStart processes the start form, stores user info and redirects to chat
+// page.  The session belongs to the clinic resolved from prefix or the host.
+func (s *Server) handleStart(w http.ResponseWriter, r *http.Request, prefix string) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "invalid form", http.StatusBadRequest)
+		writeError(w, r, errInvalidForm)
 		return
 	}
 	u := &pkg.User{
@@ -84,94 +367,836 @@ func (s *Server) handleStart(w http.ResponseWriter, r *http.Request) {
 		Name:       r.FormValue("name"),
 	}
 	if u.NationalID == "" || u.Phone == "" || u.Name == "" {
-		http.Error(w, "missing fields", http.StatusBadRequest)
+		writeError(w, r, errMissingFields)
 		return
 	}
-	if err := s.Repo.UpsertUser(r.Context(), u); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	clinic, err := s.resolveClinic(r, prefix)
+	if err != nil {
+		s.clinicError(w, r, err)
+		return
+	}
+	// The locale picker is optional; without it the session keeps its
+	// language, which is Persian for a new one.
+	locale := r.FormValue("locale")
+	if locale != "" {
+		locale = i18n.Normalize(locale)
+	}
+	u.ClientIP = clientIP(r)
+	page := newStartPage(clinic, prefix, r.FormValue("profile"), locale)
+	if !s.admitStart(w, r, u, page) {
+		return
+	}
+	if s.SMS != nil {
+		// The session waits until the patient enters the code texted to
+		// the phone (see handleVerifyStart).
+		s.sendStartCode(w, r, u, page, clinic.ID, s.resolveProfile(r), locale)
+		return
+	}
+	s.startSession(w, r, u, s.resolveProfile(r), clinic, locale)
+}
+
+// startSession creates or resumes the session of a patient whose start
+// form was accepted, sets the patient cookie and redirects to the chat.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, u *pkg.User, profile string, clinic *pkg.Clinic, locale string) {
+	if err := s.Repo.UpsertUser(r.Context(), u, profile, clinic.ID, locale, s.clinicCap(clinic)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if s.RoundRobin {
+		s.assignRoundRobin(r.Context(), u.NationalID, clinic.ID)
+	}
+	s.setPatientCookie(w, r, u.NationalID, time.Now())
+	http.Redirect(w, r, "/chat", http.StatusSeeOther)
+}
+
+// resolveClinic returns the clinic a patient starts a session with: the
+// one with the given path prefix, else the one mapped to the request's
+// host, else the default clinic.  An unknown prefix yields db.ErrNotFound.
+func (s *Server) resolveClinic(r *http.Request, prefix string) (*pkg.Clinic, error) {
+	if prefix != "" {
+		return s.Repo.GetClinicByPrefix(r.Context(), prefix)
+	}
+	return s.Repo.ClinicForHost(r.Context(), requestHost(r))
+}
+
+// clinicError writes the response for a failed resolveClinic.
+func (s *Server) clinicError(w http.ResponseWriter, r *http.Request, err error) {
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:   "national_id",
-		Value:  u.NationalID,
-		Path:   "/",
-		MaxAge: int((365 * 24 * time.Hour).Seconds()),
-	})
-	http.Redirect(w, r, "/chat/"+u.NationalID, http.StatusSeeOther)
+	writeError(w, r, err)
 }
 
-// GetTranscriptSince returns the transcript for a nationalID but only messages
-// with created_at >= since. It reuses GetTranscript and filters in-memory to
-// avoid coupling to any specific SQL shape used by GetTranscript.
-// Moved to db/repository.go
+// requestHost returns the request's host name without the port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// resolveProfile picks the prompt profile for a new session: the "profile"
+// form/query value if present, otherwise the first label of a clinic
+// subdomain.  Unknown profiles resolve to "" so the defaults are used.
+func (s *Server) resolveProfile(r *http.Request) string {
+	name := r.FormValue("profile")
+	if name == "" {
+		if labels := strings.Split(requestHost(r), "."); len(labels) > 2 {
+			name = labels[0]
+		}
+	}
+	if name == "" {
+		return ""
+	}
+	if _, err := s.Repo.GetPromptProfile(r.Context(), name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// sessionPrompts loads the prompts for a session's locale and profile,
+// falling back to the built-in prompts of the locale when the session has
+// no profile or it cannot be loaded.
+func (s *Server) sessionPrompts(ctx context.Context, session *pkg.Session) core.Prompts {
+	if session == nil {
+		return core.DefaultPrompts()
+	}
+	if session.PromptProfile == nil {
+		return core.LocalePrompts(session.Locale)
+	}
+	profile, err := s.Repo.GetPromptProfile(ctx, *session.PromptProfile)
+	if err != nil {
+		log.Printf("load prompt profile %q: %v", *session.PromptProfile, err)
+		return core.LocalePrompts(session.Locale)
+	}
+	return core.PromptsFor(profile, session.Locale)
+}
+
+// recallPrompts adds the patient's relevant past visits to prompts when
+// Recall is enabled.  The current session's patient messages, including
+// content, are matched against the past summaries.
+func (s *Server) recallPrompts(ctx context.Context, prompts core.Prompts, session *pkg.Session, history []pkg.Message, content string) core.Prompts {
+	if s.Recall == nil || session.PatientID == nil {
+		return prompts
+	}
+	var query []string
+	for _, m := range history {
+		if m.Role == pkg.RolePatient {
+			query = append(query, m.Content)
+		}
+	}
+	query = append(query, content)
+	return s.Recall.Prompts(ctx, prompts, *session.PatientID, session.ID, strings.Join(query, "\n"))
+}
 
-// handleChatPage renders the chat interface for a user.
-func (s *Server) handleChatPage(w http.ResponseWriter, r *http.Request, nationalID string) {
+// patientContext returns the messages of a session sent to the model as the
+// conversation so far: those of the last week (db.PatientTranscriptWindow)
+// and at most the chat's last turns, while the doctor and summaries see the
+// whole session.  The chat service bounds them further (see
+// core.ChatService.ContextTurns).
+func (s *Server) patientContext(ctx context.Context, sessionID string) ([]pkg.Message, error) {
+	return s.Repo.GetRecentMessages(ctx, sessionID, s.Chat.ContextMessages())
+}
+
+// withLLMContext returns ctx carrying a redactor for the session's patient
+// identifiers, so LLM debug logs and traces mask them, and the session for
+// llm.Tracer when it is flagged for tracing.
+func withLLMContext(ctx context.Context, session *pkg.Session) context.Context {
+	var ids []string
+	for _, f := range []*string{session.PatientName, session.PatientPhone, session.PatientID} {
+		if f != nil {
+			ids = append(ids, *f)
+		}
+	}
+	ctx = redact.NewContext(ctx, redact.New(ids...))
+	if session.TraceLLM {
+		ctx = llm.WithTrace(ctx, session.ID)
+	}
+	return ctx
+}
+
+// patientPage is the data of the "patient" template.
+type patientPage struct {
+	pageContext
+	SessionID  string // empty without a session
+	Greeting   string
+	Transcript []pkg.Message
+	Uploads    bool
+	Socket     string // chat WebSocket path; empty without a session
+	Unanswered string // retry path for a trailing unanswered message
+	// Hours are the clinic's operating hours, nil when the bot always
+	// answers; Closed reports that it does not answer now, until OpensAt
+	// (zero if never).
+	Hours   *pageHours
+	Closed  bool
+	OpensAt time.Time
+}
+
+// handleChatPage renders the chat interface for the patient named by the
+// national_id cookie.  The national ID stays out of the page's URL and
+// links, so it does not end up in browser history, proxy logs or Referer
+// headers.
+func (s *Server) handleChatPage(w http.ResponseWriter, r *http.Request) {
+	nationalID := s.patientNationalID(r)
+	if nationalID == "" {
+		start := "/"
+		if cookieExpired(r.Context()) {
+			start = "/?expired=1"
+		}
+		http.Redirect(w, r, start, http.StatusSeeOther)
+		return
+	}
 	transcript, err := s.Repo.GetTranscript(r.Context(), nationalID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+	s.loadAttachments(r.Context(), transcript)
+	session, err := s.Repo.GetLatestSession(r.Context(), nationalID)
+	if err != nil && !errs.Is(err, errs.NotFound) {
+		writeError(w, r, err)
+		return
+	}
+	if session != nil && session.ClosedAt != nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	clinic := s.sessionClinic(r.Context(), session)
+	var locale string
+	if session != nil {
+		locale = session.Locale
+	}
+	data := patientPage{
+		pageContext: newPageContext(clinic, locale),
+		Greeting:    s.sessionPrompts(r.Context(), session).Greeting(clinicName(clinic)),
+		Transcript:  transcript,
+		Uploads:     s.Storage != nil,
+	}
+	if hours := clinicHours(clinic); hours != nil {
+		now := time.Now()
+		data.Hours = &pageHours{Timezone: hours.Location.String(), Days: hours.Week()}
+		if !hours.Open(now) {
+			data.Closed, data.OpensAt = true, hours.NextOpen(now)
+		}
+	}
+	if session != nil {
+		data.SessionID = session.ID
+		data.Socket = "/ws/sessions/" + session.ID
+		// A patient message left without a reply, e.g. by a restart while
+		// the reply was being generated, can have its reply fetched again
+		// once it is clearly not still in progress.
+		m, err := s.Repo.GetTrailingUnansweredMessage(r.Context(), session.ID)
+		if err == nil && time.Since(m.CreatedAt) > unansweredGrace {
+			data.Unanswered = retryPath(m)
+		} else if err != nil && !errs.Is(err, errs.NotFound) {
+			log.Printf("look up unanswered message in session %s: %v", session.ID, err)
+		}
+	}
+	s.render(w, r, "patient", data)
+}
+
+// pastVisit is a closed session listed on the patient's history page with
+// the free-text summary of it, empty when there is none.
+type pastVisit struct {
+	Session pkg.Session
+	Summary string
+}
+
+// historyPage is the data of the "patient_history" template.
+type historyPage struct {
+	Locale string
+	Visits []pastVisit
+}
+
+// handlePatientHistory renders the closed sessions of the patient named by
+// the national_id cookie with their summaries, read-only.  Without the
+// cookie it does not exist.
+func (s *Server) handlePatientHistory(w http.ResponseWriter, r *http.Request) {
+	nationalID := s.patientNationalID(r)
+	if nationalID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sessions, err := s.Repo.ListSessionsByNationalID(r.Context(), nationalID)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	data := struct {
-		SessionID  string // template expects .SessionID
-		NationalID string // keep for any other template usage
-		Transcript []pkg.Message
-	}{
-		SessionID:  nationalID,
-		NationalID: nationalID,
-		Transcript: transcript,
+	data := historyPage{Locale: i18n.Default}
+	if len(sessions) > 0 {
+		data.Locale = i18n.Normalize(sessions[0].Locale)
 	}
-	if err := s.Templates.ExecuteTemplate(w, "patient", data); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	for _, session := range sessions {
+		if session.ClosedAt == nil {
+			continue
+		}
+		visit := pastVisit{Session: session}
+		summary, err := s.Repo.GetSummary(r.Context(), session.ID)
+		if err == nil {
+			visit.Summary = summary.FreeText
+		} else if !errs.Is(err, errs.NotFound) {
+			writeError(w, r, err)
+			return
+		}
+		data.Visits = append(data.Visits, visit)
 	}
+	s.render(w, r, "patient_history", data)
 }
 
-// handlePostMessage accepts a patient message, checks weekly cap and responds with bot reply.
+// handleLegacyChatPath redirects the chat URLs that carried the patient's
+// national ID, /chat/{nationalID} and /chat/{nationalID}/history, to the
+// pages that leave it out.  Only the patient the national_id cookie names
+// is redirected; for anyone else the URL does not exist.
+func (s *Server) handleLegacyChatPath(w http.ResponseWriter, r *http.Request, nationalID, rest string) {
+	if nationalID == "" || s.patientNationalID(r) != nationalID || rest != "" && rest != "history" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, strings.TrimSuffix("/chat/"+rest, "/"), http.StatusSeeOther)
+}
+
+// handlePostMessage accepts a patient message for the open session of a
+// national ID, checks weekly cap and responds with bot reply.  Only the
+// patient the national_id cookie names may post for the national ID; for
+// anyone else it has no session.
 func (s *Server) handlePostMessage(w http.ResponseWriter, r *http.Request, nationalID string) {
+	if nationalID == "" || s.patientNationalID(r) != nationalID {
+		writeError(w, r, db.ErrNoActiveSession)
+		return
+	}
+	content, ok := messageContent(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.Repo.GetLatestSession(r.Context(), nationalID); errs.Is(err, errs.NotFound) {
+		writeError(w, r, db.ErrNoActiveSession)
+		return
+	}
+	s.respondToPatient(r.Context(), httpTurn{w, r}, nationalID, content, nil)
+}
+
+// handlePostSessionMessage accepts a patient message for a session
+// identified by its UUID.  Only the patient the session belongs to may post
+// to it; to anyone else it does not exist.
+func (s *Server) handlePostSessionMessage(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session, content, ok := s.postedSessionMessage(w, r, sessionID)
+	if !ok {
+		return
+	}
+	if session.ClosedAt != nil {
+		httpTurn{w, r}.closed()
+		return
+	}
+	s.respondInSession(r.Context(), httpTurn{w, r}, session, *session.PatientID, content, nil)
+}
+
+// postedSessionMessage returns the session a patient message is posted to
+// and its content.  It writes the error response and reports false when
+// the session is not the patient's or the content is invalid.
+func (s *Server) postedSessionMessage(w http.ResponseWriter, r *http.Request, sessionID string) (*pkg.Session, string, bool) {
+	session := s.patientSession(w, r, sessionID)
+	if session == nil {
+		return nil, "", false
+	}
+	content, ok := messageContent(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	return session, content, true
+}
+
+// patientSession loads a session identified by its UUID for the patient it
+// belongs to.  It writes the error response and returns nil when there is
+// no such session or it is another patient's.
+func (s *Server) patientSession(w http.ResponseWriter, r *http.Request, sessionID string) *pkg.Session {
+	if _, err := uuid.Parse(sessionID); err != nil {
+		writeError(w, r, errSessionNotFound)
+		return nil
+	}
+	session, err := s.Repo.GetSessionByID(r.Context(), sessionID)
+	if errs.Is(err, errs.NotFound) || err == nil && !s.ownedBy(r, session) {
+		writeError(w, r, errSessionNotFound)
+		return nil
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return nil
+	}
+	return session
+}
+
+// messageContent reads the content of a posted patient message, sent as a
+// JSON pkg.ChatRequest or as a form.  It writes the error response and
+// reports false when the content is missing or too long.
+func messageContent(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req pkg.ChatRequest
+	if isJSON(r) {
+		if !decodeJSON(w, r, &req) {
+			return "", false
+		}
+		return req.Content, true
+	}
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "invalid form", http.StatusBadRequest)
+		writeError(w, r, errInvalidForm)
+		return "", false
+	}
+	req.Content = r.FormValue("content")
+	if err := validate(&req); err != nil {
+		writeError(w, r, errs.Wrap(errs.Invalid, err))
+		return "", false
+	}
+	return req.Content, true
+}
+
+// turn receives the outcome of a patient message.  The HTTP handlers render
+// HTMX fragments; the WebSocket handler sends JSON frames.
+type turn interface {
+	// chunk is called with each part of an LLM reply as it streams in.
+	chunk(text string)
+	// reply is called with the bot's complete reply once it is stored.
+	reply(m *pkg.Message, attachments []*pkg.Attachment)
+	// capped is called instead of reply with the stored cap message when
+	// the patient has reached the message cap, and when it resets (zero
+	// for a per-session cap).
+	capped(m *pkg.Message, resetsAt time.Time)
+	// closedHours is called instead of reply with the stored closed hours
+	// notice when the patient writes outside the clinic's operating hours,
+	// and when the bot answers again (zero if never).
+	closedHours(m *pkg.Message, opensAt time.Time)
+	// fail reports err, of a kind (see errs.Kind), with the message for it
+	// in the locale.
+	fail(locale string, err error)
+	// closed reports that the session was closed, so the patient has to
+	// start a new one.
+	closed()
+}
+
+// asyncTurn is implemented by turns that can poll for a reply generated in
+// the background.
+type asyncTurn interface {
+	pending(p *pkg.PendingReply)
+}
+
+// retryTurn is implemented by turns that can offer the patient a retry of
+// a reply that failed.
+type retryTurn interface {
+	// unanswered reports an LLM failure with the HTTP status it
+	// corresponds to.  The patient message m is stored without a reply.
+	unanswered(status int, locale string, m *pkg.Message)
+}
+
+// httpTurn writes the outcome of a patient message to r as an HTMX
+// fragment.
+type httpTurn struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (t httpTurn) chunk(string) {}
+
+func (t httpTurn) reply(m *pkg.Message, attachments []*pkg.Attachment) {
+	writeReply(t.w, attachments, m)
+}
+
+func (t httpTurn) pending(p *pkg.PendingReply) { writePendingReply(t.w, p) }
+
+func (t httpTurn) capped(m *pkg.Message, _ time.Time) { writeReply(t.w, nil, m) }
+
+func (t httpTurn) closedHours(m *pkg.Message, _ time.Time) { writeReply(t.w, nil, m) }
+
+func (t httpTurn) fail(locale string, err error) { writeErrorBody(t.w, t.r, locale, err) }
+
+func (t httpTurn) unanswered(status int, locale string, m *pkg.Message) {
+	writeRetryBubble(t.w, status, locale, m)
+}
+
+func (t httpTurn) closed() {
+	// Send the patient back to the start form for a fresh session.
+	t.w.Header().Set("HX-Redirect", "/")
+	t.w.WriteHeader(http.StatusConflict)
+}
+
+// respondToPatient stores a patient message and reports the bot's reply to
+// t, applying the operating hours, cap, moderation and wrap-up rules.  The patient
+// message is only stored together with the reply, so a failure leaves
+// nothing behind and the patient can simply send it again; turns that
+// support it instead keep a text message whose LLM reply failed as
+// unanswered and offer to retry the reply.  upload,
+// when set, is stored before the LLM is called and linked to the patient
+// message; if storing it fails the request fails first.  With AsyncReplies
+// the LLM reply to a text message is generated in the background instead
+// when t supports it, as it always is for a streamTurn, and with a
+// CoalesceWindow the message is stored at once.
+func (s *Server) respondToPatient(ctx context.Context, t turn, nationalID, content string, upload *upload) {
+	session, err := s.Repo.ResolveActiveSession(ctx, nationalID)
+	if errors.Is(err, db.ErrNoActiveSession) {
+		// The session was closed for inactivity.
+		t.closed()
+		return
+	}
+	if err != nil {
+		failTurn(ctx, t, i18n.Default, err)
+		return
+	}
+	s.respondInSession(ctx, t, session, nationalID, content, upload)
+}
+
+// respondInSession is respondToPatient for an open session already
+// resolved.
+func (s *Server) respondInSession(ctx context.Context, t turn, session *pkg.Session, nationalID, content string, upload *upload) {
+	received := time.Now()
+	ctx = withLLMContext(ctx, session)
+	sessionID, err := uuid.Parse(session.ID)
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
 		return
 	}
-	content := r.FormValue("content")
-	if strings.TrimSpace(content) == "" {
-		http.Error(w, "empty message", http.StatusBadRequest)
+	if hours := clinicHours(s.sessionClinic(ctx, session)); !hours.Open(received) {
+		s.replyClosedHours(ctx, t, session, sessionID, hours.NextOpen(received))
 		return
 	}
-	count, err := s.Repo.CountUserMessagesThisWeek(r.Context(), nationalID)
+	messageCap, err := s.messageCap(ctx, session, nationalID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		failTurn(ctx, t, session.Locale, err)
 		return
 	}
-	if count >= s.MessageCap {
-		// send cap message only
-		botMsg, _ := s.Repo.CreateMessage(r.Context(), nationalID, pkg.RoleBot, core.CapMessage)
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write([]byte(`<div class="msg bot">` + template.HTMLEscapeString(botMsg.Content) + `</div>`))
+	count, err := s.capCount(ctx, session, nationalID)
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
 		return
 	}
-	// store patient message
-	if _, err := s.Repo.CreateMessage(r.Context(), nationalID, pkg.RolePatient, content); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if count >= messageCap {
+		s.replyCapped(ctx, t, session, sessionID, received)
 		return
 	}
-	// Build LLM reply using last week's transcript for context
-	since := time.Now().AddDate(0, 0, -7)
-	ctxTranscript, err := s.Repo.GetTranscriptSince(r.Context(), nationalID, since)
+	moderation, err := s.Chat.ModerateMessage(ctx, content)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Moderation is best effort; an outage must not block the intake.
+		log.Printf("moderation check failed for session %s: %v", session.ID, err)
+	}
+	var attachments []*pkg.Attachment
+	if upload != nil {
+		a, err := s.storeUpload(ctx, session.ID, upload)
+		if err != nil {
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+		attachments = append(attachments, a)
+	}
+	// store stores the patient message together with the bot's reply and
+	// the result of the LLM call that wrote it (zero for canned replies).
+	store := func(reply string, res core.ReplyResult) *pkg.Message {
+		patientMsg, botMsg, err := s.Repo.CreateMessagePair(ctx, sessionID, s.storeCap(session, nationalID, messageCap, received), content, reply, attachments...)
+		if err != nil {
+			s.discardUploads(ctx, attachments)
+			if errors.Is(err, db.ErrCapped) {
+				// Another message reached the cap while this one's reply
+				// was generated.
+				s.replyCapped(ctx, t, session, sessionID, received)
+				return nil
+			}
+			failTurn(ctx, t, session.Locale, err)
+			return nil
+		}
+		s.recordMessageMeta(ctx, patientMsg, botMsg, moderation.Category, res)
+		return botMsg
+	}
+	if s.TraceRedFlags && !session.TraceLLM && core.MentionsRedFlag(content) {
+		s.traceSession(ctx, session)
+		ctx = withLLMContext(ctx, session)
+	}
+	if moderation.Escalate {
+		if err := s.Repo.EscalateSession(ctx, session.ID, moderation.Category); err != nil {
+			s.discardUploads(ctx, attachments)
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+	}
+	if moderation.Reply != "" {
+		if botMsg := store(moderation.Reply, core.ReplyResult{}); botMsg != nil {
+			t.reply(botMsg, attachments)
+		}
 		return
 	}
-	reply, err := s.Chat.ReplyWithContext(r.Context(), nationalID, content, ctxTranscript)
+	// A patient adding details after the wrap-up or the doctor's review
+	// re-opens the session until the bot wraps up again.
+	if session.Status == pkg.StatusReadyForDoctor || session.Status == pkg.StatusReviewed {
+		if err := s.Repo.UpdateSessionStatus(ctx, session.ID, pkg.StatusOpen); err != nil {
+			s.discardUploads(ctx, attachments)
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+	}
+	// Wrap-up looks at the topics of the whole session, the reply at the
+	// last week of it.
+	transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		s.discardUploads(ctx, attachments)
+		failTurn(ctx, t, session.Locale, err)
+		return
+	}
+	prompts := s.sessionPrompts(ctx, session)
+	pending := pkg.Message{SessionID: session.ID, Role: pkg.RolePatient, Content: content}
+	if s.Chat.ShouldWrapUp(append(transcript[:len(transcript):len(transcript)], pending)) {
+		botMsg := store(prompts.Closing, core.ReplyResult{})
+		if botMsg == nil {
+			return
+		}
+		if err := s.Repo.UpdateSessionStatus(ctx, session.ID, pkg.StatusReadyForDoctor); err != nil {
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+		go s.summarizeSession(session.ID, false)
+		t.reply(botMsg, attachments)
+		return
+	}
+	history, err := s.patientContext(ctx, session.ID)
+	if err != nil {
+		s.discardUploads(ctx, attachments)
+		failTurn(ctx, t, session.Locale, err)
+		return
+	}
+	if st, ok := t.(streamTurn); ok && upload == nil {
+		s.streamReply(ctx, st, session, sessionID, s.storeCap(session, nationalID, messageCap, received), content, history, moderation.Category, received)
+		return
+	}
+	if at, ok := t.(asyncTurn); ok && s.AsyncReplies && upload == nil {
+		var p *pkg.PendingReply
+		if s.CoalesceWindow > 0 {
+			p, err = s.replyCoalesced(ctx, session, sessionID, s.storeCap(session, nationalID, messageCap, received), content, moderation.Category, received)
+		} else {
+			p, _, err = s.replyAsync(ctx, session, sessionID, s.storeCap(session, nationalID, messageCap, received), content, history, moderation.Category, received, nil)
+		}
+		if errors.Is(err, db.ErrCapped) {
+			s.replyCapped(ctx, t, session, sessionID, received)
+			return
+		}
+		if err != nil {
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+		at.pending(p)
+		return
+	}
+	prompts = s.recallPrompts(ctx, prompts, session, history, content)
+	res, err := s.Chat.StreamReplyWithPrompts(ctx, prompts, content, history, t.chunk)
 	if err != nil {
 		// Trigger HTMX error bubble; patient bubble already appended client-side
-		http.Error(w, "llm error", http.StatusBadGateway)
+		s.discardUploads(ctx, attachments)
+		err = replyError(err)
+		if rt, ok := t.(retryTurn); ok && upload == nil {
+			// Keep the message so the patient can retry the reply without
+			// sending it again.
+			m, storeErr := s.Repo.CreateUnansweredMessage(ctx, sessionID, content)
+			if storeErr == nil {
+				s.recordMessageMeta(ctx, m, nil, moderation.Category, core.ReplyResult{})
+				logError(ctx, "chat turn", err)
+				rt.unanswered(errorStatus(err), session.Locale, m)
+				return
+			}
+			log.Printf("store unanswered message in session %s: %v", session.ID, storeErr)
+		}
+		failTurn(ctx, t, session.Locale, err)
 		return
 	}
-	if _, err := s.Repo.CreateMessage(r.Context(), nationalID, pkg.RoleBot, reply); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if botMsg := store(res.Text, res); botMsg != nil {
+		s.recordLatency(ctx, session.ID, botMsg, time.Since(received), res.Latency)
+		t.reply(botMsg, attachments)
+	}
+}
+
+// Cap scopes for Server.CapScope.
+const (
+	CapPerWeek    = "week"
+	CapPerSession = "session"
+)
+
+// Cap weeks for Server.CapWeek.
+const (
+	CapWeekISO    = string(core.CapWeekISO)
+	CapWeekJalali = string(core.CapWeekJalali)
+)
+
+// capCount returns the number of patient messages counted against the
+// message cap: the session's with CapPerSession, otherwise the patient's at
+// the session's clinic since the start of the week.
+func (s *Server) capCount(ctx context.Context, session *pkg.Session, nationalID string) (int, error) {
+	if s.CapScope == CapPerSession {
+		return s.Repo.CountSessionPatientMessages(ctx, session.ID)
+	}
+	return s.Repo.CountUserMessagesSince(ctx, nationalID, session.ClinicID, s.weekStart(time.Now()))
+}
+
+// storeCap returns the cap a patient message received at t is checked
+// against again when it is stored (see db.Cap).
+func (s *Server) storeCap(session *pkg.Session, nationalID string, messageCap int, t time.Time) *db.Cap {
+	if s.CapScope == CapPerSession {
+		return &db.Cap{Limit: messageCap}
+	}
+	return &db.Cap{Limit: messageCap, NationalID: nationalID, ClinicID: session.ClinicID, Since: s.weekStart(t)}
+}
+
+// replyCapped answers a patient message over the cap with the cap notice
+// alone.
+func (s *Server) replyCapped(ctx context.Context, t turn, session *pkg.Session, sessionID uuid.UUID, received time.Time) {
+	resetsAt := s.capResetsAt(received)
+	botMsg, err := s.Repo.CreateMessage(ctx, sessionID, pkg.RoleBot, s.sessionPrompts(ctx, session).CapNotice(resetsAt))
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
 		return
 	}
-	escReply := template.HTMLEscapeString(reply)
+	t.capped(botMsg, resetsAt)
+}
+
+// weekStart returns the start of the cap week containing t.
+func (s *Server) weekStart(t time.Time) time.Time {
+	return core.CapWeek(s.CapWeek).Start(t)
+}
+
+// capResetsAt returns when a cap reached at t resets, or the zero time
+// with CapPerSession: a session's cap only ends with the session.
+func (s *Server) capResetsAt(t time.Time) time.Time {
+	if s.CapScope == CapPerSession {
+		return time.Time{}
+	}
+	return core.CapWeek(s.CapWeek).ResetsAt(t)
+}
+
+// clinicCap returns the message cap new sessions at clinic start with: the
+// clinic's cap when set, otherwise MessageCap.
+func (s *Server) clinicCap(clinic *pkg.Clinic) int {
+	if clinic.MessageCap != nil {
+		return *clinic.MessageCap
+	}
+	return s.MessageCap
+}
+
+// messageCap returns the effective message cap for the session: the cap
+// stored on it when it was created, plus the extra messages of any active
+// override granted to the patient or the session.  Sessions from before
+// caps were stored have 0 and use their clinic's current cap.
+func (s *Server) messageCap(ctx context.Context, session *pkg.Session, nationalID string) (int, error) {
+	messageCap := session.MessageCap
+	if messageCap == 0 {
+		clinic, err := s.Repo.GetClinic(ctx, session.ClinicID)
+		if err != nil {
+			return 0, fmt.Errorf("load clinic %q: %w", session.ClinicID, err)
+		}
+		messageCap = s.clinicCap(clinic)
+	}
+	overrides, err := s.Repo.ListActiveCapOverrides(ctx, nationalID, session.ID)
+	if err != nil {
+		return 0, fmt.Errorf("load cap overrides: %w", err)
+	}
+	for _, o := range overrides {
+		messageCap += o.ExtraMessages
+	}
+	return messageCap, nil
+}
+
+// recordMessageMeta stores the moderation category of a patient message and
+// the model and token usage of res, the LLM call that wrote the bot's reply
+// to it, if any (botMsg is nil for a message left unanswered).  Both are
+// informational, so failures are only logged.
+func (s *Server) recordMessageMeta(ctx context.Context, patientMsg, botMsg *pkg.Message, category string, res core.ReplyResult) {
+	if category != "" {
+		if err := s.Repo.SetMessageModeration(ctx, patientMsg.ID, category); err != nil {
+			log.Printf("store moderation category for message %d: %v", patientMsg.ID, err)
+		}
+	}
+	if res.Model != "" {
+		if err := s.Repo.SetMessageModel(ctx, botMsg.ID, res.Model); err != nil {
+			log.Printf("store model for message %d: %v", botMsg.ID, err)
+		}
+	}
+	if u := res.Usage; u.PromptTokens+u.CompletionTokens > 0 {
+		usage := pkg.MessageUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, Estimated: u.Estimated}
+		if err := s.Repo.SetMessageMeta(ctx, botMsg.ID, pkg.MetaUsage, usage); err != nil {
+			log.Printf("store token usage for message %d: %v", botMsg.ID, err)
+		}
+	}
+}
+
+// recordLatency stores how long a bot reply took, in total and in the LLM,
+// and warns when it was slower than SlowReply.  Failures are only logged.
+func (s *Server) recordLatency(ctx context.Context, sessionID string, botMsg *pkg.Message, total, llmLatency time.Duration) {
+	if err := s.Repo.SetMessageLatency(ctx, botMsg.ID, total, llmLatency); err != nil {
+		log.Printf("store latency for message %d: %v", botMsg.ID, err)
+	}
+	if s.SlowReply > 0 && total > s.SlowReply {
+		log.Printf("slow reply in session %s: %v (LLM %v)", sessionID,
+			total.Round(time.Millisecond), llmLatency.Round(time.Millisecond))
+	}
+}
+
+// writeJSON encodes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeBotMessage writes a single bot bubble fragment for HTMX to append.
+// The bubble carries the message's seq for the page's read receipts (see
+// handleMarkRead).
+func writeBotMessage(w http.ResponseWriter, m *pkg.Message) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(`<div class="msg bot">` + escReply + `</div>`))
+	w.Write([]byte(`<div class="msg bot" data-seq="` + strconv.Itoa(m.Seq) + `">` + template.HTMLEscapeString(m.Content) + `</div>`))
+}
+
+// summarizeSession regenerates and stores the summary for a session, like
+// refreshSummary.  It runs outside the request so it uses its own context
+// and only logs failures.
+func (s *Server) summarizeSession(sessionID string, force bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err := s.refreshSummary(ctx, sessionID, force); err != nil {
+		log.Printf("summarize %s: %v", sessionID, err)
+	}
+}
+
+// refreshSummary regenerates the summary of a session from its transcript,
+// skipping the LLM when the transcript has not changed unless force is set.
+func (s *Server) refreshSummary(ctx context.Context, sessionID string, force bool) (*pkg.Summary, error) {
+	if s.Summarizer == nil {
+		return nil, errors.New("summarizer not configured")
+	}
+	session, err := s.Repo.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("load session: %w", err)
+	}
+	ctx = withLLMContext(ctx, session)
+	transcript, err := s.Repo.GetSessionTranscript(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("load transcript: %w", err)
+	}
+	summary, _, err := s.Summarizer.Refresh(ctx, s.sessionPrompts(ctx, session), sessionID, transcript, force)
+	return summary, err
+}
+
+// replaceSummary regenerates the summary of a session from its transcript
+// alone, discarding the stored one (see core.Summarizer.Replace).  Like
+// summarizeSession it runs outside the request.
+func (s *Server) replaceSummary(sessionID string) {
+	if s.Summarizer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	session, err := s.Repo.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		log.Printf("replace summary of %s: load session: %v", sessionID, err)
+		return
+	}
+	ctx = withLLMContext(ctx, session)
+	transcript, err := s.Repo.GetSessionTranscript(ctx, sessionID)
+	if err != nil {
+		log.Printf("replace summary of %s: load transcript: %v", sessionID, err)
+		return
+	}
+	if _, err := s.Summarizer.Replace(ctx, s.sessionPrompts(ctx, session), sessionID, transcript); err != nil {
+		log.Printf("replace summary of %s: %v", sessionID, err)
+	}
 }
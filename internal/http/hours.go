@@ -0,0 +1,78 @@
+package http
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+// clinicHours returns the operating hours of a clinic, nil (always open)
+// when it has none.  Hours that do not parse are logged and ignored, so a
+// typo in the clinics table cannot take the bot offline.
+func clinicHours(clinic *pkg.Clinic) *core.OperatingHours {
+	if clinic == nil {
+		return nil
+	}
+	hours, err := core.ParseOperatingHours(clinic.OperatingHours, clinic.Timezone)
+	if err != nil {
+		log.Printf("clinic %s: %v", clinic.ID, err)
+		return nil
+	}
+	return hours
+}
+
+// pageHours are a clinic's operating hours as the chat page exposes them to
+// its script, for warning the patient before the bot stops answering.
+type pageHours struct {
+	Timezone string          `json:"timezone"`
+	Days     []core.DayHours `json:"days"`
+}
+
+// replyClosedHours answers a patient message sent outside the clinic's
+// operating hours with the closed hours notice, without calling the LLM.
+// As with the cap notice the patient message is not stored.  The notice is
+// stored once per closed period: while the session ends with the notice
+// for the same opening time it is reported again rather than stored again.
+func (s *Server) replyClosedHours(ctx context.Context, t turn, session *pkg.Session, sessionID uuid.UUID, opensAt time.Time) {
+	transcript, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
+		return
+	}
+	if n := len(transcript); n > 0 && transcript[n-1].Role == pkg.RoleBot {
+		last := &transcript[n-1]
+		meta, err := s.Repo.GetMessageMetadata(ctx, last.ID)
+		if err != nil {
+			failTurn(ctx, t, session.Locale, err)
+			return
+		}
+		var notified time.Time
+		if ok, err := meta.Get(pkg.MetaOpensAt, &notified); ok && err == nil && notified.Equal(opensAt) {
+			t.closedHours(last, opensAt)
+			return
+		}
+	}
+	botMsg, err := s.Repo.CreateMessage(ctx, sessionID, pkg.RoleBot, s.sessionPrompts(ctx, session).ClosedHoursNotice(opensAt))
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
+		return
+	}
+	if err := s.Repo.SetMessageMeta(ctx, botMsg.ID, pkg.MetaOpensAt, opensAt); err != nil {
+		log.Printf("record opening time of notice %d: %v", botMsg.ID, err)
+	}
+	t.closedHours(botMsg, opensAt)
+}
+
+// closedHoursFrame is the "done" frame of a closed hours notice.
+func closedHoursFrame(m *pkg.Message, opensAt time.Time) socketFrame {
+	f := socketFrame{Type: "done", Content: m.Content, Seq: m.Seq}
+	if !opensAt.IsZero() {
+		f.OpensAt = &opensAt
+	}
+	return f
+}
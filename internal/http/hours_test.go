@@ -0,0 +1,123 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/pkg"
+)
+
+// setClinicHours sets the operating hours of the default clinic.
+func setClinicHours(t *testing.T, s *Server, hours, timezone string) {
+	t.Helper()
+	if _, err := s.Repo.DB.Exec(`UPDATE clinics SET operating_hours = ?, timezone = ? WHERE id = ?`, hours, timezone, pkg.DefaultClinic); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closedNow returns operating hours closed now, open only on the day
+// after tomorrow in Tehran, and when they next open.
+func closedNow(t *testing.T) (string, time.Time) {
+	t.Helper()
+	now := time.Now()
+	day := strings.ToLower(now.In(jalali.Tehran).AddDate(0, 0, 2).Weekday().String()[:3])
+	spec := day + " 09:00-10:00"
+	hours, err := core.ParseOperatingHours(spec, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec, hours.NextOpen(now)
+}
+
+func TestClosedHours(t *testing.T) {
+	s, fake := newTestServer(t)
+	spec, opensAt := closedNow(t)
+	setClinicHours(t, s, spec, "")
+	cookie, session := startPatient(t, s, "0012345678")
+	ctx := context.Background()
+	before, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice := core.DefaultPrompts().ClosedHoursNotice(opensAt)
+
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سلام، ساعت ۲ شب است"}}, cookie)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, core.ClosedHoursMessage) {
+		t.Fatalf("message: %d %q, want the closed hours notice", resp.StatusCode, body)
+	}
+	resp = serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages/stream", url.Values{"content": {"کسی هست؟"}}, cookie)
+	done := streamDone(t, readBody(t, resp))
+	if done.Content != notice || done.OpensAt == nil || !done.OpensAt.Equal(opensAt) || done.Capped {
+		t.Errorf("done event %+v, want the notice opening at %v", done, opensAt)
+	}
+	if len(fake.ChatCalls) != 0 {
+		t.Errorf("%d chat calls outside operating hours, want none", len(fake.ChatCalls))
+	}
+	// The notice is stored once and the patient's messages not at all.
+	after, err := s.Repo.GetSessionTranscript(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 || after[len(after)-1].Content != notice || after[len(after)-1].Role != pkg.RoleBot {
+		t.Fatalf("transcript %+v, want the notice added once", after)
+	}
+
+	// Once open, the bot answers again.
+	setClinicHours(t, s, "", "")
+	resp = serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سلام"}}, cookie)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, fake.ChatReply) {
+		t.Errorf("message when open: %d %q, want the bot's reply", resp.StatusCode, body)
+	}
+	if len(fake.ChatCalls) != 1 {
+		t.Errorf("%d chat calls when open, want 1", len(fake.ChatCalls))
+	}
+}
+
+// TestClosedHoursInvalid checks that hours which do not parse leave the
+// bot answering.
+func TestClosedHoursInvalid(t *testing.T) {
+	s, fake := newTestServer(t)
+	setClinicHours(t, s, "weekdays 9-5", "")
+	cookie, session := startPatient(t, s, "0012345678")
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سلام"}}, cookie)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, fake.ChatReply) {
+		t.Errorf("message: %d %q, want the bot's reply", resp.StatusCode, body)
+	}
+}
+
+func TestChatPageHours(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, _ := startPatient(t, s, "0012345678")
+	if body := readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie)); strings.Contains(body, "clinicHours") {
+		t.Errorf("chat page without operating hours exposes them")
+	}
+
+	spec, opensAt := closedNow(t)
+	setClinicHours(t, s, spec, "Asia/Tehran")
+	body := readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie))
+	for _, want := range []string{
+		`id="clinicHours"`,
+		`"timezone":"Asia/Tehran"`,
+		`"day":"sat"`,
+		`"ranges":["09:00-10:00"]`,
+		"خارج از ساعت کاری مطب هستیم",
+		jalali.FormatDateTime(opensAt),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("closed chat page: missing %q", want)
+		}
+	}
+
+	// Open all week: the hours are exposed without the closed notice.
+	setClinicHours(t, s, "sat-fri 00:00-24:00", "")
+	body = readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie))
+	if !strings.Contains(body, `id="clinicHours"`) || strings.Contains(body, "خارج از ساعت کاری مطب هستیم") {
+		t.Errorf("open chat page: want the hours without the closed notice")
+	}
+}
@@ -0,0 +1,374 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"waitroom-chatbot/internal/fhir"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/cursor"
+)
+
+// Security schemes of the OpenAPI document, named in apiRoute.Security.
+const (
+	securityPatient = "patientCookie"
+	securityDoctor  = "doctorBasic"
+	securityAdmin   = "adminToken"
+	securityAPIKey  = "apiKey"
+)
+
+// apiParam is a query parameter of an apiRoute.
+type apiParam struct {
+	Name        string
+	Type        string // a JSON schema type, "string" when empty
+	Description string
+}
+
+// apiRoute describes a JSON API route for GET /api/openapi.json.  Path has
+// {name} placeholders for the segments the handler receives.  Request and
+// Response are values of the body types, nil for no body; ResponseType is
+// the response's content type when it is not application/json, a text
+// body unless Response is set.
+type apiRoute struct {
+	Method       string
+	Path         string
+	Summary      string
+	Security     string
+	Query        []apiParam
+	Request      interface{}
+	FormRequest  bool // the body may be a form instead of JSON
+	Status       int
+	Response     interface{}
+	ResponseType string
+}
+
+// apiRoutes lists the JSON API routes that route, routeAdmin and
+// routeDoctor serve, with the types their handlers decode and encode.  A
+// JSON route added there is listed here too.
+var apiRoutes = []apiRoute{
+	{Method: http.MethodGet, Path: "/api/openapi.json", Summary: "This OpenAPI document.",
+		Status: http.StatusOK, Response: map[string]interface{}{}},
+	{Method: http.MethodPost, Path: "/api/users/{national_id}/messages", Summary: "Send a patient message to the patient's latest session; the reply is an HTML fragment.",
+		Security: securityPatient, Request: pkg.ChatRequest{}, FormRequest: true, Status: http.StatusOK, ResponseType: "text/html"},
+	{Method: http.MethodPost, Path: "/api/sessions/{session_id}/messages", Summary: "Send a patient message to a session; the reply is an HTML fragment.",
+		Security: securityPatient, Request: pkg.ChatRequest{}, FormRequest: true, Status: http.StatusOK, ResponseType: "text/html"},
+	{Method: http.MethodPut, Path: "/api/sessions/{session_id}/messages/last", Summary: "Edit the patient's latest message before the bot replies to it.",
+		Security: securityPatient, Request: pkg.ChatRequest{}, FormRequest: true, Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/summaries", Summary: "List summaries with their session metadata, oldest update first.",
+		Security: securityAPIKey, Query: []apiParam{
+			{Name: "from", Description: "date or RFC 3339 time the updates start at"},
+			{Name: "to", Description: "date or RFC 3339 time the updates end at"},
+			{Name: "national_id"},
+			{Name: "limit", Type: "integer"},
+			{Name: "cursor", Description: "next_cursor of the previous page"},
+		}, Status: http.StatusOK, Response: cursor.Page[pkg.SessionSummary]{}},
+	{Method: http.MethodGet, Path: "/api/sessions/{session_id}/fhir", Summary: "The session's summary and transcript as a FHIR R4 document Bundle.",
+		Security: securityAPIKey, Status: http.StatusOK, Response: fhir.Bundle{}, ResponseType: fhirContentType},
+	{Method: http.MethodGet, Path: "/doctor/events", Summary: "Events of the doctor's clinic after an event ID.",
+		Security: securityDoctor, Query: []apiParam{{Name: "since", Type: "integer", Description: "ID of the last event seen"}},
+		Status: http.StatusOK, Response: eventsResponse{}},
+	{Method: http.MethodGet, Path: "/admin/stats", Summary: "Operational statistics.",
+		Security: securityAdmin, Query: []apiParam{
+			{Name: "clinic", Description: "count the active sessions of this clinic only"},
+			{Name: "from", Description: "start of the latency and read period, by default a day ago"},
+			{Name: "to", Description: "end of the latency and read period"},
+		}, Status: http.StatusOK, Response: statsResponse{}},
+	{Method: http.MethodGet, Path: "/admin/webhooks", Summary: "List the webhooks, without their secrets.",
+		Security: securityAdmin, Status: http.StatusOK, Response: []pkg.Webhook{}},
+	{Method: http.MethodPost, Path: "/admin/webhooks", Summary: "Register a webhook; a secret is generated when none is given.",
+		Security: securityAdmin, Request: pkg.Webhook{}, Status: http.StatusCreated, Response: pkg.Webhook{}},
+	{Method: http.MethodDelete, Path: "/admin/webhooks/{id}", Summary: "Remove a webhook and its queued deliveries.",
+		Security: securityAdmin, Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/admin/webhooks/{id}/deliveries", Summary: "The most recent deliveries of a webhook.",
+		Security: securityAdmin, Query: []apiParam{{Name: "limit", Type: "integer"}},
+		Status: http.StatusOK, Response: []pkg.WebhookDelivery{}},
+	{Method: http.MethodGet, Path: "/admin/sessions/{session_id}/traces", Summary: "The traced model calls of a session.",
+		Security: securityAdmin, Status: http.StatusOK, Response: []pkg.LLMTrace{}},
+	{Method: http.MethodPost, Path: "/admin/cap-overrides", Summary: "Grant a patient or a session extra messages on top of the cap.",
+		Security: securityAdmin, Request: pkg.CapOverride{}, Status: http.StatusCreated, Response: pkg.CapOverride{}},
+	{Method: http.MethodPost, Path: "/admin/patients/purge", Summary: "Delete every session of a patient with their messages, summaries and attachments.",
+		Security: securityAdmin, Request: purgeRequest{}, Status: http.StatusOK, Response: purgeResponse{}},
+	{Method: http.MethodGet, Path: "/admin/prompt-profiles", Summary: "List the prompt profiles.",
+		Security: securityAdmin, Status: http.StatusOK, Response: []pkg.PromptProfile{}},
+	{Method: http.MethodPost, Path: "/admin/prompt-profiles", Summary: "Create or update a prompt profile.",
+		Security: securityAdmin, Request: pkg.PromptProfile{}, Status: http.StatusOK, Response: pkg.PromptProfile{}},
+	{Method: http.MethodGet, Path: "/admin/prompt-profiles/{name}", Summary: "Get a prompt profile.",
+		Security: securityAdmin, Status: http.StatusOK, Response: pkg.PromptProfile{}},
+	{Method: http.MethodDelete, Path: "/admin/prompt-profiles/{name}", Summary: "Delete a prompt profile.",
+		Security: securityAdmin, Status: http.StatusNoContent},
+}
+
+// openAPIDoc is an OpenAPI 3.0 document.
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*jsonSchema           `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Required    bool        `json:"required,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+// jsonSchema is the subset of the OpenAPI schema object the document uses.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+	MaxLength            *int64                 `json:"maxLength,omitempty"`
+	Maximum              *int64                 `json:"maximum,omitempty"`
+}
+
+// handleOpenAPI serves GET /api/openapi.json, the OpenAPI description of
+// the JSON API.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newOpenAPIDoc(apiRoutes))
+}
+
+// newOpenAPIDoc builds the OpenAPI document describing routes.  Named
+// struct types become component schemas, derived from their json and
+// validate tags.
+func newOpenAPIDoc(routes []apiRoute) *openAPIDoc {
+	doc := &openAPIDoc{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "waitroom-chatbot", Version: "1"},
+		Paths:   make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*jsonSchema),
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				securityPatient: {Type: "apiKey", In: "cookie", Name: patientCookie},
+				securityDoctor:  {Type: "http", Scheme: "basic"},
+				securityAdmin:   {Type: "http", Scheme: "bearer"},
+				securityAPIKey:  {Type: "apiKey", In: "header", Name: apiKeyHeader},
+			},
+		},
+	}
+	errSchema := doc.schema(reflect.TypeOf(inputError{}))
+	for _, rt := range routes {
+		op := &openAPIOperation{Summary: rt.Summary, Responses: make(map[string]*openAPIResponse)}
+		for _, name := range pathParams(rt.Path) {
+			op.Parameters = append(op.Parameters, openAPIParameter{Name: name, In: "path", Required: true, Schema: &jsonSchema{Type: "string"}})
+		}
+		for _, q := range rt.Query {
+			typ := q.Type
+			if typ == "" {
+				typ = "string"
+			}
+			op.Parameters = append(op.Parameters, openAPIParameter{Name: q.Name, In: "query", Description: q.Description, Schema: &jsonSchema{Type: typ}})
+		}
+		if rt.Request != nil {
+			body := doc.schema(reflect.TypeOf(rt.Request))
+			op.RequestBody = &openAPIBody{Required: true, Content: map[string]openAPIMediaType{"application/json": {body}}}
+			if rt.FormRequest {
+				op.RequestBody.Content["application/x-www-form-urlencoded"] = openAPIMediaType{body}
+			}
+			op.Responses["400"] = &openAPIResponse{Description: "The body was rejected.",
+				Content: map[string]openAPIMediaType{"application/json": {errSchema}}}
+		}
+		resp := &openAPIResponse{Description: http.StatusText(rt.Status)}
+		switch {
+		case rt.Response != nil:
+			typ := rt.ResponseType
+			if typ == "" {
+				typ = "application/json"
+			}
+			resp.Content = map[string]openAPIMediaType{typ: {doc.schema(reflect.TypeOf(rt.Response))}}
+		case rt.ResponseType != "":
+			resp.Content = map[string]openAPIMediaType{rt.ResponseType: {&jsonSchema{Type: "string"}}}
+		}
+		op.Responses[strconv.Itoa(rt.Status)] = resp
+		if rt.Security != "" {
+			op.Security = []map[string][]string{{rt.Security: {}}}
+		}
+		if doc.Paths[rt.Path] == nil {
+			doc.Paths[rt.Path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[rt.Path][strings.ToLower(rt.Method)] = op
+	}
+	return doc
+}
+
+// pathParams returns the names of the {name} placeholders in path.
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			names = append(names, seg[1:len(seg)-1])
+		}
+	}
+	return names
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawJSONType   = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schema returns the schema of values of t as encoding/json writes them: a
+// reference to a component schema for named struct types, added to doc on
+// first use, otherwise the schema itself.
+func (doc *openAPIDoc) schema(t reflect.Type) *jsonSchema {
+	switch {
+	case t == timeType:
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	case t == rawJSONType, t.Implements(marshalerType):
+		// Encoded by its own method, as any JSON value.
+		return &jsonSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := doc.schema(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: doc.schema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: doc.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return doc.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			// Reserve the name first, for types referring to themselves.
+			doc.Components.Schemas[name] = nil
+			doc.Components.Schemas[name] = doc.structSchema(t)
+		}
+		return &jsonSchema{Ref: "#/components/schemas/" + name}
+	}
+	return &jsonSchema{}
+}
+
+// schemaName is the component name of a named type: its name, capitalised.
+// An instance of a generic type is named after the type and its type
+// arguments, e.g. PageSessionSummary for cursor.Page[pkg.SessionSummary].
+func schemaName(t reflect.Type) string {
+	name, args, generic := strings.Cut(t.Name(), "[")
+	if generic {
+		for _, arg := range strings.Split(strings.TrimSuffix(args, "]"), ",") {
+			name += capitalise(arg[strings.LastIndex(arg, ".")+1:])
+		}
+	}
+	return capitalise(name)
+}
+
+func capitalise(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// structSchema returns the object schema of a struct type, with the
+// fields of embedded structs inlined as encoding/json does.  Fields
+// without omitempty are required, as are those tagged validate:"required";
+// max rules bound strings and numbers.
+func (doc *openAPIDoc) structSchema(t reflect.Type) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			embedded := doc.structSchema(f.Type)
+			for n, p := range embedded.Properties {
+				s.Properties[n] = p
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		p := doc.schema(f.Type)
+		required := !strings.Contains(opts, "omitempty")
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			switch rule {
+			case "required":
+				required = true
+			case "max":
+				n, _ := strconv.ParseInt(arg, 10, 64)
+				if p.Type == "string" {
+					p.MaxLength = &n
+				} else {
+					p.Maximum = &n
+				}
+			}
+		}
+		s.Properties[name] = p
+		if required {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
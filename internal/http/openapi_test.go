@@ -0,0 +1,280 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes are the routes under /api and /admin that do not
+// serve the JSON API, so are left out of the OpenAPI document.
+var undocumentedRoutes = map[string]string{
+	"/api/sessions/*/messages/stream":  "server-sent events",
+	"/api/sessions/*/replies/*/stream": "server-sent events",
+	"/api/sessions/*/messages/*/retry": "HTMX fragment",
+	"/api/sessions/*/replies/*":        "HTMX fragment",
+	"/api/sessions/*/attachments":      "HTMX fragment",
+	"/api/sessions/*/read":             "read receipt of the chat page",
+	"/admin/audit":                     "HTML page",
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := newOpenAPIDoc(apiRoutes)
+	documented := map[string]bool{}
+	for path, ops := range doc.Paths {
+		pattern := regexp.MustCompile(`\{[^}]+\}`).ReplaceAllString(path, "*")
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+pattern] = true
+		}
+	}
+	registered := map[string]bool{}
+	for _, routes := range [][]methodRoute{patientRoutes, doctorRoutes, adminRoutes} {
+		for _, rt := range routes {
+			for _, m := range rt.methods {
+				registered[m+" "+rt.pattern] = true
+				json := strings.HasPrefix(rt.pattern, "/api/") || strings.HasPrefix(rt.pattern, "/admin/") || rt.pattern == "/doctor/events"
+				if _, skip := undocumentedRoutes[rt.pattern]; json && !skip && !documented[m+" "+rt.pattern] {
+					t.Errorf("%s %s is not in the OpenAPI document", m, rt.pattern)
+				}
+			}
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("%s is documented but not served", route)
+		}
+	}
+}
+
+// TestOpenAPIDocument checks the served document against the rules of the
+// OpenAPI 3.0 specification.
+func TestOpenAPIDocument(t *testing.T) {
+	s, _ := newTestServer(t)
+	resp := serve(s, http.MethodGet, "/api/openapi.json", nil)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var doc map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	v := openAPIValidator{t: t, doc: doc}
+	v.validate()
+
+	// Schemas follow the json and validate tags of the types.
+	schemas := v.object("components.schemas", v.object("components", doc["components"])["schemas"])
+	request := v.object("ChatRequest", schemas["ChatRequest"])
+	content := v.object("ChatRequest.content", v.object("ChatRequest.properties", request["properties"])["content"])
+	if content["type"] != "string" || content["maxLength"] != float64(4000) || !contains(request["required"], "content") {
+		t.Errorf("ChatRequest schema %v", request)
+	}
+	page := v.object("PageSessionSummary", schemas["PageSessionSummary"])
+	if items := v.object("items", v.object("properties", page["properties"])["items"]); items["type"] != "array" {
+		t.Errorf("PageSessionSummary schema %v", page)
+	}
+}
+
+// openAPIValidator checks a decoded OpenAPI 3.0 document against the rules
+// of the specification the generator could break.
+type openAPIValidator struct {
+	t   *testing.T
+	doc map[string]interface{}
+}
+
+var (
+	openAPIVersion  = regexp.MustCompile(`^3\.0\.\d+$`)
+	statusCode      = regexp.MustCompile(`^([1-5]\d\d|[1-5]XX|default)$`)
+	pathPlaceholder = regexp.MustCompile(`\{([^}]+)\}`)
+	operations      = map[string]bool{"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true}
+	schemaTypes     = map[string]bool{"string": true, "number": true, "integer": true, "boolean": true, "array": true, "object": true}
+)
+
+func (v openAPIValidator) validate() {
+	if version, _ := v.doc["openapi"].(string); !openAPIVersion.MatchString(version) {
+		v.t.Errorf("openapi %q, want 3.0.x", v.doc["openapi"])
+	}
+	info := v.object("info", v.doc["info"])
+	for _, field := range []string{"title", "version"} {
+		if s, _ := info[field].(string); s == "" {
+			v.t.Errorf("info.%s is empty", field)
+		}
+	}
+	components := v.object("components", v.doc["components"])
+	schemes := v.object("components.securitySchemes", components["securitySchemes"])
+	for name, raw := range schemes {
+		scheme := v.object("securitySchemes."+name, raw)
+		switch scheme["type"] {
+		case "apiKey":
+			if scheme["name"] == nil || scheme["in"] != "query" && scheme["in"] != "header" && scheme["in"] != "cookie" {
+				v.t.Errorf("security scheme %s: %v", name, scheme)
+			}
+		case "http":
+			if scheme["scheme"] == nil {
+				v.t.Errorf("security scheme %s has no scheme", name)
+			}
+		default:
+			v.t.Errorf("security scheme %s of type %v", name, scheme["type"])
+		}
+	}
+	for name, schema := range v.object("components.schemas", components["schemas"]) {
+		v.schema("components.schemas."+name, schema)
+	}
+	paths := v.object("paths", v.doc["paths"])
+	if len(paths) == 0 {
+		v.t.Error("no paths")
+	}
+	for path, item := range paths {
+		if !strings.HasPrefix(path, "/") {
+			v.t.Errorf("path %q does not start with /", path)
+		}
+		for method, raw := range v.object(path, item) {
+			where := strings.ToUpper(method) + " " + path
+			if !operations[method] {
+				v.t.Errorf("%s: not an operation", where)
+				continue
+			}
+			v.operation(where, pathPlaceholder.FindAllStringSubmatch(path, -1), v.object(where, raw), schemes)
+		}
+	}
+}
+
+func (v openAPIValidator) operation(where string, placeholders [][]string, op map[string]interface{}, schemes map[string]interface{}) {
+	seen := map[string]bool{}
+	for _, raw := range v.array(where+" parameters", op["parameters"]) {
+		p := v.object(where+" parameter", raw)
+		name, _ := p["name"].(string)
+		in, _ := p["in"].(string)
+		key := in + " " + name
+		switch {
+		case name == "":
+			v.t.Errorf("%s: parameter without a name", where)
+		case in != "query" && in != "header" && in != "path" && in != "cookie":
+			v.t.Errorf("%s: parameter %s in %q", where, name, in)
+		case seen[key]:
+			v.t.Errorf("%s: parameter %s twice", where, key)
+		case in == "path" && p["required"] != true:
+			v.t.Errorf("%s: path parameter %s not required", where, name)
+		}
+		seen[key] = true
+		v.schema(where+" parameter "+name, p["schema"])
+	}
+	for _, m := range placeholders {
+		if !seen["path "+m[1]] {
+			v.t.Errorf("%s: path parameter %s not declared", where, m[1])
+		}
+	}
+	if raw, ok := op["requestBody"]; ok {
+		v.content(where+" request", v.object(where+" requestBody", raw)["content"], true)
+	}
+	responses := v.object(where+" responses", op["responses"])
+	if len(responses) == 0 {
+		v.t.Errorf("%s: no responses", where)
+	}
+	for code, raw := range responses {
+		if !statusCode.MatchString(code) {
+			v.t.Errorf("%s: response %q", where, code)
+		}
+		r := v.object(where+" response "+code, raw)
+		if d, _ := r["description"].(string); d == "" {
+			v.t.Errorf("%s: response %s has no description", where, code)
+		}
+		if c, ok := r["content"]; ok {
+			v.content(where+" response "+code, c, true)
+		}
+	}
+	for _, raw := range v.array(where+" security", op["security"]) {
+		for name := range v.object(where+" security", raw) {
+			if _, ok := schemes[name]; !ok {
+				v.t.Errorf("%s: unknown security scheme %s", where, name)
+			}
+		}
+	}
+}
+
+func (v openAPIValidator) content(where string, raw interface{}, required bool) {
+	content := v.object(where+" content", raw)
+	if required && len(content) == 0 {
+		v.t.Errorf("%s: empty content", where)
+	}
+	for mediaType, m := range content {
+		if !strings.Contains(mediaType, "/") {
+			v.t.Errorf("%s: media type %q", where, mediaType)
+		}
+		v.schema(where+" "+mediaType, v.object(where+" "+mediaType, m)["schema"])
+	}
+}
+
+func (v openAPIValidator) schema(where string, raw interface{}) {
+	s := v.object(where, raw)
+	if ref, ok := s["$ref"].(string); ok {
+		name, found := strings.CutPrefix(ref, "#/components/schemas/")
+		schemas, _ := v.doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		if _, exists := schemas[name]; !found || !exists {
+			v.t.Errorf("%s: $ref %s does not resolve", where, ref)
+		}
+		if len(s) > 1 {
+			v.t.Errorf("%s: $ref with siblings, which OpenAPI 3.0 ignores", where)
+		}
+		return
+	}
+	typ, hasType := s["type"].(string)
+	if hasType && !schemaTypes[typ] {
+		v.t.Errorf("%s: type %q", where, typ)
+	}
+	if typ == "array" {
+		if _, ok := s["items"]; !ok {
+			v.t.Errorf("%s: array without items", where)
+		}
+	}
+	if items, ok := s["items"]; ok {
+		v.schema(where+"[]", items)
+	}
+	props := v.object(where+" properties", s["properties"])
+	for name, p := range props {
+		v.schema(where+"."+name, p)
+	}
+	for _, name := range v.array(where+" required", s["required"]) {
+		if _, ok := props[name.(string)]; !ok {
+			v.t.Errorf("%s: required %v is not a property", where, name)
+		}
+	}
+	if ap, ok := s["additionalProperties"]; ok {
+		v.schema(where+"{}", ap)
+	}
+}
+
+// object returns raw as an object, nil when absent.
+func (v openAPIValidator) object(where string, raw interface{}) map[string]interface{} {
+	if raw == nil {
+		return nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		v.t.Errorf("%s: %T, want an object", where, raw)
+	}
+	return m
+}
+
+// array returns raw as an array, nil when absent.
+func (v openAPIValidator) array(where string, raw interface{}) []interface{} {
+	if raw == nil {
+		return nil
+	}
+	a, ok := raw.([]interface{})
+	if !ok {
+		v.t.Errorf("%s: %T, want an array", where, raw)
+	}
+	return a
+}
+
+func contains(raw interface{}, want string) bool {
+	a, _ := raw.([]interface{})
+	for _, s := range a {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
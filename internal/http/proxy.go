@@ -0,0 +1,118 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or single IPs
+// (e.g. "10.0.0.0/8,127.0.0.1") naming the reverse proxies whose forwarded
+// headers are honoured.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// withForwarded applies the X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-For headers of requests coming from a trusted proxy, so the
+// handlers see the scheme, host and client address the patient used.
+// Headers from anyone else are ignored since clients can set them freely.
+func (s *Server) withForwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, s.forwardedRequest(r))
+	})
+}
+
+// forwardedRequest returns r as seen through its forwarded headers (see
+// withForwarded).
+func (s *Server) forwardedRequest(r *http.Request) *http.Request {
+	if !s.trustedProxy(r.RemoteAddr) {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	r2.URL = &u
+	switch proto := strings.ToLower(firstForwarded(r.Header.Get("X-Forwarded-Proto"))); proto {
+	case "http", "https":
+		r2.URL.Scheme = proto
+	}
+	if host := firstForwarded(r.Header.Get("X-Forwarded-Host")); host != "" {
+		r2.Host = host
+	}
+	// The client is the right-most address not added by a trusted proxy.
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		r2.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		if !s.trustedIP(ip) {
+			break
+		}
+	}
+	return r2
+}
+
+// trustedProxy reports whether addr (host:port) is a trusted proxy.
+func (s *Server) trustedProxy(addr string) bool {
+	if len(s.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && s.trustedIP(ip)
+}
+
+func (s *Server) trustedIP(ip net.IP) bool {
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstForwarded returns the first value of a comma separated forwarded
+// header, which proxies chaining to each other may produce.
+func firstForwarded(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// isHTTPS reports whether the patient reached us over TLS, directly or
+// through a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, true},
+		{" 10.0.0.0/8 , 127.0.0.1,,::1", []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128"}, true},
+		{"10.0.0.300", nil, false},
+		{"10.0.0.0/33", nil, false},
+		{"proxy.local", nil, false},
+	}
+	for _, tt := range tests {
+		nets, err := ParseTrustedProxies(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseTrustedProxies(%q): %v", tt.list, err)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseTrustedProxies(%q) = %v, want %v", tt.list, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseTrustedProxies(%q) = %v, want %v", tt.list, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestForwardedRequest(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TrustedProxies: proxies}
+	tests := []struct {
+		name, remote, proto, host, forwardedFor string
+		https                                   bool
+		wantHost, wantClient                    string
+	}{
+		{name: "direct", remote: "192.0.2.1:1234", wantHost: "example.com", wantClient: "192.0.2.1"},
+		{name: "direct with forged headers", remote: "192.0.2.1:1234", proto: "https", host: "evil.test", forwardedFor: "198.51.100.7",
+			wantHost: "example.com", wantClient: "192.0.2.1"},
+		{name: "proxied", remote: "10.0.0.5:1234", proto: "https", host: "clinic.example", forwardedFor: "198.51.100.7",
+			https: true, wantHost: "clinic.example", wantClient: "198.51.100.7"},
+		{name: "proxied chain", remote: "10.0.0.5:1234", proto: "HTTPS, http", host: "clinic.example, inner", forwardedFor: "203.0.113.9, 198.51.100.7, 10.0.0.6",
+			https: true, wantHost: "clinic.example", wantClient: "198.51.100.7"},
+		{name: "proxied plain http", remote: "10.0.0.5:1234", proto: "http", forwardedFor: "198.51.100.7",
+			wantHost: "example.com", wantClient: "198.51.100.7"},
+		{name: "unknown proto", remote: "10.0.0.5:1234", proto: "gopher", wantHost: "example.com", wantClient: "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.RemoteAddr = tt.remote
+		for header, v := range map[string]string{"X-Forwarded-Proto": tt.proto, "X-Forwarded-Host": tt.host, "X-Forwarded-For": tt.forwardedFor} {
+			if v != "" {
+				r.Header.Set(header, v)
+			}
+		}
+		got := s.forwardedRequest(r)
+		if isHTTPS(got) != tt.https || got.Host != tt.wantHost || clientIP(got) != tt.wantClient {
+			t.Errorf("%s: https %t, host %q, client %q; want %t, %q, %q", tt.name, isHTTPS(got), got.Host, clientIP(got), tt.https, tt.wantHost, tt.wantClient)
+		}
+		if got != r && (r.URL.Scheme != "http" || r.Host != "example.com") {
+			t.Errorf("%s: original request changed", tt.name)
+		}
+	}
+	// Without trusted proxies nothing is forwarded.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.5:1234"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got := (&Server{}).forwardedRequest(r); isHTTPS(got) {
+		t.Error("forwarded headers honoured without trusted proxies")
+	}
+}
+
+func TestStartBehindProxy(t *testing.T) {
+	s, _ := newTestServer(t)
+	var err error
+	if s.TrustedProxies, err = ParseTrustedProxies("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"national_id": {"0012345678"}, "phone": {"09120000000"}, "name": {"Sara"}}
+	tests := []struct {
+		name, remote string
+		secure       bool
+	}{
+		{"direct", "192.0.2.1:1234", false},
+		{"forged header", "192.0.2.1:1234", false},
+		{"tls proxy", "10.0.0.5:1234", true},
+	}
+	for _, tt := range tests {
+		r := newRequest(http.MethodPost, "http://internal:8080/start", form)
+		r.RemoteAddr = tt.remote
+		if tt.name != "direct" {
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "clinic.example")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		resp := w.Result()
+		// The redirect is relative, so it stays on the host the patient used.
+		if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/chat" {
+			t.Errorf("%s: %d to %q, want 303 to /chat", tt.name, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		c := patientCookieOf(t, resp)
+		if c.Secure != tt.secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode {
+			t.Errorf("%s: cookie Secure %t, HttpOnly %t, SameSite %v; want Secure %t, HttpOnly, Lax", tt.name, c.Secure, c.HttpOnly, c.SameSite, tt.secure)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// handleMarkRead serves POST /api/sessions/{id}/read, the chat page's read
+// receipt: the form field seq is the highest seq of the bot bubbles that
+// have scrolled into view.  It only needs the patient's cookie and costs a
+// single UPDATE, which ignores stale receipts and other patients'
+// sessions, so it always answers 204 once the request is well-formed.
+func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request, sessionID string) {
+	nationalID := s.patientNationalID(r)
+	if _, err := uuid.Parse(sessionID); err != nil || nationalID == "" {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+	seq, err := strconv.Atoi(r.FormValue("seq"))
+	if err != nil || seq < 1 {
+		writeError(w, r, errs.New(errs.Invalid, "seq must be a positive message number"))
+		return
+	}
+	if err := s.Repo.MarkSessionRead(r.Context(), sessionID, nationalID, seq); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/pkg"
+)
+
+// templateFuncs returns the functions available to the templates.  This is
+// the one place they are registered.  The parsed templates are shared by
+// all requests, so the functions must not depend on request state: what
+// varies per request, like the locale, is passed to them from the page
+// data (see pageContext), as in {{ t .Locale "key" }}.
+func templateFuncs() template.FuncMap {
+	funcs := i18n.FuncMap()
+	funcs["jdate"] = jalali.FormatDate
+	funcs["jdatetime"] = jalali.FormatDateTime
+	return funcs
+}
+
+// parseTemplates parses the embedded templates with templateFuncs.
+func parseTemplates() (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs()).ParseFS(templateFS, "templates/*.html")
+}
+
+// pageContext holds the per-request values of the patient pages: the
+// locale they are shown in and the clinic's branding.  The page data embed
+// it, so every page reads them as .Locale and .Brand.
+type pageContext struct {
+	Locale string
+	Brand  branding
+}
+
+// newPageContext returns the page context of a clinic's page in locale,
+// the default locale when it is not supported.
+func newPageContext(clinic *pkg.Clinic, locale string) pageContext {
+	return pageContext{Locale: i18n.Normalize(locale), Brand: brandingFor(clinic)}
+}
+
+// errorPage is served when a page fails to render.  It is a constant rather
+// than a template so it still works when the templates are the problem.
+const errorPage = `<!doctype html>
+<html lang="fa">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>خطا</title>
+</head>
+<body style="font-family: sans-serif; direction: rtl; max-width: 400px; margin: 2rem auto;">
+  <h1>خطا</h1>
+  <p>متأسفانه نمایش این صفحه ممکن نشد. لطفاً چند لحظه بعد دوباره تلاش کنید یا به کارکنان پذیرش اطلاع دهید.</p>
+</body>
+</html>
+`
+
+// errorFragment replaces errorPage for HTMX requests, which swap the
+// response into a page that is already showing.
+const errorFragment = `<div class="msg bot error" dir="rtl">متأسفانه نمایش این بخش ممکن نشد. لطفاً دوباره تلاش کنید.</div>
+`
+
+// render executes the named template into a buffer and writes it only once
+// it has rendered completely, so a template error never leaves a
+// half-written page behind a 200.  On error the Persian error page is served
+// with a 500 instead, as a fragment for HTMX requests.
+func (s *Server) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	s.renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus is render with another status than 200 OK.
+func (s *Server) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := s.Templates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("render %s (request %s): %v", name, requestID(r.Context()), err)
+		page := errorPage
+		if r.Header.Get("HX-Request") == "true" {
+			page = errorFragment
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(page))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
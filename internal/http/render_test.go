@@ -0,0 +1,123 @@
+package http
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg"
+)
+
+// breakTemplates redefines the named templates of s to fail halfway
+// through.
+func breakTemplates(t *testing.T, s *Server, names ...string) {
+	t.Helper()
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if _, err := tmpl.New(name).Parse(`<p>half rendered</p>{{ index .Locale 99 }}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Templates = tmpl
+}
+
+func TestRenderBrokenTemplate(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, _ := startPatient(t, s, "0012345678")
+	breakTemplates(t, s, "patient", "patient_history")
+	tests := []struct {
+		target string
+		htmx   bool
+		want   string
+	}{
+		{"/chat", false, errorPage},
+		{"/chat/history", true, errorFragment},
+	}
+	for _, tt := range tests {
+		r := newRequest(http.MethodGet, tt.target, nil)
+		r.AddCookie(cookie)
+		if tt.htmx {
+			r.Header.Set("HX-Request", "true")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusInternalServerError || w.Body.String() != tt.want {
+			t.Errorf("%s: %d %q, want 500 with the error page", tt.target, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q", tt.target, ct)
+		}
+	}
+}
+
+func TestRenderStatus(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Templates = template.Must(template.New("ok").Parse(`<p>{{ . }}</p>`))
+	w := httptest.NewRecorder()
+	s.renderStatus(w, newRequest(http.MethodGet, "/", nil), http.StatusBadRequest, "ok", "سلام")
+	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "<p>سلام</p>" {
+		t.Errorf("render: %d %q", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestNewPageContext(t *testing.T) {
+	clinic := &pkg.Clinic{DisplayName: "درمانگاه مهر"}
+	for locale, want := range map[string]string{"": i18n.Default, "ar": "ar", "az": "az", "xx": i18n.Default} {
+		if got := newPageContext(clinic, locale); got.Locale != want || got.Brand.Name != clinic.DisplayName {
+			t.Errorf("page context of %q: %+v, want locale %q and the clinic's name", locale, got, want)
+		}
+	}
+}
+
+// TestRenderConcurrent serves the patient pages in every locale at once
+// and checks each page against the one served alone; run it with -race to
+// check that rendering shares no request state.
+func TestRenderConcurrent(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, _ := startPatient(t, s, "0012345678")
+	var targets []string
+	for _, l := range i18n.Supported() {
+		targets = append(targets, "/?lang="+l.Code)
+	}
+	targets = append(targets, "/chat")
+	get := func(target string) string {
+		r := newRequest(http.MethodGet, target, nil)
+		// Returning patients are sent from the start page to their chat.
+		if target == "/chat" {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	want := map[string]string{}
+	for _, target := range targets {
+		want[target] = get(target)
+	}
+	if want[targets[0]] == want[targets[1]] {
+		t.Fatalf("%s and %s render the same page", targets[0], targets[1])
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, target := range targets {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				if got := get(target); got != want[target] {
+					t.Errorf("%s rendered differently under concurrent requests", target)
+				}
+			}(target)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,283 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+// pendingReplyTimeout bounds a background LLM call.  A reply still pending
+// after it (e.g. because the server restarted) is reported as failed.
+const pendingReplyTimeout = 2 * time.Minute
+
+// replyErrorBubble returns the bubble shown in place of a reply that could
+// not be generated, in the session's locale.
+func replyErrorBubble(locale string) string {
+	return `<div class="msg bot error">` + template.HTMLEscapeString(i18n.T(locale, "error.reply")) + `</div>`
+}
+
+// replyOutcome is the result of a reply generated by replyAsync: the
+// stored reply, or why there is none.
+type replyOutcome struct {
+	reply *pkg.Message
+	err   error
+}
+
+// replyAsync stores the patient message, unanswered, with a pending reply
+// to it and generates the reply in the background.  The patient's page
+// polls handleGetReply until it is done, so slow completions survive mobile
+// browsers dropping the request; a reply that fails leaves the message for
+// the patient to retry.  c is the cap the message is checked against (see
+// db.Cap); over it nothing is stored and db.ErrCapped returned.  received
+// is when the patient's message arrived, from which the reply's latency is
+// measured.  With onChunk the reply is streamed to it as it comes in.  The
+// returned channel receives the outcome once the reply is stored or has
+// failed.  A patient editing the message meanwhile (see
+// handleEditLastMessage) has the reply generated again for the edited
+// message, which is not streamed.
+func (s *Server) replyAsync(ctx context.Context, session *pkg.Session, sessionID uuid.UUID, c *db.Cap, content string, history []pkg.Message, category string, received time.Time, onChunk func(string)) (*pkg.PendingReply, <-chan replyOutcome, error) {
+	patientMsg, pending, err := s.Repo.CreatePendingReply(ctx, sessionID, c, content)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.recordMessageMeta(ctx, patientMsg, nil, category, core.ReplyResult{})
+	base := s.sessionPrompts(ctx, session)
+	outcome := make(chan replyOutcome, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(withLLMContext(context.Background(), session), pendingReplyTimeout)
+		defer cancel()
+		var botMsg *pkg.Message
+		var err error
+		for {
+			prompts := s.recallPrompts(ctx, base, session, history, content)
+			var res core.ReplyResult
+			if onChunk != nil {
+				res, err = s.Chat.StreamReplyWithPrompts(ctx, prompts, content, history, onChunk)
+			} else {
+				res, err = s.Chat.ReplyWithPrompts(ctx, prompts, content, history)
+			}
+			if err != nil {
+				break
+			}
+			botMsg, err = s.Repo.CompletePendingReply(ctx, pending.ID, sessionID, content, res.Text)
+			if err == nil {
+				s.recordMessageMeta(ctx, patientMsg, botMsg, "", res)
+				s.recordLatency(ctx, session.ID, botMsg, time.Since(received), res.Latency)
+				break
+			}
+			if !errors.Is(err, db.ErrMessageEdited) {
+				break
+			}
+			var p *pkg.PendingReply
+			if p, err = s.Repo.GetPendingReply(ctx, pending.ID); err != nil {
+				break
+			}
+			content, onChunk = p.Patient, nil
+		}
+		if err != nil && !errors.Is(err, db.ErrReplySuperseded) {
+			log.Printf("async reply %s for session %s: %v", pending.ID, session.ID, err)
+			if err := s.Repo.FailPendingReply(context.Background(), pending.ID, err.Error()); err != nil {
+				log.Printf("mark reply %s failed: %v", pending.ID, err)
+			}
+		}
+		outcome <- replyOutcome{reply: botMsg, err: err}
+	}()
+	return pending, outcome, nil
+}
+
+// handleGetReply serves a pending reply to the patient who sent the
+// message: the placeholder again while it is pending, otherwise the bot
+// bubble (or an error bubble, or nothing for a superseded reply) that
+// replaces it and stops the polling.
+func (s *Server) handleGetReply(w http.ResponseWriter, r *http.Request, sessionID, replyID string) {
+	pending, err := s.Repo.GetPendingReply(r.Context(), replyID)
+	if errs.Is(err, errs.NotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if pending.SessionID != sessionID || !s.ownsSession(r, sessionID) {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case pending.Status == pkg.ReplyDone:
+		writeBotMessage(w, &pkg.Message{Seq: pending.Seq, Content: pending.Content})
+	case pending.Status == pkg.ReplySuperseded:
+		// A later reply answers the message; the empty body removes the
+		// placeholder.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case replyFailed(pending):
+		locale := i18n.Default
+		if session, err := s.Repo.GetSessionByID(r.Context(), sessionID); err == nil {
+			locale = session.Locale
+		}
+		if pending.PatientMessageID != 0 {
+			// The message is kept unanswered: offer to retry its reply.
+			writeRetryBubble(w, http.StatusOK, locale, &pkg.Message{ID: pending.PatientMessageID, SessionID: sessionID})
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, replyErrorBubble(locale))
+	default:
+		writePendingReply(w, pending)
+	}
+}
+
+// replyFailed reports whether a pending reply failed or will not be done
+// any more.
+func replyFailed(p *pkg.PendingReply) bool {
+	return p.Status == pkg.ReplyFailed || p.Status == pkg.ReplyPending && time.Since(p.CreatedAt) > pendingReplyTimeout+time.Minute
+}
+
+// writePendingReply writes the placeholder bubble for a pending reply.
+func writePendingReply(w http.ResponseWriter, p *pkg.PendingReply) {
+	src := template.HTMLEscapeString("/api/sessions/" + p.SessionID + "/replies/" + p.ID)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<div class="msg bot pending" hx-get="`+src+`" hx-trigger="every 2s" hx-swap="outerHTML">…</div>`)
+}
+
+// unansweredGrace is how old a trailing patient message must be before the
+// chat page offers to fetch its reply, so replies still being generated are
+// not requested twice.
+const unansweredGrace = 2 * time.Minute
+
+// maxReplyRetries bounds how often the patient can retry the reply to one
+// unanswered message, so a persistent LLM failure does not loop.
+const maxReplyRetries = 3
+
+// writeRetryBubble writes the error bubble for a patient message left
+// unanswered, with a button retrying its reply that the bubble is replaced
+// by.  The page swaps HTML error responses in rather than showing its own
+// error bubble.
+func writeRetryBubble(w http.ResponseWriter, status int, locale string, m *pkg.Message) {
+	key := "error.reply"
+	if status == http.StatusServiceUnavailable {
+		key = "error.busy"
+	}
+	src := template.HTMLEscapeString(retryPath(m))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, `<div class="msg bot error">`+template.HTMLEscapeString(i18n.T(locale, key))+
+		` <button hx-post="`+src+`" hx-target="closest .msg" hx-swap="outerHTML">`+
+		template.HTMLEscapeString(i18n.T(locale, "chat.retry"))+`</button></div>`)
+}
+
+// retryPath returns the path retrying the reply to m.
+func retryPath(m *pkg.Message) string {
+	return "/api/sessions/" + m.SessionID + "/messages/" + strconv.FormatInt(m.ID, 10) + "/retry"
+}
+
+// handleRetryReply generates the reply to an unanswered patient message
+// again, for the patient who sent it.  The message is not stored again, so
+// the retry does not count toward the cap.  Only the session's latest
+// message can be retried, at most maxReplyRetries times.
+func (s *Server) handleRetryReply(w http.ResponseWriter, r *http.Request, sessionID, messageID string) {
+	sid, err := uuid.Parse(sessionID)
+	if err != nil {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(messageID, 10, 64)
+	if err != nil {
+		writeError(w, r, db.ErrNotFound)
+		return
+	}
+	session, err := s.Repo.GetSessionByID(r.Context(), sessionID)
+	if errs.Is(err, errs.NotFound) || err == nil && !s.ownedBy(r, session) {
+		writeError(w, r, errSessionNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if session.ClosedAt != nil {
+		httpTurn{w, r}.closed()
+		return
+	}
+	// No reply to retry is NotFound, too many retries db.ErrRetryLimit
+	// (Capped).
+	m, retries, err := s.Repo.ClaimRetry(r.Context(), session.ID, id, maxReplyRetries)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx := withLLMContext(r.Context(), session)
+	transcript, err := s.patientContext(ctx, session.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	history := messagesBefore(transcript, m.ID)
+	prompts := s.recallPrompts(ctx, s.sessionPrompts(ctx, session), session, history, m.Content)
+	res, err := s.Chat.ReplyWithPrompts(ctx, prompts, m.Content, history)
+	if err != nil {
+		err = replyError(err)
+		logError(ctx, r.Method+" "+r.URL.Path, err)
+		status := errorStatus(err)
+		if retries < maxReplyRetries {
+			writeRetryBubble(w, status, session.Locale, m)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		io.WriteString(w, replyErrorBubble(session.Locale))
+		return
+	}
+	botMsg, err := s.Repo.AnswerMessage(ctx, sid, m.ID, m.Content, res.Text)
+	if errs.Is(err, errs.NotFound) {
+		// A concurrent retry answered it first, or the patient edited it.
+		writeError(w, r, errs.Wrap(errs.Conflict, err))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordMessageMeta(ctx, m, botMsg, "", res)
+	writeBotMessage(w, botMsg)
+}
+
+// editGrace is how long after sending it the patient can edit a message the
+// bot has not replied to.  It covers the whole time a reply is pending.
+const editGrace = pendingReplyTimeout
+
+// handleEditLastMessage serves PUT /api/sessions/{id}/messages/last: the
+// patient replaces their latest message before the bot replies to it,
+// while its reply is pending or the message is left unanswered, within
+// editGrace.  A pending reply is generated for the edited message.  Once
+// the bot has replied it answers 409.
+func (s *Server) handleEditLastMessage(w http.ResponseWriter, r *http.Request, sessionID string) {
+	session, content, ok := s.postedSessionMessage(w, r, sessionID)
+	if !ok {
+		return
+	}
+	if session.ClosedAt != nil {
+		writeError(w, r, errSessionClosed)
+		return
+	}
+	// A message the bot has replied to, or past the edit window, is
+	// db.ErrNotEditable (Conflict).
+	if err := s.Repo.EditLastPatientMessage(r.Context(), session.ID, content, time.Now().Add(-editGrace)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"waitroom-chatbot/pkg"
+)
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	actorKey
+	clinicKey
+)
+
+// withRequestID attaches a request ID to the request context and echoes it
+// in the X-Request-ID response header.  An ID supplied by an upstream proxy
+// is reused so log lines can be correlated.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// actor returns the authenticated doctor or admin name for the request.
+func actor(ctx context.Context) string {
+	if a, ok := ctx.Value(actorKey).(string); ok && a != "" {
+		return a
+	}
+	return "anonymous"
+}
+
+// doctorClinic returns the clinic of the authenticated doctor, whose
+// patients are the only ones the doctor pages show.
+func doctorClinic(ctx context.Context) string {
+	if c, ok := ctx.Value(clinicKey).(string); ok && c != "" {
+		return c
+	}
+	return pkg.DefaultClinic
+}
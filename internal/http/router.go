@@ -0,0 +1,230 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps a handler with what a group of routes shares, e.g.
+// authenticating the requests or bounding how long they may take.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws, the first outermost.
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// RouterConfig lists the middleware wrapping each group of routes,
+// outermost first.  It applies inside the middleware every request goes
+// through: request IDs, forwarded headers and compression.  Middleware
+// added for a feature passes requests through unchanged while the feature
+// is turned off, so the groups can list it unconditionally.
+type RouterConfig struct {
+	// Patient wraps the start pages, the chat pages and the patient API,
+	// and any path no other group serves.
+	Patient []Middleware
+	// Doctor wraps the /doctor routes.
+	Doctor []Middleware
+	// Admin wraps the /admin routes.
+	Admin []Middleware
+	// Metrics wraps GET /metrics, served with the admin routes.
+	Metrics []Middleware
+}
+
+// DefaultRouterConfig returns the configuration NewServer routes with:
+// every group runs under the request deadline, which streams are exempt
+// from (see requestTimeout), the patient routes keep the patient cookie's
+// lifetime rolling, the doctor routes require a doctor's login and the
+// admin routes the admin token.
+func (s *Server) DefaultRouterConfig() RouterConfig {
+	return RouterConfig{
+		Patient: []Middleware{s.withTimeout, s.withPatientCookie},
+		Doctor:  []Middleware{s.withTimeout, s.requireDoctor},
+		Admin:   []Middleware{s.withTimeout, s.requireAdmin},
+		Metrics: []Middleware{s.withTimeout},
+	}
+}
+
+// routeGroup is a group of routes served by one handler.
+type routeGroup struct {
+	// match reports whether a request is for one of the group's routes.
+	match   func(r *http.Request) bool
+	handler http.Handler
+}
+
+// router holds the handlers SetRouterConfig builds: all serves every
+// route, public every route but the admin ones, and admin only those.
+type router struct {
+	all, public, admin http.Handler
+}
+
+// SetRouterConfig routes the server's requests to the route groups
+// wrapped in the middleware cfg lists.
+func (s *Server) SetRouterConfig(cfg RouterConfig) {
+	admin := []routeGroup{
+		{s.isMetrics, chain(http.HandlerFunc(s.handleMetrics), cfg.Metrics...)},
+		{isAdmin, chain(http.HandlerFunc(s.routeAdmin), cfg.Admin...)},
+	}
+	public := []routeGroup{
+		{isDoctor, chain(http.HandlerFunc(s.routeDoctor), cfg.Doctor...)},
+		{func(*http.Request) bool { return true }, chain(http.HandlerFunc(s.route), cfg.Patient...)},
+	}
+	common := []Middleware{withRequestID, s.withForwarded, s.withCompression}
+	s.router = router{
+		all:    chain(dispatch(append(admin[:len(admin):len(admin)], public...)), common...),
+		public: chain(dispatch(public), common...),
+		admin:  chain(dispatch(admin), common...),
+	}
+}
+
+// dispatch serves a request with the first group matching it.
+func dispatch(groups []routeGroup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, g := range groups {
+			if g.match(r) {
+				g.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func (s *Server) isMetrics(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Path == "/metrics" && s.Metrics != nil
+}
+
+func isAdmin(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+func isDoctor(r *http.Request) bool {
+	return r.URL.Path == "/doctor" || strings.HasPrefix(r.URL.Path, "/doctor/")
+}
+
+// ServeHTTP routes the request.  It serves the admin routes too unless
+// SeparateAdmin is set.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.SeparateAdmin {
+		s.router.public.ServeHTTP(w, r)
+		return
+	}
+	s.router.all.ServeHTTP(w, r)
+}
+
+// AdminHandler returns the handler serving only the admin routes, for the
+// admin listener used with SeparateAdmin.
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.router.admin.ServeHTTP(w, r)
+	})
+}
+
+// methodRoute is a route's path pattern, in which "*" matches one path
+// segment, and the methods it is served with.
+type methodRoute struct {
+	pattern string
+	methods []string
+}
+
+// patientRoutes, doctorRoutes and adminRoutes list the routes of route,
+// routeDoctor and routeAdmin for methodNotAllowed.
+var (
+	patientRoutes = []methodRoute{
+		{"/", []string{http.MethodGet}},
+		{"/start", []string{http.MethodPost}},
+		{"/start/verify", []string{http.MethodPost}},
+		{"/status", []string{http.MethodGet}},
+		{"/healthz", []string{http.MethodGet}},
+		{"/readyz", []string{http.MethodGet}},
+		{"/chat", []string{http.MethodGet}},
+		{"/chat/history", []string{http.MethodGet}},
+		{"/chat/*", []string{http.MethodGet}},
+		{"/chat/*/history", []string{http.MethodGet}},
+		{"/api/users/*/messages", []string{http.MethodPost}},
+		{"/api/sessions/*/messages", []string{http.MethodPost}},
+		{"/api/sessions/*/messages/stream", []string{http.MethodPost}},
+		{"/api/sessions/*/messages/last", []string{http.MethodPut}},
+		{"/api/sessions/*/messages/*/retry", []string{http.MethodPost}},
+		{"/api/sessions/*/read", []string{http.MethodPost}},
+		{"/api/sessions/*/attachments", []string{http.MethodPost}},
+		{"/api/sessions/*/replies/*", []string{http.MethodGet}},
+		{"/api/sessions/*/replies/*/stream", []string{http.MethodGet}},
+		{"/api/sessions/*/fhir", []string{http.MethodGet}},
+		{"/api/summaries", []string{http.MethodGet}},
+		{"/api/openapi.json", []string{http.MethodGet}},
+		{"/ws/sessions/*", []string{http.MethodGet}},
+		{"/attachments/*", []string{http.MethodGet}},
+		{"/*/start", []string{http.MethodPost}},
+		{"/*/start/verify", []string{http.MethodPost}},
+	}
+	doctorRoutes = []methodRoute{
+		{"/doctor", []string{http.MethodGet}},
+		{"/doctor/search", []string{http.MethodGet}},
+		{"/doctor/sessions", []string{http.MethodGet}},
+		{"/doctor/events", []string{http.MethodGet}},
+		{"/doctor/events/stream", []string{http.MethodGet}},
+		{"/doctor/sessions/*", []string{http.MethodGet}},
+		{"/doctor/sessions/*/summary", []string{http.MethodPost}},
+		{"/doctor/sessions/*/reviewed", []string{http.MethodPost}},
+		{"/doctor/sessions/*/reassign", []string{http.MethodPost}},
+		{"/doctor/sessions/*/assign", []string{http.MethodPost}},
+		{"/doctor/sessions/*/cap-overrides", []string{http.MethodPost}},
+		{"/doctor/sessions/*/traces", []string{http.MethodGet}},
+		{"/doctor/sessions/*/messages/*/redact", []string{http.MethodPost}},
+	}
+	adminRoutes = []methodRoute{
+		{"/admin/audit", []string{http.MethodGet}},
+		{"/admin/stats", []string{http.MethodGet}},
+		{"/admin/webhooks", []string{http.MethodGet, http.MethodPost}},
+		{"/admin/webhooks/*", []string{http.MethodDelete}},
+		{"/admin/webhooks/*/deliveries", []string{http.MethodGet}},
+		{"/admin/sessions/*/traces", []string{http.MethodGet}},
+		{"/admin/cap-overrides", []string{http.MethodPost}},
+		{"/admin/patients/purge", []string{http.MethodPost}},
+		{"/admin/prompt-profiles", []string{http.MethodGet, http.MethodPost}},
+		{"/admin/prompt-profiles/*", []string{http.MethodGet, http.MethodDelete}},
+	}
+)
+
+// methodNotAllowed answers a request no route served with 405 and the
+// Allow header when its path is one of routes' with another method, so
+// only paths served with no method are 404.  It reports whether it
+// answered.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, routes []methodRoute) bool {
+	for _, rt := range routes {
+		if matchPath(rt.pattern, r.URL.Path) && !allows(rt.methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(rt.methods, ", "))
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether path matches pattern, "*" matching any one
+// non-empty segment.
+func matchPath(pattern, path string) bool {
+	want, got := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != got[i] && (want[i] != "*" || got[i] == "") {
+			return false
+		}
+	}
+	return true
+}
+
+func allows(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/internal/status"
+	"waitroom-chatbot/pkg"
+)
+
+// sampleData returns, for every template a handler renders, representative
+// data of the type the handler passes, filled in so that the optional parts
+// of the page render too.
+func sampleData() map[string]interface{} {
+	now := time.Now()
+	pain, week := 6, &pkg.Duration{Value: 2, Unit: pkg.UnitWeek}
+	reason := "self_harm"
+	session := &pkg.Session{ID: "00000000-0000-0000-0000-000000000000", CreatedAt: now,
+		Status: pkg.StatusReadyForDoctor, EscalatedAt: &now, EscalationReason: &reason, ClinicID: pkg.DefaultClinic, Locale: i18n.Default, TraceLLM: true}
+	transcript := []pkg.Message{
+		{ID: 1, SessionID: session.ID, Role: pkg.RoleBot, Content: core.FirstMessage, CreatedAt: now},
+		{ID: 2, SessionID: session.ID, Role: pkg.RolePatient, Content: "سردرد دارم", CreatedAt: now,
+			Attachments: []pkg.Attachment{{ID: 1, SessionID: session.ID, MessageID: 2}}},
+	}
+	previews := previewsPage{Sessions: []pkg.DoctorSessionPreview{{SessionID: session.ID, Status: pkg.StatusReadyForDoctor,
+		Escalated: true, Priority: 3, PainScore: &pain, Duration: week, KeyPoints: []string{"سردرد"},
+		UpdatedAt: now, LastMessage: now, AssignedTo: "doctor", Unread: 2, SummaryStale: true}}, Next: "c", Reload: "/doctor"}
+	page := pageContext{Locale: i18n.Default, Brand: branding{Name: "درمانگاه", Logo: "/logo.png", Accent: "#0b74de"}}
+	return map[string]interface{}{
+		"start": startPage{pageContext: page, Action: "/start", Locales: i18n.Supported(), Error: i18n.T(i18n.Default, "start.unavailable"),
+			Notice: i18n.T(i18n.Default, "start.expired")},
+		"verify": verifyPage{pageContext: page, Action: "/start/verify", ID: session.ID, Phone: "09120000000",
+			Restart: "/", Error: i18n.T(i18n.Default, "verify.wrong")},
+		"patient": patientPage{pageContext: page, SessionID: session.ID, Greeting: core.FirstMessage,
+			Transcript: transcript, Uploads: true, Socket: "/ws/sessions/" + session.ID,
+			Unanswered: retryPath(&transcript[1])},
+		"doctor":          dashboardPage{previewsPage: previews, Query: dashboardQuery{Status: "ready", RedFlag: true, From: "2024-01-01", Mine: true}, Assignment: true},
+		"doctor_sessions": previewsPage{Sessions: previews.Sessions, Next: "c", Updated: 1, Reload: "/doctor"},
+		"doctor_session": sessionPage{Session: session,
+			Summary: &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, FreeText: "سردرد از دو هفته پیش",
+				UpdatedAt: now, Priority: 3, PainScore: &pain, PainScoreClamped: true, Duration: week,
+				Questions:   []string{"آیا تهوع دارید؟"},
+				LastAttempt: &pkg.SummaryAttempt{Status: pkg.AttemptFailed, Error: core.SummaryErrTimeout, At: now}},
+			Medications:   []core.Medication{{Name: "acetaminophen", Original: "استامینوفن", Dose: "500mg"}, {Name: "x", Unmatched: true}},
+			Transcript:    append(transcript[:2:2], pkg.Message{ID: 3, SessionID: session.ID, Role: pkg.RolePatient, CreatedAt: now, RedactedAt: &now, RedactedBy: "doctor"}),
+			CapOverrides:  []pkg.CapOverride{{SessionID: session.ID, ExtraMessages: 10, GrantedBy: "doctor", ExpiresAt: now, CreatedAt: now}},
+			ExtraMessages: defaultExtraMessages, Tracing: true,
+			Doctors: []pkg.Doctor{{ID: 1, Username: "doctor", ClinicID: pkg.DefaultClinic, Active: true}}, Me: "doctor2", Assignee: "doctor",
+			NewFrom: 2, NewCount: 1, SummaryStale: true, SummaryFailure: summaryFailures[core.SummaryErrTimeout]},
+		"doctor_traces": tracesPage{SessionID: session.ID, Traces: []pkg.LLMTrace{{ID: 1, SessionID: session.ID, Call: "summarize",
+			Model: "gpt-4o-mini", Messages: []pkg.TraceMessage{{Role: "user", Content: "سردرد دارم"}}, Response: "{}",
+			Error: "timeout", LatencyMS: 1200, CreatedAt: now}}},
+		"doctor_search": searchPage{Query: "سردرد", Groups: []*searchGroup{{SessionID: session.ID, PatientName: "بیمار",
+			SessionAt: now, Hits: []pkg.SearchHit{{Message: transcript[1], SessionID: session.ID, Before: "", Match: "سردرد", After: " دارم"}}}}},
+		"patient_history": historyPage{Locale: i18n.Default,
+			Visits: []pastVisit{{Session: *session, Summary: "سردرد از دو هفته پیش"}, {Session: *session}}},
+		"status": statusPage{Components: []status.Status{{Name: status.Chat, Level: status.Red, LastError: now},
+			{Name: status.Database}, {Name: status.Summaries, Level: status.Yellow, LastError: now}},
+			CheckedAt: now, Names: statusNames, Levels: statusLevels},
+		"admin_audit": auditPage{Entries: []pkg.AuditEntry{{Actor: "doctor", Action: "session.view", SessionID: session.ID,
+			RequestID: "r", Assignee: "doctor", CreatedAt: now}}},
+	}
+}
+
+// checkTemplates executes every template a handler renders against its
+// sample data, so a missing template or a field the data lacks fails at
+// startup rather than on a patient's request.
+func checkTemplates(tmpl *template.Template) error {
+	var errs []error
+	for name, data := range sampleData() {
+		if err := tmpl.ExecuteTemplate(io.Discard, name, data); err != nil {
+			errs = append(errs, fmt.Errorf("template %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SelfCheck validates what the server relies on but only uses on demand:
+// the templates, the built-in prompts in every locale and the prompt
+// profiles stored in the database.  It returns every problem found.
+func (s *Server) SelfCheck(ctx context.Context) error {
+	errs := []error{checkTemplates(s.Templates)}
+	for _, l := range i18n.Supported() {
+		errs = append(errs, core.CheckPrompts("locale "+l.Code, core.LocalePrompts(l.Code)))
+	}
+	profiles, err := s.Repo.ListPromptProfiles(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("list prompt profiles: %w", err))
+	}
+	for i := range profiles {
+		errs = append(errs, core.CheckPrompts("profile "+profiles[i].Name, core.PromptsFor(&profiles[i], i18n.Default)))
+	}
+	return errors.Join(errs...)
+}
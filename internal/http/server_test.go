@@ -0,0 +1,784 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/internal/core"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/jalali"
+	"waitroom-chatbot/internal/llm"
+	"waitroom-chatbot/pkg"
+
+	"github.com/google/uuid"
+)
+
+// testMessageCap is the message cap of test servers.
+const testMessageCap = 3
+
+// newTestServer returns a Server on a fresh SQLite database whose chat and
+// summaries are answered by the returned fake client.  Tests may change
+// its fields, calling SetRouterConfig again if they change the router's.
+func newTestServer(t testing.TB) (*Server, *llm.FakeClient) {
+	t.Helper()
+	conn, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.Migrate(context.Background(), conn, db.SQLite); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	repo := db.NewRepository(conn)
+	repo.Dialect = db.SQLite
+	fake := llm.NewFakeClient("از کی این درد را دارید؟")
+	s, err := NewServer(repo, core.NewChatService(fake), core.NewSummarizer(fake, repo), testMessageCap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake
+}
+
+// newRequest returns a request with body: url.Values sent as a form, a
+// string as JSON and nil as no body.
+func newRequest(method, target string, body interface{}) *http.Request {
+	switch b := body.(type) {
+	case url.Values:
+		r := httptest.NewRequest(method, target, strings.NewReader(b.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	case string:
+		r := httptest.NewRequest(method, target, strings.NewReader(b))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+	return httptest.NewRequest(method, target, nil)
+}
+
+// serve sends a request to h with the cookies and returns the response.
+func serve(h http.Handler, method, target string, body interface{}, cookies ...*http.Cookie) *http.Response {
+	r := newRequest(method, target, body)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+// readBody returns the body of resp.
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// startPatient fills in the start form for a national ID and returns the
+// patient cookie set on the redirect to the chat, and the session.
+func startPatient(t testing.TB, s *Server, nationalID string) (*http.Cookie, *pkg.Session) {
+	t.Helper()
+	resp := serve(s, http.MethodPost, "/start", url.Values{"national_id": {nationalID}, "phone": {"09120000000"}, "name": {"Sara"}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/chat" {
+		t.Fatalf("start: %d to %q, want 303 to /chat", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	session, err := s.Repo.GetLatestSession(context.Background(), nationalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patientCookieOf(t, resp), session
+}
+
+// patientCookieOf returns the patient cookie set on resp.
+func patientCookieOf(t testing.TB, resp *http.Response) *http.Cookie {
+	t.Helper()
+	for _, c := range resp.Cookies() {
+		if c.Name == patientCookie {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie set", patientCookie)
+	return nil
+}
+
+func TestRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.AdminToken = "admin-token"
+	s.APIKey = "api-key"
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	s.SetRouterConfig(s.DefaultRouterConfig())
+	cookie, session := startPatient(t, s, "0012345678")
+	other, _ := startPatient(t, s, "0098765432")
+	messages := "/api/sessions/" + session.ID + "/messages"
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     interface{}
+		cookie   *http.Cookie
+		doctor   bool
+		admin    bool
+		apiKey   bool
+		status   int
+		location string
+		contains string
+	}{
+		// start
+		{name: "start page", method: "GET", target: "/", status: 200, contains: `action="/start"`},
+		{name: "start page of returning patient", method: "GET", target: "/", cookie: cookie, status: 303, location: "/chat"},
+		{name: "start without fields", method: "POST", target: "/start", body: url.Values{"national_id": {"0012345678"}}, status: 400},
+		{name: "start with empty fields", method: "POST", target: "/start", body: url.Values{"national_id": {""}, "phone": {""}, "name": {""}}, status: 400},
+		{name: "start page of unknown clinic", method: "GET", target: "/nowhere/", status: 404},
+		{name: "start at unknown clinic", method: "POST", target: "/nowhere/start", body: url.Values{"national_id": {"1"}, "phone": {"2"}, "name": {"3"}}, status: 404},
+		{name: "start get", method: "GET", target: "/start", status: 405},
+		{name: "start page post", method: "POST", target: "/", status: 405},
+		{name: "verify get", method: "GET", target: "/start/verify", status: 405},
+
+		// patient pages
+		{name: "chat without cookie", method: "GET", target: "/chat", status: 303, location: "/"},
+		{name: "chat", method: "GET", target: "/chat", cookie: cookie, status: 200, contains: session.ID},
+		{name: "chat post", method: "POST", target: "/chat", cookie: cookie, status: 405},
+		{name: "history", method: "GET", target: "/chat/history", cookie: cookie, status: 200},
+		{name: "history without cookie", method: "GET", target: "/chat/history", status: 404},
+		{name: "legacy chat path", method: "GET", target: "/chat/0012345678", cookie: cookie, status: 303, location: "/chat"},
+		{name: "status disabled", method: "GET", target: "/status", status: 404},
+		{name: "status post", method: "POST", target: "/status", status: 405},
+		{name: "health", method: "GET", target: "/healthz", status: 200, contains: "ok"},
+		{name: "health post", method: "POST", target: "/healthz", status: 405},
+		{name: "ready", method: "GET", target: "/readyz", status: 200, contains: "ok"},
+
+		// patient API
+		{name: "message by national ID", method: "POST", target: "/api/users/0012345678/messages", body: url.Values{"content": {"سلام"}}, cookie: cookie, status: 200},
+		{name: "message by another patient's national ID", method: "POST", target: "/api/users/0012345678/messages", body: url.Values{"content": {"سلام"}}, cookie: other, status: 404, contains: `"error"`},
+		{name: "message by national ID without cookie", method: "POST", target: "/api/users/0012345678/messages", body: url.Values{"content": {"سلام"}}, status: 404},
+		{name: "message by national ID without session", method: "POST", target: "/api/users/0055555555/messages", body: url.Values{"content": {"سلام"}}, cookie: signedCookie(s, "0055555555", time.Now()), status: 404, contains: `"kind":"not_found"`},
+		{name: "message by national ID with extra segments", method: "POST", target: "/api/users/0012345678/x/messages", body: url.Values{"content": {"سلام"}}, cookie: cookie, status: 404},
+		{name: "message by national ID get", method: "GET", target: "/api/users/0012345678/messages", cookie: cookie, status: 405},
+		{name: "message to the session", method: "POST", target: messages, body: url.Values{"content": {"سلام"}}, cookie: cookie, status: 200},
+		{name: "message to an unknown session", method: "POST", target: "/api/sessions/00000000-0000-0000-0000-000000000000/messages", body: url.Values{"content": {"سلام"}}, cookie: cookie, status: 404, contains: `"error"`},
+		{name: "message of another patient", method: "POST", target: messages, body: url.Values{"content": {"سلام"}}, cookie: other, status: 404},
+		{name: "message without cookie", method: "POST", target: messages, body: url.Values{"content": {"سلام"}}, status: 404},
+		{name: "message to a non-UUID session", method: "POST", target: "/api/sessions/abc/messages", body: url.Values{"content": {"سلام"}}, cookie: cookie, status: 404},
+		{name: "empty message", method: "POST", target: messages, body: url.Values{"content": {""}}, cookie: cookie, status: 400},
+		{name: "empty JSON message", method: "POST", target: messages, body: `{"content":""}`, cookie: cookie, status: 400},
+		{name: "message with unknown field", method: "POST", target: messages, body: `{"content":"hi","extra":1}`, cookie: cookie, status: 400},
+		{name: "message get", method: "GET", target: messages, cookie: cookie, status: 405},
+		{name: "edit last message post", method: "POST", target: "/api/sessions/" + session.ID + "/messages/last", cookie: cookie, status: 405},
+		{name: "read get", method: "GET", target: "/api/sessions/" + session.ID + "/read", cookie: cookie, status: 405},
+		{name: "unknown reply", method: "GET", target: "/api/sessions/" + session.ID + "/replies/0", cookie: cookie, status: 404},
+		{name: "unknown attachment", method: "GET", target: "/attachments/1", cookie: cookie, status: 404},
+		{name: "openapi", method: "GET", target: "/api/openapi.json", status: 200, contains: `"openapi"`},
+		{name: "openapi post", method: "POST", target: "/api/openapi.json", status: 405},
+		{name: "summaries without key", method: "GET", target: "/api/summaries", status: 401},
+		{name: "summaries", method: "GET", target: "/api/summaries", apiKey: true, status: 200},
+		{name: "summaries post", method: "POST", target: "/api/summaries", apiKey: true, status: 405},
+		{name: "fhir without key", method: "GET", target: "/api/sessions/" + session.ID + "/fhir", status: 401},
+		{name: "fhir", method: "GET", target: "/api/sessions/" + session.ID + "/fhir", apiKey: true, status: 200, contains: `"Bundle"`},
+		{name: "fhir of unknown session", method: "GET", target: "/api/sessions/00000000-0000-0000-0000-000000000000/fhir", apiKey: true, status: 404},
+		{name: "socket post", method: "POST", target: "/ws/sessions/" + session.ID, status: 405},
+
+		// doctor
+		{name: "dashboard without login", method: "GET", target: "/doctor", status: 401},
+		{name: "dashboard", method: "GET", target: "/doctor", doctor: true, status: 200, contains: session.ID},
+		{name: "dashboard post", method: "POST", target: "/doctor", doctor: true, status: 405},
+		{name: "dashboard page without cursor", method: "GET", target: "/doctor/sessions", doctor: true, status: 400},
+		{name: "search", method: "GET", target: "/doctor/search?q=x", doctor: true, status: 200},
+		{name: "events", method: "GET", target: "/doctor/events?since=0", doctor: true, status: 200},
+		{name: "events without since", method: "GET", target: "/doctor/events", doctor: true, status: 400},
+		{name: "doctor session", method: "GET", target: "/doctor/sessions/" + session.ID, doctor: true, status: 200},
+		{name: "doctor session post", method: "POST", target: "/doctor/sessions/" + session.ID, doctor: true, status: 405},
+		{name: "unknown doctor session", method: "GET", target: "/doctor/sessions/00000000-0000-0000-0000-000000000000", doctor: true, status: 404},
+		{name: "mark reviewed get", method: "GET", target: "/doctor/sessions/" + session.ID + "/reviewed", doctor: true, status: 405},
+		{name: "summary get", method: "GET", target: "/doctor/sessions/" + session.ID + "/summary", doctor: true, status: 405},
+		{name: "reassign without fields", method: "POST", target: "/doctor/sessions/" + session.ID + "/reassign", body: url.Values{}, doctor: true, status: 400},
+		{name: "traces", method: "GET", target: "/doctor/sessions/" + session.ID + "/traces", doctor: true, status: 200},
+		{name: "unknown doctor path", method: "GET", target: "/doctor/nothing", doctor: true, status: 404},
+
+		// admin
+		{name: "admin without token", method: "GET", target: "/admin/stats", status: 401},
+		{name: "stats", method: "GET", target: "/admin/stats", admin: true, status: 200},
+		{name: "stats post", method: "POST", target: "/admin/stats", admin: true, status: 405},
+		{name: "audit", method: "GET", target: "/admin/audit", admin: true, status: 200},
+		{name: "webhooks", method: "GET", target: "/admin/webhooks", admin: true, status: 200},
+		{name: "webhooks put", method: "PUT", target: "/admin/webhooks", admin: true, status: 405},
+		{name: "prompt profiles", method: "GET", target: "/admin/prompt-profiles", admin: true, status: 200},
+		{name: "unknown prompt profile", method: "GET", target: "/admin/prompt-profiles/none", admin: true, status: 404},
+		{name: "prompt profile post", method: "POST", target: "/admin/prompt-profiles/none", admin: true, status: 405},
+		{name: "cap override get", method: "GET", target: "/admin/cap-overrides", admin: true, status: 405},
+		{name: "purge without national ID", method: "POST", target: "/admin/patients/purge", body: `{}`, admin: true, status: 400},
+		{name: "purge of unknown patient", method: "POST", target: "/admin/patients/purge", body: `{"national_id":"0055555555"}`, admin: true, status: 404},
+		{name: "purge get", method: "GET", target: "/admin/patients/purge", admin: true, status: 405},
+		{name: "unknown admin path", method: "GET", target: "/admin/nothing", admin: true, status: 404},
+
+		// unknown paths
+		{name: "unknown path", method: "GET", target: "/nothing/at/all", status: 404},
+		{name: "unknown API path", method: "GET", target: "/api/nothing", status: 404},
+		{name: "unknown session path", method: "POST", target: "/api/sessions/" + session.ID + "/nothing", cookie: cookie, status: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(tt.method, tt.target, tt.body)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+			if tt.doctor {
+				r.SetBasicAuth("dr", "pw")
+			}
+			if tt.admin {
+				r.Header.Set("Authorization", "Bearer admin-token")
+			}
+			if tt.apiKey {
+				r.Header.Set(apiKeyHeader, "api-key")
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("%s %s: status %d, want %d; body %q", tt.method, tt.target, w.Code, tt.status, w.Body.String())
+			}
+			if tt.location != "" && w.Header().Get("Location") != tt.location {
+				t.Errorf("Location %q, want %q", w.Header().Get("Location"), tt.location)
+			}
+			if tt.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+				t.Error("405 without an Allow header")
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body does not contain %q:\n%s", tt.contains, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestChatPageHistory(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	body := readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie))
+	if strings.Contains(body, "سردرد دارم") {
+		t.Fatal("new session shows a message")
+	}
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: %d %s", resp.StatusCode, readBody(t, resp))
+	}
+	body = readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie))
+	for _, want := range []string{"سردرد دارم", "از کی این درد را دارید؟"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("chat page does not show %q", want)
+		}
+	}
+}
+
+func TestPostMessage(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, "از کی این درد را دارید؟") {
+		t.Errorf("reply fragment does not show the bot's reply:\n%s", body)
+	}
+	if len(fake.ChatCalls) != 1 {
+		t.Errorf("%d chat calls, want 1", len(fake.ChatCalls))
+	}
+	transcript, err := s.Repo.GetSessionTranscript(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript) != 2 || transcript[0].Role != pkg.RolePatient || transcript[1].Role != pkg.RoleBot {
+		t.Fatalf("transcript %+v, want the patient message and the reply", transcript)
+	}
+}
+
+func TestMessageCap(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	for i := 0; i < testMessageCap; i++ {
+		resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"پیام"}}, cookie)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	calls := len(fake.ChatCalls)
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"یکی دیگر"}}, cookie)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("capped message: status %d", resp.StatusCode)
+	}
+	if len(fake.ChatCalls) != calls {
+		t.Error("capped message reached the model")
+	}
+	if !strings.Contains(body, s.sessionPrompts(context.Background(), session).Cap) {
+		t.Errorf("capped reply is not the cap notice:\n%s", body)
+	}
+	n, err := s.Repo.CountSessionPatientMessages(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != testMessageCap {
+		t.Errorf("%d patient messages stored, want %d", n, testMessageCap)
+	}
+}
+
+func TestReplyInsertFails(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	messages := "/api/sessions/" + session.ID + "/messages"
+	// The model answers, then storing its reply fails.
+	if _, err := s.Repo.DB.Exec(`CREATE TRIGGER fail_bot BEFORE INSERT ON messages
+        WHEN NEW.role = 'bot' BEGIN SELECT RAISE(ABORT, 'bot insert failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+	resp := serve(s, http.MethodPost, messages, url.Values{"content": {"سردرد دارم"}}, cookie)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", resp.StatusCode)
+	}
+	if len(fake.ChatCalls) != 1 {
+		t.Fatalf("%d chat calls, want 1", len(fake.ChatCalls))
+	}
+	n, err := s.Repo.CountSessionPatientMessages(context.Background(), session.ID)
+	if err != nil || n != 0 {
+		t.Fatalf("%d patient messages stored after the failure, %v; want 0", n, err)
+	}
+
+	// Sending the message again counts it once.
+	if _, err := s.Repo.DB.Exec(`DROP TRIGGER fail_bot`); err != nil {
+		t.Fatal(err)
+	}
+	if resp := serve(s, http.MethodPost, messages, url.Values{"content": {"سردرد دارم"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("second attempt: status %d", resp.StatusCode)
+	}
+	n, err = s.Repo.CountSessionPatientMessages(context.Background(), session.ID)
+	if err != nil || n != 1 {
+		t.Errorf("%d patient messages stored, %v; want 1", n, err)
+	}
+}
+
+func TestMessageCapConcurrent(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	messages := "/api/sessions/" + session.ID + "/messages"
+	for i := 0; i < testMessageCap-1; i++ {
+		if resp := serve(s, http.MethodPost, messages, url.Values{"content": {"پیام"}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	// Both of the last two messages pass the check made before the model
+	// is called; only one of them fits under the cap.
+	fake.Delay = 200 * time.Millisecond
+	bodies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp := serve(s, http.MethodPost, messages, url.Values{"content": {"یکی دیگر"}}, cookie)
+			b, _ := io.ReadAll(resp.Body)
+			bodies <- string(b)
+		}()
+	}
+	capNotice := s.sessionPrompts(context.Background(), session).Cap
+	var capped int
+	for i := 0; i < 2; i++ {
+		if strings.Contains(<-bodies, capNotice) {
+			capped++
+		}
+	}
+	if capped != 1 {
+		t.Errorf("%d of the two messages got the cap notice, want 1", capped)
+	}
+	n, err := s.Repo.CountSessionPatientMessages(context.Background(), session.ID)
+	if err != nil || n != testMessageCap {
+		t.Errorf("%d patient messages stored, %v; want %d", n, err, testMessageCap)
+	}
+}
+
+func TestPostMessageByNationalIDOwnership(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	other, _ := startPatient(t, s, "0098765432")
+	resp := serve(s, http.MethodPost, "/api/users/0012345678/messages", url.Values{"content": {"سردرد دارم"}}, other)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("another patient's post: status %d, want 404", resp.StatusCode)
+	}
+	if len(fake.ChatCalls) != 0 {
+		t.Error("another patient's post reached the model")
+	}
+	resp = serve(s, http.MethodPost, "/api/users/0012345678/messages", url.Values{"content": {"سردرد دارم"}}, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("own post: status %d", resp.StatusCode)
+	}
+	transcript, err := s.Repo.GetSessionTranscript(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcript) != 2 || transcript[0].Content != "سردرد دارم" {
+		t.Errorf("transcript %+v, want only the patient's own message and its reply", transcript)
+	}
+}
+
+func TestSummaryRefreshMerges(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	ctx := context.Background()
+	post := func(content string) {
+		t.Helper()
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {content}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: status %d", resp.StatusCode)
+		}
+	}
+
+	post("از دیروز سردرد دارم و متفورمین ۵۰۰ می‌خورم")
+	fake.SummaryReply = `{"key_points":["سردرد از دیروز"],"structured":{"chief_complaint":"سردرد","allergies":["پنی‌سیلین"],"medications":[{"name":"متفورمین","dose":"۵۰۰"}]},"free_text":"بیمار از دیروز سردرد دارد."}`
+	first, err := s.refreshSummary(ctx, session.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next summary leaves out the complaint and the first allergy and
+	// spells the drug differently; the stored summary keeps them.
+	post("دوز متفورمین را به ۱۰۰۰ رساندم و به آسپرین هم حساسیت دارم")
+	fake.SummaryReply = `{"key_points":["سردرد از دیروز","حساسیت به آسپرین"],"structured":{"chief_complaint":"","allergies":["آسپرین"],"medications":[{"name":"metformin","dose":"۱۰۰۰"}]},"free_text":""}`
+	if _, err := s.refreshSummary(ctx, session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.Repo.GetSummary(ctx, session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := stored.Structured
+	if st["chief_complaint"] != "سردرد" {
+		t.Errorf("chief complaint %v, want the earlier one kept", st["chief_complaint"])
+	}
+	if allergies, _ := st["allergies"].([]interface{}); len(allergies) != 2 {
+		t.Errorf("allergies %v, want both", st["allergies"])
+	}
+	meds, _ := st["medications"].([]interface{})
+	if len(meds) != 1 {
+		t.Fatalf("medications %v, want metformin once", st["medications"])
+	}
+	if med, _ := meds[0].(map[string]interface{}); med["dose"] != "۱۰۰۰" {
+		t.Errorf("medication %v, want the newest dose", med)
+	}
+	if len(stored.KeyPoints) != 2 || stored.FreeText != first.FreeText {
+		t.Errorf("key points %q and free text %q, want two points and the earlier text", stored.KeyPoints, stored.FreeText)
+	}
+	if !stored.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("updated at %v, not after %v", stored.UpdatedAt, first.UpdatedAt)
+	}
+}
+
+func TestDebugLogMasksPatient(t *testing.T) {
+	s, fake := newTestServer(t)
+	var out bytes.Buffer
+	debug := llm.NewDebugLog(fake, &out)
+	s.Chat.LLM, s.Summarizer.LLM = debug, debug
+	fake.SummaryReply = `{"key_points":["سردرد"],"structured":{},"free_text":"بیمار سردرد دارد."}`
+	cookie, session := startPatient(t, s, "0012345678")
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"من Sara هستم با کد 0012345678 و شماره 09120000000"}}, cookie)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	if _, err := s.refreshSummary(context.Background(), session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	logged := out.String()
+	if !strings.Contains(logged, `"call":"chat`) || !strings.Contains(logged, `"call":"summarize"`) {
+		t.Fatalf("chat and summary calls not logged: %s", logged)
+	}
+	for _, secret := range []string{"Sara", "0012345678", "09120000000"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("debug log contains %s", secret)
+		}
+	}
+	if !strings.Contains(logged, "[name]") {
+		t.Errorf("patient name not masked: %s", logged)
+	}
+}
+
+func TestPostMessageBusy(t *testing.T) {
+	s, fake := newTestServer(t)
+	fake.Delay = 500 * time.Millisecond
+	limiter := llm.NewLimiter(fake, 1, 10*time.Millisecond)
+	s.Chat.LLM = limiter
+	cookie, session := startPatient(t, s, "0012345678")
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Chat(context.Background(), nil)
+		done <- err
+	}()
+	for limiter.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie)
+	// The patient is asked to retry shortly, with the message kept.
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "شلوغ است") || !strings.Contains(body, "/retry") {
+		t.Errorf("post while every slot is taken: %d %q, want 503 with the busy retry bubble", resp.StatusCode, body)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapScope(t *testing.T) {
+	for _, tt := range []struct {
+		scope  string
+		capped bool
+	}{
+		{CapPerWeek, true},
+		{CapPerSession, false},
+	} {
+		t.Run(tt.scope, func(t *testing.T) {
+			s, fake := newTestServer(t)
+			s.CapScope = tt.scope
+			ctx := context.Background()
+			cookie, session := startPatient(t, s, "0012345678")
+			for i := 0; i < testMessageCap; i++ {
+				if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"پیام"}}, cookie); resp.StatusCode != http.StatusOK {
+					t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+				}
+			}
+			// The patient comes back for a second visit in the same week.
+			if _, err := s.Repo.CloseSession(ctx, session.ID); err != nil {
+				t.Fatal(err)
+			}
+			cookie, next := startPatient(t, s, "0012345678")
+			if next.ID == session.ID {
+				t.Fatal("no new session for the second visit")
+			}
+			calls := len(fake.ChatCalls)
+			resp := serve(s, http.MethodPost, "/api/sessions/"+next.ID+"/messages", url.Values{"content": {"سلام دوباره"}}, cookie)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("second visit: status %d", resp.StatusCode)
+			}
+			if capped := len(fake.ChatCalls) == calls; capped != tt.capped {
+				t.Errorf("second visit capped %v, want %v", capped, tt.capped)
+			}
+		})
+	}
+}
+
+func TestCapWeekJalali(t *testing.T) {
+	s, fake := newTestServer(t)
+	s.CapWeek = CapWeekJalali
+	cookie, session := startPatient(t, s, "0012345678")
+	for i := 0; i < testMessageCap; i++ {
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"پیام"}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	post := func() (capped bool) {
+		t.Helper()
+		calls := len(fake.ChatCalls)
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"یکی دیگر"}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: status %d", resp.StatusCode)
+		}
+		return len(fake.ChatCalls) == calls
+	}
+	backdate := func(at time.Time) {
+		t.Helper()
+		if _, err := s.Repo.DB.Exec(`UPDATE messages SET created_at = $1 WHERE session_id = $2`, at.UTC().Format("2006-01-02 15:04:05.000"), session.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Messages of the Friday before count towards the previous week.
+	saturday := jalali.WeekStart(time.Now())
+	backdate(saturday.Add(-time.Minute))
+	if post() {
+		t.Error("capped by the messages of the previous Persian week")
+	}
+	backdate(saturday.Add(time.Minute))
+	if !post() {
+		t.Error("not capped by the messages of this Persian week")
+	}
+}
+
+func TestMessageCapSnapshot(t *testing.T) {
+	s, fake := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	if session.MessageCap != testMessageCap {
+		t.Fatalf("session cap %d, want %d", session.MessageCap, testMessageCap)
+	}
+	for i := 0; i < testMessageCap; i++ {
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"پیام"}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+		}
+	}
+	post := func() (capped bool) {
+		t.Helper()
+		calls := len(fake.ChatCalls)
+		if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"یکی دیگر"}}, cookie); resp.StatusCode != http.StatusOK {
+			t.Fatalf("post: status %d", resp.StatusCode)
+		}
+		return len(fake.ChatCalls) == calls
+	}
+	// Raising the configured cap leaves the open session's as it was.
+	s.MessageCap = testMessageCap + 5
+	if !post() {
+		t.Error("open session not capped at the cap it started with")
+	}
+	// Sessions from before caps were stored use the configured one.
+	if _, err := s.Repo.DB.Exec(`UPDATE sessions SET message_cap = 0 WHERE id = $1`, session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if post() {
+		t.Error("session without a stored cap capped at the old one")
+	}
+	// New sessions start with the cap configured at the time.
+	if _, err := s.Repo.CloseSession(context.Background(), session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, next := startPatient(t, s, "0012345678"); next.MessageCap != testMessageCap+5 {
+		t.Errorf("new session cap %d, want %d", next.MessageCap, testMessageCap+5)
+	}
+}
+
+func TestChatPageUnansweredMessage(t *testing.T) {
+	s, _ := newTestServer(t)
+	cookie, session := startPatient(t, s, "0012345678")
+	ctx := context.Background()
+	fetchButton := func() bool {
+		t.Helper()
+		body := readBody(t, serve(s, http.MethodGet, "/chat", nil, cookie))
+		return strings.Contains(body, "دریافت پاسخ")
+	}
+
+	if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"سردرد دارم"}}, cookie); resp.StatusCode != http.StatusOK {
+		t.Fatalf("post: status %d", resp.StatusCode)
+	}
+	if fetchButton() {
+		t.Error("answered message offers to fetch its reply")
+	}
+	// A reply may still be on its way to a message within the grace period.
+	m, err := s.Repo.CreateMessage(ctx, uuid.MustParse(session.ID), pkg.RolePatient, "از دیروز")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetchButton() {
+		t.Error("message within the grace period offers to fetch its reply")
+	}
+	at := time.Now().Add(-unansweredGrace - time.Minute).UTC().Format("2006-01-02 15:04:05.000")
+	if _, err := s.Repo.DB.Exec(`UPDATE messages SET created_at = $1 WHERE id = $2`, at, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !fetchButton() {
+		t.Fatal("stale unanswered message does not offer to fetch its reply")
+	}
+
+	// The button fetches the reply.
+	resp := serve(s, http.MethodPost, retryPath(m), nil, cookie)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, `class="msg bot"`) {
+		t.Fatalf("retry: %d %s", resp.StatusCode, body)
+	}
+	if fetchButton() {
+		t.Error("answered message still offers to fetch its reply")
+	}
+}
+
+// streamDone returns the "done" event of a reply stream.
+func streamDone(t *testing.T, body string) socketFrame {
+	t.Helper()
+	for _, event := range strings.Split(body, "\n\n") {
+		if data, ok := strings.CutPrefix(event, "event: done\ndata: "); ok {
+			var f socketFrame
+			if err := json.Unmarshal([]byte(data), &f); err != nil {
+				t.Fatal(err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("no done event in %q", body)
+	return socketFrame{}
+}
+
+func TestCapResetsAt(t *testing.T) {
+	for _, tt := range []struct {
+		scope, week string
+	}{
+		{CapPerWeek, CapWeekISO},
+		{CapPerWeek, CapWeekJalali},
+		{CapPerSession, CapWeekISO},
+	} {
+		t.Run(tt.scope+" "+tt.week, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			s.CapScope, s.CapWeek = tt.scope, tt.week
+			cookie, session := startPatient(t, s, "0012345678")
+			for i := 0; i < testMessageCap; i++ {
+				if resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages", url.Values{"content": {"پیام"}}, cookie); resp.StatusCode != http.StatusOK {
+					t.Fatalf("message %d: status %d", i+1, resp.StatusCode)
+				}
+			}
+			resp := serve(s, http.MethodPost, "/api/sessions/"+session.ID+"/messages/stream", url.Values{"content": {"یکی دیگر"}}, cookie)
+			done := streamDone(t, readBody(t, resp))
+			if !done.Capped {
+				t.Fatalf("done event %+v not capped", done)
+			}
+			prompts := core.DefaultPrompts()
+			if tt.scope == CapPerSession {
+				if done.ResetsAt != nil || done.Content != prompts.Cap {
+					t.Errorf("per-session cap: resets at %v with %q, want no reset time", done.ResetsAt, done.Content)
+				}
+				return
+			}
+			want := core.CapWeek(tt.week).ResetsAt(time.Now())
+			if done.ResetsAt == nil || !done.ResetsAt.Equal(want) {
+				t.Fatalf("resets at %v, want %v", done.ResetsAt, want)
+			}
+			if done.Content != prompts.CapNotice(want) || !strings.Contains(done.Content, jalali.FormatDateTime(want)) {
+				t.Errorf("cap message %q does not give the reset time", done.Content)
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Repo.DB.Close()
+	if resp := serve(s, http.MethodGet, "/readyz", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz without a database: status %d, want 503", resp.StatusCode)
+	}
+	if resp := serve(s, http.MethodGet, "/healthz", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz without a database: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestSavePromptProfile(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.AdminToken = "admin-token"
+	for body, status := range map[string]int{
+		`{"name":"village","max_reply_chars":79}`:                        http.StatusBadRequest,
+		`{"name":"village","max_reply_chars":-1}`:                        http.StatusBadRequest,
+		`{"name":"village","max_reply_chars":80,"simple_language":true}`: http.StatusOK,
+		`{"name":"city","max_reply_chars":0}`:                            http.StatusOK,
+		`{"name":"city","summary_language":"de"}`:                        http.StatusBadRequest,
+		`{"name":"partner","summary_language":"en"}`:                     http.StatusOK,
+	} {
+		r := newRequest(http.MethodPost, "/admin/prompt-profiles", body)
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%s: status %d, want %d: %s", body, w.Code, status, w.Body)
+		}
+	}
+	p, err := s.Repo.GetPromptProfile(context.Background(), "village")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxReplyChars != 80 || !p.SimpleLanguage {
+		t.Errorf("saved profile %+v", p)
+	}
+	if p, err := s.Repo.GetPromptProfile(context.Background(), "partner"); err != nil || p.SummaryLanguage != "en" {
+		t.Errorf("saved profile %+v, %v; want summaries in English", p, err)
+	}
+}
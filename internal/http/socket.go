@@ -0,0 +1,131 @@
+package http
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// socketIdleTimeout closes a chat socket the patient has not written to
+	// for this long.
+	socketIdleTimeout = 10 * time.Minute
+	// socketWriteTimeout bounds a single frame write.
+	socketWriteTimeout = 10 * time.Second
+	// maxSocketMessage is the largest frame accepted from the patient.
+	maxSocketMessage = 16 << 10
+)
+
+// socketUpgrader upgrades chat sockets.  Its default origin check rejects
+// cross-site pages, which would otherwise ride on the patient's cookie.
+var socketUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// socketFrame is a JSON frame sent on the chat socket, and the data of the
+// events of a reply stream (see sseTurn).  Type is "chunk" for part of a
+// streaming reply, "done" with the complete reply and its Seq, or "error";
+// an error with Redirect set means the session is closed.  A "done" frame
+// with Capped set carries the cap message and, for a per-week cap,
+// ResetsAt; one with OpensAt set carries the closed hours notice.  Reply streams also send "pending" before the first chunk.
+type socketFrame struct {
+	Type     string     `json:"type"`
+	Content  string     `json:"content,omitempty"`
+	Seq      int        `json:"seq,omitempty"`
+	Capped   bool       `json:"capped,omitempty"`
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+	OpensAt  *time.Time `json:"opens_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Kind     string     `json:"kind,omitempty"`
+	Redirect string     `json:"redirect,omitempty"`
+}
+
+// socketConn serialises writes to a chat socket.
+type socketConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (c *socketConn) send(f socketFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if err := c.conn.WriteJSON(f); err != nil {
+		log.Printf("chat socket write: %v", err)
+	}
+}
+
+// socketTurn sends the outcome of a patient message as frames.
+type socketTurn struct{ c *socketConn }
+
+func (t socketTurn) chunk(text string) {
+	t.c.send(socketFrame{Type: "chunk", Content: text})
+}
+
+func (t socketTurn) reply(m *pkg.Message, _ []*pkg.Attachment) {
+	t.c.send(socketFrame{Type: "done", Content: m.Content, Seq: m.Seq})
+}
+
+func (t socketTurn) capped(m *pkg.Message, resetsAt time.Time) {
+	f := socketFrame{Type: "done", Content: m.Content, Seq: m.Seq, Capped: true}
+	if !resetsAt.IsZero() {
+		f.ResetsAt = &resetsAt
+	}
+	t.c.send(f)
+}
+
+func (t socketTurn) closedHours(m *pkg.Message, opensAt time.Time) {
+	t.c.send(closedHoursFrame(m, opensAt))
+}
+
+func (t socketTurn) fail(locale string, err error) {
+	t.c.send(errorFrame(locale, err))
+}
+
+// errorFrame reports err with the message for its kind in the locale, as
+// writeError does.
+func errorFrame(locale string, err error) socketFrame {
+	return socketFrame{Type: "error", Error: errorMessage(locale, err), Kind: errs.KindOf(err).String()}
+}
+
+func (t socketTurn) closed() {
+	t.c.send(socketFrame{Type: "error", Error: "session closed", Redirect: "/"})
+}
+
+// handleChatSocket serves /ws/sessions/{id}: the patient sends {"content"}
+// frames and receives the reply as it streams from the LLM.  Messages go
+// through respondToPatient like the HTTP form posts, which remain the
+// fallback for browsers without JavaScript.
+func (s *Server) handleChatSocket(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if !s.ownsSession(r, sessionID) {
+		http.NotFound(w, r)
+		return
+	}
+	nationalID := s.patientNationalID(r)
+	conn, err := socketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has replied
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxSocketMessage)
+	sc := &socketConn{conn: conn}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(socketIdleTimeout))
+		var in pkg.ChatRequest
+		if err := conn.ReadJSON(&in); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("chat socket for session %s: %v", sessionID, err)
+			}
+			return
+		}
+		if err := validate(&in); err != nil {
+			sc.send(socketFrame{Type: "error", Error: err.Error()})
+			continue
+		}
+		s.respondToPatient(r.Context(), socketTurn{sc}, nationalID, in.Content, nil)
+	}
+}
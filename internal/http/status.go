@@ -0,0 +1,94 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/internal/status"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// statusCacheTTL is how long GET /status serves the same snapshot, so
+// reloading the page cannot be used to load the server.
+const statusCacheTTL = 5 * time.Second
+
+// readyTimeout bounds the database ping of GET /readyz, so a hung database
+// fails the probe rather than stalling it.
+const readyTimeout = 2 * time.Second
+
+// statusNames and statusLevels are the Persian labels of the components
+// and levels on the status page.
+var (
+	statusNames = map[string]string{
+		status.Chat:      "دستیار گفتگو",
+		status.Database:  "پایگاه داده",
+		status.Summaries: "خلاصه‌ها",
+	}
+	statusLevels = map[string]string{
+		status.Green.String():  "فعال",
+		status.Yellow.String(): "اختلال اخیر",
+		status.Red.String():    "از کار افتاده",
+	}
+)
+
+// statusPage is the data of the "status" template.
+type statusPage struct {
+	Components []status.Status
+	CheckedAt  time.Time
+	Names      map[string]string
+	Levels     map[string]string
+}
+
+// statusCache holds the snapshot GET /status serves.
+type statusCache struct {
+	mu   sync.Mutex
+	page statusPage
+}
+
+// handleStatus serves GET /status, the health of the chat assistant, the
+// database and the summaries for reception staff.  It needs no login and
+// shows no patient data: only a level and the time of the last error per
+// component.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if s.Status == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.statusCache.mu.Lock()
+	if time.Since(s.statusCache.page.CheckedAt) >= statusCacheTTL {
+		s.statusCache.page = statusPage{
+			Components: s.Status.Snapshot(),
+			CheckedAt:  time.Now(),
+			Names:      statusNames,
+			Levels:     statusLevels,
+		}
+	}
+	page := s.statusCache.page
+	s.statusCache.mu.Unlock()
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(statusCacheTTL/time.Second)))
+	s.render(w, r, "status", page)
+}
+
+// handleHealthz serves GET /healthz, the liveness probe: the server answers
+// requests.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz serves GET /readyz, the readiness probe: the server can serve
+// patients, which needs the database.  It answers 503 while the database
+// does not answer a ping.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.Repo.DB.PingContext(ctx); err != nil {
+		writeError(w, r, errs.Wrap(errs.Unavailable, err))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,274 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/errs"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// streamKeepAlive is how long an event stream stays silent, e.g. while
+	// the model is thinking, before a comment is sent so proxies do not
+	// time the connection out.
+	streamKeepAlive = 10 * time.Second
+	// replyPollInterval is how often a resumed reply stream looks for the
+	// reply in the database.
+	replyPollInterval = time.Second
+)
+
+// setStreamHeaders sets the headers of a server-sent event stream: proxies
+// must neither cache nor transform it, and nginx must not buffer it.
+func setStreamHeaders(h http.Header) {
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache, no-transform")
+	h.Set("X-Accel-Buffering", "no")
+}
+
+// sseStream writes server-sent events to a client, flushing each one, and
+// sends keep-alive comments while it has nothing to send.  Events written
+// after close, e.g. by a reply still streaming once the client went away,
+// are dropped.
+type sseStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// id is sent as the ID of every event: the pending reply the stream
+	// carries, once known.
+	id     string
+	last   time.Time
+	closed bool
+	stop   chan struct{}
+}
+
+// newSSEStream starts an event stream on w.
+func newSSEStream(w http.ResponseWriter, flusher http.Flusher) *sseStream {
+	setStreamHeaders(w.Header())
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	st := &sseStream{w: w, flusher: flusher, last: time.Now(), stop: make(chan struct{})}
+	go st.keepAlive()
+	return st
+}
+
+func (st *sseStream) keepAlive() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.stop:
+			return
+		case <-ticker.C:
+		}
+		st.mu.Lock()
+		if !st.closed && time.Since(st.last) >= streamKeepAlive {
+			fmt.Fprint(st.w, ": keep-alive\n\n")
+			st.flusher.Flush()
+			st.last = time.Now()
+		}
+		st.mu.Unlock()
+	}
+}
+
+// setID sets the ID of the events sent from now on.
+func (st *sseStream) setID(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.id = id
+}
+
+// send writes f as an event named after its type.
+func (st *sseStream) send(f socketFrame) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		log.Printf("event stream: %v", err)
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return
+	}
+	if st.id != "" {
+		fmt.Fprintf(st.w, "id: %s\n", st.id)
+	}
+	fmt.Fprintf(st.w, "event: %s\ndata: %s\n\n", f.Type, data)
+	st.flusher.Flush()
+	st.last = time.Now()
+}
+
+// close ends the stream; the handler must call it before returning.
+func (st *sseStream) close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.closed {
+		st.closed = true
+		close(st.stop)
+	}
+}
+
+// streamTurn is implemented by turns that stream the LLM reply as it is
+// generated in the background.  The reply is stored even when the client
+// goes away before it is done, so a client that lost the connection fetches
+// it rather than having it generated again.
+type streamTurn interface {
+	turn
+	// streaming is called with the pending reply before its first chunk.
+	streaming(p *pkg.PendingReply)
+}
+
+// sseTurn sends the outcome of a patient message as server-sent events
+// carrying socketFrames: "pending" with the reply's ID, "chunk"s, then
+// "done" or "error".  The events of a reply generated by the LLM have its
+// pending reply's ID as their event ID.
+type sseTurn struct{ st *sseStream }
+
+func (t sseTurn) streaming(p *pkg.PendingReply) {
+	t.st.setID(p.ID)
+	t.st.send(socketFrame{Type: "pending"})
+}
+
+func (t sseTurn) chunk(text string) {
+	t.st.send(socketFrame{Type: "chunk", Content: text})
+}
+
+func (t sseTurn) reply(m *pkg.Message, _ []*pkg.Attachment) {
+	t.st.send(socketFrame{Type: "done", Content: m.Content, Seq: m.Seq})
+}
+
+func (t sseTurn) capped(m *pkg.Message, resetsAt time.Time) {
+	f := socketFrame{Type: "done", Content: m.Content, Seq: m.Seq, Capped: true}
+	if !resetsAt.IsZero() {
+		f.ResetsAt = &resetsAt
+	}
+	t.st.send(f)
+}
+
+func (t sseTurn) closedHours(m *pkg.Message, opensAt time.Time) {
+	t.st.send(closedHoursFrame(m, opensAt))
+}
+
+func (t sseTurn) fail(locale string, err error) {
+	t.st.send(errorFrame(locale, err))
+}
+
+func (t sseTurn) closed() {
+	t.st.send(socketFrame{Type: "error", Error: "session closed", Redirect: "/"})
+}
+
+// streamReply generates the reply to a patient message in the background,
+// streaming it to t, and reports the outcome to t once it is stored.  If
+// the client goes away first the reply is still stored, for the client to
+// fetch from handleReplyStream.
+func (s *Server) streamReply(ctx context.Context, t streamTurn, session *pkg.Session, sessionID uuid.UUID, c *db.Cap, content string, history []pkg.Message, category string, received time.Time) {
+	// Chunks wait for the pending event, which carries the reply's ID.
+	ready := make(chan struct{})
+	p, outcome, err := s.replyAsync(ctx, session, sessionID, c, content, history, category, received, func(text string) {
+		<-ready
+		t.chunk(text)
+	})
+	if errors.Is(err, db.ErrCapped) {
+		s.replyCapped(ctx, t, session, sessionID, received)
+		return
+	}
+	if err != nil {
+		failTurn(ctx, t, session.Locale, err)
+		return
+	}
+	t.streaming(p)
+	close(ready)
+	select {
+	case o := <-outcome:
+		if o.err != nil {
+			failTurn(ctx, t, session.Locale, replyError(o.err))
+		} else {
+			t.reply(o.reply, nil)
+		}
+	case <-ctx.Done():
+	}
+}
+
+// handleStreamSessionMessage serves POST /api/sessions/{id}/messages/stream:
+// a patient message like handlePostSessionMessage, answered with the reply
+// streamed as server-sent events (see sseTurn).  When the response writer
+// cannot flush, so nothing would stream, the reply is sent in one piece as
+// by handlePostSessionMessage instead.
+func (s *Server) handleStreamSessionMessage(w http.ResponseWriter, r *http.Request, sessionID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.handlePostSessionMessage(w, r, sessionID)
+		return
+	}
+	session, content, ok := s.postedSessionMessage(w, r, sessionID)
+	if !ok {
+		return
+	}
+	st := newSSEStream(w, flusher)
+	defer st.close()
+	t := sseTurn{st}
+	if session.ClosedAt != nil {
+		t.closed()
+		return
+	}
+	s.respondInSession(r.Context(), t, session, *session.PatientID, content, nil)
+}
+
+// handleReplyStream serves GET /api/sessions/{id}/replies/{replyID}/stream,
+// for a client whose reply stream was cut off: it waits for the pending
+// reply and sends it as a single "done" event, or an "error" event if it
+// failed, with the reply's ID as event ID.  Without flushing it answers
+// like handleGetReply.
+func (s *Server) handleReplyStream(w http.ResponseWriter, r *http.Request, sessionID, replyID string) {
+	pending, err := s.Repo.GetPendingReply(r.Context(), replyID)
+	if errs.Is(err, errs.NotFound) || err == nil && (pending.SessionID != sessionID || !s.ownsSession(r, sessionID)) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.handleGetReply(w, r, sessionID, replyID)
+		return
+	}
+	st := newSSEStream(w, flusher)
+	defer st.close()
+	st.setID(replyID)
+	ticker := time.NewTicker(replyPollInterval)
+	defer ticker.Stop()
+	for {
+		switch {
+		case pending.Status == pkg.ReplyDone:
+			st.send(socketFrame{Type: "done", Content: pending.Content, Seq: pending.Seq})
+			return
+		case replyFailed(pending):
+			st.send(errorFrame(i18n.Default, errReplyFailed))
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if pending, err = s.Repo.GetPendingReply(r.Context(), replyID); err != nil {
+			if r.Context().Err() == nil {
+				logError(r.Context(), "reply stream", err)
+				st.send(errorFrame(i18n.Default, err))
+			}
+			return
+		}
+	}
+}
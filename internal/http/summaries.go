@@ -0,0 +1,107 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/cursor"
+	"waitroom-chatbot/pkg/errs"
+)
+
+// apiKeyHeader carries the key for the external API.
+const apiKeyHeader = "X-API-Key"
+
+// authorizeAPIKey checks the APIKey on a request of the external API, which
+// is disabled when no key is configured.  It writes the error response and
+// returns nil when the request must not proceed.
+func (s *Server) authorizeAPIKey(w http.ResponseWriter, r *http.Request) *http.Request {
+	if s.APIKey == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(apiKeyHeader)), []byte(s.APIKey)) != 1 {
+		writeError(w, r, errUnauthorized)
+		return nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), actorKey, "api"))
+}
+
+// handleListSummaries serves GET /api/summaries to external tooling: a page
+// of summaries with their session metadata, oldest update first, in the
+// cursor.Page envelope.  The
+// query may set from and to (dates or RFC 3339 times bounding the update
+// time), national_id, limit and cursor (the next_cursor of the previous
+// page; it is returned with every non-empty page).  It requires the APIKey in the X-API-Key header and is disabled
+// when no key is configured.
+func (s *Server) handleListSummaries(w http.ResponseWriter, r *http.Request) {
+	if r = s.authorizeAPIKey(w, r); r == nil {
+		return
+	}
+	q := r.URL.Query()
+	f := pkg.SummaryFilter{NationalID: q.Get("national_id")}
+	var err error
+	if f.From, err = parseAPITime(q.Get("from"), false); err != nil {
+		writeError(w, r, errs.New(errs.Invalid, "invalid from"))
+		return
+	}
+	if f.To, err = parseAPITime(q.Get("to"), true); err != nil {
+		writeError(w, r, errs.New(errs.Invalid, "invalid to"))
+		return
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			writeError(w, r, errs.New(errs.Invalid, "invalid limit"))
+			return
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		var after cursor.Position
+		if err := s.Cursors.Decode(v, &after); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if f.AfterID, err = strconv.ParseInt(after.ID, 10, 64); err != nil {
+			writeError(w, r, cursor.ErrInvalid)
+			return
+		}
+		f.AfterUpdatedAt = after.Time
+	}
+	summaries, err := s.Repo.ListSummaries(r.Context(), f)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionListSummaries, "")
+	resp := cursor.Page[pkg.SessionSummary]{Items: summaries}
+	if resp.Items == nil {
+		resp.Items = []pkg.SessionSummary{}
+	}
+	// Clients page until a page comes back empty and can keep the last
+	// cursor to poll for later updates.
+	if n := len(summaries); n > 0 {
+		last := summaries[n-1]
+		resp.NextCursor = s.Cursors.Encode(cursor.Position{Time: last.UpdatedAt, ID: strconv.FormatInt(last.ID, 10)})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseAPITime parses an RFC 3339 time or a date.  A date used as an end
+// bound covers the whole day.
+func parseAPITime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
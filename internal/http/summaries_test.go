@@ -0,0 +1,152 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"waitroom-chatbot/pkg"
+	"waitroom-chatbot/pkg/cursor"
+)
+
+func TestListSummariesPages(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.APIKey = "api-key"
+	ctx := context.Background()
+	for _, nationalID := range []string{"0012345678", "0098765432"} {
+		_, session := startPatient(t, s, nationalID)
+		if err := s.Repo.UpsertSummary(ctx, &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, FreeText: "سردرد"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only settled summaries are listed.
+	if _, err := s.Repo.DB.Exec(`UPDATE summaries SET updated_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '-' || id || ' minutes')`); err != nil {
+		t.Fatal(err)
+	}
+	get := func(target string) (cursor.Page[pkg.SessionSummary], int) {
+		r := newRequest(http.MethodGet, target, nil)
+		r.Header.Set(apiKeyHeader, "api-key")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var page cursor.Page[pkg.SessionSummary]
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatalf("%s: %v", w.Body.String(), err)
+			}
+		}
+		return page, w.Code
+	}
+	page, status := get("/api/summaries?limit=1")
+	if status != http.StatusOK || len(page.Items) != 1 || page.NextCursor == "" {
+		t.Fatalf("first page %+v, status %d", page, status)
+	}
+	first := page.Items[0].SessionID
+	page, _ = get("/api/summaries?limit=1&cursor=" + page.NextCursor)
+	if len(page.Items) != 1 || page.Items[0].SessionID == first || page.NextCursor == "" {
+		t.Fatalf("second page %+v", page)
+	}
+	page, _ = get("/api/summaries?limit=1&cursor=" + page.NextCursor)
+	if len(page.Items) != 0 || page.NextCursor != "" {
+		t.Errorf("page past the end %+v, want no items and no cursor", page)
+	}
+	if _, status := get("/api/summaries?cursor=x"); status != http.StatusBadRequest {
+		t.Errorf("tampered cursor: status %d, want 400", status)
+	}
+}
+
+func TestListSummariesInvalidQuery(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.APIKey = "api-key"
+	for _, query := range []string{"from=yesterday", "to=2024-13-01", "limit=0", "limit=x", "cursor=abc"} {
+		r := newRequest(http.MethodGet, "/api/summaries?"+query, nil)
+		r.Header.Set(apiKeyHeader, "api-key")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var body errorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: body %q is not an error body", query, w.Body)
+			continue
+		}
+		if w.Code != http.StatusBadRequest || body.Kind != "invalid" {
+			t.Errorf("%s: %d %+v, want 400 of kind invalid", query, w.Code, body)
+		}
+	}
+}
+
+func TestListSummariesAPIKey(t *testing.T) {
+	s, _ := newTestServer(t)
+	if w := serveDoctor(s, http.MethodGet, "/api/summaries", nil); w.Code != http.StatusNotFound {
+		t.Errorf("without a configured key: status %d, want 404", w.Code)
+	}
+	s.APIKey = "api-key"
+	for _, key := range []string{"", "wrong"} {
+		r := newRequest(http.MethodGet, "/api/summaries", nil)
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("key %q: status %d, want 401", key, w.Code)
+		}
+	}
+	// Doctor logins do not open the API.
+	s.DoctorUsers = map[string]string{"dr": "pw"}
+	if w := serveDoctor(s, http.MethodGet, "/api/summaries", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("doctor login: status %d, want 401", w.Code)
+	}
+}
+
+func TestListSummariesFilters(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.APIKey = "api-key"
+	ctx := context.Background()
+	now := time.Now().UTC()
+	sessions := map[string]string{}
+	for nationalID, age := range map[string]time.Duration{"0012345678": 72 * time.Hour, "0098765432": 2 * time.Hour} {
+		_, session := startPatient(t, s, nationalID)
+		sessions[session.ID] = nationalID
+		if err := s.Repo.UpsertSummary(ctx, &pkg.Summary{SessionID: session.ID, KeyPoints: []string{"سردرد"}, FreeText: "سردرد"}); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-age).Format("2006-01-02 15:04:05.000")
+		if _, err := s.Repo.DB.Exec(`UPDATE summaries SET updated_at = $1 WHERE session_id = $2`, at, session.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"0012345678", "0098765432"}},
+		{"national_id=0098765432", []string{"0098765432"}},
+		{"from=" + now.Add(-24*time.Hour).Format(time.RFC3339), []string{"0098765432"}},
+		{"to=" + now.AddDate(0, 0, -2).Format("2006-01-02"), []string{"0012345678"}},
+		{"from=" + now.AddDate(0, 0, -4).Format("2006-01-02") + "&national_id=0012345678", []string{"0012345678"}},
+		{"to=" + now.Add(-24*time.Hour).Format(time.RFC3339) + "&national_id=0098765432", nil},
+	}
+	for _, tt := range tests {
+		r := newRequest(http.MethodGet, "/api/summaries?"+tt.query, nil)
+		r.Header.Set(apiKeyHeader, "api-key")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var page cursor.Page[pkg.SessionSummary]
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.query, w.Code, w.Body)
+		}
+		var got []string
+		for _, item := range page.Items {
+			got = append(got, sessions[item.SessionID])
+			if item.Status == "" || item.SessionCreatedAt.IsZero() {
+				t.Errorf("%s: session metadata missing from %+v", tt.query, item)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// sweepInterval is how often RunSweeper looks for idle sessions.
+const sweepInterval = 5 * time.Minute
+
+// RunSweeper closes sessions that have been idle for longer than idle, and
+// deletes the phone verifications past the rate limit window and the LLM
+// traces past traceRetention, until ctx is cancelled.
+func (s *Server) RunSweeper(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		s.sweepIdleSessions(ctx, idle)
+		if s.SMS != nil {
+			if _, err := s.Repo.DeletePhoneVerificationsBefore(ctx, time.Now().Add(-otpWindow)); err != nil {
+				log.Printf("delete old phone verifications: %v", err)
+			}
+		}
+		if _, err := s.Repo.DeleteLLMTracesBefore(ctx, time.Now().Add(-traceRetention)); err != nil {
+			log.Printf("delete old LLM traces: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepIdleSessions closes every open session without a message within
+// idle, produces its final summary and notifies the dashboard.  Patients who
+// come back afterwards start a fresh session.
+func (s *Server) sweepIdleSessions(ctx context.Context, idle time.Duration) {
+	ids, err := s.Repo.ListStaleOpenSessions(ctx, idle)
+	if err != nil {
+		log.Printf("sweep idle sessions: %v", err)
+		return
+	}
+	for _, id := range ids {
+		closed, err := s.Repo.CloseSession(ctx, id)
+		if err != nil {
+			log.Printf("close idle session %s: %v", id, err)
+			continue
+		}
+		if !closed {
+			continue
+		}
+		log.Printf("closed idle session %s", id)
+		if s.Summarizer != nil {
+			if _, err := s.refreshSummary(ctx, id, false); err != nil {
+				log.Printf("final summary for %s: %v", id, err)
+			}
+		}
+		if s.Events != nil {
+			if err := s.Events.Notify(ctx, id); err != nil {
+				log.Printf("notify dashboard of closed session %s: %v", id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timeoutBubble is the fragment served when a request runs out of time.
+const timeoutBubble = `<div class="msg bot error">پاسخ‌گویی بیش از حد طول کشید. لطفاً دوباره تلاش کنید.</div>`
+
+// Default request deadlines.  Posts may wait on the LLM (replies, summary
+// regeneration) and get longer than page renders.
+const (
+	defaultPageTimeout = 15 * time.Second
+	defaultPostTimeout = 90 * time.Second
+)
+
+// requestTimeout returns the deadline for a request, or zero for streams
+// (WebSockets, SSE) that stay open by design.  A negative PageTimeout or
+// PostTimeout disables the deadline for that group.
+func (s *Server) requestTimeout(r *http.Request) time.Duration {
+	if r.Header.Get("Upgrade") != "" || strings.HasSuffix(r.URL.Path, "/stream") {
+		return 0
+	}
+	if r.Method == http.MethodPost {
+		return orDefault(s.PostTimeout, defaultPostTimeout)
+	}
+	return orDefault(s.PageTimeout, defaultPageTimeout)
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// withTimeout runs requests under the request deadline.  The request
+// context is cancelled when it passes, so database and LLM calls give up,
+// and a 503 carrying timeoutBubble is sent if nothing was written yet.
+func (s *Server) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := s.requestTimeout(r)
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.TimeoutHandler(next, d, timeoutBubble).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,92 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/pkg"
+)
+
+// traceRetention is how long LLM traces are kept.
+const traceRetention = 30 * 24 * time.Hour
+
+// traceSession flags a session whose patient mentioned a red-flag symptom
+// for tracing, from the current message on.  A failure is logged and the
+// session stays untraced.
+func (s *Server) traceSession(ctx context.Context, session *pkg.Session) {
+	if err := s.Repo.SetSessionTrace(ctx, session.ID, true); err != nil {
+		log.Printf("flag session %s for tracing: %v", session.ID, err)
+		return
+	}
+	session.TraceLLM = true
+	if s.Audit != nil {
+		s.Audit.Record(ctx, pkg.AuditEntry{
+			Actor:     "system:red_flag",
+			Action:    audit.ActionTraceOn,
+			SessionID: session.ID,
+			RequestID: requestID(ctx),
+		})
+	}
+}
+
+// handleDoctorTrace turns tracing of a session's model calls on (trace=1)
+// or off from the doctor's session page and re-renders the detail
+// fragment.
+func (s *Server) handleDoctorTrace(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	on := r.FormValue("trace") == "1"
+	if err := s.Repo.SetSessionTrace(r.Context(), sessionID, on); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	action := audit.ActionTraceOff
+	if on {
+		action = audit.ActionTraceOn
+	}
+	s.recordAccess(r, action, sessionID)
+	s.handleDoctorSession(w, r, sessionID)
+}
+
+// tracesPage is the data of the "doctor_traces" template.
+type tracesPage struct {
+	SessionID string
+	Traces    []pkg.LLMTrace
+}
+
+// handleDoctorTraces renders the traced model calls of a session as an
+// HTMX fragment for the session page.
+func (s *Server) handleDoctorTraces(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if s.clinicSession(w, r, sessionID) == nil {
+		return
+	}
+	traces, err := s.Repo.ListLLMTraces(r.Context(), sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.recordAccess(r, audit.ActionViewTraces, sessionID)
+	s.render(w, r, "doctor_traces", tracesPage{SessionID: sessionID, Traces: traces})
+}
+
+// handleAdminTraces returns the traced model calls of a session as JSON.
+func (s *Server) handleAdminTraces(w http.ResponseWriter, r *http.Request, sessionID string) {
+	traces, err := s.Repo.ListLLMTraces(r.Context(), sessionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if traces == nil {
+		traces = []pkg.LLMTrace{}
+	}
+	s.recordAccess(r, audit.ActionViewTraces, sessionID)
+	writeJSON(w, http.StatusOK, traces)
+}
@@ -0,0 +1,144 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"waitroom-chatbot/internal/audit"
+	"waitroom-chatbot/internal/db"
+	"waitroom-chatbot/internal/i18n"
+	"waitroom-chatbot/pkg"
+)
+
+const (
+	// otpDigits is the length of the code texted to the patient.
+	otpDigits = 5
+	// otpTTL is how long the code can be entered, and otpAttempts how many
+	// tries the patient has at it.
+	otpTTL      = 2 * time.Minute
+	otpAttempts = 3
+	// otpWindow is the period OTPPerPhone and OTPPerIP count codes over.
+	otpWindow = time.Hour
+	// otpSendTimeout bounds the call to the SMS provider.
+	otpSendTimeout = 15 * time.Second
+)
+
+// verifyPage is the data of the "verify" template.
+type verifyPage struct {
+	pageContext
+	Action  string
+	ID      string
+	Phone   string
+	Restart string
+	// Error is shown above the form when the code was wrong.
+	Error string
+}
+
+// newVerifyPage returns the form asking for the code of verification id,
+// texted to phone, of the start form posted to page.Action.
+func newVerifyPage(page startPage, id, phone string) verifyPage {
+	return verifyPage{
+		pageContext: page.pageContext,
+		Action:      page.Action + "/verify",
+		ID:          id,
+		Phone:       phone,
+		Restart:     strings.TrimSuffix(page.Action, "start"),
+	}
+}
+
+// otpCode returns a random code of otpDigits digits.
+func otpCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < otpDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := n.String()
+	return strings.Repeat("0", otpDigits-len(code)) + code, nil
+}
+
+// sendStartCode holds back an accepted start form and texts the patient a
+// code to enter on the verification form it renders.  OTPPerPhone and
+// OTPPerIP bound the codes sent.
+func (s *Server) sendStartCode(w http.ResponseWriter, r *http.Request, u *pkg.User, page startPage, clinicID, profile, locale string) {
+	byPhone, byIP, err := s.Repo.CountPhoneVerificationsSince(r.Context(), u.Phone, u.ClientIP, time.Now().Add(-otpWindow))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if s.OTPPerPhone > 0 && byPhone >= s.OTPPerPhone || s.OTPPerIP > 0 && u.ClientIP != "" && byIP >= s.OTPPerIP {
+		s.refuseStart(w, r, page, audit.ActionStartRateLimited, http.StatusTooManyRequests, "verify.limited")
+		return
+	}
+	code, err := otpCode()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	v := &pkg.PhoneVerification{User: *u, ClinicID: clinicID, Profile: profile, Locale: locale}
+	if err := s.Repo.CreatePhoneVerification(r.Context(), v, code, otpTTL); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), otpSendTimeout)
+	defer cancel()
+	text := strings.ReplaceAll(i18n.T(page.Locale, "verify.sms"), "{code}", code)
+	if err := s.SMS.Send(ctx, latinDigits(u.Phone), text); err != nil {
+		log.Printf("send verification code (request %s): %v", requestID(r.Context()), err)
+		page.Error = i18n.T(page.Locale, "verify.send_failed")
+		s.renderStatus(w, r, http.StatusBadGateway, "start", page)
+		return
+	}
+	s.render(w, r, "verify", newVerifyPage(page, v.ID, u.Phone))
+}
+
+// handleVerifyStart checks the code entered on the verification form and,
+// when it matches, creates the session held back by sendStartCode.  A
+// wrong code shows the form again; once the code has expired or its
+// attempts are used up the patient starts over from the start form.
+func (s *Server) handleVerifyStart(w http.ResponseWriter, r *http.Request, prefix string) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errInvalidForm)
+		return
+	}
+	clinic, err := s.resolveClinic(r, prefix)
+	if err != nil {
+		s.clinicError(w, r, err)
+		return
+	}
+	page := newStartPage(clinic, prefix, "", r.FormValue("locale"))
+	id := r.FormValue("id")
+	code := strings.TrimSpace(latinDigits(r.FormValue("code")))
+	v, err := s.Repo.CheckPhoneVerification(r.Context(), id, code, otpAttempts)
+	switch {
+	case errors.Is(err, db.ErrWrongCode):
+		verify := newVerifyPage(page, id, r.FormValue("phone"))
+		verify.Error = i18n.T(page.Locale, "verify.wrong")
+		s.renderStatus(w, r, http.StatusBadRequest, "verify", verify)
+		return
+	case errors.Is(err, db.ErrVerificationClosed):
+		page.Error = i18n.T(page.Locale, "verify.expired")
+		s.renderStatus(w, r, http.StatusBadRequest, "start", page)
+		return
+	case err != nil:
+		writeError(w, r, err)
+		return
+	}
+	// The session goes to the clinic the form was sent to.
+	if v.ClinicID != clinic.ID {
+		if clinic, err = s.Repo.GetClinic(r.Context(), v.ClinicID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	s.startSession(w, r, &v.User, v.Profile, clinic, v.Locale)
+}
@@ -0,0 +1,112 @@
+// Package i18n resolves the patient-facing strings of the chat by locale.
+//
+// Each locale has a JSON catalog in catalogs/, named after its code and
+// embedded in the binary, mapping message keys to text.  Persian is the
+// default locale and the fallback for keys another catalog lacks.  The bot's
+// own messages (bot.* keys) default to the Persian constants in core, so the
+// Persian catalog does not repeat them; other catalogs translate them.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default is the locale used when none is chosen or the chosen one is not
+// supported.
+const Default = "fa"
+
+//go:embed catalogs/*.json
+var catalogFS embed.FS
+
+// catalogs maps locale codes to their messages.
+var catalogs = load()
+
+// load reads the embedded catalogs.  They are part of the binary, so a
+// malformed one is a build mistake and panics at startup.
+func load() map[string]map[string]string {
+	entries, err := catalogFS.ReadDir("catalogs")
+	if err != nil {
+		panic(err)
+	}
+	out := make(map[string]map[string]string, len(entries))
+	for _, e := range entries {
+		data, err := catalogFS.ReadFile(path.Join("catalogs", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic("i18n: " + e.Name() + ": " + err.Error())
+		}
+		out[strings.TrimSuffix(e.Name(), ".json")] = messages
+	}
+	if out[Default] == nil {
+		panic("i18n: no catalog for the default locale " + Default)
+	}
+	return out
+}
+
+// Locale describes a supported locale for the language picker.
+type Locale struct {
+	Code string
+	Name string // the locale's name in its own language
+}
+
+// Supported returns the supported locales, the default first and the rest
+// by code.
+func Supported() []Locale {
+	var out []Locale
+	for code := range catalogs {
+		out = append(out, Locale{Code: code, Name: T(code, "locale.name")})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if (out[i].Code == Default) != (out[j].Code == Default) {
+			return out[i].Code == Default
+		}
+		return out[i].Code < out[j].Code
+	})
+	return out
+}
+
+// Normalize returns code if it is a supported locale and Default otherwise.
+func Normalize(code string) string {
+	if _, ok := catalogs[code]; ok {
+		return code
+	}
+	return Default
+}
+
+// Lookup returns the message for key in locale only, without falling back
+// to the default locale.
+func Lookup(locale, key string) (string, bool) {
+	msg, ok := catalogs[locale][key]
+	return msg, ok
+}
+
+// T returns the message for key in locale, falling back to the default
+// locale and then to the key itself.
+func T(locale, key string) string {
+	if msg, ok := Lookup(locale, key); ok {
+		return msg
+	}
+	if msg, ok := Lookup(Default, key); ok {
+		return msg
+	}
+	return key
+}
+
+// Dir returns the text direction of locale, "rtl" or "ltr".
+func Dir(locale string) string {
+	return T(Normalize(locale), "locale.dir")
+}
+
+// FuncMap returns the template functions: t resolves a key for a locale
+// ({{ t .Locale "chat.send" }}) and dir gives a locale's text direction.
+func FuncMap() template.FuncMap {
+	return template.FuncMap{"t": T, "dir": Dir}
+}
@@ -0,0 +1,150 @@
+// Package jalali converts times to the Persian (Solar Hijri) calendar used
+// in Iran and formats them for display.
+//
+// Leap years follow the 33-year cycles with the break years of the
+// astronomical calendar (the algorithm of the jalaali-js library), which
+// matches the official calendar for Jalali years 1 to 3177.  Dates are taken
+// in Tehran time, so a timestamp shortly before midnight UTC falls on the
+// next Jalali day when it is already past midnight in Tehran.
+package jalali
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tehran is the time zone dates are converted in.  It falls back to Iran
+// Standard Time when the system has no time zone database.
+var Tehran = loadTehran()
+
+func loadTehran() *time.Location {
+	if loc, err := time.LoadLocation("Asia/Tehran"); err == nil {
+		return loc
+	}
+	return time.FixedZone("IRST", 3*60*60+30*60)
+}
+
+// Date is a day of the Jalali calendar.  Month is 1 (Farvardin) to 12
+// (Esfand).
+type Date struct {
+	Year, Month, Day int
+}
+
+// breaks are the Jalali years starting a new run of 33-year leap cycles.
+var breaks = []int{-61, 9, 38, 199, 426, 686, 756, 818, 1111, 1181, 1210,
+	1635, 2060, 2097, 2192, 2262, 2324, 2394, 2456, 3178}
+
+// cal describes the Jalali year jy: leap is 0 for a leap year, gy is the
+// Gregorian year in which it starts and march the day of March on which it
+// starts (Nowruz).
+func cal(jy int) (leap, gy, march int) {
+	gy = jy + 621
+	leapJ := -14
+	jp := breaks[0]
+	jump := 0
+	for _, jm := range breaks[1:] {
+		jump = jm - jp
+		if jy < jm {
+			break
+		}
+		leapJ += jump/33*8 + jump%33/4
+		jp = jm
+	}
+	n := jy - jp
+	leapJ += n/33*8 + (n%33+3)/4
+	if jump%33 == 4 && jump-n == 4 {
+		leapJ++
+	}
+	leapG := gy/4 - (gy/100+1)*3/4 - 150
+	march = 20 + leapJ - leapG
+	if jump-n < 6 {
+		n = n - jump + (jump+4)/33*33
+	}
+	leap = ((n+1)%33 - 1) % 4
+	if leap == -1 {
+		leap = 4
+	}
+	return leap, gy, march
+}
+
+// IsLeap reports whether the Jalali year has 366 days, i.e. an Esfand 30.
+func IsLeap(year int) bool {
+	leap, _, _ := cal(year)
+	return leap == 0
+}
+
+// dayNumber counts days since 1970-01-01 for a Gregorian date.
+func dayNumber(year int, month time.Month, day int) int {
+	return int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+// FromTime returns the Jalali date of t in Tehran.
+func FromTime(t time.Time) Date {
+	t = t.In(Tehran)
+	day := dayNumber(t.Year(), t.Month(), t.Day())
+	jy := t.Year() - 621
+	leap, gy, march := cal(jy)
+	k := day - dayNumber(gy, time.March, march)
+	if k >= 0 {
+		if k <= 185 {
+			return Date{jy, 1 + k/31, k%31 + 1}
+		}
+		k -= 186
+	} else {
+		jy--
+		k += 179
+		if leap == 1 {
+			k++
+		}
+	}
+	return Date{jy, 7 + k/30, k%30 + 1}
+}
+
+// Time returns midnight in loc on the Gregorian day d falls on.
+func (d Date) Time(loc *time.Location) time.Time {
+	_, gy, march := cal(d.Year)
+	days := dayNumber(gy, time.March, march) + (d.Month-1)*31 - d.Month/7*(d.Month-7) + d.Day - 1
+	g := time.Unix(int64(days)*86400, 0).UTC()
+	return time.Date(g.Year(), g.Month(), g.Day(), 0, 0, 0, 0, loc)
+}
+
+// String formats d as "1403/01/01" with Latin digits.
+func (d Date) String() string {
+	return fmt.Sprintf("%04d/%02d/%02d", d.Year, d.Month, d.Day)
+}
+
+// WeekStart returns midnight in Tehran on the Saturday starting the Persian
+// week that contains t.
+func WeekStart(t time.Time) time.Time {
+	t = t.In(Tehran)
+	days := (int(t.Weekday()) + 1) % 7 // days since Saturday
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, Tehran)
+}
+
+// digits maps Latin digits to Persian ones.
+var digits = strings.NewReplacer("0", "۰", "1", "۱", "2", "۲", "3", "۳", "4", "۴",
+	"5", "۵", "6", "۶", "7", "۷", "8", "۸", "9", "۹")
+
+// PersianDigits replaces the Latin digits in s with Persian ones.
+func PersianDigits(s string) string {
+	return digits.Replace(s)
+}
+
+// FormatDate formats t as its Jalali date in Persian digits, e.g.
+// "۱۴۰۳/۰۱/۰۱".  The zero time formats as "".
+func FormatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return PersianDigits(FromTime(t).String())
+}
+
+// FormatDateTime formats t as its Jalali date and Tehran time in Persian
+// digits, e.g. "۱۴۰۳/۰۱/۰۱ ۱۴:۳۰".  The zero time formats as "".
+func FormatDateTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return PersianDigits(FromTime(t).String() + " " + t.In(Tehran).Format("15:04"))
+}
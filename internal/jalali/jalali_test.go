@@ -0,0 +1,114 @@
+package jalali
+
+import (
+	"testing"
+	"time"
+)
+
+// tehran returns the time in Tehran.
+func tehran(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, Tehran)
+}
+
+func TestFromTime(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want Date
+	}{
+		// Nowruz and the last day of the year before it.
+		{tehran(2022, time.March, 21, 12, 0), Date{1401, 1, 1}},
+		{tehran(2023, time.March, 20, 12, 0), Date{1401, 12, 29}},
+		{tehran(2023, time.March, 21, 12, 0), Date{1402, 1, 1}},
+		{tehran(2024, time.March, 19, 12, 0), Date{1402, 12, 29}},
+		{tehran(2024, time.March, 20, 12, 0), Date{1403, 1, 1}},
+		{tehran(2025, time.March, 21, 12, 0), Date{1404, 1, 1}},
+		// Esfand 30 of the leap years 1395, 1399 and 1403.
+		{tehran(2017, time.March, 20, 12, 0), Date{1395, 12, 30}},
+		{tehran(2021, time.March, 20, 12, 0), Date{1399, 12, 30}},
+		{tehran(2025, time.March, 20, 12, 0), Date{1403, 12, 30}},
+		// The first months have 31 days, the next five 30.
+		{tehran(2024, time.September, 21, 12, 0), Date{1403, 6, 31}},
+		{tehran(2024, time.September, 22, 12, 0), Date{1403, 7, 1}},
+		{tehran(2024, time.December, 31, 12, 0), Date{1403, 10, 11}},
+		{tehran(2025, time.January, 1, 12, 0), Date{1403, 10, 12}},
+		// Dates are taken in Tehran: 20:30 UTC is already midnight there.
+		{time.Date(2024, time.March, 19, 20, 29, 0, 0, time.UTC), Date{1402, 12, 29}},
+		{time.Date(2024, time.March, 19, 20, 30, 0, 0, time.UTC), Date{1403, 1, 1}},
+	}
+	for _, tt := range tests {
+		if got := FromTime(tt.t); got != tt.want {
+			t.Errorf("FromTime(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestIsLeap(t *testing.T) {
+	for year, want := range map[int]bool{1391: true, 1395: true, 1399: true, 1400: false, 1402: false, 1403: true, 1404: false, 1408: true} {
+		if got := IsLeap(year); got != want {
+			t.Errorf("IsLeap(%d) = %v, want %v", year, got, want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	day := time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2200, time.January, 1, 0, 0, 0, 0, time.UTC)
+	prev := FromTime(day.Add(-24 * time.Hour))
+	for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+		d := FromTime(day)
+		if back := d.Time(time.UTC); !back.Equal(day) {
+			t.Fatalf("%v is %v, which is %v", day.Format("2006-01-02"), d, back.Format("2006-01-02"))
+		}
+		// Each day follows the previous one.
+		next := d.Day == prev.Day+1 && d.Month == prev.Month && d.Year == prev.Year ||
+			d.Day == 1 && (d.Month == prev.Month+1 && d.Year == prev.Year || d.Month == 1 && prev.Month == 12 && d.Year == prev.Year+1)
+		if !next {
+			t.Fatalf("%v follows %v", d, prev)
+		}
+		if d.Month == 1 && d.Day == 1 && prev.Day != 29+btoi(IsLeap(prev.Year)) {
+			t.Fatalf("year %d ended on Esfand %d", prev.Year, prev.Day)
+		}
+		prev = d
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestWeekStart(t *testing.T) {
+	saturday := tehran(2024, time.March, 16, 0, 0)
+	for _, at := range []time.Time{
+		saturday,
+		tehran(2024, time.March, 20, 9, 0),
+		tehran(2024, time.March, 22, 23, 59),
+		// Saturday has started in Tehran but not yet in UTC.
+		time.Date(2024, time.March, 15, 20, 30, 0, 0, time.UTC),
+	} {
+		if got := WeekStart(at); !got.Equal(saturday) {
+			t.Errorf("WeekStart(%v) = %v, want %v", at, got, saturday)
+		}
+	}
+	if got := WeekStart(tehran(2024, time.March, 23, 0, 30)); !got.Equal(saturday.AddDate(0, 0, 7)) {
+		t.Errorf("the next Saturday starts the week %v", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	at := time.Date(2024, time.March, 19, 21, 0, 0, 0, time.UTC)
+	if got := FormatDate(at); got != "۱۴۰۳/۰۱/۰۱" {
+		t.Errorf("FormatDate = %q", got)
+	}
+	if got := FormatDateTime(at); got != "۱۴۰۳/۰۱/۰۱ ۰۰:۳۰" {
+		t.Errorf("FormatDateTime = %q", got)
+	}
+	if FormatDate(time.Time{}) != "" || FormatDateTime(time.Time{}) != "" {
+		t.Errorf("zero time not formatted as empty")
+	}
+	if got := PersianDigits("1403/12-30 ab"); got != "۱۴۰۳/۱۲-۳۰ ab" {
+		t.Errorf("PersianDigits = %q", got)
+	}
+}
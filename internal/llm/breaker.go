@@ -0,0 +1,207 @@
+package llm
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrCircuitOpen is returned by Breaker while the circuit is open, without
+// calling the wrapped client.
+var ErrCircuitOpen = errs.New(errs.Unavailable, "llm circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a Client that stops calling the wrapped client after repeated
+// failures.  After Failures consecutive failures within Window the circuit
+// opens for Cooldown, during which every call fails fast with
+// ErrCircuitOpen.  Once the cooldown has elapsed a single probe call is let
+// through (half-open); its outcome closes or re-opens the circuit.
+//
+// Only provider failures count (see providerFailure): a request the
+// provider refuses, such as one transcript over the context length, leaves
+// the circuit alone however often it is sent.  Moderation and embedding
+// calls pass through without the breaker, so their endpoints failing does
+// not cut patients off the chat.
+type Breaker struct {
+	Client   Client
+	Failures int
+	Window   time.Duration
+	Cooldown time.Duration
+
+	// OnOpen, when set, is called every time the circuit opens.
+	OnOpen func()
+
+	mu           sync.Mutex
+	state        BreakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+	now          func() time.Time
+}
+
+// NewBreaker wraps client with a circuit breaker.
+func NewBreaker(client Client, failures int, window, cooldown time.Duration) *Breaker {
+	return &Breaker{Client: client, Failures: failures, Window: window, Cooldown: cooldown, now: time.Now}
+}
+
+// State returns the current breaker state.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a call may proceed and, if so, whether it is the
+// half-open probe.
+func (b *Breaker) allow() (bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return false, false
+		}
+		b.transition(BreakerHalfOpen)
+		b.probing = true
+		return true, true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *Breaker) record(err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && !providerFailure(err) {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+	if probe {
+		b.open()
+		return
+	}
+	now := b.now()
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.Window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.Failures {
+		b.open()
+	}
+}
+
+func (b *Breaker) open() {
+	b.openedAt = b.now()
+	b.failures = 0
+	b.transition(BreakerOpen)
+	if b.OnOpen != nil {
+		b.OnOpen()
+	}
+}
+
+func (b *Breaker) transition(to BreakerState) {
+	if b.state == to {
+		return
+	}
+	log.Printf("llm circuit breaker: %s -> %s", b.state, to)
+	b.state = to
+}
+
+// Chat calls the wrapped client unless the circuit is open.
+func (b *Breaker) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	ok, probe := b.allow()
+	if !ok {
+		return "", ErrCircuitOpen
+	}
+	reply, err := b.Client.Chat(ctx, messages, opts...)
+	b.record(err, probe)
+	return reply, err
+}
+
+// ChatStream streams from the wrapped client unless the circuit is open.
+// Clients that cannot stream deliver the whole reply as one chunk.
+func (b *Breaker) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	ok, probe := b.allow()
+	if !ok {
+		return "", ErrCircuitOpen
+	}
+	reply, err := ChatStream(ctx, b.Client, messages, onChunk, opts...)
+	b.record(err, probe)
+	return reply, err
+}
+
+// ChatStream streams from client if it is a Streamer and otherwise sends
+// the reply of Chat as a single chunk.
+func ChatStream(ctx context.Context, client Client, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	if s, ok := client.(Streamer); ok {
+		return s.ChatStream(ctx, messages, onChunk, opts...)
+	}
+	reply, err := client.Chat(ctx, messages, opts...)
+	if err == nil && reply != "" {
+		onChunk(reply)
+	}
+	return reply, err
+}
+
+// Summarize calls the wrapped client unless the circuit is open.
+func (b *Breaker) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	ok, probe := b.allow()
+	if !ok {
+		return "", ErrCircuitOpen
+	}
+	resp, err := b.Client.Summarize(ctx, prompt, opts...)
+	b.record(err, probe)
+	return resp, err
+}
+
+// Moderate calls the wrapped client, whatever the state of the circuit.
+func (b *Breaker) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	return b.Client.Moderate(ctx, text)
+}
+
+// Embed calls the wrapped client, whatever the state of the circuit.
+func (b *Breaker) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	return b.Client.Embed(ctx, text, opts...)
+}
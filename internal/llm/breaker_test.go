@@ -0,0 +1,174 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// newTestBreaker returns a Breaker opening after 3 failures within a
+// minute for 30 seconds around fake, and the clock it reads, which the
+// test moves.
+func newTestBreaker(fake *FakeClient) (*Breaker, *time.Time) {
+	clock := time.Date(2024, 3, 20, 10, 0, 0, 0, time.UTC)
+	b := NewBreaker(fake, 3, time.Minute, 30*time.Second)
+	b.now = func() time.Time { return clock }
+	return b, &clock
+}
+
+// statusError is the error of a call the provider answered with status.
+func statusError(status int) error {
+	return unavailable(&openai.APIError{HTTPStatusCode: status, Message: http.StatusText(status)})
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	fake := NewFakeClient("سلام")
+	b, clock := newTestBreaker(fake)
+	ctx := context.Background()
+	opened := 0
+	b.OnOpen = func() { opened++ }
+
+	fake.Err = statusError(http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		if got := b.State(); got != BreakerClosed {
+			t.Fatalf("after %d failures: %s, want closed", i, got)
+		}
+		b.Chat(ctx, nil)
+	}
+	if got := b.State(); got != BreakerOpen || opened != 1 {
+		t.Fatalf("after 3 failures: %s, opened %d times; want open once", got, opened)
+	}
+	// Open: calls fail fast without reaching the provider.
+	calls := len(fake.ChatCalls)
+	if _, err := b.Summarize(ctx, "x"); err != ErrCircuitOpen || len(fake.SummarizeCalls) != 0 {
+		t.Errorf("summarize while open: %v, %d calls", err, len(fake.SummarizeCalls))
+	}
+	*clock = clock.Add(29 * time.Second)
+	if _, err := b.Chat(ctx, nil); err != ErrCircuitOpen || len(fake.ChatCalls) != calls {
+		t.Errorf("chat before the cooldown: %v", err)
+	}
+
+	// Half-open after the cooldown; a failed probe re-opens the circuit
+	// for another cooldown.
+	*clock = clock.Add(time.Second)
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("after the cooldown: %s, want half-open", got)
+	}
+	if _, err := b.Chat(ctx, nil); err == ErrCircuitOpen || len(fake.ChatCalls) != calls+1 {
+		t.Fatalf("probe: %v, want the provider called", err)
+	}
+	if got := b.State(); got != BreakerOpen || opened != 2 {
+		t.Fatalf("after a failed probe: %s, opened %d times; want open twice", got, opened)
+	}
+
+	// A successful probe closes it.
+	*clock = clock.Add(30 * time.Second)
+	fake.Err = nil
+	if _, err := b.Chat(ctx, nil); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("after a successful probe: %s, want closed", got)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b, clock := newTestBreaker(NewFakeClient("سلام"))
+	for i := 0; i < 3; i++ {
+		b.record(statusError(http.StatusServiceUnavailable), false)
+	}
+	*clock = clock.Add(30 * time.Second)
+	if ok, probe := b.allow(); !ok || !probe {
+		t.Fatalf("first call after the cooldown: allowed %t, probe %t; want the probe", ok, probe)
+	}
+	// Every other call fails fast while the probe is in flight.
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(); ok {
+			t.Fatal("a second call was let through during the probe")
+		}
+	}
+	b.record(nil, true)
+	if ok, probe := b.allow(); !ok || probe || b.State() != BreakerClosed {
+		t.Errorf("after the probe: allowed %t, probe %t, %s; want closed", ok, probe, b.State())
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	b, clock := newTestBreaker(NewFakeClient("سلام"))
+	fail := func() { b.record(statusError(http.StatusBadGateway), false) }
+	fail()
+	fail()
+	// The failures of an earlier window no longer count.
+	*clock = clock.Add(time.Minute + time.Second)
+	fail()
+	fail()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("2 failures in each of two windows: %s, want closed", got)
+	}
+	// A success resets the count too.
+	b.record(nil, false)
+	fail()
+	fail()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("2 failures after a success: %s, want closed", got)
+	}
+	fail()
+	if got := b.State(); got != BreakerOpen {
+		t.Errorf("3 failures within the window: %s, want open", got)
+	}
+}
+
+func TestBreakerCountsProviderFailures(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		err   error
+		opens bool
+	}{
+		{"server error", statusError(http.StatusInternalServerError), true},
+		{"rate limit", statusError(http.StatusTooManyRequests), true},
+		{"timeout", unavailable(context.DeadlineExceeded), true},
+		{"network", unavailable(errors.New("dial tcp: connection refused")), true},
+		{"context length", statusError(http.StatusBadRequest), false},
+		{"authentication", statusError(http.StatusUnauthorized), false},
+		{"request error", unavailable(&openai.RequestError{HTTPStatusCode: http.StatusBadRequest, Err: errors.New("content filter")}), false},
+		{"cancelled", context.Canceled, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := NewFakeClient("سلام")
+			fake.Err = tc.err
+			b, _ := newTestBreaker(fake)
+			for i := 0; i < 5; i++ {
+				b.Chat(ctx, nil)
+			}
+			if open := b.State() == BreakerOpen; open != tc.opens {
+				t.Errorf("after 5 failures: %s, want open %t", b.State(), tc.opens)
+			}
+		})
+	}
+}
+
+func TestBreakerModerateAndEmbedBypass(t *testing.T) {
+	fake := NewFakeClient("سلام")
+	fake.Err = statusError(http.StatusInternalServerError)
+	b, _ := newTestBreaker(fake)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		b.Moderate(ctx, "x")
+		b.Embed(ctx, "x")
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("after moderation and embedding failures: %s, want closed", got)
+	}
+	// Nor does an open circuit stop them.
+	for i := 0; i < 3; i++ {
+		b.Chat(ctx, nil)
+	}
+	if _, err := b.Moderate(ctx, "x"); err == ErrCircuitOpen || len(fake.ModerateCalls) != 6 {
+		t.Errorf("moderate while open: %v, %d calls", err, len(fake.ModerateCalls))
+	}
+}
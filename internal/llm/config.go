@@ -0,0 +1,141 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ProviderOpenAI is the provider of the OpenAI API and of servers speaking
+// it, such as a local model behind an OpenAI-compatible endpoint.  It is
+// the only provider ClientConfig supports.
+const ProviderOpenAI = "openai"
+
+// defaultEmbedModel is the embedding model used when none is configured.
+const defaultEmbedModel = "text-embedding-3-small"
+
+// ClientConfig describes a client for one role, read from a group of
+// environment variables by ConfigFromEnv.
+type ClientConfig struct {
+	Provider string
+	Model    string
+	// BaseURL points the client at another server speaking the provider's
+	// API; empty means the provider's own.
+	BaseURL string
+	// APIKey is required unless BaseURL is set, since local servers
+	// usually take none.
+	APIKey string
+	// Timeout bounds each HTTP request to the provider; zero leaves it to
+	// the call's context.
+	Timeout time.Duration
+	// EmbeddingModel defaults to text-embedding-3-small, and FallbackModel
+	// answers failed chat calls as OPENAI_MODEL_CHAT_FALLBACK does.
+	EmbeddingModel string
+	FallbackModel  string
+}
+
+// ConfigFromEnv reads the client configuration of the variables starting
+// with prefix, e.g. "LLM_CHAT_": PROVIDER, MODEL, BASE_URL, API_KEY,
+// TIMEOUT, EMBEDDING_MODEL and FALLBACK_MODEL.  ok is false when none of
+// them is set.  A group with some set must be complete: PROVIDER and MODEL
+// are required, and API_KEY unless BASE_URL is set.
+func ConfigFromEnv(prefix string) (cfg ClientConfig, ok bool, err error) {
+	env := func(name string) string {
+		v := os.Getenv(prefix + name)
+		ok = ok || v != ""
+		return v
+	}
+	cfg = ClientConfig{
+		Provider:       env("PROVIDER"),
+		Model:          env("MODEL"),
+		BaseURL:        env("BASE_URL"),
+		APIKey:         env("API_KEY"),
+		EmbeddingModel: env("EMBEDDING_MODEL"),
+		FallbackModel:  env("FALLBACK_MODEL"),
+	}
+	timeout := env("TIMEOUT")
+	if !ok {
+		return ClientConfig{}, false, nil
+	}
+	var errs []error
+	switch cfg.Provider {
+	case ProviderOpenAI:
+	case "":
+		errs = append(errs, fmt.Errorf("%sPROVIDER is required", prefix))
+	default:
+		errs = append(errs, fmt.Errorf("%sPROVIDER: unknown provider %q, want %s", prefix, cfg.Provider, ProviderOpenAI))
+	}
+	if cfg.Model == "" {
+		errs = append(errs, fmt.Errorf("%sMODEL is required", prefix))
+	}
+	if cfg.APIKey == "" && cfg.BaseURL == "" {
+		errs = append(errs, fmt.Errorf("%sAPI_KEY is required unless %sBASE_URL is set", prefix, prefix))
+	}
+	if timeout != "" {
+		if cfg.Timeout, err = time.ParseDuration(timeout); err != nil || cfg.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("%sTIMEOUT: %q is not a positive duration", prefix, timeout))
+		}
+	}
+	for _, m := range []struct{ name, value string }{
+		{"MODEL", cfg.Model},
+		{"EMBEDDING_MODEL", cfg.EmbeddingModel},
+		{"FALLBACK_MODEL", cfg.FallbackModel},
+	} {
+		if m.value != "" && !modelName.MatchString(m.value) {
+			errs = append(errs, fmt.Errorf("%s%s: %q is not a model name", prefix, m.name, m.value))
+		}
+	}
+	return cfg, true, errors.Join(errs...)
+}
+
+// NewClient constructs the client cfg describes.  Its chat and summaries
+// both use cfg.Model.
+func NewClient(cfg ClientConfig) *OpenAIClient {
+	oc := openai.DefaultConfig(cfg.APIKey)
+	if cfg.BaseURL != "" {
+		oc.BaseURL = cfg.BaseURL
+	}
+	oc.HTTPClient = &http.Client{Timeout: cfg.Timeout}
+	embedModel := cfg.EmbeddingModel
+	if embedModel == "" {
+		embedModel = defaultEmbedModel
+	}
+	return &OpenAIClient{
+		client:        openai.NewClientWithConfig(oc),
+		chatModel:     cfg.Model,
+		summaryModel:  cfg.Model,
+		embedModel:    embedModel,
+		fallbackModel: cfg.FallbackModel,
+	}
+}
+
+// ClientsFromEnv constructs the clients of the chat and of summaries from
+// the LLM_CHAT_* and LLM_SUMMARY_* variable groups, e.g. to keep summaries
+// on a local model.  A group configured alone serves both roles, and with
+// neither the OPENAI_* variables configure the one client (see
+// NewOpenAIClient), returned as legacy too so its model names can be
+// checked.  chat and summary are the same client unless both groups are
+// configured.
+func ClientsFromEnv() (chat, summary, legacy *OpenAIClient, err error) {
+	chatCfg, hasChat, chatErr := ConfigFromEnv("LLM_CHAT_")
+	summaryCfg, hasSummary, summaryErr := ConfigFromEnv("LLM_SUMMARY_")
+	if err := errors.Join(chatErr, summaryErr); err != nil {
+		return nil, nil, nil, err
+	}
+	switch {
+	case hasChat && hasSummary:
+		return NewClient(chatCfg), NewClient(summaryCfg), nil, nil
+	case hasChat:
+		chat = NewClient(chatCfg)
+		return chat, chat, nil, nil
+	case hasSummary:
+		summary = NewClient(summaryCfg)
+		return summary, summary, nil, nil
+	}
+	legacy = NewOpenAIClient()
+	return legacy, legacy, legacy, nil
+}
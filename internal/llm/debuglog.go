@@ -0,0 +1,212 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/internal/redact"
+)
+
+// DebugLog is a Client that writes every request and its response to Out
+// as one JSON object per line, for diagnosing model behaviour.  National
+// IDs, phone numbers and the names of the redact.Redactor carried by the
+// call's context are masked before anything is written.
+type DebugLog struct {
+	Client Client
+	Out    io.Writer
+
+	mu sync.Mutex
+}
+
+// NewDebugLog wraps client, logging its calls to out.
+func NewDebugLog(client Client, out io.Writer) *DebugLog {
+	return &DebugLog{Client: client, Out: out}
+}
+
+// debugEntry is one line of the debug log.
+type debugEntry struct {
+	Time     time.Time      `json:"time"`
+	Call     string         `json:"call"`
+	Model    string         `json:"model,omitempty"`
+	Messages []Message      `json:"-"`
+	Redacted []debugMessage `json:"messages,omitempty"`
+	Prompt   string         `json:"prompt,omitempty"`
+	Response string         `json:"response,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Millis   int64          `json:"duration_ms"`
+}
+
+// debugMessage is a redacted chat message in the debug log.
+type debugMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// write redacts and appends an entry.  Failures are logged but never fail
+// the call.
+func (d *DebugLog) write(ctx context.Context, e debugEntry, start time.Time, err error) {
+	r := redact.FromContext(ctx)
+	e.Time, e.Millis = start, time.Since(start).Milliseconds()
+	for _, m := range e.Messages {
+		e.Redacted = append(e.Redacted, debugMessage{m.Role, r.Redact(m.Content)})
+	}
+	e.Prompt, e.Response = r.Redact(e.Prompt), r.Redact(e.Response)
+	if err != nil {
+		e.Error = r.Redact(err.Error())
+	}
+	line, jerr := json.Marshal(e)
+	if jerr != nil {
+		log.Printf("llm debug log: %v", jerr)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.Out.Write(append(line, '\n')); err != nil {
+		log.Printf("llm debug log: %v", err)
+	}
+}
+
+// withModel adds a model report for the log while still reporting to the
+// caller's WithModelReport, which the added option would otherwise replace.
+func withModel(opts []Option, model *string) ([]Option, func()) {
+	caller := NewOptions(opts...)
+	return append(opts[:len(opts):len(opts)], WithModelReport(model)), func() { caller.report(*model) }
+}
+
+// Chat calls the wrapped client and logs the exchange.
+func (d *DebugLog) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	reply, err := d.Client.Chat(ctx, messages, opts...)
+	done()
+	d.write(ctx, debugEntry{Call: "chat", Model: model, Messages: messages, Response: reply}, start, err)
+	return reply, err
+}
+
+// ChatStream streams from the wrapped client and logs the complete reply.
+func (d *DebugLog) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	reply, err := ChatStream(ctx, d.Client, messages, onChunk, opts...)
+	done()
+	d.write(ctx, debugEntry{Call: "chat_stream", Model: model, Messages: messages, Response: reply}, start, err)
+	return reply, err
+}
+
+// Summarize calls the wrapped client and logs the exchange.
+func (d *DebugLog) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	resp, err := d.Client.Summarize(ctx, prompt, opts...)
+	done()
+	d.write(ctx, debugEntry{Call: "summarize", Model: model, Prompt: prompt, Response: resp}, start, err)
+	return resp, err
+}
+
+// Moderate calls the wrapped client and logs the checked text and verdict.
+func (d *DebugLog) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	start := time.Now()
+	res, err := d.Client.Moderate(ctx, text)
+	verdict := "not flagged"
+	if res.Flagged {
+		verdict = "flagged: " + res.Category
+	}
+	d.write(ctx, debugEntry{Call: "moderate", Prompt: text, Response: verdict}, start, err)
+	return res, err
+}
+
+// Embed calls the wrapped client and logs the embedded text.
+func (d *DebugLog) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	v, err := d.Client.Embed(ctx, text, opts...)
+	done()
+	d.write(ctx, debugEntry{Call: "embed", Model: model, Prompt: text, Response: fmt.Sprintf("%d dimensions", len(v))}, start, err)
+	return v, err
+}
+
+// RotatingFile is an io.Writer that appends to a file and, once it would
+// grow past its size limit, renames it to path.1 (shifting older copies up
+// to the number of backups kept) and starts a new one.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, keeping up to backups rotated
+// copies of at most maxBytes each.
+func OpenRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first when it would exceed the size limit.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, moves the current file to path.1 and reopens.
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	for i := rf.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.backups > 0 {
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Close closes the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
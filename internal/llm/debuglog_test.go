@@ -0,0 +1,90 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"waitroom-chatbot/internal/redact"
+)
+
+func TestDebugLogRedacts(t *testing.T) {
+	fake := NewFakeClient("سارا، شماره 09123456789 ثبت شد")
+	fake.Model = "test-model"
+	var out bytes.Buffer
+	d := NewDebugLog(fake, &out)
+	ctx := redact.NewContext(context.Background(), redact.New("سارا"))
+
+	var model string
+	if _, err := d.Chat(ctx, []Message{{Role: "user", Content: "من سارا هستم، کد ملی 0012345678"}}, WithModelReport(&model)); err != nil {
+		t.Fatal(err)
+	}
+	if model != "test-model" {
+		t.Errorf("model reported to the caller %q", model)
+	}
+	if _, err := d.Summarize(ctx, "سارا 0012345678"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d log lines, want 2", len(lines))
+	}
+	for _, secret := range []string{"سارا", "0012345678", "09123456789"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("debug log contains %s: %s", secret, out.String())
+		}
+	}
+	var e struct {
+		Call     string         `json:"call"`
+		Model    string         `json:"model"`
+		Messages []debugMessage `json:"messages"`
+		Response string         `json:"response"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Call != "chat" || e.Model != "test-model" || len(e.Messages) != 1 ||
+		e.Messages[0].Content != "من [name] هستم، کد ملی [national-id]" || e.Response != "[name]، شماره [phone] ثبت شد" {
+		t.Errorf("chat entry %+v", e)
+	}
+}
+
+func TestDebugLogErrors(t *testing.T) {
+	fake := NewFakeClient("")
+	fake.Err = errors.New("quota exceeded for 0012345678")
+	var out bytes.Buffer
+	if _, err := NewDebugLog(fake, &out).Chat(context.Background(), nil); err != fake.Err {
+		t.Fatalf("error %v, want the client's", err)
+	}
+	if !strings.Contains(out.String(), `"error":"quota exceeded for [national-id]"`) {
+		t.Errorf("error not logged redacted: %s", out.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "debug.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("%s: %q, %v; want %q", filepath.Base(name), got, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than kept: %v", err)
+	}
+}
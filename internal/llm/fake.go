@@ -0,0 +1,150 @@
+package llm
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeClient is an in-memory Client for tests and local development.  It
+// returns the configured canned responses and records every call so tests
+// can assert what was sent.
+type FakeClient struct {
+	mu sync.Mutex
+
+	// ChatReply and SummaryReply are returned by Chat and Summarize.
+	ChatReply    string
+	SummaryReply string
+	// ChatReplies and SummaryReplies, when set, are returned by Chat and
+	// Summarize in turn before ChatReply and SummaryReply, e.g. to exercise
+	// a reply that is rejected and requested again.
+	ChatReplies    []string
+	SummaryReplies []string
+	// Model is reported as the answering model (see WithModelReport).
+	Model string
+	// Moderation is returned by Moderate for every input.
+	Moderation ModerationResult
+	// Err, when set, is returned by every call.
+	Err error
+	// Delay, when set, is how long Chat and Summarize take, e.g. to
+	// exercise a Limiter.
+	Delay time.Duration
+
+	ChatCalls      [][]Message
+	SummarizeCalls []string
+	ModerateCalls  []string
+	EmbedCalls     []string
+	// ChatOptions and SummarizeOptions hold the resolved options of each
+	// Chat and Summarize call, in the same order as the calls.
+	ChatOptions      []Options
+	SummarizeOptions []Options
+}
+
+// NewFakeClient returns a FakeClient with the given chat reply.
+func NewFakeClient(chatReply string) *FakeClient {
+	return &FakeClient{ChatReply: chatReply, SummaryReply: chatReply}
+}
+
+// Chat records the messages and options and returns ChatReply.
+func (f *FakeClient) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	if err := f.wait(ctx); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ChatCalls = append(f.ChatCalls, messages)
+	o := NewOptions(opts...)
+	f.ChatOptions = append(f.ChatOptions, o)
+	reply := f.ChatReply
+	if len(f.ChatReplies) > 0 {
+		reply, f.ChatReplies = f.ChatReplies[0], f.ChatReplies[1:]
+	}
+	if f.Err == nil {
+		o.report(f.Model)
+		var prompt int
+		for _, m := range messages {
+			prompt += EstimateTokens(m.Content)
+		}
+		o.reportUsage(Usage{Model: f.Model, PromptTokens: prompt, CompletionTokens: EstimateTokens(reply), Estimated: true})
+	}
+	return reply, f.Err
+}
+
+// ChatStream is like Chat and sends ChatReply as a single chunk.
+func (f *FakeClient) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	reply, err := f.Chat(ctx, messages, opts...)
+	if err == nil && reply != "" {
+		onChunk(reply)
+	}
+	return reply, err
+}
+
+// Summarize records the prompt and options and returns SummaryReply.
+func (f *FakeClient) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	if err := f.wait(ctx); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.SummarizeCalls = append(f.SummarizeCalls, prompt)
+	o := NewOptions(opts...)
+	f.SummarizeOptions = append(f.SummarizeOptions, o)
+	reply := f.SummaryReply
+	if len(f.SummaryReplies) > 0 {
+		reply, f.SummaryReplies = f.SummaryReplies[0], f.SummaryReplies[1:]
+	}
+	if f.Err == nil {
+		o.report(f.Model)
+		o.reportUsage(Usage{Model: f.Model, PromptTokens: EstimateTokens(prompt), CompletionTokens: EstimateTokens(reply), Estimated: true})
+	}
+	return reply, f.Err
+}
+
+// wait sleeps for Delay or until ctx is done.
+func (f *FakeClient) wait(ctx context.Context) error {
+	if f.Delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(f.Delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Moderate records the text and returns Moderation.
+func (f *FakeClient) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ModerateCalls = append(f.ModerateCalls, text)
+	return f.Moderation, f.Err
+}
+
+// fakeDimensions is the length of FakeClient embeddings.
+const fakeDimensions = 64
+
+// Embed records the text and returns a bag-of-words vector, so texts
+// sharing words are similar.
+func (f *FakeClient) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.EmbedCalls = append(f.EmbedCalls, text)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	v := make([]float32, fakeDimensions)
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		h := fnv.New32a()
+		h.Write([]byte(word))
+		v[h.Sum32()%fakeDimensions]++
+	}
+	o := NewOptions(opts...)
+	o.report(f.Model)
+	o.reportUsage(Usage{Model: f.Model, PromptTokens: EstimateTokens(text), Estimated: true})
+	return v, nil
+}
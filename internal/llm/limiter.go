@@ -0,0 +1,115 @@
+package llm
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrBusy is returned by a Limiter when a call waited MaxWait for a free
+// slot without getting one.  Callers should ask the patient to retry.
+var ErrBusy = errs.New(errs.Unavailable, "llm: too many concurrent requests")
+
+// Limiter is a Client that allows at most a fixed number of calls to the
+// wrapped client at once, so a rush of patients does not run into the
+// provider's rate limits.  Further calls queue for up to MaxWait and then
+// fail with ErrBusy.
+type Limiter struct {
+	Client Client
+	// MaxWait bounds how long a call queues for a slot.
+	MaxWait time.Duration
+
+	slots  chan struct{}
+	queued int64
+}
+
+// NewLimiter wraps client, allowing max concurrent calls that queue for at
+// most maxWait.
+func NewLimiter(client Client, max int, maxWait time.Duration) *Limiter {
+	if max < 1 {
+		max = 1
+	}
+	return &Limiter{Client: client, MaxWait: maxWait, slots: make(chan struct{}, max)}
+}
+
+// InFlight returns the number of calls holding a slot.
+func (l *Limiter) InFlight() int { return len(l.slots) }
+
+// Queued returns the number of calls waiting for a slot.
+func (l *Limiter) Queued() int { return int(atomic.LoadInt64(&l.queued)) }
+
+// acquire takes a slot, waiting up to MaxWait.  The returned function
+// releases it.
+func (l *Limiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	atomic.AddInt64(&l.queued, 1)
+	defer atomic.AddInt64(&l.queued, -1)
+	timer := time.NewTimer(l.MaxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Chat calls the wrapped client once a slot is free.
+func (l *Limiter) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return l.Client.Chat(ctx, messages, opts...)
+}
+
+// ChatStream streams from the wrapped client once a slot is free; the slot
+// is held until the stream ends.
+func (l *Limiter) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return ChatStream(ctx, l.Client, messages, onChunk, opts...)
+}
+
+// Summarize calls the wrapped client once a slot is free.
+func (l *Limiter) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return l.Client.Summarize(ctx, prompt, opts...)
+}
+
+// Moderate calls the wrapped client once a slot is free.
+func (l *Limiter) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return ModerationResult{}, err
+	}
+	defer release()
+	return l.Client.Moderate(ctx, text)
+}
+
+// Embed calls the wrapped client once a slot is free.
+func (l *Limiter) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	release, err := l.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.Client.Embed(ctx, text, opts...)
+}
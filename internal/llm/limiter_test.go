@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterQueues(t *testing.T) {
+	fake := NewFakeClient("سلام")
+	fake.Delay = 50 * time.Millisecond
+	l := NewLimiter(fake, 2, time.Second)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				_, errs[i] = l.Chat(ctx, nil)
+			} else {
+				_, errs[i] = l.Summarize(ctx, "x")
+			}
+		}(i)
+	}
+	waitFor(t, "two calls in flight and three queued", func() bool { return l.InFlight() == 2 && l.Queued() == 3 })
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("call %d: %v", i, err)
+		}
+	}
+	if l.InFlight() != 0 || l.Queued() != 0 {
+		t.Errorf("%d in flight and %d queued after the calls", l.InFlight(), l.Queued())
+	}
+	if len(fake.ChatCalls)+len(fake.SummarizeCalls) != len(errs) {
+		t.Errorf("%d calls reached the client, want %d", len(fake.ChatCalls)+len(fake.SummarizeCalls), len(errs))
+	}
+}
+
+func TestLimiterBusy(t *testing.T) {
+	fake := NewFakeClient("سلام")
+	fake.Delay = 200 * time.Millisecond
+	l := NewLimiter(fake, 1, 10*time.Millisecond)
+	ctx := context.Background()
+	done := make(chan error)
+	go func() {
+		_, err := l.Chat(ctx, nil)
+		done <- err
+	}()
+	waitFor(t, "a call in flight", func() bool { return l.InFlight() == 1 })
+
+	start := time.Now()
+	if _, err := l.ChatStream(ctx, nil, func(string) {}); !errors.Is(err, ErrBusy) {
+		t.Errorf("queued call: %v, want ErrBusy", err)
+	}
+	if waited := time.Since(start); waited > 150*time.Millisecond {
+		t.Errorf("busy after %v, want after about MaxWait", waited)
+	}
+	// A cancelled caller stops waiting with its own error.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := l.Embed(cctx, "x"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled call: %v, want context.Canceled", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Moderate(ctx, "x"); err != nil {
+		t.Errorf("call after the slot was released: %v", err)
+	}
+}
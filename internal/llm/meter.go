@@ -0,0 +1,302 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrBudgetExceeded is returned by Meter instead of calling the model once
+// the month's estimated spend has reached the budget.
+var ErrBudgetExceeded = errs.New(errs.Unavailable, "llm monthly budget exceeded")
+
+// Price is the cost of a model in US dollars per million tokens.
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// Prices maps model names to their price.  A model is priced by the
+// longest name it starts with, so dated snapshots such as
+// "gpt-4o-mini-2024-07-18" use the price of "gpt-4o-mini".
+type Prices map[string]Price
+
+// DefaultPrices are the list prices of the models the clinic uses.
+var DefaultPrices = Prices{
+	"gpt-4o-mini":  {Input: 0.15, Output: 0.60},
+	"gpt-4o":       {Input: 2.50, Output: 10.00},
+	"gpt-4.1-mini": {Input: 0.40, Output: 1.60},
+	"gpt-4.1":      {Input: 2.00, Output: 8.00},
+	"gpt-5-mini":   {Input: 0.25, Output: 2.00},
+	"gpt-5":        {Input: 1.25, Output: 10.00},
+
+	"text-embedding-3-small": {Input: 0.02},
+	"text-embedding-3-large": {Input: 0.13},
+}
+
+// ParsePrices reads a price table of the form
+// "model=input:output,model=input:output" (dollars per million tokens) and
+// returns DefaultPrices overridden by it.
+func ParsePrices(s string) (Prices, error) {
+	prices := make(Prices, len(DefaultPrices))
+	for model, p := range DefaultPrices {
+		prices[model] = p
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, rates, ok := strings.Cut(entry, "=")
+		in, out, ok2 := strings.Cut(rates, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid price %q: want model=input:output", entry)
+		}
+		input, err := strconv.ParseFloat(strings.TrimSpace(in), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price %q: %v", entry, err)
+		}
+		output, err := strconv.ParseFloat(strings.TrimSpace(out), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price %q: %v", entry, err)
+		}
+		prices[strings.TrimSpace(model)] = Price{Input: input, Output: output}
+	}
+	return prices, nil
+}
+
+// Cost returns the estimated cost of u in dollars and whether the model has
+// a price.
+func (p Prices) Cost(u Usage) (float64, bool) {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		if strings.HasPrefix(u.Model, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return 0, false
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	price := p[names[0]]
+	return (price.Input*float64(u.PromptTokens) + price.Output*float64(u.CompletionTokens)) / 1e6, true
+}
+
+// CostStore keeps the running cost per calendar month ("2006-01") and
+// model.
+type CostStore interface {
+	AddLLMCost(ctx context.Context, month, model string, promptTokens, completionTokens int, cost float64) error
+	MonthlyLLMCost(ctx context.Context, month string) (float64, error)
+}
+
+// CostStatus reports the month's estimated spend against the budget.
+type CostStatus struct {
+	Month    string  `json:"month"`
+	Cost     float64 `json:"cost_usd"`
+	Budget   float64 `json:"budget_usd,omitempty"`
+	Exceeded bool    `json:"exceeded"`
+}
+
+// Meter is a Client that records the estimated cost of every call and,
+// when Budget is set, refuses chat and summary calls with
+// ErrBudgetExceeded once the calendar month's spend reaches it.  The
+// month's total is cached in memory: each call adds its own cost and Run
+// reloads the total from the store periodically, so the check never
+// queries the database.  Moderation calls are free and always pass.
+type Meter struct {
+	Client Client
+	Store  CostStore
+	Prices Prices
+	// Budget is the monthly ceiling in dollars; zero only records costs.
+	Budget float64
+	// RefreshInterval is how often Run reloads the month's total, which
+	// also picks up the spend of other instances.
+	RefreshInterval time.Duration
+	// OnExceeded, when set, is called once per month when the spend first
+	// reaches the budget.
+	OnExceeded func(ctx context.Context, status CostStatus)
+
+	mu      sync.Mutex
+	month   string
+	cost    float64
+	alerted string
+	now     func() time.Time
+}
+
+// NewMeter wraps client with cost accounting against budget dollars per
+// month.
+func NewMeter(client Client, store CostStore, prices Prices, budget float64) *Meter {
+	return &Meter{Client: client, Store: store, Prices: prices, Budget: budget, RefreshInterval: time.Minute, now: time.Now}
+}
+
+// currentMonth returns the calendar month key and resets the cached total
+// when a new month has begun.  m.mu must be held.
+func (m *Meter) currentMonth() string {
+	month := m.now().Format("2006-01")
+	if month != m.month {
+		m.month, m.cost = month, 0
+	}
+	return month
+}
+
+// Status returns the month's estimated spend.
+func (m *Meter) Status() CostStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status()
+}
+
+func (m *Meter) status() CostStatus {
+	month := m.currentMonth()
+	return CostStatus{Month: month, Cost: m.cost, Budget: m.Budget, Exceeded: m.Budget > 0 && m.cost >= m.Budget}
+}
+
+// Run reloads the month's total every RefreshInterval until ctx is
+// cancelled.
+func (m *Meter) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		m.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh replaces the cached total with the stored one.
+func (m *Meter) refresh(ctx context.Context) {
+	m.mu.Lock()
+	month := m.currentMonth()
+	m.mu.Unlock()
+	cost, err := m.Store.MonthlyLLMCost(ctx, month)
+	if err != nil {
+		log.Printf("llm: load monthly cost: %v", err)
+		return
+	}
+	m.mu.Lock()
+	if m.currentMonth() == month {
+		m.cost = cost
+	}
+	m.mu.Unlock()
+	m.checkBudget(ctx)
+}
+
+// exceeded reports whether the budget has been reached.
+func (m *Meter) exceeded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status().Exceeded
+}
+
+// record stores the cost of a call and adds it to the cached total.
+func (m *Meter) record(ctx context.Context, u Usage) {
+	if u.Model == "" || u.PromptTokens+u.CompletionTokens == 0 {
+		return
+	}
+	cost, ok := m.Prices.Cost(u)
+	if !ok {
+		log.Printf("llm: no price for model %s; its usage is not counted toward the budget", u.Model)
+	}
+	m.mu.Lock()
+	month := m.currentMonth()
+	m.cost += cost
+	m.mu.Unlock()
+	if err := m.Store.AddLLMCost(ctx, month, u.Model, u.PromptTokens, u.CompletionTokens, cost); err != nil {
+		log.Printf("llm: record cost of %s call: %v", u.Model, err)
+	}
+	m.checkBudget(ctx)
+}
+
+// checkBudget calls OnExceeded the first time in a month the spend reaches
+// the budget.
+func (m *Meter) checkBudget(ctx context.Context) {
+	m.mu.Lock()
+	status := m.status()
+	alert := status.Exceeded && m.alerted != status.Month
+	if alert {
+		m.alerted = status.Month
+	}
+	m.mu.Unlock()
+	if !alert {
+		return
+	}
+	log.Printf("llm: monthly budget of $%.2f reached ($%.2f spent in %s); replies are degraded", status.Budget, status.Cost, status.Month)
+	if m.OnExceeded != nil {
+		m.OnExceeded(ctx, status)
+	}
+}
+
+// withUsage adds a usage report for the meter while still reporting to the
+// caller's WithUsageReport, which the added option would otherwise replace.
+func withUsage(opts []Option, u *Usage) ([]Option, func()) {
+	caller := NewOptions(opts...)
+	return append(opts[:len(opts):len(opts)], WithUsageReport(u)), func() { caller.reportUsage(*u) }
+}
+
+// Chat calls the wrapped client unless the budget is exhausted.
+func (m *Meter) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	if m.exceeded() {
+		return "", ErrBudgetExceeded
+	}
+	var u Usage
+	opts, done := withUsage(opts, &u)
+	reply, err := m.Client.Chat(ctx, messages, opts...)
+	done()
+	m.record(ctx, u)
+	return reply, err
+}
+
+// ChatStream streams from the wrapped client unless the budget is
+// exhausted.
+func (m *Meter) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	if m.exceeded() {
+		return "", ErrBudgetExceeded
+	}
+	var u Usage
+	opts, done := withUsage(opts, &u)
+	reply, err := ChatStream(ctx, m.Client, messages, onChunk, opts...)
+	done()
+	m.record(ctx, u)
+	return reply, err
+}
+
+// Summarize calls the wrapped client unless the budget is exhausted.
+func (m *Meter) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	if m.exceeded() {
+		return "", ErrBudgetExceeded
+	}
+	var u Usage
+	opts, done := withUsage(opts, &u)
+	resp, err := m.Client.Summarize(ctx, prompt, opts...)
+	done()
+	m.record(ctx, u)
+	return resp, err
+}
+
+// Moderate calls the wrapped client.
+func (m *Meter) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	return m.Client.Moderate(ctx, text)
+}
+
+// Embed calls the wrapped client unless the budget is exhausted.
+func (m *Meter) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	if m.exceeded() {
+		return nil, ErrBudgetExceeded
+	}
+	var u Usage
+	opts, done := withUsage(opts, &u)
+	v, err := m.Client.Embed(ctx, text, opts...)
+	done()
+	m.record(ctx, u)
+	return v, err
+}
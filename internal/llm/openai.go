@@ -3,7 +3,17 @@ package llm
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"waitroom-chatbot/pkg/errs"
 
 	openai "github.com/sashabaranov/go-openai"
 )
@@ -17,17 +27,62 @@ type Message struct {
 
 // Client defines the methods required by the chat and summariser.
 // Chat accepts the full message history (system + prior turns + latest user).
+// Chat and Summarize take per-call model parameters (see Option).
+// Moderate classifies a patient message before it reaches the chat model.
+// Embed returns a vector for comparing texts by meaning (see Cosine).
 type Client interface {
-	Chat(ctx context.Context, messages []Message) (string, error)
-	Summarize(ctx context.Context, prompt string) (string, error)
+	Chat(ctx context.Context, messages []Message, opts ...Option) (string, error)
+	Summarize(ctx context.Context, prompt string, opts ...Option) (string, error)
+	Moderate(ctx context.Context, text string) (ModerationResult, error)
+	Embed(ctx context.Context, text string, opts ...Option) ([]float32, error)
+}
+
+// Streamer is implemented by clients that can stream chat replies.
+// ChatStream calls onChunk with each part of the reply as it arrives and
+// returns the complete reply.
+type Streamer interface {
+	ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error)
+}
+
+// Moderation categories reported in ModerationResult.Category.
+const (
+	CategorySelfHarm   = "self_harm"
+	CategoryHarassment = "harassment"
+	CategoryHate       = "hate"
+	CategorySexual     = "sexual"
+	CategoryViolence   = "violence"
+	// CategoryUnknown is reported for text flagged for none of the above.
+	CategoryUnknown = "unknown"
+)
+
+// ModerationResult is the outcome of a moderation check.  Category holds the
+// most relevant flagged category and is empty when the text is clean.
+type ModerationResult struct {
+	Flagged  bool
+	Category string
 }
 
+// continuePrompt asks the model to carry on with a reply that was cut off
+// at the token limit.
+const continuePrompt = "ادامه بده"
+
+// SummaryContinuations is how many times Summarize continues a summary cut
+// off at the token limit.
+const SummaryContinuations = 2
+
 // OpenAIClient calls the OpenAI API for chat and summarisation responses.
 // API credentials and model names are loaded from environment variables.
 type OpenAIClient struct {
 	client       *openai.Client
 	chatModel    string
 	summaryModel string
+	embedModel   string
+	// fallbackModel, when set, answers chat calls the chat model failed with
+	// a retryable error (see retryable).
+	fallbackModel string
+
+	// OnFallback, when set, is called every time a chat call falls back.
+	OnFallback func()
 }
 
 // NewOpenAIClient constructs an OpenAI-backed LLM client. It reads the API key
@@ -46,21 +101,247 @@ func NewOpenAIClient() *OpenAIClient {
 		summaryModel = chatModel
 	}
 
+	embedModel := os.Getenv("OPENAI_MODEL_EMBEDDING")
+	if embedModel == "" {
+		embedModel = defaultEmbedModel
+	}
+
 	return &OpenAIClient{
-		client:       c,
-		chatModel:    chatModel,
-		summaryModel: summaryModel,
+		client:        c,
+		chatModel:     chatModel,
+		summaryModel:  summaryModel,
+		embedModel:    embedModel,
+		fallbackModel: os.Getenv("OPENAI_MODEL_CHAT_FALLBACK"),
 	}
 }
 
+// modelName matches what an OpenAI model name can plausibly be, e.g.
+// "gpt-4o-mini" or "ft:gpt-4o-mini:org::id".
+var modelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]{0,127}$`)
+
+// CheckModels reports every configured model name that cannot be one, such
+// as a value with spaces or quotes pasted into the environment.  Whether the
+// model exists is only known once it is called.
+func (c *OpenAIClient) CheckModels() error {
+	var problems []error
+	for _, m := range []struct{ use, name string }{
+		{"OPENAI_MODEL_CHAT", c.chatModel},
+		{"OPENAI_MODEL_SUMMARY", c.summaryModel},
+		{"OPENAI_MODEL_EMBEDDING", c.embedModel},
+		{"OPENAI_MODEL_CHAT_FALLBACK", c.fallbackModel},
+	} {
+		if m.name == "" && m.use == "OPENAI_MODEL_CHAT_FALLBACK" {
+			continue
+		}
+		if !modelName.MatchString(m.name) {
+			problems = append(problems, fmt.Errorf("%s: %q is not a model name", m.use, m.name))
+		}
+	}
+	return errors.Join(problems...)
+}
+
 // Chat sends the message history to the OpenAI chat completion API and returns
-// the assistant's response.
-func (c *OpenAIClient) Chat(ctx context.Context, messages []Message) (string, error) {
+// the assistant's response.  A retryable failure is retried once against the
+// fallback model, if one is configured.
+func (c *OpenAIClient) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
 	if c.client == nil {
-		return "", errors.New("openai client not initialized")
+		return "", errNotInitialized
+	}
+
+	o := NewOptions(opts...)
+	msgs := toOpenAI(messages)
+	model := c.chatModel
+	res, err := c.complete(ctx, request(model, msgs, o), o.Continuations)
+	if err != nil && c.fallback(ctx, err) {
+		model = c.fallbackModel
+		res, err = c.complete(ctx, request(model, msgs, o), o.Continuations)
+	}
+	if err != nil {
+		return "", unavailable(err)
+	}
+	o.report(model)
+	o.reportUsage(Usage{Model: model, PromptTokens: res.Usage.PromptTokens, CompletionTokens: res.Usage.CompletionTokens})
+	return res.Content, nil
+}
+
+// completion is the outcome of complete: the (joined) reply, the finish
+// reason of its last part and the usage summed over all parts.
+type completion struct {
+	Content      string
+	FinishReason openai.FinishReason
+	Usage        openai.Usage
+}
+
+// complete runs a chat completion.  While the reply stops at the token
+// limit (finish reason "length") it is continued up to continuations times
+// by sending the partial reply back with continuePrompt, and the pieces are
+// concatenated.
+func (c *OpenAIClient) complete(ctx context.Context, req openai.ChatCompletionRequest, continuations int) (completion, error) {
+	var res completion
+	var reply strings.Builder
+	for i := 0; ; i++ {
+		resp, err := c.client.CreateChatCompletion(ctx, req)
+		if err != nil {
+			return completion{}, err
+		}
+		res.Usage.PromptTokens += resp.Usage.PromptTokens
+		res.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		if len(resp.Choices) == 0 {
+			res.Content = reply.String()
+			return res, nil
+		}
+		choice := resp.Choices[0]
+		reply.WriteString(choice.Message.Content)
+		if choice.FinishReason != openai.FinishReasonLength || i == continuations {
+			if choice.FinishReason == openai.FinishReasonLength {
+				log.Printf("llm: %s reply still truncated after %d continuations", req.Model, continuations)
+			}
+			res.Content, res.FinishReason = reply.String(), choice.FinishReason
+			return res, nil
+		}
+		req.Messages = append(req.Messages[:len(req.Messages):len(req.Messages)],
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: choice.Message.Content},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: continuePrompt})
+	}
+}
+
+// ChatStream is like Chat but streams the response, calling onChunk with
+// each content delta.  It only falls back when the chat model failed before
+// sending any part of the reply.
+func (c *OpenAIClient) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	if c.client == nil {
+		return "", errNotInitialized
+	}
+
+	o := NewOptions(opts...)
+	msgs := toOpenAI(messages)
+	model := c.chatModel
+	reply, started, err := c.stream(ctx, request(model, msgs, o), onChunk)
+	if err != nil && !started && c.fallback(ctx, err) {
+		model = c.fallbackModel
+		reply, _, err = c.stream(ctx, request(model, msgs, o), onChunk)
+	}
+	if err != nil {
+		return "", unavailable(err)
+	}
+	o.report(model)
+	// Streamed responses carry no usage, so it is estimated.
+	var prompt int
+	for _, m := range msgs {
+		prompt += EstimateTokens(m.Content)
+	}
+	o.reportUsage(Usage{Model: model, PromptTokens: prompt, CompletionTokens: EstimateTokens(reply), Estimated: true})
+	return reply, nil
+}
+
+// EstimateTokens roughly estimates the tokens in text.  Persian text runs at
+// about one token per three characters.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 2) / 3
+}
+
+// stream runs one streaming completion.  started reports whether any chunk
+// was passed to onChunk.
+func (c *OpenAIClient) stream(ctx context.Context, req openai.ChatCompletionRequest, onChunk func(string)) (reply string, started bool, err error) {
+	req.Stream = true
+	stream, err := c.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", false, err
 	}
+	defer stream.Close()
 
-	// Convert to OpenAI message type
+	var b strings.Builder
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return b.String(), b.Len() > 0, nil
+		}
+		if err != nil {
+			return "", b.Len() > 0, err
+		}
+		if len(resp.Choices) == 0 || resp.Choices[0].Delta.Content == "" {
+			continue
+		}
+		chunk := resp.Choices[0].Delta.Content
+		b.WriteString(chunk)
+		onChunk(chunk)
+	}
+}
+
+// fallback reports whether a chat call that failed with err should be
+// retried against the fallback model, and counts the activation.
+func (c *OpenAIClient) fallback(ctx context.Context, err error) bool {
+	if c.fallbackModel == "" || !retryable(ctx, err) {
+		return false
+	}
+	log.Printf("llm: chat model %s failed, falling back to %s: %v", c.chatModel, c.fallbackModel, err)
+	if c.OnFallback != nil {
+		c.OnFallback()
+	}
+	return true
+}
+
+// retryable reports whether err is worth retrying elsewhere: a provider
+// failure (see providerFailure) of a request that is still live.
+func retryable(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && providerFailure(err)
+}
+
+// providerFailure reports whether err says the provider is unhealthy: rate
+// limits, server errors, timeouts and network failures.  Authentication
+// and other request errors, such as a prompt over the context length or
+// refused by the content filter, are the request's fault, and a cancelled
+// request says nothing either way.
+func providerFailure(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return retryableStatus(apiErr.HTTPStatusCode)
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return retryableStatus(reqErr.HTTPStatusCode)
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// errNotInitialized is returned by the calls of an OpenAIClient not made
+// with NewOpenAIClient.
+var errNotInitialized = errs.New(errs.Unavailable, "openai client not initialized")
+
+// unavailable classifies a failed call to the provider: whatever the
+// cause, the model could not answer, so it is errs.Unavailable.
+func unavailable(err error) error {
+	return errs.Wrap(errs.Unavailable, err)
+}
+
+// RateLimited reports whether err is the provider refusing a call for the
+// rate limit.
+func RateLimited(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	var reqErr *openai.RequestError
+	return errors.As(err, &reqErr) && reqErr.HTTPStatusCode == http.StatusTooManyRequests
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// request builds a chat completion request with the call's options.
+func request(model string, messages []openai.ChatCompletionMessage, o Options) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model:       model,
+		Messages:    messages,
+		Temperature: o.Temperature,
+		MaxTokens:   o.MaxTokens,
+		TopP:        o.TopP,
+	}
+}
+
+// toOpenAI converts messages to the OpenAI message type.
+func toOpenAI(messages []Message) []openai.ChatCompletionMessage {
 	oaMsgs := make([]openai.ChatCompletionMessage, 0, len(messages))
 	for _, m := range messages {
 		role := m.Role
@@ -70,36 +351,93 @@ func (c *OpenAIClient) Chat(ctx context.Context, messages []Message) (string, er
 		}
 		oaMsgs = append(oaMsgs, openai.ChatCompletionMessage{Role: role, Content: m.Content})
 	}
+	return oaMsgs
+}
 
-	resp, err := c.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model:       c.chatModel,
-		Messages:    oaMsgs,
-		Temperature: 0.2,
-	})
+// Summarize generates a short summary of the prompt using the OpenAI API.
+// A summary cut off at the token limit is continued (see complete), since a
+// truncated summary is not valid JSON.
+func (c *OpenAIClient) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	o := NewOptions(opts...)
+	if o.Continuations < SummaryContinuations {
+		o.Continuations = SummaryContinuations
+	}
+	res, err := c.complete(ctx, request(c.summaryModel, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Summarize the following in Persian:"},
+		{Role: openai.ChatMessageRoleUser, Content: prompt},
+	}, o), o.Continuations)
+	if err != nil {
+		return "", unavailable(err)
+	}
+	o.report(c.summaryModel)
+	o.reportUsage(Usage{Model: c.summaryModel, PromptTokens: res.Usage.PromptTokens, CompletionTokens: res.Usage.CompletionTokens})
+	return res.Content, nil
+}
+
+// Moderate runs the text through the OpenAI moderation endpoint.
+func (c *OpenAIClient) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	resp, err := c.client.Moderations(ctx, openai.ModerationRequest{Input: text})
 	if err != nil {
-		return "", err
+		return ModerationResult{}, unavailable(err)
 	}
-	if len(resp.Choices) == 0 {
-		return "", nil
+	if len(resp.Results) == 0 || !resp.Results[0].Flagged {
+		return ModerationResult{}, nil
 	}
-	return resp.Choices[0].Message.Content, nil
+	return ModerationResult{Flagged: true, Category: moderationCategory(resp.Results[0].Categories)}, nil
 }
 
-// Summarize generates a short summary of the prompt using the OpenAI API.
-func (c *OpenAIClient) Summarize(ctx context.Context, prompt string) (string, error) {
-	resp, err := c.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model: c.summaryModel,
-		Messages: []openai.ChatCompletionMessage{
-			{Role: openai.ChatMessageRoleSystem, Content: "Summarize the following in Persian:"},
-			{Role: openai.ChatMessageRoleUser, Content: prompt},
-		},
-		Temperature: 0.2,
+// moderationCategory returns the most relevant of the flagged categories.
+// Self-harm, including its intent and instructions sub-categories, takes
+// precedence; text flagged for none of the known categories, such as one
+// the endpoint added since, is CategoryUnknown rather than clean.
+func moderationCategory(cats openai.ResultCategories) string {
+	switch {
+	case cats.SelfHarm, cats.SelfHarmIntent, cats.SelfHarmInstructions:
+		return CategorySelfHarm
+	case cats.Harassment, cats.HarassmentThreatening:
+		return CategoryHarassment
+	case cats.Hate, cats.HateThreatening:
+		return CategoryHate
+	case cats.Violence, cats.ViolenceGraphic:
+		return CategoryViolence
+	case cats.Sexual, cats.SexualMinors:
+		return CategorySexual
+	}
+	return CategoryUnknown
+}
+
+// Embed returns the embedding of text from the embeddings endpoint.
+func (c *OpenAIClient) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	resp, err := c.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: []string{text},
+		Model: openai.EmbeddingModel(c.embedModel),
 	})
 	if err != nil {
-		return "", err
+		return nil, unavailable(err)
+	}
+	if len(resp.Data) == 0 {
+		return nil, errs.New(errs.Unavailable, "openai: empty embedding response")
+	}
+	o := NewOptions(opts...)
+	o.report(c.embedModel)
+	o.reportUsage(Usage{Model: c.embedModel, PromptTokens: resp.Usage.PromptTokens})
+	return resp.Data[0].Embedding, nil
+}
+
+// Cosine returns the cosine similarity of two embeddings, or 0 when their
+// lengths differ or either is zero.
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
 	}
-	if len(resp.Choices) == 0 {
-		return "", nil
+	if na == 0 || nb == 0 {
+		return 0
 	}
-	return resp.Choices[0].Message.Content, nil
+	return dot / math.Sqrt(na*nb)
 }
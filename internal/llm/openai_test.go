@@ -0,0 +1,220 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// mockOpenAI is an OpenAI API answering chat completions with replies in
+// turn and recording the requests.
+type mockOpenAI struct {
+	mu       sync.Mutex
+	requests []openai.ChatCompletionRequest
+	replies  []openai.ChatCompletionResponse
+}
+
+// newMockOpenAI returns an OpenAIClient talking to a mockOpenAI answering
+// with replies.
+func newMockOpenAI(t *testing.T, replies ...openai.ChatCompletionResponse) (*OpenAIClient, *mockOpenAI) {
+	t.Helper()
+	m := &mockOpenAI{replies: replies}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.requests = append(m.requests, req)
+		if len(m.replies) == 0 {
+			m.mu.Unlock()
+			http.Error(w, `{"error":{"message":"no reply left"}}`, http.StatusInternalServerError)
+			return
+		}
+		resp := m.replies[0]
+		m.replies = m.replies[1:]
+		m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	config := openai.DefaultConfig("test-key")
+	config.BaseURL = srv.URL + "/v1"
+	return &OpenAIClient{client: openai.NewClientWithConfig(config), chatModel: "chat-model", summaryModel: "summary-model"}, m
+}
+
+// reply returns a completion of content stopping for reason.
+func reply(content string, reason openai.FinishReason) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}, FinishReason: reason}},
+		Usage:   openai.Usage{PromptTokens: 10, CompletionTokens: 5},
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	if o := NewOptions(); o.Temperature != DefaultTemperature || o.MaxTokens != 0 || o.TopP != 0 || o.Continuations != 0 {
+		t.Errorf("defaults %+v", o)
+	}
+	var model string
+	var usage Usage
+	o := NewOptions(WithTemperature(0.7), WithMaxTokens(300), WithTopP(0.9), WithContinuations(2), WithModelReport(&model), WithUsageReport(&usage))
+	if o.Temperature != 0.7 || o.MaxTokens != 300 || o.TopP != 0.9 || o.Continuations != 2 || o.Model != &model || o.Usage != &usage {
+		t.Errorf("options %+v", o)
+	}
+	// Later options win.
+	if o := NewOptions(WithTemperature(0.7), WithTemperature(0.1)); o.Temperature != 0.1 {
+		t.Errorf("temperature %v, want the last one", o.Temperature)
+	}
+}
+
+func TestOpenAIRequestOptions(t *testing.T) {
+	c, m := newMockOpenAI(t,
+		reply("سلام", openai.FinishReasonStop),
+		reply("سلام", openai.FinishReasonStop),
+		reply("{}", openai.FinishReasonStop))
+	ctx := context.Background()
+	if _, err := c.Chat(ctx, []Message{{Role: "user", Content: "سلام"}}); err != nil {
+		t.Fatal(err)
+	}
+	var model string
+	var usage Usage
+	if _, err := c.Chat(ctx, []Message{{Role: "user", Content: "سلام"}}, WithTemperature(0.8), WithMaxTokens(200), WithTopP(0.5), WithModelReport(&model), WithUsageReport(&usage)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Summarize(ctx, "خلاصه کن", WithTemperature(0.05)); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		model       string
+		temperature float32
+		maxTokens   int
+		topP        float32
+	}{
+		{"chat-model", DefaultTemperature, 0, 0},
+		{"chat-model", 0.8, 200, 0.5},
+		{"summary-model", 0.05, 0, 0},
+	}
+	if len(m.requests) != len(want) {
+		t.Fatalf("%d requests, want %d", len(m.requests), len(want))
+	}
+	for i, w := range want {
+		r := m.requests[i]
+		if r.Model != w.model || r.Temperature != w.temperature || r.MaxTokens != w.maxTokens || r.TopP != w.topP {
+			t.Errorf("request %d: %s temperature %v max_tokens %d top_p %v, want %+v", i, r.Model, r.Temperature, r.MaxTokens, r.TopP, w)
+		}
+	}
+	if model != "chat-model" || usage.PromptTokens != 10 || usage.CompletionTokens != 5 || usage.Estimated {
+		t.Errorf("reported model %q, usage %+v", model, usage)
+	}
+}
+
+func TestFakeClientRecordsOptions(t *testing.T) {
+	f := NewFakeClient("سلام")
+	ctx := context.Background()
+	if _, err := f.Chat(ctx, nil, WithTemperature(0.9)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Summarize(ctx, "x", WithMaxTokens(50)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.ChatOptions) != 1 || f.ChatOptions[0].Temperature != 0.9 {
+		t.Errorf("chat options %+v", f.ChatOptions)
+	}
+	if len(f.SummarizeOptions) != 1 || f.SummarizeOptions[0].MaxTokens != 50 || f.SummarizeOptions[0].Temperature != DefaultTemperature {
+		t.Errorf("summarize options %+v", f.SummarizeOptions)
+	}
+}
+
+func TestSummarizeContinuesTruncatedReply(t *testing.T) {
+	c, m := newMockOpenAI(t,
+		reply(`{"key_points":["سر`, openai.FinishReasonLength),
+		reply(`درد"],"free_text":`, openai.FinishReasonLength),
+		reply(`"بیمار سردرد دارد."}`, openai.FinishReasonStop))
+	var usage Usage
+	got, err := c.Summarize(context.Background(), "خلاصه کن", WithUsageReport(&usage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key_points":["سردرد"],"free_text":"بیمار سردرد دارد."}`; got != want {
+		t.Errorf("summary %s, want %s", got, want)
+	}
+	if len(m.requests) != 3 {
+		t.Fatalf("%d requests, want 3", len(m.requests))
+	}
+	// Each continuation sends the part so far back and asks for the rest.
+	last := m.requests[2].Messages
+	if len(last) != 6 {
+		t.Fatalf("%d messages in the last request, want 6", len(last))
+	}
+	for i, want := range []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleAssistant, Content: `{"key_points":["سر`},
+		{Role: openai.ChatMessageRoleUser, Content: continuePrompt},
+		{Role: openai.ChatMessageRoleAssistant, Content: `درد"],"free_text":`},
+		{Role: openai.ChatMessageRoleUser, Content: continuePrompt},
+	} {
+		if got := last[i+2]; got.Role != want.Role || got.Content != want.Content {
+			t.Errorf("message %d: %s %q, want %s %q", i+2, got.Role, got.Content, want.Role, want.Content)
+		}
+	}
+	if usage.PromptTokens != 30 || usage.CompletionTokens != 15 {
+		t.Errorf("usage %+v, want the sum over the parts", usage)
+	}
+}
+
+func TestContinuationsBounded(t *testing.T) {
+	c, m := newMockOpenAI(t,
+		reply("یک ", openai.FinishReasonLength),
+		reply("دو ", openai.FinishReasonLength),
+		reply("سه ", openai.FinishReasonLength),
+		reply("چهار", openai.FinishReasonStop))
+	got, err := c.Summarize(context.Background(), "خلاصه کن")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "یک دو سه " || len(m.requests) != SummaryContinuations+1 {
+		t.Errorf("summary %q after %d requests, want %d continuations", got, len(m.requests), SummaryContinuations)
+	}
+}
+
+func TestChatContinuationsOptIn(t *testing.T) {
+	c, m := newMockOpenAI(t,
+		reply("از کی", openai.FinishReasonLength),
+		reply("از کی", openai.FinishReasonLength),
+		reply(" این درد را دارید؟", openai.FinishReasonStop))
+	ctx := context.Background()
+	msgs := []Message{{Role: "user", Content: "سردرد دارم"}}
+	// Chat replies are not continued unless asked to.
+	if got, err := c.Chat(ctx, msgs); err != nil || got != "از کی" || len(m.requests) != 1 {
+		t.Fatalf("chat %q, %v after %d requests; want the cut reply", got, err, len(m.requests))
+	}
+	if got, err := c.Chat(ctx, msgs, WithContinuations(1)); err != nil || got != "از کی این درد را دارید؟" {
+		t.Errorf("chat %q, %v; want the continued reply", got, err)
+	}
+}
+
+func TestModerationCategory(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cats openai.ResultCategories
+		want string
+	}{
+		{"harassment only", openai.ResultCategories{Harassment: true}, CategoryHarassment},
+		{"threatening harassment", openai.ResultCategories{HarassmentThreatening: true}, CategoryHarassment},
+		{"hate", openai.ResultCategories{Hate: true}, CategoryHate},
+		{"self-harm intent", openai.ResultCategories{SelfHarmIntent: true}, CategorySelfHarm},
+		{"self-harm instructions", openai.ResultCategories{SelfHarmInstructions: true}, CategorySelfHarm},
+		{"self-harm before harassment", openai.ResultCategories{SelfHarm: true, Harassment: true}, CategorySelfHarm},
+		{"violence", openai.ResultCategories{ViolenceGraphic: true}, CategoryViolence},
+		{"none recognised", openai.ResultCategories{}, CategoryUnknown},
+	} {
+		if got := moderationCategory(tc.cats); got != tc.want {
+			t.Errorf("%s: category %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package llm
+
+// DefaultTemperature is the sampling temperature used when a call sets
+// none.
+const DefaultTemperature = 0.2
+
+// Options are the model parameters of a single call.  Zero MaxTokens and
+// TopP leave the provider's defaults in place.  The OpenAI API treats a
+// zero temperature as unset, so the lowest effective value is just above 0.
+type Options struct {
+	Temperature float32
+	MaxTokens   int
+	TopP        float32
+	// Continuations is how many times a reply cut off at the token limit is
+	// continued; see WithContinuations.
+	Continuations int
+	// Model, when set, receives the name of the model that produced the
+	// reply (see WithModelReport).
+	Model *string
+	// Usage, when set, receives the tokens the call consumed (see
+	// WithUsageReport).
+	Usage *Usage
+}
+
+// Usage is the token consumption of one call.  Model is the model that
+// answered.  Estimated is set when the provider did not report the counts
+// (e.g. streamed replies) and they were estimated from the text.
+type Usage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Estimated        bool
+}
+
+// Option sets a model parameter for one Chat, ChatStream or Summarize call.
+type Option func(*Options)
+
+// WithTemperature sets the sampling temperature.
+func WithTemperature(t float32) Option {
+	return func(o *Options) { o.Temperature = t }
+}
+
+// WithMaxTokens caps the number of tokens in the reply.
+func WithMaxTokens(n int) Option {
+	return func(o *Options) { o.MaxTokens = n }
+}
+
+// WithTopP sets nucleus sampling.
+func WithTopP(p float32) Option {
+	return func(o *Options) { o.TopP = p }
+}
+
+// WithContinuations lets a chat reply that stops at the token limit be
+// continued up to n times, the pieces being joined into one reply.
+// Summaries are always continued (see SummaryContinuations).  Streaming
+// replies are not continued.
+func WithContinuations(n int) Option {
+	return func(o *Options) { o.Continuations = n }
+}
+
+// WithModelReport makes the client store the name of the model that
+// produced the reply in *dst, so callers can record it with the message.  It
+// differs from the configured chat model after a fallback.
+func WithModelReport(dst *string) Option {
+	return func(o *Options) { o.Model = dst }
+}
+
+// WithUsageReport makes the client store the call's token usage in *dst.
+func WithUsageReport(dst *Usage) Option {
+	return func(o *Options) { o.Usage = dst }
+}
+
+// report stores the answering model for WithModelReport.
+func (o Options) report(model string) {
+	if o.Model != nil {
+		*o.Model = model
+	}
+}
+
+// NewOptions applies opts to the defaults.
+func NewOptions(opts ...Option) Options {
+	o := Options{Temperature: DefaultTemperature}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// reportUsage stores the call's usage for WithUsageReport.
+func (o Options) reportUsage(u Usage) {
+	if o.Usage != nil {
+		*o.Usage = u
+	}
+}
@@ -0,0 +1,59 @@
+package llm
+
+import "context"
+
+// Reporter is a Client that passes every call on to the wrapped client and
+// reports its outcome, e.g. to the status page: chat and moderation calls
+// to OnChat, summaries and embeddings to OnSummarize.  Either may be nil.
+type Reporter struct {
+	Client      Client
+	OnChat      func(error)
+	OnSummarize func(error)
+}
+
+// NewReporter wraps client with a Reporter.
+func NewReporter(client Client, onChat, onSummarize func(error)) *Reporter {
+	return &Reporter{Client: client, OnChat: onChat, OnSummarize: onSummarize}
+}
+
+func report(fn func(error), err error) {
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// Chat calls the wrapped client.
+func (r *Reporter) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	reply, err := r.Client.Chat(ctx, messages, opts...)
+	report(r.OnChat, err)
+	return reply, err
+}
+
+// ChatStream streams from the wrapped client.  Clients that cannot stream
+// deliver the whole reply as one chunk.
+func (r *Reporter) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	reply, err := ChatStream(ctx, r.Client, messages, onChunk, opts...)
+	report(r.OnChat, err)
+	return reply, err
+}
+
+// Summarize calls the wrapped client.
+func (r *Reporter) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	resp, err := r.Client.Summarize(ctx, prompt, opts...)
+	report(r.OnSummarize, err)
+	return resp, err
+}
+
+// Moderate calls the wrapped client.
+func (r *Reporter) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	res, err := r.Client.Moderate(ctx, text)
+	report(r.OnChat, err)
+	return res, err
+}
+
+// Embed calls the wrapped client.
+func (r *Reporter) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	v, err := r.Client.Embed(ctx, text, opts...)
+	report(r.OnSummarize, err)
+	return v, err
+}
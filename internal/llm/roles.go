@@ -0,0 +1,39 @@
+package llm
+
+import "context"
+
+// Roles is a Client that sends each call to the client serving its role:
+// chat and moderation calls to ForChat, summaries and embeddings to
+// ForSummary.  Embeddings go with the summaries because the embeddings
+// stored with summaries for recall only compare with those of the same
+// model.
+type Roles struct {
+	ForChat    Client
+	ForSummary Client
+}
+
+// Chat calls the chat client.
+func (r Roles) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	return r.ForChat.Chat(ctx, messages, opts...)
+}
+
+// ChatStream streams from the chat client.  Clients that cannot stream
+// deliver the whole reply as one chunk.
+func (r Roles) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	return ChatStream(ctx, r.ForChat, messages, onChunk, opts...)
+}
+
+// Summarize calls the summary client.
+func (r Roles) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	return r.ForSummary.Summarize(ctx, prompt, opts...)
+}
+
+// Moderate calls the chat client.
+func (r Roles) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	return r.ForChat.Moderate(ctx, text)
+}
+
+// Embed calls the summary client.
+func (r Roles) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	return r.ForSummary.Embed(ctx, text, opts...)
+}
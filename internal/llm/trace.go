@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"waitroom-chatbot/internal/redact"
+	"waitroom-chatbot/pkg"
+)
+
+// TraceStore persists traced calls.
+type TraceStore interface {
+	InsertLLMTrace(ctx context.Context, t *pkg.LLMTrace) error
+}
+
+// traceStoreTimeout bounds storing a trace.
+const traceStoreTimeout = 10 * time.Second
+
+type traceKey struct{}
+
+// WithTrace returns a context whose chat and summary calls a Tracer records
+// for the session.
+func WithTrace(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, traceKey{}, sessionID)
+}
+
+// traceSession returns the session stored by WithTrace, or "".
+func traceSession(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// Tracer is a Client that stores the chat and summary calls made with a
+// context from WithTrace: the messages sent, the raw response, the model
+// and the latency.  Like DebugLog it masks the national IDs, phone numbers
+// and names of the call's redact.Redactor first.  Other calls, and calls
+// without a traced session, are passed on untouched.
+type Tracer struct {
+	Client Client
+	Store  TraceStore
+}
+
+// NewTracer wraps client, storing traces in store.
+func NewTracer(client Client, store TraceStore) *Tracer {
+	return &Tracer{Client: client, Store: store}
+}
+
+// record redacts and stores a trace.  Failures are logged but never fail
+// the call.
+func (t *Tracer) record(ctx context.Context, tr pkg.LLMTrace, messages []Message, start time.Time, err error) {
+	r := redact.FromContext(ctx)
+	tr.LatencyMS = time.Since(start).Milliseconds()
+	for _, m := range messages {
+		tr.Messages = append(tr.Messages, pkg.TraceMessage{Role: m.Role, Content: r.Redact(m.Content)})
+	}
+	tr.Response = r.Redact(tr.Response)
+	if err != nil {
+		tr.Error = r.Redact(err.Error())
+	}
+	// The call's context may have ended, e.g. on a timeout, which is worth
+	// a trace too.
+	ctx, cancel := context.WithTimeout(context.Background(), traceStoreTimeout)
+	defer cancel()
+	if err := t.Store.InsertLLMTrace(ctx, &tr); err != nil {
+		log.Printf("store LLM trace for session %s: %v", tr.SessionID, err)
+	}
+}
+
+// Chat calls the wrapped client and traces the exchange.
+func (t *Tracer) Chat(ctx context.Context, messages []Message, opts ...Option) (string, error) {
+	sessionID := traceSession(ctx)
+	if sessionID == "" {
+		return t.Client.Chat(ctx, messages, opts...)
+	}
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	reply, err := t.Client.Chat(ctx, messages, opts...)
+	done()
+	t.record(ctx, pkg.LLMTrace{SessionID: sessionID, Call: "chat", Model: model, Response: reply}, messages, start, err)
+	return reply, err
+}
+
+// ChatStream streams from the wrapped client and traces the complete reply.
+func (t *Tracer) ChatStream(ctx context.Context, messages []Message, onChunk func(string), opts ...Option) (string, error) {
+	sessionID := traceSession(ctx)
+	if sessionID == "" {
+		return ChatStream(ctx, t.Client, messages, onChunk, opts...)
+	}
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	reply, err := ChatStream(ctx, t.Client, messages, onChunk, opts...)
+	done()
+	t.record(ctx, pkg.LLMTrace{SessionID: sessionID, Call: "chat_stream", Model: model, Response: reply}, messages, start, err)
+	return reply, err
+}
+
+// Summarize calls the wrapped client and traces the exchange, the prompt
+// being recorded as a single user message.
+func (t *Tracer) Summarize(ctx context.Context, prompt string, opts ...Option) (string, error) {
+	sessionID := traceSession(ctx)
+	if sessionID == "" {
+		return t.Client.Summarize(ctx, prompt, opts...)
+	}
+	var model string
+	opts, done := withModel(opts, &model)
+	start := time.Now()
+	resp, err := t.Client.Summarize(ctx, prompt, opts...)
+	done()
+	t.record(ctx, pkg.LLMTrace{SessionID: sessionID, Call: "summarize", Model: model, Response: resp},
+		[]Message{{Role: "user", Content: prompt}}, start, err)
+	return resp, err
+}
+
+// Moderate calls the wrapped client.
+func (t *Tracer) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	return t.Client.Moderate(ctx, text)
+}
+
+// Embed calls the wrapped client.
+func (t *Tracer) Embed(ctx context.Context, text string, opts ...Option) ([]float32, error) {
+	return t.Client.Embed(ctx, text, opts...)
+}
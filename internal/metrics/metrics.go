@@ -0,0 +1,230 @@
+// Package metrics is a small dependency-free registry that renders counters,
+// gauges and histograms in the Prometheus text exposition format for GET
+// /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metrics exposed by the server.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.metrics[name] = m
+}
+
+// Write renders every metric sorted by name.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make(map[string]metric, len(r.metrics))
+	for k, v := range r.metrics {
+		metrics[k] = v
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		metrics[name].write(w, name)
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	help  string
+	value uint64
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{help: help}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the counter.  A nil counter is a no-op so optional
+// metrics do not need guarding at call sites.
+func (c *Counter) Inc() {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, c.help, name, name, c.Value())
+}
+
+// GaugeFunc reports the value returned by a callback at scrape time.
+type GaugeFunc struct {
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge computed on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &GaugeFunc{help: help, fn: fn})
+}
+
+func (g *GaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, g.help, name, name, formatFloat(g.fn()))
+}
+
+// GaugeVecFunc reports a family of gauges, told apart by the value of one
+// label, computed by a callback at scrape time.
+type GaugeVecFunc struct {
+	help  string
+	label string
+	fn    func() map[string]float64
+}
+
+// NewGaugeVecFunc registers a gauge family computed on every scrape; fn
+// returns the value of each label value.
+func (r *Registry) NewGaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	r.register(name, &GaugeVecFunc{help: help, label: label, fn: fn})
+}
+
+func (g *GaugeVecFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, g.help, name)
+	series := g.fn()
+	values := make([]string, 0, len(series))
+	for v := range series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", name, g.label, strconv.Quote(v), formatFloat(series[v]))
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// HistogramVec is a family of histograms told apart by the value of one
+// label, such as the name of a query.
+type HistogramVec struct {
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+// NewHistogramVec registers a histogram family with the given upper bucket
+// bounds, in increasing order.
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+	r.register(name, h)
+	return h
+}
+
+// Observe records v in the histogram of the label value.  A nil
+// HistogramVec is a no-op.
+func (h *HistogramVec) Observe(value string, v float64) {
+	if h == nil {
+		return
+	}
+	s := h.get(value)
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&s.counts[i], 1)
+	atomic.AddUint64(&s.count, 1)
+	for {
+		old := atomic.LoadUint64(&s.sum)
+		if atomic.CompareAndSwapUint64(&s.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Init creates the histograms of the label values, so that they are
+// exported, empty, before their first observation.
+func (h *HistogramVec) Init(values ...string) {
+	for _, v := range values {
+		h.get(v)
+	}
+}
+
+func (h *HistogramVec) get(value string) *histogram {
+	h.mu.RLock()
+	s, ok := h.series[value]
+	h.mu.RUnlock()
+	if ok {
+		return s
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok = h.series[value]; !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[value] = s
+	}
+	return s
+}
+
+func (h *HistogramVec) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+	h.mu.RLock()
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	h.mu.RUnlock()
+	sort.Strings(values)
+	for _, v := range values {
+		s := h.get(v)
+		label := h.label + "=" + strconv.Quote(v)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&s.counts[i])
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, label, formatFloat(bound), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&s.counts[len(h.buckets)])
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, label, cumulative)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, label, formatFloat(math.Float64frombits(atomic.LoadUint64(&s.sum))))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, label, atomic.LoadUint64(&s.count))
+	}
+}
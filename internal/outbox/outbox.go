@@ -0,0 +1,99 @@
+// Package outbox publishes the session events recorded in the database's
+// events table.  Writers record an event in the same transaction as the
+// change it describes; a background Dispatcher then notifies the doctor
+// dashboard and hands the event to handlers such as webhooks, and marks it
+// published.  An event is published at least once: one whose dispatcher
+// dies before marking it is published again once its lease runs out.
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// Store claims and marks events.
+type Store interface {
+	ClaimUnpublishedEvents(ctx context.Context, limit int, lease time.Duration) ([]pkg.Event, error)
+	MarkEventPublished(ctx context.Context, id int64) error
+}
+
+// Notifier tells listeners that a session changed; db.Broker implements it.
+type Notifier interface {
+	Notify(ctx context.Context, sessionID string) error
+}
+
+// Dispatcher publishes unpublished events.
+type Dispatcher struct {
+	Store    Store
+	Notifier Notifier
+	// Handle, when set, is called with every event after the notification
+	// and before it is marked published, e.g. to queue webhook deliveries.  An error leaves the
+	// event to be published again after Lease.
+	Handle func(ctx context.Context, e pkg.Event) error
+	// PollInterval is how often unpublished events are looked for, and
+	// Lease how long a claimed event is left to this dispatcher.
+	PollInterval time.Duration
+	Lease        time.Duration
+}
+
+// NewDispatcher constructs a Dispatcher polling every second.
+func NewDispatcher(store Store, notifier Notifier) *Dispatcher {
+	return &Dispatcher{
+		Store:        store,
+		Notifier:     notifier,
+		PollInterval: time.Second,
+		Lease:        time.Minute,
+	}
+}
+
+// Run publishes events until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		d.publishDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishDue publishes one batch of events in ID order.  It stops at the
+// first event that fails, so later events of the same session are not
+// published ahead of it.
+func (d *Dispatcher) publishDue(ctx context.Context) {
+	events, err := d.Store.ClaimUnpublishedEvents(ctx, 50, d.Lease)
+	if err != nil {
+		log.Printf("outbox: claim events: %v", err)
+		return
+	}
+	for _, e := range events {
+		if err := d.publish(ctx, e); err != nil {
+			log.Printf("outbox: publish event %d (%s of %s): %v", e.ID, e.Kind, e.SessionID, err)
+			return
+		}
+		if err := d.Store.MarkEventPublished(ctx, e.ID); err != nil {
+			log.Printf("outbox: mark event %d published: %v", e.ID, err)
+			return
+		}
+	}
+}
+
+// publish notifies the dashboard of an event, then hands it to Handle.  A
+// notification is cheap to repeat, so it goes first.
+func (d *Dispatcher) publish(ctx context.Context, e pkg.Event) error {
+	if d.Notifier != nil {
+		if err := d.Notifier.Notify(ctx, e.SessionID); err != nil {
+			return err
+		}
+	}
+	if d.Handle != nil {
+		return d.Handle(ctx, e)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package pii encrypts patient identifying fields before they are stored.
+// Values are sealed with AES-256-GCM; national IDs additionally get a
+// deterministic HMAC-SHA256 so sessions can still be looked up by them.
+//
+// A nil *Cipher disables encryption: Encrypt and Decrypt return their input
+// unchanged and Hash returns "", which keeps development setups simple.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// prefix marks encrypted values so plaintext rows written before encryption
+// was enabled can still be read.
+const prefix = "enc:v1:"
+
+// Cipher encrypts and hashes PII with keys derived from a master key.
+type Cipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// New derives the encryption and HMAC keys from a master key.  The key may
+// be given as 64 hex characters or as base64 and must decode to 32 bytes.
+func New(key string) (*Cipher, error) {
+	master, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derive(master, "pii-encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead, macKey: derive(master, "pii-lookup")}, nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	key = strings.TrimSpace(key)
+	if b, err := hex.DecodeString(key); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(key); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("pii: key must be 32 bytes encoded as hex or base64")
+}
+
+func derive(master []byte, label string) []byte {
+	m := hmac.New(sha256.New, master)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// Enabled reports whether encryption is configured.
+func (c *Cipher) Enabled() bool { return c != nil }
+
+// Encrypt seals a value.  Empty strings are left empty so optional fields
+// stay distinguishable from filled ones.
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt.  Values without the encryption
+// prefix are returned unchanged.
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("pii: encrypted value but no key configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil {
+		return "", fmt.Errorf("pii: decode: %w", err)
+	}
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("pii: ciphertext too short")
+	}
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("pii: open: %w", err)
+	}
+	return string(plain), nil
+}
+
+// DecryptPtr decrypts an optional value in place.
+func (c *Cipher) DecryptPtr(value *string) error {
+	if value == nil {
+		return nil
+	}
+	plain, err := c.Decrypt(*value)
+	if err != nil {
+		return err
+	}
+	*value = plain
+	return nil
+}
+
+// Hash returns the deterministic lookup hash of a value, or "" when
+// encryption is disabled.
+func (c *Cipher) Hash(value string) string {
+	if c == nil {
+		return ""
+	}
+	m := hmac.New(sha256.New, c.macKey)
+	m.Write([]byte(value))
+	return hex.EncodeToString(m.Sum(nil))
+}
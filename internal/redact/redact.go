@@ -0,0 +1,249 @@
+// Package redact masks patient identifiers in free text before it leaves
+// the clinical record, e.g. in debug logs, exports or audit trails.
+//
+// Ten-digit national IDs and Iranian phone numbers are recognised in Latin,
+// Persian and Arabic-Indic digits, also when written in groups ("0912 345
+// 6789").  Patient names are not recognisable by shape, so a Redactor is
+// given the names known for the session and masks them, and each of their
+// words, wherever they appear.
+package redact
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Placeholders that replace masked values.
+const (
+	NationalIDMask = "[national-id]"
+	PhoneMask      = "[phone]"
+	NameMask       = "[name]"
+)
+
+// minNameWord is the shortest name word masked on its own; shorter words
+// ("ا", initials) would mask ordinary text.
+const minNameWord = 2
+
+// Redactor masks identifiers and a set of known names.  A nil *Redactor
+// masks identifiers only.
+type Redactor struct {
+	// names holds the folded names and their words, longest first.
+	names [][]rune
+}
+
+// New returns a Redactor that also masks names, e.g. the patient's name as
+// given at session start.  Empty names are ignored.
+func New(names ...string) *Redactor {
+	seen := map[string]bool{}
+	r := &Redactor{}
+	add := func(s string) {
+		if len([]rune(s)) < minNameWord || seen[s] {
+			return
+		}
+		seen[s] = true
+		r.names = append(r.names, []rune(s))
+	}
+	for _, name := range names {
+		folded := strings.Join(strings.Fields(string(fold([]rune(name)))), " ")
+		add(folded)
+		for _, word := range strings.Fields(folded) {
+			add(word)
+		}
+	}
+	sort.SliceStable(r.names, func(i, j int) bool { return len(r.names[i]) > len(r.names[j]) })
+	return r
+}
+
+// String masks national IDs and phone numbers in s.
+func String(s string) string {
+	return (*Redactor)(nil).Redact(s)
+}
+
+// Redact masks national IDs, phone numbers and the Redactor's names in s.
+func (r *Redactor) Redact(s string) string {
+	text := []rune(s)
+	masks := make([]string, len(text)) // mask starting at each rune
+	masked := make([]bool, len(text))
+	mark := func(start, end int, mask string) {
+		masks[start] = mask
+		for i := start; i < end; i++ {
+			masked[i] = true
+		}
+	}
+	maskNumbers(text, mark)
+	if r != nil && len(r.names) > 0 {
+		r.maskNames(text, masked, mark)
+	}
+	var b strings.Builder
+	for i, c := range text {
+		switch {
+		case masks[i] != "":
+			b.WriteString(masks[i])
+		case !masked[i]:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// maskNames marks every occurrence of a name that starts and ends at a word
+// boundary and does not overlap an earlier mask.
+func (r *Redactor) maskNames(text []rune, masked []bool, mark func(start, end int, mask string)) {
+	folded := fold(text)
+	for _, name := range r.names {
+		for i := 0; i+len(name) <= len(folded); i++ {
+			end := i + len(name)
+			if !boundary(folded, i-1) || !boundary(folded, end) || !equal(folded[i:end], name) || anyMasked(masked[i:end]) {
+				continue
+			}
+			mark(i, end, NameMask)
+			i = end - 1
+		}
+	}
+}
+
+// maskNumbers marks national IDs and phone numbers.  A number is a run of
+// digit groups separated by single spaces or hyphens, optionally preceded
+// by "+".  The whole run is tried first so grouped numbers are found; when
+// it is not an identifier each group is tried on its own, so an ID next to
+// an unrelated number is still caught.
+func maskNumbers(text []rune, mark func(start, end int, mask string)) {
+	for i := 0; i < len(text); i++ {
+		if digit(text[i]) < 0 {
+			continue
+		}
+		start := i
+		if start > 0 && text[start-1] == '+' {
+			start--
+		}
+		var groups [][2]int // rune ranges of the digit groups
+		for {
+			g := i
+			for i < len(text) && digit(text[i]) >= 0 {
+				i++
+			}
+			groups = append(groups, [2]int{g, i})
+			if i+1 < len(text) && (text[i] == ' ' || text[i] == '-') && digit(text[i+1]) >= 0 {
+				i++
+				continue
+			}
+			break
+		}
+		if mask := classify(digits(text, groups), text[start] == '+'); mask != "" {
+			mark(start, i, mask)
+		} else if len(groups) > 1 {
+			for _, g := range groups {
+				if mask := classify(digits(text, [][2]int{g}), false); mask != "" {
+					mark(g[0], g[1], mask)
+				}
+			}
+		}
+		i--
+	}
+}
+
+// classify reports which mask, if any, applies to a number given as ASCII
+// digits.
+func classify(n string, plus bool) string {
+	switch {
+	case plus && strings.HasPrefix(n, "98") && len(n) >= 12 && len(n) <= 13:
+		return PhoneMask
+	case strings.HasPrefix(n, "0098") && len(n) >= 14 && len(n) <= 15:
+		return PhoneMask
+	case strings.HasPrefix(n, "989") && len(n) == 12:
+		return PhoneMask
+	case strings.HasPrefix(n, "0") && len(n) == 11:
+		return PhoneMask // mobile (09…) or landline with area code
+	case len(n) == 10 && strings.HasPrefix(n, "9"):
+		return PhoneMask // mobile without the leading zero
+	case len(n) == 10:
+		return NationalIDMask
+	}
+	return ""
+}
+
+// digits returns the ASCII digits of the given groups.
+func digits(text []rune, groups [][2]int) string {
+	var b strings.Builder
+	for _, g := range groups {
+		for _, c := range text[g[0]:g[1]] {
+			b.WriteByte(byte('0' + digit(c)))
+		}
+	}
+	return b.String()
+}
+
+// digit returns the value of a Latin, Persian or Arabic-Indic digit, or -1.
+func digit(c rune) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= '۰' && c <= '۹':
+		return int(c - '۰')
+	case c >= '٠' && c <= '٩':
+		return int(c - '٠')
+	}
+	return -1
+}
+
+// fold maps each rune to a canonical form for name matching: Arabic yeh and
+// kaf become their Persian forms, the zero-width non-joiner becomes a space
+// and letters are lowercased.  The result has the same length as text.
+func fold(text []rune) []rune {
+	out := make([]rune, len(text))
+	for i, c := range text {
+		switch c {
+		case 'ي', 'ى':
+			c = 'ی'
+		case 'ك':
+			c = 'ک'
+		case '\u200c':
+			c = ' '
+		}
+		out[i] = unicode.ToLower(c)
+	}
+	return out
+}
+
+// boundary reports whether position i is outside a word: before the start,
+// past the end, or at a rune that is neither a letter nor a mark.
+func boundary(text []rune, i int) bool {
+	if i < 0 || i >= len(text) {
+		return true
+	}
+	return !unicode.IsLetter(text[i]) && !unicode.IsMark(text[i])
+}
+
+func equal(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func anyMasked(masked []bool) bool {
+	for _, m := range masked {
+		if m {
+			return true
+		}
+	}
+	return false
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying r, so code far from the session
+// (such as an LLM client) can mask the patient's name.
+func NewContext(ctx context.Context, r *Redactor) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns the Redactor stored by NewContext, or nil.
+func FromContext(ctx context.Context) *Redactor {
+	r, _ := ctx.Value(ctxKey{}).(*Redactor)
+	return r
+}
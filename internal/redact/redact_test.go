@@ -0,0 +1,80 @@
+package redact
+
+import (
+	"context"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"کد ملی من 0012345678 است", "کد ملی من [national-id] است"},
+		{"کد ملی من ۰۰۱۲۳۴۵۶۷۸ است", "کد ملی من [national-id] است"},
+		{"کد ملی من ٠٠١٢٣٤٥٦٧٨ است", "کد ملی من [national-id] است"},
+		{"شماره‌ام 09123456789 است", "شماره‌ام [phone] است"},
+		{"شماره‌ام ۰۹۱۲ ۳۴۵ ۶۷۸۹ است", "شماره‌ام [phone] است"},
+		{"شماره‌ام 0912-345-6789 است", "شماره‌ام [phone] است"},
+		{"call +98 912 345 6789", "call [phone]"},
+		{"call 00989123456789", "call [phone]"},
+		{"call 989123456789", "call [phone]"},
+		{"mobile 9123456789", "mobile [phone]"},
+		{"landline 02112345678", "landline [phone]"},
+		// Numbers that are not identifiers are kept.
+		{"فشار 120 روی 80، ۳ روز", "فشار 120 روی 80، ۳ روز"},
+		{"123456789", "123456789"},
+		{"12345678901", "12345678901"},
+		// An ID next to an unrelated number is still caught.
+		{"12 0012345678", "12 [national-id]"},
+		{"0012345678 و 09123456789", "[national-id] و [phone]"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactNames(t *testing.T) {
+	r := New("سارا محمدی", "Sara", "", "ا")
+	tests := []struct{ in, want string }{
+		{"سارا محمدی هستم", "[name] هستم"},
+		{"من سارا هستم", "من [name] هستم"},
+		{"خانم محمدی", "خانم [name]"},
+		{"Hi SARA", "Hi [name]"},
+		// The zero-width non-joiner separates words like a space.
+		{"سارا‌محمدی", "[name]"},
+		// Only whole words are names.
+		{"سارایی", "سارایی"},
+		{"Sarah", "Sarah"},
+		// Single letters are not masked on their own.
+		{"ا ب", "ا ب"},
+		{"سارا 0012345678", "[name] [national-id]"},
+	}
+	for _, tt := range tests {
+		if got := r.Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	// Arabic letters in the name match Persian ones in the text.
+	if got := New("علي").Redact("علی آمد"); got != "[name] آمد" {
+		t.Errorf("Arabic yeh in the name: %q", got)
+	}
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *Redactor
+	if got := r.Redact("سارا 0012345678"); got != "سارا [national-id]" {
+		t.Errorf("nil redactor: %q", got)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if FromContext(ctx) != nil {
+		t.Errorf("redactor in an empty context")
+	}
+	r := New("سارا")
+	if got := FromContext(NewContext(ctx, r)); got != r {
+		t.Errorf("FromContext = %p, want %p", got, r)
+	}
+}
@@ -0,0 +1,164 @@
+// Package status tracks whether the services patients depend on are
+// working, from the outcomes of recent calls to them, so reception staff
+// can tell from GET /status whether "the bot is down" and monitoring can
+// alert on the same levels through /metrics.
+package status
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Level is how a component is doing.
+type Level int
+
+const (
+	// Green: the last call succeeded and none failed recently.
+	Green Level = iota
+	// Yellow: calls failed recently, but not RedAfter in a row up to now.
+	Yellow
+	// Red: the last RedAfter calls failed, or the component reports itself
+	// down (see Tracker.Watch).
+	Red
+)
+
+func (l Level) String() string {
+	switch l {
+	case Yellow:
+		return "yellow"
+	case Red:
+		return "red"
+	default:
+		return "green"
+	}
+}
+
+// Components shown on the status page, in the order they are listed.
+const (
+	Chat      = "chat"
+	Database  = "database"
+	Summaries = "summaries"
+)
+
+// Components lists the tracked components in display order.
+var Components = []string{Chat, Database, Summaries}
+
+// Status is the state of one component.
+type Status struct {
+	Name  string
+	Level Level
+	// LastError is when a call last failed, zero if none has.
+	LastError time.Time
+}
+
+// Tracker records call outcomes per component.  It is safe for concurrent
+// use.
+type Tracker struct {
+	// RedAfter is the number of consecutive failures that turn a component
+	// red, and Recent how long a failure keeps it at least yellow.
+	RedAfter int
+	Recent   time.Duration
+
+	mu         sync.Mutex
+	components map[string]*component
+	now        func() time.Time
+}
+
+type component struct {
+	failures  int
+	lastError time.Time
+	down      func() bool
+}
+
+// NewTracker returns a Tracker turning a component red after three
+// failures in a row and keeping it yellow for ten minutes after a failure.
+func NewTracker() *Tracker {
+	t := &Tracker{RedAfter: 3, Recent: 10 * time.Minute, components: make(map[string]*component), now: time.Now}
+	for _, name := range Components {
+		t.components[name] = &component{}
+	}
+	return t
+}
+
+// Record records the outcome of a call to a component.  Calls cancelled
+// by their caller say nothing about the component and are ignored.  A nil
+// Tracker records nothing.
+func (t *Tracker) Record(name string, err error) {
+	if t == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.get(name)
+	if err == nil {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastError = t.now()
+}
+
+// Watch makes a component red whenever down reports true, e.g. while a
+// circuit breaker is open.
+func (t *Tracker) Watch(name string, down func() bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(name).down = down
+}
+
+// get returns the named component, adding it if new.  t.mu must be held.
+func (t *Tracker) get(name string) *component {
+	c, ok := t.components[name]
+	if !ok {
+		c = &component{}
+		t.components[name] = c
+	}
+	return c
+}
+
+// Snapshot returns the state of every component in Components order.
+func (t *Tracker) Snapshot() []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]Status, 0, len(Components))
+	for _, name := range Components {
+		c := t.components[name]
+		s := Status{Name: name, LastError: c.lastError}
+		switch {
+		case c.failures >= t.RedAfter || c.down != nil && c.down():
+			s.Level = Red
+		case !c.lastError.IsZero() && t.now().Sub(c.lastError) < t.Recent:
+			s.Level = Yellow
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// Pinger is a database that can be pinged, such as *sql.DB.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// PingEvery pings db every interval until ctx is cancelled, recording the
+// outcomes as Database.  Each ping gets at most the interval to answer.
+func (t *Tracker) PingEvery(ctx context.Context, db Pinger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := db.PingContext(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		t.Record(Database, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
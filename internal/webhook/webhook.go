@@ -0,0 +1,202 @@
+// Package webhook delivers events such as summary updates to external
+// systems (e.g. an EHR).  Events are queued in the database once per
+// registered endpoint and sent by a background Dispatcher, so patient
+// requests never wait on a third party.  Each request carries an
+// HMAC-SHA256 signature of the body made with the endpoint's secret.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waitroom-chatbot/pkg"
+)
+
+// Events emitted to webhooks.
+const (
+	EventSummaryUpdated = "summary.updated"
+	EventBudgetExceeded = "llm.budget_exceeded"
+)
+
+// Headers set on every delivery.
+const (
+	HeaderEvent     = "X-Chatdoc-Event"
+	HeaderDelivery  = "X-Chatdoc-Delivery"
+	HeaderSignature = "X-Chatdoc-Signature"
+)
+
+// Store queues and tracks deliveries.
+type Store interface {
+	ListWebhooks(ctx context.Context) ([]pkg.Webhook, error)
+	EnqueueWebhookEvent(ctx context.Context, event string, payload []byte) (int64, error)
+	ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]pkg.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, d *pkg.WebhookDelivery, retryIn time.Duration) error
+}
+
+// Dispatcher queues events and delivers them with exponential backoff.
+type Dispatcher struct {
+	Store  Store
+	Client *http.Client
+	// MaxAttempts is the number of attempts after which a delivery is marked
+	// dead.  Backoff is the delay before the first retry and doubles after
+	// each failure.
+	MaxAttempts int
+	Backoff     time.Duration
+	// PollInterval is how often due deliveries are looked for.
+	PollInterval time.Duration
+}
+
+// NewDispatcher constructs a Dispatcher with eight attempts starting at a
+// 30 second backoff (about two hours in total).
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		Store:        store,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts:  8,
+		Backoff:      30 * time.Second,
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by
+// the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SummaryUpdated queues a summary.updated event for every webhook.
+func (d *Dispatcher) SummaryUpdated(ctx context.Context, s *pkg.Summary) error {
+	payload, err := json.Marshal(struct {
+		Event     string       `json:"event"`
+		SessionID string       `json:"session_id"`
+		Summary   *pkg.Summary `json:"summary"`
+	}{EventSummaryUpdated, s.SessionID, s})
+	if err != nil {
+		return err
+	}
+	_, err = d.Store.EnqueueWebhookEvent(ctx, EventSummaryUpdated, payload)
+	return err
+}
+
+// Publish queues the webhook event for an event from the events outbox
+// (see package outbox).  Kinds webhooks do not carry are ignored.
+func (d *Dispatcher) Publish(ctx context.Context, e pkg.Event) error {
+	if e.Kind != pkg.EventSummaryUpdated {
+		return nil
+	}
+	var s pkg.Summary
+	if err := json.Unmarshal(e.Payload, &s); err != nil {
+		return err
+	}
+	return d.SummaryUpdated(ctx, &s)
+}
+
+// BudgetExceeded queues an llm.budget_exceeded event for every webhook.
+// month is the calendar month ("2006-01") whose estimated spend, cost, has
+// reached budget; both are in US dollars.
+func (d *Dispatcher) BudgetExceeded(ctx context.Context, month string, cost, budget float64) error {
+	payload, err := json.Marshal(struct {
+		Event  string  `json:"event"`
+		Month  string  `json:"month"`
+		Cost   float64 `json:"cost_usd"`
+		Budget float64 `json:"budget_usd"`
+	}{EventBudgetExceeded, month, cost, budget})
+	if err != nil {
+		return err
+	}
+	_, err = d.Store.EnqueueWebhookEvent(ctx, EventBudgetExceeded, payload)
+	return err
+}
+
+// Run delivers due events until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+	for {
+		d.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue sends one batch of due deliveries.
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	deliveries, err := d.Store.ClaimDueWebhookDeliveries(ctx, 20, time.Minute)
+	if err != nil {
+		log.Printf("webhook: claim deliveries: %v", err)
+		return
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	hooks, err := d.Store.ListWebhooks(ctx)
+	if err != nil {
+		log.Printf("webhook: list webhooks: %v", err)
+		return
+	}
+	byID := make(map[int64]pkg.Webhook, len(hooks))
+	for _, h := range hooks {
+		byID[h.ID] = h
+	}
+	for i := range deliveries {
+		del := &deliveries[i]
+		hook, ok := byID[del.WebhookID]
+		if !ok {
+			continue // deleted meanwhile; its deliveries went with it
+		}
+		status, err := d.send(ctx, hook, del)
+		del.Attempts++
+		del.ResponseStatus = status
+		var retryIn time.Duration
+		switch {
+		case err == nil:
+			del.Status, del.LastError = pkg.DeliveryDelivered, ""
+		case del.Attempts >= d.MaxAttempts:
+			del.Status, del.LastError = pkg.DeliveryDead, err.Error()
+			log.Printf("webhook: delivery %d to %s is dead after %d attempts: %v", del.ID, hook.URL, del.Attempts, err)
+		default:
+			del.Status, del.LastError = pkg.DeliveryPending, err.Error()
+			retryIn = d.Backoff << (del.Attempts - 1)
+		}
+		if err := d.Store.RecordWebhookAttempt(ctx, del, retryIn); err != nil {
+			log.Printf("webhook: record delivery %d: %v", del.ID, err)
+		}
+	}
+}
+
+// send POSTs one delivery and returns the response status.
+func (d *Dispatcher) send(ctx context.Context, hook pkg.Webhook, del *pkg.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(del.ID, 10))
+	req.Header.Set(HeaderSignature, Sign(hook.Secret, del.Payload))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,5 @@
+-- Migration: track the intake lifecycle of each session.  Sessions move to
+-- ready_for_doctor once the bot has covered the core intake topics.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'open';
@@ -0,0 +1,15 @@
+-- Migration: per-clinic prompt profiles.  A session may reference a profile
+-- whose prompts replace the built-in constants; empty fields fall back to
+-- the defaults.
+
+CREATE TABLE IF NOT EXISTS prompt_profiles (
+    name                  TEXT PRIMARY KEY,
+    system_prompt         TEXT NOT NULL DEFAULT '',
+    first_message         TEXT NOT NULL DEFAULT '',
+    summarize_instruction TEXT NOT NULL DEFAULT '',
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at            TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS prompt_profile TEXT REFERENCES prompt_profiles(name) ON DELETE SET NULL;
@@ -0,0 +1,9 @@
+-- Migration: store the moderation category of patient messages and flag
+-- sessions that need the doctor's immediate attention.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS moderation_category TEXT;
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS escalated_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS escalation_reason TEXT;
@@ -0,0 +1,8 @@
+-- Migration: remember which transcript produced each summary so unchanged
+-- transcripts are not re-summarised, and let one worker claim a
+-- regeneration so concurrent workers do not both call the LLM.
+
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS transcript_hash TEXT,
+    ADD COLUMN IF NOT EXISTS pending_hash TEXT,
+    ADD COLUMN IF NOT EXISTS pending_at TIMESTAMPTZ;
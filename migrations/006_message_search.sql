@@ -0,0 +1,8 @@
+-- Migration: trigram index backing the doctor message search.  pg_trgm is
+-- used instead of a stemming text search configuration so Persian text
+-- matches as typed.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_messages_content_trgm
+    ON messages USING gin (content gin_trgm_ops);
@@ -0,0 +1,10 @@
+-- Migration: application-level PII encryption.  When PII_ENCRYPTION_KEY is
+-- set, patient name, phone and national ID are stored AES-GCM encrypted and
+-- sessions are looked up by the HMAC of the national ID instead.  Existing
+-- rows are converted with `go run ./cmd/encrypt-pii`.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS patient_national_id_hmac TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_national_id_lookup
+    ON sessions ((COALESCE(patient_national_id_hmac, patient_national_id)), created_at DESC);
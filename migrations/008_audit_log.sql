@@ -0,0 +1,17 @@
+-- Migration: audit log of doctor access to patient data.  session_id is not
+-- a foreign key so entries survive session deletion.
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id          BIGSERIAL PRIMARY KEY,
+    actor       TEXT NOT NULL,
+    action      TEXT NOT NULL,
+    session_id  UUID,
+    request_id  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at
+    ON audit_log (created_at DESC);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_session_id
+    ON audit_log (session_id, created_at DESC);
@@ -0,0 +1,15 @@
+-- Migration: attachments uploaded by patients (prescription photos).  The
+-- file itself lives in the configured storage backend under storage_key.
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id            BIGSERIAL PRIMARY KEY,
+    session_id    UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    message_id    BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    storage_key   TEXT NOT NULL,
+    content_type  TEXT NOT NULL,
+    size_bytes    BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id
+    ON attachments (message_id);
@@ -0,0 +1,6 @@
+-- Migration: triage priority stored with each summary.  Higher values are
+-- more urgent (3 red flag, 2 high pain, 1 long duration, 0 default) and sort
+-- the doctor dashboard.
+
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
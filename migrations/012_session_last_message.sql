@@ -0,0 +1,9 @@
+-- Migration: last_message_at on sessions, maintained by CreateMessage, and
+-- an index on the last activity of open sessions for the inactivity sweeper
+-- that closes idle sessions.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS last_message_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_open_last_activity
+    ON sessions ((COALESCE(last_message_at, created_at))) WHERE closed_at IS NULL;
@@ -0,0 +1,8 @@
+-- Migration: backfill sessions.last_message_at from the messages written
+-- before CreateMessage maintained it.  The dashboard reads the column instead
+-- of computing MAX(messages.created_at) per session.
+
+UPDATE sessions
+SET last_message_at = (SELECT MAX(m.created_at) FROM messages m WHERE m.session_id = sessions.id)
+WHERE last_message_at IS NULL
+  AND EXISTS (SELECT 1 FROM messages m WHERE m.session_id = sessions.id);
@@ -0,0 +1,13 @@
+-- Migration: asynchronous bot replies.  With ASYNC_REPLIES enabled the
+-- message endpoint returns a pending reply at once and the LLM call runs in
+-- the background; the patient's page polls the reply until it is done.
+
+CREATE TABLE IF NOT EXISTS pending_replies (
+    id            UUID PRIMARY KEY,
+    session_id    UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    status        TEXT NOT NULL DEFAULT 'pending',
+    message_id    BIGINT REFERENCES messages(id) ON DELETE SET NULL,
+    error         TEXT,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at  TIMESTAMPTZ
+);
@@ -0,0 +1,9 @@
+-- Migration: typed pain score and symptom duration on summaries, extracted
+-- from the structured summary (or the transcript) so the doctor dashboard
+-- can show them without parsing JSON.
+
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS pain_score INT,
+    ADD COLUMN IF NOT EXISTS pain_score_clamped BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS duration_value INT,
+    ADD COLUMN IF NOT EXISTS duration_unit TEXT;
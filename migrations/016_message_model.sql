@@ -0,0 +1,6 @@
+-- Migration: record the chat model that produced each bot reply, so replies
+-- written by the fallback model (OPENAI_MODEL_CHAT_FALLBACK) can be told
+-- apart.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS model TEXT;
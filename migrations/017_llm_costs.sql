@@ -0,0 +1,12 @@
+-- Migration: running LLM token usage and estimated cost per calendar month
+-- and model, used for the monthly budget guard (LLM_MONTHLY_BUDGET).
+
+CREATE TABLE IF NOT EXISTS llm_costs (
+    month              TEXT NOT NULL,
+    model              TEXT NOT NULL,
+    prompt_tokens      BIGINT NOT NULL DEFAULT 0,
+    completion_tokens  BIGINT NOT NULL DEFAULT 0,
+    cost_usd           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    updated_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (month, model)
+);
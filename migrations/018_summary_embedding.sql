@@ -0,0 +1,7 @@
+-- Migration: store an embedding of each summary (a JSON array of floats) so
+-- a returning patient's most similar past visits can be recalled into the
+-- chat prompt.  Similarity is computed in the application, so pgvector is
+-- not required.
+
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS embedding JSONB;
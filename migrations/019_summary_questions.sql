@@ -0,0 +1,5 @@
+-- Migration: follow-up questions suggested to the doctor for each session,
+-- regenerated whenever the summary is.
+
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS questions JSONB NOT NULL DEFAULT '[]'::jsonb;
@@ -0,0 +1,7 @@
+-- Migration: time taken to produce each bot reply, in total and in the LLM
+-- call, for latency percentiles and slow-reply alerts.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS latency_ms INTEGER;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS llm_latency_ms INTEGER;
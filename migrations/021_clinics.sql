@@ -0,0 +1,20 @@
+-- Migration: clinics sharing one instance.  Existing sessions belong to the
+-- 'default' clinic, so single-clinic deployments are unchanged.
+
+CREATE TABLE IF NOT EXISTS clinics (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    host         TEXT UNIQUE,
+    path_prefix  TEXT UNIQUE,
+    message_cap  INT,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO clinics (id, name) VALUES ('default', 'Default clinic')
+    ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS clinic_id TEXT NOT NULL DEFAULT 'default' REFERENCES clinics(id);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_clinic_open
+    ON sessions (clinic_id) WHERE closed_at IS NULL;
@@ -0,0 +1,5 @@
+-- Migration: 'reviewed' and 'closed' session statuses.  Sessions closed
+-- before CloseSession set the status are marked closed.
+
+UPDATE sessions SET status = 'closed'
+WHERE closed_at IS NOT NULL AND status <> 'closed';
@@ -0,0 +1,5 @@
+-- Migration: the language a patient chose for their session.  Existing
+-- sessions are Persian.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'fa';
@@ -0,0 +1,18 @@
+-- Migration: extra messages granted on top of the message cap, to a patient
+-- or to one session, until they expire.
+
+CREATE TABLE IF NOT EXISTS cap_overrides (
+    id              BIGSERIAL PRIMARY KEY,
+    national_id     TEXT,
+    session_id      UUID REFERENCES sessions(id) ON DELETE CASCADE,
+    extra_messages  INT NOT NULL CHECK (extra_messages > 0),
+    granted_by      TEXT NOT NULL,
+    expires_at      TIMESTAMPTZ NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (national_id IS NOT NULL OR session_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_national_id
+    ON cap_overrides (national_id, expires_at);
+CREATE INDEX IF NOT EXISTS idx_cap_overrides_session
+    ON cap_overrides (session_id, expires_at);
@@ -0,0 +1,6 @@
+-- Migration: sessions keep the message cap in force when they started.
+-- The old default of 50 was never enforced, so existing sessions get 0,
+-- which means "use the current cap".
+
+UPDATE sessions SET message_cap = 0;
+ALTER TABLE sessions ALTER COLUMN message_cap SET DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Migration: patient messages stored after their reply failed, so the
+-- patient can retry the reply without sending the message again.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS unanswered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS retries INT NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Migration: messages redacted by a doctor keep their row, with the
+-- content blanked, for the audit trail.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS redacted_by TEXT;
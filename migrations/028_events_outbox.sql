@@ -0,0 +1,17 @@
+-- Migration: an outbox of session events.  Summary updates record an event
+-- in the same transaction, and a dispatcher publishes it to the dashboard
+-- (NOTIFY) and to webhooks, so no event is lost if the process dies in
+-- between.
+
+CREATE TABLE IF NOT EXISTS events (
+    id               BIGSERIAL PRIMARY KEY,
+    kind             TEXT NOT NULL,
+    session_id       UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    payload          JSONB NOT NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    published_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_unpublished
+    ON events (id) WHERE published_at IS NULL;
@@ -0,0 +1,9 @@
+-- Migration: clinic branding on the start and chat pages.  Clinics without
+-- a display name, logo or accent colour render as before.
+
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS display_name TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS logo_url TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS accent_color TEXT;
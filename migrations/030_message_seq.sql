@@ -0,0 +1,24 @@
+-- Migration: number messages within their session, so transcripts keep
+-- their order when two messages share a timestamp.  Existing messages are
+-- numbered by created_at, then id.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS last_seq INT NOT NULL DEFAULT 0;
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS seq INT;
+DO $$
+BEGIN
+    IF (SELECT is_nullable FROM information_schema.columns
+        WHERE table_name = 'messages' AND column_name = 'seq') = 'YES' THEN
+        UPDATE messages m SET seq = n.seq
+        FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY session_id ORDER BY created_at, id) AS seq
+              FROM messages) n
+        WHERE m.id = n.id;
+        ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+        UPDATE sessions
+        SET last_seq = (SELECT COALESCE(MAX(m.seq), 0) FROM messages m WHERE m.session_id = sessions.id);
+    END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_session_seq
+    ON messages (session_id, seq);
@@ -0,0 +1,16 @@
+-- Migration: anti-abuse on /start.  The denylist holds national IDs (by
+-- lookup key) and client IPs refused a session; sessions now record their
+-- client IP, indexed for the per-IP limit on new sessions.
+
+CREATE TABLE IF NOT EXISTS denylist (
+    id          BIGSERIAL PRIMARY KEY,
+    kind        TEXT NOT NULL CHECK (kind IN ('national_id', 'ip')),
+    value       TEXT NOT NULL,
+    reason      TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (kind, value)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_client_ip
+    ON sessions (client_ip, created_at);
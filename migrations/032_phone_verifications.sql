@@ -0,0 +1,24 @@
+-- Migration: optional verification of the patient's phone number by a code
+-- texted to it before the session is created.
+
+CREATE TABLE IF NOT EXISTS phone_verifications (
+    id           UUID PRIMARY KEY,
+    national_id  TEXT NOT NULL,
+    name         TEXT NOT NULL,
+    phone        TEXT NOT NULL,
+    phone_key    TEXT NOT NULL,
+    clinic_id    TEXT NOT NULL REFERENCES clinics(id),
+    profile      TEXT NOT NULL DEFAULT '',
+    locale       TEXT NOT NULL DEFAULT '',
+    client_ip    INET,
+    code_hash    TEXT NOT NULL,
+    attempts     INT NOT NULL DEFAULT 0,
+    expires_at   TIMESTAMPTZ NOT NULL,
+    verified_at  TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_phone
+    ON phone_verifications (phone_key, created_at);
+CREATE INDEX IF NOT EXISTS idx_phone_verifications_ip
+    ON phone_verifications (client_ip, created_at);
@@ -0,0 +1,23 @@
+-- Migration: raw model input and output of sessions flagged for tracing,
+-- for debugging summaries that contradict the transcript.  Traces are kept
+-- for 30 days.
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS trace_llm BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS llm_traces (
+    id          BIGSERIAL PRIMARY KEY,
+    session_id  UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    kind        TEXT NOT NULL,
+    model       TEXT NOT NULL DEFAULT '',
+    messages    JSONB NOT NULL,
+    response    TEXT NOT NULL DEFAULT '',
+    error       TEXT NOT NULL DEFAULT '',
+    latency_ms  BIGINT NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_traces_session
+    ON llm_traces (session_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_llm_traces_created
+    ON llm_traces (created_at);
@@ -0,0 +1,6 @@
+-- Migration: per-profile reply length limit and simple language setting.
+
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS max_reply_chars INT NOT NULL DEFAULT 0;
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS simple_language BOOLEAN NOT NULL DEFAULT FALSE;
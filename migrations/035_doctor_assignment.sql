@@ -0,0 +1,24 @@
+-- Migration: several doctors per clinic, with sessions assigned to them.
+-- doctors: the doctor logins (DOCTOR_USERS), synced at startup; doctors
+-- no longer configured are kept inactive for their past assignments.
+-- last_assigned_at drives the round-robin assignment of new sessions.
+CREATE TABLE IF NOT EXISTS doctors (
+    id                BIGSERIAL PRIMARY KEY,
+    username          TEXT NOT NULL UNIQUE,
+    clinic_id         TEXT NOT NULL REFERENCES clinics(id),
+    active            BOOLEAN NOT NULL DEFAULT TRUE,
+    last_assigned_at  TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- assigned_doctor_id: the doctor a session is assigned to, by claiming it
+-- on the dashboard or round robin; NULL sessions are everyone's
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS assigned_doctor_id BIGINT REFERENCES doctors(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_sessions_assigned_doctor
+    ON sessions (assigned_doctor_id) WHERE closed_at IS NULL;
+
+-- assignee: the doctor a session was assigned to, on session.assign entries
+ALTER TABLE audit_log
+    ADD COLUMN IF NOT EXISTS assignee TEXT;
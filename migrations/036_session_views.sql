@@ -0,0 +1,10 @@
+-- Migration: remember when each doctor last viewed a session.
+-- session_views: when each doctor last opened a session, to mark the
+-- messages that arrived since in the transcript and count them on the
+-- dashboard.  Doctors are keyed by login name like the audit log.
+CREATE TABLE IF NOT EXISTS session_views (
+    session_id      UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    doctor          TEXT NOT NULL,
+    last_viewed_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (session_id, doctor)
+);
@@ -0,0 +1,11 @@
+-- Migration: let patients edit their last message before the bot replies.
+-- patient_content: the patient message a pending reply answers, stored
+-- with the reply once it is done; patient_edits and messages.edits: the
+-- earlier versions of a patient message the patient edited before the bot
+-- replied, oldest first, as [{"content", "edited_at"}]
+ALTER TABLE pending_replies
+    ADD COLUMN IF NOT EXISTS patient_content TEXT,
+    ADD COLUMN IF NOT EXISTS patient_edits JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS edits JSONB NOT NULL DEFAULT '[]'::jsonb;
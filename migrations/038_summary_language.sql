@@ -0,0 +1,5 @@
+-- Migration: configurable summary language per prompt profile.
+-- summary_language: the language a profile's summaries are written in for
+-- the doctor, e.g. 'en'; '' keeps Persian
+ALTER TABLE prompt_profiles
+    ADD COLUMN IF NOT EXISTS summary_language TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- Migration: record how far patients have read their session.
+-- last_read_seq: the highest seq of the messages the patient's chat page
+-- has shown, reported by its read receipts, for the abandonment stats
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS last_read_seq INT NOT NULL DEFAULT 0;
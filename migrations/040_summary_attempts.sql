@@ -0,0 +1,8 @@
+-- Migration: record the outcome of the latest summary regeneration.
+-- attempt_status, attempt_error, attempted_at: the outcome of the latest
+-- attempt to regenerate the summary ('ok' or 'failed' with the class of the
+-- failure), so the doctor is told when the summary shown is stale
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS attempt_status TEXT,
+    ADD COLUMN IF NOT EXISTS attempt_error TEXT,
+    ADD COLUMN IF NOT EXISTS attempted_at TIMESTAMPTZ;
@@ -0,0 +1,18 @@
+-- Migration: keep per-message details in one JSON column.
+-- metadata: a JSON object of what is known about a message, under the keys
+-- of the pkg.Meta* constants, e.g. the model that wrote a bot reply; the
+-- moderation_category and model columns are moved into it
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+UPDATE messages
+SET metadata = metadata || jsonb_strip_nulls(jsonb_build_object(
+        'moderation_category', moderation_category,
+        'model', model)),
+    moderation_category = NULL,
+    model = NULL
+WHERE moderation_category IS NOT NULL OR model IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_moderation_category
+    ON messages ((metadata->>'moderation_category'))
+    WHERE metadata ? 'moderation_category';
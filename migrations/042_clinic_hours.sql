@@ -0,0 +1,9 @@
+-- Migration: per-clinic operating hours of the chatbot.
+-- operating_hours: the weekly hours the bot answers patients in, e.g.
+-- 'sat-wed 08:00-20:00; thu 08:00-13:00' (see core.ParseOperatingHours);
+-- unset for always.  timezone: the IANA zone the hours are in, Tehran when
+-- unset
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS operating_hours TEXT;
+ALTER TABLE clinics
+    ADD COLUMN IF NOT EXISTS timezone TEXT;
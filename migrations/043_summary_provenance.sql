@@ -0,0 +1,9 @@
+-- Migration: record what generated each summary.
+-- model: the model that wrote the summary, unset when unknown.
+-- schema_version: the version of the structured summary format (see
+-- core.SummarySchemaVersion); summaries stored before it was recorded are
+-- version 1
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS model TEXT;
+ALTER TABLE summaries
+    ADD COLUMN IF NOT EXISTS schema_version INT NOT NULL DEFAULT 1;
@@ -0,0 +1,7 @@
+-- Migration: store the patient message of an async reply at once.
+-- patient_message_id: the patient message a pending reply answers, stored
+-- unanswered when the reply is requested so it counts toward the cap and
+-- shows on reloads; patient_content is only set on replies stored before
+-- it was
+ALTER TABLE pending_replies
+    ADD COLUMN IF NOT EXISTS patient_message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE;
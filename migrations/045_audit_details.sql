@@ -0,0 +1,5 @@
+-- Migration: record what an audited change changed.
+-- details: JSON describing the change of an entry, such as the hashed
+-- identities a session.reassign entry moved the session between
+ALTER TABLE audit_log
+    ADD COLUMN IF NOT EXISTS details TEXT;
@@ -0,0 +1,108 @@
+// Package cursor encodes the keyset cursors of paginated endpoints.
+//
+// A list ordered by a time and then by an ID breaking ties is paged by
+// handing the client the Position of the last item of each page, signed by
+// a Codec.  A cursor is tamper-evident, not opaque: its payload is readable
+// base64 JSON, but one altered or made up by the client fails to decode.
+// The client sends it back to get the next page:
+//
+//	codec := cursor.New(secret)
+//	var after cursor.Position
+//	if v := r.URL.Query().Get("cursor"); v != "" {
+//		if err := codec.Decode(v, &after); err != nil {
+//			// 400 invalid cursor
+//		}
+//	}
+//	items := list(after, limit+1)
+//	page := cursor.Page[Item]{Items: items}
+//	if len(items) > limit {
+//		page.Items = items[:limit]
+//		last := page.Items[limit-1]
+//		page.NextCursor = codec.Encode(cursor.Position{Time: last.UpdatedAt, ID: last.ID})
+//	}
+//
+// A cursor may carry more state than a Position, such as the filters the
+// list was loaded with, by encoding a struct holding both.
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"waitroom-chatbot/pkg/errs"
+)
+
+// ErrInvalid is returned by Decode for a cursor that is malformed or was
+// not encoded with the codec's key.
+var ErrInvalid = errs.New(errs.Invalid, "invalid cursor")
+
+// Position is a place in a list ordered by Time and then by ID: the item
+// the next page starts after.
+type Position struct {
+	Time time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+// IsZero reports whether p is unset, the position before the first page.
+func (p Position) IsZero() bool {
+	return p.Time.IsZero() && p.ID == ""
+}
+
+// Page is the response envelope of a paginated JSON endpoint.  NextCursor
+// is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// macSize is how many bytes of the HMAC-SHA256 of a cursor are kept.
+const macSize = 16
+
+// Codec signs cursors with a secret key.  Cursors encoded with one key do
+// not decode with another, so the key must be shared by every instance
+// serving the same clients and kept across restarts for cursors to outlive
+// them.
+type Codec struct {
+	key []byte
+}
+
+// New returns a codec signing with key.
+func New(key []byte) *Codec {
+	return &Codec{key: append([]byte(nil), key...)}
+}
+
+// Encode returns the cursor of v, a Position or a struct holding one, as
+// URL-safe base64 of its JSON followed by its signature.  It panics when v
+// cannot be marshalled, which is a programming error.
+func (c *Codec) Encode(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic("cursor: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(append(b, c.sign(b)...))
+}
+
+// Decode verifies a cursor returned by Encode and unmarshals it into v.
+func (c *Codec) Decode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) <= macSize {
+		return ErrInvalid
+	}
+	payload, mac := b[:len(b)-macSize], b[len(b)-macSize:]
+	if !hmac.Equal(mac, c.sign(payload)) {
+		return ErrInvalid
+	}
+	if json.Unmarshal(payload, v) != nil {
+		return ErrInvalid
+	}
+	return nil
+}
+
+func (c *Codec) sign(payload []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write(payload)
+	return h.Sum(nil)[:macSize]
+}
@@ -0,0 +1,88 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	c := New([]byte("key"))
+	want := Position{Time: time.Date(2024, 3, 20, 9, 30, 0, 123, time.UTC), ID: "42"}
+	s := c.Encode(want)
+	if strings.ContainsAny(s, "+/=") {
+		t.Errorf("cursor %q is not URL-safe", s)
+	}
+	var got Position
+	if err := c.Decode(s, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Equal(want.Time) || got.ID != want.ID {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+
+	// A cursor may carry more than a Position.
+	type filtered struct {
+		Position
+		Query string `json:"q"`
+	}
+	s = c.Encode(filtered{Position: want, Query: "سردرد"})
+	var f filtered
+	if err := c.Decode(s, &f); err != nil || f.Query != "سردرد" || f.ID != "42" {
+		t.Errorf("decoded %+v, %v", f, err)
+	}
+}
+
+func TestDecodeTampered(t *testing.T) {
+	c := New([]byte("key"))
+	s := c.Encode(Position{Time: time.Now(), ID: "42"})
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The payload is readable, but changing it breaks the signature.
+	payload := raw[:len(raw)-macSize]
+	if !strings.Contains(string(payload), `"id":"42"`) {
+		t.Fatalf("payload %s", payload)
+	}
+	altered := []byte(strings.Replace(string(raw), `"id":"42"`, `"id":"43"`, 1))
+	forged, _ := json.Marshal(Position{ID: "43"})
+
+	tests := []struct {
+		name, cursor string
+	}{
+		{"altered payload", base64.RawURLEncoding.EncodeToString(altered)},
+		{"made-up payload", base64.RawURLEncoding.EncodeToString(append(forged, make([]byte, macSize)...))},
+		{"other key", New([]byte("other")).Encode(Position{ID: "42"})},
+		{"truncated", s[:len(s)-4]},
+		{"signature only", base64.RawURLEncoding.EncodeToString(raw[len(raw)-macSize:])},
+		{"not base64", "!!!"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		var p Position
+		if err := c.Decode(tt.cursor, &p); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: %v, want ErrInvalid", tt.name, err)
+		}
+	}
+}
+
+func TestPageJSON(t *testing.T) {
+	b, err := json.Marshal(Page[int]{Items: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"items":[1,2]}` {
+		t.Errorf("last page %s", b)
+	}
+	b, err = json.Marshal(Page[int]{Items: []int{1}, NextCursor: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"items":[1],"next_cursor":"c"}` {
+		t.Errorf("page %s", b)
+	}
+}
@@ -0,0 +1,115 @@
+// Package errs classifies errors by what went wrong, so the layer that
+// reports an error does not need to know every sentinel of the layers
+// below it.
+//
+// The repository, the core and the LLM clients return errors of a Kind,
+// made with New or Wrap; the HTTP layer maps the kind to a response:
+//
+//	var ErrNoActiveSession = errs.New(errs.NotFound, "no active session")
+//
+//	if err != nil {
+//		return errs.Wrap(errs.Unavailable, err)
+//	}
+//
+//	switch errs.KindOf(err) {
+//	case errs.NotFound:
+//		// 404
+//	}
+//
+// Wrapping keeps the error's chain, so errors.Is and errors.As still find
+// the sentinels and types inside it.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind is the class of an error.
+type Kind uint8
+
+const (
+	// Internal is an unexpected failure, such as a database error; the
+	// kind of errors that have none.
+	Internal Kind = iota
+	// NotFound is a missing resource.
+	NotFound
+	// Invalid is input that cannot be accepted.
+	Invalid
+	// Conflict is a request the current state of the resource does not
+	// allow.
+	Conflict
+	// Unavailable is a dependency, such as the model, failing or turning
+	// the call away; trying again later may succeed.
+	Unavailable
+	// Capped is a limit, such as the message cap, already reached.
+	Capped
+	// Unauthorized is a caller without the right credentials.
+	Unauthorized
+)
+
+var kindNames = [...]string{
+	Internal:     "internal",
+	NotFound:     "not_found",
+	Invalid:      "invalid",
+	Conflict:     "conflict",
+	Unavailable:  "unavailable",
+	Capped:       "capped",
+	Unauthorized: "unauthorized",
+}
+
+// String returns the kind's name, such as "not_found".
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("kind(%d)", k)
+}
+
+// Error is an error of a Kind.
+type Error struct {
+	kind Kind
+	err  error
+}
+
+func (e *Error) Error() string { return e.err.Error() }
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error { return e.err }
+
+// Kind returns the error's kind.
+func (e *Error) Kind() Kind { return e.kind }
+
+// New returns an error of the kind with the message.
+func New(kind Kind, msg string) error {
+	return &Error{kind: kind, err: errors.New(msg)}
+}
+
+// Errorf is like fmt.Errorf, with %w, but returns an error of the kind.
+func Errorf(kind Kind, format string, args ...interface{}) error {
+	return &Error{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+// Wrap returns err as an error of the kind, nil when err is nil.  The
+// kind replaces any err already had.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{kind: kind, err: err}
+}
+
+// KindOf returns the kind of err: that of the outermost error in its
+// chain with a Kind method, Internal when there is none.
+func KindOf(err error) Kind {
+	var k interface{ Kind() Kind }
+	if errors.As(err, &k) {
+		return k.Kind()
+	}
+	return Internal
+}
+
+// Is reports whether err is of the kind.  A nil error is of no kind.
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
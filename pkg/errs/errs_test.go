@@ -0,0 +1,60 @@
+package errs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestKinds(t *testing.T) {
+	tests := []struct {
+		kind Kind
+		name string
+	}{
+		{Internal, "internal"},
+		{NotFound, "not_found"},
+		{Invalid, "invalid"},
+		{Conflict, "conflict"},
+		{Unavailable, "unavailable"},
+		{Capped, "capped"},
+		{Unauthorized, "unauthorized"},
+		{Unauthorized + 1, fmt.Sprintf("kind(%d)", Unauthorized+1)},
+	}
+	for _, tt := range tests {
+		if got := tt.kind.String(); got != tt.name {
+			t.Errorf("Kind(%d).String() = %q, want %q", tt.kind, got, tt.name)
+		}
+		err := New(tt.kind, "boom")
+		if err.Error() != "boom" || KindOf(err) != tt.kind || !Is(err, tt.kind) {
+			t.Errorf("New(%s): %q of kind %s", tt.name, err, KindOf(err))
+		}
+		wrapped := Wrap(tt.kind, io.EOF)
+		if KindOf(wrapped) != tt.kind || !errors.Is(wrapped, io.EOF) || wrapped.Error() != io.EOF.Error() {
+			t.Errorf("Wrap(%s): %q of kind %s", tt.name, wrapped, KindOf(wrapped))
+		}
+		f := Errorf(tt.kind, "read: %w", io.EOF)
+		if KindOf(f) != tt.kind || !errors.Is(f, io.EOF) || f.Error() != "read: EOF" {
+			t.Errorf("Errorf(%s): %q of kind %s", tt.name, f, KindOf(f))
+		}
+		// The outermost kind wins.
+		if k := KindOf(fmt.Errorf("context: %w", Wrap(tt.kind, New(Conflict, "inner")))); k != tt.kind {
+			t.Errorf("KindOf rewrapped %s: %s", tt.name, k)
+		}
+	}
+}
+
+func TestNoKind(t *testing.T) {
+	if k := KindOf(io.EOF); k != Internal {
+		t.Errorf("KindOf plain error = %s, want internal", k)
+	}
+	if Is(nil, Internal) {
+		t.Error("nil is an Internal error")
+	}
+	if KindOf(nil) != Internal {
+		t.Error("KindOf(nil) is not Internal")
+	}
+	if Wrap(NotFound, nil) != nil {
+		t.Error("Wrap(nil) is not nil")
+	}
+}
@@ -1,20 +1,50 @@
 package pkg
 
-import "time"
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
 
 // Session represents a patient visit.  It is keyed by a UUID and
 // optionally includes administrative information supplied by the patient.
 type Session struct {
-	ID           string     `json:"id"`
-	CreatedAt    time.Time  `json:"created_at"`
-	ClosedAt     *time.Time `json:"closed_at,omitempty"`
-	MessageCap   int        `json:"message_cap"`
-	PatientPhone *string    `json:"patient_phone,omitempty"`
-	PatientID    *string    `json:"patient_national_id,omitempty"`
-	ClientIP     *string    `json:"client_ip,omitempty"`
-	UserAgent    *string    `json:"user_agent,omitempty"`
+	ID               string        `json:"id"`
+	CreatedAt        time.Time     `json:"created_at"`
+	ClosedAt         *time.Time    `json:"closed_at,omitempty"`
+	MessageCap       int           `json:"message_cap"` // cap when the session started; 0 for older sessions
+	Status           SessionStatus `json:"status"`
+	PatientName      *string       `json:"patient_name,omitempty"`
+	PatientPhone     *string       `json:"patient_phone,omitempty"`
+	PatientID        *string       `json:"patient_national_id,omitempty"`
+	ClientIP         *string       `json:"client_ip,omitempty"`
+	UserAgent        *string       `json:"user_agent,omitempty"`
+	PromptProfile    *string       `json:"prompt_profile,omitempty"`
+	EscalatedAt      *time.Time    `json:"escalated_at,omitempty"`
+	EscalationReason *string       `json:"escalation_reason,omitempty"`
+	ClinicID         string        `json:"clinic_id"`
+	Locale           string        `json:"locale"`
+	// TraceLLM records the session's model calls as LLMTraces.
+	TraceLLM bool `json:"trace_llm"`
+	// AssignedDoctor is the username of the doctor the session is assigned
+	// to; unassigned sessions are every doctor's of the clinic.
+	AssignedDoctor *string `json:"assigned_doctor,omitempty"`
 }
 
+// SessionStatus tracks where a session is in the intake lifecycle.  A
+// session is open while the bot is still collecting history and becomes
+// ready for the doctor once the core topics have been covered.  The doctor
+// marks it reviewed, and it is closed when the visit ends or the session
+// goes idle.  A patient adding details re-opens a ready or reviewed session.
+type SessionStatus string
+
+const (
+	StatusOpen           SessionStatus = "open"
+	StatusReadyForDoctor SessionStatus = "ready_for_doctor"
+	StatusReviewed       SessionStatus = "reviewed"
+	StatusClosed         SessionStatus = "closed"
+)
+
 // User represents an identified patient. NationalID is the unique identifier
 // provided on the start page. Phone and Name are stored for future sessions.
 type User struct {
@@ -22,6 +52,9 @@ type User struct {
 	Phone      string    `json:"phone"`
 	Name       string    `json:"name"`
 	CreatedAt  time.Time `json:"created_at"`
+	// ClientIP is the address the patient registered from, recorded on a
+	// new session.
+	ClientIP string `json:"-"`
 }
 
 // MessageRole describes who authored a message.  In the MVP there are only
@@ -33,13 +66,93 @@ const (
 	RoleBot     MessageRole = "bot"
 )
 
-// Message represents a chat message for a user identified by national ID.
+// Message represents a chat message within a session.  Seq numbers the
+// messages of a session from 1 in transcript order.  NationalID is a
+// convenience copy of the patient's national ID, filled in only by queries
+// that join the session.
 type Message struct {
-	ID         int64       `json:"id"`
-	NationalID string      `json:"national_id"`
-	Role       MessageRole `json:"role"`
-	Content    string      `json:"content"`
-	CreatedAt  time.Time   `json:"created_at"`
+	ID          int64        `json:"id"`
+	SessionID   string       `json:"session_id"`
+	Seq         int          `json:"seq"`
+	NationalID  string       `json:"national_id,omitempty"`
+	Role        MessageRole  `json:"role"`
+	Content     string       `json:"content"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// RedactedAt and RedactedBy are set on a message a doctor redacted,
+	// whose Content is then empty.
+	RedactedAt *time.Time `json:"redacted_at,omitempty"`
+	RedactedBy string     `json:"redacted_by,omitempty"`
+}
+
+// MessageEdit is an earlier version of a patient message the patient
+// edited before the bot replied.
+type MessageEdit struct {
+	Content  string    `json:"content"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// Keys of the message metadata (see MessageMetadata), with the type of
+// their values.
+const (
+	// MetaModel is the chat model that wrote a bot reply (string); it
+	// differs from the configured one when the fallback model answered.
+	MetaModel = "model"
+	// MetaModerationCategory is the moderation category of a patient
+	// message (string).
+	MetaModerationCategory = "moderation_category"
+	// MetaUsage is the token usage of the LLM call that wrote a bot reply
+	// (MessageUsage).
+	MetaUsage = "usage"
+	// MetaAnswers lists the seqs of the patient messages a coalesced bot
+	// reply answers ([]int).
+	MetaAnswers = "answers"
+	// MetaOpensAt is when the bot answers again, set on a notice sent
+	// outside the clinic's operating hours (time.Time).
+	MetaOpensAt = "opens_at"
+)
+
+// MessageUsage is the token usage stored under MetaUsage.
+type MessageUsage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	Estimated        bool `json:"estimated,omitempty"`
+}
+
+// MessageMetadata is what is known about a message beyond its content, a
+// JSON object whose values are kept encoded.  Keys not listed above, e.g.
+// written by a newer server, are kept as they are.
+type MessageMetadata map[string]json.RawMessage
+
+// Get decodes the value under key into v and reports whether there is one.
+func (m MessageMetadata) Get(key string, v interface{}) (bool, error) {
+	raw, ok := m[key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Set stores v, encoded as JSON, under key.
+func (m MessageMetadata) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m[key] = raw
+	return nil
+}
+
+// Attachment is a file uploaded with a patient message, such as a photo of
+// a medication box.  The file is kept in storage under StorageKey.
+type Attachment struct {
+	ID          int64     `json:"id"`
+	SessionID   string    `json:"session_id"`
+	MessageID   int64     `json:"message_id"`
+	StorageKey  string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 // Summary holds the doctor‑facing summary for a session.  The structured
@@ -52,11 +165,273 @@ type Summary struct {
 	Structured map[string]interface{} `json:"structured"`
 	FreeText   string                 `json:"free_text"`
 	UpdatedAt  time.Time              `json:"updated_at"`
+	// TranscriptHash is the SHA-256 of the transcript the summary was
+	// generated from.
+	TranscriptHash string `json:"transcript_hash,omitempty"`
+	// Priority is the triage score computed with the summary (see
+	// core.ScorePriority); higher is more urgent.
+	Priority int `json:"priority"`
+	// PainScore is the patient's 0-10 pain score and Duration how long the
+	// symptoms have lasted, nil when unknown (see core.ExtractVitals).
+	// PainScoreClamped reports that the score given was outside 0-10.
+	PainScore        *int      `json:"pain_score,omitempty"`
+	PainScoreClamped bool      `json:"pain_score_clamped,omitempty"`
+	Duration         *Duration `json:"duration,omitempty"`
+	// Questions are follow-up questions suggested to the doctor (see
+	// core.SuggestQuestions).
+	Questions []string `json:"suggested_questions,omitempty"`
+	// Embedding is the vector used to recall similar past visits; it is
+	// not part of the API.
+	Embedding []float32 `json:"-"`
+	// LastAttempt is the outcome of the latest attempt to regenerate the
+	// summary, nil before the first.
+	LastAttempt *SummaryAttempt `json:"last_attempt,omitempty"`
+	// Model is the model that generated the summary, empty when unknown
+	// or when it is the fallback written without one.  SchemaVersion is
+	// the version of the structured summary format (see
+	// core.SummarySchemaVersion).
+	Model         string `json:"model,omitempty"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+}
+
+// Summary attempt statuses.
+const (
+	AttemptOK     = "ok"
+	AttemptFailed = "failed"
+)
+
+// SummaryAttempt is the outcome of an attempt to regenerate a summary.
+// Error is the class of a failure, such as "rate_limited" (see
+// core.SummaryErrorClass).  A failed attempt leaves the previous summary in
+// place, except that a response that was not the requested JSON is still
+// stored as free text.
+type SummaryAttempt struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"attempted_at"`
+}
+
+// Stale reports whether the doctor should be warned that the summary may
+// not reflect the conversation: the latest attempt to regenerate it
+// failed, or the patient wrote more than after past its last update.  A
+// summary with no content yet, such as the row of a first regeneration
+// still in progress, is not stale until an attempt fails.
+func (s *Summary) Stale(lastPatientMessage time.Time, after time.Duration) bool {
+	if s.LastAttempt != nil && s.LastAttempt.Status == AttemptFailed {
+		return true
+	}
+	summarised := len(s.KeyPoints) > 0 || s.FreeText != ""
+	return summarised && lastPatientMessage.Sub(s.UpdatedAt) > after
+}
+
+// Duration units.
+const (
+	UnitDay   = "day"
+	UnitWeek  = "week"
+	UnitMonth = "month"
+	UnitYear  = "year"
+)
+
+// Duration is a symptom duration such as three weeks, kept in the unit the
+// patient used.
+type Duration struct {
+	Value int    `json:"value"`
+	Unit  string `json:"unit"`
+}
+
+// durationUnitDays and durationUnitLabels give the length in days and the
+// Persian name of each unit.
+var (
+	durationUnitDays   = map[string]int{UnitDay: 1, UnitWeek: 7, UnitMonth: 30, UnitYear: 365}
+	durationUnitLabels = map[string]string{UnitDay: "روز", UnitWeek: "هفته", UnitMonth: "ماه", UnitYear: "سال"}
+)
+
+// ValidDurationUnit reports whether unit is one of the duration units.
+func ValidDurationUnit(unit string) bool {
+	_, ok := durationUnitDays[unit]
+	return ok
+}
+
+// Days returns the duration in days, counting a month as 30 days.
+func (d Duration) Days() int {
+	return d.Value * durationUnitDays[d.Unit]
+}
+
+// String returns the duration in Persian, e.g. "۳ هفته".
+func (d Duration) String() string {
+	digits := []rune(strconv.Itoa(d.Value))
+	for i, r := range digits {
+		if r >= '0' && r <= '9' {
+			digits[i] = '۰' + (r - '0')
+		}
+	}
+	return string(digits) + " " + durationUnitLabels[d.Unit]
+}
+
+// ClosedSession is a session closed within a digest period, with the triage
+// information the weekly digest reports on.
+type ClosedSession struct {
+	SessionID        string    `json:"session_id"`
+	PatientName      string    `json:"patient_name"`
+	ClosedAt         time.Time `json:"closed_at"`
+	Escalated        bool      `json:"escalated"`
+	EscalationReason string    `json:"escalation_reason,omitempty"`
+	Priority         int       `json:"priority"`
+	KeyPoints        []string  `json:"key_points"`
+}
+
+// Webhook is an outbound endpoint notified when summaries change, e.g. for
+// EHR integration.  Payloads are signed with Secret.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url" validate:"required,max=2048"`
+	Secret    string    `json:"secret,omitempty" validate:"max=256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CapOverride grants a patient, identified by national ID, or a single
+// session ExtraMessages on top of the message cap until ExpiresAt.
+type CapOverride struct {
+	ID            int64     `json:"id"`
+	NationalID    string    `json:"national_id,omitempty" validate:"max=32"`
+	SessionID     string    `json:"session_id,omitempty" validate:"max=36"`
+	ExtraMessages int       `json:"extra_messages" validate:"required"`
+	GrantedBy     string    `json:"granted_by"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PhoneVerification is a start form held back until the patient enters
+// the code texted to User.Phone.
+type PhoneVerification struct {
+	ID        string
+	User      User
+	ClinicID  string
+	Profile   string
+	Locale    string
+	ExpiresAt time.Time
+}
+
+// DenylistKind is what a denylist entry matches.
+type DenylistKind string
+
+const (
+	DenyNationalID DenylistKind = "national_id"
+	DenyIP         DenylistKind = "ip"
+)
+
+// DenylistEntry refuses a session to a national ID or a client IP.  The
+// Value of a national ID entry is its lookup key, which is a hash when PII
+// encryption is enabled, so Reason should say who it is.
+type DenylistEntry struct {
+	ID        int64        `json:"id"`
+	Kind      DenylistKind `json:"kind"`
+	Value     string       `json:"value"`
+	Reason    string       `json:"reason"`
+	CreatedBy string       `json:"created_by"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// DeliveryStatus is the state of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead marks a delivery that exhausted its retries.
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// WebhookDelivery is one event queued for one webhook.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         DeliveryStatus  `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// Event kinds recorded in the events outbox.
+const (
+	EventSummaryUpdated = "summary.updated"
+)
+
+// Event is a change to a session recorded in the events outbox, in the
+// same transaction as the change itself.  IDs increase with every event, so
+// a consumer that has seen event n catches up with the events after it.
+type Event struct {
+	ID        int64  `json:"id"`
+	Kind      string `json:"kind"`
+	SessionID string `json:"session_id"`
+	// Payload is the JSON of what changed, e.g. the summary.
+	Payload     json.RawMessage `json:"-"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at,omitempty"`
+}
+
+// DefaultClinic is the clinic of sessions started without a clinic path
+// prefix or host, and of every session in single-clinic deployments.
+const DefaultClinic = "default"
+
+// Clinic is one clinic sharing the instance.  Patients reach it through
+// PathPrefix ("/north/") or Host; MessageCap, when set, replaces the
+// server's message cap for its patients.
+type Clinic struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	MessageCap *int   `json:"message_cap,omitempty"`
+	// DisplayName, LogoURL (an http(s) URL, a path on this server or a
+	// data:image URI) and AccentColor ("#rrggbb") brand the patient pages;
+	// empty ones keep the default look.
+	DisplayName string `json:"display_name,omitempty"`
+	LogoURL     string `json:"logo_url,omitempty"`
+	AccentColor string `json:"accent_color,omitempty"`
+	// OperatingHours are the weekly hours the bot answers patients in, in
+	// the IANA Timezone (Tehran when empty); empty for always (see
+	// core.ParseOperatingHours).
+	OperatingHours string `json:"operating_hours,omitempty"`
+	Timezone       string `json:"timezone,omitempty"`
+}
+
+// Doctor is a doctor login of a clinic, whom sessions can be assigned to.
+// Doctors removed from the configuration are kept inactive so their past
+// assignments still resolve.
+type Doctor struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	ClinicID string `json:"clinic_id"`
+	Active   bool   `json:"active"`
+}
+
+// PromptProfile customises the intake prompts for a clinic.  Empty fields
+// fall back to the built-in Persian prompts.
+type PromptProfile struct {
+	Name                 string `json:"name" validate:"required,max=64"`
+	SystemPrompt         string `json:"system_prompt"`
+	FirstMessage         string `json:"first_message"`
+	SummarizeInstruction string `json:"summarize_instruction"`
+	// MaxReplyChars limits the length of the bot's replies; zero keeps the
+	// server's default.  SimpleLanguage asks for very plain wording, for
+	// clinics serving patients who may not read well.
+	MaxReplyChars  int  `json:"max_reply_chars"`
+	SimpleLanguage bool `json:"simple_language"`
+	// SummaryLanguage is the code of the language the doctor's summaries
+	// are written in (see core.SummaryLanguages); empty for Persian.
+	SummaryLanguage string    `json:"summary_language,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
 }
 
 // ChatRequest represents a request to send a message from the patient.
 type ChatRequest struct {
-	Content string `json:"content"`
+	Content string `json:"content" validate:"required,max=4000"`
 }
 
 // ChatResponse contains the bot's reply and whether the session is
@@ -64,13 +439,192 @@ type ChatRequest struct {
 type ChatResponse struct {
 	Reply  string `json:"reply"`
 	Capped bool   `json:"capped"`
+	// ResetsAt is when a capped patient can write again, unset when the
+	// cap counts the session.
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+// SearchHit is a message matching a doctor's search, with the session it
+// belongs to and a snippet split around the first match for highlighting.
+type SearchHit struct {
+	Message     Message   `json:"message"`
+	SessionID   string    `json:"session_id"`
+	PatientName string    `json:"patient_name"`
+	SessionAt   time.Time `json:"session_created_at"`
+	Before      string    `json:"before"`
+	Match       string    `json:"match"`
+	After       string    `json:"after"`
+}
+
+// AuditEntry records an access to patient data.  SessionID is empty for
+// actions that are not tied to a single session, such as viewing the
+// dashboard.
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	SessionID string `json:"session_id,omitempty"`
+	RequestID string `json:"request_id"`
+	// Assignee is the doctor a session.assign entry assigned the session to.
+	Assignee string `json:"assignee,omitempty"`
+	// Details is JSON describing the change of the entry, such as the
+	// hashed identities a session.reassign entry moved the session between.
+	Details   string    `json:"details,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows ListAuditEntries.  Zero values do not filter.
+type AuditFilter struct {
+	Actor     string
+	Action    string
+	SessionID string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+// SummaryFilter narrows ListSummaries.  Zero values do not filter.  From
+// and To bound the summaries' update time; AfterUpdatedAt and AfterID are
+// the keyset cursor: only summaries after that position in (UpdatedAt, ID)
+// order are returned.
+type SummaryFilter struct {
+	From           time.Time
+	To             time.Time
+	NationalID     string
+	AfterUpdatedAt time.Time
+	AfterID        int64
+	Limit          int
+}
+
+// SessionSummary is a summary together with the metadata of its session,
+// as listed by the summaries API.  Patient identifiers are left out.
+type SessionSummary struct {
+	Summary
+	SessionCreatedAt time.Time     `json:"session_created_at"`
+	SessionClosedAt  *time.Time    `json:"session_closed_at,omitempty"`
+	Status           SessionStatus `json:"status"`
+	PromptProfile    *string       `json:"prompt_profile,omitempty"`
+	EscalatedAt      *time.Time    `json:"escalated_at,omitempty"`
+	EscalationReason *string       `json:"escalation_reason,omitempty"`
 }
 
 // DoctorSessionPreview is returned in the list of active sessions for the
 // doctor dashboard.  It includes a few key points and the last update time.
 type DoctorSessionPreview struct {
-	SessionID   string    `json:"session_id"`
-	KeyPoints   []string  `json:"key_points"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	LastMessage time.Time `json:"last_message"`
+	SessionID   string        `json:"session_id"`
+	Status      SessionStatus `json:"status"`
+	Escalated   bool          `json:"escalated"`
+	Priority    int           `json:"priority"`
+	PainScore   *int          `json:"pain_score,omitempty"`
+	Duration    *Duration     `json:"duration,omitempty"`
+	KeyPoints   []string      `json:"key_points"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	LastMessage time.Time     `json:"last_message"`
+	AssignedTo  string        `json:"assigned_to,omitempty"`
+	// Unread counts the patient messages since the doctor listing the
+	// session last opened it.
+	Unread int `json:"unread,omitempty"`
+	// SummaryStale reports that the summary may not reflect the
+	// conversation (see Summary.Stale).
+	SummaryStale bool `json:"summary_stale,omitempty"`
+}
+
+// PreviewCursor is the position in the session previews after which the
+// next page starts: the UpdatedAt and SessionID of the last preview seen.
+type PreviewCursor struct {
+	UpdatedAt time.Time
+	SessionID string
+}
+
+// PreviewFilter narrows ListSessionPreviews.  Zero values do not filter.
+// RedFlag keeps the escalated sessions and those whose summary found red
+// flags; From and To bound the session's creation time.  Doctor keeps the
+// sessions assigned to that doctor and the unassigned ones.
+type PreviewFilter struct {
+	Status  SessionStatus
+	RedFlag bool
+	From    time.Time
+	To      time.Time
+	Doctor  int64
+}
+
+// ReplyStatus is the state of a reply generated in the background.
+type ReplyStatus string
+
+const (
+	ReplyPending ReplyStatus = "pending"
+	ReplyDone    ReplyStatus = "done"
+	ReplyFailed  ReplyStatus = "failed"
+	// ReplySuperseded marks a coalesced reply given up for a later one,
+	// which answers its patient messages too, or a reply whose patient
+	// message a retry answered first.
+	ReplySuperseded ReplyStatus = "superseded"
+)
+
+// PendingReply tracks a bot reply generated asynchronously.  Content and
+// Seq are the bot message's once the reply is done; Patient is the patient
+// message it answers, as last edited.
+type PendingReply struct {
+	ID        string      `json:"id"`
+	SessionID string      `json:"session_id"`
+	Status    ReplyStatus `json:"status"`
+	Content   string      `json:"content,omitempty"`
+	Seq       int         `json:"seq,omitempty"`
+	Patient   string      `json:"patient,omitempty"`
+	// PatientMessageID is the patient message the reply answers, stored
+	// unanswered until it is done; 0 for a coalesced reply.
+	PatientMessageID int64     `json:"patient_message_id,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// LLMCost is the token usage and estimated cost of one model in a calendar
+// month ("2006-01").
+type LLMCost struct {
+	Month            string  `json:"month"`
+	Model            string  `json:"model"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost_usd"`
+}
+
+// LatencyStats summarises how long bot replies took in a period, in
+// milliseconds: Total from receiving the patient's message to storing the
+// reply, LLM the part spent generating it.
+type LatencyStats struct {
+	Replies  int   `json:"replies"`
+	TotalP50 int64 `json:"total_p50_ms"`
+	TotalP95 int64 `json:"total_p95_ms"`
+	LLMP50   int64 `json:"llm_p50_ms"`
+	LLMP95   int64 `json:"llm_p95_ms"`
+}
+
+// ReadStats measures abandonment from the chat page's read receipts, over
+// the sessions started in a period that have a bot message: Unanswered
+// counts those whose last message is the bot's, Unread those whose last
+// bot message never showed on the patient's screen.
+type ReadStats struct {
+	Sessions   int `json:"sessions"`
+	Unanswered int `json:"unanswered"`
+	Unread     int `json:"unread"`
+}
+
+// LLMTrace is one model call made for a session flagged for tracing: the
+// messages sent and the raw response, with the patient's identifiers
+// masked, for debugging e.g. a summary that contradicts the transcript.
+type LLMTrace struct {
+	ID        int64          `json:"id"`
+	SessionID string         `json:"session_id"`
+	Call      string         `json:"call"` // chat, chat_stream or summarize
+	Model     string         `json:"model,omitempty"`
+	Messages  []TraceMessage `json:"messages"`
+	Response  string         `json:"response"`
+	Error     string         `json:"error,omitempty"`
+	LatencyMS int64          `json:"latency_ms"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// TraceMessage is a message sent to the model in an LLMTrace.
+type TraceMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
 }
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMessageJSON(t *testing.T) {
+	m := Message{
+		ID:         7,
+		SessionID:  "5f0c4a3e-2b1d-4c8e-9a7f-1e2d3c4b5a69",
+		Seq:        3,
+		NationalID: "0012345678",
+		Role:       RolePatient,
+		Content:    "سردرد دارم",
+		CreatedAt:  time.Date(2024, 3, 20, 9, 30, 0, 0, time.UTC),
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	want := []string{"content", "created_at", "id", "national_id", "role", "seq", "session_id"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %v, want %v", keys, want)
+	}
+	if fields["session_id"] != m.SessionID {
+		t.Errorf("session_id %v, want %s", fields["session_id"], m.SessionID)
+	}
+	var back Message
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, m) {
+		t.Errorf("round trip gave %+v, want %+v", back, m)
+	}
+
+	// Without a joined session the national ID is left out.
+	m.NationalID = ""
+	data, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields = nil
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["national_id"]; ok {
+		t.Errorf("national_id in %s", data)
+	}
+}